@@ -12,6 +12,10 @@ package auth
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc/jose"
 	"github.com/coreos/go-oidc/oidc"
@@ -24,6 +28,8 @@ import (
 type Authenticator struct {
 	bucket          base.Bucket
 	channelComputer ChannelComputer
+	bcryptCost      int    // Cost of new password hashes; 0 means the default
+	guestChannels   uint32 // Max channels the guest user may be granted; 0 means no limit
 }
 
 // Interface for deriving the set of channels and roles a User/Role has access to.
@@ -32,6 +38,7 @@ type ChannelComputer interface {
 	ComputeChannelsForPrincipal(Principal) (ch.TimedSet, error)
 	ComputeRolesForUser(User) (ch.TimedSet, error)
 	UseGlobalSequence() bool
+	LastSequence() (uint64, error)
 }
 
 type userByEmailInfo struct {
@@ -46,6 +53,24 @@ func NewAuthenticator(bucket base.Bucket, channelComputer ChannelComputer) *Auth
 	}
 }
 
+// Sets the bcrypt cost used to hash passwords, which must be valid per ValidateBcryptCost; 0 means
+// the default cost.
+func (auth *Authenticator) SetBcryptCost(cost int) {
+	auth.bcryptCost = cost
+}
+
+// Sets the max number of channels the guest user may be granted; 0 means no limit.
+func (auth *Authenticator) SetGuestChannelLimit(max uint32) {
+	auth.guestChannels = max
+}
+
+func (auth *Authenticator) bcryptCostFactor() int {
+	if auth == nil || auth.bcryptCost == 0 {
+		return kBcryptCostFactor
+	}
+	return auth.bcryptCost
+}
+
 func docIDForUserEmail(email string) string {
 	return "_sync:useremail:" + email
 }
@@ -83,6 +108,12 @@ func (auth *Authenticator) GetUser(name string) (User, error) {
 	return princ.(User), err
 }
 
+// Returns a disabled guest user with no channels, without looking up the guest user's doc.  It
+// stands in for the guest user when guest access to the database is turned off.
+func (auth *Authenticator) DisabledGuestUser() User {
+	return auth.defaultGuestUser()
+}
+
 // Looks up the information for a role.
 func (auth *Authenticator) GetRole(name string) (Role, error) {
 	princ, err := auth.getPrincipal(docIDForRole(name), func() Principal { return &roleImpl{} })
@@ -105,15 +136,17 @@ func (auth *Authenticator) getPrincipal(docID string, factory func() Principal)
 			return nil, err
 		}
 		changed := false
-		if princ.Channels() == nil {
-			// Channel list has been invalidated by a doc update -- rebuild it:
+		now := time.Now()
+		if princ.Channels() == nil || princ.Channels().HasExpired(now) {
+			// Channel list has been invalidated by a doc update, or a time-limited grant has
+			// expired -- rebuild it:
 			if err := auth.rebuildChannels(princ); err != nil {
 				return nil, err
 			}
 			changed = true
 		}
 		if user, ok := princ.(User); ok {
-			if user.RoleNames() == nil {
+			if user.RoleNames() == nil || user.RoleNames().HasExpired(now) {
 				if err := auth.rebuildRoles(user); err != nil {
 					return nil, err
 				}
@@ -161,10 +194,18 @@ func (auth *Authenticator) rebuildChannels(princ Principal) error {
 		}
 		channels.Add(viewChannels)
 	}
+	// expired time-limited grants are treated as absent
+	channels.RemoveExpired(time.Now())
+
+	if _, isUser := princ.(User); isUser && princ.Name() == "" {
+		auth.limitGuestChannels(princ, channels)
+	}
+
 	// always grant access to the public document channel
 	channels.AddChannel(ch.DocumentStarChannel, 1)
 
 	base.LogTo("Access", "Computed channels for %q: %s", princ.Name(), channels)
+	princ.updateRevokedChannels(channels, auth.revocationSequence())
 	princ.SetPreviousChannels(nil)
 	princ.setChannels(channels)
 
@@ -172,6 +213,33 @@ func (auth *Authenticator) rebuildChannels(princ Principal) error {
 
 }
 
+// Drops the guest user's channel grants beyond the configured ceiling.  Its explicit channels
+// have already been checked against it, so it's grants from documents that are dropped, in
+// alphabetical order after the ones that fit.
+func (auth *Authenticator) limitGuestChannels(guest Principal, channels ch.TimedSet) {
+	if auth.guestChannels == 0 || uint32(len(channels)) <= auth.guestChannels {
+		return
+	}
+	explicit := guest.ExplicitChannels()
+	names := make([]string, 0, len(channels))
+	for name := range channels {
+		if _, found := explicit[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	excess := len(channels) - int(auth.guestChannels)
+	if excess > len(names) {
+		excess = len(names)
+	}
+	dropped := names[len(names)-excess:]
+	for _, name := range dropped {
+		delete(channels, name)
+	}
+	base.Warn("Guest user was granted more than %d channels; ignoring grants of %v", auth.guestChannels, dropped)
+	base.StatsExpvars.Add("auth_guestChannelGrantsRejected", int64(len(dropped)))
+}
+
 func (auth *Authenticator) rebuildRoles(user User) error {
 	var roles ch.TimedSet
 	if auth.channelComputer != nil {
@@ -189,12 +257,29 @@ func (auth *Authenticator) rebuildRoles(user User) error {
 	if explicit := user.ExplicitRoles(); explicit != nil {
 		roles.Add(explicit)
 	}
+	roles.RemoveExpired(time.Now())
 
 	base.LogTo("Access", "Computed roles for %q: %s", user.Name(), roles)
+	user.updateRevokedRoles(roles, auth.revocationSequence())
 	user.setRolesSince(roles)
 	return nil
 }
 
+// Returns the sequence to record as the point at which a principal lost access to channels or
+// roles while rebuilding them: the current sequence, which is at or after the change that revoked
+// access.  Returns 0 if revocations can't be tracked (i.e. not using a global sequence.)
+func (auth *Authenticator) revocationSequence() uint64 {
+	if auth.channelComputer == nil || !auth.channelComputer.UseGlobalSequence() {
+		return 0
+	}
+	seq, err := auth.channelComputer.LastSequence()
+	if err != nil {
+		base.Warn("Unable to get the current sequence to record channel revocations: %v", err)
+		return 0
+	}
+	return seq
+}
+
 // Looks up a User by email address.
 func (auth *Authenticator) GetUserByEmail(email string) (User, error) {
 	var info userByEmailInfo
@@ -204,32 +289,67 @@ func (auth *Authenticator) GetUserByEmail(email string) (User, error) {
 	} else if err != nil {
 		return nil, err
 	}
-	return auth.GetUser(info.Username)
+	user, err := auth.GetUser(info.Username)
+	if user != nil && user.Email() != email {
+		return nil, err // Stale mapping, left behind when the user's email changed
+	}
+	return user, err
+}
+
+// Returns a 409 error if the user's email address belongs to a different user.
+func (auth *Authenticator) checkEmailAvailable(user User) error {
+	var info userByEmailInfo
+	_, err := auth.bucket.Get(docIDForUserEmail(user.Email()), &info)
+	if base.IsDocNotFoundError(err) || (err == nil && info.Username == user.Name()) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if owner, err := auth.GetUser(info.Username); err != nil {
+		return err
+	} else if owner != nil && owner.Email() == user.Email() {
+		return base.HTTPErrorf(http.StatusConflict, "Email address is already in use by another user")
+	}
+	return nil
 }
 
-// Saves the information for a user/role.
+// Saves the information for a user/role.  Expired time-limited grants are pruned first.
 func (auth *Authenticator) Save(p Principal) error {
 	if err := p.validate(); err != nil {
 		return err
 	}
+	pruneExpiredGrants(p, time.Now())
 
+	user, isUser := p.(User)
+	if isUser && user.Email() != "" {
+		if err := auth.checkEmailAvailable(user); err != nil {
+			return err
+		}
+	}
 	if err := auth.bucket.Set(p.DocID(), 0, p); err != nil {
 		return err
 	}
-	if user, ok := p.(User); ok {
-		if user.Email() != "" {
-			info := userByEmailInfo{user.Name()}
-			if err := auth.bucket.Set(docIDForUserEmail(user.Email()), 0, info); err != nil {
-				return err
-			}
-			//FIX: Fail if email address is already registered to another user
-			//FIX: Unregister old email address if any
+	if isUser && user.Email() != "" {
+		// An old email address's mapping is left in place; GetUserByEmail ignores it.
+		info := userByEmailInfo{user.Name()}
+		if err := auth.bucket.Set(docIDForUserEmail(user.Email()), 0, info); err != nil {
+			return err
 		}
 	}
 	base.LogTo("Auth", "Saved %s: %s", p.DocID(), p)
 	return nil
 }
 
+// Removes expired time-limited grants from the principal's channels (and roles, for a user).
+func pruneExpiredGrants(p Principal, now time.Time) {
+	if p.Channels().RemoveExpired(now) {
+		base.LogTo("Access", "Pruned expired channel grants of %q", p.Name())
+	}
+	if user, ok := p.(User); ok && user.RoleNames().RemoveExpired(now) {
+		base.LogTo("Access", "Pruned expired role grants of %q", p.Name())
+	}
+}
+
 // Invalidates the channel list of a user/role by saving its Channels() property as nil.
 func (auth *Authenticator) InvalidateChannels(p Principal) error {
 	if p != nil && p.Channels() != nil {
@@ -263,14 +383,19 @@ func (auth *Authenticator) Delete(p Principal) error {
 		if user.Email() != "" {
 			auth.bucket.Delete(docIDForUserEmail(user.Email()))
 		}
+		auth.bucket.Delete(docIDForSessionIndex(user.Name()))
 	}
 	return auth.bucket.Delete(p.DocID())
 }
 
 // Authenticates a user given the username and password.
 // If the username and password are both "", it will return a default empty User object, not nil.
+// If the username contains "@" and isn't the name of a user, it's looked up as an email address.
 func (auth *Authenticator) AuthenticateUser(username string, password string) User {
 	user, _ := auth.GetUser(username)
+	if user == nil && strings.Contains(username, "@") {
+		user, _ = auth.GetUserByEmail(username)
+	}
 	if user == nil || !user.Authenticate(password) {
 		return nil
 	}
@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/couchbaselabs/go.assert"
+	"golang.org/x/crypto/bcrypt"
 
 	"github.com/couchbase/sync_gateway/base"
 	ch "github.com/couchbase/sync_gateway/channels"
@@ -103,6 +104,77 @@ func TestUserPasswords(t *testing.T) {
 	assert.False(t, user.Authenticate("password"))
 }
 
+func TestSetPasswordHash(t *testing.T) {
+	gTestBucket := base.GetBucketOrPanic()
+	auth := NewAuthenticator(gTestBucket, nil)
+	user, _ := auth.NewUser("hashed", "", nil)
+	generation := user.CredentialGeneration()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("letmein"), bcrypt.MinCost)
+	assert.Equals(t, user.SetPasswordHash(hash), nil)
+	assert.True(t, user.Authenticate("letmein"))
+	assert.False(t, user.Authenticate("password"))
+	assert.Equals(t, user.CredentialGeneration(), generation+1)
+
+	assert.True(t, user.SetPasswordHash([]byte("not a hash")) != nil)
+	assert.True(t, user.Authenticate("letmein"))
+}
+
+func TestPasswordRehashOnLogin(t *testing.T) {
+	assert.True(t, ValidateBcryptCost(bcrypt.MinCost) == nil)
+	assert.True(t, ValidateBcryptCost(bcrypt.MaxCost+1) != nil)
+
+	gTestBucket := base.GetBucketOrPanic()
+	auth := NewAuthenticator(gTestBucket, nil)
+	auth.SetBcryptCost(bcrypt.MinCost)
+	user, _ := auth.NewUser("rehashed", "letmein", nil)
+	assert.Equals(t, auth.Save(user), nil)
+	cost, _ := bcrypt.Cost(user.(*userImpl).PasswordHash_)
+	assert.Equals(t, cost, bcrypt.MinCost)
+	generation := user.CredentialGeneration()
+
+	// Raising the cost doesn't stop the old hash from verifying, and upgrades it on login:
+	auth.SetBcryptCost(bcrypt.MinCost + 1)
+	rehashes := base.StatsExpvars.Get("auth_passwordRehashes").String()
+	user, _ = auth.GetUser("rehashed")
+	assert.False(t, user.Authenticate("wrong"))
+	assert.True(t, user.Authenticate("letmein"))
+	assert.False(t, base.StatsExpvars.Get("auth_passwordRehashes").String() == rehashes)
+
+	user, _ = auth.GetUser("rehashed")
+	cost, _ = bcrypt.Cost(user.(*userImpl).PasswordHash_)
+	assert.Equals(t, cost, bcrypt.MinCost+1)
+	assert.Equals(t, user.CredentialGeneration(), generation)
+	assert.True(t, user.Authenticate("letmein"))
+
+	// Lowering it doesn't downgrade existing hashes:
+	auth.SetBcryptCost(bcrypt.MinCost)
+	assert.True(t, user.Authenticate("letmein"))
+	user, _ = auth.GetUser("rehashed")
+	cost, _ = bcrypt.Cost(user.(*userImpl).PasswordHash_)
+	assert.Equals(t, cost, bcrypt.MinCost+1)
+}
+
+func TestPasswordRehashDoesntOverwriteChange(t *testing.T) {
+	gTestBucket := base.GetBucketOrPanic()
+	auth := NewAuthenticator(gTestBucket, nil)
+	auth.SetBcryptCost(bcrypt.MinCost)
+	user, _ := auth.NewUser("rehashrace", "letmein", nil)
+	assert.Equals(t, auth.Save(user), nil)
+
+	// The password is changed after the user was loaded, but before it authenticates:
+	auth.SetBcryptCost(bcrypt.MinCost + 1)
+	staleUser, _ := auth.GetUser("rehashrace")
+	user, _ = auth.GetUser("rehashrace")
+	user.SetPassword("changed")
+	assert.Equals(t, auth.Save(user), nil)
+	assert.True(t, staleUser.Authenticate("letmein"))
+
+	user, _ = auth.GetUser("rehashrace")
+	assert.False(t, user.Authenticate("letmein"))
+	assert.True(t, user.Authenticate("changed"))
+}
+
 // Test that multiple authentications of the same user/password are fast.
 // This is an important check because the underlying bcrypt algorithm used to verify passwords
 // is _extremely_ slow (~100ms!) so we use a cache to speed it up (see password_hash.go).
@@ -226,6 +298,36 @@ func TestUserAccess(t *testing.T) {
 	assert.True(t, user.AuthorizeAnyChannel(ch.SetOf()) == nil)
 }
 
+func TestUserPrefixGrantAccess(t *testing.T) {
+	gTestBucket := base.GetBucketOrPanic()
+	auth := NewAuthenticator(gTestBucket, nil)
+	user, _ := auth.NewUser("foo", "password", nil)
+	user.setChannels(ch.TimedSet{"x": ch.NewVbSimpleSequence(1), "tenant-123-*": ch.NewVbSimpleSequence(5)})
+
+	assert.True(t, user.CanSeeChannel("tenant-123-orders"))
+	assert.False(t, user.CanSeeChannel("tenant-456-orders"))
+	assert.Equals(t, user.CanSeeChannelSince("tenant-123-orders"), uint64(5))
+	assert.Equals(t, user.CanSeeChannelSince("x"), uint64(1))
+	assert.True(t, user.AuthorizeAllChannels(ch.SetOf("x", "tenant-123-orders", "tenant-123-users")) == nil)
+	assert.False(t, user.AuthorizeAllChannels(ch.SetOf("x", "tenant-456-orders")) == nil)
+	assert.True(t, user.AuthorizeAnyChannel(ch.SetOf("y", "tenant-123-users")) == nil)
+}
+
+func TestGuestChannelLimit(t *testing.T) {
+	gTestBucket := base.GetBucketOrPanic()
+	computer := mockComputer{channels: ch.AtSequence(ch.SetOf("derived1", "derived2", "derived3"), 1)}
+	auth := NewAuthenticator(gTestBucket, &computer)
+	auth.SetGuestChannelLimit(3)
+
+	// The guest keeps its explicit channels, and the grants that fit under the limit:
+	guest, _ := auth.NewUser("", "", ch.SetOf("explicit1"))
+	assert.DeepEquals(t, guest.Channels().AsSet(), ch.SetOf("!", "explicit1", "derived1", "derived2"))
+
+	// Other users aren't limited:
+	user, _ := auth.NewUser("unlimited", "password", ch.SetOf("explicit1"))
+	assert.Equals(t, len(user.Channels()), 5)
+}
+
 func TestGetMissingUser(t *testing.T) {
 	gTestBucket := base.GetBucketOrPanic()
 	auth := NewAuthenticator(gTestBucket, nil)
@@ -282,6 +384,7 @@ type mockComputer struct {
 	channels     ch.TimedSet
 	roles        ch.TimedSet
 	roleChannels ch.TimedSet
+	lastSequence uint64
 	err          error
 }
 
@@ -304,6 +407,10 @@ func (self *mockComputer) UseGlobalSequence() bool {
 	return true
 }
 
+func (self *mockComputer) LastSequence() (uint64, error) {
+	return self.lastSequence, nil
+}
+
 func TestRebuildUserChannels(t *testing.T) {
 	gTestBucket := base.GetBucketOrPanic()
 	computer := mockComputer{channels: ch.AtSequence(ch.SetOf("derived1", "derived2"), 1)}
@@ -318,6 +425,33 @@ func TestRebuildUserChannels(t *testing.T) {
 	assert.DeepEquals(t, user2.Channels(), ch.AtSequence(ch.SetOf("explicit1", "derived1", "derived2", "!"), 1))
 }
 
+func TestRebuildUserChannelsRevocation(t *testing.T) {
+	gTestBucket := base.GetBucketOrPanic()
+	computer := mockComputer{channels: ch.AtSequence(ch.SetOf("derived1", "derived2"), 2)}
+	auth := NewAuthenticator(gTestBucket, &computer)
+	user, _ := auth.NewUser("revokedUser", "password", ch.SetOf("explicit1"))
+	user.setChannels(nil)
+	assert.Equals(t, auth.Save(user), nil)
+	user, _ = auth.GetUser("revokedUser")
+	assert.Equals(t, len(user.RevokedChannels()), 0)
+
+	// Losing a channel records the sequences of the grant and of the revocation:
+	computer.channels = ch.AtSequence(ch.SetOf("derived1"), 2)
+	computer.lastSequence = 10
+	assert.Equals(t, auth.InvalidateChannels(user), nil)
+	user2, err := auth.GetUser("revokedUser")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, user2.CanSeeChannel("derived2"), false)
+	assert.DeepEquals(t, user2.RevokedChannels(), RevokedChannels{"derived2": {GrantedSeq: 2, RevokedSeq: 10}})
+
+	// The revocation survives further rebuilds:
+	computer.lastSequence = 12
+	assert.Equals(t, auth.InvalidateChannels(user2), nil)
+	user3, err := auth.GetUser("revokedUser")
+	assert.Equals(t, err, nil)
+	assert.DeepEquals(t, user3.RevokedChannels(), RevokedChannels{"derived2": {GrantedSeq: 2, RevokedSeq: 10}})
+}
+
 func TestRebuildRoleChannels(t *testing.T) {
 	gTestBucket := base.GetBucketOrPanic()
 	computer := mockComputer{roleChannels: ch.AtSequence(ch.SetOf("derived1", "derived2"), 1)}
@@ -422,6 +556,38 @@ func TestRegisterUser(t *testing.T) {
 	assert.Equals(t, err, nil)
 }
 
+func TestAuthenticateUserByEmail(t *testing.T) {
+	gTestBucket := base.GetBucketOrPanic()
+	auth := NewAuthenticator(gTestBucket, nil)
+	user, _ := auth.NewUser("alice", "password", nil)
+	assert.Equals(t, user.SetEmail("alice@example.com"), nil)
+	assert.Equals(t, auth.Save(user), nil)
+
+	user = auth.AuthenticateUser("alice@example.com", "password")
+	assert.True(t, user != nil)
+	assert.Equals(t, user.Name(), "alice")
+	assert.True(t, auth.AuthenticateUser("alice@example.com", "wrong") == nil)
+
+	// Another user can't claim the same address:
+	other, _ := auth.NewUser("mallory", "password", nil)
+	assert.Equals(t, other.SetEmail("alice@example.com"), nil)
+	err := auth.Save(other)
+	assert.True(t, err != nil)
+	httpErr, ok := err.(*base.HTTPError)
+	assert.True(t, ok)
+	assert.Equals(t, httpErr.Status, 409)
+
+	// Once alice changes address, the old one no longer logs in, and is free to be claimed:
+	assert.Equals(t, user.SetEmail("alice@example.org"), nil)
+	assert.Equals(t, auth.Save(user), nil)
+	assert.True(t, auth.AuthenticateUser("alice@example.com", "password") == nil)
+	assert.True(t, auth.AuthenticateUser("alice@example.org", "password") != nil)
+	assert.Equals(t, auth.Save(other), nil)
+	user = auth.AuthenticateUser("alice@example.com", "password")
+	assert.True(t, user != nil)
+	assert.Equals(t, user.Name(), "mallory")
+}
+
 // 8 cases
 // C: Channel grant
 // R: Role grant
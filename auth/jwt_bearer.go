@@ -0,0 +1,408 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+)
+
+const (
+	DefaultJWTUsernameClaim    = "sub"
+	DefaultJWTCacheTTL         = 30 * time.Second // How long a validated token is trusted without re-verifying
+	DefaultJWKSRefreshInterval = time.Hour        // How often the JWKS is re-fetched
+	minJWKSRefreshInterval     = 10 * time.Second // Limits re-fetches triggered by unknown key IDs
+	maxJWTCacheEntries         = 10000
+)
+
+// Config for authenticating requests that present a JWT issued by an external identity provider
+// in an "Authorization: Bearer" header.  Tokens are signed either with a shared secret (HS256) or
+// with a key from the provider's JSON Web Key Set (RS256).
+type JWTBearerOptions struct {
+	Issuer          string   `json:"issuer"`                      // Required "iss" claim
+	Audience        string   `json:"audience"`                    // Required "aud" claim
+	Secret          *string  `json:"secret,omitempty"`            // Shared secret of HS256-signed tokens
+	JWKSURL         *string  `json:"jwks_url,omitempty"`          // URL of the JSON Web Key Set of RS256-signed tokens
+	JWKSRefreshSecs *uint32  `json:"jwks_refresh_secs,omitempty"` // How often the JWKS is re-fetched; defaults to an hour
+	UsernameClaim   string   `json:"username_claim,omitempty"`    // Claim mapped to the user name: "sub" (default) or "email"
+	Register        bool     `json:"register,omitempty"`          // If true, users that don't exist are created
+	Channels        []string `json:"channels,omitempty"`          // Channels of registered users; "{{claim}}" is replaced by the claim's value(s)
+	CacheSecs       *uint32  `json:"cache_secs,omitempty"`        // How long a validated token is cached; defaults to 30 seconds
+}
+
+// Validates bearer JWTs according to a JWTBearerOptions, caching the signing keys and the results.
+type JWTBearerAuth struct {
+	options         JWTBearerOptions
+	cacheTTL        time.Duration
+	refreshInterval time.Duration
+	lock            sync.Mutex
+	validated       map[string]jwtCacheEntry  // Validated tokens, keyed by SHA-256 hash of the token
+	keys            map[string]*rsa.PublicKey // JWKS keys, by key ID
+	keysFetched     time.Time
+	fetchingKeys    chan struct{} // Closed when the JWKS fetch in progress finishes; nil if there isn't one
+}
+
+type jwtCacheEntry struct {
+	username string
+	expires  time.Time
+}
+
+var jwtChannelTemplateRegexp = regexp.MustCompile(`{{\s*(\w+)\s*}}`)
+
+// Creates a JWTBearerAuth, after checking that the options are usable.
+func NewJWTBearerAuth(options JWTBearerOptions) (*JWTBearerAuth, error) {
+	if options.Issuer == "" || options.Audience == "" {
+		return nil, errors.New("JWT issuer and audience are required")
+	}
+	if (options.Secret == nil) == (options.JWKSURL == nil) {
+		return nil, errors.New("JWT config requires exactly one of secret and jwks_url")
+	}
+	switch options.UsernameClaim {
+	case "":
+		options.UsernameClaim = DefaultJWTUsernameClaim
+	case "sub", "email":
+	default:
+		return nil, fmt.Errorf("Invalid JWT username_claim %q; must be \"sub\" or \"email\"", options.UsernameClaim)
+	}
+	bearer := &JWTBearerAuth{
+		options:         options,
+		cacheTTL:        DefaultJWTCacheTTL,
+		refreshInterval: DefaultJWKSRefreshInterval,
+		validated:       make(map[string]jwtCacheEntry),
+	}
+	if options.CacheSecs != nil {
+		bearer.cacheTTL = time.Duration(*options.CacheSecs) * time.Second
+	}
+	if options.JWKSRefreshSecs != nil {
+		bearer.refreshInterval = time.Duration(*options.JWKSRefreshSecs) * time.Second
+	}
+	return bearer, nil
+}
+
+// Returns true if the token claims to be from this issuer.  (Doesn't validate it.)
+func (bearer *JWTBearerAuth) IsIssuerOf(token string) bool {
+	jwt, err := jose.ParseJWT(token)
+	if err != nil {
+		return false
+	}
+	claims, err := jwt.Claims()
+	if err != nil {
+		return false
+	}
+	iss, _, _ := claims.StringClaim("iss")
+	return iss == bearer.options.Issuer
+}
+
+// Authenticates a request's bearer JWT, returning the user it maps to.  If the user doesn't exist
+// and the config allows registration, the user is created.  Returns an error if the token is
+// invalid or expired, or doesn't map to a user.
+func (auth *Authenticator) AuthenticateBearerJWT(token string, bearer *JWTBearerAuth) (User, error) {
+	username, err := bearer.validate(token)
+	if err != nil {
+		base.LogTo("Auth+", "Invalid bearer JWT: %v", err)
+		return nil, err
+	}
+	user, err := auth.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		if !bearer.options.Register {
+			return nil, fmt.Errorf("No user %q for bearer JWT", username)
+		}
+		claims, err := bearer.claims(token)
+		if err != nil {
+			return nil, err
+		}
+		if user, err = auth.registerJWTUser(username, claims, bearer.options); err != nil {
+			return nil, err
+		}
+	}
+	if user.Disabled() {
+		return nil, fmt.Errorf("User %q is disabled", username)
+	}
+	return user, nil
+}
+
+func (auth *Authenticator) registerJWTUser(username string, claims jose.Claims, options JWTBearerOptions) (User, error) {
+	channels, err := ch.SetFromArray(jwtChannels(options.Channels, claims), ch.RemoveStar)
+	if err != nil {
+		return nil, err
+	}
+	base.LogTo("Auth", "Registering new user %q from bearer JWT, with channels %v", username, channels)
+	user, err := auth.NewUser(username, base.GenerateRandomSecret(), channels)
+	if err != nil {
+		return nil, err
+	}
+	if email, ok, _ := claims.StringClaim("email"); ok {
+		if err := user.SetEmail(email); err != nil {
+			base.Warn("Unable to set email %q of user %q from bearer JWT: %v", email, username, err)
+		}
+	}
+	if err := auth.Save(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Expands the channel templates with the values of the claims they refer to.  A claim whose value
+// is an array of strings expands to one channel per string; a template referring to a missing
+// claim is skipped.
+func jwtChannels(templates []string, claims jose.Claims) []string {
+	var result []string
+	for _, template := range templates {
+		expansions := []string{template}
+		for _, match := range jwtChannelTemplateRegexp.FindAllStringSubmatch(template, -1) {
+			var values []string
+			if value, ok, _ := claims.StringClaim(match[1]); ok {
+				values = []string{value}
+			} else if value, ok, _ := claims.StringsClaim(match[1]); ok {
+				values = value
+			}
+			var next []string
+			for _, expansion := range expansions {
+				for _, value := range values {
+					next = append(next, strings.Replace(expansion, match[0], value, 1))
+				}
+			}
+			expansions = next
+		}
+		result = append(result, expansions...)
+	}
+	return result
+}
+
+// Validates the token's signature and claims, returning the user name it maps to.  Results are
+// cached (until the cache TTL or the token's expiry, whichever comes first) so a client's repeated
+// requests don't each pay for a signature check.
+func (bearer *JWTBearerAuth) validate(token string) (string, error) {
+	hash := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(hash[:])
+	now := time.Now()
+
+	bearer.lock.Lock()
+	entry, found := bearer.validated[key]
+	bearer.lock.Unlock()
+	if found && now.Before(entry.expires) {
+		return entry.username, nil
+	}
+
+	jwt, err := jose.ParseJWT(token)
+	if err != nil {
+		return "", err
+	}
+	if err := bearer.verifySignature(jwt); err != nil {
+		return "", err
+	}
+	claims, err := jwt.Claims()
+	if err != nil {
+		return "", err
+	}
+	expiry, err := bearer.verifyClaims(claims, now)
+	if err != nil {
+		return "", err
+	}
+	username, ok, err := claims.StringClaim(bearer.options.UsernameClaim)
+	if err != nil || !ok || username == "" {
+		return "", fmt.Errorf("Missing %q claim", bearer.options.UsernameClaim)
+	}
+
+	entry = jwtCacheEntry{username: username, expires: now.Add(bearer.cacheTTL)}
+	if expiry.Before(entry.expires) {
+		entry.expires = expiry
+	}
+	bearer.lock.Lock()
+	if len(bearer.validated) >= maxJWTCacheEntries {
+		for k, e := range bearer.validated {
+			if !now.Before(e.expires) {
+				delete(bearer.validated, k)
+			}
+		}
+		if len(bearer.validated) >= maxJWTCacheEntries {
+			bearer.validated = make(map[string]jwtCacheEntry)
+		}
+	}
+	bearer.validated[key] = entry
+	bearer.lock.Unlock()
+	return username, nil
+}
+
+// Returns the claims of a token that has already been validated.
+func (bearer *JWTBearerAuth) claims(token string) (jose.Claims, error) {
+	jwt, err := jose.ParseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	return jwt.Claims()
+}
+
+func (bearer *JWTBearerAuth) verifyClaims(claims jose.Claims, now time.Time) (time.Time, error) {
+	if iss, _, _ := claims.StringClaim("iss"); iss != bearer.options.Issuer {
+		return time.Time{}, fmt.Errorf("Unexpected issuer %q", iss)
+	}
+	audienceOK := false
+	if aud, ok, _ := claims.StringClaim("aud"); ok {
+		audienceOK = aud == bearer.options.Audience
+	} else if auds, ok, _ := claims.StringsClaim("aud"); ok {
+		for _, aud := range auds {
+			audienceOK = audienceOK || aud == bearer.options.Audience
+		}
+	}
+	if !audienceOK {
+		return time.Time{}, errors.New("Token is not for this audience")
+	}
+	expiry, ok, err := claims.TimeClaim("exp")
+	if err != nil || !ok {
+		return time.Time{}, errors.New("Missing or invalid \"exp\" claim")
+	} else if !now.Before(expiry) {
+		return time.Time{}, errors.New("Token has expired")
+	}
+	if notBefore, ok, _ := claims.TimeClaim("nbf"); ok && now.Before(notBefore) {
+		return time.Time{}, errors.New("Token is not valid yet")
+	}
+	return expiry, nil
+}
+
+func (bearer *JWTBearerAuth) verifySignature(jwt jose.JWT) error {
+	data := []byte(jwt.Data())
+	alg := jwt.Header[jose.HeaderKeyAlgorithm]
+	if bearer.options.Secret != nil {
+		if alg != "HS256" {
+			return fmt.Errorf("Unexpected signing algorithm %q", alg)
+		}
+		mac := hmac.New(sha256.New, []byte(*bearer.options.Secret))
+		mac.Write(data)
+		if !hmac.Equal(mac.Sum(nil), jwt.Signature) {
+			return errors.New("Invalid signature")
+		}
+		return nil
+	}
+
+	if alg != "RS256" {
+		return fmt.Errorf("Unexpected signing algorithm %q", alg)
+	}
+	publicKey, err := bearer.getKey(jwt.Header[jose.HeaderKeyID])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], jwt.Signature)
+}
+
+// Returns the JWKS key with the given ID, re-fetching the key set if it's stale or doesn't have
+// the key (as happens after the provider rotates its keys.)  The key set is fetched without holding
+// the lock, and only once at a time: meanwhile, other callers use the cached key if there is one,
+// or else wait for the fetch.
+func (bearer *JWTBearerAuth) getKey(keyID string) (*rsa.PublicKey, error) {
+	bearer.lock.Lock()
+	age := time.Since(bearer.keysFetched)
+	publicKey := bearer.keys[keyID]
+	if age > bearer.refreshInterval || (publicKey == nil && age > minJWKSRefreshInterval) {
+		if fetching := bearer.fetchingKeys; fetching != nil {
+			bearer.lock.Unlock()
+			if publicKey == nil {
+				<-fetching
+				bearer.lock.Lock()
+				publicKey = bearer.keys[keyID]
+				bearer.lock.Unlock()
+			}
+		} else {
+			fetching = make(chan struct{})
+			bearer.fetchingKeys = fetching
+			bearer.lock.Unlock()
+
+			keys, err := fetchJWKS(*bearer.options.JWKSURL)
+
+			bearer.lock.Lock()
+			if err == nil {
+				bearer.keys = keys
+				bearer.keysFetched = time.Now()
+				publicKey = keys[keyID]
+			}
+			bearer.fetchingKeys = nil
+			close(fetching)
+			bearer.lock.Unlock()
+			if err != nil {
+				if publicKey == nil {
+					return nil, err
+				}
+				base.Warn("Unable to refresh JWKS from %s; using cached keys: %v", *bearer.options.JWKSURL, err)
+			}
+		}
+	} else {
+		bearer.lock.Unlock()
+	}
+	if publicKey == nil {
+		return nil, fmt.Errorf("Unknown signing key %q", keyID)
+	}
+	return publicKey, nil
+}
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// Fetches a JSON Web Key Set, returning its RSA signing keys.
+func fetchJWKS(url string) (map[string]*rsa.PublicKey, error) {
+	response, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS request returned status %d", response.StatusCode)
+	}
+	var keySet struct {
+		Keys []struct {
+			KeyType  string `json:"kty"`
+			KeyID    string `json:"kid"`
+			Use      string `json:"use"`
+			Modulus  string `json:"n"`
+			Exponent string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&keySet); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey, len(keySet.Keys))
+	for _, key := range keySet.Keys {
+		if key.KeyType != "RSA" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.Modulus)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid modulus of JWKS key %q: %v", key.KeyID, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.Exponent)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid exponent of JWKS key %q: %v", key.KeyID, err)
+		}
+		keys[key.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
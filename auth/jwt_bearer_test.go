@@ -0,0 +1,227 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func makeTestJWT(header, claims map[string]interface{}, sign func(data []byte) []byte) string {
+	headerJSON, _ := json.Marshal(header)
+	claimsJSON, _ := json.Marshal(claims)
+	data := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	return data + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(data)))
+}
+
+func makeHS256JWT(secret string, claims map[string]interface{}) string {
+	return makeTestJWT(map[string]interface{}{"alg": "HS256", "typ": "JWT"}, claims, func(data []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(data)
+		return mac.Sum(nil)
+	})
+}
+
+func testJWTClaims(sub string, expiry time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss": "https://idp.example.com",
+		"aud": "sync_gateway",
+		"sub": sub,
+		"exp": expiry.Unix(),
+	}
+}
+
+func TestBearerJWTSharedSecret(t *testing.T) {
+	gTestBucket := base.GetBucketOrPanic()
+	auth := NewAuthenticator(gTestBucket, nil)
+	secret := "s3cr3t"
+	bearer, err := NewJWTBearerAuth(JWTBearerOptions{
+		Issuer:   "https://idp.example.com",
+		Audience: "sync_gateway",
+		Secret:   &secret,
+		Register: true,
+		Channels: []string{"user-{{sub}}", "team-{{teams}}", "org-{{org}}"},
+	})
+	assert.Equals(t, err, nil)
+
+	// A valid token registers the user, with channels expanded from the claims:
+	claims := testJWTClaims("jwtuser", time.Now().Add(time.Hour))
+	claims["teams"] = []string{"red", "blue"}
+	claims["email"] = "jwtuser@example.com"
+	user, err := auth.AuthenticateBearerJWT(makeHS256JWT(secret, claims), bearer)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, user.Name(), "jwtuser")
+	assert.Equals(t, user.Email(), "jwtuser@example.com")
+	assert.True(t, user.CanSeeChannel("user-jwtuser"))
+	assert.True(t, user.CanSeeChannel("team-red"))
+	assert.True(t, user.CanSeeChannel("team-blue"))
+	assert.Equals(t, len(user.ExplicitChannels()), 3) // org-{{org}} was skipped
+
+	// Bad signature, expired, wrong audience, and wrong issuer are rejected:
+	_, err = auth.AuthenticateBearerJWT(makeHS256JWT("wrong", testJWTClaims("jwtuser", time.Now().Add(time.Hour))), bearer)
+	assert.True(t, err != nil)
+	_, err = auth.AuthenticateBearerJWT(makeHS256JWT(secret, testJWTClaims("jwtuser", time.Now().Add(-time.Minute))), bearer)
+	assert.True(t, err != nil)
+	claims = testJWTClaims("jwtuser", time.Now().Add(time.Hour))
+	claims["aud"] = "someone_else"
+	_, err = auth.AuthenticateBearerJWT(makeHS256JWT(secret, claims), bearer)
+	assert.True(t, err != nil)
+	claims = testJWTClaims("jwtuser", time.Now().Add(time.Hour))
+	claims["iss"] = "https://evil.example.com"
+	_, err = auth.AuthenticateBearerJWT(makeHS256JWT(secret, claims), bearer)
+	assert.True(t, err != nil)
+
+	// An unsigned token is rejected:
+	unsigned := makeTestJWT(map[string]interface{}{"alg": "none"}, testJWTClaims("jwtuser", time.Now().Add(time.Hour)),
+		func([]byte) []byte { return nil })
+	_, err = auth.AuthenticateBearerJWT(unsigned, bearer)
+	assert.True(t, err != nil)
+
+	// Validation results are cached by token, but expire with the token:
+	token := makeHS256JWT(secret, testJWTClaims("jwtuser", time.Now().Add(time.Second)))
+	_, err = auth.AuthenticateBearerJWT(token, bearer)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(bearer.validated), 2)
+	time.Sleep(1100 * time.Millisecond)
+	_, err = auth.AuthenticateBearerJWT(token, bearer)
+	assert.True(t, err != nil)
+}
+
+func TestBearerJWTWithJWKS(t *testing.T) {
+	gTestBucket := base.GetBucketOrPanic()
+	auth := NewAuthenticator(gTestBucket, nil)
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equals(t, err, nil)
+
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"key1","use":"sig","n":%q,"e":%q}]}`,
+			base64.RawURLEncoding.EncodeToString(privateKey.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.E)).Bytes()))
+	}))
+	defer server.Close()
+
+	jwksURL := server.URL
+	bearer, err := NewJWTBearerAuth(JWTBearerOptions{
+		Issuer:        "https://idp.example.com",
+		Audience:      "sync_gateway",
+		JWKSURL:       &jwksURL,
+		UsernameClaim: "email",
+	})
+	assert.Equals(t, err, nil)
+
+	signRS256 := func(kid string, claims map[string]interface{}) string {
+		return makeTestJWT(map[string]interface{}{"alg": "RS256", "kid": kid}, claims, func(data []byte) []byte {
+			digest := sha256.Sum256(data)
+			sig, _ := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+			return sig
+		})
+	}
+
+	// Users aren't registered unless the config allows it:
+	claims := testJWTClaims("12345", time.Now().Add(time.Hour))
+	claims["email"] = "jwks@example.com"
+	_, err = auth.AuthenticateBearerJWT(signRS256("key1", claims), bearer)
+	assert.True(t, err != nil)
+	assert.Equals(t, fetches, 1)
+
+	newUser, _ := auth.NewUser("jwks@example.com", "password", nil)
+	assert.Equals(t, auth.Save(newUser), nil)
+	user, err := auth.AuthenticateBearerJWT(signRS256("key1", claims), bearer)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, user.Name(), "jwks@example.com")
+	assert.Equals(t, fetches, 1) // The key set is cached
+
+	// An HS256 token signed with the public key is rejected:
+	hsToken := makeHS256JWT(string(privateKey.N.Bytes()), claims)
+	_, err = auth.AuthenticateBearerJWT(hsToken, bearer)
+	assert.True(t, err != nil)
+
+	// An unknown key ID doesn't re-fetch the key set more often than the minimum interval:
+	_, err = auth.AuthenticateBearerJWT(signRS256("key2", claims), bearer)
+	assert.True(t, err != nil)
+	assert.Equals(t, fetches, 1)
+}
+
+func TestBearerJWTOptionsValidation(t *testing.T) {
+	secret := "secret"
+	url := "https://idp.example.com/jwks"
+	_, err := NewJWTBearerAuth(JWTBearerOptions{Audience: "sync_gateway", Secret: &secret})
+	assert.True(t, err != nil)
+	_, err = NewJWTBearerAuth(JWTBearerOptions{Issuer: "idp", Audience: "sync_gateway"})
+	assert.True(t, err != nil)
+	_, err = NewJWTBearerAuth(JWTBearerOptions{Issuer: "idp", Audience: "sync_gateway", Secret: &secret, JWKSURL: &url})
+	assert.True(t, err != nil)
+	_, err = NewJWTBearerAuth(JWTBearerOptions{Issuer: "idp", Audience: "sync_gateway", Secret: &secret, UsernameClaim: "name"})
+	assert.True(t, err != nil)
+	bearer, err := NewJWTBearerAuth(JWTBearerOptions{Issuer: "idp", Audience: "sync_gateway", Secret: &secret})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, bearer.options.UsernameClaim, "sub")
+}
+
+func TestJWKSFetchedOnceAtATime(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equals(t, err, nil)
+
+	var fetches int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"key1","use":"sig","n":%q,"e":%q}]}`,
+			base64.RawURLEncoding.EncodeToString(privateKey.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.E)).Bytes()))
+	}))
+	defer server.Close()
+
+	jwksURL := server.URL
+	bearer, err := NewJWTBearerAuth(JWTBearerOptions{
+		Issuer:   "https://idp.example.com",
+		Audience: "sync_gateway",
+		JWKSURL:  &jwksURL,
+	})
+	assert.Equals(t, err, nil)
+
+	// Callers that need the key while it's being fetched wait for that fetch instead of starting
+	// their own, and the lock isn't held meanwhile:
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := bearer.getKey("key1")
+			assert.Equals(t, err, nil)
+			assert.True(t, key != nil)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	bearer.lock.Lock()
+	bearer.lock.Unlock()
+	close(release)
+	wg.Wait()
+	assert.Equals(t, atomic.LoadInt32(&fetches), int32(1))
+}
@@ -0,0 +1,63 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"net/http"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Default min length of a password a user chooses
+const DefaultPasswordMinLength = 8
+
+// Requirements of passwords users choose themselves.  (Passwords set by an admin aren't checked.)
+type PasswordPolicy struct {
+	MinLength      int // Min length in characters; 0 for DefaultPasswordMinLength
+	MinCharClasses int // Min kinds of character (lowercase, uppercase, digit, other) it must mix
+}
+
+// Returns a 400 error if the password doesn't meet the policy.
+func (policy PasswordPolicy) Check(password string) error {
+	minLength := policy.MinLength
+	if minLength <= 0 {
+		minLength = DefaultPasswordMinLength
+	}
+	if utf8.RuneCountInString(password) < minLength {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must be at least %d characters long", minLength)
+	}
+	if policy.MinCharClasses > 1 {
+		var lower, upper, digit, other bool
+		for _, r := range password {
+			switch {
+			case unicode.IsLower(r):
+				lower = true
+			case unicode.IsUpper(r):
+				upper = true
+			case unicode.IsDigit(r):
+				digit = true
+			default:
+				other = true
+			}
+		}
+		classes := 0
+		for _, found := range []bool{lower, upper, digit, other} {
+			if found {
+				classes++
+			}
+		}
+		if classes < policy.MinCharClasses {
+			return base.HTTPErrorf(http.StatusBadRequest, "Password must mix at least %d of lowercase letters, uppercase letters, digits and other characters", policy.MinCharClasses)
+		}
+	}
+	return nil
+}
@@ -38,6 +38,10 @@ type Principal interface {
 	// Sets the previous set of channels the Principal has access to.
 	SetPreviousChannels(ch.TimedSet)
 
+	// The channels the Principal has lost access to, and the sequences at which access was granted
+	// and revoked.
+	RevokedChannels() RevokedChannels
+
 	// Returns true if the Principal has access to the given channel.
 	CanSeeChannel(channel string) bool
 
@@ -67,9 +71,33 @@ type Principal interface {
 	accessViewKey() string
 	validate() error
 	setChannels(ch.TimedSet)
+	updateRevokedChannels(newChannels ch.TimedSet, revokedSeq uint64)
 	getVbNo(hashFunction VBHashFunction) uint16
 }
 
+// The sequences at which a Principal was granted, and then lost, access to a channel.
+type ChannelRevocation struct {
+	GrantedSeq uint64 `json:"granted"`
+	RevokedSeq uint64 `json:"revoked"`
+}
+
+// Channels a Principal has lost access to, keyed by channel name.
+type RevokedChannels map[string]ChannelRevocation
+
+// Records a revocation.  If the channel was already revoked before, the entry is widened to span
+// both periods of access, so clients that synced during either one are told about it.
+func (revoked RevokedChannels) add(channel string, grantedSeq, revokedSeq uint64) {
+	if existing, found := revoked[channel]; found {
+		if existing.GrantedSeq < grantedSeq {
+			grantedSeq = existing.GrantedSeq
+		}
+		if existing.RevokedSeq > revokedSeq {
+			revokedSeq = existing.RevokedSeq
+		}
+	}
+	revoked[channel] = ChannelRevocation{GrantedSeq: grantedSeq, RevokedSeq: revokedSeq}
+}
+
 // Role is basically the same as Principal, just concrete. Users can inherit channels from Roles.
 type Role interface {
 	Principal
@@ -94,9 +122,30 @@ type User interface {
 	// Authenticates the user's password.
 	Authenticate(password string) bool
 
-	// Changes the user's password.
+	// Returns true if the given password, or bcrypt hash, is the user's, whether or not the
+	// account is disabled.  Unlike Authenticate, never rehashes or saves the user.
+	HasPassword(password string) bool
+	HasPasswordHash(hash []byte) bool
+
+	// Changes the user's password.  This invalidates the user's existing login sessions.
 	SetPassword(password string)
 
+	// Changes the user's password, given its bcrypt hash instead of the password itself (for
+	// provisioning users from another system.)  Fails if the hash isn't a valid bcrypt hash.
+	SetPasswordHash(hash []byte) error
+
+	// A digest of the password (or hash) the database config last gave the user, so that loading
+	// the config again only resets the password if the configured one has changed.
+	ConfigPasswordDigest() string
+	SetConfigPasswordDigest(digest string)
+
+	// Incremented whenever the user's password changes or its sessions are revoked.  Login sessions
+	// created at an earlier generation are no longer valid.
+	CredentialGeneration() uint64
+
+	// Invalidates all of the user's existing login sessions.
+	RevokeSessions()
+
 	// The set of Roles the user belongs to (including ones given to it by the sync function)
 	RoleNames() ch.TimedSet
 
@@ -134,5 +183,12 @@ type User interface {
 	// input set
 	GetAddedChannels(channels ch.TimedSet) base.Set
 
+	// Records the channels the user lost access to because it was removed from roles.
+	updateRevokedRoles(newRoles ch.TimedSet, revokedSeq uint64)
+
+	// Returns the earliest expiry time (as a Unix timestamp) of the user's time-limited grants,
+	// including those of its roles, or 0 if none of them expire.
+	NextGrantExpiry() int64
+
 	setRolesSince(ch.TimedSet)
 }
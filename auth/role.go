@@ -21,12 +21,14 @@ import (
 
 /** A group that users can belong to, with associated channel permisisons. */
 type roleImpl struct {
-	Name_             string      `json:"name,omitempty"`
-	ExplicitChannels_ ch.TimedSet `json:"admin_channels,omitempty"`
-	Channels_         ch.TimedSet `json:"all_channels"`
-	Sequence_         uint64      `json:"sequence"`
-	PreviousChannels_ ch.TimedSet `json:"previous_channels,omitempty"`
-	vbNo              *uint16
+	Name_                string          `json:"name,omitempty"`
+	ExplicitChannels_    ch.TimedSet     `json:"admin_channels,omitempty"`
+	Channels_            ch.TimedSet     `json:"all_channels"`
+	Sequence_            uint64          `json:"sequence"`
+	PreviousChannels_    ch.TimedSet     `json:"previous_channels,omitempty"`
+	InvalidatedChannels_ ch.TimedSet     `json:"inval_channels,omitempty"` // Channels_ before invalidation, to detect revocations
+	RevokedChannels_     RevokedChannels `json:"revoked_channels,omitempty"`
+	vbNo                 *uint16
 }
 
 var kValidNameRegexp *regexp.Regexp
@@ -119,6 +121,9 @@ func (role *roleImpl) Channels() ch.TimedSet {
 }
 
 func (role *roleImpl) setChannels(channels ch.TimedSet) {
+	if channels == nil && role.InvalidatedChannels_ == nil {
+		role.InvalidatedChannels_ = role.Channels_
+	}
 	role.Channels_ = channels
 }
 
@@ -139,6 +144,32 @@ func (role *roleImpl) SetPreviousChannels(channels ch.TimedSet) {
 	role.PreviousChannels_ = channels
 }
 
+func (role *roleImpl) RevokedChannels() RevokedChannels {
+	return role.RevokedChannels_
+}
+
+// Records the channels that were in the role's channel list before it was rebuilt (or invalidated),
+// but aren't in newChannels, as revoked at revokedSeq.  If revokedSeq is zero, revocations aren't
+// tracked.
+func (role *roleImpl) updateRevokedChannels(newChannels ch.TimedSet, revokedSeq uint64) {
+	oldChannels := role.Channels_
+	if oldChannels == nil {
+		oldChannels = role.InvalidatedChannels_
+	}
+	role.InvalidatedChannels_ = nil
+	if revokedSeq == 0 {
+		return
+	}
+	for channel, seq := range oldChannels {
+		if !newChannels.Contains(channel) && seq.Sequence < revokedSeq {
+			if role.RevokedChannels_ == nil {
+				role.RevokedChannels_ = RevokedChannels{}
+			}
+			role.RevokedChannels_.add(channel, seq.Sequence, revokedSeq)
+		}
+	}
+}
+
 // Checks whether this role object contains valid data; if not, returns an error.
 func (role *roleImpl) validate() error {
 	if !IsValidPrincipalName(role.Name_) {
@@ -158,27 +189,47 @@ func (role *roleImpl) UnauthError(message string) error {
 
 // Returns true if the Role is allowed to access the channel.
 // A nil Role means access control is disabled, so the function will return true.
+// Prefix grants such as "tenant-123-*" allow access to every channel they match.
 func (role *roleImpl) CanSeeChannel(channel string) bool {
-	return role == nil || role.Channels_.Contains(channel) || role.Channels_.Contains(ch.UserStarChannel)
+	if channel == ch.NoChannels {
+		return role == nil // Docs in no channels are only visible to admins, even with "*"
+	}
+	if role == nil || role.Channels_.Contains(channel) || role.Channels_.Contains(ch.UserStarChannel) {
+		return true
+	}
+	_, found := role.Channels_.PrefixGrantFor(channel)
+	return found
 }
 
 // Returns the sequence number since which the Role has been able to access the channel, else zero.
 func (role *roleImpl) CanSeeChannelSince(channel string) uint64 {
+	if channel == ch.NoChannels {
+		return 0
+	}
 	seq := role.Channels_[channel]
 	if seq.Sequence == 0 {
 		seq = role.Channels_[ch.UserStarChannel]
 	}
+	if seq.Sequence == 0 {
+		seq, _ = role.Channels_.PrefixGrantFor(channel)
+	}
 	return seq.Sequence
 }
 
 // Returns the sequence number since which the Role has been able to access the channel, else zero.  Sets the vb
 // for an admin channel grant, if needed.
 func (role *roleImpl) CanSeeChannelSinceVbSeq(channel string, hashFunction VBHashFunction) (base.VbSeq, bool) {
+	if channel == ch.NoChannels {
+		return base.VbSeq{}, false
+	}
 	seq, ok := role.Channels_[channel]
 	if !ok {
 		seq, ok = role.Channels_[ch.UserStarChannel]
 		if !ok {
-			return base.VbSeq{}, false
+			seq, ok = role.Channels_.PrefixGrantFor(channel)
+			if !ok {
+				return base.VbSeq{}, false
+			}
 		}
 	}
 	if seq.VbNo == nil {
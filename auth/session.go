@@ -24,6 +24,8 @@ type LoginSession struct {
 	Username   string        `json:"username"`
 	Expiration time.Time     `json:"expiration"`
 	Ttl        time.Duration `json:"ttl"`
+	Created    time.Time     `json:"created,omitempty"`
+	Generation uint64        `json:"generation,omitempty"` // User's credential generation when the session was created
 }
 
 const CookieName = "SyncGatewaySession"
@@ -45,6 +47,15 @@ func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.Re
 		}
 		return nil, err
 	}
+
+	user, err := auth.GetUser(session.Username)
+	if err != nil {
+		return nil, err
+	}
+	if sessionRevoked(&session, user) {
+		return nil, base.HTTPErrorf(http.StatusUnauthorized, "Session has been revoked")
+	}
+
 	// Don't need to check session.Expiration, because Couchbase will have nuked the document.
 	//update the session Expiration if 10% or more of the current expiration time has elapsed
 	//if the session does not contain a Ttl (probably created prior to upgrading SG), use
@@ -56,41 +67,49 @@ func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.Re
 	sessionTimeElapsed := int((time.Now().Add(duration).Sub(session.Expiration)).Seconds())
 	tenPercentOfTtl := int(duration.Seconds()) / 10
 	if sessionTimeElapsed > tenPercentOfTtl {
-		session.Expiration = time.Now().Add(duration)
+		session.Expiration = time.Now().Add(duration).UTC()
 		ttlSec := int(duration.Seconds())
 		if err = auth.bucket.Set(docIDForSession(session.ID), ttlSec, session); err != nil {
 			return nil, err
 		}
 		base.AddDbPathToCookie(rq, cookie)
 		cookie.Expires = session.Expiration
+		cookie.MaxAge = ttlSec
 		http.SetCookie(response, cookie)
+		auth.indexSession(&session)
 	}
 
-	user, err := auth.GetUser(session.Username)
 	if user != nil && user.Disabled() {
-		user = nil
+		return nil, base.HTTPErrorf(http.StatusUnauthorized, "User account is disabled")
 	}
-	return user, err
+	return user, nil
 }
 
-func (auth *Authenticator) CreateSession(username string, ttl time.Duration) (*LoginSession, error) {
+// Creates a login session for the user, stamped with its current credential generation.
+func (auth *Authenticator) CreateSession(user User, ttl time.Duration) (*LoginSession, error) {
 	ttlSec := int(ttl.Seconds())
 	if ttlSec <= 0 {
 		return nil, base.HTTPErrorf(400, "Invalid session time-to-live")
 	}
 
+	// Expirations are in UTC, so that the session_expiry view sorts them chronologically
+	now := time.Now().UTC()
 	session := &LoginSession{
 		ID:         base.GenerateRandomSecret(),
-		Username:   username,
-		Expiration: time.Now().Add(ttl),
+		Username:   user.Name(),
+		Expiration: now.Add(ttl),
 		Ttl:        ttl,
+		Created:    now,
+		Generation: user.CredentialGeneration(),
 	}
 	if err := auth.bucket.Set(docIDForSession(session.ID), base.DurationToCbsExpiry(ttl), session); err != nil {
 		return nil, err
 	}
+	auth.indexSession(session)
 	return session, nil
 }
 
+// Returns the session with the given ID, or nil if it doesn't exist, has expired or been revoked.
 func (auth *Authenticator) GetSession(sessionid string) (*LoginSession, error) {
 	var session LoginSession
 	_, err := auth.bucket.Get(docIDForSession(sessionid), &session)
@@ -100,6 +119,13 @@ func (auth *Authenticator) GetSession(sessionid string) (*LoginSession, error) {
 		}
 		return nil, err
 	}
+	user, err := auth.GetUser(session.Username)
+	if err != nil {
+		return nil, err
+	}
+	if sessionRevoked(&session, user) {
+		return nil, nil
+	}
 	return &session, nil
 }
 
@@ -111,7 +137,17 @@ func (auth *Authenticator) MakeSessionCookie(session *LoginSession) *http.Cookie
 		Name:    CookieName,
 		Value:   session.ID,
 		Expires: session.Expiration,
+		MaxAge:  int(session.Ttl.Seconds()),
+	}
+}
+
+// Returns the session whose ID is in the request's session cookie, or nil if there isn't one.
+func (auth *Authenticator) GetSessionForCookie(rq *http.Request) (*LoginSession, error) {
+	cookie, _ := rq.Cookie(CookieName)
+	if cookie == nil {
+		return nil, nil
 	}
+	return auth.GetSession(cookie.Value)
 }
 
 func (auth Authenticator) DeleteSessionForCookie(rq *http.Request) *http.Cookie {
@@ -119,7 +155,7 @@ func (auth Authenticator) DeleteSessionForCookie(rq *http.Request) *http.Cookie
 	if cookie == nil {
 		return nil
 	}
-	auth.bucket.Delete(docIDForSession(cookie.Value))
+	auth.DeleteSession(cookie.Value)
 
 	newCookie := *cookie
 	newCookie.Value = ""
@@ -127,10 +163,19 @@ func (auth Authenticator) DeleteSessionForCookie(rq *http.Request) *http.Cookie
 	return &newCookie
 }
 
+// Deletes a session, and removes it from its user's session index.
 func (auth Authenticator) DeleteSession(sessionid string) error {
-
+	var session LoginSession
+	if _, err := auth.bucket.Get(docIDForSession(sessionid), &session); err == nil {
+		auth.unindexSession(session.Username, sessionid)
+	}
 	return auth.bucket.Delete(docIDForSession(sessionid))
+}
 
+// A session is revoked if the user's password has changed, or its sessions were revoked, since it
+// was created.
+func sessionRevoked(session *LoginSession, user User) bool {
+	return user != nil && session.Generation != user.CredentialGeneration()
 }
 
 func docIDForSession(sessionID string) string {
@@ -0,0 +1,190 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Couchbase Server removes a session doc when it expires, but that doesn't happen with every kind
+// of bucket, nor for sessions written without an expiry by older versions.  So a SessionCleaner
+// periodically looks up the sessions that expired more than a grace period ago, deletes them and
+// removes them from their users' session indexes.  Every node of a cluster runs one, but only the
+// node holding the cleanup lease (a doc in the bucket, renewed on each run) does the work.
+
+// Key of the lease doc of the session cleanup task.
+const SessionCleanupLeaseKey = "_sync:session_cleanup"
+
+// Defaults for SessionCleanupOptions
+const (
+	DefaultSessionCleanupInterval  = time.Hour
+	DefaultSessionCleanupBatchSize = 500
+	DefaultSessionCleanupGrace     = 10 * time.Minute
+)
+
+type SessionCleanupOptions struct {
+	Interval    time.Duration // How often to look for stale sessions; 0 for the default
+	BatchSize   int           // Max sessions looked up (and deleted) at once; 0 for the default
+	GracePeriod time.Duration // How long past its expiration a session is kept; 0 for the default
+}
+
+// Returns the doc IDs of up to limit sessions that expired before a time, earliest first.
+type ExpiredSessionQuery func(before time.Time, limit int) ([]string, error)
+
+// Aborts an update of the lease doc that another node holds.
+var errSessionCleanupLeaseHeld = errors.New("session cleanup lease is held by another node")
+
+// The lease doc.  A lease is held until it expires, and the holder renews it on each run.
+type sessionCleanupLease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// Deletes stale session docs in the background.
+type SessionCleaner struct {
+	auth       *Authenticator
+	query      ExpiredSessionQuery
+	options    SessionCleanupOptions
+	owner      string        // Identifies this node in the lease doc
+	terminator chan struct{} // Closed to stop the background task
+	done       chan struct{} // Closed when the background task has stopped
+}
+
+// Creates a SessionCleaner; call Start to run it.
+func NewSessionCleaner(auth *Authenticator, query ExpiredSessionQuery, options SessionCleanupOptions) *SessionCleaner {
+	if options.Interval <= 0 {
+		options.Interval = DefaultSessionCleanupInterval
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultSessionCleanupBatchSize
+	}
+	if options.GracePeriod <= 0 {
+		options.GracePeriod = DefaultSessionCleanupGrace
+	}
+	return &SessionCleaner{
+		auth:       auth,
+		query:      query,
+		options:    options,
+		owner:      base.GenerateRandomSecret(),
+		terminator: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Runs the cleanup every Interval until Stop is called.
+func (cleaner *SessionCleaner) Start() {
+	go func() {
+		defer close(cleaner.done)
+		ticker := time.NewTicker(cleaner.options.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := cleaner.Run(); err != nil {
+					base.Warn("Session cleanup failed: %v", err)
+				}
+			case <-cleaner.terminator:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the background task, waiting for a run in progress to finish its current batch.
+func (cleaner *SessionCleaner) Stop() {
+	close(cleaner.terminator)
+	<-cleaner.done
+}
+
+// Deletes the sessions that expired more than the grace period ago, a batch at a time, if this
+// node holds (or can take) the lease.  Returns the number of sessions deleted.
+func (cleaner *SessionCleaner) Run() (deleted int, err error) {
+	if held, err := cleaner.acquireLease(); err != nil || !held {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-cleaner.options.GracePeriod)
+	for {
+		docIDs, err := cleaner.query(cutoff, cleaner.options.BatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		batchDeleted := 0
+		for _, docID := range docIDs {
+			if cleaner.auth.deleteExpiredSession(docID, cutoff) {
+				batchDeleted++
+			}
+		}
+		deleted += batchDeleted
+		base.StatsExpvars.Add("sessions_expiredDeleted", int64(batchDeleted))
+		// Stop once the query runs dry, or nothing in a batch could be deleted (so the next
+		// query would return the same sessions):
+		if len(docIDs) < cleaner.options.BatchSize || batchDeleted == 0 {
+			break
+		}
+		select {
+		case <-cleaner.terminator:
+			return deleted, nil
+		default:
+		}
+	}
+	if deleted > 0 {
+		base.LogTo("Auth", "Session cleanup deleted %d expired sessions", deleted)
+	}
+	return deleted, nil
+}
+
+// Takes or renews the lease, for twice the interval so that it doesn't lapse between runs.
+// Returns false if another node holds it.
+func (cleaner *SessionCleaner) acquireLease() (bool, error) {
+	duration := 2 * cleaner.options.Interval
+	err := cleaner.auth.bucket.Update(SessionCleanupLeaseKey, base.DurationToCbsExpiry(duration), func(currentValue []byte) ([]byte, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		now := time.Now()
+		var lease sessionCleanupLease
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &lease); err == nil && lease.Owner != cleaner.owner && now.Before(lease.Expires) {
+				return nil, errSessionCleanupLeaseHeld
+			}
+		}
+		return json.Marshal(sessionCleanupLease{Owner: cleaner.owner, Expires: now.Add(duration)})
+	})
+	if err == errSessionCleanupLeaseHeld {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Deletes a session doc and unindexes it, if it expired before the cutoff; it may have been
+// refreshed since it was indexed.  Returns true if it was deleted.
+func (auth *Authenticator) deleteExpiredSession(docID string, cutoff time.Time) bool {
+	var session LoginSession
+	cas, err := auth.bucket.Get(docID, &session)
+	if err != nil {
+		if !base.IsDocNotFoundError(err) {
+			base.Warn("Session cleanup: can't read %q: %v", docID, err)
+		}
+		return false
+	}
+	if session.Expiration.After(cutoff) {
+		return false
+	}
+	if _, err := auth.bucket.Remove(docID, cas); err != nil {
+		if !base.IsDocNotFoundError(err) && !base.IsCasMismatch(auth.bucket, err) {
+			base.Warn("Session cleanup: can't delete %q: %v", docID, err)
+		}
+		return false
+	}
+	auth.unindexSession(session.Username, session.ID)
+	return true
+}
@@ -0,0 +1,145 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const SessionIndexKeyPrefix = "_sync:usersessions:"
+
+// Info about one of a user's login sessions, as stored in the user's session index.
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Created    time.Time `json:"created"`
+	Expiration time.Time `json:"expires"`
+	TTLSecs    int       `json:"ttl"`
+	Generation uint64    `json:"-"`
+}
+
+// The index of a user's sessions, so they can be listed without a view query.  Sessions that
+// expire naturally aren't removed from it until the next time it's read or updated.
+type sessionIndex struct {
+	Sessions map[string]sessionIndexEntry `json:"sessions"`
+}
+
+type sessionIndexEntry struct {
+	Created    time.Time `json:"created"`
+	Expiration time.Time `json:"expiration"`
+	TTLSecs    int       `json:"ttl"`
+	Generation uint64    `json:"generation,omitempty"`
+}
+
+// Returns the user's live sessions, oldest first.  Entries of expired or revoked sessions are
+// pruned from the index.
+func (auth *Authenticator) GetUserSessions(user User) ([]SessionInfo, error) {
+	var index sessionIndex
+	_, err := auth.bucket.Get(docIDForSessionIndex(user.Name()), &index)
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+
+	now := time.Now()
+	sessions := make([]SessionInfo, 0, len(index.Sessions))
+	stale := false
+	for id, entry := range index.Sessions {
+		if sessionIndexEntryStale(entry, user, now) {
+			stale = true
+			continue
+		}
+		sessions = append(sessions, SessionInfo{
+			ID:         id,
+			Created:    entry.Created,
+			Expiration: entry.Expiration,
+			TTLSecs:    entry.TTLSecs,
+			Generation: entry.Generation,
+		})
+	}
+	sort.Sort(sessionsByCreation(sessions))
+
+	if stale {
+		if err := auth.updateSessionIndex(user.Name(), nil); err != nil {
+			base.Warn("Unable to prune session index of user %q: %v", user.Name(), err)
+		}
+	}
+	return sessions, nil
+}
+
+// Adds the session to its user's index, or updates its entry.
+func (auth *Authenticator) indexSession(session *LoginSession) {
+	err := auth.updateSessionIndex(session.Username, func(index *sessionIndex) {
+		index.Sessions[session.ID] = sessionIndexEntry{
+			Created:    session.Created,
+			Expiration: session.Expiration,
+			TTLSecs:    int(session.Ttl.Seconds()),
+			Generation: session.Generation,
+		}
+	})
+	if err != nil {
+		base.Warn("Unable to update session index of user %q: %v", session.Username, err)
+	}
+}
+
+func (auth *Authenticator) unindexSession(username string, sessionID string) {
+	err := auth.updateSessionIndex(username, func(index *sessionIndex) {
+		delete(index.Sessions, sessionID)
+	})
+	if err != nil {
+		base.Warn("Unable to update session index of user %q: %v", username, err)
+	}
+}
+
+// Applies a change to a user's session index, pruning entries of expired or revoked sessions.
+func (auth *Authenticator) updateSessionIndex(username string, change func(*sessionIndex)) error {
+	user, err := auth.GetUser(username)
+	if err != nil {
+		return err
+	}
+	return auth.bucket.Update(docIDForSessionIndex(username), 0, func(currentValue []byte) ([]byte, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		var index sessionIndex
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &index); err != nil {
+				return nil, err
+			}
+		}
+		if index.Sessions == nil {
+			index.Sessions = make(map[string]sessionIndexEntry)
+		}
+		if change != nil {
+			change(&index)
+		}
+		now := time.Now()
+		for id, entry := range index.Sessions {
+			if sessionIndexEntryStale(entry, user, now) {
+				delete(index.Sessions, id)
+			}
+		}
+		return json.Marshal(index)
+	})
+}
+
+func sessionIndexEntryStale(entry sessionIndexEntry, user User, now time.Time) bool {
+	return !now.Before(entry.Expiration) || (user != nil && entry.Generation != user.CredentialGeneration())
+}
+
+type sessionsByCreation []SessionInfo
+
+func (s sessionsByCreation) Len() int           { return len(s) }
+func (s sessionsByCreation) Less(i, j int) bool { return s[i].Created.Before(s[j].Created) }
+func (s sessionsByCreation) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func docIDForSessionIndex(username string) string {
+	return SessionIndexKeyPrefix + username
+}
@@ -16,6 +16,7 @@ import (
 	"net/http"
 	"regexp"
 
+	"github.com/couchbase/go-couchbase"
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -24,6 +25,14 @@ import (
 
 const kBcryptCostFactor = bcrypt.DefaultCost
 
+// Returns an error if cost isn't in the range supported by bcrypt.
+func ValidateBcryptCost(cost int) error {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return nil
+}
+
 // Actual implementation of User interface
 type userImpl struct {
 	roleImpl // userImpl "inherits from" Role
@@ -35,12 +44,15 @@ type userImpl struct {
 // Marshalable data is stored in separate struct from userImpl,
 // to work around limitations of JSON marshaling.
 type userImplBody struct {
-	Email_           string      `json:"email,omitempty"`
-	Disabled_        bool        `json:"disabled,omitempty"`
-	PasswordHash_    []byte      `json:"passwordhash_bcrypt,omitempty"`
-	OldPasswordHash_ interface{} `json:"passwordhash,omitempty"` // For pre-beta compatibility
-	ExplicitRoles_   ch.TimedSet `json:"explicit_roles,omitempty"`
-	RolesSince_      ch.TimedSet `json:"rolesSince"`
+	Email_            string      `json:"email,omitempty"`
+	Disabled_         bool        `json:"disabled,omitempty"`
+	PasswordHash_     []byte      `json:"passwordhash_bcrypt,omitempty"`
+	OldPasswordHash_  interface{} `json:"passwordhash,omitempty"` // For pre-beta compatibility
+	ExplicitRoles_    ch.TimedSet `json:"explicit_roles,omitempty"`
+	RolesSince_       ch.TimedSet `json:"rolesSince"`
+	InvalidatedRoles_ ch.TimedSet `json:"inval_roles,omitempty"`     // RolesSince_ before invalidation, to detect revocations
+	CredentialGen_    uint64      `json:"credential_gen,omitempty"`  // Bumped when the password changes or sessions are revoked
+	ConfigPassword_   string      `json:"config_password,omitempty"` // Digest of the password last set from the db config
 
 	OldExplicitRoles_ []string `json:"admin_roles,omitempty"` // obsolete; declared for migration
 }
@@ -174,10 +186,45 @@ func (user *userImpl) RoleNames() ch.TimedSet {
 }
 
 func (user *userImpl) setRolesSince(rolesSince ch.TimedSet) {
+	if rolesSince == nil && user.InvalidatedRoles_ == nil {
+		user.InvalidatedRoles_ = user.RolesSince_
+	}
 	user.RolesSince_ = rolesSince
 	user.roles = nil // invalidate in-memory cache list of Role objects
 }
 
+// Records the channels of the roles the user belonged to before its roles were rebuilt (or
+// invalidated), but doesn't belong to in newRoles, as revoked at revokedSeq.  If revokedSeq is
+// zero, revocations aren't tracked.
+func (user *userImpl) updateRevokedRoles(newRoles ch.TimedSet, revokedSeq uint64) {
+	oldRoles := user.RolesSince_
+	if oldRoles == nil {
+		oldRoles = user.InvalidatedRoles_
+	}
+	user.InvalidatedRoles_ = nil
+	if revokedSeq == 0 {
+		return
+	}
+	for roleName, roleSince := range oldRoles {
+		if newRoles.Contains(roleName) || roleSince.Sequence >= revokedSeq {
+			continue
+		}
+		role, err := user.auth.GetRole(roleName)
+		if err != nil || role == nil {
+			continue
+		}
+		for channel, seq := range role.Channels() {
+			if channel == ch.DocumentStarChannel {
+				continue
+			}
+			if user.RevokedChannels_ == nil {
+				user.RevokedChannels_ = RevokedChannels{}
+			}
+			user.RevokedChannels_.add(channel, maxSequence(seq.Sequence, roleSince.Sequence), revokedSeq)
+		}
+	}
+}
+
 func (user *userImpl) ExplicitRoles() ch.TimedSet {
 	return user.ExplicitRoles_
 }
@@ -200,31 +247,123 @@ func (user *userImpl) Authenticate(password string) bool {
 		}
 	} else if !compareHashAndPassword(user.PasswordHash_, []byte(password)) {
 		return false
+	} else if !user.Disabled_ {
+		user.upgradePasswordHash(password)
 	}
 	return !user.Disabled_
 }
 
+func (user *userImpl) HasPassword(password string) bool {
+	if user.OldPasswordHash_ != nil {
+		return false
+	} else if user.PasswordHash_ == nil {
+		return password == ""
+	}
+	return compareHashAndPassword(user.PasswordHash_, []byte(password))
+}
+
+func (user *userImpl) HasPasswordHash(hash []byte) bool {
+	return user.PasswordHash_ != nil && bytes.Equal(user.PasswordHash_, hash)
+}
+
+// If the user's password hash has a lower bcrypt cost than the configured one, rehashes the
+// (just authenticated) password at the configured cost and saves the user.  This doesn't count
+// as a password change, so it doesn't revoke the user's sessions.  The stored user is updated
+// with CAS, and the rehash is dropped if its password hash has changed since it was read.
+func (user *userImpl) upgradePasswordHash(password string) {
+	if user.auth == nil {
+		return
+	}
+	cost, err := bcrypt.Cost(user.PasswordHash_)
+	if err != nil || cost >= user.auth.bcryptCostFactor() {
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), user.auth.bcryptCostFactor())
+	if err != nil {
+		base.Warn("Unable to rehash password of user %q: %v", user.Name_, err)
+		return
+	}
+	oldHash := user.PasswordHash_
+	err = user.auth.bucket.Update(user.DocID(), 0, func(currentValue []byte) ([]byte, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		if currentValue == nil {
+			return nil, couchbase.UpdateCancel
+		}
+		stored := &userImpl{}
+		if err := json.Unmarshal(currentValue, stored); err != nil {
+			return nil, err
+		}
+		if !stored.HasPasswordHash(oldHash) {
+			// The password was changed (or already rehashed) by someone else:
+			return nil, couchbase.UpdateCancel
+		}
+		stored.PasswordHash_ = hash
+		return json.Marshal(stored)
+	})
+	if err == couchbase.UpdateCancel {
+		return
+	} else if err != nil {
+		base.Warn("Unable to save rehashed password of user %q: %v", user.Name_, err)
+		return
+	}
+	user.PasswordHash_ = hash
+	base.LogTo("Auth", "Rehashed password of user %q at bcrypt cost %d (was %d)", user.Name_, user.auth.bcryptCostFactor(), cost)
+	base.StatsExpvars.Add("auth_passwordRehashes", 1)
+}
+
 // Changes a user's password to the given string.
 func (user *userImpl) SetPassword(password string) {
 	if password == "" {
 		user.PasswordHash_ = nil
 	} else {
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), kBcryptCostFactor)
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), user.auth.bcryptCostFactor())
 		if err != nil {
 			panic(fmt.Sprintf("Error hashing password: %v", err))
 		}
 		user.PasswordHash_ = hash
 	}
+	user.CredentialGen_++
+}
+
+func (user *userImpl) SetPasswordHash(hash []byte) error {
+	if _, err := bcrypt.Cost(hash); err != nil {
+		return err
+	}
+	user.PasswordHash_ = hash
+	user.CredentialGen_++
+	return nil
+}
+
+func (user *userImpl) ConfigPasswordDigest() string {
+	return user.ConfigPassword_
+}
+
+func (user *userImpl) SetConfigPasswordDigest(digest string) {
+	user.ConfigPassword_ = digest
+}
+
+func (user *userImpl) CredentialGeneration() uint64 {
+	return user.CredentialGen_
+}
+
+func (user *userImpl) RevokeSessions() {
+	user.CredentialGen_++
 }
 
 // Returns the sequence number since which the user has been able to access the channel, else zero.  Sets the vb
 // for an admin channel grant, if needed.
 func (user *userImpl) CanSeeChannelSinceVbSeq(channel string, hashFunction VBHashFunction) (base.VbSeq, bool) {
+	if channel == ch.NoChannels {
+		return base.VbSeq{}, false
+	}
 	seq, ok := user.Channels_[channel]
 	if !ok {
 		seq, ok = user.Channels_[ch.UserStarChannel]
 		if !ok {
-			return base.VbSeq{}, false
+			seq, ok = user.Channels_.PrefixGrantFor(channel)
+			if !ok {
+				return base.VbSeq{}, false
+			}
 		}
 	}
 	if seq.VbNo == nil {
@@ -306,6 +445,34 @@ func (user *userImpl) AuthorizeAnyChannel(channels base.Set) error {
 	return authorizeAnyChannel(user, channels)
 }
 
+// The channels the user has lost access to, including those revoked from its current roles.
+func (user *userImpl) RevokedChannels() RevokedChannels {
+	roles := user.GetRoles()
+	if len(roles) == 0 {
+		return user.RevokedChannels_
+	}
+	result := RevokedChannels{}
+	for channel, revocation := range user.RevokedChannels_ {
+		result[channel] = revocation
+	}
+	for _, role := range roles {
+		roleSince := user.RolesSince_[role.Name()]
+		for channel, revocation := range role.RevokedChannels() {
+			if revocation.RevokedSeq > roleSince.Sequence {
+				result.add(channel, maxSequence(revocation.GrantedSeq, roleSince.Sequence), revocation.RevokedSeq)
+			}
+		}
+	}
+	return result
+}
+
+func maxSequence(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func (user *userImpl) InheritedChannels() ch.TimedSet {
 	channels := user.Channels().Copy()
 	for _, role := range user.GetRoles() {
@@ -315,6 +482,22 @@ func (user *userImpl) InheritedChannels() ch.TimedSet {
 	return channels
 }
 
+// Returns the earliest expiry time (as a Unix timestamp) of the user's time-limited channel and role
+// grants, including the channel grants of its roles, or 0 if none of them expire.
+func (user *userImpl) NextGrantExpiry() int64 {
+	var result int64
+	expiries := []int64{user.Channels().NextExpiry(), user.RolesSince_.NextExpiry()}
+	for _, role := range user.GetRoles() {
+		expiries = append(expiries, role.Channels().NextExpiry())
+	}
+	for _, until := range expiries {
+		if until != 0 && (result == 0 || until < result) {
+			result = until
+		}
+	}
+	return result
+}
+
 // If a channel list contains the all-channel wildcard, replace it with all the user's accessible channels.
 func (user *userImpl) ExpandWildCardChannel(channels base.Set) base.Set {
 	if channels.Contains(ch.AllChannelWildcard) {
@@ -403,7 +586,7 @@ func (user *userImpl) InheritedChannelsForClock(sinceClock base.SequenceClock) (
 			}
 
 			rolePreSince, grantSeq, secondarySeq := CalculateRoleChannelGrant(roleSince.AsVbSeq(), roleChannelSince.AsVbSeq(), sinceClock)
-			roleGrantingSeq := ch.VbSequence{&grantSeq.Vb, grantSeq.Seq}
+			roleGrantingSeq := ch.VbSequence{VbNo: &grantSeq.Vb, Sequence: grantSeq.Seq}
 			secondaryTriggerSeq := ch.VbSequence{}
 			if secondarySeq.Seq > 0 {
 				secondaryTriggerSeq.VbNo = &secondarySeq.Vb
@@ -98,6 +98,7 @@ type BucketSpec struct {
 	MaxNumRetries                          int  // max number of retries before giving up
 	InitialRetrySleepTimeMS                int  // the initial time to sleep in between retry attempts (in millisecond), which will double each retry
 	UseXattrs                              bool // Whether to use xattrs to store _sync metadata.  Used during view initialization
+	DCPCheckpoints                         bool // Whether a DCP feed with backfill saves its position in the bucket, and resumes from it
 }
 
 // Create a RetrySleeper based on the bucket spec properties.  Used to retry bucket operations after transient errors.
@@ -329,6 +330,18 @@ func StartDCPFeed(args sgbucket.TapArguments, spec BucketSpec, bucket Bucket) (s
 		LogTo("Feed+", "Seeding seqnos: %v", highSeqnos)
 		vbuuids = statsUuids
 		startSeqnos = highSeqnos
+	} else if spec.DCPCheckpoints {
+		// Resume from the checkpoints saved by the last feed; vbuckets without one are backfilled
+		checkpoints, err := LoadDCPCheckpoints(bucket)
+		if err != nil {
+			Warn("Couldn't read the DCP checkpoints of bucket %q, so backfilling it: %v", bucketName, err)
+		} else if len(checkpoints) > 0 {
+			LogTo("Feed", "Resuming DCP feed of bucket %q from the checkpoints of %d vbuckets", bucketName, len(checkpoints))
+			for vbNo, checkpoint := range checkpoints {
+				vbuuids[vbNo] = checkpoint.UUID
+				startSeqnos[vbNo] = checkpoint.Seq
+			}
+		}
 	}
 	dcpReceiver.SeedSeqnos(vbuuids, startSeqnos)
 
@@ -354,12 +367,22 @@ func StartDCPFeed(args sgbucket.TapArguments, spec BucketSpec, bucket Bucket) (s
 	}
 
 	events := make(chan sgbucket.TapEvent)
-	dcpFeed := couchbaseDCPFeedImpl{bds, events}
+	dcpFeed := couchbaseDCPFeedImpl{bds: bds, events: events, receiver: dcpReceiver}
+	checkpointing := spec.DCPCheckpoints && args.Backfill != sgbucket.TapNoBackfill
+	if checkpointing {
+		dcpReceiver.TrackProcessedEvents()
+	}
 
 	if err = bds.Start(); err != nil {
 		return nil, err
 	}
 
+	if checkpointing {
+		dcpFeed.terminator = make(chan struct{})
+		dcpFeed.done = make(chan struct{})
+		go runDCPCheckpointer(bucket, dcpReceiver, dcpFeed.terminator, dcpFeed.done)
+	}
+
 	go func() {
 		for dcpEvent := range dcpReceiver.GetEventFeed() {
 			events <- dcpEvent
@@ -513,7 +536,16 @@ func GetBucket(spec BucketSpec, callback sgbucket.BucketNotifyFn) (bucket Bucket
 	if isWalrus, _ := regexp.MatchString(`^(walrus:|file:|/|\.)`, spec.Server); isWalrus {
 		Logf("Opening Walrus database %s on <%s>", spec.BucketName, spec.Server)
 		sgbucket.SetLogging(LogEnabled("Walrus"))
-		bucket, err = walrus.GetBucket(spec.Server, spec.PoolName, spec.BucketName)
+		if dir := WalrusPersistenceDir(spec.Server); dir != "" && !UsesWalrusFile(dir, spec.BucketName) {
+			var persistentBucket *PersistentWalrusBucket
+			persistentBucket, err = NewPersistentWalrusBucket(walrus.NewBucket(spec.BucketName), dir, DefaultWalrusPersistInterval)
+			if err != nil {
+				return nil, err
+			}
+			bucket = persistentBucket
+		} else {
+			bucket, err = walrus.GetBucket(spec.Server, spec.PoolName, spec.BucketName)
+		}
 		// If feed type is not specified (defaults to DCP) or isn't TAP, wrap with pseudo-vbucket handling for walrus
 		if spec.FeedType == "" || spec.FeedType != TapFeedType {
 			bucket = &LeakyBucket{bucket: bucket, config: LeakyBucketConfig{TapFeedVbuckets: true}}
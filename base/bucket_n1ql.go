@@ -0,0 +1,62 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/couchbase/gocb"
+)
+
+// Replaced by the bucket's escaped name in N1QL statements.
+const KeyspaceToken = "$_keyspace"
+
+// The rows of a N1QL query result.  Next unmarshals the next row into valuePtr, returning false
+// when there are no more; Close returns the error, if any, that ended the rows early.
+type N1QLQueryResults interface {
+	Next(valuePtr interface{}) bool
+	Close() error
+}
+
+// A bucket that supports N1QL queries.  Walrus buckets don't.
+type N1QLBucket interface {
+	GetName() string
+	Query(statement string, params map[string]interface{}, requestPlus bool, adhoc bool) (N1QLQueryResults, error)
+}
+
+// Runs a N1QL statement.  With requestPlus, the query waits until the indexes it uses include all
+// mutations made before it.  Unless adhoc is true, the statement is prepared once and the prepared
+// statement reused; DDL statements must be adhoc.
+func (bucket CouchbaseBucketGoCB) Query(statement string, params map[string]interface{}, requestPlus bool, adhoc bool) (N1QLQueryResults, error) {
+	// N1QL queries share the limit on concurrent view queries:
+	bucket.waitForAvailViewOp()
+	defer bucket.releaseViewOp()
+
+	statement = strings.Replace(statement, KeyspaceToken, fmt.Sprintf("`%s`", bucket.GetName()), -1)
+	query := gocb.NewN1qlQuery(statement).AdHoc(adhoc)
+	if requestPlus {
+		query.Consistency(gocb.RequestPlus)
+	}
+	results, err := bucket.ExecuteN1qlQuery(query, params)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Returns the bucket as a N1QLBucket, or false if it doesn't support N1QL queries.
+func AsN1QLBucket(bucket Bucket) (N1QLBucket, bool) {
+	if loggingBucket, ok := bucket.(*LoggingBucket); ok {
+		bucket = loggingBucket.bucket
+	}
+	n1qlBucket, ok := bucket.(N1QLBucket)
+	return n1qlBucket, ok
+}
@@ -0,0 +1,178 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gocb"
+	"github.com/couchbase/gomemcached"
+)
+
+// How bucket operations that fail with transient errors are retried.
+type BucketRetryPolicy struct {
+	MaxAttempts  int           // Max number of attempts, including the first
+	InitialDelay time.Duration // Delay before the first retry; doubles (with jitter) every retry
+	MaxDelay     time.Duration // Max delay between retries
+	Deadline     time.Duration // Max total time to spend retrying; 0 for no limit
+
+	// True if the bucket already retries the errors isRecoverableGoCBError accepts (as a
+	// CouchbaseBucketGoCB does), so only the other retryable errors are retried again.
+	RetriedByBucket bool
+}
+
+var DefaultBucketRetryPolicy = BucketRetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 20 * time.Millisecond,
+	MaxDelay:     time.Second,
+	Deadline:     5 * time.Second,
+}
+
+// Creates a RetrySleeper for RetryLoop that implements the policy.  Each call to the sleeper
+// waits a random time between half and all of the current delay, so that lots of clients
+// that failed at the same moment don't all retry at the same moment too.
+func (policy BucketRetryPolicy) RetrySleeper() RetrySleeper {
+	start := time.Now()
+	delay := policy.InitialDelay
+	return func(numAttempts int) (bool, int) {
+		if numAttempts >= policy.MaxAttempts {
+			return false, -1
+		}
+		sleep := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if policy.Deadline > 0 && time.Since(start)+sleep > policy.Deadline {
+			return false, -1
+		}
+		if delay *= 2; delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+		return true, int(sleep / time.Millisecond)
+	}
+}
+
+// Returns true if a bucket operation that failed with this error may succeed if it's retried.
+// Timeouts only count if the operation is idempotent, since it may have succeeded anyway; the
+// other errors mean the server didn't perform the operation.
+func IsRetryableBucketError(err error, idempotent bool) bool {
+	switch err {
+	case nil:
+		return false
+	case gocb.ErrTmpFail, gocb.ErrOverload, gocb.ErrBusy:
+		return true
+	case gocb.ErrTimeout:
+		return idempotent
+	}
+	switch err.(type) {
+	case *HTTPError, *DocConflictError:
+		return false // Not from the bucket; e.g. a conflict detected by a WriteUpdate callback
+	}
+	if mcErr, ok := err.(*gomemcached.MCResponse); ok {
+		return mcErr.Status == gomemcached.TMPFAIL || mcErr.Status == gomemcached.NOT_MY_VBUCKET
+	}
+	message := strings.ToLower(err.Error())
+	if strings.Contains(message, "not my vbucket") || strings.Contains(message, "temporary failure") {
+		return true
+	}
+	return idempotent && strings.Contains(message, "timed out")
+}
+
+// A circuit breaker for bucket operations.  After `threshold` operations in a row have failed
+// with retryable errors (even after retrying), it opens: for the next `openTime`, operations fail
+// immediately with a CircuitOpenError instead of piling up waiting for a server that's down.
+// After that, operations are allowed again; the first failure re-opens it, the first success
+// closes it.
+type CircuitBreaker struct {
+	threshold int
+	openTime  time.Duration
+	lock      sync.Mutex
+	failures  int       // Number of consecutive failures
+	openUntil time.Time // Operations aren't allowed until this time
+}
+
+// The error returned by operations while a CircuitBreaker is open.
+type CircuitOpenError struct {
+	RetryAfter time.Duration // How much longer the breaker will stay open
+}
+
+func (err *CircuitOpenError) Error() string {
+	return "Database server is unavailable"
+}
+
+// Creates a CircuitBreaker.  A threshold of 0 means it never opens.
+func NewCircuitBreaker(threshold int, openTime time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, openTime: openTime}
+}
+
+// Returns a CircuitOpenError if operations aren't currently allowed.
+func (cb *CircuitBreaker) Allow() error {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if wait := cb.openUntil.Sub(time.Now()); wait > 0 {
+		return &CircuitOpenError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// Records the result of an operation.  Only retryable errors count as failures, since others
+// (like a missing doc) don't mean the server is in trouble.
+func (cb *CircuitBreaker) Record(err error, retryable bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if err == nil {
+		cb.failures = 0
+	} else if retryable {
+		cb.failures++
+		if cb.threshold > 0 && cb.failures >= cb.threshold {
+			if cb.failures == cb.threshold {
+				Warn("%d bucket operations in a row have failed; failing fast for %v", cb.failures, cb.openTime)
+			}
+			cb.openUntil = time.Now().Add(cb.openTime)
+		}
+	}
+}
+
+// Calls op, retrying it according to the policy while it fails with a retryable error that the
+// bucket hasn't retried already.  If the breaker is non-nil, fails fast while it's open, and
+// records the outcome in it.
+func RetryBucketOp(description string, idempotent bool, policy BucketRetryPolicy, breaker *CircuitBreaker, op func() error) error {
+	if breaker != nil {
+		if err := breaker.Allow(); err != nil {
+			return err
+		}
+	}
+	var retryable bool
+	worker := func() (bool, error, interface{}) {
+		err := op()
+		retryable = IsRetryableBucketError(err, idempotent)
+		return retryable && !(policy.RetriedByBucket && isRecoverableGoCBError(err)), err, nil
+	}
+	err, _ := RetryLoop(description, worker, policy.RetrySleeper())
+	if breaker != nil {
+		breaker.Record(err, retryable)
+	}
+	return err
+}
+
+// Calls bucket.AddRaw, with retries.  If a retry finds the key already exists, an earlier
+// attempt that timed out must have added it after all, so that counts as success.
+func AddRawWithRetry(bucket Bucket, key string, exp int, value []byte, policy BucketRetryPolicy, breaker *CircuitBreaker) (added bool, err error) {
+	attempts := 0
+	err = RetryBucketOp("AddRaw "+key, true, policy, breaker, func() (opErr error) {
+		attempts++
+		added, opErr = bucket.AddRaw(key, exp, value)
+		if attempts > 1 && (opErr == gocb.ErrKeyExists || (opErr == nil && !added)) {
+			added, opErr = true, nil
+		}
+		return opErr
+	})
+	return
+}
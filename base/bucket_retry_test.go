@@ -0,0 +1,141 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/gocb"
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbaselabs/go.assert"
+	"github.com/couchbaselabs/walrus"
+)
+
+var testRetryPolicy = BucketRetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+func TestRetryBucketOp(t *testing.T) {
+	// Transient errors are retried:
+	attempts := 0
+	err := RetryBucketOp("test", false, testRetryPolicy, nil, func() error {
+		if attempts++; attempts < 3 {
+			return gocb.ErrTmpFail
+		}
+		return nil
+	})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, attempts, 3)
+
+	// ...but only up to MaxAttempts:
+	attempts = 0
+	err = RetryBucketOp("test", false, testRetryPolicy, nil, func() error {
+		attempts++
+		return gocb.ErrTmpFail
+	})
+	assert.Equals(t, err, gocb.ErrTmpFail)
+	assert.Equals(t, attempts, 3)
+
+	// Timeouts are only retried if the op is idempotent:
+	attempts = 0
+	err = RetryBucketOp("test", false, testRetryPolicy, nil, func() error {
+		attempts++
+		return gocb.ErrTimeout
+	})
+	assert.Equals(t, attempts, 1)
+	attempts = 0
+	err = RetryBucketOp("test", true, testRetryPolicy, nil, func() error {
+		attempts++
+		return gocb.ErrTimeout
+	})
+	assert.Equals(t, attempts, 3)
+
+	// Errors the bucket has already retried aren't retried again, but the others still are:
+	bucketPolicy := testRetryPolicy
+	bucketPolicy.RetriedByBucket = true
+	attempts = 0
+	err = RetryBucketOp("test", true, bucketPolicy, nil, func() error {
+		attempts++
+		return gocb.ErrTmpFail
+	})
+	assert.Equals(t, attempts, 1)
+	attempts = 0
+	err = RetryBucketOp("test", true, bucketPolicy, nil, func() error {
+		attempts++
+		return &gomemcached.MCResponse{Status: gomemcached.NOT_MY_VBUCKET}
+	})
+	assert.Equals(t, attempts, 3)
+
+	// Other errors aren't retried at all:
+	attempts = 0
+	err = RetryBucketOp("test", true, testRetryPolicy, nil, func() error {
+		attempts++
+		return HTTPErrorf(409, "Conflict")
+	})
+	assert.Equals(t, attempts, 1)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker(2, time.Minute)
+	failing := func() error { return gocb.ErrTmpFail }
+
+	// Non-transient errors don't count:
+	RetryBucketOp("test", true, testRetryPolicy, breaker, func() error { return gocb.ErrKeyNotFound })
+	RetryBucketOp("test", true, testRetryPolicy, breaker, failing)
+	assert.Equals(t, breaker.Allow(), nil)
+
+	// Once it opens, ops fail without being called:
+	RetryBucketOp("test", true, testRetryPolicy, breaker, failing)
+	called := false
+	err := RetryBucketOp("test", true, testRetryPolicy, breaker, func() error {
+		called = true
+		return nil
+	})
+	assert.False(t, called)
+	circuitErr, ok := err.(*CircuitOpenError)
+	assert.True(t, ok)
+	assert.True(t, circuitErr.RetryAfter > 59*time.Second)
+	status, _ := ErrorAsHTTPStatus(err)
+	assert.Equals(t, status, 503)
+
+	// Once it's closed again, a success resets it:
+	breaker.openUntil = time.Time{}
+	assert.Equals(t, RetryBucketOp("test", true, testRetryPolicy, breaker, func() error { return nil }), nil)
+	RetryBucketOp("test", true, testRetryPolicy, breaker, failing)
+	assert.Equals(t, breaker.Allow(), nil)
+}
+
+// A bucket whose first AddRaw stores the value but then times out.
+type timingOutAddBucket struct {
+	Bucket
+	calls int
+}
+
+func (b *timingOutAddBucket) AddRaw(k string, exp int, v []byte) (bool, error) {
+	added, err := b.Bucket.AddRaw(k, exp, v)
+	if b.calls++; b.calls == 1 && err == nil {
+		return added, gocb.ErrTimeout
+	}
+	return added, err
+}
+
+func TestAddRawWithRetry(t *testing.T) {
+	bucket := &timingOutAddBucket{Bucket: walrus.NewBucket("addraw_retry")}
+	defer bucket.Close()
+
+	added, err := AddRawWithRetry(bucket, "key", 0, []byte("value"), testRetryPolicy, nil)
+	assert.Equals(t, err, nil)
+	assert.True(t, added)
+	assert.Equals(t, bucket.calls, 2)
+
+	// Without a retry, an existing key still isn't added:
+	added, err = AddRawWithRetry(bucket, "key", 0, []byte("value"), testRetryPolicy, nil)
+	assert.Equals(t, err, nil)
+	assert.False(t, added)
+}
@@ -0,0 +1,133 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/couchbase/go-couchbase/cbdatasource"
+)
+
+// A DCP feed whose bucket spec has DCPCheckpoints set saves how far it's got in each vbucket (the
+// vbucket's UUID and the last sequence processed) to a doc in the bucket every
+// kDCPCheckpointInterval, and when it's closed.  When it's started again with backfill, it resumes
+// each vbucket from its checkpoint, rather than from the beginning.  If a checkpoint's UUID isn't
+// in the vbucket's failover log any more, the server asks the feed to roll back, which it does.
+//
+// The checkpoints only cover the events the feed's consumer has reported processing (see
+// CheckpointedFeed), so none are skipped if the gateway stops without closing the feed.  Every
+// node of a cluster may run a checkpointed feed, but only the node holding the checkpoints' lease
+// saves them, so that nodes don't overwrite each other's.  Since the nodes share the work of
+// importing docs, any of them may resume from the lease holder's checkpoints.
+
+// Key of the doc holding a bucket's DCP checkpoints.
+const DCPCheckpointsKey = "_sync:dcp_checkpoints"
+
+// How often a DCP feed saves its checkpoints, if they've changed.
+const kDCPCheckpointInterval = 10 * time.Second
+
+// How long a node holds the checkpoints' lease after saving them.
+const kDCPCheckpointLease = 3 * kDCPCheckpointInterval
+
+// Aborts saving checkpoints while another node holds the lease.
+var errDCPCheckpointLeaseHeld = errors.New("DCP checkpoint lease is held by another node")
+
+// The position of a DCP feed in a vbucket.
+type DCPCheckpoint struct {
+	UUID uint64 `json:"uuid"` // The vbucket UUID the sequence belongs to
+	Seq  uint64 `json:"seq"`  // The last sequence processed
+}
+
+// DCP checkpoints by vbucket number.
+type DCPCheckpoints map[uint16]DCPCheckpoint
+
+// The checkpoints doc, which also holds the lease of the node that saves them.
+type dcpCheckpointsDoc struct {
+	Owner       string         `json:"owner"`
+	Expires     time.Time      `json:"expires"`
+	Checkpoints DCPCheckpoints `json:"checkpoints"`
+}
+
+// Reads a bucket's DCP checkpoints.  Returns nil if there aren't any.
+func LoadDCPCheckpoints(bucket Bucket) (DCPCheckpoints, error) {
+	rawCheckpoints, _, err := bucket.GetRaw(DCPCheckpointsKey)
+	if IsDocNotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var doc dcpCheckpointsDoc
+	if err := json.Unmarshal(rawCheckpoints, &doc); err != nil {
+		return nil, err
+	}
+	return doc.Checkpoints, nil
+}
+
+// Saves a feed's checkpoints, and holds the lease for the given time, unless another node holds
+// it.  Returns false if another node does.
+func SaveDCPCheckpoints(bucket Bucket, owner string, checkpoints DCPCheckpoints, lease time.Duration) (bool, error) {
+	err := bucket.Update(DCPCheckpointsKey, 0, func(currentValue []byte) ([]byte, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		now := time.Now()
+		var doc dcpCheckpointsDoc
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &doc); err == nil && doc.Owner != owner && now.Before(doc.Expires) {
+				return nil, errDCPCheckpointLeaseHeld
+			}
+		}
+		return json.Marshal(dcpCheckpointsDoc{Owner: owner, Expires: now.Add(lease), Checkpoints: checkpoints})
+	})
+	if err == errDCPCheckpointLeaseHeld {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Returns the UUID of a vbucket's current branch, from its cbdatasource metadata.  The failover
+// log is newest first.
+func metadataUUID(meta *cbdatasource.VBucketMetaData) uint64 {
+	if len(meta.FailOverLog) == 0 || len(meta.FailOverLog[0]) == 0 {
+		return 0
+	}
+	return meta.FailOverLog[0][0]
+}
+
+// Saves a feed's checkpoints every kDCPCheckpointInterval, if they've changed or the lease needs
+// renewing, until terminator is closed.  Then saves them a last time, releasing the lease, and
+// closes done.
+func runDCPCheckpointer(bucket Bucket, receiver Receiver, terminator <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	owner := GenerateRandomSecret()
+	var lastSaved time.Time
+	save := func(lease time.Duration) {
+		checkpoints, changed := receiver.Checkpoints()
+		if !changed && lease > 0 && time.Since(lastSaved) < kDCPCheckpointLease/2 {
+			return
+		}
+		if saved, err := SaveDCPCheckpoints(bucket, owner, checkpoints, lease); err != nil {
+			Warn("Couldn't save the DCP checkpoints of bucket %q: %v", bucket.GetName(), err)
+		} else if saved {
+			lastSaved = time.Now()
+		}
+	}
+	ticker := time.NewTicker(kDCPCheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			save(kDCPCheckpointLease)
+		case <-terminator:
+			save(0)
+			return
+		}
+	}
+}
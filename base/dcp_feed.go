@@ -28,8 +28,21 @@ const (
 )
 
 type couchbaseDCPFeedImpl struct {
-	bds    cbdatasource.BucketDataSource
-	events chan sgbucket.TapEvent
+	bds        cbdatasource.BucketDataSource
+	events     chan sgbucket.TapEvent
+	receiver   Receiver
+	terminator chan struct{} // Closed to stop the checkpointer, if there is one
+	done       chan struct{} // Closed when the checkpointer has saved the last checkpoints
+}
+
+// A feed that saves checkpoints of the events its consumer has processed.  The consumer calls
+// EventProcessed once it's done with each event it gets from the feed.
+type CheckpointedFeed interface {
+	EventProcessed(event sgbucket.TapEvent)
+}
+
+func (feed *couchbaseDCPFeedImpl) EventProcessed(event sgbucket.TapEvent) {
+	feed.receiver.EventProcessed(event.VbNo, event.Cas)
 }
 
 func (feed *couchbaseDCPFeedImpl) Events() <-chan sgbucket.TapEvent {
@@ -41,7 +54,12 @@ func (feed *couchbaseDCPFeedImpl) WriteEvents() chan<- sgbucket.TapEvent {
 }
 
 func (feed *couchbaseDCPFeedImpl) Close() error {
-	return feed.bds.Close()
+	err := feed.bds.Close()
+	if feed.terminator != nil {
+		close(feed.terminator)
+		<-feed.done
+	}
+	return err
 }
 
 type SimpleFeed struct {
@@ -70,6 +88,16 @@ type Receiver interface {
 	updateSeq(vbucketId uint16, seq uint64, warnOnLowerSeqNo bool)
 	SetBucketNotifyFn(sgbucket.BucketNotifyFn)
 	GetBucketNotifyFn() sgbucket.BucketNotifyFn
+	Checkpoints() (checkpoints DCPCheckpoints, changed bool)
+	TrackProcessedEvents()
+	EventProcessed(vbucketId uint16, cas uint64)
+}
+
+// An event sent to the consumer of a checkpointed feed, which it hasn't finished processing.
+type pendingDCPEvent struct {
+	seq  uint64
+	cas  uint64
+	done bool
 }
 
 // DCPReceiver implements cbdatasource.Receiver to manage updates coming from a
@@ -80,8 +108,12 @@ type DCPReceiver struct {
 	seqs      map[uint16]uint64 // To track max seq #'s we received per vbucketId.
 	meta      map[uint16][]byte // To track metadata blob's per vbucketId.
 	eventFeed <-chan sgbucket.TapEvent
-	output    chan sgbucket.TapEvent  // Same as EventFeed but writeably-typed
-	notify    sgbucket.BucketNotifyFn // Function to callback when we lose our dcp feed
+	output    chan sgbucket.TapEvent       // Same as EventFeed but writeably-typed
+	notify    sgbucket.BucketNotifyFn      // Function to callback when we lose our dcp feed
+	changed   bool                         // Whether seqs or meta changed since the last Checkpoints()
+	tracking  bool                         // Whether the consumer reports the events it's processed
+	pending   map[uint16][]pendingDCPEvent // Events sent to the consumer and not yet processed, oldest first
+	processed map[uint16]uint64            // The last seq before a vbucket's first pending event
 }
 
 func NewDCPReceiver() Receiver {
@@ -139,6 +171,7 @@ func (r *DCPReceiver) OnError(err error) {
 
 func (r *DCPReceiver) DataUpdate(vbucketId uint16, key []byte, seq uint64,
 	req *gomemcached.MCRequest) error {
+	r.addPending(vbucketId, seq, req.Cas)
 	r.updateSeq(vbucketId, seq, true)
 	r.output <- makeFeedEvent(req, vbucketId, sgbucket.TapMutation)
 	return nil
@@ -146,6 +179,7 @@ func (r *DCPReceiver) DataUpdate(vbucketId uint16, key []byte, seq uint64,
 
 func (r *DCPReceiver) DataDelete(vbucketId uint16, key []byte, seq uint64,
 	req *gomemcached.MCRequest) error {
+	r.addPending(vbucketId, seq, req.Cas)
 	r.updateSeq(vbucketId, seq, true)
 	r.output <- makeFeedEvent(req, vbucketId, sgbucket.TapDeletion)
 	return nil
@@ -162,6 +196,7 @@ func makeFeedEvent(rq *gomemcached.MCRequest, vbucketId uint16, opcode sgbucket.
 		Sequence: rq.Cas,
 		DataType: rq.DataType,
 		Cas:      rq.Cas,
+		VbNo:     vbucketId,
 	}
 	return event
 }
@@ -186,6 +221,7 @@ func (r *DCPReceiver) SetMetaData(vbucketId uint16, value []byte) error {
 		r.meta = make(map[uint16][]byte)
 	}
 	r.meta[vbucketId] = value
+	r.changed = true
 
 	return nil
 }
@@ -208,14 +244,72 @@ func (r *DCPReceiver) GetMetaData(vbucketId uint16) (
 	return value, lastSeq, nil
 }
 
-// Until we have CBL client support for rollback, we just rollback the sequence for the
-// vbucket to unblock the DCP stream.
+// The server asks for a rollback when the feed's position in a vbucket isn't on the vbucket's
+// current branch (after a failover lost the mutations the feed had received past rollbackSeq.)
+// The vbucket's stream is restarted from rollbackSeq, on the newest branch that includes it, so
+// the mutations after that are fed again; the change cache ignores the ones it's already seen.
 func (r *DCPReceiver) Rollback(vbucketId uint16, rollbackSeq uint64) error {
 	Warn("DCP Rollback request - rolling back DCP feed for: vbucketId: %d, rollbackSeq: %x", vbucketId, rollbackSeq)
-	r.updateSeq(vbucketId, rollbackSeq, false)
+	StatsExpvars.Add("dcp_rollbacks", 1)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.seqs == nil {
+		r.seqs = make(map[uint16]uint64)
+	}
+	r.seqs[vbucketId] = rollbackSeq
+	r.changed = true
+	delete(r.pending, vbucketId) // Those events are fed again, and acknowledging the old ones does nothing
+
+	var meta *cbdatasource.VBucketMetaData
+	if r.meta != nil && len(r.meta[vbucketId]) > 0 {
+		meta = &cbdatasource.VBucketMetaData{}
+		if err := json.Unmarshal(r.meta[vbucketId], meta); err != nil {
+			meta = nil
+		}
+	}
+	if meta != nil && rollbackSeq > 0 {
+		meta = rollbackMetadata(meta, rollbackSeq)
+	} else {
+		meta = nil
+	}
+	if meta == nil {
+		// Start the vbucket over from the beginning
+		r.seqs[vbucketId] = 0
+		delete(r.meta, vbucketId)
+		return nil
+	}
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	r.meta[vbucketId] = buf
 	return nil
 }
 
+// Rewinds a vbucket's metadata to rollbackSeq: drops the failover log entries of the branches that
+// started after it, and restarts the stream and its snapshot there.  Returns nil if no branch
+// includes rollbackSeq.
+func rollbackMetadata(meta *cbdatasource.VBucketMetaData, rollbackSeq uint64) *cbdatasource.VBucketMetaData {
+	var failOverLog [][]uint64
+	for i, entry := range meta.FailOverLog {
+		if len(entry) >= 2 && entry[1] <= rollbackSeq {
+			failOverLog = meta.FailOverLog[i:]
+			break
+		}
+	}
+	if len(failOverLog) == 0 {
+		return nil
+	}
+	return &cbdatasource.VBucketMetaData{
+		SeqStart:    rollbackSeq,
+		SeqEnd:      meta.SeqEnd,
+		SnapStart:   rollbackSeq,
+		SnapEnd:     rollbackSeq,
+		FailOverLog: failOverLog,
+	}
+}
+
 // This updates the value stored in r.seqs with the given seq number for the given partition
 // (whic.  Setting warnOnLowerSeqNo to true will check
 // if we are setting the seq number to a _lower_ value than we already have stored for that
@@ -233,7 +327,7 @@ func (r *DCPReceiver) updateSeq(vbucketId uint16, seq uint64, warnOnLowerSeqNo b
 	}
 
 	r.seqs[vbucketId] = seq // Remember the max seq for GetMetaData().
-
+	r.changed = true
 }
 
 // Seeds the sequence numbers returned by GetMetadata to support starting DCP from a particular
@@ -271,6 +365,76 @@ func (r *DCPReceiver) SeedSeqnos(uuids map[uint16]uint64, seqs map[uint16]uint64
 	}
 }
 
+// Makes the receiver keep track of the events the consumer has processed, so that Checkpoints
+// only covers those.  Must be called before the feed starts.
+func (r *DCPReceiver) TrackProcessedEvents() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.tracking = true
+	r.pending = map[uint16][]pendingDCPEvent{}
+	r.processed = map[uint16]uint64{}
+}
+
+// Notes an event about to be sent to the consumer, if it reports the events it's processed.
+func (r *DCPReceiver) addPending(vbucketId uint16, seq uint64, cas uint64) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if !r.tracking {
+		return
+	}
+	if len(r.pending[vbucketId]) == 0 {
+		r.processed[vbucketId] = r.seqs[vbucketId]
+	}
+	r.pending[vbucketId] = append(r.pending[vbucketId], pendingDCPEvent{seq: seq, cas: cas})
+}
+
+// Called when the consumer has processed an event.  Events may finish out of order, so a vbucket's
+// checkpoint only moves past the ones that finished before all the earlier ones did.
+func (r *DCPReceiver) EventProcessed(vbucketId uint16, cas uint64) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	pending := r.pending[vbucketId]
+	for i := range pending {
+		if pending[i].cas == cas && !pending[i].done {
+			pending[i].done = true
+			break
+		}
+	}
+	n := 0
+	for n < len(pending) && pending[n].done {
+		r.processed[vbucketId] = pending[n].seq
+		n++
+	}
+	if n > 0 {
+		r.pending[vbucketId] = pending[n:]
+		r.changed = true
+	}
+}
+
+// Returns the feed's position in each vbucket it's received anything from (or was seeded with),
+// and whether that's changed since the last call.  If the consumer reports the events it's
+// processed, the position is that of the last event processed, along with all the earlier ones.
+func (r *DCPReceiver) Checkpoints() (checkpoints DCPCheckpoints, changed bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	checkpoints = make(DCPCheckpoints, len(r.meta))
+	for vbucketId, value := range r.meta {
+		var meta cbdatasource.VBucketMetaData
+		if err := json.Unmarshal(value, &meta); err != nil {
+			continue
+		}
+		seq := r.seqs[vbucketId]
+		if len(r.pending[vbucketId]) > 0 {
+			seq = r.processed[vbucketId]
+		}
+		checkpoints[vbucketId] = DCPCheckpoint{UUID: metadataUUID(&meta), Seq: seq}
+	}
+	changed = r.changed
+	r.changed = false
+	return checkpoints, changed
+}
+
 // DCPReceiver implements cbdatasource.Receiver to manage updates coming from a
 // cbdatasource BucketDataSource.  See go-couchbase/cbdatasource for
 // additional details
@@ -348,3 +512,15 @@ func (r *DCPLoggingReceiver) GetEventFeed() <-chan sgbucket.TapEvent {
 func (r *DCPLoggingReceiver) GetOutput() chan sgbucket.TapEvent {
 	return r.rec.GetOutput()
 }
+
+func (r *DCPLoggingReceiver) Checkpoints() (checkpoints DCPCheckpoints, changed bool) {
+	return r.rec.Checkpoints()
+}
+
+func (r *DCPLoggingReceiver) TrackProcessedEvents() {
+	r.rec.TrackProcessedEvents()
+}
+
+func (r *DCPLoggingReceiver) EventProcessed(vbucketId uint16, cas uint64) {
+	r.rec.EventProcessed(vbucketId, cas)
+}
@@ -1,8 +1,13 @@
 package base
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
+	"github.com/couchbase/go-couchbase/cbdatasource"
+	"github.com/couchbase/gomemcached"
+	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbaselabs/go.assert"
 )
 
@@ -38,3 +43,104 @@ func TestTransformBucketCredentials(t *testing.T) {
 	assert.Equals(t, bucketname2, inputBucketName2)
 
 }
+
+func TestDCPRollback(t *testing.T) {
+	receiver := &DCPReceiver{}
+	receiver.SeedSeqnos(map[uint16]uint64{1: 111, 2: 222}, map[uint16]uint64{1: 50, 2: 60})
+
+	// A failover happened at 40 (branch 333), on top of one at 10 (branch 111):
+	meta := cbdatasource.VBucketMetaData{
+		SeqStart:    50,
+		SeqEnd:      0xFFFFFFFFFFFFFFFF,
+		SnapStart:   45,
+		SnapEnd:     55,
+		FailOverLog: [][]uint64{{333, 40}, {111, 10}},
+	}
+	rawMeta, _ := json.Marshal(meta)
+	assert.True(t, receiver.SetMetaData(1, rawMeta) == nil)
+
+	checkpoints, changed := receiver.Checkpoints()
+	assert.True(t, changed)
+	assert.DeepEquals(t, checkpoints, DCPCheckpoints{1: {UUID: 333, Seq: 50}, 2: {UUID: 222, Seq: 60}})
+	_, changed = receiver.Checkpoints()
+	assert.False(t, changed)
+
+	// Rolling back before the last failover restarts the stream on the branch before it:
+	assert.True(t, receiver.Rollback(1, 30) == nil)
+	rawMeta, lastSeq, _ := receiver.GetMetaData(1)
+	assert.Equals(t, lastSeq, uint64(30))
+	var rolledBack cbdatasource.VBucketMetaData
+	assert.True(t, json.Unmarshal(rawMeta, &rolledBack) == nil)
+	assert.Equals(t, rolledBack.SeqStart, uint64(30))
+	assert.Equals(t, rolledBack.SnapStart, uint64(30))
+	assert.Equals(t, rolledBack.SnapEnd, uint64(30))
+	assert.DeepEquals(t, rolledBack.FailOverLog, [][]uint64{{111, 10}})
+
+	checkpoints, changed = receiver.Checkpoints()
+	assert.True(t, changed)
+	assert.Equals(t, checkpoints[1], DCPCheckpoint{UUID: 111, Seq: 30})
+
+	// Rolling back to before any branch starts the vbucket over:
+	assert.True(t, receiver.Rollback(2, 0) == nil)
+	rawMeta, lastSeq, _ = receiver.GetMetaData(2)
+	assert.True(t, rawMeta == nil)
+	assert.Equals(t, lastSeq, uint64(0))
+}
+
+func TestDCPCheckpointsPersistence(t *testing.T) {
+	bucket := GetBucketOrPanic()
+	defer bucket.Close()
+
+	checkpoints, err := LoadDCPCheckpoints(bucket)
+	assert.True(t, err == nil)
+	assert.True(t, checkpoints == nil)
+
+	saved := DCPCheckpoints{0: {UUID: 123, Seq: 456}, 1023: {UUID: 789, Seq: 1}}
+	ok, err := SaveDCPCheckpoints(bucket, "node1", saved, time.Minute)
+	assert.True(t, ok && err == nil)
+	checkpoints, err = LoadDCPCheckpoints(bucket)
+	assert.True(t, err == nil)
+	assert.DeepEquals(t, checkpoints, saved)
+
+	// Another node can't overwrite them while the first holds the lease:
+	ok, err = SaveDCPCheckpoints(bucket, "node2", DCPCheckpoints{0: {UUID: 123, Seq: 1}}, time.Minute)
+	assert.True(t, !ok && err == nil)
+	checkpoints, _ = LoadDCPCheckpoints(bucket)
+	assert.DeepEquals(t, checkpoints, saved)
+
+	// Saving with no lease releases it:
+	ok, _ = SaveDCPCheckpoints(bucket, "node1", saved, 0)
+	assert.True(t, ok)
+	ok, _ = SaveDCPCheckpoints(bucket, "node2", DCPCheckpoints{0: {UUID: 123, Seq: 500}}, time.Minute)
+	assert.True(t, ok)
+	checkpoints, _ = LoadDCPCheckpoints(bucket)
+	assert.Equals(t, checkpoints[0].Seq, uint64(500))
+	assert.True(t, bucket.Delete(DCPCheckpointsKey) == nil)
+}
+
+func TestDCPCheckpointsOfProcessedEvents(t *testing.T) {
+	receiver := &DCPReceiver{output: make(chan sgbucket.TapEvent, 10)}
+	receiver.TrackProcessedEvents()
+	receiver.SeedSeqnos(map[uint16]uint64{1: 111}, map[uint16]uint64{1: 50})
+	for seq := uint64(51); seq <= 53; seq++ {
+		assert.True(t, receiver.DataUpdate(1, []byte("doc"), seq, &gomemcached.MCRequest{Key: []byte("doc"), Cas: seq * 1000}) == nil)
+	}
+	checkpoints, _ := receiver.Checkpoints()
+	assert.Equals(t, checkpoints[1].Seq, uint64(50))
+
+	// Events may finish out of order, but the checkpoint only moves past those whose predecessors are done:
+	for i := 0; i < 3; i++ {
+		event := <-receiver.output
+		assert.Equals(t, event.VbNo, uint16(1))
+	}
+	receiver.EventProcessed(1, 52000)
+	checkpoints, _ = receiver.Checkpoints()
+	assert.Equals(t, checkpoints[1].Seq, uint64(50))
+	receiver.EventProcessed(1, 51000)
+	checkpoints, changed := receiver.Checkpoints()
+	assert.True(t, changed)
+	assert.Equals(t, checkpoints[1].Seq, uint64(52))
+	receiver.EventProcessed(1, 53000)
+	checkpoints, _ = receiver.Checkpoints()
+	assert.Equals(t, checkpoints[1].Seq, uint64(53))
+}
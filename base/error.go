@@ -25,6 +25,7 @@ const (
 	alreadyImported  = sgErrorCode(0x00)
 	importCancelled  = sgErrorCode(0x01)
 	importCasFailure = sgErrorCode(0x02)
+	importFiltered   = sgErrorCode(0x03)
 )
 
 type SGError struct {
@@ -35,6 +36,7 @@ var (
 	ErrImportCancelled  = &SGError{importCancelled}
 	ErrAlreadyImported  = &SGError{alreadyImported}
 	ErrImportCasFailure = &SGError{importCasFailure}
+	ErrImportFiltered   = &SGError{importFiltered}
 )
 
 func (e SGError) Error() string {
@@ -45,6 +47,8 @@ func (e SGError) Error() string {
 		return "Import cancelled"
 	case importCasFailure:
 		return "CAS failure during import"
+	case importFiltered:
+		return "Import cancelled by import filter"
 	default:
 		return "Unknown error"
 	}
@@ -64,6 +68,33 @@ func HTTPErrorf(status int, format string, args ...interface{}) *HTTPError {
 	return &HTTPError{status, fmt.Sprintf(format, args...)}
 }
 
+// A 409 from a document update that conflicts with the doc's current revisions.  It describes the
+// doc's current state, so the client can retry without reading the doc first.
+type DocConflictError struct {
+	Message    string
+	CurrentRev string   // The doc's current (winning) revision; empty if the doc doesn't exist
+	Deleted    bool     // True if the current revision is a tombstone
+	Leaves     []string // The doc's leaf revisions
+}
+
+func (err *DocConflictError) Error() string {
+	return fmt.Sprintf("%d %s", http.StatusConflict, err.Message)
+}
+
+// A 400 from a revision pushed with new_edits=false whose rev ID doesn't match its content.
+type RevIDMismatchError struct {
+	RevID    string // The rev ID the revision was pushed with
+	Expected string // The rev ID of the revision's content
+}
+
+func (err *RevIDMismatchError) Error() string {
+	return fmt.Sprintf("%d %s", http.StatusBadRequest, err.message())
+}
+
+func (err *RevIDMismatchError) message() string {
+	return fmt.Sprintf("Rev ID mismatch: %q doesn't match the revision's content, whose rev ID is %q", err.RevID, err.Expected)
+}
+
 // Attempts to map an error to an HTTP status code and message.
 // Defaults to 500 if it doesn't recognize the error. Returns 200 for a nil error.
 func ErrorAsHTTPStatus(err error) (int, string) {
@@ -84,11 +115,19 @@ func ErrorAsHTTPStatus(err error) (int, string) {
 		return http.StatusServiceUnavailable, "Database server is over capacity (gocb.ErrBusy)"
 	case gocb.ErrTmpFail:
 		return http.StatusServiceUnavailable, "Database server is over capacity (gocb.ErrTmpFail)"
+	case ErrImportFiltered:
+		return http.StatusNotFound, "Not imported"
 	}
 
 	switch err := err.(type) {
 	case *HTTPError:
 		return err.Status, err.Message
+	case *DocConflictError:
+		return http.StatusConflict, err.Message
+	case *RevIDMismatchError:
+		return http.StatusBadRequest, err.message()
+	case *CircuitOpenError:
+		return http.StatusServiceUnavailable, "Database server is unavailable; try again later"
 	case *gomemcached.MCResponse:
 		switch err.Status {
 		case gomemcached.KEY_ENOENT:
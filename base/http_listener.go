@@ -1,6 +1,7 @@
 package base
 
 import (
+	"context"
 	"crypto/tls"
 	"expvar"
 	"net"
@@ -10,6 +11,10 @@ import (
 )
 
 var httpListenerExpvars *expvar.Map
+
+// The servers started by ListenAndServeHTTP, so they can be shut down.
+var activeServers []*http.Server
+var activeServersLock sync.Mutex
 var maxWaitExpvar, maxActiveExpvar IntMax
 
 func init() {
@@ -20,11 +25,12 @@ func init() {
 
 // This is like a combination of http.ListenAndServe and http.ListenAndServeTLS, which also
 // uses ThrottledListen to limit the number of open HTTP connections.
-func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *string, handler http.Handler, readTimeout *int, writeTimeout *int, http2Enabled bool) error {
+func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *string, handler http.Handler, readTimeout *int, writeTimeout *int, http2Enabled bool, clientAuth tls.ClientAuthType) error {
 	var config *tls.Config
 	if certFile != nil {
 		config = &tls.Config{}
 		config.MinVersion = tls.VersionTLS10 // Disable SSLv3 due to POODLE vulnerability
+		config.ClientAuth = clientAuth
 		protocolsEnabled := []string{"http/1.1"}
 		if http2Enabled {
 			protocolsEnabled = []string{"h2", "http/1.1"}
@@ -54,9 +60,37 @@ func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *s
 		server.WriteTimeout = time.Duration(*writeTimeout) * time.Second
 	}
 
+	activeServersLock.Lock()
+	activeServers = append(activeServers, server)
+	activeServersLock.Unlock()
 	return server.Serve(listener)
 }
 
+// Gracefully shuts down all the servers started by ListenAndServeHTTP: they stop accepting
+// connections right away, and their ListenAndServeHTTP calls return http.ErrServerClosed.  Then
+// waits until their requests in progress have finished, or the context expires.
+func ShutdownHTTPServers(ctx context.Context) error {
+	activeServersLock.Lock()
+	servers := activeServers
+	activeServers = nil
+	activeServersLock.Unlock()
+
+	var wg sync.WaitGroup
+	errors := make(chan error, len(servers))
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				errors <- err
+			}
+		}(server)
+	}
+	wg.Wait()
+	close(errors)
+	return <-errors // the first error, if any
+}
+
 type throttledListener struct {
 	net.Listener
 	active int
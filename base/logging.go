@@ -10,6 +10,7 @@
 package base
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/couchbase/clog"
@@ -182,6 +183,131 @@ var logFile *os.File
 
 var logStar bool // enabling log key "*" enables all key-based logging
 
+var logJSON bool // if true, each log line is a JSON object (see logJSONRecord)
+
+// Identifies the HTTP request a log message is about, along with its database and user.  Passing
+// one to the LogContext methods tags the messages with its properties, so all the log lines of a
+// request can be found.  A nil *LogContext is allowed, and logs untagged messages.
+type LogContext struct {
+	RequestID string
+	Database  string
+	User      string
+	ClientIP  string     // The client's address, as seen through any trusted proxies
+	Keys      *LogKeySet // The database's log keys and level; nil for the global ones
+}
+
+// The log keys and level of a database, which replace the global ones for the messages logged
+// with its LogContext.  Until they're set, the global ones apply.
+type LogKeySet struct {
+	lock  sync.RWMutex
+	keys  map[string]bool // nil to use the global keys
+	level int             // 0 to use the global level
+}
+
+// Creates a LogKeySet with the given keys (as in ParseLogFlags) and level.  No keys, or a zero
+// level, means the global ones.
+func NewLogKeySet(keys []string, level int) *LogKeySet {
+	set := &LogKeySet{}
+	set.Configure(keys, level)
+	return set
+}
+
+// Replaces the keys (as in ParseLogFlags) and the level.
+func (set *LogKeySet) Configure(keys []string, level int) {
+	var keyMap map[string]bool
+	if len(keys) > 0 {
+		keyMap = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			keyMap[key] = true
+			for strings.HasSuffix(key, "+") {
+				key = key[0 : len(key)-1]
+				keyMap[key] = true // "foo+" also enables "foo"
+			}
+		}
+	}
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	set.keys = keyMap
+	set.level = level
+}
+
+// Returns a copy of the keys, or nil if the global ones apply.
+func (set *LogKeySet) Keys() map[string]bool {
+	set.lock.RLock()
+	defer set.lock.RUnlock()
+	if set.keys == nil {
+		return nil
+	}
+	keys := make(map[string]bool, len(set.keys))
+	for k, v := range set.keys {
+		keys[k] = v
+	}
+	return keys
+}
+
+// Returns the level, or 0 if the global one applies.
+func (set *LogKeySet) Level() int {
+	set.lock.RLock()
+	defer set.lock.RUnlock()
+	return set.level
+}
+
+// Like UpdateLogKeys.  Updating the keys without replacing them starts from the global keys, if
+// those apply.
+func (set *LogKeySet) UpdateKeys(keys map[string]bool, replace bool) {
+	var global map[string]bool
+	if !replace {
+		global = GetLogKeys()
+	}
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	if replace {
+		set.keys = map[string]bool{}
+	} else if set.keys == nil {
+		set.keys = global
+	}
+	for k, v := range keys {
+		set.keys[k] = v
+	}
+}
+
+func (set *LogKeySet) SetLevel(level int) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	set.level = level
+}
+
+// Returns the level that applies to the context's messages.  Assumes caller is holding logLock
+// read lock.
+func (lc *LogContext) _level() int {
+	if lc != nil && lc.Keys != nil {
+		if level := lc.Keys.Level(); level != 0 {
+			return level
+		}
+	}
+	return logLevel
+}
+
+// Returns whether the context's messages with the given key are logged.  Assumes caller is
+// holding logLock read lock.
+func (lc *LogContext) _keyEnabled(key string) bool {
+	if lc != nil && lc.Keys != nil {
+		lc.Keys.lock.RLock()
+		defer lc.Keys.lock.RUnlock()
+		if lc.Keys.keys != nil {
+			return lc.Keys.keys["*"] || lc.Keys.keys[key]
+		}
+	}
+	return logStar || LogKeys[key]
+}
+
+// Like LogEnabled, but for the context's messages.
+func (lc *LogContext) LogEnabled(key string) bool {
+	logLock.RLock()
+	defer logLock.RUnlock()
+	return lc._level() <= 1 && lc._keyEnabled(key)
+}
+
 type LogRotationConfig struct {
 	// MaxSize is the maximum size in megabytes of the log file before it gets
 	// rotated. It defaults to 100 megabytes.
@@ -214,6 +340,7 @@ type LogAppenderConfig struct {
 	LogKeys     []string           `json:",omitempty"` // Log keywords to enable
 	LogLevel    Level              `json:",omitempty"`
 	Rotation    *LogRotationConfig `json:",omitempty"`
+	JSON        bool               `json:",omitempty"` // Write each log line as a JSON object
 }
 
 type LoggingConfigMap map[string]*LogAppenderConfig
@@ -292,6 +419,8 @@ func ParseLogFlags(flags []string) {
 			LogColor()
 		case "notime":
 			LogNoTime()
+		case "json":
+			setLogJSON(true)
 		default:
 			LogKeys[key] = true
 			if key == "*" {
@@ -361,15 +490,38 @@ func GetCallersName(depth int) string {
 
 // Logs a message to the console, but only if the corresponding key is true in LogKeys.
 func LogTo(key string, format string, args ...interface{}) {
+	var lc *LogContext
+	lc.LogTo(key, format, args...)
+}
+
+// Like LogTo, but tags the message with the context's request ID.
+func (lc *LogContext) LogTo(key string, format string, args ...interface{}) {
 	logLock.RLock()
 	defer logLock.RUnlock()
-	ok := logLevel <= 1 && (logStar || LogKeys[key])
+	ok := lc._level() <= 1 && lc._keyEnabled(key)
 
-	if ok {
+	if !ok {
+		return
+	} else if logJSON {
+		logJSONRecord("info", key, lc, fmt.Sprintf(format, args...))
+	} else if lc != nil && lc.RequestID != "" {
+		printf(fgYellow+key+": "+reset+"["+lc.RequestID+"] "+format, args...)
+	} else {
 		printf(fgYellow+key+": "+reset+format, args...)
 	}
 }
 
+// Like Warn, but tags the message with the context's request ID.
+func (lc *LogContext) Warn(format string, args ...interface{}) {
+	logLock.RLock()
+	ok := lc._level() <= 2
+	logLock.RUnlock()
+
+	if ok {
+		lc.logWithCaller(2, fgRed, "WARNING", format, args...)
+	}
+}
+
 func EnableLogKey(key string) {
 	logLock.Lock()
 	defer logLock.Unlock()
@@ -394,7 +546,11 @@ func Log(message string) {
 	defer logLock.RUnlock()
 	ok := logLevel <= 1
 
-	if ok {
+	if !ok {
+		return
+	} else if logJSON {
+		logJSONRecord("info", "", nil, message)
+	} else {
 		print(message)
 	}
 }
@@ -405,7 +561,11 @@ func Logf(format string, args ...interface{}) {
 	defer logLock.RUnlock()
 	ok := logLevel <= 1
 
-	if ok {
+	if !ok {
+		return
+	} else if logJSON {
+		logJSONRecord("info", "", nil, fmt.Sprintf(format, args...))
+	} else {
 		printf(format, args...)
 	}
 }
@@ -456,11 +616,64 @@ func LogFatal(format string, args ...interface{}) {
 }
 
 func logWithCaller(color string, prefix string, format string, args ...interface{}) {
+	var lc *LogContext
+	lc.logWithCaller(3, color, prefix, format, args...)
+}
+
+// Logs a message with the name of the function depth frames up the stack that made the call.
+func (lc *LogContext) logWithCaller(depth int, color string, prefix string, format string, args ...interface{}) {
 	message := fmt.Sprintf(format, args...)
 	logLock.RLock()
 	defer logLock.RUnlock()
-	print(color, prefix, ": ", message, reset,
-		dim, " -- ", GetCallersName(2), reset)
+	if logJSON {
+		logJSONRecord(strings.ToLower(prefix), "", lc, message+" -- "+GetCallersName(depth))
+	} else if lc != nil && lc.RequestID != "" {
+		print(color, prefix, ": ", "[", lc.RequestID, "] ", message, reset,
+			dim, " -- ", GetCallersName(depth), reset)
+	} else {
+		print(color, prefix, ": ", message, reset,
+			dim, " -- ", GetCallersName(depth), reset)
+	}
+}
+
+// Writes a log message as a single-line JSON object, for log shippers.  Unlike printf, this
+// ignores the log level and "notime" flag.  Assumes caller is holding logLock read lock.
+func logJSONRecord(level string, key string, lc *LogContext, message string) {
+	record := map[string]interface{}{
+		"time":  time.Now().Format(ISO8601Format),
+		"level": level,
+		"msg":   message,
+	}
+	if key != "" {
+		record["key"] = key
+	}
+	if lc != nil {
+		if lc.RequestID != "" {
+			record["req"] = lc.RequestID
+		}
+		if lc.Database != "" {
+			record["db"] = lc.Database
+		}
+		if lc.User != "" {
+			record["user"] = lc.User
+		}
+		if lc.ClientIP != "" {
+			record["client"] = lc.ClientIP
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"level":"error","msg":%q}`, err.Error()))
+	}
+	logger.Print(string(line))
+}
+
+// Turns JSON log output on or off.  Assumes caller is holding logLock write lock.
+func setLogJSON(enabled bool) {
+	logJSON = enabled
+	if enabled {
+		logger.SetFlags(0) // the record has its own timestamp
+	}
 }
 
 // Simple wrapper that converts Print to Printf.  Assumes caller is holding logLock read lock.
@@ -510,6 +723,7 @@ func UpdateLogger(logFilePath string) {
 	oldLogFile := logFile
 	logFile = fo
 	logger = log.New(fo, "", log.Lmicroseconds)
+	setLogJSON(logJSON)
 	logLock.Unlock()
 
 	//re-apply log no time flags on new logger
@@ -552,6 +766,11 @@ func CreateRollingLogger(logConfig *LogAppenderConfig) {
 	if logConfig != nil {
 		SetLogLevel(logConfig.LogLevel.sgLevel())
 		ParseLogFlags(logConfig.LogKeys)
+		if logConfig.JSON {
+			logLock.Lock()
+			setLogJSON(true)
+			logLock.Unlock()
+		}
 
 		if logConfig.LogFilePath == nil {
 			return
@@ -10,8 +10,14 @@
 package base
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"log"
+	"strings"
 	"testing"
+
+	"github.com/couchbaselabs/go.assert"
 )
 
 func Benchmark_LoggingPerformance(b *testing.B) {
@@ -33,3 +39,87 @@ func Benchmark_LoggingPerformance(b *testing.B) {
 		TEMP("%s", "A TEMP message")
 	}
 }
+
+func TestLogContext(t *testing.T) {
+	var buf bytes.Buffer
+	logLock.Lock()
+	oldLogger, oldJSON, oldNoTime := logger, logJSON, logNoTime
+	logger = log.New(&buf, "", 0)
+	logNoTime = true
+	logLock.Unlock()
+	defer func() {
+		logLock.Lock()
+		logger, logJSON, logNoTime = oldLogger, oldJSON, oldNoTime
+		logLock.Unlock()
+	}()
+	UpdateLogKeys(map[string]bool{"CRUD": true}, true)
+
+	// Text output is tagged with the request ID:
+	lc := &LogContext{RequestID: "abcd1234", Database: "db", User: "alice", ClientIP: "10.1.2.3"}
+	lc.LogTo("CRUD", "Stored doc %q", "doc1")
+	assert.True(t, strings.Contains(buf.String(), `[abcd1234] Stored doc "doc1"`))
+
+	// A nil context works like LogTo:
+	buf.Reset()
+	var nilContext *LogContext
+	nilContext.LogTo("CRUD", "Stored doc %q", "doc2")
+	assert.True(t, strings.Contains(buf.String(), `Stored doc "doc2"`))
+	assert.False(t, strings.Contains(buf.String(), "["))
+
+	// JSON output has one record per line:
+	logLock.Lock()
+	setLogJSON(true)
+	logLock.Unlock()
+	buf.Reset()
+	lc.LogTo("CRUD", "Stored doc %q", "doc3")
+	lc.Warn("Uh-oh")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equals(t, len(lines), 2)
+	var record map[string]interface{}
+	assert.Equals(t, json.Unmarshal([]byte(lines[0]), &record), nil)
+	assert.Equals(t, record["level"], "info")
+	assert.Equals(t, record["key"], "CRUD")
+	assert.Equals(t, record["req"], "abcd1234")
+	assert.Equals(t, record["db"], "db")
+	assert.Equals(t, record["user"], "alice")
+	assert.Equals(t, record["client"], "10.1.2.3")
+	assert.Equals(t, record["msg"], `Stored doc "doc3"`)
+	record = nil
+	assert.Equals(t, json.Unmarshal([]byte(lines[1]), &record), nil)
+	assert.Equals(t, record["level"], "warning")
+	assert.True(t, strings.HasPrefix(record["msg"].(string), "Uh-oh -- base.TestLogContext()"))
+}
+
+func TestLogKeySet(t *testing.T) {
+	UpdateLogKeys(map[string]bool{"CRUD": true}, true)
+	defer UpdateLogKeys(map[string]bool{}, true)
+
+	// Until a database's keys are set, the global ones apply:
+	dbKeys := NewLogKeySet(nil, 0)
+	lc := &LogContext{Database: "db", Keys: dbKeys}
+	assert.True(t, lc.LogEnabled("CRUD"))
+	assert.False(t, lc.LogEnabled("Changes"))
+	assert.True(t, dbKeys.Keys() == nil)
+
+	// "Changes+" also enables "Changes":
+	dbKeys.Configure([]string{"Changes+"}, 0)
+	assert.False(t, lc.LogEnabled("CRUD"))
+	assert.True(t, lc.LogEnabled("Changes"))
+	assert.True(t, lc.LogEnabled("Changes+"))
+	assert.DeepEquals(t, dbKeys.Keys(), map[string]bool{"Changes": true, "Changes+": true})
+	assert.False(t, LogEnabled("Changes"))
+
+	// Updating without replacing adds to the keys:
+	dbKeys.UpdateKeys(map[string]bool{"Cache": true, "Changes+": false}, false)
+	assert.DeepEquals(t, dbKeys.Keys(), map[string]bool{"Changes": true, "Changes+": false, "Cache": true})
+
+	// Starting from the global keys, if the database has none:
+	dbKeys.Configure(nil, 0)
+	dbKeys.UpdateKeys(map[string]bool{"Cache": true}, false)
+	assert.DeepEquals(t, dbKeys.Keys(), map[string]bool{"CRUD": true, "Cache": true})
+
+	// The database's level silences its messages, but no one else's:
+	dbKeys.SetLevel(2)
+	assert.False(t, lc.LogEnabled("Cache"))
+	assert.True(t, (&LogContext{}).LogEnabled("CRUD"))
+}
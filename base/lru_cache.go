@@ -51,6 +51,8 @@ func (lc *LRUCache) Get(key string) (result interface{}, found bool) {
 
 // Adds an entry to the cache.
 func (lc *LRUCache) Put(key string, value interface{}) {
+	lc.lruLock.Lock()
+	defer lc.lruLock.Unlock()
 
 	// If already present, move to front
 	if elem := lc.cache[key]; elem != nil {
@@ -0,0 +1,163 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Prometheus metric types
+const (
+	MetricCounter = "counter"
+	MetricGauge   = "gauge"
+)
+
+// A set of named metrics that can be exported in the Prometheus text format.  These are meant to
+// gradually replace the expvars, which can't be scraped by Prometheus.
+type MetricsRegistry struct {
+	lock    sync.RWMutex
+	metrics map[string]*Metric
+}
+
+// A counter or gauge, with a separate value for each database.  Process-wide values use the
+// database name "".
+type Metric struct {
+	Name   string
+	Help   string
+	Type   string
+	lock   sync.Mutex
+	values map[string]int64
+}
+
+// The registry exported by the admin API's /_metrics handler.
+var Metrics = NewMetricsRegistry()
+
+// Metrics updated by the db and rest packages.
+var (
+	MetricDocReads           = Metrics.NewMetric("sgw_doc_reads_total", MetricCounter, "Number of document revisions read")
+	MetricDocWrites          = Metrics.NewMetric("sgw_doc_writes_total", MetricCounter, "Number of document revisions written")
+	MetricChangesFeedsActive = Metrics.NewMetric("sgw_changes_feeds_active", MetricGauge, "Number of _changes feeds in progress")
+	MetricRevCacheHits       = Metrics.NewMetric("sgw_rev_cache_hits_total", MetricCounter, "Number of revision cache hits")
+	MetricRevCacheMisses     = Metrics.NewMetric("sgw_rev_cache_misses_total", MetricCounter, "Number of revision cache misses")
+	MetricRevCacheEvictions  = Metrics.NewMetric("sgw_rev_cache_evictions_total", MetricCounter, "Number of revisions evicted from the revision cache")
+	MetricRevCacheBytes      = Metrics.NewMetric("sgw_rev_cache_bytes", MetricGauge, "Estimated size of the revisions in the revision cache")
+	MetricAttachmentBytesIn  = Metrics.NewMetric("sgw_attachment_bytes_written_total", MetricCounter, "Number of bytes of attachments stored")
+	MetricAttachmentBytesOut = Metrics.NewMetric("sgw_attachment_bytes_read_total", MetricCounter, "Number of bytes of attachments read")
+	MetricSyncFnRejections   = Metrics.NewMetric("sgw_sync_function_rejections_total", MetricCounter, "Number of writes rejected by the sync function")
+	MetricAuthFailures       = Metrics.NewMetric("sgw_auth_failures_total", MetricCounter, "Number of requests that failed authentication")
+)
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{metrics: map[string]*Metric{}}
+}
+
+// Creates and registers a metric.  Panics if the name is already taken, since that's a programming error.
+func (r *MetricsRegistry) NewMetric(name string, metricType string, help string) *Metric {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.metrics[name] != nil {
+		panic(fmt.Sprintf("Metric %q is already registered", name))
+	}
+	metric := &Metric{Name: name, Help: help, Type: metricType, values: map[string]int64{}}
+	r.metrics[name] = metric
+	return metric
+}
+
+// Adds delta to the metric's value for a database.
+func (m *Metric) Add(database string, delta int64) {
+	m.lock.Lock()
+	m.values[database] += delta
+	m.lock.Unlock()
+}
+
+// Sets the metric's value for a database.
+func (m *Metric) Set(database string, value int64) {
+	m.lock.Lock()
+	m.values[database] = value
+	m.lock.Unlock()
+}
+
+// Returns the metric's value for a database.
+func (m *Metric) Value(database string) int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.values[database]
+}
+
+// Writes all the metrics, followed by the Go runtime's, in the Prometheus text exposition format.
+func (r *MetricsRegistry) WritePrometheus(w io.Writer) error {
+	out := bufio.NewWriter(w)
+
+	r.lock.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	r.lock.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.lock.RLock()
+		metric := r.metrics[name]
+		r.lock.RUnlock()
+		metric.writePrometheus(out)
+	}
+	writeRuntimeMetrics(out)
+	return out.Flush()
+}
+
+func (m *Metric) writePrometheus(out io.Writer) {
+	m.lock.Lock()
+	databases := make([]string, 0, len(m.values))
+	for database := range m.values {
+		databases = append(databases, database)
+	}
+	sort.Strings(databases)
+	values := make([]int64, len(databases))
+	for i, database := range databases {
+		values[i] = m.values[database]
+	}
+	m.lock.Unlock()
+
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type)
+	for i, database := range databases {
+		if database == "" {
+			fmt.Fprintf(out, "%s %d\n", m.Name, values[i])
+		} else {
+			fmt.Fprintf(out, "%s{db=\"%s\"} %d\n", m.Name, escapePrometheusLabel(database), values[i])
+		}
+	}
+}
+
+func writeRuntimeMetrics(out io.Writer) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeValue := func(name string, metricType string, help string, value interface{}) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, metricType, name, value)
+	}
+	writeValue("go_goroutines", MetricGauge, "Number of goroutines that currently exist", runtime.NumGoroutine())
+	writeValue("go_memstats_alloc_bytes", MetricGauge, "Number of bytes allocated and still in use", mem.Alloc)
+	writeValue("go_memstats_heap_objects", MetricGauge, "Number of allocated objects", mem.HeapObjects)
+	writeValue("go_memstats_sys_bytes", MetricGauge, "Number of bytes obtained from the system", mem.Sys)
+	writeValue("go_memstats_gc_count_total", MetricCounter, "Number of completed GC cycles", mem.NumGC)
+	writeValue("go_memstats_gc_pause_seconds_total", MetricCounter, "Total time spent in GC pauses",
+		float64(mem.PauseTotalNs)/1e9)
+}
+
+// Label values can contain anything, but backslashes, quotes and newlines have to be escaped.
+func escapePrometheusLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,46 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	registry := NewMetricsRegistry()
+	writes := registry.NewMetric("test_writes_total", MetricCounter, "Writes")
+	active := registry.NewMetric("test_active", MetricGauge, "Active")
+
+	writes.Add("db1", 2)
+	writes.Add("db1", 1)
+	writes.Add(`we"ird`, 1)
+	active.Add("", 3)
+	active.Add("", -1)
+	assert.Equals(t, writes.Value("db1"), int64(3))
+	assert.Equals(t, active.Value(""), int64(2))
+
+	var out bytes.Buffer
+	assert.Equals(t, registry.WritePrometheus(&out), nil)
+	text := out.String()
+	assert.True(t, strings.HasPrefix(text, "# HELP test_active Active\n# TYPE test_active gauge\ntest_active 2\n"+
+		"# HELP test_writes_total Writes\n# TYPE test_writes_total counter\n"+
+		"test_writes_total{db=\"db1\"} 3\ntest_writes_total{db=\"we\\\"ird\"} 1\n"))
+	assert.True(t, strings.Contains(text, "\ngo_goroutines "))
+
+	// Names must be unique:
+	defer func() {
+		assert.True(t, recover() != nil)
+	}()
+	registry.NewMetric("test_active", MetricGauge, "Active")
+}
@@ -0,0 +1,109 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"sync"
+	"time"
+)
+
+const rateLimiterPruneInterval = time.Minute
+
+// A set of token-bucket rate limiters, one per key (e.g. client IP address.)  Each key may make
+// requests at the given rate, with bursts of up to burst requests.
+type RateLimiter struct {
+	rate      float64 // Tokens added per second
+	burst     float64 // Capacity of each bucket
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	now       func() time.Time // Overridden by tests
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Creates a RateLimiter.  A burst smaller than 1 is treated as 1.
+func NewRateLimiter(requestsPerSec float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    requestsPerSec,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Takes a token from the key's bucket.  If it's empty, returns false and how long the caller
+// should wait before retrying.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	return l.check(key, true)
+}
+
+// Like Allow, but doesn't take a token; for callers that only charge for some requests (e.g.
+// failed logins) but have to refuse all of them once the key has run out.
+func (l *RateLimiter) Check(key string) (bool, time.Duration) {
+	return l.check(key, false)
+}
+
+func (l *RateLimiter) check(key string, take bool) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.prune(now)
+
+	bucket := l.buckets[key]
+	if bucket == nil {
+		if !take {
+			return true, 0
+		}
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	} else {
+		bucket.refill(now, l.rate, l.burst)
+	}
+	if bucket.tokens >= 1 {
+		if take {
+			bucket.tokens--
+		}
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, rateLimiterPruneInterval
+	}
+	wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+func (bucket *tokenBucket) refill(now time.Time, rate, burst float64) {
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * rate
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.updated = now
+}
+
+// Occasionally drops the buckets that have refilled completely, since they're equivalent to new ones.
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < rateLimiterPruneInterval {
+		return
+	}
+	for key, bucket := range l.buckets {
+		bucket.refill(now, l.rate, l.burst)
+		if bucket.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
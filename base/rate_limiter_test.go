@@ -0,0 +1,60 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	// A burst of 3 is allowed, then the 4th request has to wait half a second:
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.Allow("1.2.3.4")
+		assert.True(t, ok)
+	}
+	ok, wait := limiter.Allow("1.2.3.4")
+	assert.False(t, ok)
+	assert.Equals(t, wait, 500*time.Millisecond)
+
+	// Checking doesn't take a token:
+	ok, wait = limiter.Check("1.2.3.4")
+	assert.False(t, ok)
+	assert.Equals(t, wait, 500*time.Millisecond)
+	ok, _ = limiter.Check("9.9.9.9")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("9.9.9.9")
+	assert.True(t, ok)
+	ok, _ = limiter.Check("9.9.9.9")
+	assert.True(t, ok)
+
+	// Other keys have their own buckets:
+	ok, _ = limiter.Allow("5.6.7.8")
+	assert.True(t, ok)
+
+	// Tokens refill at the rate:
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = limiter.Allow("1.2.3.4")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("1.2.3.4")
+	assert.False(t, ok)
+
+	// Full buckets are pruned:
+	now = now.Add(2 * time.Minute)
+	ok, _ = limiter.Allow("1.2.3.4")
+	assert.True(t, ok)
+	assert.Equals(t, len(limiter.buckets), 1)
+}
@@ -11,11 +11,20 @@ import (
 
 const (
 	DefaultContinuousRetryTimeMs = 500
+	MaxFailedReplications        = 50 // Max number of failed replications listed in the active tasks
+)
+
+// Values of ActiveTask.Status
+const (
+	ReplicationRunning = "running"
+	ReplicationStopped = "stopped"
+	ReplicationFailed  = "failed"
 )
 
 type Replicator struct {
 	replications      map[string]sgreplicate.SGReplication
 	replicationParams map[string]sgreplicate.ReplicationParameters
+	failed            map[string]*ActiveTask // Replications that stopped with an error, until cancelled
 	lock              sync.RWMutex
 }
 
@@ -30,12 +39,16 @@ type ActiveTask struct {
 	DocWriteFailures uint32      `json:"doc_write_failures"`
 	StartLastSeq     uint32      `json:"start_last_seq"`
 	EndLastSeq       interface{} `json:"end_last_seq"`
+	Status           string      `json:"status"`
+	LastError        string      `json:"last_error,omitempty"`
+	failedAt         time.Time
 }
 
 func NewReplicator() *Replicator {
 	return &Replicator{
 		replications:      make(map[string]sgreplicate.SGReplication),
 		replicationParams: make(map[string]sgreplicate.ReplicationParameters),
+		failed:            make(map[string]*ActiveTask),
 	}
 }
 
@@ -45,6 +58,10 @@ func (r *Replicator) Replicate(params sgreplicate.ReplicationParameters, isCance
 
 	if isCancel {
 		if !found {
+			// Cancelling a failed replication removes it from the active tasks:
+			if task := r.removeFailedReplication(params.ReplicationId); task != nil {
+				return task, nil
+			}
 			return nil, HTTPErrorf(http.StatusNotFound, "No replication found matching specified parameters")
 		}
 		return r.stopReplication(replicationId)
@@ -71,6 +88,9 @@ func (r *Replicator) ActiveTasks() (tasks []ActiveTask) {
 		task := r.populateActiveTaskFromReplication(replication, params)
 		tasks = append(tasks, *task)
 	}
+	for _, task := range r.failed {
+		tasks = append(tasks, *task)
+	}
 	return tasks
 
 }
@@ -124,6 +144,33 @@ func (r *Replicator) getReplicationForParams(queryParams sgreplicate.Replication
 
 }
 
+// Records a replication that stopped with an error, so it's listed in the active tasks.
+func (r *Replicator) addFailedReplication(task *ActiveTask, err error) {
+	task.Status = ReplicationFailed
+	task.LastError = err.Error()
+	task.failedAt = time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failed[task.ReplicationID] = task
+	for len(r.failed) > MaxFailedReplications {
+		var oldest *ActiveTask
+		for _, failedTask := range r.failed {
+			if oldest == nil || failedTask.failedAt.Before(oldest.failedAt) {
+				oldest = failedTask
+			}
+		}
+		delete(r.failed, oldest.ReplicationID)
+	}
+}
+
+func (r *Replicator) removeFailedReplication(repId string) *ActiveTask {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	task := r.failed[repId]
+	delete(r.failed, repId)
+	return task
+}
+
 func (r *Replicator) removeReplication(repId string) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
@@ -140,6 +187,7 @@ func (r *Replicator) startReplication(parameters sgreplicate.ReplicationParamete
 	if parameters.ReplicationId == "" {
 		parameters.ReplicationId = CreateUUID()
 	}
+	r.removeFailedReplication(parameters.ReplicationId)
 
 	switch parameters.Lifecycle {
 	case sgreplicate.ONE_SHOT:
@@ -164,6 +212,7 @@ func (r *Replicator) stopReplication(repId string) (task *ActiveTask, err error)
 	}
 
 	taskState := r.populateActiveTaskFromReplication(replication, params)
+	taskState.Status = ReplicationStopped
 
 	r.removeReplication(repId)
 	return taskState, nil
@@ -188,6 +237,10 @@ func (r *Replicator) startOneShotReplication(parameters sgreplicate.ReplicationP
 func (r *Replicator) runOneShotReplication(replication *sgreplicate.Replication, parameters sgreplicate.ReplicationParameters) error {
 	defer r.removeReplication(parameters.ReplicationId)
 	_, err := replication.WaitUntilDone()
+	if err != nil {
+		Warn("Replication %s failed: %v", parameters.ReplicationId, err)
+		r.addFailedReplication(r.populateActiveTaskFromReplication(replication, parameters), err)
+	}
 	return err
 }
 
@@ -238,6 +291,7 @@ func (r *Replicator) populateActiveTaskFromReplication(replication sgreplicate.S
 		DocWriteFailures: stats.GetDocWriteFailures(),
 		StartLastSeq:     stats.GetStartLastSeq(),
 		EndLastSeq:       stats.GetEndLastSeq(),
+		Status:           ReplicationRunning,
 	}
 
 	return
@@ -0,0 +1,44 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+	sgreplicate "github.com/couchbaselabs/sg-replicate"
+)
+
+func TestReplicatorFailedTasks(t *testing.T) {
+	r := NewReplicator()
+	r.addFailedReplication(&ActiveTask{ReplicationID: "rep1"}, errors.New("target unreachable"))
+
+	// Failed replications are listed until they're cancelled:
+	tasks := r.ActiveTasks()
+	assert.Equals(t, len(tasks), 1)
+	assert.Equals(t, tasks[0].Status, ReplicationFailed)
+	assert.Equals(t, tasks[0].LastError, "target unreachable")
+
+	task, err := r.Replicate(sgreplicate.ReplicationParameters{ReplicationId: "rep1"}, true)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, task.ReplicationID, "rep1")
+	assert.Equals(t, len(r.ActiveTasks()), 0)
+	_, err = r.Replicate(sgreplicate.ReplicationParameters{ReplicationId: "rep1"}, true)
+	assert.True(t, err != nil)
+
+	// Only the most recent failures are kept:
+	for i := 0; i < MaxFailedReplications+5; i++ {
+		r.addFailedReplication(&ActiveTask{ReplicationID: fmt.Sprintf("rep%d", i)}, errors.New("oops"))
+	}
+	assert.Equals(t, len(r.ActiveTasks()), MaxFailedReplications)
+	assert.True(t, r.failed["rep0"] == nil)
+}
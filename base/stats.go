@@ -22,6 +22,19 @@ func init() {
 	StatsExpvars.Add("requests_active", 0)
 	StatsExpvars.Add("revisionCache_hits", 0)
 	StatsExpvars.Add("revisionCache_misses", 0)
+	StatsExpvars.Add("revisionCache_evictions", 0)
+	StatsExpvars.Add("auth_passwordRehashes", 0)
+	StatsExpvars.Add("auth_guestChannelGrantsRejected", 0)
+	StatsExpvars.Add("guest_rateLimited", 0)
+	StatsExpvars.Add("dcp_rollbacks", 0)
+	StatsExpvars.Add("revs_idMismatches", 0)
+	StatsExpvars.Add("js_checkouts", 0)
+	StatsExpvars.Add("js_waits", 0)
+	StatsExpvars.Add("js_timeouts", 0)
+	StatsExpvars.Add("js_recycles", 0)
+	StatsExpvars.Add("sessions_expiredDeleted", 0)
+	StatsExpvars.Add("deltas_skippedBySize", 0)
+	StatsExpvars.Add("deltas_skippedByRatio", 0)
 	TimingExpvars = NewSequenceTimingExpvar(KTimingExpvarFrequency, KTimingExpvarVbNo, "st")
 	StatsExpvars.Set("sequenceTiming", TimingExpvars)
 
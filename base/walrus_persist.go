@@ -0,0 +1,356 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+)
+
+// Version of the walrus snapshot file format.  Bump this when making incompatible changes, and
+// teach load() to read the older versions.
+const WalrusSnapshotVersion = 1
+
+// How often a persistent walrus bucket's changes are saved to disk.
+const DefaultWalrusPersistInterval = 5 * time.Second
+
+// The contents of a walrus snapshot file.
+type walrusSnapshot struct {
+	Version    int                           `json:"version"`
+	Docs       map[string]walrusSnapshotDoc  `json:"docs"`
+	DesignDocs map[string]sgbucket.DesignDoc `json:"design_docs,omitempty"`
+}
+
+type walrusSnapshotDoc struct {
+	Value  []byte `json:"value"`
+	JSON   bool   `json:"json,omitempty"` // Whether Value is a JSON doc (else it's raw, like attachments & counters)
+	Flags  uint32 `json:"flags,omitempty"`
+	Expiry uint32 `json:"exp,omitempty"`
+}
+
+// A wrapper around an in-memory walrus bucket that saves its docs and design docs to a file, and
+// loads them back when it's reopened.  This is only meant for development, so that sync functions
+// etc. can be iterated on without losing the data every time Sync Gateway restarts.
+//
+// The snapshot is loaded into the bucket before anything else can use it, so a TAP/DCP feed with
+// backfill sees the saved docs just as it would see existing docs in a Couchbase Server bucket.
+// Sync Gateway's own sequence counter and _sync metadata are ordinary docs, so they're saved too.
+type PersistentWalrusBucket struct {
+	Bucket
+	path       string                        // Path of the snapshot file
+	interval   time.Duration                 // How often to save, if there were changes
+	lock       sync.Mutex                    // Protects the fields below
+	dirty      bool                          // Has the bucket changed since it was last saved?
+	designDocs map[string]sgbucket.DesignDoc // Design docs, since buckets can't list them
+	closed     chan struct{}                 // Closed when the bucket is, to stop the saver goroutine
+}
+
+// Returns the snapshot directory of a walrus server URL like "walrus:/path/to/dir", "file:dir",
+// "/path/to/dir" or "./dir", or "" if the URL doesn't specify one (i.e. is just "walrus:").
+func WalrusPersistenceDir(serverURL string) string {
+	dir := serverURL
+	for _, prefix := range []string{"walrus:", "file://", "file:"} {
+		if strings.HasPrefix(dir, prefix) {
+			dir = dir[len(prefix):]
+			break
+		}
+	}
+	return dir
+}
+
+// Returns true if a bucket in a walrus directory is stored in walrus's own "<bucket>.walrus" file,
+// as it was before snapshots, rather than in a snapshot.  Walrus then keeps loading and saving
+// that file, the same as when the URL names it, so that the data in it isn't ignored.
+func UsesWalrusFile(dir string, bucketName string) bool {
+	if _, err := os.Stat(walrusSnapshotPath(dir, bucketName)); err == nil {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(dir, bucketName+".walrus"))
+	return err == nil && !info.IsDir()
+}
+
+func walrusSnapshotPath(dir string, bucketName string) string {
+	return filepath.Join(dir, bucketName+".walrus.json")
+}
+
+// Wraps an in-memory walrus bucket so that it's persisted to a file in dir, first loading the
+// file's contents into the bucket if it exists.  The bucket should be empty.
+func NewPersistentWalrusBucket(bucket Bucket, dir string, interval time.Duration) (*PersistentWalrusBucket, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	pb := &PersistentWalrusBucket{
+		Bucket:     bucket,
+		path:       walrusSnapshotPath(dir, bucket.GetName()),
+		interval:   interval,
+		designDocs: map[string]sgbucket.DesignDoc{},
+		closed:     make(chan struct{}),
+	}
+	if err := pb.load(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go pb.saveRegularly()
+	}
+	return pb, nil
+}
+
+// Loads the snapshot file, if there is one, into the bucket.
+func (pb *PersistentWalrusBucket) load() error {
+	data, err := ioutil.ReadFile(pb.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snapshot walrusSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("Can't read walrus snapshot %s: %v", pb.path, err)
+	}
+	if snapshot.Version != WalrusSnapshotVersion {
+		return fmt.Errorf("Walrus snapshot %s has unsupported version %d", pb.path, snapshot.Version)
+	}
+
+	for key, doc := range snapshot.Docs {
+		if doc.JSON {
+			err = pb.Bucket.Write(key, int(doc.Flags), int(doc.Expiry), json.RawMessage(doc.Value), 0)
+		} else {
+			err = pb.Bucket.Write(key, int(doc.Flags), int(doc.Expiry), doc.Value, sgbucket.Raw)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for name, ddoc := range snapshot.DesignDocs {
+		if err := pb.Bucket.PutDDoc(name, ddoc); err != nil {
+			return err
+		}
+		pb.designDocs[name] = ddoc
+	}
+	Logf("Loaded %d docs and %d design docs into walrus bucket %s from %s",
+		len(snapshot.Docs), len(snapshot.DesignDocs), pb.GetName(), pb.path)
+	return nil
+}
+
+// Writes the bucket's contents to the snapshot file, if they've changed since the last save.
+// The file is replaced atomically, so a crash can't leave a partly-written snapshot behind.
+func (pb *PersistentWalrusBucket) Save() error {
+	pb.lock.Lock()
+	if !pb.dirty {
+		pb.lock.Unlock()
+		return nil
+	}
+	pb.dirty = false
+	snapshot := walrusSnapshot{
+		Version:    WalrusSnapshotVersion,
+		Docs:       map[string]walrusSnapshotDoc{},
+		DesignDocs: make(map[string]sgbucket.DesignDoc, len(pb.designDocs)),
+	}
+	for name, ddoc := range pb.designDocs {
+		snapshot.DesignDocs[name] = ddoc
+	}
+	pb.lock.Unlock()
+
+	err := pb.readDocs(snapshot.Docs)
+	if err == nil {
+		err = pb.writeSnapshot(&snapshot)
+	}
+	if err != nil {
+		pb.setDirty() // Try again next time
+		return err
+	}
+	LogTo("Walrus", "Saved %d docs of walrus bucket %s to %s", len(snapshot.Docs), pb.GetName(), pb.path)
+	return nil
+}
+
+// Reads all the docs in the bucket by backfilling a TAP feed.
+func (pb *PersistentWalrusBucket) readDocs(docs map[string]walrusSnapshotDoc) error {
+	feed, err := pb.Bucket.StartTapFeed(sgbucket.TapArguments{Backfill: 0, Dump: true})
+	if err != nil {
+		return err
+	}
+	defer feed.Close()
+	for event := range feed.Events() {
+		switch event.Opcode {
+		case sgbucket.TapMutation:
+			docs[string(event.Key)] = walrusSnapshotDoc{
+				Value:  event.Value,
+				JSON:   isJSONObject(event.Value),
+				Flags:  event.Flags,
+				Expiry: event.Expiry,
+			}
+		case sgbucket.TapDeletion:
+			delete(docs, string(event.Key))
+		case sgbucket.TapEndBackfill:
+			return nil
+		}
+	}
+	return nil
+}
+
+func isJSONObject(data []byte) bool {
+	var raw json.RawMessage
+	return len(data) > 0 && data[0] == '{' && json.Unmarshal(data, &raw) == nil
+}
+
+func (pb *PersistentWalrusBucket) writeSnapshot(snapshot *walrusSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tempPath := pb.path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, pb.path)
+}
+
+func (pb *PersistentWalrusBucket) saveRegularly() {
+	ticker := time.NewTicker(pb.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := pb.Save(); err != nil {
+				Warn("Couldn't save walrus bucket %s to %s: %v", pb.GetName(), pb.path, err)
+			}
+		case <-pb.closed:
+			return
+		}
+	}
+}
+
+func (pb *PersistentWalrusBucket) setDirty() {
+	pb.lock.Lock()
+	pb.dirty = true
+	pb.lock.Unlock()
+}
+
+// Saves the bucket one last time before closing it.
+func (pb *PersistentWalrusBucket) Close() {
+	close(pb.closed)
+	if err := pb.Save(); err != nil {
+		Warn("Couldn't save walrus bucket %s to %s: %v", pb.GetName(), pb.path, err)
+	}
+	pb.Bucket.Close()
+}
+
+//////// Bucket methods that change it:
+
+func (pb *PersistentWalrusBucket) Add(k string, exp int, v interface{}) (bool, error) {
+	defer pb.setDirty()
+	return pb.Bucket.Add(k, exp, v)
+}
+func (pb *PersistentWalrusBucket) AddRaw(k string, exp int, v []byte) (bool, error) {
+	defer pb.setDirty()
+	return pb.Bucket.AddRaw(k, exp, v)
+}
+func (pb *PersistentWalrusBucket) Append(k string, data []byte) error {
+	defer pb.setDirty()
+	return pb.Bucket.Append(k, data)
+}
+func (pb *PersistentWalrusBucket) Set(k string, exp int, v interface{}) error {
+	defer pb.setDirty()
+	return pb.Bucket.Set(k, exp, v)
+}
+func (pb *PersistentWalrusBucket) SetRaw(k string, exp int, v []byte) error {
+	defer pb.setDirty()
+	return pb.Bucket.SetRaw(k, exp, v)
+}
+func (pb *PersistentWalrusBucket) Delete(k string) error {
+	defer pb.setDirty()
+	return pb.Bucket.Delete(k)
+}
+func (pb *PersistentWalrusBucket) Remove(k string, cas uint64) (uint64, error) {
+	defer pb.setDirty()
+	return pb.Bucket.Remove(k, cas)
+}
+func (pb *PersistentWalrusBucket) Write(k string, flags int, exp int, v interface{}, opt sgbucket.WriteOptions) error {
+	defer pb.setDirty()
+	return pb.Bucket.Write(k, flags, exp, v, opt)
+}
+func (pb *PersistentWalrusBucket) WriteCas(k string, flags int, exp int, cas uint64, v interface{}, opt sgbucket.WriteOptions) (uint64, error) {
+	defer pb.setDirty()
+	return pb.Bucket.WriteCas(k, flags, exp, cas, v, opt)
+}
+func (pb *PersistentWalrusBucket) Update(k string, exp int, callback sgbucket.UpdateFunc) error {
+	defer pb.setDirty()
+	return pb.Bucket.Update(k, exp, callback)
+}
+func (pb *PersistentWalrusBucket) WriteUpdate(k string, exp int, callback sgbucket.WriteUpdateFunc) error {
+	defer pb.setDirty()
+	return pb.Bucket.WriteUpdate(k, exp, callback)
+}
+func (pb *PersistentWalrusBucket) Incr(k string, amt, def uint64, exp int) (uint64, error) {
+	defer pb.setDirty()
+	return pb.Bucket.Incr(k, amt, def, exp)
+}
+func (pb *PersistentWalrusBucket) WriteCasWithXattr(k string, xattr string, exp int, cas uint64, v interface{}, xv interface{}) (uint64, error) {
+	defer pb.setDirty()
+	return pb.Bucket.WriteCasWithXattr(k, xattr, exp, cas, v, xv)
+}
+func (pb *PersistentWalrusBucket) WriteUpdateWithXattr(k string, xattr string, exp int, callback sgbucket.WriteUpdateWithXattrFunc) (uint64, error) {
+	defer pb.setDirty()
+	return pb.Bucket.WriteUpdateWithXattr(k, xattr, exp, callback)
+}
+func (pb *PersistentWalrusBucket) DeleteWithXattr(k string, xattr string) error {
+	defer pb.setDirty()
+	return pb.Bucket.DeleteWithXattr(k, xattr)
+}
+func (pb *PersistentWalrusBucket) SetBulk(entries []*sgbucket.BulkSetEntry) error {
+	defer pb.setDirty()
+	return pb.Bucket.SetBulk(entries)
+}
+
+func (pb *PersistentWalrusBucket) PutDDoc(docname string, value interface{}) error {
+	if err := pb.Bucket.PutDDoc(docname, value); err != nil {
+		return err
+	}
+	// Keep a copy, since the bucket has no way to list its design docs:
+	var ddoc sgbucket.DesignDoc
+	if err := pb.Bucket.GetDDoc(docname, &ddoc); err != nil {
+		return err
+	}
+	pb.lock.Lock()
+	pb.designDocs[docname] = ddoc
+	pb.dirty = true
+	pb.lock.Unlock()
+	return nil
+}
+func (pb *PersistentWalrusBucket) DeleteDDoc(docname string) error {
+	if err := pb.Bucket.DeleteDDoc(docname); err != nil {
+		return err
+	}
+	pb.lock.Lock()
+	delete(pb.designDocs, docname)
+	pb.dirty = true
+	pb.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,103 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbaselabs/go.assert"
+	"github.com/couchbaselabs/walrus"
+)
+
+func TestWalrusPersistenceDir(t *testing.T) {
+	assert.Equals(t, WalrusPersistenceDir("walrus:"), "")
+	assert.Equals(t, WalrusPersistenceDir("walrus:/tmp/data"), "/tmp/data")
+	assert.Equals(t, WalrusPersistenceDir("file:data"), "data")
+	assert.Equals(t, WalrusPersistenceDir("file:///tmp/data"), "/tmp/data")
+	assert.Equals(t, WalrusPersistenceDir("./data"), "./data")
+}
+
+func TestUsesWalrusFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walrus_file")
+	assertNoError(t, err, "TempDir")
+	defer os.RemoveAll(dir)
+
+	assert.False(t, UsesWalrusFile(dir, "db"))
+	// A bucket saved by walrus itself keeps using its file:
+	assertNoError(t, ioutil.WriteFile(filepath.Join(dir, "db.walrus"), []byte{}, 0600), "WriteFile")
+	assert.True(t, UsesWalrusFile(dir, "db"))
+	assert.False(t, UsesWalrusFile(dir, "other"))
+	// unless it also has a snapshot:
+	assertNoError(t, ioutil.WriteFile(filepath.Join(dir, "db.walrus.json"), []byte{}, 0600), "WriteFile")
+	assert.False(t, UsesWalrusFile(dir, "db"))
+}
+
+func TestPersistentWalrusBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walrus_persist")
+	assert.Equals(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	bucket, err := NewPersistentWalrusBucket(walrus.NewBucket("persisted"), dir, 0)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, bucket.Set("doc1", 0, map[string]interface{}{"foo": "bar"}), nil)
+	assert.Equals(t, bucket.SetRaw("_sync:att:abc", 0, []byte("attachment")), nil)
+	_, err = bucket.Incr("_sync:seq", 5, 5, 0)
+	assert.Equals(t, err, nil)
+	ddoc := sgbucket.DesignDoc{Views: sgbucket.ViewMap{"all": sgbucket.ViewDef{Map: `function(doc,meta){emit(meta.id,null);}`}}}
+	assert.Equals(t, bucket.PutDDoc("test", ddoc), nil)
+	bucket.Close()
+
+	// Reopening the bucket restores everything:
+	bucket, err = NewPersistentWalrusBucket(walrus.NewBucket("persisted"), dir, 0)
+	assert.Equals(t, err, nil)
+	defer bucket.Close()
+	var doc map[string]interface{}
+	_, err = bucket.Get("doc1", &doc)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, doc["foo"], "bar")
+	raw, _, err := bucket.GetRaw("_sync:att:abc")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, string(raw), "attachment")
+	seq, err := bucket.Incr("_sync:seq", 1, 0, 0)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, seq, uint64(6))
+	vres, err := bucket.View("test", "all", map[string]interface{}{"stale": false})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(vres.Rows), 1)
+
+	// A backfilling feed sees the restored docs:
+	feed, err := bucket.StartTapFeed(sgbucket.TapArguments{Backfill: 0, Dump: true})
+	assert.Equals(t, err, nil)
+	keys := map[string]bool{}
+	for event := range feed.Events() {
+		if event.Opcode == sgbucket.TapMutation {
+			keys[string(event.Key)] = true
+		} else if event.Opcode == sgbucket.TapEndBackfill {
+			break
+		}
+	}
+	feed.Close()
+	assert.DeepEquals(t, keys, map[string]bool{"doc1": true, "_sync:att:abc": true, "_sync:seq": true})
+}
+
+func TestPersistentWalrusBucketBadVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walrus_persist")
+	assert.Equals(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "versioned.walrus.json")
+	assert.Equals(t, ioutil.WriteFile(path, []byte(`{"version":99,"docs":{}}`), 0600), nil)
+	_, err = NewPersistentWalrusBucket(walrus.NewBucket("versioned"), dir, 0)
+	assert.True(t, err != nil)
+}
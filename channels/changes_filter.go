@@ -0,0 +1,81 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"fmt"
+	"time"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/robertkrimen/otto"
+)
+
+// Wraps a CouchDB-style changes filter function.  It's called as (doc, req), where req.query has
+// the request's query parameters, and the doc passes the filter if it returns a truthy value.  The
+// sync function callbacks are hidden by local functions that fail the call.
+const changesFilterWrapper = `
+	function(doc, req) {
+
+		var f = %s;
+
+		function notAllowed(name) {
+			return function() {
+				throw(name + "() can't be called from a filter function");
+			};
+		}
+		var channel = notAllowed("channel");
+		var access = notAllowed("access");
+		var role = notAllowed("role");
+		var expiry = notAllowed("expiry");
+		var reject = notAllowed("reject");
+
+		return f(doc, req) ? true : false;
+	}`
+
+// Runs a JS changes filter function.  It shares the SyncRunner implementation, including its
+// timeout, with the ChannelMapper.
+type ChangesFilterFunction struct {
+	*JSFunction // "Superclass"
+}
+
+// Creates a SyncRunner for a changes filter function.  Also useful for checking the function's syntax.
+func NewChangesFilterRunner(funcSource string, timeout time.Duration) (*SyncRunner, error) {
+	runner := &SyncRunner{timeout: timeout, wrapper: changesFilterWrapper}
+	runner.after = func(result otto.Value, err error) (interface{}, error) {
+		if err != nil {
+			return false, err
+		}
+		return result.ToBoolean()
+	}
+	if err := runner.init(fmt.Sprintf(changesFilterWrapper, funcSource)); err != nil {
+		return nil, err
+	}
+	return runner, nil
+}
+
+// Creates a ChangesFilterFunction whose invocations are aborted after the given timeout (0 for no limit).
+func NewChangesFilterFunction(fnSource string, timeout time.Duration) *ChangesFilterFunction {
+	return &ChangesFilterFunction{
+		JSFunction: NewJSFunction(fmt.Sprintf("filter/%v", timeout), fnSource,
+			func(fnSource string) (sgbucket.JSServerTask, error) {
+				return NewChangesFilterRunner(fnSource, timeout)
+			}),
+	}
+}
+
+// Runs the filter function on a doc's JSON body, with the request's query parameters.  An exception
+// thrown by the function, or a timeout (ErrSyncFnTimeout), is returned as err.
+func (filter *ChangesFilterFunction) Filter(docJSON string, query map[string]interface{}) (bool, error) {
+	result, err := filter.Call(sgbucket.JSONString(docJSON), map[string]interface{}{"query": query})
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
+}
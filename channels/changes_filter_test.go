@@ -0,0 +1,56 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestChangesFilterFunction(t *testing.T) {
+	filter := NewChangesFilterFunction(`function(doc, req) {
+		return doc.type == req.query.type;
+	}`, DefaultSyncFnTimeout)
+
+	passed, err := filter.Filter(`{"type": "task"}`, map[string]interface{}{"type": "task"})
+	assertNoError(t, err, "Filter failed")
+	assert.True(t, passed)
+
+	passed, err = filter.Filter(`{"type": "note"}`, map[string]interface{}{"type": "task"})
+	assertNoError(t, err, "Filter failed")
+	assert.False(t, passed)
+
+	// Exceptions, and the sync function callbacks, fail the call:
+	filter = NewChangesFilterFunction(`function(doc) {throw("oops");}`, DefaultSyncFnTimeout)
+	_, err = filter.Filter(`{}`, nil)
+	assert.True(t, err != nil)
+	filter = NewChangesFilterFunction(`function(doc) {channel("foo"); return true;}`, DefaultSyncFnTimeout)
+	_, err = filter.Filter(`{}`, nil)
+	assert.True(t, err != nil)
+
+	_, err = NewChangesFilterRunner(`function(doc) {`, 0)
+	assert.True(t, err != nil)
+}
+
+func TestChangesFilterTimeout(t *testing.T) {
+	filter := NewChangesFilterFunction(`function(doc) {while (true) {}}`, 100*time.Millisecond)
+	_, err := filter.Filter(`{}`, nil)
+	assert.Equals(t, err, ErrSyncFnTimeout)
+
+	// The recycled runner still returns the filter's result:
+	filter = NewChangesFilterFunction(`function(doc) {while (doc.loop) {} return true;}`, 100*time.Millisecond)
+	_, err = filter.Filter(`{"loop": true}`, nil)
+	assert.Equals(t, err, ErrSyncFnTimeout)
+	passed, err := filter.Filter(`{}`, nil)
+	assertNoError(t, err, "Filter failed")
+	assert.True(t, passed)
+}
@@ -10,6 +10,9 @@
 package channels
 
 import (
+	"fmt"
+	"time"
+
 	_ "github.com/robertkrimen/otto/underscore"
 
 	sgbucket "github.com/couchbase/sg-bucket"
@@ -18,27 +21,42 @@ import (
 
 /** Result of running a channel-mapper function. */
 type ChannelMapperOutput struct {
-	Channels  base.Set
-	Roles     AccessMap // roles granted to users via role() callback
-	Access    AccessMap
-	Rejection error
+	Channels    base.Set
+	Roles       AccessMap // roles granted to users via role() callback
+	Access      AccessMap
+	Rejection   error
+	Expiry      *uint32     // expiry set via expiry() callback, as a Couchbase Server expiry value
+	GrantExpiry GrantExpiry // expiry times of time-limited access() and role() grants
 }
 
 type ChannelMapper struct {
-	*sgbucket.JSServer // "Superclass"
+	*JSFunction // "Superclass"
 }
 
 // Maps user names (or role names prefixed with "role:") to arrays of channel or role names
 type AccessMap map[string]base.Set
 
-// Number of SyncRunner tasks (and Otto contexts) to cache
-const kTaskCacheSize = 4
+// Maps user names (or role names prefixed with "role:") to the channel or role names they were
+// granted until a given time, and that time as a Unix timestamp.  Grants not listed don't expire.
+type AccessExpiryMap map[string]map[string]int64
+
+// Expiry times of the time-limited grants made by the access() and role() callbacks, keyed the
+// same way as ChannelMapperOutput's Access and Roles.
+type GrantExpiry struct {
+	Access AccessExpiryMap
+	Roles  AccessExpiryMap
+}
 
 func NewChannelMapper(fnSource string) *ChannelMapper {
+	return NewChannelMapperWithTimeout(fnSource, DefaultSyncFnTimeout)
+}
+
+// Creates a ChannelMapper whose function invocations are aborted after the given timeout (0 for no limit).
+func NewChannelMapperWithTimeout(fnSource string, timeout time.Duration) *ChannelMapper {
 	return &ChannelMapper{
-		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
+		JSFunction: NewJSFunction(fmt.Sprintf("sync/%v", timeout), fnSource,
 			func(fnSource string) (sgbucket.JSServerTask, error) {
-				return NewSyncRunner(fnSource)
+				return NewSyncRunnerWithTimeout(fnSource, timeout)
 			}),
 	}
 }
@@ -47,8 +65,10 @@ func NewDefaultChannelMapper() *ChannelMapper {
 	return NewChannelMapper(`function(doc){channel(doc.channels);}`)
 }
 
-func (mapper *ChannelMapper) MapToChannelsAndAccess(body map[string]interface{}, oldBodyJSON string, userCtx map[string]interface{}) (*ChannelMapperOutput, error) {
-	result1, err := mapper.Call(body, sgbucket.JSONString(oldBodyJSON), userCtx)
+// Runs the sync function.  metaMap is passed to the function as its third argument, and
+// describes the old revision and the source of the write.
+func (mapper *ChannelMapper) MapToChannelsAndAccess(body map[string]interface{}, oldBodyJSON string, metaMap map[string]interface{}, userCtx map[string]interface{}) (*ChannelMapperOutput, error) {
+	result1, err := mapper.Call(body, sgbucket.JSONString(oldBodyJSON), metaMap, userCtx)
 	if err != nil {
 		return nil, err
 	}
@@ -72,8 +92,8 @@ func ForChangedUsers(a, b AccessMap, fn func(user string)) {
 	}
 }
 
-func (runner *SyncRunner) MapToChannelsAndAccess(body map[string]interface{}, oldBodyJSON string, userCtx map[string]interface{}) (*ChannelMapperOutput, error) {
-	result, err := runner.Call(body, sgbucket.JSONString(oldBodyJSON), userCtx)
+func (runner *SyncRunner) MapToChannelsAndAccess(body map[string]interface{}, oldBodyJSON string, metaMap map[string]interface{}, userCtx map[string]interface{}) (*ChannelMapperOutput, error) {
+	result, err := runner.Call(body, sgbucket.JSONString(oldBodyJSON), metaMap, userCtx)
 	if err != nil {
 		return nil, err
 	}
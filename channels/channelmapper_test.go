@@ -12,6 +12,7 @@ package channels
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/couchbaselabs/go.assert"
 
@@ -42,7 +43,7 @@ func TestOttoValueToStringArray(t *testing.T) {
 // verify that our version of Otto treats JSON parsed arrays like real arrays
 func TestJavaScriptWorks(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel(doc.x.concat(doc.y));}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"x":["abc"],"y":["xyz"]}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"x":["abc"],"y":["xyz"]}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Channels, SetOf("abc", "xyz"))
 }
@@ -50,7 +51,7 @@ func TestJavaScriptWorks(t *testing.T) {
 // Just verify that the calls to the channel() fn show up in the output channel list.
 func TestSyncFunction(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel("foo", "bar"); channel("baz")}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": []}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": []}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Channels, SetOf("foo", "bar", "baz"))
 }
@@ -58,37 +59,57 @@ func TestSyncFunction(t *testing.T) {
 // Just verify that the calls to the access() fn show up in the output channel list.
 func TestAccessFunction(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {access("foo", "bar"); access("foo", "baz")}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Access, AccessMap{"foo": SetOf("bar", "baz")})
 }
 
 // Just verify that the calls to the channel() fn show up in the output channel list.
 func TestSyncFunctionTakesArray(t *testing.T) {
-	mapper := NewChannelMapper(`function(doc) {channel(["foo", "bar ok","baz"])}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": []}`), `{}`, noUser)
+	mapper := NewChannelMapper(`function(doc) {channel(["foo", "bar_ok","baz"])}`)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": []}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
-	assert.DeepEquals(t, res.Channels, SetOf("foo", "bar ok", "baz"))
+	assert.DeepEquals(t, res.Channels, SetOf("foo", "bar_ok", "baz"))
+}
+
+// Calling channel() with NoChannels puts the doc in that channel only, even with other channels.
+func TestSyncFunctionNoChannels(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc) {channel(doc.channels); if (doc.type == "config") channel("!none");}`)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"type": "config", "channels": ["foo"]}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Channels, base.SetOf(NoChannels))
+
+	// The runner is reused; the next doc doesn't inherit it:
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"type": "note", "channels": ["foo"]}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Channels, SetOf("foo"))
 }
 
 // Calling channel() with an invalid channel name should return an error.
 func TestSyncFunctionRejectsInvalidChannels(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel(["foo", "bad,name","baz"])}`)
-	_, err := mapper.MapToChannelsAndAccess(parse(`{"channels": []}`), `{}`, noUser)
+	_, err := mapper.MapToChannelsAndAccess(parse(`{"channels": []}`), `{}`, nil, noUser)
+	assert.True(t, err != nil)
+}
+
+// Calling channel() with a name containing a character outside the allowed set should return an error.
+func TestSyncFunctionRejectsDisallowedChannelChars(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc) {channel(["foo", "bar ok","baz"])}`)
+	_, err := mapper.MapToChannelsAndAccess(parse(`{"channels": []}`), `{}`, nil, noUser)
 	assert.True(t, err != nil)
 }
 
 // Calling access() with an invalid channel name should return an error.
 func TestAccessFunctionRejectsInvalidChannels(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {access("foo", "bad,name");}`)
-	_, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	_, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
 	assert.True(t, err != nil)
 }
 
 // Just verify that the calls to the access() fn show up in the output channel list.
 func TestAccessFunctionTakesArrayOfUsers(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {access(["foo","bar","baz"], "ginger")}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Access, AccessMap{"bar": SetOf("ginger"), "baz": SetOf("ginger"), "foo": SetOf("ginger")})
 }
@@ -96,14 +117,14 @@ func TestAccessFunctionTakesArrayOfUsers(t *testing.T) {
 // Just verify that the calls to the access() fn show up in the output channel list.
 func TestAccessFunctionTakesArrayOfChannels(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {access("lee", ["ginger", "earl_grey", "green"])}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Access, AccessMap{"lee": SetOf("ginger", "earl_grey", "green")})
 }
 
 func TestAccessFunctionTakesArrayOfChannelsAndUsers(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {access(["lee", "nancy"], ["ginger", "earl_grey", "green"])}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Access["lee"], SetOf("ginger", "earl_grey", "green"))
 	assert.DeepEquals(t, res.Access["nancy"], SetOf("ginger", "earl_grey", "green"))
@@ -111,42 +132,42 @@ func TestAccessFunctionTakesArrayOfChannelsAndUsers(t *testing.T) {
 
 func TestAccessFunctionTakesEmptyArrayUser(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {access([], ["ginger", "earl grey", "green"])}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Access, AccessMap{})
 }
 
 func TestAccessFunctionTakesEmptyArrayChannels(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {access("lee", [])}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Access, AccessMap{})
 }
 
 func TestAccessFunctionTakesNullUser(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {access(null, ["ginger", "earl grey", "green"])}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Access, AccessMap{})
 }
 
 func TestAccessFunctionTakesNullChannels(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {access("lee", null)}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Access, AccessMap{})
 }
 
 func TestAccessFunctionTakesNonChannelsInArray(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {access("lee", ["ginger", null, 5])}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Access, AccessMap{"lee": SetOf("ginger")})
 }
 
 func TestAccessFunctionTakesUndefinedUser(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {var x = {}; access(x.nothing, ["ginger", "earl grey", "green"])}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Access, AccessMap{})
 }
@@ -155,15 +176,56 @@ func TestAccessFunctionTakesUndefinedUser(t *testing.T) {
 // implementation with access(), so most of the above tests also apply to it.)
 func TestRoleFunction(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {role(["foo","bar","baz"], "role:froods")}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Roles, AccessMap{"bar": SetOf("froods"), "baz": SetOf("froods"), "foo": SetOf("froods")})
 }
 
+// Test the object form of access() and role(), which makes a time-limited grant
+func TestAccessFunctionWithExpiry(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc) {
+		access({name: "foo", until: "2030-07-01T00:00:00Z"}, ["bar", "baz"]);
+		access("foo", "baz");
+		access({name: ["alice", "role:froods"], until: "2030-07-01T00:00:00Z"}, "zap");
+		access({name: "alice", until: "2031-07-01T00:00:00Z"}, "zap");
+		access({name: "bob"}, "zip");
+		role({name: "bob", until: "2030-07-01T00:00:00Z"}, "role:froods");
+	}`)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Access, AccessMap{
+		"foo":         SetOf("bar", "baz"),
+		"alice":       SetOf("zap"),
+		"role:froods": SetOf("zap"),
+		"bob":         SetOf("zip")})
+	assert.DeepEquals(t, res.Roles, AccessMap{"bob": SetOf("froods")})
+
+	until2030 := time.Date(2030, 7, 1, 0, 0, 0, 0, time.UTC).Unix()
+	until2031 := time.Date(2031, 7, 1, 0, 0, 0, 0, time.UTC).Unix()
+	assert.DeepEquals(t, res.GrantExpiry.Access, AccessExpiryMap{
+		"foo":         {"bar": until2030},
+		"alice":       {"zap": until2031},
+		"role:froods": {"zap": until2030}})
+	assert.DeepEquals(t, res.GrantExpiry.Roles, AccessExpiryMap{"bob": {"froods": until2030}})
+
+	// Grants without an expiry don't produce an AccessExpiryMap:
+	mapper = NewChannelMapper(`function(doc) {access("foo", "bar"); role("foo", "role:froods")}`)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.GrantExpiry, GrantExpiry{})
+
+	// An 'until' that isn't an ISO-8601 date fails the call:
+	mapper = NewChannelMapper(`function(doc) {access({name: "foo", until: doc.until}, "bar")}`)
+	_, err = mapper.MapToChannelsAndAccess(parse(`{"until": "next tuesday"}`), `{}`, nil, noUser)
+	assert.True(t, err != nil)
+	_, err = mapper.MapToChannelsAndAccess(parse(`{"until": 12345}`), `{}`, nil, noUser)
+	assert.True(t, err != nil)
+}
+
 // Now just make sure the input comes through intact
 func TestInputParse(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel(doc.channel);}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"channel": "foo"}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channel": "foo"}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Channels, SetOf("foo"))
 }
@@ -171,11 +233,11 @@ func TestInputParse(t *testing.T) {
 // A more realistic example
 func TestDefaultChannelMapper(t *testing.T) {
 	mapper := NewDefaultChannelMapper()
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Channels, SetOf("foo", "bar", "baz"))
 
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"x": "y"}`), `{}`, noUser)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"x": "y"}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Channels, base.Set{})
 }
@@ -183,7 +245,7 @@ func TestDefaultChannelMapper(t *testing.T) {
 // Empty/no-op channel mapper fn
 func TestEmptyChannelMapper(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Channels, base.Set{})
 }
@@ -193,7 +255,7 @@ func TestChannelMapperUnderscoreLib(t *testing.T) {
 	underscore.Enable() // It really slows down unit tests (by making otto.New take a lot longer)
 	defer underscore.Disable()
 	mapper := NewChannelMapper(`function(doc) {channel(_.first(doc.channels));}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Channels, SetOf("foo"))
 }
@@ -201,7 +263,7 @@ func TestChannelMapperUnderscoreLib(t *testing.T) {
 // Validation by calling reject()
 func TestChannelMapperReject(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {reject(403, "bad");}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "bad"))
 }
@@ -209,7 +271,7 @@ func TestChannelMapperReject(t *testing.T) {
 // Rejection by calling throw()
 func TestChannelMapperThrow(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {throw({forbidden:"bad"});}`)
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, noUser)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "bad"))
 }
@@ -217,14 +279,14 @@ func TestChannelMapperThrow(t *testing.T) {
 // Test other runtime exception
 func TestChannelMapperException(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {(nil)[5];}`)
-	_, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, noUser)
+	_, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, nil, noUser)
 	assert.True(t, err != nil)
 }
 
 // Test the public API
 func TestPublicChannelMapper(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel(doc.channels);}`)
-	output, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, noUser)
+	output, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, output.Channels, SetOf("foo", "bar", "baz"))
 }
@@ -235,16 +297,16 @@ func TestCheckUser(t *testing.T) {
 			requireUser(doc.owner);
 		}`)
 	var sally = map[string]interface{}{"name": "sally", "channels": []string{}}
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"owner": "sally"}`), `{}`, sally)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"owner": "sally"}`), `{}`, nil, sally)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, nil)
 
 	var linus = map[string]interface{}{"name": "linus", "channels": []string{}}
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"owner": "sally"}`), `{}`, linus)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"owner": "sally"}`), `{}`, nil, linus)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "wrong user"))
 
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"owner": "sally"}`), `{}`, nil)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"owner": "sally"}`), `{}`, nil, nil)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, nil)
 }
@@ -255,16 +317,16 @@ func TestCheckUserArray(t *testing.T) {
 			requireUser(doc.owners);
 		}`)
 	var sally = map[string]interface{}{"name": "sally", "channels": []string{}}
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"owners": ["sally", "joe"]}`), `{}`, sally)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"owners": ["sally", "joe"]}`), `{}`, nil, sally)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, nil)
 
 	var linus = map[string]interface{}{"name": "linus", "channels": []string{}}
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"owners": ["sally", "joe"]}`), `{}`, linus)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"owners": ["sally", "joe"]}`), `{}`, nil, linus)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "wrong user"))
 
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"owners": ["sally"]}`), `{}`, nil)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"owners": ["sally"]}`), `{}`, nil, nil)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, nil)
 }
@@ -275,16 +337,16 @@ func TestCheckRole(t *testing.T) {
 			requireRole(doc.role);
 		}`)
 	var sally = map[string]interface{}{"name": "sally", "roles": map[string]int{"girl": 1, "5yo": 1}}
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"role": "girl"}`), `{}`, sally)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"role": "girl"}`), `{}`, nil, sally)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, nil)
 
 	var linus = map[string]interface{}{"name": "linus", "roles": []string{"boy", "musician"}}
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"role": "girl"}`), `{}`, linus)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"role": "girl"}`), `{}`, nil, linus)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "missing role"))
 
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"role": "girl"}`), `{}`, nil)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"role": "girl"}`), `{}`, nil, nil)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, nil)
 }
@@ -295,16 +357,16 @@ func TestCheckRoleArray(t *testing.T) {
 			requireRole(doc.roles);
 		}`)
 	var sally = map[string]interface{}{"name": "sally", "roles": map[string]int{"girl": 1, "5yo": 1}}
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"roles": ["kid","girl"]}`), `{}`, sally)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"roles": ["kid","girl"]}`), `{}`, nil, sally)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, nil)
 
 	var linus = map[string]interface{}{"name": "linus", "roles": map[string]int{"boy": 1, "musician": 1}}
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"roles": ["girl"]}`), `{}`, linus)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"roles": ["girl"]}`), `{}`, nil, linus)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "missing role"))
 
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"roles": ["girl"]}`), `{}`, nil)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"roles": ["girl"]}`), `{}`, nil, nil)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, nil)
 }
@@ -315,16 +377,16 @@ func TestCheckAccess(t *testing.T) {
 		requireAccess(doc.channel)
 	}`)
 	var sally = map[string]interface{}{"name": "sally", "roles": []string{"girl", "5yo"}, "channels": []string{"party", "school"}}
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"channel": "party"}`), `{}`, sally)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channel": "party"}`), `{}`, nil, sally)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, nil)
 
 	var linus = map[string]interface{}{"name": "linus", "roles": []string{"boy", "musician"}, "channels": []string{"party", "school"}}
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"channel": "work"}`), `{}`, linus)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"channel": "work"}`), `{}`, nil, linus)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "missing channel access"))
 
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"channel": "magic"}`), `{}`, nil)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"channel": "magic"}`), `{}`, nil, nil)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, nil)
 }
@@ -335,33 +397,187 @@ func TestCheckAccessArray(t *testing.T) {
 		requireAccess(doc.channels)
 	}`)
 	var sally = map[string]interface{}{"name": "sally", "roles": []string{"girl", "5yo"}, "channels": []string{"party", "school"}}
-	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["swim","party"]}`), `{}`, sally)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["swim","party"]}`), `{}`, nil, sally)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, nil)
 
 	var linus = map[string]interface{}{"name": "linus", "roles": []string{"boy", "musician"}, "channels": []string{"party", "school"}}
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["work"]}`), `{}`, linus)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["work"]}`), `{}`, nil, linus)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "missing channel access"))
 
-	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["magic"]}`), `{}`, nil)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["magic"]}`), `{}`, nil, nil)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, nil)
+}
+
+// Test requireAccess with "*" and prefix grants in userCtx.channels
+func TestCheckAccessWildcards(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc, oldDoc) {
+		requireAccess(doc.channels)
+	}`)
+	var star = map[string]interface{}{"name": "star", "channels": []string{"*"}}
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["anything"]}`), `{}`, nil, star)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, nil)
+
+	var tenant = map[string]interface{}{"name": "tenant", "channels": []string{"tenant-1-*"}}
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["other", "tenant-1-orders"]}`), `{}`, nil, tenant)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, nil)
+
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["tenant-2-orders"]}`), `{}`, nil, tenant)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "missing channel access"))
+}
+
+// Test requireAdmin(), which only passes when there's no user context
+func TestCheckAdmin(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc, oldDoc) {
+		if (doc.type == "config")
+			requireAdmin();
+		channel(doc.channels);
+	}`)
+	var sally = map[string]interface{}{"name": "sally", "channels": []string{"*"}}
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"type": "config", "channels": ["ABC"]}`), `{}`, nil, sally)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "admin access required"))
+	assert.DeepEquals(t, res.Channels, SetOf())
+
+	var guest = map[string]interface{}{"name": "", "channels": []string{}}
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"type": "config", "channels": ["ABC"]}`), `{}`, nil, guest)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "admin access required"))
+
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"type": "note", "channels": ["ABC"]}`), `{}`, nil, sally)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, nil)
+
+	// Admin writes and resync have no user context:
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"type": "config", "channels": ["ABC"]}`), `{}`, nil, nil)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, nil)
+	assert.DeepEquals(t, res.Channels, SetOf("ABC"))
+
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"type": "config", "channels": ["ABC"]}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, res.Rejection, nil)
 }
 
+// Test that requireAdmin() and an explicit throw({forbidden:...}) can be combined
+func TestCheckAdminWithThrow(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc, oldDoc) {
+		if (doc.locked)
+			throw({forbidden: "doc is locked"});
+		try {
+			requireAdmin();
+		} catch (x) {
+			if (doc.owner != "sally")
+				throw({forbidden: "only admins or the owner: " + x.forbidden});
+		}
+		channel(doc.channels);
+	}`)
+	var sally = map[string]interface{}{"name": "sally", "channels": []string{}}
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"owner": "sally", "channels": ["ABC"]}`), `{}`, nil, sally)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, nil)
+	assert.DeepEquals(t, res.Channels, SetOf("ABC"))
+
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"owner": "linus", "channels": ["ABC"]}`), `{}`, nil, sally)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "only admins or the owner: admin access required"))
+
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"locked": true, "channels": ["ABC"]}`), `{}`, nil, nil)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "doc is locked"))
+}
+
 // Test changing the function
 func TestSetFunction(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel(doc.channels);}`)
-	output, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, noUser)
+	output, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	changed, err := mapper.SetFunction(`function(doc) {channel("all");}`)
 	assertTrue(t, changed, "SetFunction failed")
 	assertNoError(t, err, "SetFunction failed")
-	output, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, noUser)
+	output, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, nil, noUser)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
 	assert.DeepEquals(t, output.Channels, SetOf("all"))
 }
 
+// Test the expiry() callback
+func TestExpiryFunction(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc) {expiry(doc.ttl); expiry(doc.ttl2);}`)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"ttl": 100, "ttl2": "50"}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assertTrue(t, res.Expiry != nil, "Expected expiry to be set")
+	assert.Equals(t, *res.Expiry, uint32(50)) // Earliest expiry wins
+
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"ttl": "2100-01-01T00:00:00Z"}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.Equals(t, *res.Expiry, uint32(4102444800))
+
+	// No call to expiry() leaves it unset
+	mapper = NewChannelMapper(`function(doc) {channel(doc.channels);}`)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo"]}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assertTrue(t, res.Expiry == nil, "Expected expiry to be unset")
+
+	// Invalid values fail the sync function
+	mapper = NewChannelMapper(`function(doc) {expiry(doc.ttl);}`)
+	for _, body := range []string{`{"ttl": -5}`, `{"ttl": "tomorrow"}`, `{"ttl": true}`} {
+		_, err = mapper.MapToChannelsAndAccess(parse(body), `{}`, nil, noUser)
+		assertTrue(t, err != nil, "Expected error for invalid expiry "+body)
+	}
+}
+
+// Test the meta argument, alongside the requireUser helper
+func TestSyncFunctionMeta(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc, oldDoc, meta) {
+		if (oldDoc && !meta.admin) {
+			requireUser(meta.updated_by);
+		}
+		channel(meta.old_channels);
+		channel("gen-" + meta.generation);
+	}`)
+	var linus = map[string]interface{}{"name": "linus", "roles": []string{}, "channels": []string{}}
+	meta := map[string]interface{}{"old_channels": []string{"party"}, "updated_by": "linus", "generation": 2, "admin": false}
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{"x": 1}`, meta, linus)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, nil)
+	assert.DeepEquals(t, res.Channels, SetOf("party", "gen-2"))
+
+	meta["updated_by"] = "lucy"
+	res, err = mapper.MapToChannelsAndAccess(parse(`{}`), `{"x": 1}`, meta, linus)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "wrong user"))
+
+	meta["admin"] = true
+	res, err = mapper.MapToChannelsAndAccess(parse(`{}`), `{"x": 1}`, meta, nil)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, nil)
+}
+
+// Test that a runaway sync function is aborted, and the mapper still works afterwards
+func TestSyncFunctionTimeout(t *testing.T) {
+	mapper := NewChannelMapperWithTimeout(`function(doc) {if (doc.loop) {while (true) {}} channel(doc.channels);}`, 100*time.Millisecond)
+	_, err := mapper.MapToChannelsAndAccess(parse(`{"loop": true}`), `{}`, nil, noUser)
+	assert.Equals(t, err, ErrSyncFnTimeout)
+
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo"]}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed after timeout")
+	assert.DeepEquals(t, res.Channels, SetOf("foo"))
+}
+
+// Test the limit on the number of values passed to callbacks
+func TestSyncFunctionOutputLimit(t *testing.T) {
+	defer func(limit int) { MaxSyncFnOutputSize = limit }(MaxSyncFnOutputSize)
+	MaxSyncFnOutputSize = 10
+	mapper := NewChannelMapper(`function(doc) {for (var i = 0; i < 20; i++) {channel("ch" + i);}}`)
+	_, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
+	assertTrue(t, err != nil, "Expected output limit error")
+}
+
 func TestChangedUsers(t *testing.T) {
 	a := AccessMap{"alice": SetOf("x", "y"), "bita": SetOf("z"), "claire": SetOf("w")}
 	b := AccessMap{"alice": SetOf("x", "z"), "bita": SetOf("z"), "diana": SetOf("w")}
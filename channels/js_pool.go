@@ -0,0 +1,298 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Defaults for JSRunnerPoolOptions
+const (
+	DefaultJSRunnerPoolSize = 32 // Max number of JS runners (Otto VMs), checked out or idle
+	DefaultJSMaxPrograms    = 16 // Max number of distinct functions to keep idle runners for
+)
+
+// Returned when no JS runner became available within the pool's CheckoutTimeout.
+var ErrJSPoolTimeout = base.HTTPErrorf(http.StatusServiceUnavailable, "Timed out waiting for a JavaScript runner")
+
+// Creates a JS runner (a SyncRunner or a sgbucket.JSRunner) running the given function.
+type JSRunnerFactory func(fnSource string) (sgbucket.JSServerTask, error)
+
+type JSRunnerPoolOptions struct {
+	Size            int           // Max number of runners, checked out or idle; 0 for the default
+	CheckoutTimeout time.Duration // Max time a call waits for a runner; 0 waits as long as it takes
+	MaxPrograms     int           // Max number of functions to keep idle runners for; 0 for the default
+}
+
+// A function compiled in a runner.  Runners of the same kind are created by the same factory, so an
+// idle runner can be re-bound to another function of its kind instead of creating a new VM.
+type jsProgram struct {
+	kind   string
+	source string
+}
+
+// A bounded pool of JS runners, shared by all the JS functions in the process (the sync and
+// validate functions, changes filters, import filters and webhook filters of every database.)  A runner is checked
+// out for a single call, then kept idle, with its function compiled, for the next call to the
+// same function.  When the pool is full, the least recently used idle runner is re-bound to the
+// function being called (or discarded, if it's of another kind), and once all the runners are
+// checked out, calls wait for one to be returned.
+type JSRunnerPool struct {
+	options   JSRunnerPoolOptions
+	slots     chan struct{} // Holds a token for each checked-out runner
+	lock      sync.Mutex    // Protects the fields below
+	idle      map[jsProgram][]sgbucket.JSServerTask
+	lru       []jsProgram // Programs with idle runners, least recently used first
+	idleCount int
+}
+
+// The pool used by JSFunctions; replaced by ConfigureJSRunnerPool.
+var jsRunnerPool = NewJSRunnerPool(JSRunnerPoolOptions{})
+
+// Replaces the pool used by all JS functions.  Runners checked out of the old pool are returned
+// to it, and then discarded.  Not thread-safe: should only be called at startup.
+func ConfigureJSRunnerPool(options JSRunnerPoolOptions) {
+	jsRunnerPool = NewJSRunnerPool(options)
+}
+
+func NewJSRunnerPool(options JSRunnerPoolOptions) *JSRunnerPool {
+	if options.Size <= 0 {
+		options.Size = DefaultJSRunnerPoolSize
+	}
+	if options.MaxPrograms <= 0 {
+		options.MaxPrograms = DefaultJSMaxPrograms
+	}
+	return &JSRunnerPool{
+		options: options,
+		slots:   make(chan struct{}, options.Size),
+		idle:    map[jsProgram][]sgbucket.JSServerTask{},
+	}
+}
+
+// Checks out a runner for a program, waiting up to the CheckoutTimeout if they're all checked out.
+// It must be passed to checkin (or discard) when the caller's done with it.
+func (pool *JSRunnerPool) checkout(program jsProgram, factory JSRunnerFactory) (sgbucket.JSServerTask, error) {
+	select {
+	case pool.slots <- struct{}{}:
+	default:
+		base.StatsExpvars.Add("js_waits", 1)
+		var timeout <-chan time.Time
+		if pool.options.CheckoutTimeout > 0 {
+			timer := time.NewTimer(pool.options.CheckoutTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case pool.slots <- struct{}{}:
+		case <-timeout:
+			base.StatsExpvars.Add("js_timeouts", 1)
+			return nil, ErrJSPoolTimeout
+		}
+	}
+	base.StatsExpvars.Add("js_checkouts", 1)
+
+	runner, err := pool.takeRunner(program, factory)
+	if err != nil {
+		<-pool.slots
+	}
+	return runner, err
+}
+
+// Returns a runner for reuse by later calls to the same program.
+func (pool *JSRunnerPool) checkin(program jsProgram, runner sgbucket.JSServerTask) {
+	pool.lock.Lock()
+	pool.idle[program] = append(pool.idle[program], runner)
+	pool.idleCount++
+	pool.touch(program)
+	for len(pool.lru) > pool.options.MaxPrograms {
+		pool.evictProgram(pool.lru[0])
+	}
+	pool.lock.Unlock()
+	<-pool.slots
+}
+
+// Gives up a checked-out runner whose VM can't be reused, e.g. because the function panicked.
+func (pool *JSRunnerPool) discard() {
+	base.StatsExpvars.Add("js_recycles", 1)
+	<-pool.slots
+}
+
+// Returns an idle runner for the program if there is one.  Otherwise, if the pool is full, an
+// idle runner is re-bound to the program, or discarded to make room for a new one.
+func (pool *JSRunnerPool) takeRunner(program jsProgram, factory JSRunnerFactory) (sgbucket.JSServerTask, error) {
+	pool.lock.Lock()
+	if runner := pool.popIdle(program); runner != nil {
+		pool.lock.Unlock()
+		return runner, nil
+	}
+	var rebind sgbucket.JSServerTask
+	if len(pool.slots)+pool.idleCount > pool.options.Size && len(pool.lru) > 0 {
+		// Prefer the least recently used program of the same kind, whose runner can be re-bound:
+		victim := pool.lru[0]
+		for _, p := range pool.lru {
+			if p.kind == program.kind {
+				victim = p
+				break
+			}
+		}
+		runner := pool.popIdle(victim)
+		base.StatsExpvars.Add("js_recycles", 1)
+		if victim.kind == program.kind {
+			rebind = runner
+		}
+	}
+	pool.lock.Unlock()
+
+	if rebind != nil {
+		if _, err := rebind.SetFunction(program.source); err == nil {
+			return rebind, nil
+		}
+		// The function doesn't compile; let the factory report the error
+	}
+	return factory(program.source)
+}
+
+// Removes and returns one of a program's idle runners, or nil.  Must be called with the lock held.
+func (pool *JSRunnerPool) popIdle(program jsProgram) sgbucket.JSServerTask {
+	runners := pool.idle[program]
+	if len(runners) == 0 {
+		return nil
+	}
+	runner := runners[len(runners)-1]
+	if len(runners) == 1 {
+		delete(pool.idle, program)
+		pool.removeFromLRU(program)
+	} else {
+		pool.idle[program] = runners[:len(runners)-1]
+	}
+	pool.idleCount--
+	return runner
+}
+
+// Discards all of a program's idle runners.
+func (pool *JSRunnerPool) evict(program jsProgram) {
+	pool.lock.Lock()
+	pool.evictProgram(program)
+	pool.lock.Unlock()
+}
+
+// Discards all of a program's idle runners.  Must be called with the lock held.
+func (pool *JSRunnerPool) evictProgram(program jsProgram) {
+	count := len(pool.idle[program])
+	base.StatsExpvars.Add("js_recycles", int64(count))
+	pool.idleCount -= count
+	delete(pool.idle, program)
+	pool.removeFromLRU(program)
+}
+
+// Moves a program to the most recently used end of the LRU list.  Must be called with the lock held.
+func (pool *JSRunnerPool) touch(program jsProgram) {
+	pool.removeFromLRU(program)
+	pool.lru = append(pool.lru, program)
+}
+
+func (pool *JSRunnerPool) removeFromLRU(program jsProgram) {
+	for i, p := range pool.lru {
+		if p == program {
+			pool.lru = append(pool.lru[:i], pool.lru[i+1:]...)
+			return
+		}
+	}
+}
+
+// Returns the number of runners (VMs) the pool holds, checked out or idle.
+func (pool *JSRunnerPool) RunnerCount() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return len(pool.slots) + pool.idleCount
+}
+
+//////// JSFunction
+
+// A thread-safe JS function, whose calls run on runners checked out of the shared JSRunnerPool.
+// It takes the place of an sgbucket.JSServer, which keeps its own runners.
+type JSFunction struct {
+	kind    string
+	factory JSRunnerFactory
+	lock    sync.RWMutex // Protects source and closed
+	source  string
+	closed  bool
+}
+
+// Creates a JSFunction.  The kind identifies the factory: runners made by factories of the same
+// kind must be interchangeable after a SetFunction call.
+func NewJSFunction(kind string, fnSource string, factory JSRunnerFactory) *JSFunction {
+	return &JSFunction{kind: kind, factory: factory, source: fnSource}
+}
+
+// Returns the function's JS source.
+func (fn *JSFunction) Function() string {
+	fn.lock.RLock()
+	defer fn.lock.RUnlock()
+	return fn.source
+}
+
+// Changes the function's JS source.  Calls in progress finish with the old function.  Returns
+// true if the source changed.  A syntax error isn't reported until the function is called.
+func (fn *JSFunction) SetFunction(fnSource string) (bool, error) {
+	fn.lock.Lock()
+	defer fn.lock.Unlock()
+	if fnSource == fn.source {
+		return false, nil
+	}
+	fn.source = fnSource
+	return true, nil
+}
+
+// Discards the function's idle runners, once it's been replaced by another.  Calls in progress
+// finish, but their runners are discarded rather than kept for reuse.
+func (fn *JSFunction) Close() {
+	fn.lock.Lock()
+	fn.closed = true
+	program := jsProgram{kind: fn.kind, source: fn.source}
+	fn.lock.Unlock()
+	jsRunnerPool.evict(program)
+}
+
+func (fn *JSFunction) isClosed() bool {
+	fn.lock.RLock()
+	defer fn.lock.RUnlock()
+	return fn.closed
+}
+
+// Calls the function with a runner checked out of the pool.
+func (fn *JSFunction) Call(inputs ...interface{}) (interface{}, error) {
+	pool := jsRunnerPool
+	program := jsProgram{kind: fn.kind, source: fn.Function()}
+	runner, err := pool.checkout(program, fn.factory)
+	if err != nil {
+		return nil, err
+	}
+	returned := false
+	defer func() {
+		// If the call panicked, the VM may be left in a bad state, so don't reuse it:
+		if !returned {
+			pool.discard()
+		}
+	}()
+	result, err := runner.Call(inputs...)
+	if fn.isClosed() {
+		pool.discard()
+	} else {
+		pool.checkin(program, runner)
+	}
+	returned = true
+	return result, err
+}
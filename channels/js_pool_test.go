@@ -0,0 +1,136 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func jsStat(name string) int64 {
+	return base.StatsExpvars.Get(name).(*expvar.Int).Value()
+}
+
+// Installs a pool with the given options for the duration of a test.
+func useJSRunnerPool(options JSRunnerPoolOptions) (pool *JSRunnerPool, restore func()) {
+	oldPool := jsRunnerPool
+	ConfigureJSRunnerPool(options)
+	return jsRunnerPool, func() { jsRunnerPool = oldPool }
+}
+
+func TestJSRunnerPoolReuse(t *testing.T) {
+	pool, restore := useJSRunnerPool(JSRunnerPoolOptions{Size: 2})
+	defer restore()
+
+	mapper := NewChannelMapper(`function(doc) {channel(doc.channels);}`)
+	for i := 0; i < 5; i++ {
+		output, err := mapper.MapToChannelsAndAccess(parse(`{"channels": "foo"}`), `{}`, nil, noUser)
+		assertNoError(t, err, "MapToChannelsAndAccess failed")
+		assert.DeepEquals(t, output.Channels, SetOf("foo"))
+	}
+	// Another mapper with the same function shares the idle runner:
+	mapper2 := NewChannelMapper(`function(doc) {channel(doc.channels);}`)
+	_, err := mapper2.MapToChannelsAndAccess(parse(`{"channels": "foo"}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.Equals(t, pool.RunnerCount(), 1)
+}
+
+func TestJSFunctionClose(t *testing.T) {
+	pool, restore := useJSRunnerPool(JSRunnerPoolOptions{Size: 2})
+	defer restore()
+
+	mapper := NewChannelMapper(`function(doc) {channel(doc.channels);}`)
+	_, err := mapper.MapToChannelsAndAccess(parse(`{"channels": "foo"}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.Equals(t, pool.RunnerCount(), 1)
+
+	// Closing a replaced function discards its idle runner, and any it was still using:
+	mapper.Close()
+	assert.Equals(t, pool.RunnerCount(), 0)
+	_, err = mapper.MapToChannelsAndAccess(parse(`{"channels": "foo"}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.Equals(t, pool.RunnerCount(), 0)
+}
+
+func TestJSRunnerPoolBounded(t *testing.T) {
+	pool, restore := useJSRunnerPool(JSRunnerPoolOptions{Size: 2})
+	defer restore()
+
+	recycles := jsStat("js_recycles")
+	mapper := NewChannelMapper(`function(doc) {channel("a");}`)
+	filter := NewChangesFilterFunction(`function(doc) {return true;}`, DefaultSyncFnTimeout)
+	validator := NewDocValidator(`function(doc) {}`, DefaultSyncFnTimeout)
+	_, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	_, err = filter.Filter(`{}`, nil)
+	assertNoError(t, err, "Filter failed")
+	assert.Equals(t, pool.RunnerCount(), 2)
+
+	// The pool is full, so a new sync function re-binds the idle runner of the old one:
+	mapper = NewChannelMapper(`function(doc) {channel("b");}`)
+	output, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, output.Channels, SetOf("b"))
+	assert.Equals(t, pool.RunnerCount(), 2)
+	assert.Equals(t, jsStat("js_recycles"), recycles+1)
+
+	// and the validator's runner replaces the least recently used one, the filter's:
+	_, err = validator.Validate(parse(`{}`), `{}`, noUser)
+	assertNoError(t, err, "Validate failed")
+	assert.Equals(t, pool.RunnerCount(), 2)
+	assert.Equals(t, jsStat("js_recycles"), recycles+2)
+
+	// A syntax error in a re-bound function is still reported:
+	mapper = NewChannelMapper(`function(doc) {`)
+	_, err = mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil, noUser)
+	assert.True(t, err != nil)
+	assert.True(t, pool.RunnerCount() <= 2)
+}
+
+func TestJSRunnerPoolMaxPrograms(t *testing.T) {
+	pool, restore := useJSRunnerPool(JSRunnerPoolOptions{Size: 4, MaxPrograms: 1})
+	defer restore()
+
+	_, err := NewChangesFilterFunction(`function(doc) {return true;}`, DefaultSyncFnTimeout).Filter(`{}`, nil)
+	assertNoError(t, err, "Filter failed")
+	_, err = NewChangesFilterFunction(`function(doc) {return false;}`, DefaultSyncFnTimeout).Filter(`{}`, nil)
+	assertNoError(t, err, "Filter failed")
+	assert.Equals(t, pool.RunnerCount(), 1)
+}
+
+func TestJSRunnerPoolCheckoutTimeout(t *testing.T) {
+	pool, restore := useJSRunnerPool(JSRunnerPoolOptions{Size: 1, CheckoutTimeout: 50 * time.Millisecond})
+	defer restore()
+
+	filter := NewChangesFilterFunction(`function(doc) {return true;}`, DefaultSyncFnTimeout)
+	program := jsProgram{kind: filter.kind, source: filter.Function()}
+	runner, err := pool.checkout(program, filter.factory)
+	assertNoError(t, err, "checkout failed")
+
+	waits, timeouts := jsStat("js_waits"), jsStat("js_timeouts")
+	_, err = filter.Filter(`{}`, nil)
+	assert.Equals(t, err, ErrJSPoolTimeout)
+	assert.Equals(t, jsStat("js_waits"), waits+1)
+	assert.Equals(t, jsStat("js_timeouts"), timeouts+1)
+
+	// A call that's waiting gets the runner once it's checked in:
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pool.checkin(program, runner)
+	}()
+	passed, err := filter.Filter(`{}`, nil)
+	assertNoError(t, err, "Filter failed")
+	assert.True(t, passed)
+	assert.Equals(t, pool.RunnerCount(), 1)
+}
@@ -11,7 +11,8 @@ package channels
 
 import (
 	"fmt"
-	"regexp"
+	"strings"
+	"unicode"
 
 	"github.com/couchbase/sync_gateway/base"
 )
@@ -29,29 +30,86 @@ const UserStarChannel = "*"     // user channel for "can access all docs"
 const DocumentStarChannel = "!" // doc channel for "visible to all users"
 const AllChannelWildcard = "*"  // wildcard for 'all channels'
 
-var kValidChannelRegexp *regexp.Regexp
+// Passing this to the sync function's channel() puts the doc in no channels, not even "*", so
+// that only admins can see it.  It's the doc's only channel, which only admin feeds include.
+const NoChannels = "!none"
 
-func init() {
-	var err error
-	kValidChannelRegexp, err = regexp.Compile(`,`)
-	if err != nil {
-		panic("Bad IsValidChannel regexp")
+// Characters allowed in channel names in addition to letters and digits
+const DefaultChannelNameChars = "-_.@"
+
+var allowedChannelNameChars = DefaultChannelNameChars
+
+// Allows additional characters in channel names, for compatibility with legacy data.  Commas and
+// "*" can't be allowed, since they're used to separate channel lists and for wildcard grants.
+// Not thread-safe: should only be called at startup.
+func SetExtraChannelNameChars(extra string) error {
+	if strings.ContainsAny(extra, ","+UserStarChannel) {
+		return fmt.Errorf("Channel names can't be allowed to contain %q", extra)
 	}
+	allowedChannelNameChars = DefaultChannelNameChars + extra
+	return nil
 }
 
-func illegalChannelError(name string) error {
-	return base.HTTPErrorf(400, "Illegal channel name %q", name)
+// Returns an error describing why the channel name is invalid, or nil if it's valid.  Channel names
+// consist of letters, digits and the characters in DefaultChannelNameChars (plus any configured via
+// SetExtraChannelNameChars.)  "*" may only appear as the last character, as the all-channels
+// wildcard or a prefix grant, and "!" is only valid as the public channel.
+func ValidateChannelName(channel string) error {
+	if channel == "" {
+		return base.HTTPErrorf(400, "Illegal channel name: channel names can't be empty")
+	}
+	if channel == UserStarChannel || channel == DocumentStarChannel {
+		return nil
+	}
+	for i, r := range channel {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+		case strings.ContainsRune(allowedChannelNameChars, r):
+		case r == '*' && i == len(channel)-1:
+		default:
+			return base.HTTPErrorf(400, "Illegal channel name %q: character %q is not allowed", channel, r)
+		}
+	}
+	return nil
 }
 
 func IsValidChannel(channel string) bool {
-	return len(channel) > 0 && !kValidChannelRegexp.MatchString(channel)
+	return ValidateChannelName(channel) == nil
+}
+
+// A channel grant ending in "*", such as "tenant-123-*", grants access to every channel whose name
+// begins with the preceding characters.  The bare "*" is the all-channels grant, not a prefix grant.
+func IsPrefixGrant(name string) bool {
+	return len(name) > 1 && strings.HasSuffix(name, UserStarChannel)
+}
+
+// Returns true if the channel is matched by the given prefix grant.
+func MatchesPrefixGrant(grant string, channel string) bool {
+	return IsPrefixGrant(grant) && strings.HasPrefix(channel, grant[:len(grant)-1])
+}
+
+// Returns a copy of the set with each prefix grant's matching channels from knownChannels added.
+// The prefix grants themselves are kept.  Returns the original set if it has no prefix grants.
+func ExpandingPrefixGrants(set base.Set, knownChannels base.Set) base.Set {
+	var matches []string
+	for grant := range set {
+		if !IsPrefixGrant(grant) {
+			continue
+		}
+		for channel := range knownChannels {
+			if MatchesPrefixGrant(grant, channel) {
+				matches = append(matches, channel)
+			}
+		}
+	}
+	return set.Union(base.SetFromArray(matches))
 }
 
 // Creates a new Set from an array of strings. Returns an error if any names are invalid.
 func SetFromArray(names []string, mode StarMode) (base.Set, error) {
 	for _, name := range names {
-		if !IsValidChannel(name) {
-			return nil, illegalChannelError(name)
+		if err := ValidateChannelName(name); err != nil {
+			return nil, err
 		}
 	}
 	result := base.SetFromArray(names)
@@ -68,8 +126,8 @@ func SetFromArray(names []string, mode StarMode) (base.Set, error) {
 
 func ValidateChannelSet(set base.Set) error {
 	for name := range set {
-		if !IsValidChannel(name) {
-			return illegalChannelError(name)
+		if err := ValidateChannelName(name); err != nil {
+			return err
 		}
 	}
 	return nil
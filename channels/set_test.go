@@ -16,13 +16,14 @@ import (
 )
 
 func TestIsValidChannel(t *testing.T) {
-	valid := []string{"*", "**", "a", "a ", "a b", "a*b", "FOO", "123", "-z", "foo_bar", "Éclær", "z7_", "!",  "Z∫•", "*!"}
+	valid := []string{"*", "a", "a*", "FOO", "123", "-z", "foo_bar", "Éclær", "z7_", "!", "tenant-123-*", "user@example.com", "v1.2"}
 	for _, ch := range valid {
 		if !IsValidChannel(ch) {
 			t.Errorf("IsValidChannel(%q) should be true", ch)
 		}
 	}
-	invalid := []string{"", "*,*", "a,*", "a, ", "b,?", ",", "Z,∫•", "*,!"}
+	invalid := []string{"", "*,*", "a,*", "a, ", "b,?", ",", "Z,∫•", "*,!", "**", "a*b", "*!", "*a*",
+		"a ", "a b", "Z∫•", "a\tb", "a\nb", "a\x00", "a:b", "a/b", "a!"}
 	for _, ch := range invalid {
 		if IsValidChannel(ch) {
 			t.Errorf("IsValidChannel(%q) should be false", ch)
@@ -64,6 +65,33 @@ func TestSetFromArrayWithStar(t *testing.T) {
 	}
 }
 
+func TestExtraChannelNameChars(t *testing.T) {
+	defer SetExtraChannelNameChars("")
+
+	assert.False(t, IsValidChannel("legacy:channel name"))
+	assertNoError(t, SetExtraChannelNameChars(": "), "SetExtraChannelNameChars failed")
+	assert.True(t, IsValidChannel("legacy:channel name"))
+	assert.False(t, IsValidChannel("legacy/channel"))
+
+	assertTrue(t, SetExtraChannelNameChars(",") != nil, "Commas shouldn't be allowed")
+	assertTrue(t, SetExtraChannelNameChars("*") != nil, "Stars shouldn't be allowed")
+}
+
+func TestPrefixGrants(t *testing.T) {
+	assert.True(t, IsPrefixGrant("tenant-123-*"))
+	assert.False(t, IsPrefixGrant("*"))
+	assert.False(t, IsPrefixGrant("tenant-123"))
+	assert.True(t, MatchesPrefixGrant("tenant-123-*", "tenant-123-orders"))
+	assert.True(t, MatchesPrefixGrant("tenant-123-*", "tenant-123-"))
+	assert.False(t, MatchesPrefixGrant("tenant-123-*", "tenant-1234-orders"))
+	assert.False(t, MatchesPrefixGrant("*", "tenant-123-orders"))
+
+	known := SetOf("tenant-123-orders", "tenant-123-users", "tenant-456-orders")
+	assert.DeepEquals(t, ExpandingPrefixGrants(SetOf("a", "tenant-123-*"), known),
+		SetOf("a", "tenant-123-*", "tenant-123-orders", "tenant-123-users"))
+	assert.DeepEquals(t, ExpandingPrefixGrants(SetOf("a"), known), SetOf("a"))
+}
+
 func TestSetFromArrayError(t *testing.T) {
 	_, err := SetFromArray([]string{""}, RemoveStar)
 	assertTrue(t, err != nil, "SetFromArray didn't return an error")
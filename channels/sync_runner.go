@@ -10,8 +10,12 @@
 package channels
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/robertkrimen/otto"
@@ -21,14 +25,29 @@ import (
 )
 
 const funcWrapper = `
-	function(newDoc, oldDoc, realUserCtx) {
+	function(newDoc, oldDoc, meta, realUserCtx) {
 
 		var v = %s;
 
 		if (oldDoc) {
 			oldDoc._id = newDoc._id;
 		}
+` + userCtxHelpers + `
+		try {
+			v(newDoc, oldDoc, meta);
+		} catch(x) {
+			if (x.forbidden)
+				reject(403, x.forbidden);
+			else if (x.unauthorized)
+				reject(401, x.unauthorized);
+			else
+				throw(x);
+		}
+	}`
 
+// JS helper functions shared by the sync and validate function wrappers: requireUser(),
+// requireRole(), requireAccess() and requireAdmin(), which check the realUserCtx argument.
+const userCtxHelpers = `
 		function makeArray(maybeArray) {
 			if (Array.isArray(maybeArray)) {
 				return maybeArray;
@@ -41,9 +60,14 @@ const funcWrapper = `
 			return array.indexOf(string) != -1;
 		}
 
-		function anyInArray(any, array) {
-			for (var i = 0; i < any.length; ++i) {
-				if (inArray(any[i], array))
+		// True if the channel is in the user's channels, directly, via "*" or via a prefix grant
+		function hasChannelAccess(channel, userChannels) {
+			for (var i = 0; i < userChannels.length; ++i) {
+				var granted = userChannels[i];
+				if (granted == channel || granted == "*")
+					return true;
+				if (granted.length > 1 && granted.charAt(granted.length - 1) == "*" &&
+						channel.indexOf(granted.substring(0, granted.length - 1)) == 0)
 					return true;
 			}
 			return false;
@@ -74,47 +98,90 @@ const funcWrapper = `
 					throw({forbidden: "missing role"});
 		}
 
+		// Passes if the user has access to any of the channels
 		function requireAccess(channels) {
 				if (!shouldValidate) return;
 				channels = makeArray(channels);
-				if (!anyInArray(realUserCtx.channels, channels))
-					throw({forbidden: "missing channel access"});
+				var userChannels = realUserCtx.channels || [];
+				for (var i = 0; i < channels.length; ++i) {
+					if (hasChannelAccess(channels[i], userChannels))
+						return;
+				}
+				throw({forbidden: "missing channel access"});
 		}
 
-		try {
-			v(newDoc, oldDoc);
-		} catch(x) {
-			if (x.forbidden)
-				reject(403, x.forbidden);
-			else if (x.unauthorized)
-				reject(401, x.unauthorized);
-			else
-				throw(x);
+		// Passes only for writes made through the admin API (or by a resync), which have no user context
+		function requireAdmin() {
+				if (shouldValidate)
+					throw({forbidden: "admin access required"});
 		}
-	}`
+`
+
+// Default max time a single sync function invocation may run before it's aborted
+const DefaultSyncFnTimeout = 5 * time.Second
+
+// Max number of values a single sync function invocation may pass to channel(), access() and role()
+var MaxSyncFnOutputSize = 100000
+
+var ErrSyncFnTimeout = errors.New("Sync function timed out")
+
+// Panic value used to unwind the JS VM when the timeout fires
+var errSyncFnHalt = errors.New("Sync function halted")
 
 // An object that runs a specific JS sync() function. Not thread-safe!
 type SyncRunner struct {
 	sgbucket.JSRunner                      // "Superclass"
 	output            *ChannelMapperOutput // Results being accumulated while the JS fn runs
 	channels          []string
+	noChannels        bool                // channel(NoChannels) was called
 	access            map[string][]string // channels granted to users via access() callback
 	roles             map[string][]string // roles granted to users via role() callback
+	accessUntil       grantExpiries       // expiry of each access() grant
+	rolesUntil        grantExpiries       // expiry of each role() grant
+	callbackErr       error               // Invalid argument passed to a callback, fails the call
+	outputSize        int                 // Number of values passed to callbacks so far
+	timeout           time.Duration       // Max execution time per call; 0 for no limit
+	wrapper           string              // Format string that wraps the function source
+	wrappedSource     string              // Current function source, used to recycle the JS VM
+
+	// If set, replaces the After handler, which returns a ChannelMapperOutput
+	after func(otto.Value, error) (interface{}, error)
 }
 
 func NewSyncRunner(funcSource string) (*SyncRunner, error) {
-	funcSource = fmt.Sprintf(funcWrapper, funcSource)
-	runner := &SyncRunner{}
-	err := runner.Init(funcSource)
-	if err != nil {
+	return NewSyncRunnerWithTimeout(funcSource, DefaultSyncFnTimeout)
+}
+
+func NewSyncRunnerWithTimeout(funcSource string, timeout time.Duration) (*SyncRunner, error) {
+	return newSyncRunner(funcWrapper, funcSource, timeout)
+}
+
+func newSyncRunner(wrapper string, funcSource string, timeout time.Duration) (*SyncRunner, error) {
+	runner := &SyncRunner{timeout: timeout, wrapper: wrapper}
+	if err := runner.init(fmt.Sprintf(wrapper, funcSource)); err != nil {
 		return nil, err
 	}
+	return runner, nil
+}
+
+// Creates a fresh JS VM running the given (already wrapped) function, and installs the callbacks.
+func (runner *SyncRunner) init(wrappedSource string) error {
+	if err := runner.Init(wrappedSource); err != nil {
+		return err
+	}
+	runner.wrappedSource = wrappedSource
 
-	// Implementation of the 'channel()' callback:
+	// Implementation of the 'channel()' callback.  The NoChannels sentinel overrides any channels:
 	runner.DefineNativeFunction("channel", func(call otto.FunctionCall) otto.Value {
 		for _, arg := range call.ArgumentList {
-			if strings := ottoValueToStringArray(arg); strings != nil {
-				runner.channels = append(runner.channels, strings...)
+			if strings := ottoValueToStringArray(arg); strings != nil && runner.checkOutputSize(len(strings)) {
+				for _, channel := range strings {
+					if channel == NoChannels {
+						runner.noChannels = true
+					} else {
+						runner.channels = append(runner.channels, channel)
+					}
+				}
 			}
 		}
 		return otto.UndefinedValue()
@@ -122,12 +189,28 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 
 	// Implementation of the 'access()' callback:
 	runner.DefineNativeFunction("access", func(call otto.FunctionCall) otto.Value {
-		return runner.addValueForUser(call.Argument(0), call.Argument(1), runner.access)
+		return runner.addValueForUser(call.Argument(0), call.Argument(1), runner.access, runner.accessUntil)
 	})
 
 	// Implementation of the 'role()' callback:
 	runner.DefineNativeFunction("role", func(call otto.FunctionCall) otto.Value {
-		return runner.addValueForUser(call.Argument(0), call.Argument(1), runner.roles)
+		return runner.addValueForUser(call.Argument(0), call.Argument(1), runner.roles, runner.rolesUntil)
+	})
+
+	// Implementation of the 'expiry()' callback.  If called more than once the earliest expiry wins:
+	runner.DefineNativeFunction("expiry", func(call otto.FunctionCall) otto.Value {
+		expiry, err := ottoValueToExpiry(call.Argument(0))
+		if err != nil {
+			if runner.callbackErr == nil {
+				runner.callbackErr = err
+			}
+			return otto.UndefinedValue()
+		}
+		current := runner.output.Expiry
+		if current == nil || base.CbsExpiryToTime(expiry).Before(base.CbsExpiryToTime(*current)) {
+			runner.output.Expiry = &expiry
+		}
+		return otto.UndefinedValue()
 	})
 
 	// Implementation of the 'reject()' callback:
@@ -147,42 +230,157 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 	runner.Before = func() {
 		runner.output = &ChannelMapperOutput{}
 		runner.channels = []string{}
+		runner.noChannels = false
 		runner.access = map[string][]string{}
 		runner.roles = map[string][]string{}
+		runner.accessUntil = grantExpiries{}
+		runner.rolesUntil = grantExpiries{}
+		runner.callbackErr = nil
+		runner.outputSize = 0
 	}
 	runner.After = func(result otto.Value, err error) (interface{}, error) {
 		output := runner.output
 		runner.output = nil
+		if err == nil {
+			err = runner.callbackErr
+		}
 		if err == nil {
 			output.Channels, err = SetFromArray(runner.channels, ExpandStar)
+			if err == nil && runner.noChannels {
+				output.Channels = base.SetOf(NoChannels)
+			}
 			if err == nil {
 				output.Access, err = compileAccessMap(runner.access, "")
 				if err == nil {
 					output.Roles, err = compileAccessMap(runner.roles, "role:")
+					output.GrantExpiry.Access = runner.accessUntil.compile("")
+					output.GrantExpiry.Roles = runner.rolesUntil.compile("role:")
 				}
 			}
 		}
 		return output, err
 	}
-	return runner, nil
+	if runner.after != nil {
+		runner.After = runner.after
+	}
+	return nil
 }
 
 func (runner *SyncRunner) SetFunction(funcSource string) (bool, error) {
-	funcSource = fmt.Sprintf(funcWrapper, funcSource)
-	return runner.JSRunner.SetFunction(funcSource)
+	funcSource = fmt.Sprintf(runner.wrapper, funcSource)
+	changed, err := runner.JSRunner.SetFunction(funcSource)
+	if err == nil {
+		runner.wrappedSource = funcSource
+	}
+	return changed, err
+}
+
+// Runs the function, aborting it with ErrSyncFnTimeout if it runs longer than the runner's timeout.
+// A runner whose VM was interrupted is recycled, so the next call starts with a clean VM.
+func (runner *SyncRunner) Call(inputs ...interface{}) (result interface{}, err error) {
+	if runner.timeout <= 0 {
+		return runner.JSRunner.Call(inputs...)
+	}
+
+	vm := runner.JS()
+	vm.Interrupt = make(chan func(), 1)
+	timer := time.AfterFunc(runner.timeout, func() {
+		vm.Interrupt <- func() {
+			panic(errSyncFnHalt)
+		}
+	})
+
+	defer func() {
+		caught := recover()
+		if !timer.Stop() {
+			// The timer fired, so the VM was (or is about to be) interrupted - replace it
+			base.StatsExpvars.Add("js_recycles", 1)
+			if initErr := runner.init(runner.wrappedSource); initErr != nil {
+				base.Warn("SyncRunner: Unable to recycle JS runner after timeout: %v", initErr)
+			}
+		}
+		if caught == errSyncFnHalt {
+			result, err = nil, ErrSyncFnTimeout
+		} else if caught != nil {
+			panic(caught)
+		}
+	}()
+
+	return runner.JSRunner.Call(inputs...)
+}
+
+// Counts values passed to the sync function callbacks.  Returns false, and fails the call, once
+// MaxSyncFnOutputSize is exceeded.
+func (runner *SyncRunner) checkOutputSize(count int) bool {
+	runner.outputSize += count
+	if runner.outputSize > MaxSyncFnOutputSize {
+		if runner.callbackErr == nil {
+			runner.callbackErr = fmt.Errorf("Sync function output exceeds limit of %d values", MaxSyncFnOutputSize)
+		}
+		return false
+	}
+	return true
 }
 
 // Common implementation of 'access()' and 'role()' callbacks
-func (runner *SyncRunner) addValueForUser(user otto.Value, value otto.Value, mapping map[string][]string) otto.Value {
+func (runner *SyncRunner) addValueForUser(user otto.Value, value otto.Value, mapping map[string][]string, expiries grantExpiries) otto.Value {
 	valueStrings := ottoValueToStringArray(value)
-	if len(valueStrings) > 0 {
-		for _, name := range ottoValueToStringArray(user) {
+	if len(valueStrings) > 0 && runner.checkOutputSize(len(valueStrings)) {
+		names, until, err := ottoValueToGrantees(user)
+		if err != nil {
+			if runner.callbackErr == nil {
+				runner.callbackErr = err
+			}
+			return otto.UndefinedValue()
+		}
+		for _, name := range names {
 			mapping[name] = append(mapping[name], valueStrings...)
+			expiries.add(name, valueStrings, until)
 		}
 	}
 	return otto.UndefinedValue()
 }
 
+// Expiry times of the grants made by access() or role() during one call, keyed by user/role name
+// and then by channel/role name.  Grants that don't expire are recorded as 0.
+type grantExpiries map[string]map[string]int64
+
+func (expiries grantExpiries) add(name string, values []string, until int64) {
+	userExpiries := expiries[name]
+	if userExpiries == nil {
+		userExpiries = make(map[string]int64, len(values))
+		expiries[name] = userExpiries
+	}
+	for _, value := range values {
+		if oldUntil, exists := userExpiries[value]; exists {
+			userExpiries[value] = mergeGrantExpiry(oldUntil, until)
+		} else {
+			userExpiries[value] = until
+		}
+	}
+}
+
+// Returns an AccessExpiryMap of the grants that expire, stripping the prefix (if any) from the
+// values.  Returns nil if no grants expire.
+func (expiries grantExpiries) compile(prefix string) AccessExpiryMap {
+	var result AccessExpiryMap
+	for name, userExpiries := range expiries {
+		for value, until := range userExpiries {
+			if until == 0 {
+				continue
+			}
+			if result == nil {
+				result = AccessExpiryMap{}
+			}
+			if result[name] == nil {
+				result[name] = map[string]int64{}
+			}
+			result[name][strings.TrimPrefix(value, prefix)] = until
+		}
+	}
+	return result
+}
+
 func compileAccessMap(input map[string][]string, prefix string) (AccessMap, error) {
 	access := make(AccessMap, len(input))
 	for name, values := range input {
@@ -216,3 +414,59 @@ func ottoValueToStringArray(value otto.Value) []string {
 
 	return result
 }
+
+// Converts the first argument of the access() or role() callback into user/role names.  Besides a
+// string or array, this can be an object {name: ..., until: "<ISO-8601 date>"}, which makes the
+// grant time-limited.  The returned expiry is a Unix time, or 0 if the grant doesn't expire.
+func ottoValueToGrantees(value otto.Value) ([]string, int64, error) {
+	if !value.IsObject() || value.Class() == "Array" {
+		return ottoValueToStringArray(value), 0, nil
+	}
+	object := value.Object()
+	nameValue, _ := object.Get("name")
+	names := ottoValueToStringArray(nameValue)
+	untilValue, _ := object.Get("until")
+	if untilValue.IsUndefined() || untilValue.IsNull() {
+		return names, 0, nil
+	}
+	if untilValue.IsString() {
+		if date, err := time.Parse(time.RFC3339, untilValue.String()); err == nil {
+			return names, date.Unix(), nil
+		}
+	}
+	return nil, 0, fmt.Errorf("Invalid 'until' value %s in grant - must be an ISO-8601 date", untilValue)
+}
+
+// Converts the argument of the expiry() callback into a Couchbase Server expiry value.  Accepts a
+// number of seconds from now (as a number or numeric string), or an ISO-8601 date string.
+func ottoValueToExpiry(value otto.Value) (uint32, error) {
+	nativeValue, _ := value.Export()
+
+	var seconds float64
+	switch v := nativeValue.(type) {
+	case float64:
+		seconds = v
+	case int64:
+		seconds = float64(v)
+	case int:
+		seconds = float64(v)
+	case string:
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			seconds = float64(secs)
+		} else if date, err := time.Parse(time.RFC3339, v); err == nil {
+			if !date.After(time.Now()) || date.Unix() > math.MaxUint32 {
+				return 0, fmt.Errorf("Invalid expiry date %q passed to expiry()", v)
+			}
+			return uint32(date.Unix()), nil
+		} else {
+			return 0, fmt.Errorf("Unable to parse %q passed to expiry() as either numeric or date expiry", v)
+		}
+	default:
+		return 0, fmt.Errorf("Invalid value %s passed to expiry() - must be a number of seconds or an ISO-8601 date", value)
+	}
+
+	if seconds < 1 || seconds > math.MaxUint32 {
+		return 0, fmt.Errorf("Invalid expiry %v passed to expiry() - must be a positive number of seconds", seconds)
+	}
+	return uint32(base.SecondsToCbsExpiry(int(seconds))), nil
+}
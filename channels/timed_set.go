@@ -15,6 +15,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/couchbase/sync_gateway/base"
 )
@@ -23,6 +24,7 @@ import (
 type VbSequence struct {
 	VbNo     *uint16 `json:"vb,omitempty"`
 	Sequence uint64  `json:"seq"`
+	Until    int64   `json:"until,omitempty"` // Unix time a time-limited grant expires; 0 if it doesn't
 }
 
 func NewVbSequence(vbNo uint16, sequence uint64) VbSequence {
@@ -42,12 +44,31 @@ func (vbs VbSequence) String() string {
 }
 
 func (vbs VbSequence) Copy() VbSequence {
+	var result VbSequence
 	if vbs.VbNo == nil {
-		return NewVbSimpleSequence(vbs.Sequence)
+		result = NewVbSimpleSequence(vbs.Sequence)
 	} else {
 		vbInt := *vbs.VbNo
-		return NewVbSequence(vbInt, vbs.Sequence)
+		result = NewVbSequence(vbInt, vbs.Sequence)
 	}
+	result.Until = vbs.Until
+	return result
+}
+
+// Returns true if this is a time-limited grant that has expired as of the given time.
+func (vbs VbSequence) IsExpired(now time.Time) bool {
+	return vbs.Until != 0 && vbs.Until <= now.Unix()
+}
+
+// Combines the expiry times of two grants of the same channel: a grant that doesn't expire wins,
+// otherwise the later expiry does.
+func mergeGrantExpiry(a, b int64) int64 {
+	if a == 0 || b == 0 {
+		return 0
+	} else if a > b {
+		return a
+	}
+	return b
 }
 
 func (vbs VbSequence) Equals(other VbSequence) bool {
@@ -119,8 +140,8 @@ func (set TimedSet) AsSet() base.Set {
 
 func (set TimedSet) Validate() error {
 	for name := range set {
-		if !IsValidChannel(name) {
-			return illegalChannelError(name)
+		if err := ValidateChannelName(name); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -148,6 +169,96 @@ func (set TimedSet) Contains(ch string) bool {
 	return exists
 }
 
+// Returns true if any of the set's entries is a prefix grant.
+func (set TimedSet) HasPrefixGrants() bool {
+	for name := range set {
+		if IsPrefixGrant(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the earliest of the set's prefix grants matching the channel, or false if none match.
+func (set TimedSet) PrefixGrantFor(channel string) (VbSequence, bool) {
+	var result VbSequence
+	found := false
+	for name, sequence := range set {
+		if MatchesPrefixGrant(name, channel) && (!found || sequence.Sequence < result.Sequence) {
+			result = sequence
+			found = true
+		}
+	}
+	return result, found
+}
+
+// Returns a copy of the set in which each prefix grant is replaced by the channels in knownChannels
+// that match it, at the sequence of the prefix grant.  Exact grants take precedence.
+func (set TimedSet) ExpandingPrefixGrants(knownChannels base.Set) TimedSet {
+	result := make(TimedSet, len(set))
+	for name, sequence := range set {
+		if !IsPrefixGrant(name) {
+			result[name] = sequence
+		}
+	}
+	for channel := range knownChannels {
+		if _, exists := set[channel]; exists {
+			continue
+		}
+		if sequence, found := set.PrefixGrantFor(channel); found {
+			result[channel] = sequence
+		}
+	}
+	return result
+}
+
+// Returns true if any of the set's entries is a time-limited grant that has expired.
+func (set TimedSet) HasExpired(now time.Time) bool {
+	for _, sequence := range set {
+		if sequence.IsExpired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes entries that are time-limited grants that have expired.  Returns true if any were removed.
+func (set TimedSet) RemoveExpired(now time.Time) bool {
+	changed := false
+	for name, sequence := range set {
+		if sequence.IsExpired(now) {
+			delete(set, name)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Returns the earliest expiry time of the set's time-limited grants, or 0 if there are none.
+func (set TimedSet) NextExpiry() int64 {
+	var result int64
+	for _, sequence := range set {
+		if sequence.Until != 0 && (result == 0 || sequence.Until < result) {
+			result = sequence.Until
+		}
+	}
+	return result
+}
+
+// Sets the expiry time of each entry to its value in expiries; entries not in expiries don't
+// expire.  Returns true if any entry changed.
+func (set TimedSet) UpdateExpiry(expiries map[string]int64) bool {
+	changed := false
+	for name, sequence := range set {
+		if until := expiries[name]; until != sequence.Until {
+			sequence.Until = until
+			set[name] = sequence
+			changed = true
+		}
+	}
+	return changed
+}
+
 // Updates membership to match the given Set. Newly added members will have the given sequence.
 func (set TimedSet) UpdateAtSequence(other base.Set, sequence uint64) bool {
 	changed := false
@@ -183,11 +294,28 @@ func (set TimedSet) Equals(other base.Set) bool {
 }
 
 func (set TimedSet) AddChannel(channelName string, atSequence uint64) bool {
-	if atSequence > 0 {
-		if oldSequence := set[channelName]; oldSequence.Sequence == 0 || atSequence < oldSequence.Sequence {
-			set[channelName] = NewVbSimpleSequence(atSequence)
-			return true
-		}
+	return set.addEntry(channelName, NewVbSimpleSequence(atSequence))
+}
+
+// Adds a sequence-only entry.  If the channel is already present the earliest sequence wins, and
+// the expiry times of the two grants are merged.
+func (set TimedSet) addEntry(channelName string, entry VbSequence) bool {
+	if entry.Sequence == 0 {
+		return false
+	}
+	oldSequence := set[channelName]
+	if oldSequence.Sequence == 0 {
+		set[channelName] = VbSequence{Sequence: entry.Sequence, Until: entry.Until}
+		return true
+	}
+	until := mergeGrantExpiry(oldSequence.Until, entry.Until)
+	if entry.Sequence < oldSequence.Sequence {
+		set[channelName] = VbSequence{Sequence: entry.Sequence, Until: until}
+		return true
+	} else if until != oldSequence.Until {
+		oldSequence.Until = until
+		set[channelName] = oldSequence
+		return true
 	}
 	return false
 }
@@ -201,15 +329,18 @@ func (set TimedSet) Add(other TimedSet) bool {
 func (set TimedSet) AddAtSequence(other TimedSet, atSequence uint64) bool {
 	changed := false
 	for ch, vbSeq := range other {
-		// If vbucket is present, do a straight replace
+		// If vbucket is present, do a straight replace (keeping the longest-lived expiry)
 		if vbSeq.VbNo != nil {
+			if oldSequence, exists := set[ch]; exists {
+				vbSeq.Until = mergeGrantExpiry(oldSequence.Until, vbSeq.Until)
+			}
 			set[ch] = vbSeq
 			changed = true
 		} else {
 			if vbSeq.Sequence < atSequence {
 				vbSeq.Sequence = atSequence
 			}
-			if set.AddChannel(ch, vbSeq.Sequence) {
+			if set.addEntry(ch, vbSeq) {
 				changed = true
 			}
 		}
@@ -228,10 +359,11 @@ func (set TimedSet) AddAtVbSequence(other TimedSet, atVbSequence VbSequence) boo
 }
 
 // For any channel present in both the set and the other set, updates the sequence to the value
-// from the other set
+// from the other set.  The receiver's expiry times are kept.
 func (set TimedSet) UpdateIfPresent(other TimedSet) {
-	for ch := range set {
+	for ch, seq := range set {
 		if otherSeq, ok := other[ch]; ok {
+			otherSeq.Until = seq.Until
 			set[ch] = otherSeq
 		}
 	}
@@ -268,15 +400,16 @@ func (setPtr *TimedSet) UnmarshalJSON(data []byte) error {
 
 func (set TimedSet) MarshalJSON() ([]byte, error) {
 
-	// If no vbuckets are defined, marshal as SequenceOnlySet for backwards compatibility.  Otherwise marshal with vbuckets
-	hasVbucket := false
+	// If no vbuckets or grant expiry times are defined, marshal as SequenceOnlySet for backwards compatibility.
+	// Otherwise marshal with vbuckets
+	needsNormalForm := false
 	for _, vbSeq := range set {
-		if vbSeq.VbNo != nil {
-			hasVbucket = true
+		if vbSeq.VbNo != nil || vbSeq.Until != 0 {
+			needsNormalForm = true
 			break
 		}
 	}
-	if hasVbucket {
+	if needsNormalForm {
 		// Normal form - unmarshal as map[string]VbSequence.  Need to convert back to simple map[string]VbSequence to avoid
 		// having json.Marshal just call back into this function.
 		// Marshals entries as "ABC":{"vb":5,"seq":1} or "CBS":{"seq":1}, depending on whether VbSequence.VbNo is nil
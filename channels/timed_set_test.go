@@ -13,6 +13,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbaselabs/go.assert"
@@ -67,6 +68,68 @@ func TestTimedSetUnmarshal(t *testing.T) {
 	assert.Equals(t, fmt.Sprintf("%s", str.Channels), fmt.Sprintf("%s", TimedSet{"a": NewVbSequence(21, 17), "b": NewVbSequence(25, 23)}))
 }
 
+func TestTimedSetPrefixGrants(t *testing.T) {
+	set := TimedSet{"a": NewVbSimpleSequence(5), "tenant-1-*": NewVbSimpleSequence(10), "tenant-*": NewVbSimpleSequence(20)}
+	assert.True(t, set.HasPrefixGrants())
+	assert.False(t, TimedSet{"a": NewVbSimpleSequence(5)}.HasPrefixGrants())
+
+	grant, found := set.PrefixGrantFor("tenant-1-orders")
+	assert.True(t, found)
+	assert.Equals(t, grant.Sequence, uint64(10))
+	grant, found = set.PrefixGrantFor("tenant-2-orders")
+	assert.True(t, found)
+	assert.Equals(t, grant.Sequence, uint64(20))
+	_, found = set.PrefixGrantFor("b")
+	assert.False(t, found)
+
+	expanded := set.ExpandingPrefixGrants(base.SetOf("a", "b", "tenant-1-orders", "tenant-2-users"))
+	assert.DeepEquals(t, expanded, TimedSet{
+		"a":               NewVbSimpleSequence(5),
+		"tenant-1-orders": NewVbSimpleSequence(10),
+		"tenant-2-users":  NewVbSimpleSequence(20),
+	})
+}
+
+func TestTimedSetGrantExpiry(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	set := TimedSet{
+		"a": NewVbSimpleSequence(5),
+		"b": VbSequence{Sequence: 6, Until: now.Unix() + 60},
+		"c": VbSequence{Sequence: 7, Until: now.Unix() - 60},
+	}
+	assert.True(t, set.HasExpired(now))
+	assert.Equals(t, set.NextExpiry(), now.Unix()-60)
+
+	// Expiry times force the normal form, and survive a round trip:
+	bytes, err := json.Marshal(set)
+	assertNoError(t, err, "Marshal")
+	var set2 TimedSet
+	assertNoError(t, json.Unmarshal(bytes, &set2), "Unmarshal")
+	assert.DeepEquals(t, set2, set)
+
+	assert.True(t, set.RemoveExpired(now))
+	assert.False(t, set.HasExpired(now))
+	assert.DeepEquals(t, set.AsSet(), base.SetOf("a", "b"))
+	assert.Equals(t, set.NextExpiry(), now.Unix()+60)
+
+	// A grant that doesn't expire wins over one that does; otherwise the later expiry wins:
+	set.Add(TimedSet{"b": NewVbSimpleSequence(8)})
+	assert.Equals(t, set["b"], VbSequence{Sequence: 6})
+	set.Add(TimedSet{"a": VbSequence{Sequence: 2, Until: now.Unix() + 10}})
+	assert.Equals(t, set["a"], VbSequence{Sequence: 2})
+	set.Add(TimedSet{"d": VbSequence{Sequence: 9, Until: now.Unix() + 10}})
+	set.Add(TimedSet{"d": VbSequence{Sequence: 10, Until: now.Unix() + 20}})
+	assert.Equals(t, set["d"], VbSequence{Sequence: 9, Until: now.Unix() + 20})
+
+	assert.True(t, set.UpdateExpiry(map[string]int64{"a": now.Unix() + 30}))
+	assert.DeepEquals(t, set, TimedSet{
+		"a": VbSequence{Sequence: 2, Until: now.Unix() + 30},
+		"b": NewVbSimpleSequence(6),
+		"d": NewVbSimpleSequence(9),
+	})
+	assert.False(t, set.UpdateExpiry(map[string]int64{"a": now.Unix() + 30}))
+}
+
 func TestEncodeSequenceID(t *testing.T) {
 	set := TimedSet{"ABC": NewVbSimpleSequence(17), "CBS": NewVbSimpleSequence(23), "BBC": NewVbSimpleSequence(1)}
 	encoded := set.String()
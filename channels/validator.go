@@ -0,0 +1,88 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"fmt"
+	"time"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+)
+
+// Wraps a validate function.  It's called as (doc, oldDoc, userCtx), and can only reject the doc
+// by throwing; the channel(), access(), role() and expiry() callbacks are hidden by local
+// functions that fail the call.
+const validateFuncWrapper = `
+	function(newDoc, oldDoc, realUserCtx) {
+
+		var v = %s;
+
+		if (oldDoc) {
+			oldDoc._id = newDoc._id;
+		}
+` + userCtxHelpers + `
+		function notAllowed(name) {
+			return function() {
+				throw(name + "() can't be called from the validate function");
+			};
+		}
+		var channel = notAllowed("channel");
+		var access = notAllowed("access");
+		var role = notAllowed("role");
+		var expiry = notAllowed("expiry");
+
+		var userCtx = null;
+		if (realUserCtx != null) {
+			userCtx = {name: realUserCtx.name, roles: Object.keys(realUserCtx.roles || {}),
+				channels: realUserCtx.channels || []};
+		}
+
+		try {
+			v(newDoc, oldDoc, userCtx);
+		} catch(x) {
+			if (x.forbidden)
+				reject(403, x.forbidden);
+			else if (x.unauthorized)
+				reject(401, x.unauthorized);
+			else
+				throw(x);
+		}
+	}`
+
+// Runs a JS validate function, which checks document updates before the sync function is called.
+// It shares the SyncRunner implementation, including its timeout, with the ChannelMapper.
+type DocValidator struct {
+	*JSFunction // "Superclass"
+}
+
+// Creates a SyncRunner for a validate function.  Also useful for checking the function's syntax.
+func NewValidateRunner(funcSource string, timeout time.Duration) (*SyncRunner, error) {
+	return newSyncRunner(validateFuncWrapper, funcSource, timeout)
+}
+
+// Creates a DocValidator whose function invocations are aborted after the given timeout (0 for no limit).
+func NewDocValidator(fnSource string, timeout time.Duration) *DocValidator {
+	return &DocValidator{
+		JSFunction: NewJSFunction(fmt.Sprintf("validate/%v", timeout), fnSource,
+			func(fnSource string) (sgbucket.JSServerTask, error) {
+				return NewValidateRunner(fnSource, timeout)
+			}),
+	}
+}
+
+// Runs the validate function.  Returns the rejection, if the function threw {forbidden: ...} or
+// {unauthorized: ...}; any other exception, or a timeout (ErrSyncFnTimeout), is returned as err.
+func (validator *DocValidator) Validate(body map[string]interface{}, oldBodyJSON string, userCtx map[string]interface{}) (rejection error, err error) {
+	result, err := validator.Call(body, sgbucket.JSONString(oldBodyJSON), userCtx)
+	if err != nil {
+		return nil, err
+	}
+	return result.(*ChannelMapperOutput).Rejection, nil
+}
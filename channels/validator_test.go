@@ -0,0 +1,69 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+func TestDocValidator(t *testing.T) {
+	validator := NewDocValidator(`function(doc, oldDoc, userCtx) {
+		if (!doc.title) throw({forbidden: "missing title"});
+		if (oldDoc && oldDoc.locked) throw({unauthorized: "locked"});
+		if (doc.owner && userCtx && doc.owner != userCtx.name) throw({forbidden: "not the owner"});
+	}`, DefaultSyncFnTimeout)
+
+	rejection, err := validator.Validate(parse(`{"title": "hi"}`), `{}`, noUser)
+	assertNoError(t, err, "Validate failed")
+	assert.Equals(t, rejection, nil)
+
+	rejection, err = validator.Validate(parse(`{}`), `{}`, noUser)
+	assertNoError(t, err, "Validate failed")
+	assert.DeepEquals(t, rejection, base.HTTPErrorf(403, "missing title"))
+
+	rejection, err = validator.Validate(parse(`{"title": "hi"}`), `{"locked": true}`, noUser)
+	assertNoError(t, err, "Validate failed")
+	assert.DeepEquals(t, rejection, base.HTTPErrorf(401, "locked"))
+
+	user := map[string]interface{}{"name": "alice", "roles": map[string]interface{}{}, "channels": []string{}}
+	rejection, err = validator.Validate(parse(`{"title": "hi", "owner": "alice"}`), `{}`, user)
+	assertNoError(t, err, "Validate failed")
+	assert.Equals(t, rejection, nil)
+	rejection, err = validator.Validate(parse(`{"title": "hi", "owner": "bob"}`), `{}`, user)
+	assertNoError(t, err, "Validate failed")
+	assert.DeepEquals(t, rejection, base.HTTPErrorf(403, "not the owner"))
+}
+
+// The validate function can't assign channels or grant access.
+func TestDocValidatorCallbacks(t *testing.T) {
+	validator := NewDocValidator(`function(doc) {channel("foo");}`, DefaultSyncFnTimeout)
+	_, err := validator.Validate(parse(`{}`), `{}`, noUser)
+	assert.True(t, err != nil)
+
+	validator = NewDocValidator(`function(doc) {access("alice", "foo");}`, DefaultSyncFnTimeout)
+	_, err = validator.Validate(parse(`{}`), `{}`, noUser)
+	assert.True(t, err != nil)
+}
+
+func TestDocValidatorTimeout(t *testing.T) {
+	validator := NewDocValidator(`function(doc) {if (doc.loop) {while (true) {}}}`, 100*time.Millisecond)
+	_, err := validator.Validate(parse(`{"loop": true}`), `{}`, noUser)
+	assert.Equals(t, err, ErrSyncFnTimeout)
+
+	// The runner is recycled after the timeout, so later calls work:
+	rejection, err := validator.Validate(parse(`{}`), `{}`, noUser)
+	assertNoError(t, err, "Validate failed")
+	assert.Equals(t, rejection, nil)
+}
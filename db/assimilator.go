@@ -19,6 +19,10 @@ func (c *DatabaseContext) watchDocChanges() {
 		if err == nil {
 			if doc.HasValidSyncData(c.writeSequences()) {
 				if c.Shadower != nil {
+					if err := c.loadOutOfLineBody(doc); err != nil {
+						base.Warn("Can't get body of %q to push to external bucket: %v", doc.ID, err)
+						continue
+					}
 					c.Shadower.PushRevision(doc)
 				}
 			} else {
@@ -38,6 +42,9 @@ func (c *DatabaseContext) assimilate(docid string) {
 		if doc.HasValidSyncData(c.writeSequences()) {
 			return nil, nil, couchbase.UpdateCancel // someone beat me to it
 		}
+		if !c.shouldImport(docid, doc.body) {
+			return nil, nil, couchbase.UpdateCancel
+		}
 		if err := db.initializeSyncData(doc); err != nil {
 			return nil, nil, err
 		}
@@ -19,11 +19,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/couchbase/sync_gateway/base"
 )
@@ -35,9 +36,29 @@ const kMaxInlineAttachmentSize = 200
 // JSON bodies smaller than this won't be GZip-encoded.
 const kMinCompressedJSONSize = 300
 
+// Default max length of the name of an attachment being added, in bytes
+const DefaultMaxAttachmentNameLength = 255
+
 // Key for retrieving an attachment from Couchbase.
 type AttachmentKey string
-type AttachmentData map[AttachmentKey][]byte
+
+// The bodies of new attachments to store, by key.
+type AttachmentData map[AttachmentKey]attachmentBody
+
+// A deletion revision has no attachments, so any _attachments in its body are removed before it's
+// stored (rather than storing blobs nothing will read), or rejected if RejectDeletionAttachments
+// is set.  Returns true if they were removed.
+func (db *Database) stripDeletionAttachments(docid string, body Body) (bool, error) {
+	if body["_attachments"] == nil {
+		return false, nil
+	}
+	if db.GetOptions().RejectDeletionAttachments {
+		return false, base.HTTPErrorf(http.StatusBadRequest, "A deletion revision can't have attachments")
+	}
+	db.LogContext.LogTo("CRUD", "Stripping _attachments from deletion of doc %q", docid)
+	delete(body, "_attachments")
+	return true, nil
+}
 
 // Given a CouchDB document body about to be stored in the database, goes through the _attachments
 // dict, finds attachments with inline bodies, copies the bodies into the Couchbase db, and replaces
@@ -56,12 +77,35 @@ func (db *Database) storeAttachments(doc *document, body Body, generation int, p
 		}
 		data := meta["data"]
 		if data != nil {
-			// Attachment contains data, so store it in the db:
-			attachment, err := decodeAttachment(data)
-			if err != nil {
+			if err := db.validateAttachmentName(name); err != nil {
 				return nil, err
 			}
-			key := AttachmentKey(sha1DigestKey(attachment))
+			// Attachment contains data, so store it in the db.  Data read from a MIME part is
+			// spooled, and its digest was computed as it was read:
+			var attachment attachmentBody
+			var length int
+			var key AttachmentKey
+			if spooled, ok := data.(*SpooledAttachment); ok {
+				attachment, length, key = spooled, int(spooled.length), AttachmentKey(spooled.sha1Digest)
+			} else {
+				decoded, err := decodeAttachment(name, data)
+				if err != nil {
+					return nil, err
+				}
+				attachment, length, key = inlineAttachment(decoded), len(decoded), AttachmentKey(sha1DigestKey(decoded))
+			}
+			// The length the client gave has to match the data: the encoded length if it's encoded
+			encoding, encoded := Body(meta).GetString("encoding")
+			if meta["encoding"] != nil && !encoded {
+				return nil, base.HTTPErrorf(400, "Invalid encoding of attachment %q", name)
+			}
+			lengthProperty := "length"
+			if encoded {
+				lengthProperty = "encoded_length"
+			}
+			if declared, ok := Body(meta).GetInt64(lengthProperty); ok && declared != int64(length) {
+				return nil, base.HTTPErrorf(400, "Attachment %q has %s %d, but its data is %d bytes", name, lengthProperty, declared, length)
+			}
 			newAttachmentData[key] = attachment
 
 			newMeta := map[string]interface{}{
@@ -69,17 +113,17 @@ func (db *Database) storeAttachments(doc *document, body Body, generation int, p
 				"digest": string(key),
 				"revpos": generation,
 			}
-			if contentType, ok := meta["content_type"].(string); ok {
+			if contentType, ok := Body(meta).GetString("content_type"); ok {
 				newMeta["content_type"] = contentType
 			}
-			if encoding := meta["encoding"]; encoding != nil {
+			if encoded {
 				newMeta["encoding"] = encoding
-				newMeta["encoded_length"] = len(attachment)
-				if length, ok := meta["length"].(float64); ok {
-					newMeta["length"] = length
+				newMeta["encoded_length"] = length
+				if decodedLength, ok := Body(meta).GetInt64("length"); ok {
+					newMeta["length"] = decodedLength
 				}
 			} else {
-				newMeta["length"] = len(attachment)
+				newMeta["length"] = length
 			}
 			atts[name] = newMeta
 
@@ -88,7 +132,7 @@ func (db *Database) storeAttachments(doc *document, body Body, generation int, p
 			if meta["stub"] != true {
 				return nil, base.HTTPErrorf(400, "Missing data of attachment %q", name)
 			}
-			if revpos, ok := base.ToInt64(meta["revpos"]); !ok || revpos < 1 {
+			if revpos, ok := Body(meta).GetInt64("revpos"); !ok || revpos < 1 {
 				return nil, base.HTTPErrorf(400, "Missing/invalid revpos in stub attachment %q", name)
 			}
 			// Try to look up the attachment in ancestor attachments
@@ -96,18 +140,80 @@ func (db *Database) storeAttachments(doc *document, body Body, generation int, p
 				parentAttachments = db.retrieveAncestorAttachments(doc, parentRev, docHistory)
 			}
 
-			if parentAttachments != nil {
-				if parentAttachment := parentAttachments[name]; parentAttachment != nil {
-					atts[name] = parentAttachment
-				}
-			} else if meta["digest"] == nil {
-				return nil, base.HTTPErrorf(400, "Missing digest in stub attachment %q", name)
+			if parentAttachment := parentAttachments[name]; parentAttachment != nil {
+				atts[name] = parentAttachment
+			} else if _, ok := Body(meta).GetString("digest"); !ok {
+				return nil, base.HTTPErrorf(400, "Missing/invalid digest in stub attachment %q", name)
+			} else if err := db.validateAttachmentName(name); err != nil {
+				return nil, err
 			}
 		}
 	}
 	return newAttachmentData, nil
 }
 
+// Checks the name of an attachment being added: it has to be valid UTF-8, without control
+// characters or ".." path segments, and not too long.  The names of attachments a doc already
+// has aren't checked, so docs stored before names were checked can still be read and updated.
+func (context *DatabaseContext) validateAttachmentName(name string) error {
+	maxLength := context.GetOptions().MaxAttachmentNameLength
+	if maxLength <= 0 {
+		maxLength = DefaultMaxAttachmentNameLength
+	}
+	var reason string
+	if name == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid attachment name")
+	} else if !utf8.ValidString(name) {
+		reason = "it isn't valid UTF-8"
+	} else if len(name) > maxLength {
+		reason = fmt.Sprintf("it's longer than %d bytes", maxLength)
+	} else if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		reason = "it contains control characters"
+	} else {
+		for _, segment := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+			if segment == ".." {
+				reason = `it contains a ".." path segment`
+			}
+		}
+	}
+	if reason != "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid attachment name %q: %s", name, reason)
+	}
+	return nil
+}
+
+// Returns the Content-Disposition header of an attachment.  A name that isn't all printable ASCII
+// is given as an RFC 5987 filename* parameter, after an ASCII filename for older clients with "_"
+// in place of the other characters.
+func AttachmentContentDisposition(name string) string {
+	var filename bytes.Buffer
+	ascii := true
+	for _, r := range name {
+		if r == '"' || r == '\\' {
+			filename.WriteByte('\\')
+			filename.WriteRune(r)
+		} else if r >= 0x20 && r < 0x7f {
+			filename.WriteRune(r)
+		} else {
+			filename.WriteByte('_')
+			ascii = false
+		}
+	}
+	disposition := `attachment; filename="` + filename.String() + `"`
+	if !ascii {
+		var encoded bytes.Buffer
+		for i := 0; i < len(name); i++ {
+			if c := name[i]; c < 0x80 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+				encoded.WriteByte(c)
+			} else {
+				fmt.Fprintf(&encoded, "%%%02X", c)
+			}
+		}
+		disposition += "; filename*=UTF-8''" + encoded.String()
+	}
+	return disposition
+}
+
 // Attempts to retrieve ancestor attachments for a document.  First attempts to find and use a non-pruned ancestor.
 // If no non-pruned ancestor is available, checks whether the currently active doc has a common ancestor with the new revision.
 // If it does, can use the attachments on the active revision with revpos earlier than that common ancestor.
@@ -127,7 +233,7 @@ func (db *Database) retrieveAncestorAttachments(doc *document, parentRev string,
 			for name, activeAttachment := range BodyAttachments(doc.body) {
 				attachmentMeta, ok := activeAttachment.(map[string]interface{})
 				if ok {
-					activeRevpos, ok := base.ToInt64(attachmentMeta["revpos"])
+					activeRevpos, ok := Body(attachmentMeta).GetInt64("revpos")
 					if ok && activeRevpos <= commonAncestorGen {
 						parentAttachments[name] = activeAttachment
 					}
@@ -143,46 +249,86 @@ func (db *Database) retrieveAncestorAttachments(doc *document, parentRev string,
 // marshaler will convert that to base64.
 // If minRevpos is > 0, then only attachments that have been changed in a revision of that
 // generation or later are loaded.
+// The body's top level has to be the caller's own, as the bodies from the revision cache and
+// getRevision are, but the rest of it may be shared with the revision cache.  So if any
+// attachments are loaded, the _attachments map and their metadata are replaced with copies; the
+// metadata of the others, and the rest of the body, aren't copied.  (WriteMultipartDocument only
+// changes the metadata of attachments that have data, which are the copies.)
 func (db *Database) loadBodyAttachments(body Body, minRevpos int) (Body, error) {
-
-	body = body.ImmutableAttachmentsCopy()
-	for _, value := range BodyAttachments(body) {
-		meta := value.(map[string]interface{})
-		revpos, ok := base.ToInt64(meta["revpos"])
+	atts := BodyAttachments(body)
+	var attsCopy map[string]interface{}
+	for name, value := range atts {
+		meta, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, base.HTTPErrorf(http.StatusInternalServerError, "Invalid metadata of attachment %q", name)
+		}
+		revpos, ok := Body(meta).GetInt64("revpos")
 		if ok && revpos >= int64(minRevpos) {
-			key := AttachmentKey(meta["digest"].(string))
-			data, err := db.GetAttachment(key)
+			digest, ok := Body(meta).GetString("digest")
+			if !ok {
+				return nil, base.HTTPErrorf(http.StatusInternalServerError, "Invalid digest of attachment %q", name)
+			}
+			data, err := db.GetAttachment(AttachmentKey(digest))
 			if err != nil {
 				return nil, err
 			}
-			meta["data"] = data
-			delete(meta, "stub")
+			if attsCopy == nil {
+				attsCopy = make(map[string]interface{}, len(atts))
+				for otherName, otherMeta := range atts {
+					attsCopy[otherName] = otherMeta
+				}
+			}
+			metaCopy := make(map[string]interface{}, len(meta)+1)
+			for key, value := range meta {
+				metaCopy[key] = value
+			}
+			metaCopy["data"] = data
+			delete(metaCopy, "stub")
+			attsCopy[name] = metaCopy
 		}
 	}
+	if attsCopy != nil {
+		body["_attachments"] = attsCopy
+	}
 	return body, nil
 }
 
 // Retrieves an attachment given its key.
 func (db *Database) GetAttachment(key AttachmentKey) ([]byte, error) {
-	v, _, err := db.Bucket.GetRaw(attachmentKeyToString(key))
+	if err := db.checkCancelled(); err != nil {
+		return nil, err
+	}
+	var v []byte
+	err := db.retryBucketOp("GetAttachment", true, func() (opErr error) {
+		v, _, opErr = db.Bucket.GetRaw(attachmentKeyToString(key))
+		return opErr
+	})
+	base.MetricAttachmentBytesOut.Add(db.Name, int64(len(v)))
 	return v, err
 }
 
 // Stores a base64-encoded attachment and returns the key to get it by.
 func (db *Database) setAttachment(attachment []byte) (AttachmentKey, error) {
 	key := AttachmentKey(sha1DigestKey(attachment))
-	_, err := db.Bucket.AddRaw(attachmentKeyToString(key), 0, attachment)
+	_, err := base.AddRawWithRetry(db.Bucket, attachmentKeyToString(key), 0, attachment, db.bucketRetryPolicy, db.bucketBreaker)
 	if err == nil {
-		base.LogTo("Attach", "\tAdded attachment %q", key)
+		db.LogContext.LogTo("Attach", "\tAdded attachment %q", key)
+		base.MetricAttachmentBytesIn.Add(db.Name, int64(len(attachment)))
 	}
 	return key, err
 }
 
+// Stores new attachments.  Spooled ones are read into memory one at a time, as they're stored.
 func (db *Database) setAttachments(attachments AttachmentData) error {
-	for key, data := range attachments {
-		_, err := db.Bucket.AddRaw(attachmentKeyToString(key), 0, data)
+	for key, attachment := range attachments {
+		data, err := attachment.Bytes()
+		if err != nil {
+			return err
+		}
+		_, err = base.AddRawWithRetry(db.Bucket, attachmentKeyToString(key), 0, data, db.bucketRetryPolicy, db.bucketBreaker)
 		if err == nil {
-			base.LogTo("Attach", "\tAdded attachment %q", key)
+			db.LogContext.LogTo("Attach", "\tAdded attachment %q", key)
+			base.MetricAttachmentBytesIn.Add(db.Name, int64(len(data)))
 		} else {
 			return err
 		}
@@ -259,14 +405,14 @@ func (db *Database) WriteMultipartDocument(body Body, writer *multipart.Writer,
 	// First extract the attachments that should follow:
 	following := []attInfo{}
 	for name, value := range BodyAttachments(body) {
-		meta := value.(map[string]interface{})
-		if meta["stub"] != true {
+		meta, ok := value.(map[string]interface{})
+		if ok && meta["stub"] != true {
 			var err error
 			var info attInfo
-			info.contentType, _ = meta["content_type"].(string)
-			info.data, err = decodeAttachment(meta["data"])
+			info.contentType, _ = Body(meta).GetString("content_type")
+			info.data, err = decodeAttachment(name, meta["data"])
 			if info.data == nil {
-				base.Warn("Couldn't decode attachment %q of doc %q: %v", name, body["_id"], err)
+				db.LogContext.Warn("Couldn't decode attachment %q of doc %q: %v", name, body["_id"], err)
 				meta["stub"] = true
 				delete(meta, "data")
 			} else if len(info.data) > kMaxInlineAttachmentSize {
@@ -287,7 +433,7 @@ func (db *Database) WriteMultipartDocument(body Body, writer *multipart.Writer,
 		if info.contentType != "" {
 			partHeaders.Set("Content-Type", info.contentType)
 		}
-		partHeaders.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.name))
+		partHeaders.Set("Content-Disposition", AttachmentContentDisposition(info.name))
 		part, _ := writer.CreatePart(partHeaders)
 		part.Write(info.data)
 	}
@@ -331,7 +477,11 @@ func (db *Database) WriteRevisionAsPart(revBody Body, isError bool, compressPart
 	}
 }
 
-func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
+// Reads a multipart/related document: a JSON body followed by a MIME part per attachment with
+// a "follows" property.  The parts may come in any order; each is matched to an attachment by its
+// digest, which is computed as the part is read into the spool.  The attachment's "data" is then
+// the *SpooledAttachment, which must be stored before the spool is closed.
+func ReadMultipartDocument(reader *multipart.Reader, spool *AttachmentSpool) (Body, error) {
 	// First read the main JSON document body:
 	mainPart, err := reader.NextPart()
 	if err != nil {
@@ -347,7 +497,7 @@ func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
 	// Collect the attachments with a "follows" property, which will appear as MIME parts:
 	followingAttachments := map[string]map[string]interface{}{}
 	for name, value := range BodyAttachments(body) {
-		if meta := value.(map[string]interface{}); meta["follows"] == true {
+		if meta, ok := value.(map[string]interface{}); ok && meta["follows"] == true {
 			followingAttachments[name] = meta
 		}
 	}
@@ -358,7 +508,7 @@ func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
 	findFollowingAttachment := func(withDigest string) (string, map[string]interface{}) {
 		for name, meta := range followingAttachments {
 			if meta["follows"] == true {
-				if digest, ok := meta["digest"].(string); ok && digest == withDigest {
+				if digest, ok := Body(meta).GetString("digest"); ok && digest == withDigest {
 					return name, meta
 				}
 			}
@@ -366,6 +516,24 @@ func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
 		return "", nil
 	}
 
+	// Subroutine to find the greatest declared length of the attachments still to be read, so
+	// that a part longer than that is rejected without reading all of it.  Returns -1 if an
+	// attachment's length isn't declared.
+	maxFollowingLength := func() (maxLength int64) {
+		for _, meta := range followingAttachments {
+			if meta["follows"] == true {
+				length, ok := declaredAttachmentLength(meta)
+				if !ok {
+					return -1
+				}
+				if length > maxLength {
+					maxLength = length
+				}
+			}
+		}
+		return maxLength
+	}
+
 	// Read the parts one by one:
 	for i := 0; i < len(followingAttachments); i++ {
 		part, err := reader.NextPart()
@@ -377,37 +545,35 @@ func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
 			}
 			return nil, err
 		}
-		data, err := ioutil.ReadAll(part)
+		maxLength := maxFollowingLength()
+		data, err := spool.add(part, maxLength)
 		part.Close()
 		if err != nil {
 			return nil, err
 		}
+		if maxLength >= 0 && data.length > maxLength {
+			return nil, base.HTTPErrorf(http.StatusBadRequest,
+				"MIME part #%d is longer than any attachment still to be read", i+2)
+		}
 
 		// Look up the attachment by its digest:
-		digest := sha1DigestKey(data)
-		name, meta := findFollowingAttachment(digest)
+		name, meta := findFollowingAttachment(data.sha1Digest)
 		if meta == nil {
-			name, meta = findFollowingAttachment(md5DigestKey(data))
+			name, meta = findFollowingAttachment(data.md5Digest)
 			if meta == nil {
 				return nil, base.HTTPErrorf(http.StatusBadRequest,
 					"MIME part #%d doesn't match any attachment", i+2)
 			}
 		}
 
-		length, ok := base.ToInt64(meta["encoded_length"])
-		if !ok {
-			length, ok = base.ToInt64(meta["length"])
-		}
-		if ok {
-			if length != int64(len(data)) {
-				return nil, base.HTTPErrorf(http.StatusBadRequest, "Attachment length mismatch for %q: read %d bytes, should be %g", name, len(data), length)
-			}
+		if length, ok := declaredAttachmentLength(meta); ok && length != data.length {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Attachment length mismatch for %q: read %d bytes, should be %d", name, data.length, length)
 		}
 
 		// Stuff the data into the attachment metadata and remove the "follows" property:
 		delete(meta, "follows")
 		meta["data"] = data
-		meta["digest"] = digest
+		meta["digest"] = data.sha1Digest
 	}
 
 	// Make sure there are no unused MIME parts:
@@ -422,6 +588,16 @@ func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
 	return body, nil
 }
 
+// Returns the length of an attachment's data as declared in its metadata: its encoded length if
+// it's encoded.
+func declaredAttachmentLength(meta map[string]interface{}) (int64, bool) {
+	length, ok := base.ToInt64(meta["encoded_length"])
+	if !ok {
+		length, ok = base.ToInt64(meta["length"])
+	}
+	return length, ok
+}
+
 type AttachmentCallback func(name string, digest string, knownData []byte, meta map[string]interface{}) ([]byte, error)
 
 // Given a document body, invokes the callback once for each attachment that doesn't include
@@ -439,10 +615,10 @@ func (db *Database) ForEachStubAttachment(body Body, minRevpos int, callback Att
 			return base.HTTPErrorf(400, "Invalid attachment")
 		}
 		if meta["data"] == nil {
-			if revpos, ok := base.ToInt64(meta["revpos"]); revpos < int64(minRevpos) || !ok {
+			if revpos, ok := Body(meta).GetInt64("revpos"); revpos < int64(minRevpos) || !ok {
 				continue
 			}
-			digest, ok := meta["digest"].(string)
+			digest, ok := Body(meta).GetString("digest")
 			if !ok {
 				return base.HTTPErrorf(400, "Invalid attachment")
 			}
@@ -508,13 +684,51 @@ func attachmentKeyToString(key AttachmentKey) string {
 	return "_sync:att:" + string(key)
 }
 
-func decodeAttachment(att interface{}) ([]byte, error) {
+func decodeAttachment(name string, att interface{}) ([]byte, error) {
 	switch att := att.(type) {
 	case []byte:
 		return att, nil
+	case *SpooledAttachment:
+		return att.Bytes()
 	case string:
-		return base64.StdEncoding.DecodeString(att)
+		return decodeBase64Attachment(name, att)
 	default:
-		return nil, base.HTTPErrorf(400, "invalid attachment data (type %T)", att)
+		return nil, base.HTTPErrorf(400, "invalid data of attachment %q (type %T)", name, att)
+	}
+}
+
+// Decodes base64 attachment data in either the standard or the URL-safe alphabet, with or without
+// padding, ignoring whitespace (clients may wrap lines.)  If the data is invalid, the error gives
+// the offset of the first invalid character.
+func decodeBase64Attachment(name string, data string) ([]byte, error) {
+	stripped := make([]byte, 0, len(data))
+	offsets := make([]int, 0, len(data)) // Offset in data of each byte of stripped
+	urlSafe := false
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '-', '_':
+			urlSafe = true
+		}
+		stripped = append(stripped, data[i])
+		offsets = append(offsets, i)
+	}
+	for n := 0; n < 2 && len(stripped) > 0 && stripped[len(stripped)-1] == '='; n++ {
+		stripped = stripped[:len(stripped)-1]
+	}
+
+	encoding := base64.RawStdEncoding
+	if urlSafe {
+		encoding = base64.RawURLEncoding
+	}
+	decoded, err := encoding.DecodeString(string(stripped))
+	if corrupt, ok := err.(base64.CorruptInputError); ok {
+		offset := len(data)
+		if int(corrupt) < len(offsets) {
+			offset = offsets[corrupt]
+		}
+		return nil, base.HTTPErrorf(400, "Invalid base64 data of attachment %q at offset %d", name, offset)
 	}
+	return decoded, err
 }
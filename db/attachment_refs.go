@@ -0,0 +1,97 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/couchbase/go-couchbase"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Prefix of the keys of the docs that list which documents reference an attachment, by digest.
+const kAttachmentRefsKeyPrefix = KSyncKeyPrefix + "attrefs:"
+
+// Max number of documents listed in an attachment's refs.  Once it's full, the oldest are dropped, since
+// they're the likeliest to have removed the attachment.
+const kMaxAttachmentRefs = 100
+
+// The IDs of the documents that have stored an attachment's data, oldest first.  A document may
+// have removed the attachment since, so this is only a list of candidates to check.
+type attachmentRefs struct {
+	DocIDs []string `json:"docs"`
+}
+
+// Records that a document stored the data of the given attachments, so that they can be served by
+// digest to users who can access the document.
+func (db *Database) addAttachmentRefs(docid string, attachments AttachmentData) {
+	for key := range attachments {
+		err := db.retryBucketOp("addAttachmentRefs", true, func() error {
+			return db.Bucket.Update(kAttachmentRefsKeyPrefix+string(key), 0, func(current []byte) ([]byte, error) {
+				var refs attachmentRefs
+				if current != nil {
+					if err := json.Unmarshal(current, &refs); err != nil {
+						return nil, err
+					}
+				}
+				for _, id := range refs.DocIDs {
+					if id == docid {
+						return nil, couchbase.UpdateCancel
+					}
+				}
+				if len(refs.DocIDs) >= kMaxAttachmentRefs {
+					refs.DocIDs = refs.DocIDs[len(refs.DocIDs)-kMaxAttachmentRefs+1:]
+				}
+				refs.DocIDs = append(refs.DocIDs, docid)
+				return json.Marshal(refs)
+			})
+		})
+		if err != nil && err != couchbase.UpdateCancel {
+			db.LogContext.Warn("Unable to record reference from doc %q to attachment %q: %v", docid, key, err)
+		}
+	}
+}
+
+// Given just an attachment's digest, returns its metadata from a document that has it.  The user
+// must be able to access the current revision of at least one document that has the attachment;
+// otherwise this returns a 404, so as not to reveal whether the attachment exists.  The documents
+// are checked newest first, reading each one's current revision through the revision cache.
+func (db *Database) GetAttachmentMetaByDigest(digest string) (map[string]interface{}, error) {
+	rawRefs, _, err := db.Bucket.GetRaw(kAttachmentRefsKeyPrefix + digest)
+	if err != nil {
+		if base.IsDocNotFoundError(err) {
+			err = base.HTTPErrorf(http.StatusNotFound, "missing attachment")
+		}
+		return nil, err
+	}
+	var refs attachmentRefs
+	if err = json.Unmarshal(rawRefs, &refs); err != nil {
+		return nil, err
+	}
+	for i := len(refs.DocIDs) - 1; i >= 0; i-- {
+		docid := refs.DocIDs[i]
+		syncData, err := db.GetDocSyncData(docid)
+		if err != nil || syncData.CurrentRev == "" || syncData.Flags&channels.Deleted != 0 {
+			continue
+		}
+		body, _, inChannels, err := db.revisionCache.Get(docid, syncData.CurrentRev)
+		if err != nil || body == nil || db.authorizeAnyChannel(inChannels) != nil {
+			continue // Not accessible to the user
+		}
+		for _, value := range BodyAttachments(body) {
+			if meta, ok := value.(map[string]interface{}); ok && meta["digest"] == digest {
+				return meta, nil
+			}
+		}
+	}
+	return nil, base.HTTPErrorf(http.StatusNotFound, "missing attachment")
+}
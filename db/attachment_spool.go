@@ -0,0 +1,134 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Default max size of an attachment read from a MIME part that's kept in memory until it's
+// stored; bigger ones are spooled to temp files.
+const DefaultAttachmentSpoolThreshold = 256 * 1024
+
+// The body of an attachment to be stored: a []byte (inlineAttachment) or a *SpooledAttachment.
+type attachmentBody interface {
+	Bytes() ([]byte, error)
+}
+
+type inlineAttachment []byte
+
+func (att inlineAttachment) Bytes() ([]byte, error) {
+	return att, nil
+}
+
+// Holds the bodies of the attachments read from the MIME parts of a request until they're
+// stored, so that only one of them at a time has to be in memory.  Small ones are kept in memory
+// and the rest in temp files, which Close deletes.
+type AttachmentSpool struct {
+	threshold int64
+	lock      sync.Mutex
+	files     []*os.File
+}
+
+// The body of an attachment read into an AttachmentSpool.  Its digests are computed as it's read.
+type SpooledAttachment struct {
+	data       []byte   // The body, if it's kept in memory
+	file       *os.File // Otherwise the temp file it's spooled to
+	length     int64
+	sha1Digest string
+	md5Digest  string
+}
+
+// Creates a spool that keeps attachments of up to threshold bytes in memory.
+func NewAttachmentSpool(threshold int) *AttachmentSpool {
+	return &AttachmentSpool{threshold: int64(threshold)}
+}
+
+// Reads an attachment body into the spool.  If maxLength is 0 or more, reading stops after
+// maxLength+1 bytes, so that a too-long body can be rejected without reading all of it.
+func (spool *AttachmentSpool) add(input io.Reader, maxLength int64) (*SpooledAttachment, error) {
+	if maxLength >= 0 {
+		input = io.LimitReader(input, maxLength+1)
+	}
+	sha1Digester, md5Digester := sha1.New(), md5.New()
+	input = io.TeeReader(input, io.MultiWriter(sha1Digester, md5Digester))
+
+	var buffer bytes.Buffer
+	length, err := io.CopyN(&buffer, input, spool.threshold+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	att := &SpooledAttachment{}
+	if length <= spool.threshold {
+		att.data = buffer.Bytes()
+	} else {
+		if att.file, err = spool.createFile(); err != nil {
+			return nil, err
+		}
+		if _, err = att.file.Write(buffer.Bytes()); err != nil {
+			return nil, err
+		}
+		var rest int64
+		if rest, err = io.Copy(att.file, input); err != nil {
+			return nil, err
+		}
+		length += rest
+	}
+	att.length = length
+	att.sha1Digest = "sha1-" + base64.StdEncoding.EncodeToString(sha1Digester.Sum(nil))
+	att.md5Digest = "md5-" + base64.StdEncoding.EncodeToString(md5Digester.Sum(nil))
+	return att, nil
+}
+
+func (spool *AttachmentSpool) createFile() (*os.File, error) {
+	file, err := ioutil.TempFile("", "sg_attachment_")
+	if err != nil {
+		base.Warn("Unable to create a temp file to spool an attachment: %v", err)
+		return nil, err
+	}
+	spool.lock.Lock()
+	spool.files = append(spool.files, file)
+	spool.lock.Unlock()
+	return file, nil
+}
+
+// Deletes the spool's temp files.  The attachments read into it can't be stored after this.
+func (spool *AttachmentSpool) Close() {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	for _, file := range spool.files {
+		file.Close()
+		if err := os.Remove(file.Name()); err != nil {
+			base.Warn("Unable to remove attachment spool file %s: %v", file.Name(), err)
+		}
+	}
+	spool.files = nil
+}
+
+// Returns the attachment's body, reading it from its temp file if it was spooled to one.
+func (att *SpooledAttachment) Bytes() ([]byte, error) {
+	if att.file == nil {
+		return att.data, nil
+	}
+	data := make([]byte, att.length)
+	if _, err := io.ReadFull(io.NewSectionReader(att.file, 0, att.length), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,100 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Builds a multipart/related document whose attachments follow as parts, in the given order.
+func makeMultipartDocument(t *testing.T, atts map[string]string, order []string, corrupt string) *multipart.Reader {
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	meta := map[string]interface{}{}
+	for name, data := range atts {
+		meta[name] = map[string]interface{}{"follows": true, "length": len(data), "digest": sha1DigestKey([]byte(data))}
+	}
+	part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	assertNoError(t, err, "CreatePart")
+	part.Write([]byte(tojson(Body{"_attachments": meta})))
+	for _, name := range order {
+		part, err = writer.CreatePart(textproto.MIMEHeader{})
+		assertNoError(t, err, "CreatePart")
+		if name == corrupt {
+			part.Write([]byte(strings.ToUpper(atts[name])))
+		} else {
+			part.Write([]byte(atts[name]))
+		}
+	}
+	writer.Close()
+	return multipart.NewReader(&buffer, writer.Boundary())
+}
+
+func TestReadMultipartDocumentSpooled(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	atts := map[string]string{
+		"small.txt": "tiny",
+		"big.txt":   strings.Repeat("spooled to a file; ", 10),
+	}
+
+	// Parts may come in any order; the big one goes to a temp file:
+	spool := NewAttachmentSpool(16)
+	body, err := ReadMultipartDocument(makeMultipartDocument(t, atts, []string{"big.txt", "small.txt"}, ""), spool)
+	assertNoError(t, err, "ReadMultipartDocument")
+	big := BodyAttachments(body)["big.txt"].(map[string]interface{})
+	spooled := big["data"].(*SpooledAttachment)
+	assert.True(t, spooled.file != nil)
+	assert.Equals(t, big["digest"], sha1DigestKey([]byte(atts["big.txt"])))
+	small := BodyAttachments(body)["small.txt"].(map[string]interface{})
+	assert.True(t, small["data"].(*SpooledAttachment).file == nil)
+
+	// Storing the doc stores the attachments from the spool:
+	_, err = db.Put("doc", body)
+	assertNoError(t, err, "Put")
+	data, err := db.GetAttachment(AttachmentKey(sha1DigestKey([]byte(atts["big.txt"]))))
+	assertNoError(t, err, "GetAttachment")
+	assert.Equals(t, string(data), atts["big.txt"])
+	fileName := spooled.file.Name()
+	spool.Close()
+	_, err = os.Stat(fileName)
+	assert.True(t, os.IsNotExist(err))
+
+	// A part that doesn't match its attachment's digest is rejected, and nothing is stored:
+	atts["big.txt"] = strings.Repeat("never stored; ", 10)
+	spool = NewAttachmentSpool(16)
+	_, err = ReadMultipartDocument(makeMultipartDocument(t, atts, []string{"small.txt", "big.txt"}, "big.txt"), spool)
+	assertHTTPError(t, err, 400)
+	spool.Close()
+	_, err = db.GetAttachment(AttachmentKey(sha1DigestKey([]byte(atts["big.txt"]))))
+	assert.True(t, err != nil)
+
+	// So is a part longer than any attachment still to be read, before it's all read:
+	spool = NewAttachmentSpool(16)
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	part, _ := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	part.Write([]byte(`{"_attachments": {"a.txt": {"follows": true, "length": 5}}}`))
+	part, _ = writer.CreatePart(textproto.MIMEHeader{})
+	part.Write([]byte(fmt.Sprintf("%0100d", 0)))
+	writer.Close()
+	_, err = ReadMultipartDocument(multipart.NewReader(&buffer, writer.Boundary()), spool)
+	assertHTTPError(t, err, 400)
+	spool.Close()
+}
@@ -10,9 +10,13 @@
 package db
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/couchbase/sync_gateway/channels"
@@ -129,3 +133,227 @@ func TestAttachmentForRejectedDocument(t *testing.T) {
 	assertTrue(t, err != nil, "Expect error when attempting to retrieve attachment document after doc is rejected.")
 
 }
+
+func TestDecodeAttachment(t *testing.T) {
+	// The base64 of "hello world?>" has a '/', which is '_' in the URL-safe alphabet:
+	expected := []byte("hello world?>")
+	for _, encoded := range []string{
+		"aGVsbG8gd29ybGQ/Pg==", // standard
+		"aGVsbG8gd29ybGQ_Pg==", // URL-safe
+		"aGVsbG8gd29ybGQ_Pg",   // URL-safe, unpadded
+		"aGVsbG8g\r\nd29y bGQ/\tPg==\n",
+	} {
+		decoded, err := decodeAttachment("a.txt", encoded)
+		assertNoError(t, err, "decodeAttachment "+encoded)
+		assert.DeepEquals(t, decoded, expected)
+	}
+
+	// Invalid characters, including mixed alphabets:
+	_, err := decodeAttachment("a.txt", "aGVs\nbG8*d29ybGQ=")
+	assertHTTPError(t, err, 400)
+	assert.Equals(t, err.Error(), `400 Invalid base64 data of attachment "a.txt" at offset 8`)
+	_, err = decodeAttachment("a.txt", "aGVsbG8gd29ybGQ/Pg-_")
+	assertHTTPError(t, err, 400)
+	assert.Equals(t, err.Error(), `400 Invalid base64 data of attachment "a.txt" at offset 15`)
+	_, err = decodeAttachment("a.txt", 17)
+	assertHTTPError(t, err, 400)
+}
+
+func TestAttachmentLengthMismatch(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	_, err := db.Put("doc1", unjson(`{"_attachments": {"hello.txt": {"data":"aGVsbG8gd29ybGQ=", "length": 12}}}`))
+	assertHTTPError(t, err, 400)
+	assert.Equals(t, err.Error(), `400 Attachment "hello.txt" has length 12, but its data is 11 bytes`)
+
+	_, err = db.Put("doc1", unjson(`{"_attachments": {"hello.txt": {"data":"aGVsbG8gd29ybGQ=", "length": 11}}}`))
+	assertNoError(t, err, "Put")
+}
+
+// Malformed attachment metadata is rejected with a 400, rather than panicking.
+func TestMalformedAttachments(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	for _, atts := range []string{
+		`[]`,
+		`{"a": "hello"}`,
+		`{"a": {"data": 17}}`,
+		`{"a": {"data": "aGVsbG8=", "encoding": 1}}`,
+		`{"a": {"stub": true}}`,
+		`{"a": {"stub": true, "revpos": "1"}}`,
+		`{"a": {"stub": true, "revpos": 1, "digest": 17}}`,
+	} {
+		_, err := db.Put("doc1", unjson(`{"_attachments": `+atts+`}`))
+		assertHTTPError(t, err, 400)
+	}
+
+	// Random metadata, through both new revisions and new_edits=false:
+	values := []interface{}{nil, "", "aGVsbG8=", "sha1-qvTGHdzF6KLavt4PO0gs2a6pQ00=", 5.0, -1.5, true,
+		[]interface{}{1}, map[string]interface{}{}}
+	keys := []string{"data", "stub", "digest", "revpos", "length", "encoding", "encoded_length", "content_type", "follows"}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		meta := map[string]interface{}{}
+		for _, key := range keys {
+			if random.Intn(2) == 0 {
+				meta[key] = values[random.Intn(len(values))]
+			}
+		}
+		body := Body{"_attachments": map[string]interface{}{"a": meta}}
+		docid := fmt.Sprintf("doc%d", i)
+		var err error
+		if i%2 == 0 {
+			_, err = db.Put(docid, body)
+		} else {
+			err = db.PutExistingRev(docid, body, []string{"2-b", "1-a"})
+		}
+		if err == nil {
+			// (The attachment a stub refers to may not exist)
+			_, err = db.GetRev(docid, "", false, []string{})
+		}
+		status, _ := base.ErrorAsHTTPStatus(err)
+		assert.True(t, status < 500)
+	}
+}
+
+func TestAttachmentNames(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	attach := func(docid, name string) error {
+		_, err := db.Put(docid, Body{"_attachments": map[string]interface{}{name: map[string]interface{}{"data": "aGVsbG8="}}})
+		return err
+	}
+	for _, name := range []string{"", "bad\x01name", "tab\there", "../etc/passwd", "a/../b", `a\..\b`, "..", "\xff\xfe.txt", strings.Repeat("x", 256)} {
+		assertHTTPError(t, attach("doc", name), 400)
+	}
+	for i, name := range []string{"images/logo.png", "日本語.txt", "a..b", "..hidden", strings.Repeat("x", 255)} {
+		assertNoError(t, attach(fmt.Sprintf("doc%d", i), name), fmt.Sprintf("attach %q", name))
+	}
+
+	// A doc whose attachment names are no longer allowed can still be read and updated, as long as
+	// it doesn't add attachments with such names:
+	longName := strings.Repeat("y", 100)
+	revid, err := db.Put("old", Body{"_attachments": map[string]interface{}{longName: map[string]interface{}{"data": "aGVsbG8="}}})
+	assertNoError(t, err, "Put")
+	db.Options.MaxAttachmentNameLength = 50
+	body, err := db.GetRev("old", "", false, []string{})
+	assertNoError(t, err, "GetRev")
+	atts := BodyAttachments(body)
+	assert.DeepEquals(t, atts[longName].(map[string]interface{})["data"], []byte("hello"))
+	_, err = db.Put("old", Body{"_rev": revid, "updated": true,
+		"_attachments": map[string]interface{}{longName: map[string]interface{}{"stub": true, "revpos": 1}}})
+	assertNoError(t, err, "Put")
+	assertHTTPError(t, attach("new", longName), 400)
+}
+
+func TestAttachmentContentDisposition(t *testing.T) {
+	assert.Equals(t, AttachmentContentDisposition("logo.png"), `attachment; filename="logo.png"`)
+	assert.Equals(t, AttachmentContentDisposition(`say "hi".txt`), `attachment; filename="say \"hi\".txt"`)
+	assert.Equals(t, AttachmentContentDisposition("images/logo.png"), `attachment; filename="images/logo.png"`)
+	assert.Equals(t, AttachmentContentDisposition("résumé 1.pdf"), `attachment; filename="r_sum_ 1.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9%201.pdf`)
+	assert.Equals(t, AttachmentContentDisposition("bad\nname"), `attachment; filename="bad_name"; filename*=UTF-8''bad%0Aname`)
+}
+
+func TestLoadBodyAttachmentsSharing(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1, err := db.Put("doc", unjson(`{"_attachments": {"a.txt": {"data": "YQ=="}, "b.txt": {"data": "Yg=="}}}`))
+	assertNoError(t, err, "Put")
+	rev2, err := db.Put("doc", Body{"_rev": rev1, "_attachments": map[string]interface{}{
+		"a.txt": map[string]interface{}{"stub": true, "revpos": 1},
+		"b.txt": map[string]interface{}{"data": "YmI="}}})
+	assertNoError(t, err, "Put")
+	cached, _, _, err := db.revisionCache.Get("doc", rev2)
+	assertNoError(t, err, "Get")
+	cachedAtts := BodyAttachments(cached)
+	sameMap := func(a, b interface{}) bool {
+		return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+	}
+
+	// Only b.txt changed since rev 1, so only its metadata is copied:
+	body, _, _, _ := db.revisionCache.Get("doc", rev2)
+	body, err = db.loadBodyAttachments(body, 2)
+	assertNoError(t, err, "loadBodyAttachments")
+	atts := BodyAttachments(body)
+	assert.DeepEquals(t, atts["b.txt"].(map[string]interface{})["data"], []byte("bb"))
+	assert.Equals(t, atts["a.txt"].(map[string]interface{})["data"], nil)
+	assert.True(t, sameMap(atts["a.txt"], cachedAtts["a.txt"]))
+	assert.False(t, sameMap(atts["b.txt"], cachedAtts["b.txt"]))
+
+	// The cached revision is unchanged:
+	cached, _, _, _ = db.revisionCache.Get("doc", rev2)
+	cachedMeta := BodyAttachments(cached)["b.txt"].(map[string]interface{})
+	assert.Equals(t, cachedMeta["stub"], true)
+	assert.Equals(t, cachedMeta["data"], nil)
+
+	// If no attachments are loaded, nothing is copied:
+	body, _, _, _ = db.revisionCache.Get("doc", rev2)
+	body, err = db.loadBodyAttachments(body, 3)
+	assertNoError(t, err, "loadBodyAttachments")
+	assert.True(t, sameMap(body["_attachments"], cachedAtts))
+}
+
+// Loads the attachments of a revision with a 1MB body and 20 attachments, as a GET or _bulk_get
+// with attachments does, when the client has none of them (MinRevpos1) or all of them
+// (MinRevpos2).  ImmutableAttachmentsCopy is the copy each of these used to make.
+func BenchmarkLoadBodyAttachments(b *testing.B) {
+	db := setupTestDB(b)
+	defer tearDownTestDB(b, db)
+
+	body := Body{}
+	for i := 0; i < 10000; i++ {
+		body[fmt.Sprintf("field%d", i)] = strings.Repeat("x", 100)
+	}
+	atts := map[string]interface{}{}
+	for i := 0; i < 20; i++ {
+		data := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("attachment %d", i)))
+		atts[fmt.Sprintf("att%d.txt", i)] = map[string]interface{}{"data": data}
+	}
+	body["_attachments"] = atts
+	revid, err := db.Put("doc", body)
+	assertNoError(b, err, "Put")
+	cached, _, _, err := db.revisionCache.Get("doc", revid)
+	assertNoError(b, err, "Get")
+	cachedAtts := cached["_attachments"]
+
+	for _, minRevpos := range []int{1, 2} {
+		b.Run(fmt.Sprintf("MinRevpos%d", minRevpos), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cached["_attachments"] = cachedAtts
+				if _, err := db.loadBodyAttachments(cached, minRevpos); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	b.Run("ImmutableAttachmentsCopy", func(b *testing.B) {
+		b.ReportAllocs()
+		cached["_attachments"] = cachedAtts
+		for i := 0; i < b.N; i++ {
+			cached.ImmutableAttachmentsCopy()
+		}
+	})
+}
+
+func TestAttachmentRefsCapped(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Once the list is full, the oldest docs are dropped:
+	attachments := AttachmentData{"sha1-abc": nil}
+	for i := 0; i < kMaxAttachmentRefs+5; i++ {
+		db.addAttachmentRefs(fmt.Sprintf("doc%d", i), attachments)
+	}
+	db.addAttachmentRefs("doc10", attachments)
+	var refs attachmentRefs
+	_, err := db.Bucket.Get(kAttachmentRefsKeyPrefix+"sha1-abc", &refs)
+	assertNoError(t, err, "Get refs")
+	assert.Equals(t, len(refs.DocIDs), kMaxAttachmentRefs)
+	assert.Equals(t, refs.DocIDs[0], "doc5")
+	assert.Equals(t, refs.DocIDs[kMaxAttachmentRefs-1], fmt.Sprintf("doc%d", kMaxAttachmentRefs+4))
+}
@@ -0,0 +1,178 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	DefaultBodyDeltaCacheSize = 1000 // Max number of computed body deltas to cache
+	DefaultBodyDeltaMaxRatio  = 0.5  // A delta bigger than this fraction of the full body isn't used
+)
+
+// Body deltas describe how to turn one revision's body into another's.  A delta is a JSON object
+// whose properties are the ones that changed:
+//   - An empty array means the property was removed.
+//   - A one-element array means the property was set to that element.  Objects and arrays are
+//     always wrapped this way, to tell them apart from the other cases.
+//   - An object means the property's value is an object that changed; the object is its delta.
+//   - Any other value means the property was set to that value.
+type BodyDelta map[string]interface{}
+
+// Computes the delta from the body oldBody to the body newBody.
+func DiffBodies(oldBody, newBody map[string]interface{}) BodyDelta {
+	delta := BodyDelta{}
+	for key, newValue := range newBody {
+		oldValue, exists := oldBody[key]
+		if exists && reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		oldMap, oldIsMap := oldValue.(map[string]interface{})
+		newMap, newIsMap := newValue.(map[string]interface{})
+		if exists && oldIsMap && newIsMap {
+			delta[key] = map[string]interface{}(DiffBodies(oldMap, newMap))
+		} else {
+			delta[key] = deltaReplacement(newValue)
+		}
+	}
+	for key := range oldBody {
+		if _, exists := newBody[key]; !exists {
+			delta[key] = []interface{}{}
+		}
+	}
+	return delta
+}
+
+func deltaReplacement(value interface{}) interface{} {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return []interface{}{value}
+	default:
+		return value
+	}
+}
+
+var errBadBodyDelta = errors.New("Invalid body delta")
+
+// Applies a delta to a body, returning the result.  The input body isn't modified.
+func ApplyBodyDelta(body map[string]interface{}, delta BodyDelta) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(body)+len(delta))
+	for key, value := range body {
+		result[key] = value
+	}
+	for key, change := range delta {
+		switch change := change.(type) {
+		case []interface{}:
+			switch len(change) {
+			case 0:
+				delete(result, key)
+			case 1:
+				result[key] = change[0]
+			default:
+				return nil, errBadBodyDelta
+			}
+		case map[string]interface{}:
+			oldMap, ok := result[key].(map[string]interface{})
+			if !ok {
+				return nil, errBadBodyDelta
+			}
+			newMap, err := ApplyBodyDelta(oldMap, change)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = newMap
+		default:
+			result[key] = change
+		}
+	}
+	return result, nil
+}
+
+// Returns the JSON delta from one of the revisions the client already has (knownRevIDs, in order
+// of preference) to the body targetBody of a revision of the document, along with the revision it
+// applies to.  Returns a nil delta if none of the known revisions can be read in full, if the body
+// is bigger than BodyDeltaMaxBytes, or if the delta wouldn't be enough smaller than the body to be
+// worth it.  Deltas are cached, since revisions never change; a cached nil records that the delta
+// wasn't worth it, so that it isn't computed again.  The cache is keyed by user as well as by
+// revision, since a user's bodies depend on its access, and by the thresholds, so that changing
+// them applies to deltas already cached.  The body is only marshaled, to check its size, when the
+// delta isn't cached.  (Only bodies are sent as deltas; attachments are always sent whole.)
+func (db *Database) GetBodyDelta(docid string, targetBody Body, knownRevIDs []string) (sourceRevID string, delta []byte) {
+	if targetBody["_removed"] != nil {
+		return "", nil
+	}
+	targetRevID, _ := targetBody["_rev"].(string)
+	userName := ""
+	if db.user != nil {
+		userName = db.user.Name()
+	}
+	options := db.GetOptions()
+	maxRatio := options.BodyDeltaMaxRatio
+	if maxRatio <= 0 {
+		maxRatio = DefaultBodyDeltaMaxRatio
+	}
+	thresholds := fmt.Sprintf("%d\x00%g", options.BodyDeltaMaxBytes, maxRatio)
+	var fullJSON []byte
+	for _, revid := range knownRevIDs {
+		if revid == "" || revid == targetRevID {
+			continue
+		}
+		// A revision the user can't access reads as a stub marked _removed, which isn't the body
+		// the client has, so it can't be a delta's source:
+		sourceBody, err := db.GetRev(docid, revid, false, nil)
+		if err != nil || sourceBody["_removed"] != nil {
+			continue
+		}
+		key := userName + "\x00" + docid + "\x00" + revid + "\x00" + targetRevID + "\x00" + thresholds
+		if cached, found := db.bodyDeltaCache.Get(key); found {
+			delta, _ = cached.([]byte)
+		} else {
+			if fullJSON == nil {
+				if fullJSON, err = json.Marshal(targetBody); err != nil {
+					return "", nil
+				}
+				// Check the size before diffing, since diffing big bodies is expensive:
+				if maxBytes := options.BodyDeltaMaxBytes; maxBytes > 0 && len(fullJSON) > maxBytes {
+					base.StatsExpvars.Add("deltas_skippedBySize", 1)
+					return "", nil
+				}
+			}
+			delta = db.makeBodyDelta(sourceBody, targetBody, fullJSON, maxRatio)
+			db.bodyDeltaCache.Put(key, delta)
+		}
+		if delta == nil {
+			return "", nil
+		}
+		return revid, delta
+	}
+	return "", nil
+}
+
+// Returns the delta between two bodies, or nil if it's bigger than maxRatio of the target body's
+// JSON.
+func (db *Database) makeBodyDelta(sourceBody, targetBody Body, fullJSON []byte, maxRatio float64) []byte {
+	delta, err := json.Marshal(DiffBodies(sourceBody, targetBody))
+	if err != nil {
+		return nil
+	}
+	if float64(len(delta)) > maxRatio*float64(len(fullJSON)) {
+		db.LogContext.LogTo("CRUD+", "Body delta of %q is %d bytes, vs. %d for the full body; not using it",
+			targetBody["_id"], len(delta), len(fullJSON))
+		base.StatsExpvars.Add("deltas_skippedByRatio", 1)
+		return nil
+	}
+	return delta
+}
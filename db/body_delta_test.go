@@ -0,0 +1,146 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestDiffAndApplyBodies(t *testing.T) {
+	var oldBody, newBody map[string]interface{}
+	json.Unmarshal([]byte(`{"name":"Zegpold", "age":3, "owner":{"name":"Jens", "city":"Oakland"}, "tags":["a"], "gone":true}`), &oldBody)
+	json.Unmarshal([]byte(`{"name":"Zegpold", "age":4, "owner":{"name":"Jens", "city":"Berkeley"}, "tags":["a","b"], "toy":{"kind":"ball"}}`), &newBody)
+
+	delta := DiffBodies(oldBody, newBody)
+	deltaJSON, _ := json.Marshal(delta)
+	assert.Equals(t, string(deltaJSON),
+		`{"age":4,"gone":[],"owner":{"city":"Berkeley"},"tags":[["a","b"]],"toy":[{"kind":"ball"}]}`)
+
+	result, err := ApplyBodyDelta(oldBody, delta)
+	assert.Equals(t, err, nil)
+	assert.DeepEquals(t, result, newBody)
+	assert.Equals(t, oldBody["age"], float64(3)) // The input isn't changed
+
+	// Identical bodies have an empty delta:
+	assert.Equals(t, len(DiffBodies(newBody, newBody)), 0)
+
+	// A nested delta can only be applied to an object:
+	_, err = ApplyBodyDelta(map[string]interface{}{"owner": "nobody"}, BodyDelta{"owner": map[string]interface{}{"city": "Oakland"}})
+	assert.True(t, err != nil)
+}
+
+func TestGetBodyDelta(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	longText := strings.Repeat("lorem ipsum ", 100)
+	rev1, err := db.Put("doc1", Body{"text": longText, "count": 1})
+	assert.Equals(t, err, nil)
+	rev2, err := db.Put("doc1", Body{"_rev": rev1, "text": longText, "count": 2})
+	assert.Equals(t, err, nil)
+	target, err := db.GetRev("doc1", rev2, false, nil)
+	assert.Equals(t, err, nil)
+
+	// Unknown revisions are skipped:
+	source, delta := db.GetBodyDelta("doc1", target, []string{"9-abc", rev1})
+	assert.Equals(t, source, rev1)
+	var decoded BodyDelta
+	assert.Equals(t, json.Unmarshal(delta, &decoded), nil)
+	assert.DeepEquals(t, decoded, BodyDelta{"_rev": rev2, "count": float64(2)})
+
+	// The cached delta is the same:
+	_, cached := db.GetBodyDelta("doc1", target, []string{rev1})
+	assert.DeepEquals(t, cached, delta)
+
+	// No delta if it's not smaller than the body:
+	rev3, err := db.Put("doc1", Body{"_rev": rev2, "text": "short"})
+	assert.Equals(t, err, nil)
+	target, _ = db.GetRev("doc1", rev3, false, nil)
+	source, delta = db.GetBodyDelta("doc1", target, []string{rev2})
+	assert.Equals(t, source, "")
+	assert.True(t, delta == nil)
+}
+
+// A revision the user can't access isn't a delta's source, even if another user's delta from it is cached.
+func TestGetBodyDeltaAccess(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	longText := strings.Repeat("lorem ipsum ", 100)
+	rev1, err := db.Put("doc1", Body{"text": longText, "count": 1, "channels": []string{"secret"}})
+	assert.Equals(t, err, nil)
+	rev2, err := db.Put("doc1", Body{"_rev": rev1, "text": longText, "count": 2, "channels": []string{"public"}})
+	assert.Equals(t, err, nil)
+	target, err := db.GetRev("doc1", rev2, false, nil)
+	assert.Equals(t, err, nil)
+
+	// The admin's delta is cached:
+	source, delta := db.GetBodyDelta("doc1", target, []string{rev1})
+	assert.Equals(t, source, rev1)
+	assert.True(t, delta != nil)
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("public"))
+	db.user = user
+	target, err = db.GetRev("doc1", rev2, false, nil)
+	assert.Equals(t, err, nil)
+	source, delta = db.GetBodyDelta("doc1", target, []string{rev1})
+	assert.Equals(t, source, "")
+	assert.True(t, delta == nil)
+}
+
+func TestBodyDeltaLimits(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	longText := strings.Repeat("lorem ipsum ", 100)
+	rev1, err := db.Put("doc1", Body{"text": longText, "count": 1})
+	assert.Equals(t, err, nil)
+	rev2, err := db.Put("doc1", Body{"_rev": rev1, "text": longText, "count": 2})
+	assert.Equals(t, err, nil)
+	target, err := db.GetRev("doc1", rev2, false, nil)
+	assert.Equals(t, err, nil)
+
+	// A body bigger than the max isn't sent as a delta, and that isn't cached:
+	db.Options.BodyDeltaMaxBytes = 100
+	source, delta := db.GetBodyDelta("doc1", target, []string{rev1})
+	assert.Equals(t, source, "")
+	assert.True(t, delta == nil)
+	db.Options.BodyDeltaMaxBytes = 0
+	source, delta = db.GetBodyDelta("doc1", target, []string{rev1})
+	assert.Equals(t, source, rev1)
+	assert.True(t, delta != nil)
+
+	// Lowering the max applies to the cached delta too:
+	db.Options.BodyDeltaMaxBytes = 100
+	source, _ = db.GetBodyDelta("doc1", target, []string{rev1})
+	assert.Equals(t, source, "")
+	db.Options.BodyDeltaMaxBytes = 0
+
+	// Nor is a delta bigger than the max ratio of the body:
+	rev3, err := db.Put("doc1", Body{"_rev": rev2, "text": longText, "count": 3})
+	assert.Equals(t, err, nil)
+	target, _ = db.GetRev("doc1", rev3, false, nil)
+	db.Options.BodyDeltaMaxRatio = 0.001
+	source, delta = db.GetBodyDelta("doc1", target, []string{rev2})
+	assert.Equals(t, source, "")
+	assert.True(t, delta == nil)
+
+	// ... but that result doesn't outlast the ratio:
+	db.Options.BodyDeltaMaxRatio = 0
+	source, delta = db.GetBodyDelta("doc1", target, []string{rev2})
+	assert.Equals(t, source, rev2)
+	assert.True(t, delta != nil)
+}
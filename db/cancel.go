@@ -0,0 +1,42 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// The error returned by the operations of a Database whose request has been cancelled.
+var ErrRequestCancelled = base.HTTPErrorf(http.StatusServiceUnavailable, "Request timed out or was cancelled")
+
+// Returns a copy of the Database whose reads and writes fail with ErrRequestCancelled once the
+// done channel is closed, such as when the request it's handling runs past its deadline or the
+// client goes away.  The bucket calls themselves can't be interrupted, so an operation stops at
+// its next bucket call (or the next doc of a bulk operation.)
+func (db *Database) WithCancel(done <-chan struct{}) *Database {
+	cancelDB := *db
+	cancelDB.cancelled = done
+	return &cancelDB
+}
+
+// Returns ErrRequestCancelled if the database's request has been cancelled.
+func (db *Database) checkCancelled() error {
+	if db.cancelled == nil {
+		return nil
+	}
+	select {
+	case <-db.cancelled:
+		return ErrRequestCancelled
+	default:
+		return nil
+	}
+}
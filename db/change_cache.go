@@ -5,6 +5,7 @@ import (
 	"errors"
 	"expvar"
 	"fmt"
+	"net/http"
 	"sort"
 	"strconv"
 	"strings"
@@ -67,6 +68,12 @@ type SkippedSequence struct {
 	timeAdded time.Time
 }
 
+// Snapshot of a pending skipped sequence, as reported by the admin API
+type SkippedSequenceStatus struct {
+	Seq        uint64  `json:"seq"`
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
 type CacheOptions struct {
 	ChannelCacheOptions
 	CachePendingSeqMaxWait time.Duration // Max wait for pending sequence before skipping
@@ -109,7 +116,7 @@ func (c *changeCache) Init(context *DatabaseContext, lastSequence SequenceID, on
 		c.options.ChannelCacheOptions = options.ChannelCacheOptions
 	}
 
-	base.LogTo("Cache", "Initializing changes cache with options %+v", c.options)
+	c.context.dbLogContext().LogTo("Cache", "Initializing changes cache with options %+v", c.options)
 
 	heap.Init(&c.pendingLogs)
 
@@ -211,15 +218,15 @@ func (c *changeCache) CleanSkippedSequenceQueue() bool {
 				//       aren't indexed by the channel view.  This means we can potentially miss channel removals:
 				//       when an older revision is missed by the TAP feed, and a channel is removed in that revision,
 				//       the doc won't be flagged as removed from that channel in the in-memory channel cache.
-				entries, err := c.context.getChangesInChannelFromView("*", endSequence, options)
+				entries, err := c.context.getChangesInChannelFromQuery("*", endSequence, options)
 				if err == nil && len(entries) > 0 {
 					// Found it - store to send to the caches.
 					found = append(found, entries[0])
 				} else {
 					if err != nil {
-						base.Warn("Error retrieving changes from view during skipped sequence check:", err)
+						c.context.dbLogContext().Warn("Error retrieving changes from view during skipped sequence check:", err)
 					}
-					base.Warn("Skipped Sequence %d didn't show up in MaxChannelLogMissingWaitTime, and isn't available from the * channel view.  If it's a valid sequence, it won't be replicated until Sync Gateway is restarted.", skippedSeq.seq)
+					c.context.dbLogContext().Warn("Skipped Sequence %d didn't show up in MaxChannelLogMissingWaitTime, and isn't available from the * channel view.  If it's a valid sequence, it won't be replicated until Sync Gateway is restarted.", skippedSeq.seq)
 				}
 				// Remove from skipped queue
 				deletes = append(deletes, skippedSeq.seq)
@@ -241,7 +248,7 @@ func (c *changeCache) CleanSkippedSequenceQueue() bool {
 		// view will only have the * channel
 		doc, err := c.context.GetDoc(entry.DocID)
 		if err != nil {
-			base.Warn("Unable to retrieve doc when processing skipped document %q: abandoning sequence %d", entry.DocID, entry.Sequence)
+			c.context.dbLogContext().Warn("Unable to retrieve doc when processing skipped document %q: abandoning sequence %d", entry.DocID, entry.Sequence)
 			continue
 		}
 		entry.Channels = doc.Channels
@@ -260,9 +267,10 @@ func (c *changeCache) CleanSkippedSequenceQueue() bool {
 	for _, sequence := range pendingDeletes {
 		err := c.RemoveSkipped(sequence)
 		if err != nil {
-			base.Warn("Error purging skipped sequence %d from skipped sequence queue", sequence)
+			c.context.dbLogContext().Warn("Error purging skipped sequence %d from skipped sequence queue", sequence)
 		} else {
 			dbExpvars.Add("abandoned_seqs", 1)
+			dbExpvars.Add("abandoned_seqs_timeout", 1)
 		}
 	}
 
@@ -328,6 +336,7 @@ func (c *changeCache) DocChanged(event sgbucket.TapEvent) {
 
 	processDocChanged := func() {
 		// ** This method does not directly access any state of c, so it doesn't lock.
+		defer c.context.tapListener.EventProcessed(event)
 		// Is this a user/role doc?
 		if strings.HasPrefix(docID, auth.UserKeyPrefix) {
 			c.processPrincipalDoc(docID, docJSON, true)
@@ -345,7 +354,7 @@ func (c *changeCache) DocChanged(event sgbucket.TapEvent) {
 
 		// If this is a delete and there are no xattrs (no existing SG revision), we can ignore
 		if event.Opcode == sgbucket.TapDeletion && len(docJSON) == 0 {
-			base.LogTo("Import+", "Ignoring delete mutation for %s - no existing Sync Gateway metadata.", docID)
+			c.context.dbLogContext().LogTo("Import+", "Ignoring delete mutation for %s - no existing Sync Gateway metadata.", docID)
 			return
 		}
 
@@ -353,7 +362,7 @@ func (c *changeCache) DocChanged(event sgbucket.TapEvent) {
 		syncData, rawBody, err := UnmarshalDocumentSyncDataFromFeed(docJSON, event.DataType, false)
 
 		if err != nil {
-			base.Warn("changeCache: Error unmarshaling doc %q: %v", docID, err)
+			c.context.dbLogContext().Warn("changeCache: Error unmarshaling doc %q: %v", docID, err)
 			return
 		}
 
@@ -371,9 +380,11 @@ func (c *changeCache) DocChanged(event sgbucket.TapEvent) {
 					_, err := db.ImportDocRaw(docID, rawBody, isDelete, event.Cas, ImportFromFeed)
 					if err != nil {
 						if err == base.ErrImportCasFailure {
-							base.LogTo("Import+", "Not importing mutation - document %s has been subsequently updated and will be imported based on that mutation.", docID)
+							c.context.dbLogContext().LogTo("Import+", "Not importing mutation - document %s has been subsequently updated and will be imported based on that mutation.", docID)
+						} else if err == base.ErrImportFiltered {
+							c.context.dbLogContext().LogTo("Import+", "Not importing mutation - document %s was rejected by the import filter.", docID)
 						} else {
-							base.Warn("Unable to import doc %q - external update will not be accessible via Sync Gateway.  Reason: %v", docID, err)
+							c.context.dbLogContext().Warn("Unable to import doc %q - external update will not be accessible via Sync Gateway.  Reason: %v", docID, err)
 						}
 					}
 				}
@@ -382,7 +393,7 @@ func (c *changeCache) DocChanged(event sgbucket.TapEvent) {
 		}
 
 		if !syncData.HasValidSyncData(c.context.writeSequences()) {
-			base.Warn("changeCache: Doc %q does not have valid sync data.", docID)
+			c.context.dbLogContext().Warn("changeCache: Doc %q does not have valid sync data.", docID)
 			return
 		}
 
@@ -397,7 +408,7 @@ func (c *changeCache) DocChanged(event sgbucket.TapEvent) {
 
 		// If the doc update wasted any sequences due to conflicts, add empty entries for them:
 		for _, seq := range syncData.UnusedSequences {
-			base.LogTo("Cache", "Received unused #%d for (%q / %q)", seq, docID, syncData.CurrentRev)
+			c.context.dbLogContext().LogTo("Cache", "Received unused #%d for (%q / %q)", seq, docID, syncData.CurrentRev)
 			change := &LogEntry{
 				Sequence:     seq,
 				TimeReceived: time.Now(),
@@ -420,7 +431,7 @@ func (c *changeCache) DocChanged(event sgbucket.TapEvent) {
 			nextSeq := c.getNextSequence()
 			for _, seq := range syncData.RecentSequences {
 				if seq >= nextSeq && seq < currentSequence {
-					base.LogTo("Cache", "Received deduplicated #%d for (%q / %q)", seq, docID, syncData.CurrentRev)
+					c.context.dbLogContext().LogTo("Cache", "Received deduplicated #%d for (%q / %q)", seq, docID, syncData.CurrentRev)
 					change := &LogEntry{
 						Sequence:     seq,
 						TimeReceived: time.Now(),
@@ -450,7 +461,7 @@ func (c *changeCache) DocChanged(event sgbucket.TapEvent) {
 			TimeSaved:    syncData.TimeSaved,
 			Channels:     syncData.Channels,
 		}
-		base.LogTo("Cache", "Received #%d after %3dms (%q / %q)", change.Sequence, int(tapLag/time.Millisecond), change.DocID, change.RevID)
+		c.context.dbLogContext().LogTo("Cache", "Received #%d after %3dms (%q / %q)", change.Sequence, int(tapLag/time.Millisecond), change.DocID, change.RevID)
 
 		changedChannels := c.processEntry(change)
 		changedChannelsCombined = changedChannelsCombined.Union(changedChannels)
@@ -489,14 +500,14 @@ func (c *changeCache) processUnusedSequence(docID string) {
 	sequenceStr := strings.TrimPrefix(docID, UnusedSequenceKeyPrefix)
 	sequence, err := strconv.ParseUint(sequenceStr, 10, 64)
 	if err != nil {
-		base.Warn("Unable to identify sequence number for unused sequence notification with key: %s, error:", docID, err)
+		c.context.dbLogContext().Warn("Unable to identify sequence number for unused sequence notification with key: %s, error:", docID, err)
 		return
 	}
 	change := &LogEntry{
 		Sequence:     sequence,
 		TimeReceived: time.Now(),
 	}
-	base.LogTo("Cache", "Received #%d (unused sequence)", sequence)
+	c.context.dbLogContext().LogTo("Cache", "Received #%d (unused sequence)", sequence)
 
 	// Since processEntry may unblock pending sequences, if there were any changed channels we need
 	// to notify any change listeners that are working changes feeds for these channels
@@ -513,7 +524,7 @@ func (c *changeCache) processPrincipalDoc(docID string, docJSON []byte, isUser b
 	// have gaps in it, causing later sequences to get stuck in the queue.
 	princ, err := c.unmarshalPrincipal(docJSON, isUser)
 	if princ == nil {
-		base.Warn("changeCache: Error unmarshaling doc %q: %v", docID, err)
+		c.context.dbLogContext().Warn("changeCache: Error unmarshaling doc %q: %v", docID, err)
 		return
 	}
 	sequence := princ.Sequence()
@@ -535,7 +546,7 @@ func (c *changeCache) processPrincipalDoc(docID string, docJSON []byte, isUser b
 		change.DocID = "_role/" + princ.Name()
 	}
 
-	base.LogTo("Cache", "Received #%d (%q)", change.Sequence, change.DocID)
+	c.context.dbLogContext().LogTo("Cache", "Received #%d (%q)", change.Sequence, change.DocID)
 
 	changedChannels := c.processEntry(change)
 	if c.onChange != nil && len(changedChannels) > 0 {
@@ -554,7 +565,7 @@ func (c *changeCache) processEntry(change *LogEntry) base.Set {
 	sequence := change.Sequence
 	nextSequence := c.nextSequence
 	if _, found := c.receivedSeqs[sequence]; found {
-		base.LogTo("Cache+", "  Ignoring duplicate of #%d", sequence)
+		c.context.dbLogContext().LogTo("Cache+", "  Ignoring duplicate of #%d", sequence)
 		return nil
 	}
 	c.receivedSeqs[sequence] = struct{}{}
@@ -570,7 +581,7 @@ func (c *changeCache) processEntry(change *LogEntry) base.Set {
 		// There's a missing sequence (or several), so put this one on ice until it arrives:
 		heap.Push(&c.pendingLogs, change)
 		numPending := len(c.pendingLogs)
-		base.LogTo("Cache", "  Deferring #%d (%d now waiting for #%d...#%d)",
+		c.context.dbLogContext().LogTo("Cache", "  Deferring #%d (%d now waiting for #%d...#%d)",
 			sequence, numPending, nextSequence, c.pendingLogs[0].Sequence-1)
 		changeCacheExpvars.Get("maxPending").(*base.IntMax).SetIfMax(int64(numPending))
 		if numPending > c.options.CachePendingSeqMaxNum {
@@ -582,9 +593,9 @@ func (c *changeCache) processEntry(change *LogEntry) base.Set {
 		// Remove from skipped sequence queue
 		if !c.WasSkipped(sequence) {
 			// Error removing from skipped sequences
-			base.LogTo("Cache", "  Received unexpected out-of-order change - not in skippedSeqs (seq %d, expecting %d) doc %q / %q", sequence, nextSequence, change.DocID, change.RevID)
+			c.context.dbLogContext().LogTo("Cache", "  Received unexpected out-of-order change - not in skippedSeqs (seq %d, expecting %d) doc %q / %q", sequence, nextSequence, change.DocID, change.RevID)
 		} else {
-			base.LogTo("Cache", "  Received previously skipped out-of-order change (seq %d, expecting %d) doc %q / %q ", sequence, nextSequence, change.DocID, change.RevID)
+			c.context.dbLogContext().LogTo("Cache", "  Received previously skipped out-of-order change (seq %d, expecting %d) doc %q / %q ", sequence, nextSequence, change.DocID, change.RevID)
 			change.Skipped = true
 		}
 
@@ -615,7 +626,7 @@ func (c *changeCache) _addToCache(change *LogEntry) base.Set {
 	func() {
 		if change.Skipped {
 			c.lateSeqLock.Lock()
-			base.LogTo("Sequences", "Acquired late sequence lock for %d", change.Sequence)
+			c.context.dbLogContext().LogTo("Sequences", "Acquired late sequence lock for %d", change.Sequence)
 			defer c.lateSeqLock.Unlock()
 		}
 
@@ -630,7 +641,9 @@ func (c *changeCache) _addToCache(change *LogEntry) base.Set {
 			}
 		}
 
-		if EnableStarChannelLog {
+		if removal, found := ch[channels.NoChannels]; found && removal == nil {
+			// Docs in no channels aren't in the "*" channel either
+		} else if EnableStarChannelLog {
 			channelCache := c._getChannelCache(channels.UserStarChannel)
 			channelCache.addToCache(change, false)
 			addedTo = append(addedTo, channels.UserStarChannel)
@@ -709,6 +722,16 @@ func (c *changeCache) _getChannelCache(channelName string) *channelCache {
 
 //////// CHANGE ACCESS:
 
+// Applies new channel cache options to the cache, and to the channel caches already created.
+func (c *changeCache) updateChannelCacheOptions(options ChannelCacheOptions) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.options.ChannelCacheOptions = options
+	for _, cache := range c.channelCaches {
+		cache.setOptions(options)
+	}
+}
+
 func (c *changeCache) GetChanges(channelName string, options ChangesOptions) ([]*LogEntry, error) {
 	if c.IsStopped() {
 		return nil, base.HTTPErrorf(503, "Database closed")
@@ -727,6 +750,12 @@ func (c *changeCache) LastSequence() uint64 {
 	return c.nextSequence - 1
 }
 
+func (c *changeCache) KnownChannels() base.Set {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c._allChannels()
+}
+
 func (c *changeCache) _allChannels() base.Set {
 	array := make([]string, len(c.channelCaches))
 	i := 0
@@ -741,7 +770,7 @@ func (c *changeCache) getOldestSkippedSequence() uint64 {
 	c.skippedSeqLock.RLock()
 	defer c.skippedSeqLock.RUnlock()
 	if len(c.skippedSeqs) > 0 {
-		base.LogTo("Sequences", "get oldest, returning: %d", c.skippedSeqs[0].seq)
+		c.context.dbLogContext().LogTo("Sequences", "get oldest, returning: %d", c.skippedSeqs[0].seq)
 		return c.skippedSeqs[0].seq
 	} else {
 		return uint64(0)
@@ -781,6 +810,48 @@ func (c *changeCache) WasSkipped(x uint64) bool {
 	return c.skippedSeqs.Contains(x)
 }
 
+// Returns whether the channel is resident in the cache and, if so, how many entries it holds.
+// Unlike getChannelCache, doesn't create a cache for the channel.
+func (c *changeCache) channelCacheSize(channelName string) (resident bool, entries int) {
+	c.lock.RLock()
+	cache := c.channelCaches[channelName]
+	c.lock.RUnlock()
+	if cache == nil {
+		return false, 0
+	}
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	return true, len(cache.logs)
+}
+
+// Returns the sequences currently in the skipped queue, oldest first, along with how long each has been pending.
+func (c *changeCache) GetSkippedSequences() []SkippedSequenceStatus {
+	c.skippedSeqLock.RLock()
+	defer c.skippedSeqLock.RUnlock()
+
+	now := time.Now()
+	result := make([]SkippedSequenceStatus, 0, len(c.skippedSeqs))
+	for _, skippedSeq := range c.skippedSeqs {
+		result = append(result, SkippedSequenceStatus{
+			Seq:        skippedSeq.seq,
+			AgeSeconds: now.Sub(skippedSeq.timeAdded).Seconds(),
+		})
+	}
+	return result
+}
+
+// Abandons a skipped sequence without waiting for CacheSkippedSeqMaxWait, so that the stable sequence
+// can advance past it.  Returns a 404 error if the sequence isn't in the skipped queue.
+func (c *changeCache) ReleaseSkippedSequence(sequence uint64) error {
+	if err := c.RemoveSkipped(sequence); err != nil {
+		return base.HTTPErrorf(http.StatusNotFound, "Sequence %d is not a pending skipped sequence", sequence)
+	}
+	base.Logf("Skipped sequence %d released manually - it won't be replicated unless it's later seen on the feed", sequence)
+	dbExpvars.Add("abandoned_seqs", 1)
+	dbExpvars.Add("abandoned_seqs_manual", 1)
+	return nil
+}
+
 func (c *changeCache) PushSkipped(sequence uint64) {
 
 	c.skippedSeqLock.Lock()
@@ -16,6 +16,7 @@ import (
 	"testing"
 	"time"
 
+	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/channels"
 
@@ -608,6 +609,57 @@ func TestLowSequenceHandlingAcrossChannels(t *testing.T) {
 	close(options.Terminator)
 }
 
+// Replays a changes feed from every checkpoint it emits, while some sequences are skipped, and
+// checks that no entries are lost and that the only entries sent again are the ones after LowSeq.
+func TestCheckpointReplay(t *testing.T) {
+
+	db := setupTestDBWithCacheOptions(t, shortWaitCache())
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	authenticator := db.Authenticator()
+	user, err := authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC"))
+	assertNoError(t, err, "Couldn't create user")
+	authenticator.Save(user)
+
+	// Simulate seq 3 and 4 being delayed - write 1,2,5,6
+	WriteDirect(db, []string{"ABC"}, 1)
+	WriteDirect(db, []string{"ABC"}, 2)
+	WriteDirect(db, []string{"ABC"}, 5)
+	WriteDirect(db, []string{"ABC"}, 6)
+	db.changeCache.waitForSequence(6)
+	db.user, _ = authenticator.GetUser("naomi")
+
+	getChanges := func(since SequenceID) []*ChangeEntry {
+		changes, err := db.GetChanges(base.SetOf("*"), ChangesOptions{Since: since})
+		assertNoError(t, err, "Couldn't get changes")
+		return changes
+	}
+
+	changes := getChanges(SequenceID{})
+	assert.True(t, verifyChangesFullSequences(changes, []string{"1", "2", "2::5", "2::6"}))
+	var checkpoint SequenceID
+	for i, change := range changes {
+		checkpoint = checkpoint.AdvanceCheckpoint(change.Seq)
+		replayed := getChanges(checkpoint)
+		assert.True(t, verifyChangesSequences(replayed, []uint64{1, 2, 5, 6}[i+1:]))
+	}
+	assert.Equals(t, checkpoint.String(), "2::6")
+
+	// Once the skipped sequences arrive, replaying from the checkpoint sends them, along with the
+	// entries after LowSeq that were already sent:
+	WriteDirect(db, []string{"ABC"}, 3)
+	WriteDirect(db, []string{"ABC"}, 4)
+	db.changeCache.waitForSequenceWithMissing(4)
+	changes = getChanges(checkpoint)
+	assert.True(t, verifyChangesSequences(changes, []uint64{3, 4, 5, 6}))
+	for _, change := range changes {
+		checkpoint = checkpoint.AdvanceCheckpoint(change.Seq)
+	}
+	assert.Equals(t, checkpoint.String(), "6")
+	assert.Equals(t, len(getChanges(checkpoint)), 0)
+}
+
 // Test low sequence handling of late arriving sequences to a continuous changes feed, when the
 // user gets added to a new channel with existing entries (and existing backfill)
 func TestLowSequenceHandlingWithAccessGrant(t *testing.T) {
@@ -842,6 +894,76 @@ func TestSkippedViewRetrieval(t *testing.T) {
 
 }
 
+// Test listing and manual release of skipped sequences
+func TestReleaseSkippedSequence(t *testing.T) {
+	db := setupTestDBWithCacheOptions(t, shortWaitCache())
+	defer tearDownTestDB(t, db)
+
+	changeCache, ok := db.changeCache.(*changeCache)
+	assertTrue(t, ok, "Testing skipped sequences without a change cache")
+
+	changeCache.PushSkipped(3)
+	changeCache.PushSkipped(5)
+
+	skipped, err := db.GetSkippedSequences()
+	assertNoError(t, err, "Error retrieving skipped sequences")
+	assert.Equals(t, len(skipped), 2)
+	assert.Equals(t, skipped[0].Seq, uint64(3))
+	assert.Equals(t, skipped[1].Seq, uint64(5))
+	assert.Equals(t, changeCache.getOldestSkippedSequence(), uint64(3))
+
+	// Releasing the oldest skipped sequence should advance the oldest skipped
+	assertNoError(t, db.ReleaseSkippedSequence(3), "Error releasing skipped sequence")
+	assert.Equals(t, changeCache.getOldestSkippedSequence(), uint64(5))
+	skipped, _ = db.GetSkippedSequences()
+	assert.Equals(t, len(skipped), 1)
+
+	// Releasing a sequence that isn't pending is a 404
+	assertHTTPError(t, db.ReleaseSkippedSequence(3), 404)
+}
+
+// Test that docs the feed delivers again (as it does after a DCP rollback) aren't cached twice,
+// whether or not their sequences were skipped the first time.
+func TestRedeliveredSequences(t *testing.T) {
+	if base.TestUseXattrs() {
+		t.Skip("This test does not work with XATTRs due to calling WriteDirect().  Skipping.")
+	}
+
+	db := setupTestDBWithCacheOptions(t, shortWaitCache())
+	defer tearDownTestDB(t, db)
+
+	changeCache, ok := db.changeCache.(*changeCache)
+	assertTrue(t, ok, "Testing redelivery without a change cache")
+	redeliver := func(sequences ...uint64) {
+		for _, seq := range sequences {
+			docID := fmt.Sprintf("doc-%v", seq)
+			raw, _, err := db.Bucket.GetRaw(docID)
+			assertNoError(t, err, "GetRaw")
+			changeCache.DocChanged(sgbucket.TapEvent{Opcode: sgbucket.TapMutation, Key: []byte(docID), Value: raw})
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	WriteDirect(db, []string{"ABC"}, 1)
+	WriteDirect(db, []string{"ABC"}, 3)
+	db.changeCache.waitForSequenceWithMissing(3)
+	redeliver(1, 3)
+
+	WriteDirect(db, []string{"ABC"}, 2)
+	db.changeCache.waitForSequenceWithMissing(2)
+	redeliver(3, 2, 1)
+
+	entries, err := db.changeCache.GetChanges("ABC", ChangesOptions{})
+	assertNoError(t, err, "Get Changes returned error")
+	assert.Equals(t, len(entries), 3)
+	sequences := map[uint64]bool{}
+	for _, entry := range entries {
+		sequences[entry.Sequence] = true
+	}
+	assert.DeepEquals(t, sequences, map[uint64]bool{1: true, 2: true, 3: true})
+	assert.Equals(t, changeCache.getOldestSkippedSequence(), uint64(0))
+}
+
 // Test that housekeeping goroutines get terminated when change cache is stopped
 func TestStopChangeCache(t *testing.T) {
 	// Setup short-wait cache to ensure cleanup goroutines fire often
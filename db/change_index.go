@@ -41,6 +41,9 @@ type ChangeIndex interface {
 	// Retrieve in-memory changes in a channel
 	GetCachedChanges(channelName string, options ChangesOptions) (validFrom uint64, entries []*LogEntry)
 
+	// Names of the channels currently known to the index, used to expand prefix grants
+	KnownChannels() base.Set
+
 	// Called to add a document to the index
 	DocChanged(event sgbucket.TapEvent)
 
@@ -24,6 +24,9 @@ type changeListener struct {
 	keyCounts             map[string]uint64      // Latest count at which each doc key was updated
 	DocChannel            chan sgbucket.TapEvent // Passthru channel for doc mutations
 	OnDocChanged          DocChangedFunc         // Called when change arrives on feed
+	checkpointedFeed      base.CheckpointedFeed  // The feed, if it checkpoints the events that have been processed
+	logContext            *base.LogContext       // Tags log messages with the database
+	feedLock              sync.Mutex             // Guards tapFeed and checkpointedFeed
 }
 
 type DocChangedFunc func(event sgbucket.TapEvent)
@@ -45,7 +48,8 @@ func (listener *changeListener) Start(bucket base.Bucket, trackDocs bool, xattrI
 		Notify:   bucketStateNotify,
 	}
 
-	// TODO: for xattr import nodes, we're forcing full backfill.  Pending #2484
+	// Xattr import nodes backfill, to import the docs written while the gateway wasn't running.  A
+	// DCP feed resumes that from where it got to last time, rather than from the beginning.
 	if xattrImport {
 		listener.TapArgs.Backfill = 0
 	}
@@ -55,7 +59,10 @@ func (listener *changeListener) Start(bucket base.Bucket, trackDocs bool, xattrI
 		return err
 	}
 
+	listener.feedLock.Lock()
 	listener.tapFeed = tapFeed
+	listener.checkpointedFeed, _ = tapFeed.(base.CheckpointedFeed)
+	listener.feedLock.Unlock()
 	if trackDocs {
 		listener.DocChannel = make(chan sgbucket.TapEvent, 100)
 	}
@@ -69,42 +76,67 @@ func (listener *changeListener) Start(bucket base.Bucket, trackDocs bool, xattrI
 			}
 		}()
 		for event := range tapFeed.Events() {
+			handled := false
 			if event.Opcode == sgbucket.TapMutation || event.Opcode == sgbucket.TapDeletion {
 				key := string(event.Key)
 				if strings.HasPrefix(key, auth.UserKeyPrefix) ||
 					strings.HasPrefix(key, auth.RoleKeyPrefix) {
-					if listener.OnDocChanged != nil {
-						listener.OnDocChanged(event)
-					}
+					handled = listener.docChanged(event)
 					listener.Notify(base.SetOf(key))
 				} else if strings.HasPrefix(key, UnusedSequenceKeyPrefix) {
-					if listener.OnDocChanged != nil {
-						listener.OnDocChanged(event)
-					}
+					handled = listener.docChanged(event)
 				} else if !strings.HasPrefix(key, KSyncKeyPrefix) && !strings.HasPrefix(key, base.KIndexPrefix) {
-					if listener.OnDocChanged != nil {
-						listener.OnDocChanged(event)
-					}
+					handled = listener.docChanged(event)
 					if trackDocs {
 						listener.DocChannel <- event
 					}
 
 				}
 			}
+			if !handled {
+				listener.EventProcessed(event)
+			}
 		}
 	}()
 
 	return nil
 }
 
+// Passes an event to OnDocChanged, which calls EventProcessed when it's done with it.  Returns
+// false if there's no OnDocChanged.
+func (listener *changeListener) docChanged(event sgbucket.TapEvent) bool {
+	if listener.OnDocChanged == nil {
+		return false
+	}
+	listener.OnDocChanged(event)
+	return true
+}
+
+// Tells the feed an event has been processed, so that its checkpoints can move past it.
+func (listener *changeListener) EventProcessed(event sgbucket.TapEvent) {
+	listener.feedLock.Lock()
+	checkpointedFeed := listener.checkpointedFeed
+	listener.feedLock.Unlock()
+	if checkpointedFeed != nil {
+		checkpointedFeed.EventProcessed(event)
+	}
+}
+
 // Stops a changeListener. Any pending Wait() calls will immediately return false.
+// It's safe to call this more than once.
 func (listener *changeListener) Stop() {
-	if listener.tapFeed != nil {
-		listener.tapFeed.Close()
+	listener.feedLock.Lock()
+	tapFeed := listener.tapFeed
+	listener.tapFeed = nil
+	listener.feedLock.Unlock()
+	if tapFeed != nil {
+		tapFeed.Close()
 	}
 }
 
-func (listener changeListener) TapFeed() base.TapFeed {
+func (listener *changeListener) TapFeed() base.TapFeed {
+	listener.feedLock.Lock()
+	defer listener.feedLock.Unlock()
 	return listener.tapFeed
 }
 
@@ -120,7 +152,7 @@ func (listener *changeListener) Notify(keys base.Set) {
 	for key := range keys {
 		listener.keyCounts[key] = listener.counter
 	}
-	base.LogTo("Changes+", "Notifying that %q changed (keys=%q) count=%d",
+	listener.logContext.LogTo("Changes+", "Notifying that %q changed (keys=%q) count=%d",
 		listener.bucketName, keys, listener.counter)
 	listener.tapNotifier.Broadcast()
 	listener.tapNotifier.L.Unlock()
@@ -141,7 +173,7 @@ func (listener *changeListener) NotifyCheckForTermination(keys base.Set) {
 		listener.terminateCheckCounter = 0
 	}
 
-	base.LogTo("Changes+", "Notifying to check for _changes feed termination")
+	listener.logContext.LogTo("Changes+", "Notifying to check for _changes feed termination")
 	listener.tapNotifier.Broadcast()
 	listener.tapNotifier.L.Unlock()
 }
@@ -150,7 +182,7 @@ func (listener *changeListener) notifyStopping() {
 	listener.tapNotifier.L.Lock()
 	listener.counter = 0
 	listener.keyCounts = map[string]uint64{}
-	base.LogTo("Changes+", "Notifying that changeListener is stopping")
+	listener.logContext.LogTo("Changes+", "Notifying that changeListener is stopping")
 	listener.tapNotifier.Broadcast()
 	listener.tapNotifier.L.Unlock()
 }
@@ -159,7 +191,7 @@ func (listener *changeListener) notifyStopping() {
 func (listener *changeListener) Wait(keys []string, counter uint64, terminateCheckCounter uint64) (uint64, uint64) {
 	listener.tapNotifier.L.Lock()
 	defer listener.tapNotifier.L.Unlock()
-	base.LogTo("Changes+", "No new changes to send to change listener.  Waiting for %q's count to pass %d",
+	listener.logContext.LogTo("Changes+", "No new changes to send to change listener.  Waiting for %q's count to pass %d",
 		listener.bucketName, counter)
 	for {
 		curCounter := listener._currentCount(keys)
@@ -275,6 +307,21 @@ func (waiter *changeWaiter) UpdateChannels(chans channels.TimedSet) {
 
 }
 
+// Updates the user keys to the user's current roles, so that a change to a role the user has been
+// granted since the waiter was created (such as a channel granted to the role) wakes it too.  The
+// last user count is left alone, so the next check for user changes sees any change to the new
+// roles since then.  Takes effect at the next UpdateChannels.
+func (waiter *changeWaiter) RefreshUserKeys(user auth.User) {
+	if user == nil {
+		return
+	}
+	userKeys := []string{auth.UserKeyPrefix + user.Name()}
+	for role := range user.RoleNames() {
+		userKeys = append(userKeys, auth.RoleKeyPrefix+role)
+	}
+	waiter.userKeys = userKeys
+}
+
 // Returns the set of user keys for this ChangeWaiter
 func (waiter *changeWaiter) GetUserKeys() (result []string) {
 	if len(waiter.userKeys) == 0 {
@@ -16,22 +16,26 @@ import (
 	"sort"
 	"time"
 
+	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/channels"
 )
 
 // Options for changes-feeds
 type ChangesOptions struct {
-	Since       SequenceID // sequence # to start _after_
-	Limit       int        // Max number of changes to return, if nonzero
-	Conflicts   bool       // Show all conflicting revision IDs, not just winning one?
-	IncludeDocs bool       // Include doc body of each change?
-	Wait        bool       // Wait for results, instead of immediately returning empty result?
-	Continuous  bool       // Run continuously until terminated?
-	Terminator  chan bool  // Caller can close this channel to terminate the feed
-	HeartbeatMs uint64     // How often to send a heartbeat to the client
-	TimeoutMs   uint64     // After this amount of time, close the longpoll connection
-	ActiveOnly  bool       // If true, only return information on non-deleted, non-removed revisions
+	Since       SequenceID     // sequence # to start _after_
+	Limit       int            // Max number of changes to return, if nonzero
+	Conflicts   bool           // Show all conflicting revision IDs, not just winning one?
+	IncludeDocs bool           // Include doc body of each change?
+	Wait        bool           // Wait for results, instead of immediately returning empty result?
+	Continuous  bool           // Run continuously until terminated?
+	Terminator  chan bool      // Caller can close this channel to terminate the feed
+	HeartbeatMs uint64         // How often to send a heartbeat to the client
+	TimeoutMs   uint64         // After this amount of time, close the longpoll connection
+	ActiveOnly  bool           // If true, only return information on non-deleted, non-removed revisions
+	Revocations bool           // If true, send removals for docs in channels the user has lost access to
+	Filter      *ChangesFilter // JS filter function the entries must pass, if any
+	SyncFnEpoch bool           // Flag entries whose docs' channels were computed by an older sync function
 }
 
 // A changes entry; Database.GetChanges returns an array of these.
@@ -43,11 +47,13 @@ type ChangeEntry struct {
 	Removed    base.Set    `json:"removed,omitempty"`
 	Doc        Body        `json:"doc,omitempty"`
 	Changes    []ChangeRev `json:"changes"`
+	OldSyncFn  bool        `json:"old_sync_fn,omitempty"`
 	Err        error       `json:"err,omitempty"` // Used to notify feed consumer of errors
 	allRemoved bool        // Flag to track whether an entry is a removal in all channels visible to the user.
 	branched   bool
 	backfill   backfillFlag // Flag used to identify non-client entries used for backfill synchronization (di only)
 	pseudoDoc  bool         // Used to indicate _user docs e.t.c
+	revoked    bool         // Removal due to the user losing access to a channel
 }
 
 const (
@@ -82,13 +88,14 @@ func (db *Database) addDocToChangeEntry(entry *ChangeEntry, options ChangesOptio
 		return
 	}
 
-	// If this is pseudo doc, it will not be in the cache so ignore
-	if entry.pseudoDoc {
+	// If this is pseudo doc, it will not be in the cache so ignore.  The body of a revoked doc
+	// mustn't be sent.
+	if entry.pseudoDoc || entry.revoked {
 		return
 	}
 	doc, err := db.GetDoc(entry.ID)
 	if err != nil {
-		base.Warn("Changes feed: error getting doc %q: %v", entry.ID, err)
+		db.LogContext.Warn("Changes feed: error getting doc %q: %v", entry.ID, err)
 		return
 	}
 
@@ -97,7 +104,7 @@ func (db *Database) addDocToChangeEntry(entry *ChangeEntry, options ChangesOptio
 		// load whole doc
 		doc, err = db.GetDoc(entry.ID)
 		if err != nil {
-			base.Warn("Changes feed: error getting doc %q: %v", entry.ID, err)
+			db.LogContext.Warn("Changes feed: error getting doc %q: %v", entry.ID, err)
 			return
 		}
 
@@ -106,7 +113,7 @@ func (db *Database) addDocToChangeEntry(entry *ChangeEntry, options ChangesOptio
 		doc = &document{}
 		doc.syncData, err = db.GetDocSyncData(entry.ID)
 		if err != nil {
-			base.Warn("Changes feed: error getting doc sync data %q: %v", entry.ID, err)
+			db.LogContext.Warn("Changes feed: error getting doc sync data %q: %v", entry.ID, err)
 			return
 		}
 
@@ -136,13 +143,13 @@ func (db *Database) AddDocInstanceToChangeEntry(entry *ChangeEntry, doc *documen
 	}
 	if options.IncludeDocs {
 		if doc.body == nil {
-			base.Warn("AddDocInstanceToChangeEntry called with options.IncludeDocs, but doc is missing Body")
+			db.LogContext.Warn("AddDocInstanceToChangeEntry called with options.IncludeDocs, but doc is missing Body")
 			return
 		}
 		var err error
 		entry.Doc, err = db.getRevFromDoc(doc, revID, false)
 		if err != nil {
-			base.Warn("Changes feed: error getting doc %q/%q: %v", doc.ID, revID, err)
+			db.LogContext.Warn("Changes feed: error getting doc %q/%q: %v", doc.ID, revID, err)
 		}
 	}
 }
@@ -152,7 +159,7 @@ func (db *Database) AddDocInstanceToChangeEntry(entry *ChangeEntry, doc *documen
 func (db *Database) changesFeed(channel string, options ChangesOptions, to string) (<-chan *ChangeEntry, error) {
 	dbExpvars.Add("channelChangesFeeds", 1)
 	log, err := db.changeCache.GetChanges(channel, options)
-	base.LogTo("Changes+", "[changesFeed] Found %d changes for channel %s", len(log), channel)
+	db.LogContext.LogTo("Changes+", "[changesFeed] Found %d changes for channel %s", len(log), channel)
 	if err != nil {
 		return nil, err
 	}
@@ -187,10 +194,10 @@ func (db *Database) changesFeed(channel string, options ChangesOptions, to strin
 
 			change := makeChangeEntry(logEntry, seqID, channel)
 
-			base.LogTo("Changes+", "Channel feed processing seq:%v in channel %s %s", seqID, channel, to)
+			db.LogContext.LogTo("Changes+", "Channel feed processing seq:%v in channel %s %s", seqID, channel, to)
 			select {
 			case <-options.Terminator:
-				base.LogTo("Changes+", "Terminating channel feed %s", to)
+				db.LogContext.LogTo("Changes+", "Terminating channel feed %s", to)
 				return
 			case feed <- &change:
 			}
@@ -250,31 +257,105 @@ func makeErrorEntry(message string) ChangeEntry {
 	return change
 }
 
+// Returned by checkForUserUpdates when the user has been disabled, which terminates its feeds.
+var errUserDisabled = errors.New("User disabled")
+
+// Makes the error entry that terminates a changes feed when reloading the user failed.
+func makeUserReloadErrorEntry(err error) ChangeEntry {
+	if err == errUserDisabled {
+		return makeErrorEntry("User disabled - terminating changes feed")
+	}
+	return makeErrorEntry("User not found during reload - terminating changes feed")
+}
+
 func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-chan *ChangeEntry, error) {
 	if len(chans) == 0 {
 		return nil, nil
 	}
+	if err := db.checkCancelled(); err != nil {
+		return nil, err
+	}
+	if db.user == nil && chans.Contains(channels.UserStarChannel) {
+		// The "*" channel doesn't include docs in no channels, but an admin's "*" feed should
+		chans = chans.Union(base.SetOf(channels.NoChannels))
+	}
 
 	if (options.Continuous || options.Wait) && options.Terminator == nil {
-		base.Warn("MultiChangesFeed: Terminator missing for Continuous/Wait mode")
+		db.LogContext.Warn("MultiChangesFeed: Terminator missing for Continuous/Wait mode")
 	}
+	var feed <-chan *ChangeEntry
 	if db.SequenceType == IntSequenceType {
-		base.LogTo("Changes+", "Int sequence multi changes feed...")
-		return db.SimpleMultiChangesFeed(chans, options)
+		db.LogContext.LogTo("Changes+", "Int sequence multi changes feed...")
+		feed, err = db.SimpleMultiChangesFeed(chans, options)
 	} else {
-		base.LogTo("Changes+", "Vector multi changes feed...")
-		return db.VectorMultiChangesFeed(chans, options)
+		db.LogContext.LogTo("Changes+", "Vector multi changes feed...")
+		feed, err = db.VectorMultiChangesFeed(chans, options)
+	}
+	if err == nil && feed != nil && options.SyncFnEpoch {
+		feed = db.flagStaleSyncFnEpochs(feed, options.Terminator)
+	}
+	return feed, err
+}
+
+// Splits a set of channels requested by a changes feed into the ones the user can currently access
+// and the (sorted) ones it can't.  The "*" wildcard counts as accessible, since it follows the
+// user's grants as they change.  If there's no user (admin), all the channels are accessible.
+// A feed needn't be given only the accessible channels: it checks access again whenever the
+// user's grants change.
+func (db *Database) FilterChannelsForUser(chans base.Set) (allowed base.Set, disallowed []string) {
+	if db.user == nil || chans.Contains(channels.AllChannelWildcard) {
+		return chans, nil
+	}
+	allowed = make(base.Set, len(chans))
+	for channel := range chans {
+		if db.user.CanSeeChannel(channel) {
+			allowed[channel] = struct{}{}
+		} else {
+			disallowed = append(disallowed, channel)
+		}
 	}
+	sort.Strings(disallowed)
+	return allowed, disallowed
 }
 
 func (db *Database) startChangeWaiter(chans base.Set) *changeWaiter {
 	waitChans := chans
 	if db.user != nil {
-		waitChans = db.user.ExpandWildCardChannel(chans)
+		waitChans = channels.ExpandingPrefixGrants(db.user.ExpandWildCardChannel(chans), db.changeCache.KnownChannels())
 	}
 	return db.tapListener.NewWaiterWithChannels(waitChans, db.user)
 }
 
+// Replaces any prefix grants (e.g. "tenant-123-*") in the user's available channels with the
+// matching channels known to the channel cache/index, so a feed can be built for each of them.
+func (db *Database) expandPrefixGrants(channelsSince channels.TimedSet) channels.TimedSet {
+	if !channelsSince.HasPrefixGrants() {
+		return channelsSince
+	}
+	return channelsSince.ExpandingPrefixGrants(db.changeCache.KnownChannels())
+}
+
+// If the user has time-limited channel or role grants, arranges for its user key to be notified when
+// the earliest one expires, so that a waiting changes feed reloads the user and stops sending that
+// channel's docs.  Stops the previous timer (if any), and returns the new one (or nil).
+func (db *Database) scheduleGrantExpiryNotification(previous *time.Timer) *time.Timer {
+	if previous != nil {
+		previous.Stop()
+	}
+	if db.user == nil {
+		return nil
+	}
+	until := db.user.NextGrantExpiry()
+	if until == 0 {
+		return nil
+	}
+	name := db.user.Name()
+	return time.AfterFunc(time.Unix(until, 0).Sub(time.Now()), func() {
+		db.LogContext.LogTo("Changes+", "Time-limited grant to %q has expired", name)
+		db.tapListener.Notify(base.SetOf(auth.UserKeyPrefix + name))
+	})
+}
+
 func (db *Database) appendUserFeed(feeds []<-chan *ChangeEntry, names []string, options ChangesOptions) ([]<-chan *ChangeEntry, []string) {
 	userSeq := SequenceID{Seq: db.user.Sequence()}
 	if options.Since.Before(userSeq) {
@@ -305,19 +386,22 @@ func (db *Database) checkForUserUpdates(userChangeCount uint64, changeWaiter *ch
 	if newCount > userChangeCount || !isContinuous {
 		var previousChannels channels.TimedSet
 		var newChannels base.Set
-		base.LogTo("Changes+", "MultiChangesFeed reloading user %+v", db.user)
+		db.LogContext.LogTo("Changes+", "MultiChangesFeed reloading user %+v", db.user)
 		userChangeCount = newCount
 
 		if db.user != nil {
 			previousChannels = db.user.InheritedChannels()
 			if err := db.ReloadUser(); err != nil {
-				base.Warn("Error reloading user %q: %v", db.user.Name(), err)
+				db.LogContext.Warn("Error reloading user %q: %v", db.user.Name(), err)
 				return false, 0, nil, err
 			}
+			if db.user.Disabled() {
+				return false, 0, nil, errUserDisabled
+			}
 			// check whether channels have changed
 			newChannels = db.user.GetAddedChannels(previousChannels)
 			if len(newChannels) > 0 {
-				base.LogTo("Changes+", "New channels found after user reload: %v", newChannels)
+				db.LogContext.LogTo("Changes+", "New channels found after user reload: %v", newChannels)
 			}
 		}
 		return true, newCount, newChannels, nil
@@ -332,12 +416,12 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 		to = fmt.Sprintf("  (to %s)", db.user.Name())
 	}
 
-	base.LogTo("Changes", "MultiChangesFeed(channels: %s, options: %+v) ... %s", chans, options, to)
+	db.LogContext.LogTo("Changes", "MultiChangesFeed(channels: %s, options: %+v) ... %s", chans, options, to)
 	output := make(chan *ChangeEntry, 50)
 
 	go func() {
 		defer func() {
-			base.LogTo("Changes", "MultiChangesFeed done %s", to)
+			db.LogContext.LogTo("Changes", "MultiChangesFeed done %s", to)
 			close(output)
 		}()
 
@@ -350,6 +434,13 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 		var userChanged bool       // Whether the user document has changed in a given iteration loop
 		var deferredBackfill bool  // Whether there's a backfill identified in the user doc that's deferred while the SG cache catches up
 
+		var grantExpiryTimer *time.Timer // Wakes the changeWaiter when a time-limited grant expires
+		defer func() {
+			if grantExpiryTimer != nil {
+				grantExpiryTimer.Stop()
+			}
+		}()
+
 		// lowSequence is used to send composite keys to clients, so that they can obtain any currently
 		// skipped sequences in a future iteration or request.
 		oldestSkipped := db.changeCache.getOldestSkippedSequence()
@@ -370,12 +461,14 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 			// included in the initial changes loop iteration, and (b) won't wake up the changeWaiter.
 			if db.user != nil {
 				if err := db.ReloadUser(); err != nil {
-					base.Warn("Error reloading user during changes initialization %q: %v", db.user.Name(), err)
+					db.LogContext.Warn("Error reloading user during changes initialization %q: %v", db.user.Name(), err)
 					change := makeErrorEntry("User not found during reload - terminating changes feed")
 					output <- &change
 					return
 				}
+				changeWaiter.RefreshUserKeys(db.user)
 			}
+			grantExpiryTimer = db.scheduleGrantExpiryNotification(grantExpiryTimer)
 
 		}
 
@@ -383,7 +476,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 		// have been available to the user:
 		var channelsSince channels.TimedSet
 		if db.user != nil {
-			channelsSince = db.user.FilterToAvailableChannels(chans)
+			channelsSince = db.expandPrefixGrants(db.user.FilterToAvailableChannels(chans))
 		} else {
 			channelsSince = channels.AtSequence(chans, 0)
 		}
@@ -410,7 +503,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 			if changeWaiter != nil {
 				changeWaiter.UpdateChannels(channelsSince)
 			}
-			base.LogTo("Changes+", "MultiChangesFeed: channels expand to %#v ... %s", channelsSince.String(), to)
+			db.LogContext.LogTo("Changes+", "MultiChangesFeed: channels expand to %#v ... %s", channelsSince.String(), to)
 
 			// lowSequence is used to send composite keys to clients, so that they can obtain any currently
 			// skipped sequences in a future iteration or request.
@@ -456,7 +549,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 				// Backfill required when seqAddedAt is before current sequence
 				backfillRequired := seqAddedAt > 1 && options.Since.Before(SequenceID{Seq: seqAddedAt}) && seqAddedAt <= currentCachedSequence
 				if seqAddedAt > currentCachedSequence {
-					base.LogTo("Changes+", "Grant for channel [%s] is after the current sequence - skipped for this iteration.  Grant:[%d] Current:[%d] %s", name, seqAddedAt, currentCachedSequence, to)
+					db.LogContext.LogTo("Changes+", "Grant for channel [%s] is after the current sequence - skipped for this iteration.  Grant:[%d] Current:[%d] %s", name, seqAddedAt, currentCachedSequence, to)
 					deferredBackfill = true
 					continue
 				}
@@ -475,7 +568,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 
 				feed, err := db.changesFeed(name, chanOpts, to)
 				if err != nil {
-					base.Warn("MultiChangesFeed got error reading changes feed %q: %v", name, err)
+					db.LogContext.Warn("MultiChangesFeed got error reading changes feed %q: %v", name, err)
 					change := makeErrorEntry("Error reading changes feed - terminating changes feed")
 					output <- &change
 					return
@@ -491,7 +584,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 					if lateSequenceFeedHandler != nil {
 						latefeed, err := db.getLateFeed(lateSequenceFeedHandler)
 						if err != nil {
-							base.Warn("MultiChangesFeed got error reading late sequence feed %q: %v", name, err)
+							db.LogContext.Warn("MultiChangesFeed got error reading late sequence feed %q: %v", name, err)
 						} else {
 							// Mark feed as actively used in this iteration.  Used to remove lateSequenceFeeds
 							// when the user loses channel access
@@ -509,6 +602,9 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 			// If the user object has changed, create a special pseudo-feed for it:
 			if db.user != nil {
 				feeds, names = db.appendUserFeed(feeds, names, options)
+				if options.Revocations {
+					feeds, names = db.appendRevocationFeeds(feeds, names, options)
+				}
 			}
 
 			current := make([]*ChangeEntry, len(feeds))
@@ -569,14 +665,14 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 				}
 
 				if options.ActiveOnly {
-					if minEntry.Deleted || minEntry.allRemoved {
+					if (minEntry.Deleted || minEntry.allRemoved) && !minEntry.revoked {
 						continue
 					}
 				}
 
 				// Don't send any entries later than the cached sequence at the start of this iteration
 				if currentCachedSequence < minEntry.Seq.Seq {
-					base.LogTo("Changes+", "Found sequence later than stable sequence: stable:[%d] entry:[%d] (%s)", currentCachedSequence, minEntry.Seq.Seq, minEntry.ID)
+					db.LogContext.LogTo("Changes+", "Found sequence later than stable sequence: stable:[%d] entry:[%d] (%s)", currentCachedSequence, minEntry.Seq.Seq, minEntry.ID)
 					postStableSeqsFound = true
 					continue
 				}
@@ -588,8 +684,13 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 					options.Since = minSeq
 				}
 
-				// Add the doc body or the conflicting rev IDs, if those options are set:
-				if options.IncludeDocs || options.Conflicts {
+				// Apply the filter function, if any, which also adds the doc body or the conflicting
+				// rev IDs; otherwise add those if the options are set:
+				if options.Filter != nil {
+					if !db.filterChangeEntry(minEntry, options) {
+						continue
+					}
+				} else if options.IncludeDocs || options.Conflicts {
 					db.addDocToChangeEntry(minEntry, options)
 				}
 
@@ -597,7 +698,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 				minEntry.Seq.LowSeq = lowSequence
 
 				// Send the entry, and repeat the loop:
-				base.LogTo("Changes+", "MultiChangesFeed sending %+v %s", minEntry, to)
+				db.LogContext.LogTo("Changes+", "MultiChangesFeed sending %+v %s", minEntry, to)
 
 				select {
 				case <-options.Terminator:
@@ -621,7 +722,7 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 
 			// If nothing found, and in wait mode: wait for the db to change, then run again.
 			// First notify the reader that we're waiting by sending a nil.
-			base.LogTo("Changes+", "MultiChangesFeed waiting... %s", to)
+			db.LogContext.LogTo("Changes+", "MultiChangesFeed waiting... %s", to)
 			output <- nil
 		waitForChanges:
 			for {
@@ -664,13 +765,18 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 			var err error
 			userChanged, userCounter, addedChannels, err = db.checkForUserUpdates(userCounter, changeWaiter, options.Continuous)
 			if err != nil {
-				change := makeErrorEntry("User not found during reload - terminating changes feed")
-				base.LogTo("Changes+", "User not found during reload - terminating changes feed with entry %+v", change)
+				change := makeUserReloadErrorEntry(err)
+				db.LogContext.LogTo("Changes+", "Terminating changes feed with entry %+v", change)
 				output <- &change
 				return
 			}
 			if userChanged && db.user != nil {
-				channelsSince = db.user.FilterToAvailableChannels(chans)
+				channelsSince = db.expandPrefixGrants(db.user.FilterToAvailableChannels(chans))
+				if changeWaiter != nil {
+					// Roles granted since the last reload need waking the feed too, when they gain channels
+					changeWaiter.RefreshUserKeys(db.user)
+					grantExpiryTimer = db.scheduleGrantExpiryNotification(grantExpiryTimer)
+				}
 			}
 
 			// Clean up inactive lateSequenceFeeds (because user has lost access to the channel)
@@ -705,6 +811,17 @@ func (db *Database) GetChanges(channels base.Set, options ChangesOptions) ([]*Ch
 	return changes, err
 }
 
+// Estimates how many changes a feed cut off at a sequence didn't send, from the cache's stable
+// sequence rather than by finishing the scan.  It counts changes in channels the feed doesn't
+// include, so it's an upper bound.
+func (db *Database) EstimatePendingChanges(since SequenceID) uint64 {
+	stable := db.changeCache.GetStableSequence("").Seq
+	if stable <= since.Seq {
+		return 0
+	}
+	return stable - since.Seq
+}
+
 func (db *Database) GetChangeLog(channelName string, afterSeq uint64) []*LogEntry {
 	options := ChangesOptions{Since: SequenceID{Seq: afterSeq}}
 	_, log := db.changeCache.getChannelCache(channelName).getCachedChanges(options)
@@ -0,0 +1,73 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// A named JS filter function from the database config, applied to a changes feed, and the query
+// parameters of the request, which the function gets as req.query.
+type ChangesFilter struct {
+	Name     string
+	Function *channels.ChangesFilterFunction
+	Query    map[string]interface{}
+}
+
+// Runs the feed's filter function on the revision of a change entry, returning false if the entry
+// should be dropped.  The entries have already been limited to the user's channels, and the filter
+// sees the revision as the user would.  Removals, revocations and pseudo-docs aren't filtered, since
+// the client needs them whatever the revision's body.  Also adds the doc body (reusing the one the
+// filter saw) and conflicts, if the options ask for them.
+func (db *Database) filterChangeEntry(entry *ChangeEntry, options ChangesOptions) bool {
+	if entry.pseudoDoc || entry.revoked || entry.allRemoved {
+		if options.IncludeDocs || options.Conflicts {
+			db.addDocToChangeEntry(entry, options)
+		}
+		return true
+	}
+
+	filter := options.Filter
+	revID := entry.Changes[0]["rev"]
+	doc, err := db.GetDoc(entry.ID)
+	var body Body
+	if err == nil {
+		body, err = db.getRevFromDoc(doc, revID, false)
+	}
+	var bodyJSON []byte
+	if err == nil {
+		bodyJSON, err = json.Marshal(body)
+	}
+	if err != nil {
+		db.LogContext.Warn("Changes feed: error getting doc %q/%q for filter %q: %v", entry.ID, revID, filter.Name, err)
+		return false
+	}
+
+	passed, err := filter.Function.Filter(string(bodyJSON), filter.Query)
+	if err != nil {
+		dbExpvars.Add("changes_filter_errors", 1)
+		db.LogContext.Warn("Changes feed: filter %q failed on doc %q/%q, so it's left out: %v", filter.Name, entry.ID, revID, err)
+		return false
+	} else if !passed {
+		return false
+	}
+
+	if options.Conflicts {
+		conflictOptions := options
+		conflictOptions.IncludeDocs = false
+		db.AddDocInstanceToChangeEntry(entry, doc, conflictOptions)
+	}
+	if options.IncludeDocs {
+		entry.Doc = body
+	}
+	return true
+}
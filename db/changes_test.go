@@ -19,6 +19,7 @@ import (
 
 	"bytes"
 	"fmt"
+	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/channels"
 )
@@ -125,6 +126,261 @@ func _testChangesAfterChannelAdded(t *testing.T, db *Database) {
 	printChanges(changes)
 }
 
+// A prefix grant gives the user a feed of every matching channel known to the cache
+func TestChangesWithPrefixGrant(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("tenant-1-*"))
+	authenticator.Save(user)
+
+	db.Put("doc1", Body{"channels": []string{"tenant-1-orders"}})
+	db.Put("doc2", Body{"channels": []string{"tenant-2-orders"}})
+	db.Put("doc3", Body{"channels": []string{"tenant-1-users"}})
+	db.changeCache.waitForSequence(3)
+
+	db.user, _ = authenticator.GetUser("naomi")
+	changes, err := db.GetChanges(base.SetOf("*"), getZeroSequence(db))
+	assertNoError(t, err, "Couldn't GetChanges")
+	printChanges(changes)
+	assert.Equals(t, len(changes), 2)
+	assert.Equals(t, changes[0].ID, "doc1")
+	assert.Equals(t, changes[1].ID, "doc3")
+
+	// Explicitly requesting a channel covered by the prefix grant:
+	changes, err = db.GetChanges(base.SetOf("tenant-1-users"), getZeroSequence(db))
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "doc3")
+}
+
+// A time-limited grant stops giving access to the channel once it expires, without the granting
+// doc being updated
+func TestChangesAfterGrantExpiry(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {
+		channel(doc.channels);
+		if (doc.grant)
+			access({name: "naomi", until: doc.until}, doc.grant);
+	}`)
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC"))
+	authenticator.Save(user)
+
+	until := time.Now().Add(2 * time.Second).Truncate(time.Second)
+	db.Put("grant1", Body{"grant": "PBS", "until": until.Format(time.RFC3339)})
+	db.Put("grant2", Body{"grant": "CBS", "until": "2001-01-01T00:00:00Z"})
+	db.Put("doc1", Body{"channels": []string{"ABC"}})
+	db.Put("doc2", Body{"channels": []string{"PBS"}})
+	db.Put("doc3", Body{"channels": []string{"CBS"}})
+	db.changeCache.waitForSequence(5)
+
+	db.user, _ = authenticator.GetUser("naomi")
+	assert.DeepEquals(t, db.user.Channels().AsSet(), channels.SetOf("!", "ABC", "PBS"))
+	assert.Equals(t, db.user.Channels()["PBS"].Until, until.Unix())
+	assert.Equals(t, db.user.NextGrantExpiry(), until.Unix())
+	changes, err := db.GetChanges(base.SetOf("*"), getZeroSequence(db))
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 2)
+	assert.Equals(t, changes[0].ID, "doc1")
+	assert.Equals(t, changes[1].ID, "doc2")
+
+	time.Sleep(until.Sub(time.Now()) + 100*time.Millisecond)
+
+	db.user, _ = authenticator.GetUser("naomi")
+	assert.DeepEquals(t, db.user.Channels().AsSet(), channels.SetOf("!", "ABC"))
+	assert.Equals(t, db.user.NextGrantExpiry(), int64(0))
+	changes, err = db.GetChanges(base.SetOf("*"), getZeroSequence(db))
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "doc1")
+
+	// The expired grant was pruned from the saved user:
+	var saved map[string]interface{}
+	_, err = db.Bucket.Get(auth.UserKeyPrefix+"naomi", &saved)
+	assertNoError(t, err, "Couldn't get user doc")
+	_, hasPBS := saved["all_channels"].(map[string]interface{})["PBS"]
+	assert.False(t, hasPBS)
+}
+
+// Reads a continuous feed until it sends the given doc, skipping other entries.
+func readFromFeedUntil(t *testing.T, feed <-chan *ChangeEntry, docID string) {
+	for {
+		entry, err := readNextFromFeed(feed, 5*time.Second)
+		assertNoError(t, err, fmt.Sprintf("Waiting for %q on changes feed", docID))
+		if err != nil || entry.ID == docID {
+			return
+		}
+	}
+}
+
+func TestContinuousChangesAfterRoleGrant(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {
+		channel(doc.channels);
+		if (doc.grant)
+			access(doc.to, doc.grant);
+		if (doc.role)
+			role("naomi", doc.role);
+	}`)
+
+	authenticator := db.Authenticator()
+	for _, name := range []string{"r1", "r2"} {
+		role, _ := authenticator.NewRole(name, nil)
+		assertNoError(t, authenticator.Save(role), "Couldn't save role")
+	}
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC"))
+	user.SetExplicitRoles(channels.AtSequence(base.SetOf("r1"), 1))
+	assertNoError(t, authenticator.Save(user), "Couldn't save user")
+
+	// Docs are written by the admin, while the feed runs as naomi:
+	writer, _ := CreateDatabase(db.DatabaseContext)
+	writer.Put("doc1", Body{"channels": []string{"ABC"}})
+	writer.Put("doc2", Body{"channels": []string{"PBS"}})
+	writer.Put("doc3", Body{"channels": []string{"CBS"}})
+	db.changeCache.waitForSequence(3)
+
+	db.user, _ = authenticator.GetUser("naomi")
+	options := ChangesOptions{Since: SequenceID{Seq: 0}, Terminator: make(chan bool), Continuous: true, Wait: true}
+	defer close(options.Terminator)
+	feed, err := db.MultiChangesFeed(base.SetOf("*"), options)
+	assertNoError(t, err, "Couldn't start changes feed")
+	readFromFeedUntil(t, feed, "doc1")
+
+	// A channel granted to a role naomi has is backfilled:
+	_, err = writer.Put("grant1", Body{"to": "role:r1", "grant": "PBS"})
+	assertNoError(t, err, "Couldn't grant PBS")
+	readFromFeedUntil(t, feed, "doc2")
+
+	// So is one granted to a role naomi was given after the feed started:
+	_, err = writer.Put("grant2", Body{"role": "role:r2"})
+	assertNoError(t, err, "Couldn't grant r2")
+	time.Sleep(100 * time.Millisecond) // Let the feed reload naomi before r2 changes
+	_, err = writer.Put("grant3", Body{"to": "role:r2", "grant": "CBS"})
+	assertNoError(t, err, "Couldn't grant CBS")
+	readFromFeedUntil(t, feed, "doc3")
+}
+
+func TestChangesWithRevocations(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	if db.SequenceType != IntSequenceType {
+		t.Skip("Revocations are only tracked with a global sequence")
+	}
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {
+		channel(doc.channels);
+		if (doc.grant)
+			access("naomi", doc.grant);
+	}`)
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC"))
+	authenticator.Save(user)
+
+	grantRev, _ := db.Put("grant1", Body{"grant": "PBS"})
+	db.Put("doc1", Body{"channels": []string{"ABC", "PBS"}})
+	db.Put("doc2", Body{"channels": []string{"PBS"}})
+	db.changeCache.waitForSequence(3)
+
+	db.user, _ = authenticator.GetUser("naomi")
+	changes, err := db.GetChanges(base.SetOf("*"), getZeroSequence(db))
+	assertNoError(t, err, "Couldn't GetChanges")
+	lastSeq := changes[len(changes)-1].Seq
+
+	// Revoke the grant:
+	db.Put("grant1", Body{"_rev": grantRev})
+	db.changeCache.waitForSequence(4)
+	db.user, _ = authenticator.GetUser("naomi")
+	assert.False(t, db.user.CanSeeChannel("PBS"))
+	revocation, found := db.user.RevokedChannels()["PBS"]
+	assert.True(t, found)
+	assert.Equals(t, revocation.RevokedSeq, uint64(4))
+
+	// Without the option, nothing tells the client doc2 is gone:
+	changes, err = db.GetChanges(base.SetOf("*"), ChangesOptions{Since: lastSeq})
+	assertNoError(t, err, "Couldn't GetChanges")
+	for _, change := range changes {
+		assert.True(t, change.Removed == nil)
+	}
+
+	// With it, doc2 is removed; doc1 is still visible through ABC:
+	changes, err = db.GetChanges(base.SetOf("*"), ChangesOptions{Since: lastSeq, Revocations: true})
+	assertNoError(t, err, "Couldn't GetChanges")
+	var removed []*ChangeEntry
+	for _, change := range changes {
+		if change.Removed != nil {
+			removed = append(removed, change)
+		}
+	}
+	assert.Equals(t, len(removed), 1)
+	assert.Equals(t, removed[0].ID, "doc2")
+	assert.DeepEquals(t, removed[0].Removed, base.SetOf("PBS"))
+	assert.Equals(t, removed[0].Seq.TriggeredBy, uint64(4))
+
+	// A client that never synced while it had access isn't sent anything:
+	changes, err = db.GetChanges(base.SetOf("*"), ChangesOptions{Since: SequenceID{Seq: 0}, Revocations: true})
+	assertNoError(t, err, "Couldn't GetChanges")
+	for _, change := range changes {
+		assert.True(t, change.Removed == nil)
+	}
+
+	// Nor is one that has already passed the revocation:
+	changes, err = db.GetChanges(base.SetOf("*"), ChangesOptions{Since: removed[0].Seq, Revocations: true})
+	assertNoError(t, err, "Couldn't GetChanges")
+	for _, change := range changes {
+		assert.True(t, change.Removed == nil)
+	}
+}
+
+func TestContinuousChangesTerminatedWhenUserDisabled(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC"))
+	authenticator.Save(user)
+	db.Put("doc1", Body{"channels": []string{"ABC"}})
+	db.changeCache.waitForSequence(1)
+
+	db.user, _ = authenticator.GetUser("naomi")
+	options := ChangesOptions{Since: SequenceID{Seq: 0}, Terminator: make(chan bool), Continuous: true, Wait: true}
+	defer close(options.Terminator)
+	feed, err := db.MultiChangesFeed(base.SetOf("*"), options)
+	assertNoError(t, err, "Couldn't start changes feed")
+	entry, err := readNextFromFeed(feed, 5*time.Second)
+	assertNoError(t, err, "Error reading changes feed")
+	assert.Equals(t, entry.ID, "doc1")
+
+	// Disabling the user terminates the feed:
+	name := "naomi"
+	_, err = db.UpdatePrincipal(PrincipalConfig{Name: &name, ExplicitChannels: base.SetOf("ABC"), Disabled: true}, true, true)
+	assertNoError(t, err, "Couldn't disable user")
+	for {
+		entry, err = readNextFromFeed(feed, 5*time.Second)
+		assertNoError(t, err, "Error reading changes feed")
+		if err != nil || entry.Err != nil {
+			break
+		}
+	}
+	if entry != nil {
+		assert.Equals(t, entry.Err.Error(), "User disabled - terminating changes feed")
+	}
+
+	// Re-enabling restores the user exactly as before:
+	_, err = db.UpdatePrincipal(PrincipalConfig{Name: &name, ExplicitChannels: base.SetOf("ABC")}, true, true)
+	assertNoError(t, err, "Couldn't enable user")
+	reenabled, _ := authenticator.GetUser("naomi")
+	assert.False(t, reenabled.Disabled())
+	assert.DeepEquals(t, reenabled.ExplicitChannels(), db.user.ExplicitChannels())
+	assert.True(t, reenabled.Authenticate("letmein"))
+}
+
 func TestDocDeletionFromChannelCoalescedRemoved(t *testing.T) {
 
 	if !base.UnitTestUrlIsWalrus() && base.TestUseXattrs() {
@@ -370,3 +626,35 @@ func BenchmarkChangesFeedDocUnmarashalling(b *testing.B) {
 	}
 
 }
+
+func TestFilterChannelsForUser(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Admins aren't restricted:
+	chans, disallowed := db.FilterChannelsForUser(base.SetOf("ABC", "PBS"))
+	assert.DeepEquals(t, chans, base.SetOf("ABC", "PBS"))
+	assert.Equals(t, len(disallowed), 0)
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC"))
+	authenticator.Save(user)
+	db.user = user
+
+	chans, disallowed = db.FilterChannelsForUser(base.SetOf("ABC", "PBS"))
+	assert.DeepEquals(t, chans, base.SetOf("ABC"))
+	assert.DeepEquals(t, disallowed, []string{"PBS"})
+
+	chans, disallowed = db.FilterChannelsForUser(base.SetOf("*"))
+	assert.DeepEquals(t, chans, base.SetOf("*"))
+	assert.Equals(t, len(disallowed), 0)
+
+	chans, disallowed = db.FilterChannelsForUser(base.SetOf("PBS", "CBS"))
+	assert.Equals(t, len(chans), 0)
+	assert.DeepEquals(t, disallowed, []string{"CBS", "PBS"})
+
+	// A feed checks access itself, as the user's grants change, so it isn't refused:
+	changes, err := db.GetChanges(base.SetOf("PBS"), getZeroSequence(db))
+	assertNoError(t, err, "GetChanges")
+	assert.Equals(t, len(changes), 0)
+}
@@ -0,0 +1,126 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+)
+
+// Max number of distinct doc channel sets whose access checks a request remembers
+const kMaxCachedChannelAccessChecks = 1000
+
+// Checks a user's access to revisions by their channels, for the length of a request.  The user's
+// channels, including those it has through its roles, are gathered once up front, and the result
+// for each distinct set of doc channels is remembered, so that a bulk request doesn't walk the
+// user's and roles' grants again for every doc.
+type channelAccessCache struct {
+	user         auth.User
+	channels     base.Set // The user's channels, including its roles'
+	allChannels  bool     // True if the user has access to "*"
+	prefixGrants []string // The user's prefix grants, such as "tenant-123-*"
+	lock         sync.Mutex
+	results      map[string]error // Result of authorizeAnyChannel, by channelSetKey
+}
+
+func newChannelAccessCache(user auth.User) *channelAccessCache {
+	cache := &channelAccessCache{
+		user:     user,
+		channels: user.InheritedChannels().AsSet(),
+		results:  map[string]error{},
+	}
+	for channel := range cache.channels {
+		if channel == ch.UserStarChannel {
+			cache.allChannels = true
+		} else if ch.IsPrefixGrant(channel) {
+			cache.prefixGrants = append(cache.prefixGrants, channel)
+		}
+	}
+	return cache
+}
+
+// Returns a copy of this Database that remembers the results of its channel access checks until
+// it's discarded.  Meant for requests that read many docs, like _bulk_get; a Database that outlives
+// a request, as a changes feed's does, shouldn't use it since the user's grants may change.
+func (db *Database) WithChannelAccessCache() *Database {
+	cacheDB := *db
+	if db.user != nil {
+		cacheDB.channelAccess = newChannelAccessCache(db.user)
+	}
+	return &cacheDB
+}
+
+// Returns an HTTP 403 error if the database's user isn't allowed to access any of the channels.
+// A nil user means access control is disabled, so the function will return nil.
+func (db *Database) authorizeAnyChannel(channels base.Set) error {
+	if db.user == nil {
+		return nil
+	}
+	if cache := db.channelAccess; cache != nil && cache.user == db.user {
+		return cache.authorizeAnyChannel(channels)
+	}
+	return db.user.AuthorizeAnyChannel(channels)
+}
+
+func (cache *channelAccessCache) authorizeAnyChannel(channels base.Set) error {
+	if len(channels) == 0 {
+		// Only the user's own "*" grant allows this, not its roles'
+		return cache.user.AuthorizeAnyChannel(channels)
+	}
+	key := channelSetKey(channels)
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if result, found := cache.results[key]; found {
+		return result
+	}
+	var result error
+	if !cache.canSeeAnyChannel(channels) {
+		result = cache.user.UnauthError("You are not allowed to see this")
+	}
+	if len(cache.results) < kMaxCachedChannelAccessChecks {
+		cache.results[key] = result
+	}
+	return result
+}
+
+// Same as auth.User.CanSeeChannel for each channel, but against the precomputed channel set.
+func (cache *channelAccessCache) canSeeAnyChannel(channels base.Set) bool {
+	for channel := range channels {
+		if channel == ch.NoChannels {
+			continue // Docs in no channels are only visible to admins, even with "*"
+		}
+		if cache.allChannels || cache.channels.Contains(channel) {
+			return true
+		}
+		for _, grant := range cache.prefixGrants {
+			if ch.MatchesPrefixGrant(grant, channel) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns a key identifying a set of channels regardless of its order.
+func channelSetKey(channels base.Set) string {
+	if len(channels) == 1 {
+		for channel := range channels {
+			return channel
+		}
+	}
+	names := channels.ToArray()
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,112 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Creates a user with access to ABC and to the "tenant-1-" channels itself, and to "staff"
+// through a role.
+func setupChannelAccessUser(t testing.TB, db *Database) auth.User {
+	authenticator := db.Authenticator()
+	role, err := authenticator.NewRole("staff", channels.SetOf("staff"))
+	assertNoError(t, err, "NewRole")
+	assertNoError(t, authenticator.Save(role), "Save role")
+	user, err := authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC", "tenant-1-*"))
+	assertNoError(t, err, "NewUser")
+	user.SetExplicitRoles(channels.TimedSet{"staff": channels.NewVbSimpleSequence(1)})
+	assertNoError(t, authenticator.Save(user), "Save user")
+	user, err = authenticator.GetUser("naomi")
+	assertNoError(t, err, "GetUser")
+	return user
+}
+
+func TestChannelAccessCache(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+	db.user = setupChannelAccessUser(t, db)
+	cacheDB := db.WithChannelAccessCache()
+
+	// The cached checks agree with the user's own, the first time and when they're remembered:
+	channelSets := []base.Set{
+		channels.SetOf("ABC"),
+		channels.SetOf("NBC"),
+		channels.SetOf("NBC", "ABC"),
+		channels.SetOf("ABC", "NBC"),
+		channels.SetOf("staff"),
+		channels.SetOf("tenant-1-x"),
+		channels.SetOf("tenant-2-x"),
+		base.SetOf(channels.NoChannels),
+		channels.SetOf(),
+	}
+	for i := 0; i < 2; i++ {
+		for _, set := range channelSets {
+			expected := db.user.AuthorizeAnyChannel(set)
+			err := cacheDB.authorizeAnyChannel(set)
+			assert.Equals(t, err == nil, expected == nil)
+			if expected != nil {
+				assertHTTPError(t, err, 403)
+			}
+		}
+	}
+	assert.Equals(t, len(cacheDB.channelAccess.results), 7)
+
+	// Reads through the cached Database are authorized the same way:
+	_, err := db.Put("doc1", Body{"channels": []string{"staff"}})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("doc2", Body{"channels": []string{"CBS"}})
+	assertNoError(t, err, "Put")
+	_, err = cacheDB.Get("doc1")
+	assertNoError(t, err, "Get doc1")
+	_, err = cacheDB.Get("doc2")
+	assertHTTPError(t, err, 403)
+
+	// A reloaded user isn't checked against the cached results of the old one:
+	assertNoError(t, cacheDB.ReloadUser(), "ReloadUser")
+	assert.False(t, cacheDB.channelAccess.user == cacheDB.user)
+	_, err = cacheDB.Get("doc1")
+	assertNoError(t, err, "Get doc1")
+}
+
+// Compares checking the access to 1,000 docs, in 10 distinct sets of channels, with and without
+// the cache.
+func BenchmarkChannelAccessCheck(b *testing.B) {
+	db := setupTestDB(b)
+	defer tearDownTestDB(b, db)
+	db.user = setupChannelAccessUser(b, db)
+	docChannels := make([]base.Set, 1000)
+	for i := range docChannels {
+		docChannels[i] = channels.SetOf(fmt.Sprintf("tenant-%d-x", i%10), "CBS", "NBC")
+	}
+
+	b.Run("Uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, set := range docChannels {
+				db.authorizeAnyChannel(set)
+			}
+		}
+	})
+	b.Run("Cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			cacheDB := db.WithChannelAccessCache()
+			for _, set := range docChannels {
+				cacheDB.authorizeAnyChannel(set)
+			}
+		}
+	})
+}
@@ -5,7 +5,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/channels"
 )
 
@@ -61,7 +60,7 @@ func newChannelCacheWithOptions(context *DatabaseContext, channelName string, va
 		cache.options.ChannelCacheAge = options.ChannelCacheAge
 	}
 
-	base.LogTo("Cache", "Initialized cache for channel %q with options: %+v", cache.channelName, cache.options)
+	context.dbLogContext().LogTo("Cache", "Initialized cache for channel %q with options: %+v", cache.channelName, cache.options)
 
 	return cache
 }
@@ -72,6 +71,28 @@ type ChannelCacheOptions struct {
 	ChannelCacheAge       time.Duration // Keep entries at least this long
 }
 
+// Replaces the cache's size/expiry settings, keeping the defaults for ones that aren't set.
+func (c *channelCache) setOptions(options ChannelCacheOptions) {
+	merged := ChannelCacheOptions{
+		ChannelCacheMinLength: DefaultChannelCacheMinLength,
+		ChannelCacheMaxLength: DefaultChannelCacheMaxLength,
+		ChannelCacheAge:       DefaultChannelCacheAge,
+	}
+	if options.ChannelCacheMinLength > 0 {
+		merged.ChannelCacheMinLength = options.ChannelCacheMinLength
+	}
+	if options.ChannelCacheMaxLength > 0 {
+		merged.ChannelCacheMaxLength = options.ChannelCacheMaxLength
+	}
+	if options.ChannelCacheAge > 0 {
+		merged.ChannelCacheAge = options.ChannelCacheAge
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.options = &merged
+	c._pruneCache()
+}
+
 // Low-level method to add a LogEntry to a single channel's cache.
 func (c *channelCache) addToCache(change *LogEntry, isRemoval bool) {
 	c.lock.Lock()
@@ -85,7 +106,7 @@ func (c *channelCache) addToCache(change *LogEntry, isRemoval bool) {
 		c._appendChange(&removalChange)
 	}
 	c._pruneCache()
-	base.LogTo("Cache", "    #%d ==> channel %q", change.Sequence, c.channelName)
+	c.context.dbLogContext().LogTo("Cache", "    #%d ==> channel %q", change.Sequence, c.channelName)
 }
 
 // Internal helper that prunes a single channel's cache. Caller MUST be holding the lock.
@@ -111,7 +132,7 @@ func (c *channelCache) _pruneCache() {
 		pruned++
 	}
 	if pruned > 0 {
-		base.LogTo("Cache+", "Pruned %d old entries from channel %q", pruned, c.channelName)
+		c.context.dbLogContext().LogTo("Cache+", "Pruned %d old entries from channel %q", pruned, c.channelName)
 	}
 }
 
@@ -167,10 +188,10 @@ func (c *channelCache) GetChanges(options ChangesOptions) ([]*LogEntry, error) {
 	cacheValidFrom, resultFromCache := c.getCachedChanges(options)
 	numFromCache := len(resultFromCache)
 	if numFromCache > 0 || resultFromCache == nil {
-		base.LogTo("Cache", "getCachedChanges(%q, %s) --> %d changes valid from #%d",
+		c.context.dbLogContext().LogTo("Cache", "getCachedChanges(%q, %s) --> %d changes valid from #%d",
 			c.channelName, options.Since.String(), numFromCache, cacheValidFrom)
 	} else if resultFromCache == nil {
-		base.LogTo("Cache", "getCachedChanges(%q, %s) --> nothing cached",
+		c.context.dbLogContext().LogTo("Cache", "getCachedChanges(%q, %s) --> nothing cached",
 			c.channelName, options.Since.String())
 	}
 	startSeq := options.Since.SafeSequence() + 1
@@ -187,7 +208,7 @@ func (c *channelCache) GetChanges(options ChangesOptions) ([]*LogEntry, error) {
 	// the cache, so repeat the above:
 	cacheValidFrom, resultFromCache = c.getCachedChanges(options)
 	if len(resultFromCache) > numFromCache {
-		base.LogTo("Cache", "2nd getCachedChanges(%q, %d) got %d more, valid from #%d!",
+		c.context.dbLogContext().LogTo("Cache", "2nd getCachedChanges(%q, %d) got %d more, valid from #%d!",
 			c.channelName, options.Since, len(resultFromCache)-numFromCache, cacheValidFrom)
 	}
 	if cacheValidFrom <= startSeq {
@@ -196,7 +217,7 @@ func (c *channelCache) GetChanges(options ChangesOptions) ([]*LogEntry, error) {
 
 	// Now query the view. We set the max sequence equal to cacheValidFrom, so we'll get one
 	// overlap, which helps confirm that we've got everything.
-	resultFromView, err := c.context.getChangesInChannelFromView(c.channelName, cacheValidFrom,
+	resultFromView, err := c.context.getChangesInChannelFromQuery(c.channelName, cacheValidFrom,
 		options)
 	if err != nil {
 		return nil, err
@@ -220,7 +241,7 @@ func (c *channelCache) GetChanges(options ChangesOptions) ([]*LogEntry, error) {
 		}
 		result = append(result, resultFromCache[0:n]...)
 	}
-	base.LogTo("Cache", "GetChangesInChannel(%q) --> %d rows", c.channelName, len(result))
+	c.context.dbLogContext().LogTo("Cache", "GetChangesInChannel(%q) --> %d rows", c.channelName, len(result))
 	return result, nil
 }
 
@@ -239,7 +260,7 @@ func (c *channelCache) _appendChange(change *LogEntry) {
 	end := len(log) - 1
 	if end >= 0 {
 		if change.Sequence <= log[end].Sequence {
-			base.LogTo("Cache+", "LogEntries.appendChange: out-of-order sequence #%d (last is #%d) - handling as insert",
+			c.context.dbLogContext().LogTo("Cache+", "LogEntries.appendChange: out-of-order sequence #%d (last is #%d) - handling as insert",
 				change.Sequence, log[end].Sequence)
 			// insert the change in the array, ensuring the docID isn't already present
 			c.insertChange(&c.logs, change)
@@ -338,7 +359,7 @@ func (c *channelCache) prependChanges(changes LogEntries, changesValidFrom uint6
 			}
 			c.logs = make(LogEntries, len(changes))
 			copy(c.logs, changes)
-			base.LogTo("Cache", "  Initialized cache of %q with %d entries from view (#%d--#%d)",
+			c.context.dbLogContext().LogTo("Cache", "  Initialized cache of %q with %d entries from view (#%d--#%d)",
 				c.channelName, len(changes), changes[0].Sequence, changes[len(changes)-1].Sequence)
 		}
 		c.validFrom = changesValidFrom
@@ -367,7 +388,7 @@ func (c *channelCache) prependChanges(changes LogEntries, changesValidFrom uint6
 						newLog = append(newLog, changes[0:i]...)
 						newLog = append(newLog, log...)
 						c.logs = newLog
-						base.LogTo("Cache", "  Added %d entries from view (#%d--#%d) to cache of %q",
+						c.context.dbLogContext().LogTo("Cache", "  Added %d entries from view (#%d--#%d) to cache of %q",
 							i, changes[0].Sequence, changes[i-1].Sequence, c.channelName)
 					}
 					c.validFrom = changesValidFrom
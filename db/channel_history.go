@@ -0,0 +1,153 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// A span of sequences during which a document was in a channel.  Stored in the _sync metadata as a
+// JSON array [channel, addedSeq] while the doc is still in the channel, or [channel, addedSeq,
+// removedSeq] after it's left.  addedSeq is 0 if it isn't known, because the doc joined the
+// channel before its metadata recorded channel history.
+type ChannelHistoryEntry struct {
+	Name    string
+	Added   uint64
+	Removed uint64 // 0 if the doc is still in the channel
+}
+
+type ChannelHistory []ChannelHistoryEntry
+
+func (entry ChannelHistoryEntry) MarshalJSON() ([]byte, error) {
+	if entry.Removed == 0 {
+		return json.Marshal([]interface{}{entry.Name, entry.Added})
+	}
+	return json.Marshal([]interface{}{entry.Name, entry.Added, entry.Removed})
+}
+
+func (entry *ChannelHistoryEntry) UnmarshalJSON(data []byte) error {
+	var tuple []json.RawMessage
+	if err := json.Unmarshal(data, &tuple); err != nil {
+		return err
+	}
+	if len(tuple) < 2 || len(tuple) > 3 {
+		return fmt.Errorf("Invalid channel history entry %s", data)
+	}
+	*entry = ChannelHistoryEntry{}
+	if err := json.Unmarshal(tuple[0], &entry.Name); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(tuple[1], &entry.Added); err != nil {
+		return err
+	}
+	if len(tuple) == 3 {
+		return json.Unmarshal(tuple[2], &entry.Removed)
+	}
+	return nil
+}
+
+// Builds the channel history of a doc whose metadata predates it, from its channel map.  The
+// sequences at which it joined its channels aren't known.
+func (doc *document) migrateChannelHistory() {
+	if doc.ChannelHistory != nil || len(doc.Channels) == 0 {
+		return
+	}
+	history := make(ChannelHistory, 0, len(doc.Channels))
+	for name, removal := range doc.Channels {
+		entry := ChannelHistoryEntry{Name: name}
+		if removal != nil {
+			entry.Removed = removal.Seq
+		}
+		history = append(history, entry)
+	}
+	sort.Sort(channelHistoryByName(history))
+	doc.ChannelHistory = history
+}
+
+// Records that the doc joined or left a channel at the given sequence.
+func (doc *document) addChannelHistory(name string, seq uint64, joined bool) {
+	if joined {
+		doc.ChannelHistory = append(doc.ChannelHistory, ChannelHistoryEntry{Name: name, Added: seq})
+		return
+	}
+	for i := range doc.ChannelHistory {
+		if entry := &doc.ChannelHistory[i]; entry.Name == name && entry.Removed == 0 {
+			entry.Removed = seq
+			return
+		}
+	}
+	// Shouldn't happen, but don't lose the removal:
+	doc.ChannelHistory = append(doc.ChannelHistory, ChannelHistoryEntry{Name: name, Removed: seq})
+}
+
+// Removes the channel history entries of channel removals that are more than `retention` sequences
+// older than the doc's current sequence.  The channel map isn't pruned, since the changes feed
+// relies on its removals.  Does nothing if retention is 0.  Returns the approximate number of
+// bytes of metadata trimmed.
+func (doc *document) pruneChannelHistory(retention uint64) (trimmedBytes int) {
+	if retention == 0 || doc.Sequence <= retention {
+		return 0
+	}
+	minSeq := doc.Sequence - retention
+	kept := doc.ChannelHistory[:0]
+	for _, entry := range doc.ChannelHistory {
+		if entry.Removed != 0 && entry.Removed < minSeq {
+			if data, err := json.Marshal(entry); err == nil {
+				trimmedBytes += len(data) + 1 // comma
+			}
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	doc.ChannelHistory = kept
+	return trimmedBytes
+}
+
+// A channel history entry, as shown in a doc's "_channel_history" by the admin API.
+type ChannelHistoryInfo struct {
+	Channel string `json:"channel"`
+	Added   uint64 `json:"added_seq,omitempty"`   // Omitted if it isn't known
+	Removed uint64 `json:"removed_seq,omitempty"` // Omitted while the doc is still in the channel
+}
+
+// Adds the channels of a revision body's revision to it, as "_channels", and if withHistory is
+// true, the doc's channel history, as "_channel_history".  Nothing else of the doc's metadata is
+// added.  Only for the admin API.
+func (db *Database) AddRevChannels(docid string, body Body, withHistory bool) error {
+	doc, err := db.GetDoc(docid)
+	if doc == nil {
+		return err
+	}
+	revid, _ := body["_rev"].(string)
+	rev := doc.History[revid]
+	if rev == nil {
+		return nil
+	}
+	revChannels := rev.Channels.ToArray()
+	sort.Strings(revChannels)
+	body["_channels"] = revChannels
+	if withHistory {
+		doc.migrateChannelHistory()
+		history := make([]ChannelHistoryInfo, 0, len(doc.ChannelHistory))
+		for _, entry := range doc.ChannelHistory {
+			history = append(history, ChannelHistoryInfo{Channel: entry.Name, Added: entry.Added, Removed: entry.Removed})
+		}
+		body["_channel_history"] = history
+	}
+	return nil
+}
+
+type channelHistoryByName ChannelHistory
+
+func (h channelHistoryByName) Len() int           { return len(h) }
+func (h channelHistoryByName) Less(i, j int) bool { return h[i].Name < h[j].Name }
+func (h channelHistoryByName) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
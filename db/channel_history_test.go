@@ -0,0 +1,101 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+func sortedChannelHistory(history ChannelHistory) ChannelHistory {
+	sorted := append(ChannelHistory(nil), history...)
+	sort.Sort(channelHistoryByName(sorted))
+	return sorted
+}
+
+func TestChannelHistoryJSON(t *testing.T) {
+	history := ChannelHistory{{Name: "a", Added: 5}, {Name: "b", Added: 2, Removed: 7}}
+	data, err := json.Marshal(history)
+	assertNoError(t, err, "Marshal failed")
+	assert.Equals(t, string(data), `[["a",5],["b",2,7]]`)
+
+	var parsed ChannelHistory
+	assertNoError(t, json.Unmarshal(data, &parsed), "Unmarshal failed")
+	assert.DeepEquals(t, parsed, history)
+
+	assert.True(t, json.Unmarshal([]byte(`[["a"]]`), &parsed) != nil)
+	assert.True(t, json.Unmarshal([]byte(`[{"name":"a"}]`), &parsed) != nil)
+}
+
+func TestUpdateChannelsHistory(t *testing.T) {
+	doc := newDocument("doc")
+	doc.CurrentRev = "1-a"
+	doc.Sequence = 10
+	doc.updateChannels(base.SetOf("a", "b"))
+	assert.DeepEquals(t, sortedChannelHistory(doc.ChannelHistory), ChannelHistory{{Name: "a", Added: 10}, {Name: "b", Added: 10}})
+
+	doc.CurrentRev = "2-a"
+	doc.Sequence = 20
+	doc.updateChannels(base.SetOf("b", "c"))
+	assert.DeepEquals(t, sortedChannelHistory(doc.ChannelHistory), ChannelHistory{
+		{Name: "a", Added: 10, Removed: 20}, {Name: "b", Added: 10}, {Name: "c", Added: 20}})
+	assert.DeepEquals(t, doc.Channels["a"], &channels.ChannelRemoval{Seq: 20, RevID: "2-a"})
+
+	// Rejoining a channel starts a new entry:
+	doc.CurrentRev = "3-a"
+	doc.Sequence = 30
+	doc.updateChannels(base.SetOf("a", "b", "c"))
+	assert.Equals(t, len(doc.ChannelHistory), 4)
+	assert.Equals(t, doc.ChannelHistory[3], ChannelHistoryEntry{Name: "a", Added: 30})
+}
+
+// Docs saved before channel history existed get it built from their channel map on their next update.
+func TestMigrateChannelHistory(t *testing.T) {
+	doc, err := unmarshalDocument("doc", []byte(`{"_sync": {"rev": "2-a", "sequence": 20,
+		"channels": {"a": null, "b": {"seq": 15, "rev": "1-a"}}}}`))
+	assertNoError(t, err, "Unmarshal failed")
+	assert.Equals(t, len(doc.ChannelHistory), 0)
+
+	doc.Sequence = 25
+	doc.updateChannels(base.SetOf("a"))
+	assert.DeepEquals(t, doc.ChannelHistory, ChannelHistory{{Name: "a"}, {Name: "b", Removed: 15}})
+}
+
+func TestPruneChannelHistory(t *testing.T) {
+	doc := newDocument("doc")
+	doc.CurrentRev = "1-a"
+	doc.Sequence = 10
+	doc.updateChannels(base.SetOf("a", "b"))
+	doc.Sequence = 20
+	doc.updateChannels(base.SetOf("b"))
+	doc.Sequence = 100
+	doc.updateChannels(base.SetOf())
+
+	// No retention means nothing's pruned:
+	assert.Equals(t, doc.pruneChannelHistory(0), 0)
+	assert.Equals(t, len(doc.Channels), 2)
+
+	// Only the removal of "a" at 20 is older than the retention:
+	before, _ := json.Marshal(doc.syncData)
+	trimmed := doc.pruneChannelHistory(50)
+	after, _ := json.Marshal(doc.syncData)
+	assert.Equals(t, trimmed, len(before)-len(after))
+	assert.DeepEquals(t, doc.ChannelHistory, ChannelHistory{{Name: "b", Added: 10, Removed: 100}})
+
+	// The channel map keeps both removals:
+	assert.True(t, doc.Channels["a"] != nil)
+	assert.True(t, doc.Channels["b"] != nil)
+}
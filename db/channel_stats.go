@@ -0,0 +1,108 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Statistics about a single channel, as returned by GET /db/_channels
+type ChannelDocStats struct {
+	DocCount      int      `json:"doc_count"`                // Number of docs currently in the channel
+	LastSequence  uint64   `json:"last_seq"`                 // Latest sequence of a doc currently in the channel
+	Cached        bool     `json:"cached"`                   // Whether the channel is resident in the channel cache
+	CachedEntries int      `json:"cached_entries,omitempty"` // Number of entries in the channel cache
+	DocIDs        []string `json:"doc_ids,omitempty"`        // Sample of the channel's doc IDs
+}
+
+// Returns statistics for the given channels, or for every channel with documents if channelNames is
+// nil.  Doc counts come from a reduce over the channel_stats view.  If docIDLimit is non-zero, up
+// to that many doc IDs are included for each channel.
+func (context *DatabaseContext) GetChannelStats(channelNames []string, docIDLimit int) (map[string]*ChannelDocStats, error) {
+	result := make(map[string]*ChannelDocStats)
+	if channelNames == nil {
+		opts := Body{"stale": false, "reduce": true, "group_level": 1}
+		vres, err := context.Bucket.View(context.DesignDocName(DesignDocSyncGatewayChannels, ViewChannelStats), ViewChannelStats, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range vres.Rows {
+			key, ok := row.Key.([]interface{})
+			if !ok || len(key) < 1 {
+				continue
+			}
+			if name, ok := key[0].(string); ok {
+				result[name] = &ChannelDocStats{DocCount: viewRowCount(row.Value)}
+			}
+		}
+	} else {
+		for _, name := range channelNames {
+			opts := Body{"stale": false, "reduce": true,
+				"startkey": []interface{}{name}, "endkey": []interface{}{name, map[string]interface{}{}}}
+			vres, err := context.Bucket.View(context.DesignDocName(DesignDocSyncGatewayChannels, ViewChannelStats), ViewChannelStats, opts)
+			if err != nil {
+				return nil, err
+			}
+			stats := &ChannelDocStats{}
+			if len(vres.Rows) > 0 {
+				stats.DocCount = viewRowCount(vres.Rows[0].Value)
+			}
+			result[name] = stats
+		}
+	}
+
+	for name, stats := range result {
+		if stats.DocCount > 0 {
+			opts := Body{"stale": false, "reduce": false, "descending": true, "limit": 1,
+				"startkey": []interface{}{name, map[string]interface{}{}}, "endkey": []interface{}{name}}
+			vres, err := context.Bucket.View(context.DesignDocName(DesignDocSyncGatewayChannels, ViewChannelStats), ViewChannelStats, opts)
+			if err != nil {
+				return nil, err
+			}
+			if len(vres.Rows) > 0 {
+				if key, ok := vres.Rows[0].Key.([]interface{}); ok && len(key) > 1 {
+					if seq, ok := key[1].(float64); ok {
+						stats.LastSequence = uint64(seq)
+					}
+				}
+			}
+
+			if docIDLimit > 0 {
+				opts := Body{"stale": false, "reduce": false, "limit": docIDLimit,
+					"startkey": []interface{}{name}, "endkey": []interface{}{name, map[string]interface{}{}}}
+				vres, err := context.Bucket.View(context.DesignDocName(DesignDocSyncGatewayChannels, ViewChannelStats), ViewChannelStats, opts)
+				if err != nil {
+					return nil, err
+				}
+				stats.DocIDs = make([]string, 0, len(vres.Rows))
+				for _, row := range vres.Rows {
+					stats.DocIDs = append(stats.DocIDs, row.ID)
+				}
+			}
+		}
+
+		if changeCache, ok := context.changeCache.(*changeCache); ok {
+			stats.Cached, stats.CachedEntries = changeCache.channelCacheSize(name)
+		}
+	}
+	return result, nil
+}
+
+func viewRowCount(value interface{}) int {
+	switch count := value.(type) {
+	case float64:
+		return int(count)
+	case int:
+		return count
+	default:
+		base.Warn("Unexpected reduce value %v (%T) from channel_stats view", value, value)
+		return 0
+	}
+}
@@ -0,0 +1,347 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const kMaxConsistencyIssues = 1000 // Max number of inconsistent docs listed in the report
+
+// A document whose channel metadata or channel index entries are inconsistent.
+type ConsistencyIssue struct {
+	DocID             string   `json:"doc_id"`
+	MissingChannels   []string `json:"missing_channels,omitempty"`   // Assigned by the sync fn, but not in the metadata
+	ExtraChannels     []string `json:"extra_channels,omitempty"`     // In the metadata, but not assigned by the sync fn
+	UnindexedChannels []string `json:"unindexed_channels,omitempty"` // In the metadata, but not in the channels view
+	Repaired          bool     `json:"repaired,omitempty"`
+	Error             string   `json:"error,omitempty"`
+}
+
+// Progress, and after completion the report, of a background consistency check.  Its states are
+// the same as a background _resync's.
+type ConsistencyCheckStatus struct {
+	State            string             `json:"state,omitempty"`
+	Repair           bool               `json:"repair"`
+	DocsProcessed    int                `json:"docs_processed"`
+	DocsTotal        int                `json:"docs_total"`
+	DocsRemaining    int                `json:"docs_remaining"`
+	DocsInconsistent int                `json:"docs_inconsistent"`
+	DocsRepaired     int                `json:"docs_repaired"`
+	StartTime        *time.Time         `json:"start_time,omitempty"`
+	EndTime          *time.Time         `json:"end_time,omitempty"`
+	LastError        string             `json:"last_error,omitempty"`
+	Issues           []ConsistencyIssue `json:"issues"`
+	IssuesTruncated  bool               `json:"issues_truncated,omitempty"` // More docs were inconsistent than are listed
+}
+
+// State of the background consistency check task of a DatabaseContext.
+type consistencyCheckTask struct {
+	lock       sync.Mutex
+	status     ConsistencyCheckStatus
+	terminator chan struct{} // Closed to stop the running task
+	done       chan struct{} // Closed by the task once it has stopped
+}
+
+// Starts checking, in the background, that documents' channel metadata matches what the sync
+// function assigns, and that the channels view indexes them in those channels.  Checks the given
+// docs, or all current docs if docIDs is nil.  With repair, inconsistent docs have their metadata
+// rewritten and are given a new sequence, so that the view and the changes feeds pick them up.
+func (context *DatabaseContext) StartConsistencyCheck(docIDs []string, repair bool) error {
+	task := &context.consistencyCheck
+	task.lock.Lock()
+	defer task.lock.Unlock()
+
+	if task.status.State == ResyncStateRunning {
+		return base.HTTPErrorf(http.StatusServiceUnavailable, "A consistency check is already in progress")
+	}
+	now := time.Now()
+	task.status = ConsistencyCheckStatus{
+		State:     ResyncStateRunning,
+		Repair:    repair,
+		StartTime: &now,
+		Issues:    []ConsistencyIssue{},
+	}
+	task.terminator = make(chan struct{})
+	task.done = make(chan struct{})
+
+	go context.runConsistencyCheck(docIDs, repair, task.terminator, task.done)
+	return nil
+}
+
+// Stops a running consistency check, blocking until it has stopped.
+func (context *DatabaseContext) StopConsistencyCheck() error {
+	task := &context.consistencyCheck
+	task.lock.Lock()
+	if task.status.State != ResyncStateRunning {
+		task.lock.Unlock()
+		return base.HTTPErrorf(http.StatusBadRequest, "No consistency check is in progress")
+	}
+	close(task.terminator)
+	done := task.done
+	task.lock.Unlock()
+	<-done
+	return nil
+}
+
+// Returns the progress of the current or most recent consistency check, including the
+// inconsistent docs found so far.
+func (context *DatabaseContext) GetConsistencyCheckStatus() ConsistencyCheckStatus {
+	task := &context.consistencyCheck
+	task.lock.Lock()
+	defer task.lock.Unlock()
+	status := task.status
+	status.Issues = append([]ConsistencyIssue(nil), task.status.Issues...)
+	return status
+}
+
+func (context *DatabaseContext) runConsistencyCheck(docIDs []string, repair bool, terminator, done chan struct{}) {
+	defer close(done)
+	db, _ := CreateDatabase(context)
+	task := &context.consistencyCheck
+
+	total := len(docIDs)
+	if docIDs == nil {
+		var err error
+		if total, err = db.countCurrentDocs(); err != nil {
+			task.finish(ResyncStateError, err)
+			return
+		}
+	}
+	task.lock.Lock()
+	task.status.DocsTotal = total
+	task.status.DocsRemaining = total
+	task.lock.Unlock()
+	base.Logf("Checking channel consistency of %d documents of db %q...", total, context.Name)
+
+	// Bring the channels view up to date once, so that the docs can be looked up in it with stale=ok:
+	var vres channelsViewResult
+	if err := db.queryView(DesignDocSyncGatewayChannels, ViewChannels, Body{"stale": false, "limit": 1}, &vres, "channels"); err != nil {
+		task.finish(ResyncStateError, err)
+		return
+	}
+
+	checkDoc := func(docid string) bool {
+		select {
+		case <-terminator:
+			return false
+		default:
+		}
+		issue, err := db.checkDocConsistency(docid, repair)
+		task.lock.Lock()
+		defer task.lock.Unlock()
+		if err != nil && !base.IsDocNotFoundError(err) {
+			base.Warn("Consistency check of doc %q failed: %v", docid, err)
+			issue = &ConsistencyIssue{DocID: docid, Error: err.Error()}
+		}
+		if issue != nil {
+			task.status.DocsInconsistent++
+			if issue.Repaired {
+				task.status.DocsRepaired++
+			}
+			if len(task.status.Issues) < kMaxConsistencyIssues {
+				task.status.Issues = append(task.status.Issues, *issue)
+			} else {
+				task.status.IssuesTruncated = true
+			}
+		}
+		task.status.DocsProcessed++
+		task.status.DocsRemaining = remainingDocs(total, task.status.DocsProcessed)
+		return true
+	}
+
+	if docIDs != nil {
+		for _, docid := range docIDs {
+			if !checkDoc(docid) {
+				task.finish(ResyncStateStopped, nil)
+				return
+			}
+		}
+	} else {
+		lastDocID := ""
+		for {
+			startKey := []interface{}{true}
+			if lastDocID != "" {
+				startKey = append(startKey, lastDocID)
+			}
+			options := Body{"stale": false, "reduce": false, "startkey": startKey, "limit": kResyncBatchSize}
+			vres, err := db.Bucket.View(db.DesignDocName(DesignDocSyncHousekeeping, ViewImport), ViewImport, options)
+			if err != nil {
+				task.finish(ResyncStateError, err)
+				return
+			}
+			for _, row := range vres.Rows {
+				docid := row.Key.([]interface{})[1].(string)
+				if docid == lastDocID {
+					continue // startkey is inclusive, and this doc was already checked
+				}
+				if !checkDoc(docid) {
+					task.finish(ResyncStateStopped, nil)
+					return
+				}
+				lastDocID = docid
+			}
+			if len(vres.Rows) < kResyncBatchSize {
+				break
+			}
+		}
+	}
+
+	status := context.GetConsistencyCheckStatus()
+	base.Logf("Finished checking channel consistency of db %q; %d of %d docs inconsistent, %d repaired",
+		context.Name, status.DocsInconsistent, status.DocsProcessed, status.DocsRepaired)
+	task.finish(ResyncStateCompleted, nil)
+}
+
+func (task *consistencyCheckTask) finish(state string, err error) {
+	task.lock.Lock()
+	defer task.lock.Unlock()
+	task.status.State = state
+	now := time.Now()
+	task.status.EndTime = &now
+	if err != nil {
+		base.Warn("Consistency check failed: %v", err)
+		task.status.LastError = err.Error()
+	}
+}
+
+// Checks one document's channels.  Returns nil if they're consistent, else a description of the
+// discrepancies.  With repair, also fixes an inconsistent doc.
+func (db *Database) checkDocConsistency(docid string, repair bool) (*ConsistencyIssue, error) {
+	doc, err := db.GetDoc(docid)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := base.Set{}
+	for name, removal := range doc.Channels {
+		if removal == nil {
+			stored[name] = struct{}{}
+		}
+	}
+	body, err := db.getRevFromDoc(doc, doc.CurrentRev, false)
+	if err != nil {
+		return nil, err
+	}
+	expected, _, _, _, _, _, err := db.getChannelsAndAccess(doc, body, doc.CurrentRev)
+	if err != nil {
+		// Same as _resync: a doc the sync fn rejects isn't in any channels
+		expected = nil
+	}
+
+	issue := &ConsistencyIssue{DocID: docid}
+	for name := range expected {
+		if !stored.Contains(name) {
+			issue.MissingChannels = append(issue.MissingChannels, name)
+		}
+	}
+	for name := range stored {
+		if !expected.Contains(name) {
+			issue.ExtraChannels = append(issue.ExtraChannels, name)
+		}
+		indexed, err := db.isIndexedInChannel(docid, name, doc.Sequence)
+		if err != nil {
+			return nil, err
+		} else if !indexed {
+			issue.UnindexedChannels = append(issue.UnindexedChannels, name)
+		}
+	}
+	if issue.MissingChannels == nil && issue.ExtraChannels == nil && issue.UnindexedChannels == nil {
+		return nil, nil
+	}
+	sort.Strings(issue.MissingChannels)
+	sort.Strings(issue.ExtraChannels)
+	sort.Strings(issue.UnindexedChannels)
+	db.LogContext.Warn("Doc %q has inconsistent channels: missing %v, extra %v, unindexed %v",
+		docid, issue.MissingChannels, issue.ExtraChannels, issue.UnindexedChannels)
+
+	if repair {
+		if err := db.repairDocChannels(docid); err != nil {
+			issue.Error = fmt.Sprintf("Repair failed: %v", err)
+		} else {
+			issue.Repaired = true
+		}
+	}
+	return issue, nil
+}
+
+// Returns true if the channels view has an entry for the doc at the given sequence in the channel.
+// The view is queried with stale=ok, since a check starts by updating it; only if the entry isn't
+// found is it queried again with stale=false, in case the doc was written since.
+func (db *Database) isIndexedInChannel(docid string, channelName string, sequence uint64) (bool, error) {
+	indexed, err := db.findChannelsViewEntry(docid, channelName, sequence, ViewStaleOK)
+	if err != nil || indexed {
+		return indexed, err
+	}
+	return db.findChannelsViewEntry(docid, channelName, sequence, ViewStaleFalse)
+}
+
+func (db *Database) findChannelsViewEntry(docid string, channelName string, sequence uint64, stale string) (bool, error) {
+	var vres channelsViewResult
+	options := Body{"stale": viewStaleParam(stale), "key": []interface{}{channelName, sequence}}
+	if err := db.queryView(DesignDocSyncGatewayChannels, ViewChannels, options, &vres, fmt.Sprintf("channel %q", channelName)); err != nil {
+		return false, err
+	}
+	for _, row := range vres.Rows {
+		if row.ID == docid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Re-runs the sync function on a doc and rewrites its metadata with a new sequence.  Writing the
+// doc makes the view index it again, and the new sequence makes the change cache distribute it to
+// the channels it's now in.
+func (db *Database) repairDocChannels(docid string) error {
+	var newSequence uint64
+	var unusedSequences []uint64
+	err := db.updateDocMetadata(docid, func(doc *document) (*document, bool, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		if !doc.HasValidSyncData(db.writeSequences()) {
+			return nil, false, couchbase.UpdateCancel
+		}
+		if db.writeSequences() {
+			for newSequence <= doc.Sequence {
+				if newSequence > 0 {
+					unusedSequences = append(unusedSequences, newSequence)
+				}
+				var err error
+				if newSequence, err = db.sequences.nextSequence(); err != nil {
+					return nil, false, err
+				}
+			}
+			doc.Sequence = newSequence
+			doc.UnusedSequences = unusedSequences
+			doc.RecentSequences = append(doc.RecentSequences, unusedSequences...)
+			doc.RecentSequences = append(doc.RecentSequences, newSequence)
+		}
+		db.recomputeChannelsAndAccess(doc)
+		return doc, true, nil
+	})
+	if err != nil && db.writeSequences() {
+		if newSequence > 0 {
+			unusedSequences = append(unusedSequences, newSequence)
+		}
+		for _, sequence := range unusedSequences {
+			if seqErr := db.sequences.releaseSequence(sequence); seqErr != nil {
+				db.LogContext.Warn("Error returned when releasing sequence %d. Falling back to skipped sequence handling.  Error:%v", sequence, seqErr)
+			}
+		}
+	}
+	return err
+}
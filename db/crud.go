@@ -11,10 +11,13 @@ package db
 
 import (
 	"encoding/json"
+	"errors"
 	"math"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"fmt"
 
@@ -26,31 +29,100 @@ import (
 )
 
 const (
-	kMaxRecentSequences = 20 // Maximum number of sequences stored in RecentSequences before pruning is triggered
+	kMaxRecentSequences     = 20                     // Maximum number of sequences stored in RecentSequences before pruning is triggered
+	kSyncFnWarnThreshold    = 100 * time.Millisecond // Sync function invocations slower than this are logged
+	kMaxChannelNamesInError = 5                      // Number of channel names listed when a doc exceeds the channel limit
 )
 
 //////// READING DOCUMENTS:
 
-func realDocID(docid string) string {
-	if len(docid) > 250 {
-		return "" // Invalid doc IDs
+// Returns true if a doc ID has the prefix of the gateway's internal docs (like users, sessions and
+// old revisions), which a regular doc must never be stored under.
+func IsReservedDocID(docid string) bool {
+	return strings.HasPrefix(docid, KSyncKeyPrefix) || strings.HasPrefix(docid, base.KIndexPrefix)
+}
+
+// Max length of a bucket key, in bytes
+const MaxBucketKeyLength = 250
+
+// Most bytes an internal key adds to a doc ID: an old revision body's key is
+// "_sync:rev:<docid>:<length>:<revid>"
+const kMaxDocIDKeyOverhead = 64
+
+// Default, and greatest, max length of a doc ID in bytes
+const DefaultMaxDocIDLength = MaxBucketKeyLength - kMaxDocIDKeyOverhead
+
+// Least max length of a doc ID in bytes; it has to fit the IDs Post generates
+const MinMaxDocIDLength = 32
+
+// Checks that the ID of a doc being created, of any kind of doc, is valid UTF-8 and not too long
+// to fit in the keys it's stored under.  Docs created before these limits may break them, so
+// they're not checked when reading, updating or deleting a doc.
+func (context *DatabaseContext) checkDocIDFormat(docid string) error {
+	maxLength := context.GetOptions().MaxDocIDLength
+	if maxLength <= 0 || maxLength > DefaultMaxDocIDLength {
+		maxLength = DefaultMaxDocIDLength
+	} else if maxLength < MinMaxDocIDLength {
+		maxLength = MinMaxDocIDLength
 	}
-	if strings.HasPrefix(docid, "_") {
-		return "" // Disallow "_" prefix, which is for special docs
+	if docid == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid doc ID")
+	} else if !utf8.ValidString(docid) {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid doc ID %q: it isn't valid UTF-8", docid)
+	} else if len(docid) > maxLength {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid doc ID %q: it's longer than %d bytes", docid, maxLength)
+	}
+	return nil
+}
+
+// Checks that a doc ID can be used by a regular doc.  IDs starting with "_" are reserved for
+// special docs (like _local/ and _design/ docs) and the gateway's internal docs.  The unsupported
+// allow_underscore_doc_ids option permits the ones that aren't internal docs' prefixes.
+// New docs' IDs are also checked by checkDocIDFormat.
+func (context *DatabaseContext) ValidateDocID(docid string) error {
+	if docid == "" || len(docid) > MaxBucketKeyLength {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid doc ID")
+	} else if IsReservedDocID(docid) {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid doc ID %q: its prefix is reserved for internal docs", docid)
+	} else if strings.HasPrefix(docid, "_") && !context.GetOptions().UnsupportedOptions.AllowUnderscoreDocIDs {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid doc ID %q: IDs starting with \"_\" are reserved", docid)
+	}
+	return nil
+}
+
+// Returns the bucket key of a regular doc, or "" if its ID is invalid.
+func (context *DatabaseContext) realDocID(docid string) string {
+	if context.ValidateDocID(docid) != nil {
+		return ""
 	}
 	return docid
 }
 
 // Lowest-level method that reads a document from the bucket.
 func (db *DatabaseContext) GetDoc(docid string) (doc *document, err error) {
-	key := realDocID(docid)
+	// A concurrent write may replace the doc's out-of-line body between reading the doc and its
+	// body, in which case the doc is read again:
+	for attempt := 1; ; attempt++ {
+		doc, err = db.getDoc(docid)
+		if err != errOutOfLineBodyMissing || attempt >= kMaxOutOfLineBodyAttempts {
+			return doc, err
+		}
+	}
+}
+
+func (db *DatabaseContext) getDoc(docid string) (doc *document, err error) {
+	key := db.realDocID(docid)
 	if key == "" {
 		return nil, base.HTTPErrorf(400, "Invalid doc ID")
 	}
 	dbExpvars.Add("document_gets", 1)
 	if db.UseXattrs() {
 		var rawDoc, rawXattr []byte
-		cas, getErr := db.Bucket.GetWithXattr(key, KSyncXattrName, &rawDoc, &rawXattr)
+		var cas uint64
+		getErr := db.retryBucketOp("GetDoc "+key, true, func() (opErr error) {
+			cas, opErr = db.Bucket.GetWithXattr(key, KSyncXattrName, &rawDoc, &rawXattr)
+			return opErr
+		})
 		if getErr != nil {
 			return nil, getErr
 		}
@@ -68,14 +140,22 @@ func (db *DatabaseContext) GetDoc(docid string) (doc *document, err error) {
 			if importErr != nil {
 				return nil, importErr
 			}
+		} else if err = db.loadOutOfLineBody(doc); err != nil {
+			return nil, err
 		}
 
 	} else {
 		doc = newDocument(docid)
-		_, err = db.Bucket.Get(key, doc)
+		err = db.retryBucketOp("GetDoc "+key, true, func() (opErr error) {
+			_, opErr = db.Bucket.Get(key, doc)
+			return opErr
+		})
 		if err != nil {
 			return nil, err
 		}
+		if err = db.loadOutOfLineBody(doc); err != nil {
+			return nil, err
+		}
 	}
 
 	if !doc.HasValidSyncData(db.writeSequences()) {
@@ -87,12 +167,16 @@ func (db *DatabaseContext) GetDoc(docid string) (doc *document, err error) {
 // This gets *just* the Sync Metadata (_sync field) rather than the entire doc, for efficiency reasons
 func (db *DatabaseContext) GetDocSyncData(docid string) (syncData, error) {
 
-	key := realDocID(docid)
+	key := db.realDocID(docid)
 	if key == "" {
 		return syncData{}, base.HTTPErrorf(400, "Invalid doc ID")
 	}
 	dbExpvars.Add("document_gets", 1)
-	rawDocBytes, _, err := db.Bucket.GetRaw(key)
+	var rawDocBytes []byte
+	err := db.retryBucketOp("GetDocSyncData "+key, true, func() (opErr error) {
+		rawDocBytes, _, opErr = db.Bucket.GetRaw(key)
+		return opErr
+	})
 	if err != nil {
 		return syncData{}, err
 	}
@@ -103,11 +187,73 @@ func (db *DatabaseContext) GetDocSyncData(docid string) (syncData, error) {
 	if err := json.Unmarshal(rawDocBytes, &docRoot); err != nil {
 		return syncData{}, err
 	}
+	if err := docRoot.SyncData.checkMetadataVersion(); err != nil {
+		return syncData{}, err
+	}
 
 	return *docRoot.SyncData, nil
 
 }
 
+// Gets the sync metadata of a set of docs, by doc ID, in a single bulk bucket operation unless it's
+// in xattrs, which can't be bulk-loaded; then, or if the bulk get fails, each doc is read on its
+// own.  Docs that don't exist or can't be read are left out.
+func (db *DatabaseContext) getDocsSyncData(docids []string) map[string]*syncData {
+	result := make(map[string]*syncData, len(docids))
+	if !db.UseXattrs() {
+		keys := make([]string, 0, len(docids))
+		for _, docid := range docids {
+			if key := db.realDocID(docid); key != "" {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			return result
+		}
+		dbExpvars.Add("document_gets", int64(len(keys)))
+		rawDocs, err := db.Bucket.GetBulkRaw(keys)
+		if err == nil {
+			for docid, rawDoc := range rawDocs {
+				docRoot := documentRoot{SyncData: &syncData{History: make(RevTree)}}
+				if json.Unmarshal(rawDoc, &docRoot) == nil && docRoot.SyncData.checkMetadataVersion() == nil {
+					result[docid] = docRoot.SyncData
+				}
+			}
+			return result
+		}
+		base.Warn("Bulk get of the sync metadata of %d docs failed; getting them individually: %v", len(keys), err)
+	}
+	for _, docid := range docids {
+		if syncData := db.peekSyncData(docid); syncData != nil {
+			result[docid] = syncData
+		}
+	}
+	return result
+}
+
+// Returns a document as it's stored in the bucket, including its _sync metadata, for debugging.
+// If includeBody is false, only the metadata is returned.  Bypasses the revision cache.
+func (db *DatabaseContext) GetRawDocJSON(docid string, includeBody bool) ([]byte, error) {
+	doc, err := db.GetDoc(docid)
+	if doc == nil {
+		return nil, err
+	}
+	if !includeBody {
+		return json.Marshal(Body{"_sync": &doc.syncData})
+	}
+	return json.Marshal(doc)
+}
+
+// Returns the stored body of a revision of a document, if it's still available, for debugging.
+// Bypasses the revision cache.
+func (db *Database) GetRawRevisionJSON(docid, revid string) ([]byte, error) {
+	doc, err := db.GetDoc(docid)
+	if doc == nil {
+		return nil, err
+	}
+	return db.getRevisionJSON(doc, revid)
+}
+
 // This is the RevisionCacheLoaderFunc callback for the context's RevisionCache.
 // Its job is to load a revision from the bucket when there's a cache miss.
 func (context *DatabaseContext) revCacheLoader(id IDAndRev) (body Body, history Body, channels base.Set, err error) {
@@ -150,6 +296,10 @@ func (db *Database) GetRev(docid, revid string, history bool, attachmentsSince [
 //   revisions for which the client already has attachments and doesn't need bodies. Any attachment
 //   that hasn't changed since one of those revisions will be returned as a stub.
 func (db *Database) GetRevWithHistory(docid, revid string, maxHistory int, historyFrom []string, attachmentsSince []string, showExp bool) (Body, error) {
+	if err := db.checkCancelled(); err != nil {
+		return nil, err
+	}
+	base.MetricDocReads.Add(db.Name, 1)
 	var doc *document
 	var body Body
 	var revisions map[string]interface{}
@@ -193,7 +343,7 @@ func (db *Database) GetRevWithHistory(docid, revid string, maxHistory int, histo
 
 	// Authorize the access:
 	if db.user != nil {
-		if err := db.user.AuthorizeAnyChannel(inChannels); err != nil {
+		if err := db.authorizeAnyChannel(inChannels); err != nil {
 			if !revIDGiven {
 				return nil, base.HTTPErrorf(403, "forbidden")
 			}
@@ -237,6 +387,12 @@ func (db *Database) GetRevWithHistory(docid, revid string, maxHistory int, histo
 		}
 	}
 
+	// A tombstone written before deletions' attachments were stripped may still have attachment
+	// metadata, whose blobs needn't exist any more; it's returned without them:
+	if deleted, _ := body["_deleted"].(bool); deleted && body["_attachments"] != nil {
+		delete(body, "_attachments")
+	}
+
 	// Add attachment bodies:
 	if attachmentsSince != nil && len(BodyAttachments(body)) > 0 {
 		minRevpos := 1
@@ -277,6 +433,9 @@ func (db *Database) GetDocAndActiveRev(docid string) (populatedDoc *document, bo
 // Returns the body of a revision of a document, as well as the document's current channels
 // and the user/roles it grants channel access to.
 func (db *Database) GetRevAndChannels(docid string, revid string, listRevisions bool) (body Body, channels channels.ChannelMap, access UserAccessMap, roleAccess UserAccessMap, flags uint8, sequence uint64, err error) {
+	if err = db.checkCancelled(); err != nil {
+		return
+	}
 	doc, err := db.GetDoc(docid)
 	if doc == nil {
 		return
@@ -313,7 +472,7 @@ func (db *Database) authorizeDoc(doc *document, revid string) error {
 	}
 	if rev := doc.History[revid]; rev != nil {
 		// Authenticate against specific revision:
-		return db.user.AuthorizeAnyChannel(rev.Channels)
+		return db.authorizeAnyChannel(rev.Channels)
 	} else {
 		// No such revision; let the caller proceed and return a 404
 		return nil
@@ -432,7 +591,7 @@ func (db *Database) backupAncestorRevs(doc *document, revid string) error {
 	// Store the JSON as a separate doc in the bucket:
 	if err := db.setOldRevisionJSON(doc.ID, revid, json); err != nil {
 		// This isn't fatal since we haven't lost any information; just warn about it.
-		base.Warn("backupAncestorRevs failed: doc=%q rev=%q err=%v", doc.ID, revid, err)
+		db.LogContext.Warn("backupAncestorRevs failed: doc=%q rev=%q err=%v", doc.ID, revid, err)
 		return err
 	}
 
@@ -442,7 +601,7 @@ func (db *Database) backupAncestorRevs(doc *document, revid string) error {
 	} else {
 		doc.History.setRevisionBody(revid, nil)
 	}
-	base.LogTo("CRUD+", "Backed up obsolete rev %q/%q", doc.ID, revid)
+	db.LogContext.LogTo("CRUD+", "Backed up obsolete rev %q/%q", doc.ID, revid)
 	return nil
 }
 
@@ -467,20 +626,26 @@ func (db *Database) initializeSyncData(doc *document) (err error) {
 // The new body's "_rev" property must match the current revision's, if any.
 func (db *Database) Put(docid string, body Body) (newRevID string, err error) {
 	// Get the revision ID to match, and the new generation number:
-	matchRev, _ := body["_rev"].(string)
+	matchRev, _ := body.GetString("_rev")
 	generation, _ := ParseRevID(matchRev)
 	if generation < 0 {
 		return "", base.HTTPErrorf(http.StatusBadRequest, "Invalid revision ID")
 	}
 	generation++
-	deleted, _ := body["_deleted"].(bool)
+	deleted, _ := body.GetBool("_deleted")
+	if deleted {
+		if _, err := db.stripDeletionAttachments(docid, body); err != nil {
+			return "", err
+		}
+	}
 
 	expiry, err := body.extractExpiry()
 	if err != nil {
 		return "", base.HTTPErrorf(http.StatusBadRequest, "Invalid expiry: %v", err)
 	}
+	maxOperationIDs, operationIDTTL := db.operationIDLimits()
 
-	return db.updateDoc(docid, true, expiry, func(doc *document) (Body, AttachmentData, error) {
+	newRevID, err = db.updateDoc(docid, true, expiry, func(doc *document) (Body, AttachmentData, error) {
 
 		// If doc isn't an SG write, import it before updating.
 		if doc != nil && !doc.IsSGWrite() {
@@ -504,6 +669,14 @@ func (db *Database) Put(docid string, body Body) (newRevID string, err error) {
 			}
 		}
 
+		// A retry of an operation that already created a revision gets that revision:
+		now := time.Now().Unix()
+		if db.operationID != "" {
+			if revid := doc.operationRev(db.operationID, db.operationUser(), now-int64(operationIDTTL/time.Second)); revid != "" {
+				return nil, nil, &operationDoneError{revID: revid}
+			}
+		}
+
 		// (Be careful: this block can be invoked multiple times if there are races!)
 		// First, make sure matchRev matches an existing leaf revision:
 		if matchRev == "" {
@@ -512,13 +685,13 @@ func (db *Database) Put(docid string, body Body) (newRevID string, err error) {
 				// PUT with no parent rev given, but there is an existing current revision.
 				// This is OK as long as the current one is deleted.
 				if !doc.History[matchRev].Deleted {
-					return nil, nil, base.HTTPErrorf(http.StatusConflict, "Document exists")
+					return nil, nil, newDocConflictError(doc, "Document exists")
 				}
 				generation, _ = ParseRevID(matchRev)
 				generation++
 			}
 		} else if !doc.History.isLeaf(matchRev) {
-			return nil, nil, base.HTTPErrorf(http.StatusConflict, "Document revision conflict")
+			return nil, nil, newDocConflictError(doc, "Document revision conflict")
 		}
 
 		// Process the attachments, replacing bodies with digests. This alters 'body' so it has to
@@ -532,23 +705,56 @@ func (db *Database) Put(docid string, body Body) (newRevID string, err error) {
 		newRev := createRevID(generation, matchRev, body)
 		body["_rev"] = newRev
 		doc.History.addRevision(RevInfo{ID: newRev, Parent: matchRev, Deleted: deleted})
+		if db.operationID != "" {
+			record := operationRecord{ID: db.operationID, User: db.operationUser(), Rev: newRev, Time: now}
+			doc.recordOperation(record, maxOperationIDs, operationIDTTL)
+		}
 		return body, newAttachments, nil
 	})
+	if done, ok := err.(*operationDoneError); ok {
+		db.LogContext.LogTo("CRUD", "Operation %q already created doc %q rev %s", db.operationID, docid, done.revID)
+		return done.revID, nil
+	}
+	return newRevID, err
+}
+
+// Returns the error for an update that conflicts with the doc's revisions, describing the doc as
+// it was read by the update.
+func newDocConflictError(doc *document, message string) error {
+	return &base.DocConflictError{
+		Message:    message,
+		CurrentRev: doc.CurrentRev,
+		Deleted:    doc.CurrentRev != "" && doc.History[doc.CurrentRev].Deleted,
+		Leaves:     doc.History.GetLeaves(),
+	}
 }
 
 // Adds an existing revision to a document along with its history (list of rev IDs.)
 // This is equivalent to the "new_edits":false mode of CouchDB.
 func (db *Database) PutExistingRev(docid string, body Body, docHistory []string) error {
+	_, err := db.PutExistingRevIfNew(docid, body, docHistory)
+	return err
+}
+
+// Like PutExistingRev, but also returns whether any revisions were added; if the doc already
+// had the revision, nothing changes and added is false.
+func (db *Database) PutExistingRevIfNew(docid string, body Body, docHistory []string) (added bool, err error) {
 	newRev := docHistory[0]
 	generation, _ := ParseRevID(newRev)
 	if generation < 0 {
-		return base.HTTPErrorf(http.StatusBadRequest, "Invalid revision ID")
+		return false, base.HTTPErrorf(http.StatusBadRequest, "Invalid revision ID")
+	}
+	deleted, _ := body.GetBool("_deleted")
+	strippedAttachments := false
+	if deleted {
+		if strippedAttachments, err = db.stripDeletionAttachments(docid, body); err != nil {
+			return false, err
+		}
 	}
-	deleted, _ := body["_deleted"].(bool)
 
 	expiry, err := body.extractExpiry()
 	if err != nil {
-		return base.HTTPErrorf(http.StatusBadRequest, "Invalid expiry: %v", err)
+		return false, base.HTTPErrorf(http.StatusBadRequest, "Invalid expiry: %v", err)
 	}
 
 	_, err = db.updateDoc(docid, true, expiry, func(doc *document) (Body, AttachmentData, error) {
@@ -566,6 +772,7 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 		}
 
 		// (Be careful: this block can be invoked multiple times if there are races!)
+		added = false
 		// Find the point where this doc's history branches from the current rev:
 		currentRevIndex := len(docHistory)
 		parent := ""
@@ -577,7 +784,7 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 			}
 		}
 		if currentRevIndex == 0 {
-			base.LogTo("CRUD+", "PutExistingRev(%q): No new revisions to add", docid)
+			db.LogContext.LogTo("CRUD+", "PutExistingRev(%q): No new revisions to add", docid)
 			return nil, nil, couchbase.UpdateCancel // No new revisions to add
 		}
 
@@ -596,10 +803,17 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 		if err != nil {
 			return nil, nil, err
 		}
+		// (A deletion's rev ID can't be verified once its attachments have been stripped.)
+		if db.GetOptions().VerifyRevIDs && !strippedAttachments {
+			if err := verifyRevID(newRev, generation, parentRevID, body); err != nil {
+				return nil, nil, err
+			}
+		}
 		body["_rev"] = newRev
+		added = true
 		return body, newAttachments, nil
 	})
-	return err
+	return added, err
 }
 
 type ImportMode uint8
@@ -618,7 +832,7 @@ func (db *Database) ImportDocRaw(docid string, value []byte, isDelete bool, cas
 	} else {
 		err := body.Unmarshal(value)
 		if err != nil {
-			base.LogTo("Import", "Unmarshal error during importDoc %v", err)
+			db.LogContext.LogTo("Import", "Unmarshal error during importDoc %v", err)
 			return nil, err
 		}
 	}
@@ -627,29 +841,33 @@ func (db *Database) ImportDocRaw(docid string, value []byte, isDelete bool, cas
 }
 
 func (db *Database) ImportDoc(docid string, body Body, isDelete bool, importCas uint64, mode ImportMode) (docOut *document, err error) {
+	// Docs written to the bucket under reserved IDs are never imported:
+	if err := db.ValidateDocID(docid); err != nil {
+		return nil, err
+	}
 
-	base.LogTo("Import+", "Attempting to import doc %q...", docid)
+	db.LogContext.LogTo("Import+", "Attempting to import doc %q...", docid)
 	var newRev string
 	var alreadyImportedDoc *document
 	docOut, _, err = db.updateAndReturnDoc(docid, true, 0, func(doc *document) (Body, AttachmentData, error) {
 
 		// Check if the doc has been deleted
 		if doc.Cas == 0 {
-			base.LogTo("Import+", "Document has been removed from the bucket before it could be imported - cancelling import.")
+			db.LogContext.LogTo("Import+", "Document has been removed from the bucket before it could be imported - cancelling import.")
 			return nil, nil, base.ErrImportCancelled
 		}
 
 		// If this is a delete, and there is no xattr on the existing doc,
 		// we shouldn't import.  (SG purge arriving over DCP feed)
 		if isDelete && doc.CurrentRev == "" {
-			base.LogTo("Import+", "Import not required for delete mutation with no existing SG xattr (SG purge): %s", docid)
+			db.LogContext.LogTo("Import+", "Import not required for delete mutation with no existing SG xattr (SG purge): %s", docid)
 			return nil, nil, base.ErrImportCancelled
 		}
 
 		// If the current version of the doc is an SG write, document has been updated by SG subsequent to the update that triggered this import.
 		// Cancel update
 		if doc.IsSGWrite() {
-			base.LogTo("Import+", "During import, existing doc (%s) identified as SG write.  Canceling import.", docid)
+			db.LogContext.LogTo("Import+", "During import, existing doc (%s) identified as SG write.  Canceling import.", docid)
 			alreadyImportedDoc = doc
 			return nil, nil, base.ErrAlreadyImported
 		}
@@ -667,12 +885,17 @@ func (db *Database) ImportDoc(docid string, body Body, isDelete bool, importCas
 			}
 		}
 
+		// Only import docs the import filter accepts.  (Deletes of already-imported docs are always imported.)
+		if !isDelete && !db.shouldImport(docid, body) {
+			return nil, nil, base.ErrImportFiltered
+		}
+
 		// The active rev is the parent for an import
 		parentRev := doc.CurrentRev
 		generation, _ := ParseRevID(parentRev)
 		generation++
 		newRev = createRevID(generation, parentRev, body)
-		base.LogTo("Import", "Created new rev ID %v", newRev)
+		db.LogContext.LogTo("Import", "Created new rev ID %v", newRev)
 		body["_rev"] = newRev
 		doc.History.addRevision(RevInfo{ID: newRev, Parent: parentRev, Deleted: isDelete})
 
@@ -689,14 +912,14 @@ func (db *Database) ImportDoc(docid string, body Body, isDelete bool, importCas
 		// If the doc was already imported, we want to return the imported version
 		docOut = alreadyImportedDoc
 	case nil:
-		base.LogTo("Import+", "Imported %s (delete=%v) as rev %s", docid, isDelete, newRev)
+		db.LogContext.LogTo("Import+", "Imported %s (delete=%v) as rev %s", docid, isDelete, newRev)
 	case base.ErrImportCancelled:
 		// Import was cancelled (SG purge) - don't return error.
-	case base.ErrImportCasFailure:
-		// Import was cancelled due to CAS failure.
+	case base.ErrImportCasFailure, base.ErrImportFiltered:
+		// Import was cancelled due to CAS failure, or rejected by the import filter.
 		return nil, err
 	default:
-		base.LogTo("Import", "Error importing doc %q: %v", docid, err)
+		db.LogContext.LogTo("Import", "Error importing doc %q: %v", docid, err)
 		return nil, err
 
 	}
@@ -704,6 +927,35 @@ func (db *Database) ImportDoc(docid string, body Body, isDelete bool, importCas
 	return docOut, nil
 }
 
+// What an update would have done, as found by a dry run of it.
+type DryRunResult struct {
+	RevID    string             `json:"rev"`
+	Channels base.Set           `json:"channels"`
+	Access   channels.AccessMap `json:"access,omitempty"`
+	Roles    channels.AccessMap `json:"roles,omitempty"`
+}
+
+// Returned by the update callback of a dry run to abort the update before it's written.
+var errDryRun = errors.New("Dry run")
+
+// Returned by the update callback when the sync function sets a different expiry than the write
+// was started with, to abort it so that it's made again with that expiry.
+var errWriteExpiryChanged = errors.New("Write expiry changed")
+
+// Max number of times a write is made again because the sync function changed its expiry.  (A
+// far-off expiry is an absolute time, so it may move on by a second between attempts.)
+const kMaxWriteExpiryAttempts = 3
+
+// Returns a copy of the database handle whose document updates are dry runs: they go through the
+// same path as real ones (attachment processing, conflict checks, validation and the sync function)
+// but stop before anything is written, storing what they'd have done in result.  A rejected update
+// returns its error as usual.
+func (db *Database) WithDryRun(result *DryRunResult) *Database {
+	dryRunDB := *db
+	dryRunDB.dryRun = result
+	return &dryRunDB
+}
+
 // Common subroutine of Put and PutExistingRev: a shell that loads the document, lets the caller
 // make changes to it in a callback and supply a new body, then saves the body and document.
 func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, callback func(*document) (Body, AttachmentData, error)) (newRevID string, err error) {
@@ -712,10 +964,24 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 }
 
 func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry uint32, callback func(*document) (Body, AttachmentData, error)) (docOut *document, newRevID string, err error) {
-	key := realDocID(docid)
-	if key == "" {
-		return nil, "", base.HTTPErrorf(400, "Invalid doc ID")
+	// A concurrent write may replace the doc's out-of-line body after the doc is read, in which
+	// case the update is made again on the new version of the doc:
+	for attempt := 1; ; attempt++ {
+		docOut, newRevID, err = db.updateAndReturnDocOnce(docid, allowImport, expiry, callback)
+		if err != errOutOfLineBodyMissing || attempt >= kMaxOutOfLineBodyAttempts {
+			return docOut, newRevID, err
+		}
+	}
+}
+
+func (db *Database) updateAndReturnDocOnce(docid string, allowImport bool, expiry uint32, callback func(*document) (Body, AttachmentData, error)) (docOut *document, newRevID string, err error) {
+	if err := db.checkCancelled(); err != nil {
+		return nil, "", err
+	}
+	if err := db.ValidateDocID(docid); err != nil {
+		return nil, "", err
 	}
+	key := docid
 
 	var parentRevID string
 	var doc *document
@@ -726,15 +992,51 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 	var unusedSequences []uint64
 	var oldBodyJSON string
 	var newAttachments AttachmentData
+	var syncExpiry *uint32
+	var prevBodyKey string
+	var writtenBodyKeys []string
+	var prevState docState
+	writeExpiry, writeExpiryAttempt := expiry, 1
+
+	// Aborts the write if the sync function's expiry isn't the one it's being made with, unless
+	// it's been made again too many times already:
+	checkWriteExpiry := func() error {
+		newExpiry := expiry
+		if syncExpiry != nil {
+			newExpiry = *syncExpiry
+		}
+		if newExpiry != writeExpiry && writeExpiryAttempt < kMaxWriteExpiryAttempts {
+			writeExpiry = newExpiry
+			return errWriteExpiryChanged
+		}
+		return nil
+	}
 
 	// documentUpdateFunc applies the changes to the document.  Called by either WriteUpdate or WriteUpdateWithXATTR below.
 	documentUpdateFunc := func(doc *document, docExists bool) (updatedDoc *document, writeOpts sgbucket.WriteOptions, shadowerEcho bool, err error) {
 
 		// Be careful: this block can be invoked multiple times if there are races!
+		// A request that's been cancelled while retrying doesn't write:
+		if err = db.checkCancelled(); err != nil {
+			return
+		}
 		if !allowImport && docExists && !doc.HasValidSyncData(db.writeSequences()) {
 			err = base.HTTPErrorf(409, "Not imported")
 			return
 		}
+		if !docExists {
+			if err = db.checkDocIDFormat(docid); err != nil {
+				return
+			}
+		}
+
+		// Load the current revision's body if it's stored out of line, since it may move into the
+		// revision tree and the sync function sees it as the old doc:
+		if err = db.loadOutOfLineBody(doc); err != nil {
+			return
+		}
+		prevBodyKey = doc.BodyKey
+		prevState = doc.syncData.docState()
 
 		// Invoke the callback to update the document and return a new revision body:
 		body, newAttachments, err = callback(doc)
@@ -760,9 +1062,13 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 		}
 
 		// Determine which is the current "winning" revision (it's not necessarily the new one):
-		newRevID = body["_rev"].(string)
+		newRevID, _ = body.GetString("_rev")
 		parentRevID = doc.History[newRevID].Parent
 		prevCurrentRev := doc.CurrentRev
+		if info := doc.History[prevCurrentRev]; info != nil && info.UpdatedBy == "" {
+			// Written before writers were recorded per revision, when only the doc had one:
+			info.UpdatedBy = doc.UpdatedBy
+		}
 		var branched, inConflict bool
 		doc.CurrentRev, branched, inConflict = doc.History.winningRevision()
 		doc.setFlag(channels.Deleted, doc.History[doc.CurrentRev].Deleted)
@@ -799,13 +1105,40 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 			}
 		}
 
-		// Run the sync function, to validate the update and compute its channels/access:
+		// Run the validate function, then the sync function, to validate the update and compute its
+		// channels/access:
 		body["_id"] = doc.ID
-		channelSet, access, roles, oldBody, err := db.getChannelsAndAccess(doc, body, newRevID)
+		if err = db.validateDoc(doc, body, newRevID); err != nil {
+			return
+		}
+		channelSet, access, roles, grantExpiry, revExpiry, oldBody, err := db.getChannelsAndAccess(doc, body, newRevID)
 		if err != nil {
 			return
 		}
 
+		// A dry run stops here, before any sequence is allocated or anything is written:
+		if db.dryRun != nil {
+			*db.dryRun = DryRunResult{RevID: newRevID, Channels: channelSet, Access: access, Roles: roles}
+			err = errDryRun
+			return
+		}
+
+		// Record who made this write, so the sync function of the revisions based on it can see it
+		if db.user != nil {
+			doc.UpdatedBy = db.user.Name()
+		} else {
+			doc.UpdatedBy = ""
+		}
+		if info := doc.History[newRevID]; info != nil {
+			info.UpdatedBy = doc.UpdatedBy
+		}
+
+		// An expiry set by the sync function overrides the requested expiry, except for tombstones
+		syncExpiry = nil
+		if revExpiry != nil && !doc.History[newRevID].Deleted {
+			syncExpiry = revExpiry
+		}
+
 		//Assign old revision body to variable in method scope
 		oldBodyJSON = oldBody
 
@@ -826,7 +1159,7 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 					// we previously allocated is unusable now. We have to allocate a new sequence
 					// instead, but we add the unused one(s) to the document so when the changeCache
 					// reads the doc it won't freak out over the break in the sequence numbering.
-					base.LogTo("Cache", "updateDoc %q: Unused sequence #%d", docid, docSequence)
+					db.LogContext.LogTo("Cache", "updateDoc %q: Unused sequence #%d", docid, docSequence)
 					unusedSequences = append(unusedSequences, docSequence)
 				}
 
@@ -893,9 +1226,9 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 				// channels & access, for purposes of updating the doc:
 				var curBody Body
 				if curBody, err = db.getAvailableRev(doc, doc.CurrentRev); curBody != nil {
-					base.LogTo("CRUD+", "updateDoc(%q): Rev %q causes %q to become current again",
+					db.LogContext.LogTo("CRUD+", "updateDoc(%q): Rev %q causes %q to become current again",
 						docid, newRevID, doc.CurrentRev)
-					channelSet, access, roles, oldBody, err = db.getChannelsAndAccess(doc, curBody, doc.CurrentRev)
+					channelSet, access, roles, grantExpiry, _, oldBody, err = db.getChannelsAndAccess(doc, curBody, doc.CurrentRev)
 
 					//Assign old revision body to variable in method scope
 					oldBodyJSON = oldBody
@@ -904,19 +1237,24 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 					}
 				} else {
 					// Shouldn't be possible (CurrentRev is a leaf so won't have been compacted)
-					base.Warn("updateDoc(%q): Rev %q missing, can't call getChannelsAndAccess "+
+					db.LogContext.Warn("updateDoc(%q): Rev %q missing, can't call getChannelsAndAccess "+
 						"on it (err=%v)", docid, doc.CurrentRev, err)
 					channelSet = nil
 					access = nil
 					roles = nil
+					grantExpiry = channels.GrantExpiry{}
 				}
 			}
 
 			// Update the document struct's channel assignment and user access.
 			// (This uses the new sequence # so has to be done after updating doc.Sequence)
 			changedChannels = doc.updateChannels(channelSet) //FIX: Incorrect if new rev is not current!
-			changedPrincipals = doc.Access.updateAccess(doc, access)
-			changedRoleUsers = doc.RoleAccess.updateAccess(doc, roles)
+			if trimmed := doc.pruneChannelHistory(db.GetOptions().ChannelHistoryRetention); trimmed > 0 {
+				dbExpvars.Add("channel_history_bytes_trimmed", int64(trimmed))
+			}
+			changedPrincipals = doc.Access.updateAccess(doc, access, grantExpiry.Access)
+			changedRoleUsers = doc.RoleAccess.updateAccess(doc, roles, grantExpiry.Roles)
+			doc.SyncFnEpoch = db.SyncFnEpoch()
 
 			if len(changedPrincipals) > 0 || len(changedRoleUsers) > 0 {
 
@@ -932,102 +1270,142 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 			}
 
 		} else {
-			base.LogTo("CRUD+", "updateDoc(%q): Rev %q leaves %q still current",
+			db.LogContext.LogTo("CRUD+", "updateDoc(%q): Rev %q leaves %q still current",
 				docid, newRevID, prevCurrentRev)
 		}
 
 		// Prune old revision history to limit the number of revisions:
 		if pruned := doc.History.pruneRevisions(db.RevsLimit, doc.CurrentRev); pruned > 0 {
-			base.LogTo("CRUD+", "updateDoc(%q): Pruned %d old revisions", docid, pruned)
+			db.LogContext.LogTo("CRUD+", "updateDoc(%q): Pruned %d old revisions", docid, pruned)
 		}
 
+		doc.migrateMetadata(db.syncMetadataWriteVersion())
 		doc.TimeSaved = time.Now()
-		doc.UpdateExpiry(expiry)
+		if syncExpiry != nil {
+			doc.UpdateExpiry(*syncExpiry)
+		} else {
+			doc.UpdateExpiry(expiry)
+		}
+
+		var writtenBodyKey string
+		if writtenBodyKey, err = db.storeOutOfLineBody(doc); err != nil {
+			return
+		} else if writtenBodyKey != "" {
+			writtenBodyKeys = append(writtenBodyKeys, writtenBodyKey)
+		}
 
 		// Now that the document has been successfully validated, we can store any new attachments
 		db.setAttachments(newAttachments)
+		db.addAttachmentRefs(docid, newAttachments)
 		return doc, writeOpts, shadowerEcho, err
 	}
 
 	var shadowerEcho bool
 
-	// Update the document
-	if db.UseXattrs() {
-		var casOut uint64
-		casOut, err = db.Bucket.WriteUpdateWithXattr(key, KSyncXattrName, int(expiry), func(currentValue []byte, currentXattr []byte, cas uint64) (raw []byte, rawXattr []byte, deleteDoc bool, err error) {
-			// Be careful: this block can be invoked multiple times if there are races!
-			if doc, err = unmarshalDocumentWithXattr(docid, currentValue, currentXattr, cas); err != nil {
-				return
-			}
+	// Update the document, with the expiry set by the sync function:
+	for ; ; writeExpiryAttempt++ {
+		if db.UseXattrs() {
+			var casOut uint64
+			err = db.retryBucketOp("WriteUpdateWithXattr "+key, false, func() (opErr error) {
+				casOut, opErr = db.Bucket.WriteUpdateWithXattr(key, KSyncXattrName, int(writeExpiry), func(currentValue []byte, currentXattr []byte, cas uint64) (raw []byte, rawXattr []byte, deleteDoc bool, err error) {
+					// Be careful: this block can be invoked multiple times if there are races!
+					if doc, err = unmarshalDocumentWithXattr(docid, currentValue, currentXattr, cas); err != nil {
+						return
+					}
 
-			docOut, _, _, err = documentUpdateFunc(doc, currentValue != nil)
-			if err != nil {
-				return
-			}
+					docOut, _, _, err = documentUpdateFunc(doc, currentValue != nil)
+					if err == nil {
+						err = checkWriteExpiry()
+					}
+					if err != nil {
+						return
+					}
 
-			currentRevFromHistory, ok := docOut.History[docOut.CurrentRev]
-			if !ok {
-				err = fmt.Errorf("WriteUpdateWithXattr() not able to find revision (%v) in history of doc: %+v.  Cannot update doc.", docOut.CurrentRev, docOut)
-				return
-			}
+					currentRevFromHistory, ok := docOut.History[docOut.CurrentRev]
+					if !ok {
+						err = fmt.Errorf("WriteUpdateWithXattr() not able to find revision (%v) in history of doc: %+v.  Cannot update doc.", docOut.CurrentRev, docOut)
+						return
+					}
 
-			deleteDoc = currentRevFromHistory.Deleted
+					deleteDoc = currentRevFromHistory.Deleted
 
-			// Return the new raw document value for the bucket to store.
-			raw, rawXattr, err = docOut.MarshalWithXattr()
-			base.LogTo("CRUD+", "Saving doc (seq: #%d, id: %v rev: %v)", doc.Sequence, doc.ID, doc.CurrentRev)
-			return raw, rawXattr, deleteDoc, err
-		})
-		if err != nil {
-			base.LogTo("CRUD+", "Did not update document %q w/ xattr: %v", key, err)
-		} else if docOut != nil {
-			docOut.Cas = casOut
-		}
-	} else {
-		err = db.Bucket.WriteUpdate(key, int(expiry), func(currentValue []byte) (raw []byte, writeOpts sgbucket.WriteOptions, err error) {
-			// Be careful: this block can be invoked multiple times if there are races!
-			if doc, err = unmarshalDocument(docid, currentValue); err != nil {
-				return
-			}
-			docOut, writeOpts, shadowerEcho, err = documentUpdateFunc(doc, currentValue != nil)
+					// Return the new raw document value for the bucket to store.
+					raw, rawXattr, err = docOut.MarshalWithXattr()
+					db.LogContext.LogTo("CRUD+", "Saving doc (seq: #%d, id: %v rev: %v)", doc.Sequence, doc.ID, doc.CurrentRev)
+					return raw, rawXattr, deleteDoc, err
+				})
+				return opErr
+			})
 			if err != nil {
-				return
+				db.LogContext.LogTo("CRUD+", "Did not update document %q w/ xattr: %v", key, err)
+			} else if docOut != nil {
+				docOut.Cas = casOut
 			}
+		} else {
+			err = db.retryBucketOp("WriteUpdate "+key, false, func() (opErr error) {
+				opErr = db.Bucket.WriteUpdate(key, int(writeExpiry), func(currentValue []byte) (raw []byte, writeOpts sgbucket.WriteOptions, err error) {
+					// Be careful: this block can be invoked multiple times if there are races!
+					if doc, err = unmarshalDocument(docid, currentValue); err != nil {
+						return
+					}
+					docOut, writeOpts, shadowerEcho, err = documentUpdateFunc(doc, currentValue != nil)
+					if err == nil {
+						err = checkWriteExpiry()
+					}
+					if err != nil {
+						return
+					}
 
-			// Return the new raw document value for the bucket to store.
-			raw, err = json.Marshal(docOut)
-			base.LogTo("CRUD+", "Saving doc (seq: #%d, id: %v rev: %v)", doc.Sequence, doc.ID, doc.CurrentRev)
+					// Return the new raw document value for the bucket to store.
+					raw, err = json.Marshal(docOut)
+					db.LogContext.LogTo("CRUD+", "Saving doc (seq: #%d, id: %v rev: %v)", doc.Sequence, doc.ID, doc.CurrentRev)
 
-			return raw, writeOpts, err
-		})
+					return raw, writeOpts, err
+				})
+				return opErr
+			})
+		}
+		if err != errWriteExpiryChanged {
+			break
+		}
 	}
 
 	// If the WriteUpdate didn't succeed, check whether there are unused, allocated sequences that need to be accounted for
 	if err != nil && db.writeSequences() {
 		if docSequence > 0 {
 			if seqErr := db.sequences.releaseSequence(docSequence); seqErr != nil {
-				base.Warn("Error returned when releasing sequence %d. Falling back to skipped sequence handling.  Error:%v", docSequence, seqErr)
+				db.LogContext.Warn("Error returned when releasing sequence %d. Falling back to skipped sequence handling.  Error:%v", docSequence, seqErr)
 			}
 
 		}
 		for _, sequence := range unusedSequences {
 			if seqErr := db.sequences.releaseSequence(sequence); seqErr != nil {
-				base.Warn("Error returned when releasing sequence %d. Falling back to skipped sequence handling.  Error:%v", sequence, seqErr)
+				db.LogContext.Warn("Error returned when releasing sequence %d. Falling back to skipped sequence handling.  Error:%v", sequence, seqErr)
 			}
 		}
 	}
 
-	if err == couchbase.UpdateCancel {
+	if err == errDryRun {
+		return nil, newRevID, nil
+	} else if err == couchbase.UpdateCancel {
 		return nil, "", nil
 	} else if err == couchbase.ErrOverwritten {
 		// ErrOverwritten is ok; if a later revision got persisted, that's fine too
-		base.LogTo("CRUD+", "Note: Rev %q/%q was overwritten in RAM before becoming indexable",
+		db.LogContext.LogTo("CRUD+", "Note: Rev %q/%q was overwritten in RAM before becoming indexable",
 			docid, newRevID)
 	} else if err != nil {
 		return nil, "", err
 	}
 
+	// The bodies the doc used to point to, or that were written by attempts that lost a race, are
+	// no longer referenced:
+	if docOut != nil {
+		db.removeOutOfLineBodies(docOut, append(writtenBodyKeys, prevBodyKey)...)
+		db.docCounts.recordChange(prevState, docOut.syncData.docState())
+	}
+
 	dbExpvars.Add("revs_added", 1)
+	base.MetricDocWrites.Add(db.Name, 1)
 
 	if doc.History[newRevID] != nil {
 		// Store the new revision in the cache
@@ -1047,22 +1425,22 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 		}
 	} else {
 		//Revision has been pruned away so won't be added to cache
-		base.LogTo("CRUD", "doc %q / %q, has been pruned, it has not been inserted into the revision cache", docid, newRevID)
+		db.LogContext.LogTo("CRUD", "doc %q / %q, has been pruned, it has not been inserted into the revision cache", docid, newRevID)
 	}
 
 	// Now that the document has successfully been stored, we can make other db changes:
-	base.LogTo("CRUD", "Stored doc %q / %q", docid, newRevID)
+	db.LogContext.LogTo("CRUD", "Stored doc %q / %q", docid, newRevID)
 
 	// Mark affected users/roles as needing to recompute their channel access:
 	if len(changedPrincipals) > 0 {
-		base.LogTo("Access", "Rev %q/%q invalidates channels of %s", docid, newRevID, changedPrincipals)
+		db.LogContext.LogTo("Access", "Rev %q/%q invalidates channels of %s", docid, newRevID, changedPrincipals)
 		for _, name := range changedPrincipals {
 			db.invalUserOrRoleChannels(name)
 			//If this is the current in memory db.user, reload to generate updated channels
 			if db.user != nil && db.user.Name() == name {
 				user, err := db.Authenticator().GetUser(db.user.Name())
 				if err != nil {
-					base.Warn("Error reloading db.user[%s], channels list is out of date --> %+v", db.user.Name(), err)
+					db.LogContext.Warn("Error reloading db.user[%s], channels list is out of date --> %+v", db.user.Name(), err)
 				} else {
 					db.user = user
 				}
@@ -1071,14 +1449,14 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 	}
 
 	if len(changedRoleUsers) > 0 {
-		base.LogTo("Access", "Rev %q/%q invalidates roles of %s", docid, newRevID, changedRoleUsers)
+		db.LogContext.LogTo("Access", "Rev %q/%q invalidates roles of %s", docid, newRevID, changedRoleUsers)
 		for _, name := range changedRoleUsers {
 			db.invalUserRoles(name)
 			//If this is the current in memory db.user, reload to generate updated roles
 			if db.user != nil && db.user.Name() == name {
 				user, err := db.Authenticator().GetUser(db.user.Name())
 				if err != nil {
-					base.Warn("Error reloading db.user[%s], roles list is out of date --> %+v", db.user.Name(), err)
+					db.LogContext.Warn("Error reloading db.user[%s], roles list is out of date --> %+v", db.user.Name(), err)
 				} else {
 					db.user = user
 				}
@@ -1098,7 +1476,11 @@ func (db *Database) Post(body Body) (string, string, error) {
 	// If there's an incoming _id property, use that as the doc ID.
 	docid, idFound := body["_id"].(string)
 	if !idFound {
-		docid = base.CreateUUID()
+		if db.operationID != "" {
+			docid = db.operationDocID()
+		} else {
+			docid = base.CreateUUID()
+		}
 	}
 
 	rev, err := db.Put(docid, body)
@@ -1116,20 +1498,38 @@ func (db *Database) DeleteDoc(docid string, revid string) (string, error) {
 
 // Purges a document from the bucket (no tombstone)
 func (db *Database) Purge(key string) error {
+	if err := db.checkCancelled(); err != nil {
+		return err
+	}
+
+	// The doc's revisions are about to disappear from the bucket, so don't keep serving them:
+	defer db.revisionCache.Invalidate(key)
 
+	var state docState
+	var bodyKey string
+	if sync := db.peekSyncData(key); sync != nil {
+		state, bodyKey = sync.docState(), sync.BodyKey
+	}
+	var err error
 	if db.UseXattrs() {
-		return db.Bucket.DeleteWithXattr(key, KSyncXattrName)
+		err = db.Bucket.DeleteWithXattr(key, KSyncXattrName)
 	} else {
-		return db.Bucket.Delete(key)
+		err = db.Bucket.Delete(key)
 	}
+	if err == nil {
+		db.docCounts.recordChange(state, docState{})
+		// The doc's out-of-line body goes with it:
+		db.removeOutOfLineBodies(&document{ID: key}, bodyKey)
+	}
+	return err
 }
 
 //////// CHANNELS:
 
 // Calls the JS sync function to assign the doc to channels, grant users
 // access to channels, and reject invalid documents.
-func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string) (result base.Set, access channels.AccessMap, roles channels.AccessMap, oldJson string, err error) {
-	base.LogTo("CRUD+", "Invoking sync on doc %q rev %s", doc.ID, body["_rev"])
+func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string) (result base.Set, access channels.AccessMap, roles channels.AccessMap, grantExpiry channels.GrantExpiry, expiry *uint32, oldJson string, err error) {
+	db.LogContext.LogTo("CRUD+", "Invoking sync on doc %q rev %s", doc.ID, body["_rev"])
 
 	// Get the parent revision, to pass to the sync function:
 	var oldJsonBytes []byte
@@ -1138,24 +1538,43 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 	}
 	oldJson = string(oldJsonBytes)
 
-	if db.ChannelMapper != nil {
+	// Get the sync function once, since a config reload may replace it:
+	if mapper := db.GetChannelMapper(); mapper != nil {
 		// Call the ChannelMapper:
 		var output *channels.ChannelMapperOutput
-		output, err = db.ChannelMapper.MapToChannelsAndAccess(body, oldJson,
-			makeUserCtx(db.user))
-		if err == nil {
+		startTime := time.Now()
+		output, err = mapper.MapToChannelsAndAccess(body, oldJson,
+			db.makeSyncMeta(doc, revID), makeUserCtx(db.user))
+		if elapsed := time.Since(startTime); elapsed > kSyncFnWarnThreshold {
+			db.LogContext.LogTo("CRUD", "Sync fn for doc %q rev %s took %v", doc.ID, revID, elapsed)
+		}
+		if err == channels.ErrSyncFnTimeout {
+			dbExpvars.Add("sync_function_timeouts", 1)
+			db.LogContext.Warn("Sync fn timed out processing doc %q rev %s", doc.ID, revID)
+			err = base.HTTPErrorf(500, "Sync function timed out processing doc %q", doc.ID)
+		} else if err == nil {
 			result = output.Channels
 			access = output.Access
 			roles = output.Roles
+			grantExpiry = output.GrantExpiry
+			expiry = output.Expiry
 			err = output.Rejection
 			if err != nil {
+				base.MetricSyncFnRejections.Add(db.Name, 1)
 				base.Logf("Sync fn rejected: new=%+v  old=%s --> %s", body, oldJson, err)
+				err = db.recordSyncRejection(doc.ID, revID, err)
 			} else if !validateAccessMap(access) || !validateRoleAccessMap(roles) {
 				err = base.HTTPErrorf(500, "Error in JS sync function")
+			} else {
+				err = db.checkChannelLimits(doc.ID, result, access, roles)
 			}
 
+		} else if httpErr, ok := err.(*base.HTTPError); ok {
+			// The sync function passed an invalid value, such as an illegal channel name, to a callback
+			db.LogContext.Warn("Sync fn error: %v; doc = %q", err, doc.ID)
+			err = base.HTTPErrorf(500, "Error in JS sync function: %s", httpErr.Message)
 		} else {
-			base.Warn("Sync fn exception: %+v; doc = %s", err, body)
+			db.LogContext.Warn("Sync fn exception: %+v; doc = %s", err, body)
 			err = base.HTTPErrorf(500, "Exception in JS sync function")
 		}
 
@@ -1165,11 +1584,120 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 		if value != nil {
 			array := base.ValueToStringArray(value)
 			result, err = channels.SetFromArray(array, channels.KeepStar)
+			if err == nil {
+				err = db.checkChannelLimits(doc.ID, result, nil, nil)
+			}
 		}
 	}
 	return
 }
 
+// Rejects a doc that's assigned to more channels, or that grants a user or role more channels or
+// roles, than the database's MaxChannelsPerDoc allows.  Guards against runaway sync functions.
+func (context *DatabaseContext) checkChannelLimits(docID string, result base.Set, access, roles channels.AccessMap) error {
+	limit := context.maxChannelsPerDoc()
+	if limit == 0 {
+		return nil
+	}
+	if err := checkChannelSetLimit(docID, "channels", result, limit); err != nil {
+		return err
+	}
+	for name, set := range access {
+		if err := checkChannelSetLimit(docID, fmt.Sprintf("channel grants to %q", name), set, limit); err != nil {
+			return err
+		}
+	}
+	for name, set := range roles {
+		if err := checkChannelSetLimit(docID, fmt.Sprintf("role grants to %q", name), set, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkChannelSetLimit(docID string, what string, set base.Set, limit int) error {
+	if len(set) <= limit {
+		return nil
+	}
+	names := set.ToArray()
+	sort.Strings(names)
+	if len(names) > kMaxChannelNamesInError {
+		names = append(names[:kMaxChannelNamesInError], "...")
+	}
+	dbExpvars.Add("channel_limit_exceeded", 1)
+	base.Warn("Doc %q has %d %s, exceeding the limit of %d", docID, len(set), what, limit)
+	return base.HTTPErrorf(http.StatusInternalServerError, "Doc %q has %d %s, exceeding the limit of %d: %s",
+		docID, len(set), what, limit, strings.Join(names, ", "))
+}
+
+// Runs a sync function against a document without saving anything, as the given user (nil for an
+// admin write).  Uses the database's sync function, unless syncFn is non-empty.  Rejections are
+// returned in the output rather than as an error.
+func (context *DatabaseContext) DryRunSyncFunction(syncFn string, newDoc Body, oldDoc Body, user auth.User) (*channels.ChannelMapperOutput, error) {
+	var oldJson string
+	if oldDoc != nil {
+		oldJsonBytes, err := json.Marshal(oldDoc)
+		if err != nil {
+			return nil, err
+		}
+		oldJson = string(oldJsonBytes)
+	}
+
+	generation, _ := ParseRevID(fmt.Sprintf("%v", newDoc["_rev"]))
+	meta := map[string]interface{}{
+		"old_channels": []string{},
+		"updated_by":   "",
+		"generation":   generation + 1,
+		"admin":        user == nil,
+	}
+
+	var output *channels.ChannelMapperOutput
+	var err error
+	if syncFn != "" {
+		runner, compileErr := channels.NewSyncRunnerWithTimeout(syncFn, context.syncFnTimeout())
+		if compileErr != nil {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid sync function: %v", compileErr)
+		}
+		output, err = runner.MapToChannelsAndAccess(newDoc, oldJson, meta, makeUserCtx(user))
+	} else if mapper := context.GetChannelMapper(); mapper != nil {
+		output, err = mapper.MapToChannelsAndAccess(newDoc, oldJson, meta, makeUserCtx(user))
+	} else {
+		output, err = channels.NewDefaultChannelMapper().MapToChannelsAndAccess(newDoc, oldJson, meta, makeUserCtx(user))
+	}
+
+	if err == channels.ErrSyncFnTimeout {
+		return nil, base.HTTPErrorf(http.StatusInternalServerError, "Sync function timed out")
+	} else if err != nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Exception in sync function: %v", err)
+	}
+	if output.Rejection == nil && (!validateAccessMap(output.Access) || !validateRoleAccessMap(output.Roles)) {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Sync function granted access to an invalid user or role name")
+	}
+	return output, nil
+}
+
+// Creates the meta object passed to the sync function, describing the revision being replaced
+// and the source of the write
+func (db *Database) makeSyncMeta(doc *document, revID string) map[string]interface{} {
+	generation, _ := ParseRevID(revID)
+	oldChannels := []string{}
+	updatedBy := ""
+	if parentRevID := doc.History.getParent(revID); parentRevID != "" {
+		if parent := doc.History[parentRevID]; parent != nil {
+			if parent.Channels != nil {
+				oldChannels = parent.Channels.ToArray()
+			}
+			updatedBy = parent.UpdatedBy
+		}
+	}
+	return map[string]interface{}{
+		"old_channels": oldChannels,
+		"updated_by":   updatedBy,
+		"generation":   generation,
+		"admin":        db.user == nil,
+	}
+}
+
 // Creates a userCtx object to be passed to the sync function
 func makeUserCtx(user auth.User) map[string]interface{} {
 	if user == nil {
@@ -1182,6 +1710,32 @@ func makeUserCtx(user auth.User) map[string]interface{} {
 	}
 }
 
+// Calls the JS validate function, if any, which can reject a revision before the sync function runs.
+func (db *Database) validateDoc(doc *document, body Body, revID string) error {
+	validator := db.GetValidator()
+	if validator == nil {
+		return nil
+	}
+	oldJson, err := db.getAncestorJSON(doc, revID)
+	if err != nil {
+		return err
+	}
+	rejection, err := validator.Validate(body, string(oldJson), makeUserCtx(db.user))
+	if err == channels.ErrSyncFnTimeout {
+		dbExpvars.Add("validate_function_timeouts", 1)
+		db.LogContext.Warn("Validate fn timed out processing doc %q rev %s", doc.ID, revID)
+		return base.HTTPErrorf(500, "Validate function timed out processing doc %q", doc.ID)
+	} else if err != nil {
+		db.LogContext.Warn("Validate fn exception: %+v; doc = %q", err, doc.ID)
+		return base.HTTPErrorf(500, "Exception in JS validate function")
+	} else if rejection != nil {
+		dbExpvars.Add("validate_function_rejections", 1)
+		db.LogContext.LogTo("CRUD+", "Validate fn rejected doc %q rev %s: %v", doc.ID, revID, rejection)
+		return db.recordSyncRejection(doc.ID, revID, rejection)
+	}
+	return nil
+}
+
 // Are the principal and role names in an AccessMap all valid?
 func validateAccessMap(access channels.AccessMap) bool {
 	for name := range access {
@@ -1229,22 +1783,7 @@ func (context *DatabaseContext) ComputeSequenceChannelsForPrincipal(princ auth.P
 	if _, ok := princ.(auth.User); !ok {
 		key = "role:" + key // Roles are identified in access view by a "role:" prefix
 	}
-
-	var vres struct {
-		Rows []struct {
-			Value channels.TimedSet
-		}
-	}
-
-	opts := map[string]interface{}{"stale": false, "key": key}
-	if verr := context.Bucket.ViewCustom(DesignDocSyncGatewayAccess, ViewAccess, opts, &vres); verr != nil {
-		return nil, verr
-	}
-	channelSet := channels.TimedSet{}
-	for _, row := range vres.Rows {
-		channelSet.Add(row.Value)
-	}
-	return channelSet, nil
+	return context.querier.queryAccess(key)
 }
 
 // Recomputes the set of channels a User/Role has been granted access to by sync() functions.
@@ -1262,7 +1801,7 @@ func (context *DatabaseContext) ComputeVbSequenceChannelsForPrincipal(princ auth
 	}
 
 	opts := map[string]interface{}{"stale": false, "key": key}
-	if verr := context.Bucket.ViewCustom(DesignDocSyncGatewayAccessVbSeq, ViewAccessVbSeq, opts, &vres); verr != nil {
+	if verr := context.Bucket.ViewCustom(context.DesignDocName(DesignDocSyncGatewayAccessVbSeq, ViewAccessVbSeq), ViewAccessVbSeq, opts, &vres); verr != nil {
 		return nil, verr
 	}
 
@@ -1286,26 +1825,7 @@ func (context *DatabaseContext) ComputeRolesForUser(user auth.User) (channels.Ti
 // Recomputes the set of roles a User has been granted access to by sync() functions.
 // This is part of the ChannelComputer interface defined by the Authenticator.
 func (context *DatabaseContext) ComputeSequenceRolesForUser(user auth.User) (channels.TimedSet, error) {
-	var vres struct {
-		Rows []struct {
-			Value channels.TimedSet
-		}
-	}
-
-	opts := map[string]interface{}{"stale": false, "key": user.Name()}
-	if verr := context.Bucket.ViewCustom(DesignDocSyncGatewayRoleAccess, ViewRoleAccess, opts, &vres); verr != nil {
-		return nil, verr
-	}
-	// Merge the TimedSets from the view result:
-	var result channels.TimedSet
-	for _, row := range vres.Rows {
-		if result == nil {
-			result = row.Value
-		} else {
-			result.Add(row.Value)
-		}
-	}
-	return result, nil
+	return context.querier.queryRoleAccess(user.Name())
 }
 
 // Recomputes the set of channels a User/Role has been granted access to by sync() functions.
@@ -1318,7 +1838,7 @@ func (context *DatabaseContext) ComputeVbSequenceRolesForUser(user auth.User) (c
 	}
 
 	opts := map[string]interface{}{"stale": false, "key": user.Name()}
-	if verr := context.Bucket.ViewCustom(DesignDocSyncGatewayRoleAccessVbSeq, ViewRoleAccessVbSeq, opts, &vres); verr != nil {
+	if verr := context.Bucket.ViewCustom(context.DesignDocName(DesignDocSyncGatewayRoleAccessVbSeq, ViewRoleAccessVbSeq), ViewRoleAccessVbSeq, opts, &vres); verr != nil {
 		return nil, verr
 	}
 
@@ -1340,14 +1860,54 @@ func (db *Database) RevDiff(docid string, revids []string) (missing, possible []
 	doc, err := db.GetDoc(docid)
 	if err != nil {
 		if !base.IsDocNotFoundError(err) {
-			base.Warn("RevDiff(%q) --> %T %v", docid, err, err)
+			db.LogContext.Warn("RevDiff(%q) --> %T %v", docid, err, err)
 			// If something goes wrong getting the doc, treat it as though it's nonexistent.
 		}
 		missing = revids
 		return
 	}
+	return revDiff(doc.History, revids)
+}
+
+// Like RevDiff, but for a set of docs, given as a map from doc ID to revision IDs. Returns maps
+// from doc ID to missing revisions and possible ancestors, for the docs that have missing revisions.
+// The docs' sync metadata is read by getDocsSyncData, in a single bulk bucket operation if it can be.
+func (db *Database) RevsDiff(docRevs map[string][]string) (missing, possible map[string][]string) {
+	missing = make(map[string][]string)
+	possible = make(map[string][]string)
+
+	docids := make([]string, 0, len(docRevs))
+	for docid := range docRevs {
+		if strings.HasPrefix(docid, "_design/") && db.user != nil {
+			continue // Users can't upload design docs, so ignore them
+		}
+		docids = append(docids, docid)
+	}
+	docsSyncData := db.getDocsSyncData(docids)
+
+	for _, docid := range docids {
+		var revtree RevTree
+		if sync := docsSyncData[docid]; sync != nil && sync.HasValidSyncData(db.writeSequences()) {
+			revtree = sync.History
+		}
+		if docMissing, docPossible := revDiff(revtree, docRevs[docid]); docMissing != nil {
+			missing[docid] = docMissing
+			if docPossible != nil {
+				possible[docid] = docPossible
+			}
+		}
+	}
+	return
+}
+
+// Checks which of the revids are missing from a doc's rev tree, and which of the tree's revisions
+// might be recent ancestors of the missing ones.  A nil tree means the doc doesn't exist.
+func revDiff(revtree RevTree, revids []string) (missing, possible []string) {
+	if revtree == nil {
+		missing = revids
+		return
+	}
 	// Check each revid to see if it's in the doc's rev tree:
-	revtree := doc.History
 	revidsSet := base.SetFromArray(revids)
 	possibleSet := make(map[string]bool)
 	for _, revid := range revids {
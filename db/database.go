@@ -47,11 +47,21 @@ var RunStateString = []string{
 }
 
 const (
-	DefaultRevsLimit     = 1000
-	DefaultPurgeInterval = 30               // Default metadata purge interval, in days.  Used if server's purge interval is unavailable
-	KSyncKeyPrefix       = "_sync:"         // All special/internal documents the gateway creates have this prefix in their keys.
-	kSyncDataKey         = "_sync:syncdata" // Key used to store sync function
-	KSyncXattrName       = "_sync"          // Name of XATTR used to store sync metadata
+	DefaultRevsLimit         = 1000
+	DefaultPurgeInterval     = 30               // Default metadata purge interval, in days.  Used if server's purge interval is unavailable
+	DefaultMaxChannelsPerDoc = 1000             // Default max number of channels a doc can be assigned to
+	DefaultMaxSessionTTL     = 24 * time.Hour   // Default max TTL of a session created through the public API
+	DefaultMaxBulkDocs       = 10000            // Default max number of docs in a _bulk_docs request
+	DefaultMaxBulkDocsBytes  = 100 << 20        // Default max size of a _bulk_docs request body
+	DefaultMaxAllDocsKeys    = 10000            // Default max number of keys in an _all_docs request
+	DefaultMaxBulkPrincipals = 10000            // Default max number of users or roles in a _user/_bulk or _role/_bulk request
+	DefaultMaxLocalDocBytes  = 1 << 20          // Default max size of a _local doc
+	DefaultChangesBuffer     = 1000             // Default max number of changes buffered for a continuous feed's client
+	DefaultBreakerThreshold  = 50               // Default number of failed bucket ops in a row that make later ones fail fast
+	DefaultBreakerOpenTime   = 5 * time.Second  // Default time bucket ops fail fast for, once the breaker opens
+	KSyncKeyPrefix           = "_sync:"         // All special/internal documents the gateway creates have this prefix in their keys.
+	kSyncDataKey             = "_sync:syncdata" // Key used to store sync function
+	KSyncXattrName           = "_sync"          // Name of XATTR used to store sync metadata
 )
 
 // Basic description of a database. Shared between all Database objects on the same database.
@@ -63,36 +73,103 @@ type DatabaseContext struct {
 	BucketLock         sync.RWMutex            // Control Access to the underlying bucket object
 	tapListener        changeListener          // Listens on server Tap feed -- TODO: change to mutationListener
 	sequences          *sequenceAllocator      // Source of new sequence numbers
-	ChannelMapper      *channels.ChannelMapper // Runs JS 'sync' function
+	configLock         sync.RWMutex            // Protects ChannelMapper, syncFnEpoch, Validator and Options, which a config reload replaces
+	ChannelMapper      *channels.ChannelMapper // Runs JS 'sync' function; see GetChannelMapper
+	syncFnEpoch        string                  // Epoch of the sync function; see SyncFnEpoch
+	Validator          *channels.DocValidator  // Runs JS 'validate' function; see GetValidator
 	StartTime          time.Time               // Timestamp when context was instantiated
 	ChangesClientStats Statistics              // Tracks stats of # of changes connections
 	RevsLimit          uint32                  // Max depth a document's revision tree can grow to
 	autoImport         bool                    // Add sync data to new untracked docs?
 	Shadower           *Shadower               // Tracks an external Couchbase bucket
 	revisionCache      *RevisionCache          // Cache of recently-accessed doc revisions
+	bodyDeltaCache     *base.LRUCache          // Cache of deltas between revision bodies
 	changeCache        ChangeIndex             //
+	querier            indexQuerier            // Makes the channel, _all_docs and access queries, with views or N1QL
+	docCounts          *docCounter             // Keeps the document counts
+	userActivity       *userActivityTracker    // Notes users' latest changes requests and checkpoints
+	sessionCleaner     *auth.SessionCleaner    // Deletes stale session docs
+	designDocs         *designDocMigration     // Which version of the built-in design docs is queried
 	EventMgr           *EventManager           // Manages notification events
 	AllowEmptyPassword bool                    // Allow empty passwords?  Defaults to false
 	SequenceHasher     *sequenceHasher         // Used to generate and resolve hash values for vector clock sequences
 	SequenceType       SequenceType            // Type of sequences used for this DB (integer or vector clock)
-	Options            DatabaseContextOptions  // Database Context Options
+	Options            *DatabaseContextOptions // Database Context Options; see GetOptions and UpdateOptions
 	AccessLock         sync.RWMutex            // Allows DB offline to block until synchronous calls have completed
 	State              uint32                  // The runtime state of the DB from a service perspective
 	ExitChanges        chan struct{}           // Active _changes feeds on the DB will close when this channel is closed
 	OIDCProviders      auth.OIDCProviderMap    // OIDC clients
+	JWTBearer          *auth.JWTBearerAuth     // Validates bearer JWTs from an external identity provider
+	GuestRateLimiter   *base.RateLimiter       // Limits unauthenticated requests per client IP, if configured
 	PurgeInterval      int                     // Metadata purge interval, in hours
+	resync             resyncTask              // Background _resync task
+	consistencyCheck   consistencyCheckTask    // Background channel consistency check
+	refreshingUsers    int32                   // Set while RefreshAllUserChannels is running
+	bucketRetryPolicy  base.BucketRetryPolicy  // How bucket ops that fail with transient errors are retried
+	bucketBreaker      *base.CircuitBreaker    // Makes bucket ops fail fast while the server is unavailable
+	syncRejections     *syncRejectionLog       // Recent sync function rejections
+	LogKeys            *base.LogKeySet         // The database's own log keys and level, if it has them
+	logContext         *base.LogContext        // Tags the database's log messages that aren't made for a request
 }
 
 type DatabaseContextOptions struct {
-	CacheOptions          *CacheOptions
-	IndexOptions          *ChannelIndexOptions
-	SequenceHashOptions   *SequenceHashOptions
-	RevisionCacheCapacity uint32
-	AdminInterface        *string
-	UnsupportedOptions    UnsupportedOptions
-	TrackDocs             bool // Whether doc tracking channel should be created (used for autoImport, shadowing)
-	OIDCOptions           *auth.OIDCOptions
-	DBOnlineCallback      DBOnlineCallback // Callback function to take the DB back online
+	CacheOptions              *CacheOptions
+	IndexOptions              *ChannelIndexOptions
+	SequenceHashOptions       *SequenceHashOptions
+	RevisionCacheCapacity     uint32
+	RevisionCacheMaxBytes     int64 // Max estimated size of the revision cache; 0 for no limit
+	AdminInterface            *string
+	UnsupportedOptions        UnsupportedOptions
+	TrackDocs                 bool // Whether doc tracking channel should be created (used for autoImport, shadowing)
+	OIDCOptions               *auth.OIDCOptions
+	JWTBearerOptions          *auth.JWTBearerOptions
+	DBOnlineCallback          DBOnlineCallback // Callback function to take the DB back online
+	SyncFnTimeout             time.Duration    // Max execution time of a sync function invocation.  Defaults to channels.DefaultSyncFnTimeout
+	ValidateFnTimeout         time.Duration    // Max execution time of a validate function invocation.  Defaults to channels.DefaultSyncFnTimeout
+	MaxChannelsPerDoc         *uint32          // Max channels a doc may be assigned to (or grant a principal).  Defaults to DefaultMaxChannelsPerDoc; 0 for no limit
+	MaxSessionTTL             time.Duration    // Max TTL a client may request when creating a session through the public API.  Defaults to DefaultMaxSessionTTL
+	BcryptCost                int              // bcrypt cost of password hashes; 0 for the default
+	GuestRateLimit            *GuestRateLimitConfig
+	GuestMaxChannels          uint32   // Max channels the guest user may be granted; 0 for no limit
+	MaxBulkDocs               uint32   // Max docs in a _bulk_docs request.  Defaults to DefaultMaxBulkDocs
+	MaxBulkDocsBytes          int64    // Max size of a _bulk_docs request body.  Defaults to DefaultMaxBulkDocsBytes
+	MaxAllDocsKeys            uint32   // Max keys in an _all_docs request.  Defaults to DefaultMaxAllDocsKeys
+	MaxBulkPrincipals         uint32   // Max users or roles in a _user/_bulk or _role/_bulk request.  Defaults to DefaultMaxBulkPrincipals
+	MaxLocalDocBytes          int64    // Max size of a _local doc.  Defaults to DefaultMaxLocalDocBytes
+	ChangesBuffer             uint32   // Max changes buffered for a continuous feed's client.  Defaults to DefaultChangesBuffer
+	LogKeys                   []string // Log keys of the database's messages; the global ones if empty
+	LogLevel                  int      // Log level of the database's messages; the global one if 0
+	BucketRetry               *BucketRetryConfig
+	ViewQuery                 *ViewQueryConfig
+	N1QL                      *N1QLConfig
+	ChangesFilters            map[string]*channels.ChangesFilterFunction
+	ImportFilter              *ImportFilterFunction // Decides which docs written directly to the bucket are imported; nil to import all
+	HideSyncRejectionMessages bool                  // If true, the public API doesn't show the messages thrown by the sync function
+	ChannelHistoryRetention   uint64                // Number of sequences a doc's channel history keeps its channel removals; 0 to keep them forever
+	ClusterCompatVersion      int                   // Sync metadata version docs are written in; 0 for MaxSyncMetadataVersion
+	OutOfLineBodyThreshold    int                   // Min size in bytes of a body stored out of line; 0 to store all bodies inline
+	InlineBodies              bool                  // Moves bodies stored out of line back into their docs as they're written
+	VerifyRevIDs              bool                  // Rejects revisions pushed with new_edits=false whose rev IDs don't match their content
+	DisableGuest              bool                  // Unauthenticated public API requests, other than GET /{db}/, fail with a 401 rather than acting as the guest user
+	SessionCleanup            auth.SessionCleanupOptions
+	PasswordPolicy            auth.PasswordPolicy
+	MaxDocIDLength            int           // Max length of a doc ID in bytes; 0 for DefaultMaxDocIDLength
+	MaxAttachmentNameLength   int           // Max length of a new attachment's name in bytes; 0 for DefaultMaxAttachmentNameLength
+	MaxOperationIDs           int           // Max operation IDs recorded per doc.  Defaults to DefaultMaxOperationIDs
+	OperationIDTTL            time.Duration // How long a doc's operation IDs are recorded.  Defaults to DefaultOperationIDTTL
+	RejectDeletionAttachments bool          // Deletion revisions with _attachments fail with a 400, rather than having them stripped
+	MaxChangesRows            int           // Max rows of a one-shot _changes response; 0 for no limit
+	MaxChangesDuration        time.Duration // Max time spent sending a one-shot _changes response; 0 for no limit
+	BodyDeltaMaxBytes         int           // Max size of a revision body sent as a delta; 0 for no limit
+	BodyDeltaMaxRatio         float64       // A delta bigger than this fraction of the full body isn't used.  Defaults to DefaultBodyDeltaMaxRatio
+}
+
+// Retry policy and circuit breaker settings for bucket operations that fail with transient errors.
+type BucketRetryConfig struct {
+	MaxAttempts      *int `json:"max_attempts,omitempty"`      // Max attempts at an op, including the first.  Defaults to 5
+	DeadlineMs       *int `json:"deadline_ms,omitempty"`       // Max total time spent retrying an op.  Defaults to 5000
+	BreakerThreshold *int `json:"breaker_threshold,omitempty"` // Failed ops in a row that make later ones fail fast.  Defaults to 50; 0 to disable
+	BreakerOpenSecs  *int `json:"breaker_open_secs,omitempty"` // How long ops fail fast for.  Defaults to 5
 }
 
 type OidcTestProviderOptions struct {
@@ -101,20 +178,27 @@ type OidcTestProviderOptions struct {
 }
 
 type UserViewsOptions struct {
-	Enabled *bool `json:"enabled,omitempty"` // Whether pass-through view query is supported through public API
+	Enabled *bool `json:"enabled,omitempty"` // Whether users can query views through the public API, filtered by channel; defaults to false
 }
 type UnsupportedOptions struct {
-	UserViews        UserViewsOptions        `json:"user_views,omitempty"`         // Config settings for user views
-	Replicator2      bool                    `json:"replicator_2,omitempty"`       // Enable new replicator (_blipsync)
-	OidcTestProvider OidcTestProviderOptions `json:"oidc_test_provider,omitempty"` // Config settings for OIDC Provider
-	EnableXattr      *bool                   `json:"enable_extended_attributes"`   // Use xattr for _sync
+	UserViews             UserViewsOptions        `json:"user_views,omitempty"`               // Config settings for user views
+	Replicator2           bool                    `json:"replicator_2,omitempty"`             // Enable new replicator (_blipsync)
+	OidcTestProvider      OidcTestProviderOptions `json:"oidc_test_provider,omitempty"`       // Config settings for OIDC Provider
+	EnableXattr           *bool                   `json:"enable_extended_attributes"`         // Use xattr for _sync
+	AllowUnderscoreDocIDs bool                    `json:"allow_underscore_doc_ids,omitempty"` // Allow regular doc IDs starting with "_", other than internal docs' prefixes
 }
 
 // Represents a simulated CouchDB database. A new instance is created for each HTTP request,
 // so this struct does not have to be thread-safe.
 type Database struct {
 	*DatabaseContext
-	user auth.User
+	user        auth.User
+	LogContext  *base.LogContext // Tags log messages with the request being handled; may be nil
+	dryRun      *DryRunResult    // If non-nil, updates are dry runs that report here; see WithDryRun
+	operationID string           // If set, Put and Post are retry-safe; see WithOperationID
+	cancelled   <-chan struct{}  // If set, operations fail once it's closed; see WithCancel
+
+	channelAccess *channelAccessCache // If set, remembers channel access checks; see WithChannelAccessCache
 }
 
 var dbExpvars = expvar.NewMap("syncGateway_db")
@@ -164,6 +248,19 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 	if err := ValidateDatabaseName(dbName); err != nil {
 		return nil, err
 	}
+	if options.ClusterCompatVersion != 0 {
+		if err := ValidateClusterCompatVersion(options.ClusterCompatVersion); err != nil {
+			return nil, err
+		}
+	}
+	if options.ViewQuery != nil {
+		if err := validateViewStale(options.ViewQuery.ChangesStale); err != nil {
+			return nil, err
+		}
+		if err := validateViewStale(options.ViewQuery.AllDocsStale); err != nil {
+			return nil, err
+		}
+	}
 
 	context := &DatabaseContext{
 		Name:       dbName,
@@ -171,9 +268,15 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 		StartTime:  time.Now(),
 		RevsLimit:  DefaultRevsLimit,
 		autoImport: autoImport,
-		Options:    options,
+		Options:    &options,
 	}
+	context.LogKeys = base.NewLogKeySet(options.LogKeys, options.LogLevel)
+	context.logContext = &base.LogContext{Database: dbName, Keys: context.LogKeys}
 	context.revisionCache = NewRevisionCache(int(options.RevisionCacheCapacity), context.revCacheLoader)
+	context.revisionCache.dbName = dbName
+	context.revisionCache.SetMaxBytes(options.RevisionCacheMaxBytes)
+	context.bodyDeltaCache, _ = base.NewLRUCache(DefaultBodyDeltaCacheSize)
+	context.syncRejections = newSyncRejectionLog(DefaultSyncRejectionLogSize)
 
 	context.EventMgr = NewEventManager()
 
@@ -187,6 +290,10 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 		return nil, err
 	}
 
+	if context.designDocs, err = newDesignDocMigration(context); err != nil {
+		return nil, err
+	}
+
 	if options.IndexOptions == nil {
 		// In-memory channel cache
 		context.SequenceType = IntSequenceType
@@ -201,12 +308,17 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 		}
 	}
 
+	if context.querier, err = newIndexQuerier(context); err != nil {
+		return nil, err
+	}
+
 	context.changeCache.Init(context, SequenceID{Seq: lastSeq}, func(changedChannels base.Set) {
 		context.tapListener.Notify(changedChannels)
 	}, options.CacheOptions, options.IndexOptions)
 	context.SetOnChangeCallback(context.changeCache.DocChanged)
 
 	// Initialize the tap Listener for notify handling
+	context.tapListener.logContext = context.logContext
 	context.tapListener.Init(bucket.GetName())
 
 	// TODO: Currently we're forcing the DCP feed to restart from zero if the node is importing xattrs, based on this flag.
@@ -315,6 +427,27 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 
 	}
 
+	context.SetGuestRateLimit(options.GuestRateLimit)
+	context.setBucketRetry(options.BucketRetry)
+
+	if options.JWTBearerOptions != nil {
+		if context.JWTBearer, err = auth.NewJWTBearerAuth(*options.JWTBearerOptions); err != nil {
+			return nil, err
+		}
+	}
+
+	// Build the new versions of the design docs, if they've changed
+	context.designDocs.start()
+
+	// Load the document counts, and keep them up to date
+	context.docCounts = newDocCounter(context)
+
+	// Note the users' replication activity, for _sync_status
+	context.userActivity = newUserActivityTracker(context)
+
+	// Periodically delete session docs that have outlived their TTL
+	context.SetSessionCleanup(options.SessionCleanup)
+
 	// watchDocChanges is used for bucket shadowing and legacy import - not required when running w/ xattrs.
 	if !context.UseXattrs() {
 		go context.watchDocChanges()
@@ -377,8 +510,8 @@ func (context *DatabaseContext) UseGlobalSequence() bool {
 	return context.SequenceType != ClockSequenceType
 }
 
-func (context *DatabaseContext) TapListener() changeListener {
-	return context.tapListener
+func (context *DatabaseContext) TapListener() *changeListener {
+	return &context.tapListener
 }
 
 func (context *DatabaseContext) Close() {
@@ -388,6 +521,10 @@ func (context *DatabaseContext) Close() {
 	context.tapListener.Stop()
 	context.changeCache.Stop()
 	context.Shadower.Stop()
+	context.designDocs.stop()
+	context.docCounts.stop()
+	context.userActivity.stop()
+	context.sessionCleaner.Stop()
 	context.Bucket.Close()
 	context.Bucket = nil
 }
@@ -406,7 +543,7 @@ func (context *DatabaseContext) RestartListener() error {
 	if context.UseXattrs() && context.autoImport {
 		xattrImportNode = true
 	}
-	if err := context.tapListener.Start(context.Bucket, context.Options.TrackDocs, xattrImportNode, nil); err != nil {
+	if err := context.tapListener.Start(context.Bucket, context.GetOptions().TrackDocs, xattrImportNode, nil); err != nil {
 		return err
 	}
 	return nil
@@ -416,6 +553,17 @@ func (context *DatabaseContext) NotifyUser(username string) {
 	context.tapListener.NotifyCheckForTermination(base.SetOf(auth.UserKeyPrefix + username))
 }
 
+// Starts stopping an online database as the server shuts down: new requests fail with a 503 and
+// _changes feeds end, but requests in progress are allowed to finish.  Returns false if the
+// database wasn't online.
+func (dc *DatabaseContext) BeginShutdown() bool {
+	if atomic.CompareAndSwapUint32(&dc.State, DBOnline, DBStopping) {
+		close(dc.ExitChanges) // notify all active _changes feeds to close
+		return true
+	}
+	return false
+}
+
 func (dc *DatabaseContext) TakeDbOffline(reason string) error {
 
 	dbState := atomic.LoadUint32(&dc.State)
@@ -437,8 +585,13 @@ func (dc *DatabaseContext) TakeDbOffline(reason string) error {
 		//set DB state to Offline
 		atomic.StoreUint32(&dc.State, DBOffline)
 
+		//Stop following the bucket's feed; the caches are rebuilt from the current sequence
+		//when the DB is brought back online
+		dc.tapListener.Stop()
+		dc.changeCache.Stop()
+
 		if dc.EventMgr.HasHandlerForEvent(DBStateChange) {
-			dc.EventMgr.RaiseDBStateChangeEvent(dc.Name, "offline", reason, *dc.Options.AdminInterface)
+			dc.EventMgr.RaiseDBStateChangeEvent(dc.Name, "offline", reason, *dc.GetOptions().AdminInterface)
 		}
 
 		return nil
@@ -451,16 +604,29 @@ func (dc *DatabaseContext) TakeDbOffline(reason string) error {
 
 func (context *DatabaseContext) Authenticator() *auth.Authenticator {
 	// Authenticators are lightweight & stateless, so it's OK to return a new one every time
-	return auth.NewAuthenticator(context.Bucket, context)
+	authenticator := auth.NewAuthenticator(context.Bucket, context)
+	options := context.GetOptions()
+	authenticator.SetBcryptCost(options.BcryptCost)
+	authenticator.SetGuestChannelLimit(options.GuestMaxChannels)
+	return authenticator
 }
 
 // Makes a Database object given its name and bucket.
 func GetDatabase(context *DatabaseContext, user auth.User) (*Database, error) {
-	return &Database{context, user}, nil
+	return &Database{DatabaseContext: context, user: user, LogContext: context.logContext}, nil
 }
 
 func CreateDatabase(context *DatabaseContext) (*Database, error) {
-	return &Database{context, nil}, nil
+	return &Database{DatabaseContext: context, LogContext: context.logContext}, nil
+}
+
+// Returns the LogContext of the database's messages that aren't made for a request, which tags
+// them with its name and applies its log keys.
+func (context *DatabaseContext) dbLogContext() *base.LogContext {
+	if context == nil {
+		return nil
+	}
+	return context.logContext
 }
 
 func (db *Database) SameAs(otherdb *Database) bool {
@@ -550,6 +716,29 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
                      if (meta.id.substring(0,10) == "_sync:rev:")
 	                     emit("",null); }`
 
+	// View for the document counts
+	// Key is "live" or "tombstone", plus "conflict" for conflicted docs; value is null
+	docStates_map := `function (doc, meta) {
+                     %s
+                     if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+                       return;
+                     if ((sync.flags & 1) || sync.deleted)
+                       emit("tombstone", null);
+                     else
+                       emit("live", null);
+                     if (sync.flags & 8)
+                       emit("conflict", null); }`
+	docStates_map = fmt.Sprintf(docStates_map, syncData)
+
+	// View for the sync function epochs of docs
+	// Key is [epoch, docid]; value is null
+	syncFnEpochs_map := `function (doc, meta) {
+                     %s
+                     if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+                       return;
+                     emit([sync.sync_fn || "", meta.id], null); }`
+	syncFnEpochs_map = fmt.Sprintf(syncFnEpochs_map, syncData)
+
 	// Sessions view - used for session delete
 	// Key is username; value is docid
 	sessions_map := `function (doc, meta) {
@@ -558,6 +747,25 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
                      		emit(doc.username, meta.id);}`
 	sessions_map = fmt.Sprintf(sessions_map, len(auth.SessionKeyPrefix), auth.SessionKeyPrefix)
 
+	// Session expiry view - used by the session cleanup task
+	// Key is expiration time (RFC 3339, UTC, in milliseconds); value is docid.  Older sessions'
+	// expirations are in the server's time zone, so they're converted to sort chronologically.
+	sessionExpiry_map := `function (doc, meta) {
+                     	var prefix = meta.id.substring(0,%d);
+                     	if (prefix == %q && doc.expiration) {
+                     		var expiration = new Date(doc.expiration);
+                     		emit(isNaN(expiration) ? doc.expiration : expiration.toISOString(), meta.id);}}`
+	sessionExpiry_map = fmt.Sprintf(sessionExpiry_map, len(auth.SessionKeyPrefix), auth.SessionKeyPrefix)
+
+	// Local docs view - used for listing and purging _local docs
+	// Key is docid (without the "_local/" prefix); value is {size, updated_at}
+	localDocs_map := `function (doc, meta) {
+                     	var prefix = meta.id.substring(0,%d);
+                     	if (prefix == %q)
+                     		emit(meta.id.substring(%d), {size: JSON.stringify(doc).length, updated_at: doc.%s});}`
+	localDocs_map = fmt.Sprintf(localDocs_map, len(kLocalDocKeyPrefix), kLocalDocKeyPrefix,
+		len(kLocalDocKeyPrefix), kSpecialDocUpdatedAtProperty)
+
 	// Tombstones view - used for view tombstone compaction
 	// Key is purge time; value is docid
 	tombstones_map := `function (doc, meta) {
@@ -575,6 +783,40 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
 	principals_map = fmt.Sprintf(principals_map, auth.UserKeyPrefix, auth.RoleKeyPrefix,
 		len(auth.UserKeyPrefix))
 
+	// Principal details view - used for listing users/roles
+	// Key is ["user" or "role", name]; value is {admin_channels, admin_roles, disabled}
+	principalSummary := `var prefix = meta.id.substring(0,11);
+						 var type;
+						 if (prefix == %q)
+						     type = "user";
+						 else if (prefix == %q)
+						     type = "role";
+						 else
+						     return;
+						 var name = meta.id.substring(%d);
+						 var value = {admin_channels: Object.keys(doc.admin_channels || {})};
+						 if (type == "user") {
+						     value.admin_roles = Object.keys(doc.explicit_roles || {});
+						     value.disabled = (doc.disabled === true);
+						 }`
+	principalSummary = fmt.Sprintf(principalSummary, auth.UserKeyPrefix, auth.RoleKeyPrefix,
+		len(auth.UserKeyPrefix))
+	principalDetails_map := `function (doc, meta) {
+							 %s
+							 emit([type, name], value); }`
+	principalDetails_map = fmt.Sprintf(principalDetails_map, principalSummary)
+
+	// Principal grants view - used for listing the users/roles with access to a channel
+	// Key is ["user" or "role", channel]; value is the same as the principal details view.  The
+	// name is left out of the key (it's in the doc ID) so that one query with "keys" can get the
+	// principals of every grant that covers a channel.
+	// If the computed channels have been invalidated, only the admin channels are known.
+	principalGrants_map := `function (doc, meta) {
+							 %s
+							 for (var channel in (doc.all_channels || doc.admin_channels || {}))
+							     emit([type, channel], value); }`
+	principalGrants_map = fmt.Sprintf(principalGrants_map, principalSummary)
+
 	// By-channels view.
 	// Key is [channelname, sequence]; value is [docid, revid, flag?]
 	// where flag is true for doc deletion, false for removed from channel, missing otherwise
@@ -591,9 +833,9 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
 	                    } else if (sync.deleted) {
 	                    	value.flags = %d // channels.Deleted
 	                    }
-	                    if (%v) // EnableStarChannelLog
-							emit(["*", sequence], value);
 						var channels = sync.channels;
+	                    if (%v && !(channels && channels[%q] === null)) // EnableStarChannelLog, unless in channels.NoChannels
+							emit(["*", sequence], value);
 						if (channels) {
 							for (var name in channels) {
 								removed = channels[name];
@@ -607,9 +849,25 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
 						}
 					}`
 
-	channels_map = fmt.Sprintf(channels_map, syncData, channels.Deleted, EnableStarChannelLog,
+	channels_map = fmt.Sprintf(channels_map, syncData, channels.Deleted, EnableStarChannelLog, channels.NoChannels,
 		channels.Removed|channels.Deleted, channels.Removed)
 
+	// Channel stats view, used by GetChannelStats().  Only includes docs currently in each channel.
+	// Key is [channelName, sequence]; value is null
+	channelStats_map := `function (doc, meta) {
+	                    %s
+	                    if (sync === undefined || meta.id.substring(0,6) == "_sync:" || sync.deleted)
+	                        return;
+	                    var channels = sync.channels;
+	                    if (channels) {
+	                        for (var name in channels) {
+	                            if (!channels[name])
+	                                emit([name, sync.sequence], null);
+	                        }
+	                    }
+	               }`
+	channelStats_map = fmt.Sprintf(channelStats_map, syncData)
+
 	// Channel access view, used by ComputeChannelsForPrincipal()
 	// Key is username; value is dictionary channelName->firstSequence (compatible with TimedSet)
 	access_map := `function (doc, meta) {
@@ -641,6 +899,8 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
 		                        		var timedSetWithVbucket = {};
 				                        timedSetWithVbucket["vb"] = parseInt(meta.vb, 10);
 				                        timedSetWithVbucket["seq"] = parseInt(meta.seq, 10);
+				                        if (access[name][channel].until)
+				                        	timedSetWithVbucket["until"] = access[name][channel].until;
 				                        value[channel] = timedSetWithVbucket;
 			                        }
 		                            emit(name, value)
@@ -681,6 +941,8 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
 		                        		var timedSetWithVbucket = {};
 				                        timedSetWithVbucket["vb"] = parseInt(meta.vb, 10);
 				                        timedSetWithVbucket["seq"] = parseInt(meta.seq, 10);
+				                        if (access[name][role].until)
+				                        	timedSetWithVbucket["until"] = access[name][role].until;
 				                        value[role] = timedSetWithVbucket;
 			                        }
 		                            emit(name, value)
@@ -694,7 +956,8 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
 
 	designDocMap[DesignDocSyncGatewayChannels] = sgbucket.DesignDoc{
 		Views: sgbucket.ViewMap{
-			ViewChannels: sgbucket.ViewDef{Map: channels_map},
+			ViewChannels:     sgbucket.ViewDef{Map: channels_map},
+			ViewChannelStats: sgbucket.ViewDef{Map: channelStats_map, Reduce: "_count"},
 		},
 		Options: &sgbucket.DesignDocOptions{
 			IndexXattrOnTombstones: true,
@@ -727,13 +990,19 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
 
 	designDocMap[DesignDocSyncHousekeeping] = sgbucket.DesignDoc{
 		Views: sgbucket.ViewMap{
-			ViewAllBits:    sgbucket.ViewDef{Map: allbits_map},
-			ViewAllDocs:    sgbucket.ViewDef{Map: alldocs_map, Reduce: "_count"},
-			ViewImport:     sgbucket.ViewDef{Map: import_map, Reduce: "_count"},
-			ViewOldRevs:    sgbucket.ViewDef{Map: oldrevs_map, Reduce: "_count"},
-			ViewSessions:   sgbucket.ViewDef{Map: sessions_map},
-			ViewTombstones: sgbucket.ViewDef{Map: tombstones_map},
-			ViewPrincipals: sgbucket.ViewDef{Map: principals_map},
+			ViewAllBits:          sgbucket.ViewDef{Map: allbits_map},
+			ViewAllDocs:          sgbucket.ViewDef{Map: alldocs_map, Reduce: "_count"},
+			ViewImport:           sgbucket.ViewDef{Map: import_map, Reduce: "_count"},
+			ViewOldRevs:          sgbucket.ViewDef{Map: oldrevs_map, Reduce: "_count"},
+			ViewSessions:         sgbucket.ViewDef{Map: sessions_map},
+			ViewSessionExpiry:    sgbucket.ViewDef{Map: sessionExpiry_map},
+			ViewLocalDocs:        sgbucket.ViewDef{Map: localDocs_map},
+			ViewTombstones:       sgbucket.ViewDef{Map: tombstones_map},
+			ViewDocStates:        sgbucket.ViewDef{Map: docStates_map, Reduce: "_count"},
+			ViewSyncFnEpochs:     sgbucket.ViewDef{Map: syncFnEpochs_map, Reduce: "_count"},
+			ViewPrincipals:       sgbucket.ViewDef{Map: principals_map},
+			ViewPrincipalDetails: sgbucket.ViewDef{Map: principalDetails_map},
+			ViewPrincipalGrants:  sgbucket.ViewDef{Map: principalGrants_map},
 		},
 		Options: &sgbucket.DesignDocOptions{
 			IndexXattrOnTombstones: true, // For ViewTombstones
@@ -748,8 +1017,11 @@ func installViews(bucket base.Bucket, useXattrs bool) error {
 	// Remove legacy sync gateway design doc, if present
 	bucket.DeleteDDoc(DesignDocSyncGateway)
 
-	// add all design docs from map into bucket
-	for designDocName, designDoc := range designDocMap {
+	// add all design docs from map into bucket, under this version's names.  The database switches
+	// to them once they're built (see designDocMigration.)
+	version := currentDesignDocVersion(useXattrs)
+	for name, designDoc := range designDocMap {
+		designDocName := version.designDocName(name)
 
 		//start a retry loop to put design document backing off double the delay each time
 		worker := func() (shouldRetry bool, err error, value interface{}) {
@@ -788,36 +1060,21 @@ type ForEachDocIDFunc func(id IDAndRev, channels []string) bool
 
 // Iterates over all documents in the database, calling the callback function on each
 func (db *Database) ForEachDocID(callback ForEachDocIDFunc, resultsOpts ForEachDocIDOptions) error {
-	type viewRow struct {
-		Key   string
-		Value struct {
-			RevID    string   `json:"r"`
-			Sequence uint64   `json:"s"`
-			Channels []string `json:"c"`
-		}
-	}
-	var vres struct {
-		Rows []viewRow
-	}
-	opts := Body{"stale": false, "reduce": false}
-
-	if resultsOpts.Startkey != "" {
-		opts["startkey"] = resultsOpts.Startkey
-	}
-
-	if resultsOpts.Endkey != "" {
-		opts["endkey"] = resultsOpts.Endkey
+	if err := db.checkCancelled(); err != nil {
+		return err
 	}
-
-	err := db.Bucket.ViewCustom(DesignDocSyncHousekeeping, ViewAllDocs, opts, &vres)
+	rows, err := db.querier.queryAllDocs(resultsOpts.Startkey, resultsOpts.Endkey)
 	if err != nil {
-		base.Warn("all_docs got error: %v", err)
+		db.LogContext.Warn("all_docs got error: %v", err)
 		return err
 	}
 
 	count := uint64(0)
-	for _, row := range vres.Rows {
-		if callback(IDAndRev{row.Key, row.Value.RevID, row.Value.Sequence}, row.Value.Channels) {
+	for _, row := range rows {
+		if err := db.checkCancelled(); err != nil {
+			return err
+		}
+		if callback(row.IDAndRev, row.Channels) {
 			count++
 		}
 		//We have to apply limit check after callback has been called
@@ -832,30 +1089,24 @@ func (db *Database) ForEachDocID(callback ForEachDocIDFunc, resultsOpts ForEachD
 
 // Returns the IDs of all users and roles
 func (db *DatabaseContext) AllPrincipalIDs() (users, roles []string, err error) {
-	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewPrincipals, Body{"stale": false})
+	allUsers, roles, err := db.querier.queryPrincipals()
 	if err != nil {
-		return
+		return nil, nil, err
 	}
-	users = []string{}
-	roles = []string{}
-	for _, row := range vres.Rows {
-		name := row.Key.(string)
+	users = make([]string, 0, len(allUsers))
+	for _, name := range allUsers {
 		if name != "" {
-			if row.Value.(bool) {
-				users = append(users, name)
-			} else {
-				roles = append(roles, name)
-			}
+			users = append(users, name)
 		}
 	}
-	return
+	return users, roles, nil
 }
 
 func (db *Database) queryAllDocs(reduce bool) (sgbucket.ViewResult, error) {
 	opts := Body{"stale": false, "reduce": reduce}
-	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewAllDocs, opts)
+	vres, err := db.Bucket.View(db.DesignDocName(DesignDocSyncHousekeeping, ViewAllDocs), ViewAllDocs, opts)
 	if err != nil {
-		base.Warn("all_docs got error: %v", err)
+		db.LogContext.Warn("all_docs got error: %v", err)
 	}
 	return vres, err
 }
@@ -870,42 +1121,72 @@ func (db *Database) DeleteAllDocs(docType string) error {
 		opts["endkey"] = "_sync:" + docType + "~"
 		opts["inclusive_end"] = false
 	}
-	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewAllBits, opts)
+	vres, err := db.Bucket.View(db.DesignDocName(DesignDocSyncHousekeeping, ViewAllBits), ViewAllBits, opts)
 	if err != nil {
-		base.Warn("all_bits view returned %v", err)
+		db.LogContext.Warn("all_bits view returned %v", err)
 		return err
 	}
 
 	//FIX: Is there a way to do this in one operation?
 	base.Logf("Deleting %d %q documents of %q ...", len(vres.Rows), docType, db.Name)
 	for _, row := range vres.Rows {
-		base.LogTo("CRUD", "\tDeleting %q", row.ID)
+		db.LogContext.LogTo("CRUD", "\tDeleting %q", row.ID)
 		if err := db.Bucket.Delete(row.ID); err != nil {
-			base.Warn("Error deleting %q: %v", row.ID, err)
+			db.LogContext.Warn("Error deleting %q: %v", row.ID, err)
 		}
 	}
 	return nil
 }
 
-// Deletes all session documents for a user
-func (db *DatabaseContext) DeleteUserSessions(userName string) error {
-	opts := Body{"stale": false}
-	opts["startkey"] = userName
-	opts["endkey"] = userName
-	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewSessions, opts)
+// Revokes all of a user's login sessions.  Requests that still carry one of the sessions' cookies
+// are rejected rather than treated as the guest user.
+func (db *DatabaseContext) RevokeUserSessions(userName string) error {
+	authr := db.Authenticator()
+	user, err := authr.GetUser(userName)
 	if err != nil {
-		base.Warn("sessions view returned %v", err)
 		return err
+	} else if user == nil {
+		return base.HTTPErrorf(http.StatusNotFound, "No such user %q", userName)
+	}
+	user.RevokeSessions()
+	return authr.Save(user)
+}
+
+// (Re)starts the session cleanup task with new options.
+func (context *DatabaseContext) SetSessionCleanup(options auth.SessionCleanupOptions) {
+	context.UpdateOptions(func(dbOptions *DatabaseContextOptions) {
+		dbOptions.SessionCleanup = options
+	})
+	if context.sessionCleaner != nil {
+		context.sessionCleaner.Stop()
 	}
+	context.sessionCleaner = auth.NewSessionCleaner(context.Authenticator(), context.queryExpiredSessions, options)
+	context.sessionCleaner.Start()
+}
+
+// Runs the session cleanup task now, instead of waiting for its next run.  Returns the number of
+// sessions deleted; 0 if another node holds the cleanup lease.
+func (context *DatabaseContext) CleanupSessions() (int, error) {
+	return context.sessionCleaner.Run()
+}
+
+// Format of the session_expiry view's keys, which is that of JavaScript's Date.toISOString
+const kSessionExpiryKeyFormat = "2006-01-02T15:04:05.000Z"
 
+// Returns the doc IDs of up to limit sessions that expired before a time, earliest first.
+func (context *DatabaseContext) queryExpiredSessions(before time.Time, limit int) ([]string, error) {
+	opts := Body{"stale": false, "endkey": before.UTC().Format(kSessionExpiryKeyFormat), "limit": limit}
+	vres, err := context.Bucket.View(context.DesignDocName(DesignDocSyncHousekeeping, ViewSessionExpiry), ViewSessionExpiry, opts)
+	if err != nil {
+		return nil, err
+	}
+	docIDs := make([]string, 0, len(vres.Rows))
 	for _, row := range vres.Rows {
-		docId := row.Value.(string)
-		base.LogTo("CRUD", "\tDeleting %q", docId)
-		if err := db.Bucket.Delete(docId); err != nil {
-			base.Warn("Error deleting %q: %v", row.ID, err)
+		if docID, ok := row.Value.(string); ok {
+			docIDs = append(docIDs, docID)
 		}
 	}
-	return nil
+	return docIDs, nil
 }
 
 // Trigger tombstone compaction from views.  Several Sync Gateway views index server tombstones (deleted documents with an xattr).
@@ -927,9 +1208,9 @@ func (db *Database) Compact() (int, error) {
 	opts["startkey"] = 1
 	purgeIntervalDuration := time.Duration(-db.PurgeInterval) * time.Hour
 	opts["endkey"] = time.Now().Add(purgeIntervalDuration).Unix()
-	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewTombstones, opts)
+	vres, err := db.Bucket.View(db.DesignDocName(DesignDocSyncHousekeeping, ViewTombstones), ViewTombstones, opts)
 	if err != nil {
-		base.Warn("Tombstones view returned error during compact: %v", err)
+		db.LogContext.Warn("Tombstones view returned error during compact: %v", err)
 		return 0, err
 	}
 
@@ -937,7 +1218,7 @@ func (db *Database) Compact() (int, error) {
 	purgeBody := Body{"_purged": true}
 	count := 0
 	for _, row := range vres.Rows {
-		base.LogTo("CRUD", "\tDeleting %q", row.ID)
+		db.LogContext.LogTo("CRUD", "\tDeleting %q", row.ID)
 		// First, attempt to purge.
 		purgeErr := db.Purge(row.ID)
 		if purgeErr == nil {
@@ -946,15 +1227,15 @@ func (db *Database) Compact() (int, error) {
 			// If key no longer exists, need to add and remove to trigger removal from view
 			_, addErr := db.Bucket.Add(row.ID, 0, purgeBody)
 			if addErr != nil {
-				base.Warn("Error compacting key %s (add) - tombstone will not be compacted.  %v", row.ID, addErr)
+				db.LogContext.Warn("Error compacting key %s (add) - tombstone will not be compacted.  %v", row.ID, addErr)
 				continue
 			}
 			if delErr := db.Bucket.Delete(row.ID); delErr != nil {
-				base.Warn("Error compacting key %s (delete) - tombstone will not be compacted.  %v", row.ID, delErr)
+				db.LogContext.Warn("Error compacting key %s (delete) - tombstone will not be compacted.  %v", row.ID, delErr)
 			}
 			count++
 		} else {
-			base.Warn("Error compacting key %s (purge) - tombstone will not be compacted.  %v", row.ID, purgeErr)
+			db.LogContext.Warn("Error compacting key %s (purge) - tombstone will not be compacted.  %v", row.ID, purgeErr)
 		}
 	}
 	return count, nil
@@ -967,21 +1248,206 @@ func VacuumAttachments(bucket base.Bucket) (int, error) {
 
 //////// SYNC FUNCTION:
 
+func (context *DatabaseContext) maxChannelsPerDoc() int {
+	if value := context.GetOptions().MaxChannelsPerDoc; value != nil {
+		return int(*value)
+	}
+	return DefaultMaxChannelsPerDoc
+}
+
+// Returns the max TTL of a session created through the public API.
+func (context *DatabaseContext) MaxSessionTTL() time.Duration {
+	if value := context.GetOptions().MaxSessionTTL; value > 0 {
+		return value
+	}
+	return DefaultMaxSessionTTL
+}
+
+// Returns the max number of docs in a _bulk_docs request.
+func (context *DatabaseContext) MaxBulkDocs() int {
+	if value := context.GetOptions().MaxBulkDocs; value > 0 {
+		return int(value)
+	}
+	return DefaultMaxBulkDocs
+}
+
+// Returns the max size in bytes of a _bulk_docs request body.
+func (context *DatabaseContext) MaxBulkDocsBytes() int64 {
+	if value := context.GetOptions().MaxBulkDocsBytes; value > 0 {
+		return value
+	}
+	return DefaultMaxBulkDocsBytes
+}
+
+// Sets or removes the limit on the rate of guest requests per client IP.
+func (context *DatabaseContext) SetGuestRateLimit(limit *GuestRateLimitConfig) {
+	context.UpdateOptions(func(options *DatabaseContextOptions) {
+		options.GuestRateLimit = limit
+	})
+	if limit == nil {
+		context.GuestRateLimiter = nil
+		return
+	}
+	burst := limit.Burst
+	if burst == 0 {
+		burst = int(limit.RequestsPerSec)
+	}
+	context.GuestRateLimiter = base.NewRateLimiter(limit.RequestsPerSec, burst)
+}
+
+func (context *DatabaseContext) setBucketRetry(config *BucketRetryConfig) {
+	context.bucketRetryPolicy = base.DefaultBucketRetryPolicy
+	_, context.bucketRetryPolicy.RetriedByBucket = context.Bucket.(*base.CouchbaseBucketGoCB)
+	threshold, openTime := DefaultBreakerThreshold, DefaultBreakerOpenTime
+	if config != nil {
+		if config.MaxAttempts != nil {
+			context.bucketRetryPolicy.MaxAttempts = *config.MaxAttempts
+		}
+		if config.DeadlineMs != nil {
+			context.bucketRetryPolicy.Deadline = time.Duration(*config.DeadlineMs) * time.Millisecond
+		}
+		if config.BreakerThreshold != nil {
+			threshold = *config.BreakerThreshold
+		}
+		if config.BreakerOpenSecs != nil {
+			openTime = time.Duration(*config.BreakerOpenSecs) * time.Second
+		}
+	}
+	context.bucketBreaker = base.NewCircuitBreaker(threshold, openTime)
+}
+
+// Runs a bucket operation, retrying it if it fails with a transient error, and failing fast if
+// the server's been unavailable.  Ops that aren't idempotent aren't retried after timeouts.
+func (context *DatabaseContext) retryBucketOp(description string, idempotent bool, op func() error) error {
+	return base.RetryBucketOp(description, idempotent, context.bucketRetryPolicy, context.bucketBreaker, op)
+}
+
+// Changes the size and age limits of the channel caches, including the ones already in use.
+func (context *DatabaseContext) UpdateChannelCacheOptions(options ChannelCacheOptions) {
+	if cache, ok := context.changeCache.(*changeCache); ok {
+		cache.updateChannelCacheOptions(options)
+	} else {
+		base.Warn("Channel cache options of database %q can't be changed while it's running", context.Name)
+	}
+}
+
+// Returns the max number of keys in an _all_docs request.
+func (context *DatabaseContext) MaxAllDocsKeys() int {
+	if value := context.GetOptions().MaxAllDocsKeys; value > 0 {
+		return int(value)
+	}
+	return DefaultMaxAllDocsKeys
+}
+
+// Returns the max number of changes buffered for the client of a continuous changes feed.
+func (context *DatabaseContext) ChangesBuffer() int {
+	if value := context.GetOptions().ChangesBuffer; value > 0 {
+		return int(value)
+	}
+	return DefaultChangesBuffer
+}
+
+// Returns the max number of users or roles in a _user/_bulk or _role/_bulk request.
+func (context *DatabaseContext) MaxBulkPrincipals() int {
+	if value := context.GetOptions().MaxBulkPrincipals; value > 0 {
+		return int(value)
+	}
+	return DefaultMaxBulkPrincipals
+}
+
+// Returns the max size in bytes of a _local doc.
+func (context *DatabaseContext) MaxLocalDocBytes() int64 {
+	if value := context.GetOptions().MaxLocalDocBytes; value > 0 {
+		return value
+	}
+	return DefaultMaxLocalDocBytes
+}
+
+func (context *DatabaseContext) syncFnTimeout() time.Duration {
+	if value := context.GetOptions().SyncFnTimeout; value > 0 {
+		return value
+	}
+	return channels.DefaultSyncFnTimeout
+}
+
+func (context *DatabaseContext) validateFnTimeout() time.Duration {
+	if value := context.GetOptions().ValidateFnTimeout; value > 0 {
+		return value
+	}
+	return channels.DefaultSyncFnTimeout
+}
+
+// Sets the database context's validate function, which checks document updates before the sync
+// function runs.  It doesn't affect channels or access, so unlike the sync function it isn't
+// saved to the bucket, and changing it never calls for a resync.
+func (context *DatabaseContext) UpdateValidateFun(validateFun string) {
+	// A new DocValidator replaces the old one, so that calls in progress finish with the old function:
+	var validator *channels.DocValidator
+	if validateFun != "" {
+		validator = channels.NewDocValidator(validateFun, context.validateFnTimeout())
+	}
+	context.configLock.Lock()
+	oldValidator := context.Validator
+	context.Validator = validator
+	context.configLock.Unlock()
+	// Discard the old function's idle VMs, unless the new one can reuse them:
+	if oldValidator != nil && oldValidator.Function() != validateFun {
+		oldValidator.Close()
+	}
+}
+
+// Returns the database's current validate function, or nil if it has none.  An operation should
+// get it once, since a config reload may replace it.
+func (context *DatabaseContext) GetValidator() *channels.DocValidator {
+	context.configLock.RLock()
+	defer context.configLock.RUnlock()
+	return context.Validator
+}
+
+// Returns the database's current sync function, or nil for the default one.  An operation should
+// get it once, since a config reload may replace it.
+func (context *DatabaseContext) GetChannelMapper() *channels.ChannelMapper {
+	context.configLock.RLock()
+	defer context.configLock.RUnlock()
+	return context.ChannelMapper
+}
+
+// Returns the database's current options, which must not be modified.  An operation should get
+// them once, since a config reload may replace them.
+func (context *DatabaseContext) GetOptions() *DatabaseContextOptions {
+	context.configLock.RLock()
+	defer context.configLock.RUnlock()
+	return context.Options
+}
+
+// Replaces the database's options with a copy changed by the update function.  Operations in
+// progress carry on with the options they already got.
+func (context *DatabaseContext) UpdateOptions(update func(options *DatabaseContextOptions)) {
+	context.configLock.Lock()
+	defer context.configLock.Unlock()
+	options := *context.Options
+	update(&options)
+	context.Options = &options
+}
+
 // Sets the database context's sync function based on the JS code from config.
 // Returns a boolean indicating whether the function is different from the saved one.
 // If multiple gateway instances try to update the function at the same time (to the same new
 // value) only one of them will get a changed=true result.
 func (context *DatabaseContext) UpdateSyncFun(syncFun string) (changed bool, err error) {
-	if syncFun == "" {
-		context.ChannelMapper = nil
-	} else if context.ChannelMapper != nil {
-		_, err = context.ChannelMapper.SetFunction(syncFun)
-	} else {
-		context.ChannelMapper = channels.NewChannelMapper(syncFun)
+	// A new ChannelMapper replaces the old one, so that calls in progress finish with the old function:
+	var mapper *channels.ChannelMapper
+	if syncFun != "" {
+		mapper = channels.NewChannelMapperWithTimeout(syncFun, context.syncFnTimeout())
 	}
-	if err != nil {
-		base.Warn("Error setting sync function: %s", err)
-		return
+	context.configLock.Lock()
+	oldMapper := context.ChannelMapper
+	context.ChannelMapper = mapper
+	context.syncFnEpoch = syncFnEpoch(syncFun)
+	context.configLock.Unlock()
+	// Discard the old function's idle VMs, unless the new one can reuse them:
+	if oldMapper != nil && oldMapper.Function() != syncFun {
+		oldMapper.Close()
 	}
 
 	var syncData struct { // format of the sync-fn document
@@ -1029,7 +1495,7 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 	} else if !doImportDocs {
 		options["startkey"] = []interface{}{true}
 	}
-	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewImport, options)
+	vres, err := db.Bucket.View(db.DesignDocName(DesignDocSyncHousekeeping, ViewImport), ViewImport, options)
 	if err != nil {
 		return 0, err
 	}
@@ -1045,122 +1511,166 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 	for _, row := range vres.Rows {
 		rowKey := row.Key.([]interface{})
 		docid := rowKey[1].(string)
-		key := realDocID(docid)
-
-		documentUpdateFunc := func(doc *document) (updatedDoc *document, shouldUpdate bool, err error) {
-			imported := false
-			if !doc.HasValidSyncData(db.writeSequences()) {
-				// This is a document not known to the sync gateway. Ignore or import it:
-				if !doImportDocs {
-					return nil, false, couchbase.UpdateCancel
-				}
-				imported = true
-				if err = db.initializeSyncData(doc); err != nil {
-					return nil, false, err
-				}
-				base.LogTo("CRUD", "\tImporting document %q --> rev %q", docid, doc.CurrentRev)
-			} else {
-				if !doCurrentDocs {
-					return nil, false, couchbase.UpdateCancel
-				}
-				base.LogTo("CRUD", "\tRe-syncing document %q", docid)
-			}
-
-			// Run the sync fn over each current/leaf revision, in case there are conflicts:
-			changed := 0
-			doc.History.forEachLeaf(func(rev *RevInfo) {
-				body, _ := db.getRevFromDoc(doc, rev.ID, false)
-				channels, access, roles, _, err := db.getChannelsAndAccess(doc, body, rev.ID)
-				if err != nil {
-					// Probably the validator rejected the doc
-					base.Warn("Error calling sync() on doc %q: %v", docid, err)
-					access = nil
-					channels = nil
-				}
-				rev.Channels = channels
-
-				if rev.ID == doc.CurrentRev {
-					changed = len(doc.Access.updateAccess(doc, access)) +
-						len(doc.RoleAccess.updateAccess(doc, roles)) +
-						len(doc.updateChannels(channels))
-				}
-			})
-			shouldUpdate = changed > 0 || imported
-			return doc, shouldUpdate, nil
-		}
-		var err error
-		if db.UseXattrs() {
-			_, err = db.Bucket.WriteUpdateWithXattr(key, KSyncXattrName, 0, func(currentValue []byte, currentXattr []byte, cas uint64) (raw []byte, rawXattr []byte, deleteDoc bool, err error) {
-				// There's no scenario where a doc should from non-deleted to deleted during UpdateAllDocChannels processing, so deleteDoc is always returned as false.
-				if currentValue == nil || len(currentValue) == 0 {
-					return nil, nil, deleteDoc, errors.New("Cancel update")
-				}
-				doc, err := unmarshalDocumentWithXattr(docid, currentValue, currentXattr, cas)
-				if err != nil {
-					return nil, nil, deleteDoc, err
-				}
-
-				updatedDoc, shouldUpdate, err := documentUpdateFunc(doc)
-				if err != nil {
-					return nil, nil, deleteDoc, err
-				}
-				if shouldUpdate {
-					base.LogTo("Access", "Saving updated channels and access grants of %q", docid)
-					raw, rawXattr, err = updatedDoc.MarshalWithXattr()
-					return raw, rawXattr, deleteDoc, err
-				} else {
-					return nil, nil, deleteDoc, errors.New("Cancel update")
-				}
-			})
-		} else {
-			err = db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, error) {
-				// Be careful: this block can be invoked multiple times if there are races!
-				if currentValue == nil {
-					return nil, couchbase.UpdateCancel // someone deleted it?!
-				}
-				doc, err := unmarshalDocument(docid, currentValue)
-				if err != nil {
-					return nil, err
-				}
-				updatedDoc, shouldUpdate, err := documentUpdateFunc(doc)
-				if err != nil {
-					return nil, err
-				}
-				if shouldUpdate {
-					base.LogTo("Access", "Saving updated channels and access grants of %q", docid)
-					return json.Marshal(updatedDoc)
-				} else {
-					return nil, couchbase.UpdateCancel
-				}
-			})
-		}
+		err := db.resyncDocument(docid, doCurrentDocs, doImportDocs)
 		if err == nil {
 			changeCount++
 		} else if err != couchbase.UpdateCancel {
-			base.Warn("Error updating doc %q: %v", docid, err)
+			db.LogContext.Warn("Error updating doc %q: %v", docid, err)
 		}
 	}
 	base.Logf("Finished re-running sync function; %d docs changed", changeCount)
 
 	if changeCount > 0 {
-		// Now invalidate channel cache of all users/roles:
-		base.Log("Invalidating channel caches of users/roles...")
-		users, roles, _ := db.AllPrincipalIDs()
-		for _, name := range users {
-			db.invalUserChannels(name)
+		db.invalAllPrincipalChannels()
+	}
+	return changeCount, nil
+}
+
+// Invalidates the channel caches of all users and roles, after documents' access grants were recomputed.
+func (db *Database) invalAllPrincipalChannels() {
+	base.Log("Invalidating channel caches of users/roles...")
+	users, roles, _ := db.AllPrincipalIDs()
+	for _, name := range users {
+		db.invalUserChannels(name)
+	}
+	for _, name := range roles {
+		db.invalRoleChannels(name)
+	}
+}
+
+// Re-runs the sync function on a single document, importing it first if it has no sync metadata
+// and doImportDocs is set.  Returns couchbase.UpdateCancel (or an error) if the doc wasn't changed.
+func (db *Database) resyncDocument(docid string, doCurrentDocs bool, doImportDocs bool) error {
+	documentUpdateFunc := func(doc *document) (updatedDoc *document, shouldUpdate bool, err error) {
+		imported := false
+		if !doc.HasValidSyncData(db.writeSequences()) {
+			// This is a document not known to the sync gateway. Ignore or import it:
+			if !doImportDocs || !db.shouldImport(docid, doc.body) {
+				return nil, false, couchbase.UpdateCancel
+			}
+			imported = true
+			if err = db.initializeSyncData(doc); err != nil {
+				return nil, false, err
+			}
+			db.LogContext.LogTo("CRUD", "\tImporting document %q --> rev %q", docid, doc.CurrentRev)
+		} else {
+			if !doCurrentDocs {
+				return nil, false, couchbase.UpdateCancel
+			}
+			db.LogContext.LogTo("CRUD", "\tRe-syncing document %q", docid)
 		}
-		for _, name := range roles {
-			db.invalRoleChannels(name)
+
+		changed := db.recomputeChannelsAndAccess(doc)
+		// A doc on an older sync function epoch is rewritten to record the current one, but one
+		// from before epochs were recorded isn't rewritten unless something changed.  Rewriting the
+		// doc also moves its body back inline, if the database is set to do that:
+		staleEpoch := db.recordsSyncFnEpochs() && doc.SyncFnEpoch != "" && doc.SyncFnEpoch != db.SyncFnEpoch()
+		doc.SyncFnEpoch = db.SyncFnEpoch()
+		shouldUpdate = changed > 0 || imported || staleEpoch || (!db.outOfLineBodiesAllowed() && doc.BodyKey != "")
+		return doc, shouldUpdate, nil
+	}
+	return db.updateDocMetadata(docid, documentUpdateFunc)
+}
+
+// Runs the sync fn over each current/leaf revision of a doc, in case there are conflicts, and
+// updates the doc's channels and access grants to match the current revision's.  Returns the
+// number of channels and grants that changed.
+func (db *Database) recomputeChannelsAndAccess(doc *document) (changed int) {
+	doc.History.forEachLeaf(func(rev *RevInfo) {
+		body, _ := db.getRevFromDoc(doc, rev.ID, false)
+		channels, access, roles, grantExpiry, _, _, err := db.getChannelsAndAccess(doc, body, rev.ID)
+		if err != nil {
+			// Probably the validator rejected the doc
+			db.LogContext.Warn("Error calling sync() on doc %q: %v", doc.ID, err)
+			access = nil
+			channels = nil
 		}
+		rev.Channels = channels
+
+		if rev.ID == doc.CurrentRev {
+			changed = len(doc.Access.updateAccess(doc, access, grantExpiry.Access)) +
+				len(doc.RoleAccess.updateAccess(doc, roles, grantExpiry.Roles)) +
+				len(doc.updateChannels(channels))
+		}
+	})
+	return changed
+}
+
+// Updates a document's metadata in place, without creating a revision.  The callback returns the
+// updated doc, or shouldUpdate=false to leave it alone (in which case the update is cancelled.)
+func (db *Database) updateDocMetadata(docid string, documentUpdateFunc func(doc *document) (updatedDoc *document, shouldUpdate bool, err error)) error {
+	key := db.realDocID(docid)
+	var err error
+	var updatedDoc *document
+	var inlinedBodyKey string
+	if db.UseXattrs() {
+		_, err = db.Bucket.WriteUpdateWithXattr(key, KSyncXattrName, 0, func(currentValue []byte, currentXattr []byte, cas uint64) (raw []byte, rawXattr []byte, deleteDoc bool, err error) {
+			// There's no scenario where a doc should from non-deleted to deleted during UpdateAllDocChannels processing, so deleteDoc is always returned as false.
+			if currentValue == nil || len(currentValue) == 0 {
+				return nil, nil, deleteDoc, errors.New("Cancel update")
+			}
+			doc, err := unmarshalDocumentWithXattr(docid, currentValue, currentXattr, cas)
+			if err != nil {
+				return nil, nil, deleteDoc, err
+			}
+			if err = db.loadOutOfLineBody(doc); err != nil {
+				return nil, nil, deleteDoc, err
+			}
+
+			var shouldUpdate bool
+			updatedDoc, shouldUpdate, err = documentUpdateFunc(doc)
+			if err != nil {
+				return nil, nil, deleteDoc, err
+			}
+			if shouldUpdate {
+				updatedDoc.migrateMetadata(db.syncMetadataWriteVersion())
+				inlinedBodyKey = db.inlineOutOfLineBody(updatedDoc)
+				db.LogContext.LogTo("Access", "Saving updated channels and access grants of %q", docid)
+				raw, rawXattr, err = updatedDoc.MarshalWithXattr()
+				return raw, rawXattr, deleteDoc, err
+			} else {
+				return nil, nil, deleteDoc, errors.New("Cancel update")
+			}
+		})
+	} else {
+		err = db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, error) {
+			// Be careful: this block can be invoked multiple times if there are races!
+			if currentValue == nil {
+				return nil, couchbase.UpdateCancel // someone deleted it?!
+			}
+			doc, err := unmarshalDocument(docid, currentValue)
+			if err != nil {
+				return nil, err
+			}
+			if err = db.loadOutOfLineBody(doc); err != nil {
+				return nil, err
+			}
+			var shouldUpdate bool
+			updatedDoc, shouldUpdate, err = documentUpdateFunc(doc)
+			if err != nil {
+				return nil, err
+			}
+			if shouldUpdate {
+				updatedDoc.migrateMetadata(db.syncMetadataWriteVersion())
+				inlinedBodyKey = db.inlineOutOfLineBody(updatedDoc)
+				db.LogContext.LogTo("Access", "Saving updated channels and access grants of %q", docid)
+				return json.Marshal(updatedDoc)
+			} else {
+				return nil, couchbase.UpdateCancel
+			}
+		})
 	}
-	return changeCount, nil
+	if err == nil && inlinedBodyKey != "" {
+		db.removeOutOfLineBodies(updatedDoc, inlinedBodyKey)
+	}
+	return err
 }
 
 func (db *Database) invalUserRoles(username string) {
 	authr := db.Authenticator()
 	if user, _ := authr.GetUser(username); user != nil {
 		if err := authr.InvalidateRoles(user); err != nil {
-			base.Warn("Error invalidating roles for user %s: %v", username, err)
+			db.LogContext.Warn("Error invalidating roles for user %s: %v", username, err)
 		}
 	}
 }
@@ -1169,7 +1679,7 @@ func (db *Database) invalUserChannels(username string) {
 	authr := db.Authenticator()
 	if user, _ := authr.GetUser(username); user != nil {
 		if err := authr.InvalidateChannels(user); err != nil {
-			base.Warn("Error invalidating channels for user %s: %v", username, err)
+			db.LogContext.Warn("Error invalidating channels for user %s: %v", username, err)
 		}
 	}
 }
@@ -1178,7 +1688,7 @@ func (db *Database) invalRoleChannels(rolename string) {
 	authr := db.Authenticator()
 	if role, _ := authr.GetRole(rolename); role != nil {
 		if err := authr.InvalidateChannels(role); err != nil {
-			base.Warn("Error invalidating channels for role %s: %v", rolename, err)
+			db.LogContext.Warn("Error invalidating channels for role %s: %v", rolename, err)
 		}
 	}
 }
@@ -1200,23 +1710,40 @@ func (context *DatabaseContext) GetIndexBucket() base.Bucket {
 	}
 }
 
+// Returns the sequences the change cache is currently waiting on.  Only supported by the in-memory change cache.
+func (context *DatabaseContext) GetSkippedSequences() ([]SkippedSequenceStatus, error) {
+	if changeCache, ok := context.changeCache.(*changeCache); ok {
+		return changeCache.GetSkippedSequences(), nil
+	}
+	return nil, base.HTTPErrorf(http.StatusNotImplemented, "Skipped sequences are only tracked by the in-memory channel cache")
+}
+
+// Stops waiting for a skipped sequence, allowing the stable sequence to advance past it.
+func (context *DatabaseContext) ReleaseSkippedSequence(sequence uint64) error {
+	if changeCache, ok := context.changeCache.(*changeCache); ok {
+		return changeCache.ReleaseSkippedSequence(sequence)
+	}
+	return base.HTTPErrorf(http.StatusNotImplemented, "Skipped sequences are only tracked by the in-memory channel cache")
+}
+
 func (context *DatabaseContext) GetUserViewsEnabled() bool {
-	if context.Options.UnsupportedOptions.UserViews.Enabled != nil {
-		return *context.Options.UnsupportedOptions.UserViews.Enabled
+	if value := context.GetOptions().UnsupportedOptions.UserViews.Enabled; value != nil {
+		return *value
 	}
 	return false
 }
 
 func (context *DatabaseContext) UseXattrs() bool {
-	if context.Options.UnsupportedOptions.EnableXattr != nil {
-		return *context.Options.UnsupportedOptions.EnableXattr
+	if value := context.GetOptions().UnsupportedOptions.EnableXattr; value != nil {
+		return *value
 	}
 	return base.DefaultUseXattrs
 }
 
 func (context *DatabaseContext) SetUserViewsEnabled(value bool) {
-
-	context.Options.UnsupportedOptions.UserViews.Enabled = &value
+	context.UpdateOptions(func(options *DatabaseContextOptions) {
+		options.UnsupportedOptions.UserViews.Enabled = &value
+	})
 }
 
 //////// SEQUENCE ALLOCATION:
@@ -1225,6 +1752,20 @@ func (context *DatabaseContext) LastSequence() (uint64, error) {
 	return context.sequences.lastSequence()
 }
 
+// The latest sequence up to which the changes feeds are complete; every change up to it has been
+// received from the mutation feed.  With a channel index, that's the last allocated sequence.
+func (context *DatabaseContext) StableSequence() (uint64, error) {
+	if !context.UseGlobalSequence() {
+		return context.LastSequence()
+	}
+	return context.changeCache.GetStableSequence("").Seq, nil
+}
+
 func (context *DatabaseContext) ReserveSequences(numToReserve uint64) error {
 	return context.sequences.reserveSequences(numToReserve)
 }
+
+// Releases any sequences that were reserved but never assigned to a document.
+func (context *DatabaseContext) ReleaseUnusedSequences() {
+	context.sequences.releaseUnusedSequences()
+}
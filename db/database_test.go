@@ -201,6 +201,22 @@ func TestDatabase(t *testing.T) {
 		"3-foo"})
 	assert.True(t, possible == nil)
 
+	// Test RevsDiff, which bulk-loads the docs:
+	log.Printf("Check RevsDiff...")
+	missingMap, possibleMap := db.RevsDiff(map[string][]string{
+		"doc1":      {"1-cb0c9a22be0e5a1b01084ec019defa81", "3-foo"},
+		"nosuchdoc": {"1-a"},
+		"_badid":    {"1-b"},
+	})
+	assert.DeepEquals(t, missingMap, map[string][]string{
+		"doc1":      {"3-foo"},
+		"nosuchdoc": {"1-a"},
+		"_badid":    {"1-b"},
+	})
+	assert.DeepEquals(t, possibleMap, map[string][]string{
+		"doc1": {"2-488724414d0ed6b398d6d2aeb228d797"},
+	})
+
 	// Test PutExistingRev:
 	log.Printf("Check PutExistingRev...")
 	body["_rev"] = "4-four"
@@ -275,6 +291,20 @@ func allDocIDs(db *Database) (docs []AllDocsEntry, err error) {
 	return
 }
 
+func TestPurgeInvalidatesRevisionCache(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1id, err := db.Put("doc1", Body{"key1": 1234})
+	assertNoError(t, err, "Put")
+	_, err = db.GetRev("doc1", rev1id, false, nil)
+	assertNoError(t, err, "GetRev")
+
+	assertNoError(t, db.Purge("doc1"), "Purge")
+	_, err = db.GetRev("doc1", rev1id, false, nil)
+	assertHTTPError(t, err, 404)
+}
+
 func TestAllDocs(t *testing.T) {
 	// base.LogKeys["Cache"] = true
 	// base.LogKeys["Changes"] = true
@@ -550,6 +580,158 @@ func TestSyncFnOnPush(t *testing.T) {
 	assert.DeepEquals(t, doc.History["4-four"].Channels, base.SetOf("clibup"))
 }
 
+// Docs the sync function puts in no channels are hidden from users with access to "*", but not
+// from admins, and resync recomputes that.
+func TestNoChannels(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	const adminOnlySyncFn = `function(doc) {
+		if (doc.type == "config") {
+			requireAdmin();
+			channel("!none");
+		}
+		channel(doc.channels);
+	}`
+	_, err := db.UpdateSyncFun(adminOnlySyncFn)
+	assertNoError(t, err, "UpdateSyncFun")
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("*"))
+	assertNoError(t, authenticator.Save(user), "Save")
+
+	_, err = db.Put("config", Body{"type": "config", "channels": []string{"ABC"}})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("doc1", Body{"channels": []string{"ABC"}})
+	assertNoError(t, err, "Put")
+	db.changeCache.waitForSequence(2)
+
+	doc, err := db.GetDoc("config")
+	assertNoError(t, err, "GetDoc")
+	assert.DeepEquals(t, doc.Channels, channels.ChannelMap{channels.NoChannels: nil})
+
+	// Admins see the doc:
+	changes, err := db.GetChanges(base.SetOf("*"), getZeroSequence(db))
+	assertNoError(t, err, "GetChanges")
+	assert.Equals(t, len(changes), 2)
+	_, err = db.Get("config")
+	assertNoError(t, err, "Get")
+
+	// ...but users with access to "*" don't:
+	db.user, _ = authenticator.GetUser("naomi")
+	changes, err = db.GetChanges(base.SetOf("*"), getZeroSequence(db))
+	assertNoError(t, err, "GetChanges")
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "doc1")
+	_, err = db.Get("config")
+	assertHTTPError(t, err, 403)
+	_, err = db.Put("config2", Body{"type": "config"})
+	assertHTTPError(t, err, 403)
+
+	// Resync with a sync function that doesn't hide the doc moves it out of "!none":
+	db.user = nil
+	_, err = db.UpdateSyncFun(`function(doc) {channel(doc.channels);}`)
+	assertNoError(t, err, "UpdateSyncFun")
+	_, err = db.UpdateAllDocChannels(true, false)
+	assertNoError(t, err, "UpdateAllDocChannels")
+	doc, err = db.GetDoc("config")
+	assertNoError(t, err, "GetDoc")
+	assert.True(t, doc.Channels[channels.NoChannels] != nil)
+	removal, found := doc.Channels["ABC"]
+	assert.True(t, found && removal == nil)
+	db.user, _ = authenticator.GetUser("naomi")
+	_, err = db.Get("config")
+	assertNoError(t, err, "Get")
+
+	// ...and resyncing with the original one moves it back:
+	db.user = nil
+	_, err = db.UpdateSyncFun(adminOnlySyncFn)
+	assertNoError(t, err, "UpdateSyncFun")
+	_, err = db.UpdateAllDocChannels(true, false)
+	assertNoError(t, err, "UpdateAllDocChannels")
+	doc, err = db.GetDoc("config")
+	assertNoError(t, err, "GetDoc")
+	assert.True(t, doc.Channels[channels.NoChannels] == nil)
+	assert.True(t, doc.Channels["ABC"] != nil)
+	db.user, _ = authenticator.GetUser("naomi")
+	_, err = db.Get("config")
+	assertHTTPError(t, err, 403)
+}
+
+// meta.updated_by is the writer of the revision's parent, which is recorded with each revision.
+func TestSyncMetaUpdatedBy(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	_, err := db.UpdateSyncFun(`function(doc, oldDoc, meta) {
+		channel("by_" + (meta.updated_by || "admin"));
+	}`)
+	assertNoError(t, err, "UpdateSyncFun")
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("alice", "letmein", channels.SetOf("*"))
+	assertNoError(t, authenticator.Save(user), "Save")
+
+	db.user, _ = authenticator.GetUser("alice")
+	rev1, err := db.Put("doc1", Body{"n": 1})
+	assertNoError(t, err, "Put")
+	db.user = nil
+	_, err = db.Put("doc1", Body{"n": 2, "_rev": rev1})
+	assertNoError(t, err, "Put")
+
+	// A conflicting revision based on rev1 sees its writer, not the current revision's:
+	assertNoError(t, db.PutExistingRev("doc1", Body{"n": 3}, []string{"2-zzz", rev1}), "PutExistingRev")
+	doc, err := db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.History[rev1].UpdatedBy, "alice")
+	assert.DeepEquals(t, doc.History["2-zzz"].Channels, base.SetOf("by_alice"))
+	assert.Equals(t, doc.History["2-zzz"].UpdatedBy, "")
+}
+
+// Users with access to "*" are told when a doc they could see is moved into no channels.
+func TestNoChannelsRemovedFromStar(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	_, err := db.UpdateSyncFun(`function(doc) {
+		if (doc.hidden) {
+			channel("!none");
+		}
+		channel(doc.channels);
+	}`)
+	assertNoError(t, err, "UpdateSyncFun")
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("*"))
+	assertNoError(t, authenticator.Save(user), "Save")
+
+	rev1, err := db.Put("doc1", Body{"channels": []string{"ABC"}})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("doc1", Body{"hidden": true, "channels": []string{"ABC"}, "_rev": rev1})
+	assertNoError(t, err, "Put")
+	db.changeCache.waitForSequence(2)
+
+	doc, err := db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	removal := doc.Channels[channels.UserStarChannel]
+	assert.True(t, removal != nil && removal.Seq == 2)
+
+	db.user, _ = authenticator.GetUser("naomi")
+	changes, err := db.GetChanges(base.SetOf("*"), getZeroSequence(db))
+	assertNoError(t, err, "GetChanges")
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "doc1")
+	assert.DeepEquals(t, changes[0].Removed, base.SetOf(channels.UserStarChannel))
+
+	// Once the doc is back in channels, the removal is dropped:
+	db.user = nil
+	_, err = db.Put("doc1", Body{"channels": []string{"ABC"}, "_rev": doc.CurrentRev})
+	assertNoError(t, err, "Put")
+	doc, err = db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	_, found := doc.Channels[channels.UserStarChannel]
+	assert.False(t, found)
+}
+
 func TestInvalidChannel(t *testing.T) {
 	db := setupTestDB(t)
 	defer tearDownTestDB(t, db)
@@ -559,6 +741,66 @@ func TestInvalidChannel(t *testing.T) {
 	body := Body{"channels": []string{"bad,name"}}
 	_, err := db.Put("doc", body)
 	assertHTTPError(t, err, 500)
+
+	body = Body{"channels": []string{"bad name"}}
+	_, err = db.Put("doc", body)
+	assertHTTPError(t, err, 500)
+	assert.True(t, strings.Contains(err.Error(), `Illegal channel name "bad name"`))
+}
+
+func TestMaxChannelsPerDoc(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	limit := uint32(3)
+	db.Options.MaxChannelsPerDoc = &limit
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc){channel(doc.channels); access(doc.users, doc.grants); role(doc.users, doc.roles);}`)
+
+	body := Body{"channels": []string{"a", "b", "c"}}
+	_, err := db.Put("doc1", body)
+	assertNoError(t, err, "Doc at the channel limit should be accepted")
+
+	body = Body{"channels": []string{"a", "b", "c", "d", "e", "f", "g"}}
+	_, err = db.Put("doc2", body)
+	assertHTTPError(t, err, 500)
+	assert.True(t, strings.Contains(err.Error(), "7 channels"))
+	assert.True(t, strings.Contains(err.Error(), "a, b, c, d, e, ..."))
+
+	body = Body{"users": []string{"naomi"}, "grants": []string{"a", "b", "c", "d"}}
+	_, err = db.Put("doc3", body)
+	assertHTTPError(t, err, 500)
+
+	body = Body{"users": []string{"naomi"}, "roles": []string{"role:a", "role:b", "role:c", "role:d"}}
+	_, err = db.Put("doc4", body)
+	assertHTTPError(t, err, 500)
+
+	// 0 means no limit:
+	limit = 0
+	body = Body{"channels": []string{"a", "b", "c", "d", "e", "f", "g"}}
+	_, err = db.Put("doc2", body)
+	assertNoError(t, err, "Channel limit of 0 should be unlimited")
+}
+
+func TestUpdateOptions(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Options got before an update aren't changed by it:
+	options := db.GetOptions()
+	db.UpdateOptions(func(options *DatabaseContextOptions) {
+		options.MaxBulkDocs = 5
+	})
+	assert.Equals(t, options.MaxBulkDocs, uint32(0))
+	assert.Equals(t, db.MaxBulkDocs(), 5)
+
+	// Replacing the sync function doesn't affect a mapper already got:
+	_, err := db.UpdateSyncFun(`function(doc) {channel("old");}`)
+	assertNoError(t, err, "UpdateSyncFun")
+	mapper := db.GetChannelMapper()
+	_, err = db.UpdateSyncFun(`function(doc) {channel("new");}`)
+	assertNoError(t, err, "UpdateSyncFun")
+	assert.Equals(t, mapper.Function(), `function(doc) {channel("old");}`)
+	assert.Equals(t, db.GetChannelMapper().Function(), `function(doc) {channel("new");}`)
 }
 
 func TestAccessFunctionValidation(t *testing.T) {
@@ -689,12 +931,19 @@ func CouchbaseTestAccessFunctionWithVbuckets(t *testing.T) {
 }
 
 func TestDocIDs(t *testing.T) {
-	assert.Equals(t, realDocID(""), "")
-	assert.Equals(t, realDocID("_"), "")
-	assert.Equals(t, realDocID("_foo"), "")
-	assert.Equals(t, realDocID("foo"), "foo")
-	assert.Equals(t, realDocID("_design/foo"), "")
-	assert.Equals(t, realDocID("_sync:rev:x"), "")
+	context := &DatabaseContext{Options: &DatabaseContextOptions{}}
+	assert.Equals(t, context.realDocID(""), "")
+	assert.Equals(t, context.realDocID("_"), "")
+	assert.Equals(t, context.realDocID("_foo"), "")
+	assert.Equals(t, context.realDocID("foo"), "foo")
+	assert.Equals(t, context.realDocID("_design/foo"), "")
+	assert.Equals(t, context.realDocID("_sync:rev:x"), "")
+
+	// The unsafe option allows "_" IDs, but not internal docs' prefixes:
+	context.Options.UnsupportedOptions.AllowUnderscoreDocIDs = true
+	assert.Equals(t, context.realDocID("_foo"), "_foo")
+	assert.Equals(t, context.realDocID("_sync:user:x"), "")
+	assert.Equals(t, context.realDocID("_idx:x"), "")
 }
 
 func TestUpdateDesignDoc(t *testing.T) {
@@ -763,6 +1012,107 @@ func TestImport(t *testing.T) {
 	assertNoError(t, err, "can't get doc")
 }
 
+// With VerifyRevIDs, revisions pushed with new_edits=false must have their content's rev IDs.
+func TestVerifyRevIDs(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Without the option, any rev ID is accepted:
+	assertNoError(t, db.PutExistingRev("doc0", Body{"k": 1}, []string{"1-abc"}), "PutExistingRev")
+
+	db.Options.VerifyRevIDs = true
+	rev1 := createRevID(1, "", Body{"k": 1})
+	assertNoError(t, db.PutExistingRev("doc1", Body{"k": 1}, []string{rev1}), "PutExistingRev")
+	err := db.PutExistingRev("doc1", Body{"k": 2}, []string{"2-abc", rev1})
+	_, ok := err.(*base.RevIDMismatchError)
+	assert.True(t, ok)
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equals(t, status, 400)
+	rev2 := createRevID(2, rev1, Body{"k": 2})
+	assertNoError(t, db.PutExistingRev("doc1", Body{"k": 2}, []string{rev2, rev1}), "PutExistingRev")
+
+	// A revision whose parent isn't known can't be checked:
+	assertNoError(t, db.PutExistingRev("doc2", Body{"k": 1}, []string{"3-abc"}), "PutExistingRev")
+
+	// Attachments are digested the same way as when the gateway makes up the rev ID:
+	newBody := func() Body {
+		return Body{"k": 1, "_attachments": map[string]interface{}{"a.txt": map[string]interface{}{"data": "aGVsbG8="}}}
+	}
+	rev, err := db.Put("doc3", newBody())
+	assertNoError(t, err, "Put")
+	assertNoError(t, db.PutExistingRev("doc4", newBody(), []string{rev}), "PutExistingRev")
+}
+
+// Neither updates nor imports can write a doc under a reserved ID.
+func TestReservedDocIDs(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	_, err := db.Put("_sync:user:eve", Body{"name": "eve", "admin_channels": []string{"*"}})
+	assertHTTPError(t, err, 400)
+	_, err = db.Put("_foo", Body{"n": 1})
+	assertHTTPError(t, err, 400)
+	assertHTTPError(t, db.PutExistingRev("_sync:session:1234", Body{"n": 1}, []string{"1-a"}), 400)
+
+	// Docs written to the bucket under reserved IDs aren't imported:
+	_, err = db.Bucket.Add("_foo", 0, Body{"n": 1})
+	assertNoError(t, err, "Add")
+	_, err = db.ImportDocRaw("_foo", []byte(`{"n": 1}`), false, 0, ImportOnDemand)
+	assertHTTPError(t, err, 400)
+	_, err = db.ImportDocRaw("_sync:user:eve", []byte(`{"name": "eve"}`), false, 0, ImportFromFeed)
+	assertHTTPError(t, err, 400)
+	var raw Body
+	_, err = db.Bucket.Get("_foo", &raw)
+	assertNoError(t, err, "Get")
+	assert.DeepEquals(t, raw, Body{"n": float64(1)})
+	_, _, err = db.Bucket.GetRaw("_sync:user:eve")
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// The unsafe option allows other "_" IDs, but never internal docs':
+	db.Options.UnsupportedOptions.AllowUnderscoreDocIDs = true
+	_, err = db.Put("_bar", Body{"n": 1})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("_sync:user:eve", Body{"name": "eve"})
+	assertHTTPError(t, err, 400)
+}
+
+func TestImportFilter(t *testing.T) {
+
+	if !base.UnitTestUrlIsWalrus() {
+		t.Skip("Backfill-style import is only tested against walrus")
+	}
+
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.Options.ImportFilter = NewImportFilterFunction(`function(doc) { return doc.type == "mobile"; }`)
+
+	// Add docs to the underlying bucket; only the even ones are meant for mobile:
+	for i := 1; i <= 10; i++ {
+		docType := "server"
+		if i%2 == 0 {
+			docType = "mobile"
+		}
+		db.Bucket.Add(fmt.Sprintf("alreadyHere%d", i), 0, Body{"key1": i, "type": docType})
+	}
+
+	count, err := db.UpdateAllDocChannels(false, true)
+	assertNoError(t, err, "UpdateAllDocChannels")
+	assert.Equals(t, count, 5)
+
+	doc, err := db.GetDoc("alreadyHere2")
+	assertNoError(t, err, "Imported doc should be visible")
+	assert.True(t, doc != nil)
+	_, err = db.GetDoc("alreadyHere1")
+	assertHTTPError(t, err, 404)
+
+	// A filter that doesn't return a boolean rejects everything:
+	filter := NewImportFilterFunction(`function(doc) { return doc.type; }`)
+	_, err = filter.EvaluateFunction(Body{"type": "mobile"})
+	assert.True(t, err != nil)
+	db.Options.ImportFilter = filter
+	assert.False(t, db.shouldImport("doc", Body{"type": "mobile"}))
+}
+
 func TestPostWithExistingId(t *testing.T) {
 	db := setupTestDB(t)
 	defer tearDownTestDB(t, db)
@@ -953,7 +1303,7 @@ func TestChannelView(t *testing.T) {
 	// Query view (retry loop to wait for indexing)
 	for i := 0; i < 10; i++ {
 		var err error
-		entries, err = db.getChangesInChannelFromView("*", 0, ChangesOptions{})
+		entries, err = db.getChangesInChannelFromQuery("*", 0, ChangesOptions{})
 
 		assertNoError(t, err, "Couldn't create document")
 		if len(entries) >= 1 {
@@ -1046,7 +1396,7 @@ func TestViewCustom(t *testing.T) {
 	// query all docs using ViewCustom query.
 	opts := Body{"stale": false, "reduce": false}
 	viewResult := sgbucket.ViewResult{}
-	errViewCustom := db.Bucket.ViewCustom(DesignDocSyncHousekeeping, ViewAllDocs, opts, &viewResult)
+	errViewCustom := db.Bucket.ViewCustom(db.DesignDocName(DesignDocSyncHousekeeping, ViewAllDocs), ViewAllDocs, opts, &viewResult)
 	assert.True(t, errViewCustom == nil)
 
 	// assert that the doc added earlier is in the results
@@ -1078,3 +1428,147 @@ func BenchmarkDatabase(b *testing.B) {
 		db.Close()
 	}
 }
+
+func TestSessionCleanup(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	authr := db.Authenticator()
+	user, err := authr.NewUser("naomi", "letmein", nil)
+	assertNoError(t, err, "NewUser")
+	assertNoError(t, authr.Save(user), "Save")
+	var sessions []*auth.LoginSession
+	for i := 0; i < 3; i++ {
+		session, err := authr.CreateSession(user, time.Hour)
+		assertNoError(t, err, "CreateSession")
+		sessions = append(sessions, session)
+	}
+
+	// Backdate two of the sessions, one of them to within the grace period:
+	expire := func(session *auth.LoginSession, expiration time.Time) {
+		session.Expiration = expiration.UTC()
+		assertNoError(t, db.Bucket.Set(auth.SessionKeyPrefix+session.ID, 0, session), "Set")
+	}
+	expire(sessions[0], time.Now().Add(-time.Hour))
+	expire(sessions[1], time.Now().Add(-time.Minute))
+	// An older session's expiration is in the server's time zone, which may be ahead of UTC:
+	legacy, err := authr.CreateSession(user, time.Hour)
+	assertNoError(t, err, "CreateSession")
+	legacy.Expiration = time.Now().Add(-time.Hour).In(time.FixedZone("JST", 9*60*60))
+	assertNoError(t, db.Bucket.Set(auth.SessionKeyPrefix+legacy.ID, 0, legacy), "Set")
+
+	deletedStat := base.StatsExpvars.Get("sessions_expiredDeleted").String()
+	deleted, err := db.CleanupSessions()
+	assertNoError(t, err, "CleanupSessions")
+	assert.Equals(t, deleted, 2)
+	assert.False(t, base.StatsExpvars.Get("sessions_expiredDeleted").String() == deletedStat)
+	_, _, err = db.Bucket.GetRaw(auth.SessionKeyPrefix + sessions[0].ID)
+	assert.True(t, base.IsDocNotFoundError(err))
+	_, _, err = db.Bucket.GetRaw(auth.SessionKeyPrefix + legacy.ID)
+	assert.True(t, base.IsDocNotFoundError(err))
+	_, _, err = db.Bucket.GetRaw(auth.SessionKeyPrefix + sessions[1].ID)
+	assertNoError(t, err, "Session within the grace period was deleted")
+	infos, err := authr.GetUserSessions(user)
+	assertNoError(t, err, "GetUserSessions")
+	assert.Equals(t, len(infos), 2)
+
+	// Another node can't clean up while this one holds the lease:
+	other := auth.NewSessionCleaner(db.Authenticator(), db.queryExpiredSessions, auth.SessionCleanupOptions{GracePeriod: time.Second})
+	deleted, err = other.Run()
+	assertNoError(t, err, "Run")
+	assert.Equals(t, deleted, 0)
+	_, _, err = db.Bucket.GetRaw(auth.SessionKeyPrefix + sessions[1].ID)
+	assertNoError(t, err, "Session was deleted without the lease")
+}
+
+func TestPutWithOperationID(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.Options.MaxOperationIDs = 2
+
+	rev1, err := db.WithOperationID("op1").Put("doc", Body{"n": 1})
+	assertNoError(t, err, "Put")
+	// A retry gets the same revision, even though the doc now exists:
+	revid, err := db.WithOperationID("op1").Put("doc", Body{"n": 1})
+	assertNoError(t, err, "Retried Put")
+	assert.Equals(t, revid, rev1)
+
+	// and still does after the revision is superseded:
+	rev2, err := db.WithOperationID("op2").Put("doc", Body{"n": 2, "_rev": rev1})
+	assertNoError(t, err, "Put")
+	revid, err = db.WithOperationID("op1").Put("doc", Body{"n": 1})
+	assertNoError(t, err, "Retried Put")
+	assert.Equals(t, revid, rev1)
+
+	// Only the newest MaxOperationIDs are recorded:
+	_, err = db.WithOperationID("op3").Put("doc", Body{"n": 3, "_rev": rev2})
+	assertNoError(t, err, "Put")
+	doc, err := db.GetDoc("doc")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, len(doc.Operations), 2)
+	_, err = db.WithOperationID("op1").Put("doc", Body{"n": 1})
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equals(t, status, 409)
+
+	// A retried Post updates the same doc:
+	docid, rev1, err := db.WithOperationID("post1").Post(Body{"n": 1})
+	assertNoError(t, err, "Post")
+	retryID, retryRev, err := db.WithOperationID("post1").Post(Body{"n": 1})
+	assertNoError(t, err, "Retried Post")
+	assert.Equals(t, retryID, docid)
+	assert.Equals(t, retryRev, rev1)
+}
+
+// A bucket that records the expiry each doc write is made with.
+type expiryRecordingBucket struct {
+	base.Bucket
+	expiries []int
+}
+
+func (bucket *expiryRecordingBucket) WriteUpdate(k string, exp int, callback sgbucket.WriteUpdateFunc) error {
+	bucket.expiries = append(bucket.expiries, exp)
+	return bucket.Bucket.WriteUpdate(k, exp, callback)
+}
+
+func (bucket *expiryRecordingBucket) WriteUpdateWithXattr(k string, xattr string, exp int, callback sgbucket.WriteUpdateWithXattrFunc) (uint64, error) {
+	bucket.expiries = append(bucket.expiries, exp)
+	return bucket.Bucket.WriteUpdateWithXattr(k, xattr, exp, callback)
+}
+
+func TestSyncFunctionExpiryWrite(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {if (doc.ttl) expiry(doc.ttl);}`)
+	bucket := &expiryRecordingBucket{Bucket: db.Bucket}
+	db.Bucket = bucket
+
+	// The doc is written again with the sync function's expiry, rather than touched afterwards:
+	_, err := db.Put("doc1", Body{"ttl": 100})
+	assertNoError(t, err, "Put")
+	assert.DeepEquals(t, bucket.expiries, []int{0, 100})
+	syncData, err := db.GetDocSyncData("doc1")
+	assertNoError(t, err, "GetDocSyncData")
+	assert.True(t, syncData.Expiry != nil)
+
+	// A write without one is made once:
+	bucket.expiries = nil
+	_, err = db.Put("doc2", Body{})
+	assertNoError(t, err, "Put")
+	assert.DeepEquals(t, bucket.expiries, []int{0})
+}
+
+func TestGetDocsSyncData(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1, err := db.Put("doc1", Body{"k": 1})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("doc2", Body{"k": 2})
+	assertNoError(t, err, "Put")
+
+	// Missing docs are left out:
+	docsSyncData := db.getDocsSyncData([]string{"doc1", "doc2", "nosuchdoc"})
+	assert.Equals(t, len(docsSyncData), 2)
+	assert.Equals(t, docsSyncData["doc1"].CurrentRev, rev1)
+	assert.Equals(t, len(db.getDocsSyncData(nil)), 0)
+}
@@ -20,7 +20,10 @@ const (
 	DesignDocSyncGatewayRoleAccessVbSeq = "sync_gateway_role_access_vbseq"
 	DesignDocSyncHousekeeping           = "sync_housekeeping"
 	ViewPrincipals                      = "principals"
+	ViewPrincipalDetails                = "principal_details"
+	ViewPrincipalGrants                 = "principal_grants"
 	ViewChannels                        = "channels"
+	ViewChannelStats                    = "channel_stats"
 	ViewAccess                          = "access"
 	ViewAccessVbSeq                     = "access_vbseq"
 	ViewRoleAccess                      = "role_access"
@@ -30,14 +33,18 @@ const (
 	ViewImport                          = "import"
 	ViewOldRevs                         = "old_revs"
 	ViewSessions                        = "sessions"
+	ViewSessionExpiry                   = "session_expiry"
+	ViewLocalDocs                       = "local_docs"
 	ViewTombstones                      = "tombstones"
+	ViewDocStates                       = "doc_states"
+	ViewSyncFnEpochs                    = "sync_fn_epochs"
 )
 
 func GetDesignDocForView(viewName string) (designDocName string) {
 	switch viewName {
-	case ViewPrincipals:
+	case ViewPrincipals, ViewPrincipalDetails, ViewPrincipalGrants:
 		return DesignDocSyncHousekeeping
-	case ViewChannels:
+	case ViewChannels, ViewChannelStats:
 		return DesignDocSyncGatewayChannels
 	case ViewAccess:
 		return DesignDocSyncGatewayAccess
@@ -55,33 +62,57 @@ func isInternalDDoc(ddocName string) bool {
 	return strings.HasPrefix(ddocName, "sync_")
 }
 
-// Enforces access by admins only, and not to the built-in Sync Gateway design docs:
+// Design docs put through the REST API are stored in the bucket under this prefix.  While user
+// views are enabled, their map functions are wrapped to record the channels of each doc they index,
+// so that regular users' queries can be filtered by channel.  Raw design docs are stored under their
+// own names, and only admins can query them.  Design docs put before this namespace existed are
+// also stored under their own names, and aren't migrated: admins can still query them, but users
+// can't until they're put again, as with design docs put while user views were disabled.
+const UserDesignDocPrefix = "sgviews_"
+
+// Returns the names a design doc put through the REST API may have in the bucket, the namespaced
+// one first.
+func ddocBucketNames(ddocName string) []string {
+	return []string{UserDesignDocPrefix + ddocName, ddocName}
+}
+
+// Enforces access by admins only, and not to the built-in Sync Gateway design docs, nor directly
+// to the namespace of the channel-safe ones:
 func (db *Database) checkDDocAccess(ddocName string) error {
-	if db.user != nil || isInternalDDoc(ddocName) {
+	if db.user != nil || isInternalDDoc(ddocName) || strings.HasPrefix(ddocName, UserDesignDocPrefix) {
 		return base.HTTPErrorf(http.StatusForbidden, "forbidden")
 	}
 	return nil
 }
 
 func (db *Database) GetDesignDoc(ddocName string, result interface{}) (err error) {
-	if err = db.checkDDocAccess(ddocName); err == nil {
-		err = db.Bucket.GetDDoc(ddocName, result)
+	if err = db.checkDDocAccess(ddocName); err != nil {
+		return
+	}
+	for _, name := range ddocBucketNames(ddocName) {
+		if err = db.Bucket.GetDDoc(name, result); err == nil {
+			return
+		}
 	}
 	return
 }
 
+// Stores a design doc.  Unless it's raw, its map functions get the cleaned doc (without _sync
+// metadata), and if user views are enabled, its index values record the doc's channels; see
+// QueryDesignDoc.
 func (db *Database) PutDesignDoc(ddocName string, ddoc sgbucket.DesignDoc) (err error) {
-	wrap := true
-	if opts := ddoc.Options; opts != nil {
-		if opts.Raw == true {
-			wrap = false
-		}
+	if err = db.checkDDocAccess(ddocName); err != nil {
+		return
 	}
-	if wrap {
+	names := ddocBucketNames(ddocName)
+	if opts := ddoc.Options; opts != nil && opts.Raw {
+		names[0], names[1] = names[1], names[0]
+	} else {
 		wrapViews(&ddoc, db.GetUserViewsEnabled(), db.UseXattrs())
 	}
-	if err = db.checkDDocAccess(ddocName); err == nil {
-		err = db.Bucket.PutDDoc(ddocName, ddoc)
+	if err = db.Bucket.PutDDoc(names[0], ddoc); err == nil {
+		// A design doc of the same name in the other namespace would shadow, or be shadowed by, this one:
+		db.Bucket.DeleteDDoc(names[1])
 	}
 	return
 }
@@ -98,7 +129,8 @@ const (
 	                    meta.rev = sync.rev;
 						(%s) (doc, meta);
 						doc._sync = sync;}`
-	// viewWrapper_userViews does the same work as viewWrapper_adminViews, and also includes channel information in the view results
+	// viewWrapper_userViews strips the _sync property from the doc, adds the rev to metadata, and
+	// emits the doc's channels along with each value, as [channels, value]
 	viewWrapper_userViews = `function(doc,meta) {
 		                    var sync = doc._sync;
 		                    if (sync === undefined || meta.id.substring(0,6) == "_sync:")
@@ -181,7 +213,7 @@ func getViewWrapper(enableUserViews bool, useXattrs bool) string {
 
 func wrapViews(ddoc *sgbucket.DesignDoc, enableUserViews bool, useXattrs bool) {
 	// Wrap the map functions to ignore special docs and strip _sync metadata.  If user views are enabled, also
-	// add channel filtering.
+	// record channels.
 	viewWrapper := getViewWrapper(enableUserViews, useXattrs)
 	for name, view := range ddoc.Views {
 		view.Map = fmt.Sprintf(viewWrapper, view.Map)
@@ -190,84 +222,97 @@ func wrapViews(ddoc *sgbucket.DesignDoc, enableUserViews bool, useXattrs bool) {
 }
 
 func (db *Database) DeleteDesignDoc(ddocName string) (err error) {
-	if err = db.checkDDocAccess(ddocName); err == nil {
-		err = db.Bucket.DeleteDDoc(ddocName)
+	if err = db.checkDDocAccess(ddocName); err != nil {
+		return
+	}
+	for _, name := range ddocBucketNames(ddocName) {
+		if err = db.Bucket.DeleteDDoc(name); err == nil {
+			return
+		}
 	}
 	return
 }
 
+// Queries a view.  Regular users can only query the channel-safe design docs put through the REST
+// API (if user views aren't disabled), and only get the rows of docs in channels they can see;
+// they can't query reduce functions, whose results can't be filtered.  Admins can query any
+// design doc, including the internal ones.
 func (db *Database) QueryDesignDoc(ddocName string, viewName string, options map[string]interface{}) (*sgbucket.ViewResult, error) {
-
-	// Regular users have limitations on what they can query
-	if db.user != nil {
-		// * Regular users can only query when user views are enabled
-		if !db.GetUserViewsEnabled() {
-			return nil, base.HTTPErrorf(http.StatusForbidden, "forbidden")
-		}
-		// * Admins can query any design doc including the internal ones
-		// * Regular users can query non-internal design docs
-		if isInternalDDoc(ddocName) {
-			return nil, base.HTTPErrorf(http.StatusForbidden, "forbidden")
-		}
-	}
-
-	result, err := db.Bucket.View(ddocName, viewName, options)
-	if err != nil {
+	if err := db.checkCancelled(); err != nil {
 		return nil, err
 	}
 	if isInternalDDoc(ddocName) {
+		if db.user != nil {
+			return nil, base.HTTPErrorf(http.StatusForbidden, "forbidden")
+		}
+		result, err := db.Bucket.View(db.DesignDocName(ddocName, viewName), viewName, options)
+		if err != nil {
+			return nil, err
+		}
 		if options["include_docs"] == true {
 			for _, row := range result.Rows {
 				stripSyncProperty(row)
 			}
 		}
-	} else {
-		applyChannelFiltering := options["reduce"] != true && db.GetUserViewsEnabled()
-		result = filterViewResult(result, db.user, applyChannelFiltering)
+		return &result, nil
+	} else if strings.HasPrefix(ddocName, UserDesignDocPrefix) {
+		return nil, base.HTTPErrorf(http.StatusForbidden, "forbidden")
 	}
-	return &result, nil
+
+	names := ddocBucketNames(ddocName)
+	if db.user != nil {
+		if !db.GetUserViewsEnabled() {
+			return nil, base.HTTPErrorf(http.StatusForbidden, "forbidden")
+		} else if options["reduce"] == true || options["group"] == true || options["group_level"] != nil {
+			return nil, base.HTTPErrorf(http.StatusForbidden, "Reduce queries aren't available to users")
+		}
+		options["reduce"] = false
+		names = names[:1]
+	}
+
+	var result sgbucket.ViewResult
+	var err error
+	for i, name := range names {
+		if result, err = db.Bucket.View(name, viewName, options); err == nil {
+			channelSafe := i == 0 && db.GetUserViewsEnabled()
+			result = filterViewResult(result, db.user, channelSafe)
+			return &result, nil
+		}
+	}
+	return nil, err
 }
 
-// Cleans up the Value property, and removes rows that aren't visible to the current user
-func filterViewResult(input sgbucket.ViewResult, user auth.User, applyChannelFiltering bool) (result sgbucket.ViewResult) {
-	hasStarChannel := false
+// Cleans up the rows of a view result.  The values of a channel-safe view are [channels, value]:
+// rows are removed unless the user has access to one of the channels (or is an admin), and the
+// value is unwrapped.  The rows of a reduce query, which only admins can make, have no doc ID and
+// are left as they are.
+func filterViewResult(input sgbucket.ViewResult, user auth.User, channelSafe bool) (result sgbucket.ViewResult) {
 	var visibleChannels ch.TimedSet
 	if user != nil {
 		visibleChannels = user.InheritedChannels()
-		hasStarChannel = !visibleChannels.Contains("*")
-		if !applyChannelFiltering {
-			return // this is an error
-		}
 	}
-	result.TotalRows = input.TotalRows
-	result.Rows = make([]*sgbucket.ViewRow, 0, len(input.Rows)/2)
+	seesAllChannels := user == nil || visibleChannels.Contains(ch.UserStarChannel)
+	result.Rows = make([]*sgbucket.ViewRow, 0, len(input.Rows))
 	for _, row := range input.Rows {
-		if applyChannelFiltering {
-			value, ok := row.Value.([]interface{})
-			if ok {
-				// value[0] is the array of channels; value[1] is the actual value
-				if !hasStarChannel || channelsIntersect(visibleChannels, value[0].([]interface{})) {
-					// Add this row:
-					stripSyncProperty(row)
-					result.Rows = append(result.Rows, &sgbucket.ViewRow{
-						Key:   row.Key,
-						Value: value[1],
-						ID:    row.ID,
-						Doc:   row.Doc,
-					})
-				}
+		value := row.Value
+		if channelSafe && !(user == nil && row.ID == "") {
+			wrapped, ok := row.Value.([]interface{})
+			if !ok || len(wrapped) != 2 {
+				continue
 			}
-		} else {
-			// Add the raw row:
-			stripSyncProperty(row)
-			result.Rows = append(result.Rows, &sgbucket.ViewRow{
-				Key:   row.Key,
-				Value: row.Value,
-				ID:    row.ID,
-				Doc:   row.Doc,
-			})
+			docChannels, _ := wrapped[0].([]interface{})
+			if !seesAllChannels && !channelsIntersect(visibleChannels, docChannels) {
+				continue
+			}
+			value = wrapped[1]
 		}
-
+		stripSyncProperty(row)
+		result.Rows = append(result.Rows, &sgbucket.ViewRow{
+			Key:   row.Key,
+			Value: value,
+			ID:    row.ID,
+			Doc:   row.Doc,
+		})
 	}
 	result.TotalRows = len(result.Rows)
 	return
@@ -276,7 +321,7 @@ func filterViewResult(input sgbucket.ViewResult, user auth.User, applyChannelFil
 // Is any item of channels found in visibleChannels?
 func channelsIntersect(visibleChannels ch.TimedSet, channels []interface{}) bool {
 	for _, channel := range channels {
-		if visibleChannels.Contains(channel.(string)) || channel == "*" {
+		if name, _ := channel.(string); visibleChannels.Contains(name) || name == "*" {
 			return true
 		}
 	}
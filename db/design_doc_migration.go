@@ -0,0 +1,301 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// The built-in design docs are installed under versioned names (e.g. "sync_housekeeping_v2"), so
+// that new view definitions don't replace the ones in use.  A bucket's _sync:design_docs doc
+// records the version its queries use.  When a database starts with a newer version than that,
+// it keeps querying the old design docs while the new ones build in the background; once they've
+// caught up, it switches to them, records their version, and deletes the old ones.  Views that
+// don't exist in the old design docs are queried in the new ones right away.
+
+// Version of the built-in design docs.  Bump it whenever installViews changes a view.  Buckets
+// whose design docs were installed before they were versioned are at version 0.
+const DesignDocVersion = 7
+
+// Key of the doc recording the version of the design docs a bucket's queries use.
+const kDesignDocVersionKey = KSyncKeyPrefix + "design_docs"
+
+const (
+	kDesignDocBuildInitialRetry = time.Second // Initial delay between checks of whether new design docs have been built
+	kDesignDocBuildMaxRetry     = time.Minute // Max delay between those checks
+)
+
+// States of a design doc migration, as reported by DesignDocStatus
+const (
+	DesignDocsCurrent  = "current"  // The queries use this node's design docs
+	DesignDocsBuilding = "building" // The new design docs are being built; queries use the old ones
+	DesignDocsNewer    = "newer"    // The bucket's queries use newer design docs than this node knows
+)
+
+// The built-in design docs, as installed by installViews.
+var builtInDesignDocs = []string{
+	DesignDocSyncGatewayChannels,
+	DesignDocSyncGatewayAccess,
+	DesignDocSyncGatewayAccessVbSeq,
+	DesignDocSyncGatewayRoleAccess,
+	DesignDocSyncGatewayRoleAccessVbSeq,
+	DesignDocSyncHousekeeping,
+}
+
+// A version of the built-in design docs.  The map functions depend on whether the metadata is in
+// xattrs, so that's part of the version.
+type designDocVersion struct {
+	Version int  `json:"version"`
+	Xattrs  bool `json:"xattrs,omitempty"`
+}
+
+func currentDesignDocVersion(useXattrs bool) designDocVersion {
+	return designDocVersion{Version: DesignDocVersion, Xattrs: useXattrs}
+}
+
+func (v designDocVersion) String() string {
+	if v.Version == 0 {
+		return "unversioned"
+	} else if v.Xattrs {
+		return fmt.Sprintf("v%dx", v.Version)
+	}
+	return fmt.Sprintf("v%d", v.Version)
+}
+
+// The name a built-in design doc is installed under in this version.
+func (v designDocVersion) designDocName(ddocName string) string {
+	if v.Version == 0 {
+		return ddocName
+	}
+	return ddocName + "_" + v.String()
+}
+
+func isBuiltInDesignDoc(ddocName string) bool {
+	for _, name := range builtInDesignDocs {
+		if name == ddocName {
+			return true
+		}
+	}
+	return false
+}
+
+// The state of a database's design doc migration, for the admin API's /_status.
+type DesignDocStatus struct {
+	State      string     `json:"state"`
+	Version    string     `json:"version"`               // The version this node installs
+	InUse      string     `json:"in_use"`                // The version queries use
+	Since      *time.Time `json:"since,omitempty"`       // When the migration started
+	Checks     int        `json:"checks,omitempty"`      // How many times the new design docs were checked
+	LastError  string     `json:"last_error,omitempty"`  // Why the last check failed
+	FinishedAt *time.Time `json:"finished_at,omitempty"` // When the migration finished
+}
+
+// Tracks which version of the built-in design docs a database queries, and migrates it to this
+// node's version.
+type designDocMigration struct {
+	context    *DatabaseContext
+	lock       sync.RWMutex
+	target     designDocVersion    // The version installViews installed
+	active     designDocVersion    // The version queries use
+	oldViews   map[string]base.Set // While building, the views of each old design doc
+	status     DesignDocStatus
+	terminator chan struct{}
+	done       chan struct{}
+}
+
+// Reads which version of the design docs the database's queries use.  If it's older than this
+// node's, call start() to build the new ones.
+func newDesignDocMigration(context *DatabaseContext) (*designDocMigration, error) {
+	migration := &designDocMigration{
+		context:    context,
+		target:     currentDesignDocVersion(context.UseXattrs()),
+		terminator: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	migration.active = migration.target
+
+	var stored designDocVersion
+	rawVersion, _, err := context.Bucket.GetRaw(kDesignDocVersionKey)
+	if err == nil {
+		if err = json.Unmarshal(rawVersion, &stored); err != nil {
+			return nil, err
+		}
+	} else if !base.IsDocNotFoundError(err) {
+		return nil, err
+	} else if !migration.designDocExists(designDocVersion{}.designDocName(DesignDocSyncHousekeeping)) {
+		// A new bucket, or one whose views were never installed; nothing to migrate
+		stored = migration.target
+		if added, err := context.Bucket.Add(kDesignDocVersionKey, 0, stored); err != nil {
+			return nil, err
+		} else if !added {
+			return newDesignDocMigration(context) // Another node got there first
+		}
+	}
+
+	migration.status = DesignDocStatus{State: DesignDocsCurrent, Version: migration.target.String(), InUse: stored.String()}
+	if stored.Version > migration.target.Version {
+		// A newer gateway has migrated the bucket; leave its design docs alone, and use this node's own
+		base.Warn("Database %q uses design docs %s, newer than this node's %s", context.Name, stored, migration.target)
+		migration.status.State = DesignDocsNewer
+		migration.status.InUse = migration.target.String()
+	} else if stored != migration.target {
+		migration.active = stored
+		migration.oldViews = make(map[string]base.Set, len(builtInDesignDocs))
+		for _, ddocName := range builtInDesignDocs {
+			var ddoc sgbucket.DesignDoc
+			if err := context.Bucket.GetDDoc(stored.designDocName(ddocName), &ddoc); err == nil {
+				viewNames := make([]string, 0, len(ddoc.Views))
+				for viewName := range ddoc.Views {
+					viewNames = append(viewNames, viewName)
+				}
+				migration.oldViews[ddocName] = base.SetFromArray(viewNames)
+			}
+		}
+		migration.status.State = DesignDocsBuilding
+	}
+	return migration, nil
+}
+
+func (migration *designDocMigration) designDocExists(name string) bool {
+	var ddoc interface{}
+	return migration.context.Bucket.GetDDoc(name, &ddoc) == nil
+}
+
+// Starts building the new design docs in the background, if they're needed.
+func (migration *designDocMigration) start() {
+	if migration.status.State != DesignDocsBuilding {
+		close(migration.done)
+		return
+	}
+	base.Logf("Database %q: building design docs %s to replace %s", migration.context.Name, migration.target, migration.active)
+	now := time.Now()
+	migration.lock.Lock()
+	migration.status.Since = &now
+	migration.lock.Unlock()
+	go migration.build()
+}
+
+// Queries each new design doc with stale=false until they've all been built, backing off between
+// attempts, then switches to them.
+func (migration *designDocMigration) build() {
+	defer close(migration.done)
+	retry := kDesignDocBuildInitialRetry
+	for {
+		err := migration.checkBuilt()
+		migration.lock.Lock()
+		migration.status.Checks++
+		if err != nil {
+			migration.status.LastError = err.Error()
+		}
+		migration.lock.Unlock()
+		if err == nil {
+			break
+		}
+		base.LogTo("CRUD", "Design docs %s of database %q aren't built yet (%v); checking again in %v", migration.target, migration.context.Name, err, retry)
+		select {
+		case <-time.After(retry):
+		case <-migration.terminator:
+			return
+		}
+		if retry *= 2; retry > kDesignDocBuildMaxRetry {
+			retry = kDesignDocBuildMaxRetry
+		}
+	}
+
+	if err := migration.switchToTarget(); err != nil {
+		base.Warn("Database %q couldn't switch to design docs %s: %v", migration.context.Name, migration.target, err)
+	}
+}
+
+// Returns an error unless every new design doc's index has caught up.  Querying a view with
+// stale=false builds the index of its design doc, and only returns once it's up to date.
+func (migration *designDocMigration) checkBuilt() error {
+	for _, ddocName := range builtInDesignDocs {
+		name := migration.target.designDocName(ddocName)
+		var ddoc sgbucket.DesignDoc
+		if err := migration.context.Bucket.GetDDoc(name, &ddoc); err != nil {
+			return fmt.Errorf("design doc %s: %v", name, err)
+		}
+		for viewName := range ddoc.Views {
+			var vres sgbucket.ViewResult
+			opts := Body{"stale": false, "limit": 1}
+			if err := migration.context.Bucket.ViewCustom(name, viewName, opts, &vres); err != nil {
+				return fmt.Errorf("view %s/%s: %v", name, viewName, err)
+			}
+			break // All the views of a design doc share its index
+		}
+	}
+	return nil
+}
+
+// Makes queries use the new design docs, records their version, and deletes the old ones.
+func (migration *designDocMigration) switchToTarget() error {
+	if err := migration.context.Bucket.Set(kDesignDocVersionKey, 0, migration.target); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	migration.lock.Lock()
+	old := migration.active
+	migration.active = migration.target
+	migration.oldViews = nil
+	migration.status.State = DesignDocsCurrent
+	migration.status.InUse = migration.target.String()
+	migration.status.LastError = ""
+	migration.status.FinishedAt = &now
+	migration.lock.Unlock()
+	base.Logf("Database %q switched to design docs %s", migration.context.Name, migration.target)
+
+	for _, ddocName := range builtInDesignDocs {
+		name := old.designDocName(ddocName)
+		if err := migration.context.Bucket.DeleteDDoc(name); err != nil && migration.designDocExists(name) {
+			base.Warn("Couldn't delete old design doc %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (migration *designDocMigration) stop() {
+	select {
+	case <-migration.terminator:
+	default:
+		close(migration.terminator)
+	}
+	<-migration.done
+}
+
+// Returns the name of the design doc to query a view of a built-in design doc in: the old
+// version's while the new one is building, unless the old one doesn't have that view.  Other
+// design docs' names are returned as is.
+func (context *DatabaseContext) DesignDocName(ddocName, viewName string) string {
+	migration := context.designDocs
+	if !isBuiltInDesignDoc(ddocName) {
+		return ddocName
+	}
+	migration.lock.RLock()
+	defer migration.lock.RUnlock()
+	if migration.active != migration.target && migration.oldViews[ddocName].Contains(viewName) {
+		return migration.active.designDocName(ddocName)
+	}
+	return migration.target.designDocName(ddocName)
+}
+
+// Returns the state of the database's design doc migration.
+func (context *DatabaseContext) DesignDocStatus() DesignDocStatus {
+	context.designDocs.lock.RLock()
+	defer context.designDocs.lock.RUnlock()
+	return context.designDocs.status
+}
@@ -0,0 +1,93 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/couchbase/sg-bucket"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func storedDesignDocVersion(t *testing.T, db *Database) (version designDocVersion) {
+	rawVersion, _, err := db.Bucket.GetRaw(kDesignDocVersionKey)
+	assertNoError(t, err, "GetRaw")
+	assertNoError(t, json.Unmarshal(rawVersion, &version), "Unmarshal")
+	return
+}
+
+func TestDesignDocVersionNewBucket(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	target := currentDesignDocVersion(db.UseXattrs())
+	assert.Equals(t, db.DesignDocStatus().State, DesignDocsCurrent)
+	assert.Equals(t, storedDesignDocVersion(t, db), target)
+	assert.Equals(t, db.DesignDocName(DesignDocSyncHousekeeping, ViewAllDocs), DesignDocSyncHousekeeping+"_"+target.String())
+	assert.Equals(t, db.DesignDocName("mine", "myview"), "mine")
+}
+
+func TestDesignDocMigration(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	target := currentDesignDocVersion(db.UseXattrs())
+
+	// Make the bucket look like it was set up before design docs were versioned, with an old
+	// housekeeping design doc that lacks the doc_states view:
+	legacy := sgbucket.DesignDoc{Views: sgbucket.ViewMap{
+		ViewAllDocs: sgbucket.ViewDef{Map: `function(doc, meta) {emit(meta.id, null);}`},
+	}}
+	assertNoError(t, db.Bucket.PutDDoc(DesignDocSyncHousekeeping, legacy), "PutDDoc")
+	assertNoError(t, db.Bucket.Delete(kDesignDocVersionKey), "Delete")
+
+	db.designDocs.stop()
+	migration, err := newDesignDocMigration(db.DatabaseContext)
+	assertNoError(t, err, "newDesignDocMigration")
+	db.designDocs = migration
+
+	// Until the new design docs are built, queries use the old ones, if they have the view:
+	status := db.DesignDocStatus()
+	assert.Equals(t, status.State, DesignDocsBuilding)
+	assert.Equals(t, status.InUse, "unversioned")
+	assert.Equals(t, status.Version, target.String())
+	assert.Equals(t, db.DesignDocName(DesignDocSyncHousekeeping, ViewAllDocs), DesignDocSyncHousekeeping)
+	assert.Equals(t, db.DesignDocName(DesignDocSyncHousekeeping, ViewDocStates), target.designDocName(DesignDocSyncHousekeeping))
+	assert.Equals(t, db.DesignDocName(DesignDocSyncGatewayChannels, ViewChannels), target.designDocName(DesignDocSyncGatewayChannels))
+
+	// Once they're built, queries switch to them and the old ones are deleted:
+	migration.start()
+	<-migration.done
+	status = db.DesignDocStatus()
+	assert.Equals(t, status.State, DesignDocsCurrent)
+	assert.Equals(t, status.InUse, target.String())
+	assert.True(t, status.FinishedAt != nil)
+	assert.Equals(t, db.DesignDocName(DesignDocSyncHousekeeping, ViewAllDocs), target.designDocName(DesignDocSyncHousekeeping))
+	assert.Equals(t, storedDesignDocVersion(t, db), target)
+	var ddoc sgbucket.DesignDoc
+	assert.True(t, db.Bucket.GetDDoc(DesignDocSyncHousekeeping, &ddoc) != nil)
+}
+
+func TestDesignDocVersionNewer(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	target := currentDesignDocVersion(db.UseXattrs())
+
+	// A newer gateway's design docs are left alone:
+	assertNoError(t, db.Bucket.Set(kDesignDocVersionKey, 0, designDocVersion{Version: DesignDocVersion + 1}), "Set")
+	db.designDocs.stop()
+	migration, err := newDesignDocMigration(db.DatabaseContext)
+	assertNoError(t, err, "newDesignDocMigration")
+	db.designDocs = migration
+	migration.start()
+	assert.Equals(t, db.DesignDocStatus().State, DesignDocsNewer)
+	assert.Equals(t, db.DesignDocName(DesignDocSyncHousekeeping, ViewAllDocs), target.designDocName(DesignDocSyncHousekeeping))
+	assert.Equals(t, storedDesignDocVersion(t, db).Version, DesignDocVersion+1)
+}
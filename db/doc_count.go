@@ -0,0 +1,339 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// The logical document counts of a database are kept up to date by the update path (and purges),
+// which records how each write changed them.  Each node adds its changes to the counts stored in
+// the bucket every kDocCountFlushInterval, and every kDocCountReconcileInterval recounts them with
+// a query, which corrects changes the gateway doesn't see (like docs expiring.)  So the counts may
+// be a little off between reconciliations, but they're cheap to read.  Only the node holding the
+// reconcile lease recounts, and it folds in the changes other nodes flushed during its query.
+
+// Key of the doc holding the database's document counts.
+const kDocCountsKey = KSyncKeyPrefix + "doc_counts"
+
+// Key of the doc recording which node reconciles the counts.
+const kDocCountsLeaseKey = KSyncKeyPrefix + "doc_counts_lease"
+
+const (
+	kDocCountFlushInterval     = 10 * time.Second // How often a node adds its count changes to the stored counts
+	kDocCountReconcileInterval = time.Hour        // How often the counts are recomputed by a query
+)
+
+var errDocCountsLeaseHeld = errors.New("doc counts lease is held by another node")
+
+// The contents of the reconcile lease doc.
+type docCountsLease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// Counts of a database's documents, excluding the gateway's own housekeeping docs.
+type DocStateCounts struct {
+	Docs       int64 `json:"doc_count"`       // Docs whose current revision isn't deleted
+	Tombstones int64 `json:"tombstone_count"` // Docs whose current revision is deleted
+	Conflicts  int64 `json:"conflict_count"`  // Docs in conflict, deleted or not
+}
+
+func (counts *DocStateCounts) add(delta DocStateCounts) {
+	counts.Docs += delta.Docs
+	counts.Tombstones += delta.Tombstones
+	counts.Conflicts += delta.Conflicts
+}
+
+func (counts *DocStateCounts) subtract(delta DocStateCounts) {
+	counts.add(DocStateCounts{-delta.Docs, -delta.Tombstones, -delta.Conflicts})
+}
+
+// The state of a doc, as far as the counts are concerned.
+type docState struct {
+	exists, deleted, conflict bool
+}
+
+func (s *syncData) docState() docState {
+	if s == nil || s.CurrentRev == "" {
+		return docState{}
+	}
+	return docState{
+		exists:   true,
+		deleted:  s.Flags&channels.Deleted != 0,
+		conflict: s.Flags&channels.Conflict != 0,
+	}
+}
+
+// The contribution of a doc in this state to the counts.
+func (state docState) counts() (counts DocStateCounts) {
+	if !state.exists {
+		return
+	}
+	if state.deleted {
+		counts.Tombstones = 1
+	} else {
+		counts.Docs = 1
+	}
+	if state.conflict {
+		counts.Conflicts = 1
+	}
+	return
+}
+
+// Keeps a database's document counts.
+type docCounter struct {
+	context    *DatabaseContext
+	owner      string // Identifies this node in the reconcile lease doc
+	lock       sync.Mutex
+	stored     DocStateCounts // The counts in the bucket, as of the last flush
+	pending    DocStateCounts // Changes made by this node since the last flush
+	ready      chan struct{}  // Closed once the counts have been loaded or computed
+	terminator chan struct{}  // Closed to stop the background task
+	done       chan struct{}  // Closed when the background task has stopped
+}
+
+func newDocCounter(context *DatabaseContext) *docCounter {
+	counter := &docCounter{
+		context:    context,
+		owner:      base.GenerateRandomSecret(),
+		ready:      make(chan struct{}),
+		terminator: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go counter.run()
+	return counter
+}
+
+// Loads the stored counts (or computes them, the first time), then flushes and reconciles them
+// periodically until stopped.
+func (counter *docCounter) run() {
+	defer close(counter.done)
+	var stored DocStateCounts
+	if rawCounts, _, err := counter.context.Bucket.GetRaw(kDocCountsKey); err == nil && json.Unmarshal(rawCounts, &stored) == nil {
+		counter.lock.Lock()
+		counter.stored = stored
+		counter.lock.Unlock()
+	} else if err := counter.reconcile(); err != nil {
+		base.Warn("Couldn't count the documents of database %q: %v", counter.context.Name, err)
+	}
+	close(counter.ready)
+
+	flushTicker := time.NewTicker(kDocCountFlushInterval)
+	defer flushTicker.Stop()
+	reconcileTicker := time.NewTicker(kDocCountReconcileInterval)
+	defer reconcileTicker.Stop()
+	for {
+		select {
+		case <-flushTicker.C:
+			if err := counter.flush(); err != nil {
+				base.Warn("Couldn't save the document counts of database %q: %v", counter.context.Name, err)
+			}
+		case <-reconcileTicker.C:
+			if err := counter.reconcile(); err != nil {
+				base.Warn("Couldn't count the documents of database %q: %v", counter.context.Name, err)
+			}
+		case <-counter.terminator:
+			return
+		}
+	}
+}
+
+// Records a write that changed a doc from one state to another.
+func (counter *docCounter) recordChange(before, after docState) {
+	if before == after {
+		return
+	}
+	delta := after.counts()
+	delta.subtract(before.counts())
+	counter.lock.Lock()
+	counter.pending.add(delta)
+	counter.lock.Unlock()
+}
+
+// Returns the current counts, or ok=false if they haven't been loaded yet.
+func (counter *docCounter) counts() (counts DocStateCounts, ok bool) {
+	select {
+	case <-counter.ready:
+	default:
+		return counts, false
+	}
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	counts = counter.stored
+	counts.add(counter.pending)
+	return counts, true
+}
+
+// Adds this node's changes to the counts stored in the bucket, also picking up the changes other
+// nodes have flushed.  The changes stay pending until they've been stored, so that a failed flush
+// leaves them to the next one, and nothing is counted twice.
+func (counter *docCounter) flush() error {
+	counter.lock.Lock()
+	delta := counter.pending
+	counter.lock.Unlock()
+
+	if delta == (DocStateCounts{}) {
+		// Nothing to add; just pick up the other nodes' changes
+		stored, err := counter.readStored()
+		if err != nil {
+			return err
+		}
+		counter.lock.Lock()
+		counter.stored = stored
+		counter.lock.Unlock()
+		return nil
+	}
+
+	var stored DocStateCounts
+	err := counter.context.Bucket.Update(kDocCountsKey, 0, func(current []byte) ([]byte, error) {
+		stored = DocStateCounts{}
+		if current != nil {
+			if err := json.Unmarshal(current, &stored); err != nil {
+				return nil, err
+			}
+		}
+		stored.add(delta)
+		return json.Marshal(stored)
+	})
+
+	if err != nil {
+		return err
+	}
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	counter.pending.subtract(delta)
+	counter.stored = stored
+	return nil
+}
+
+// Reads the counts stored in the bucket; zero if there aren't any yet.
+func (counter *docCounter) readStored() (stored DocStateCounts, err error) {
+	rawCounts, _, err := counter.context.Bucket.GetRaw(kDocCountsKey)
+	if base.IsDocNotFoundError(err) {
+		return stored, nil
+	} else if err == nil {
+		err = json.Unmarshal(rawCounts, &stored)
+	}
+	return stored, err
+}
+
+// Recomputes the counts with a query and stores them, unless another node holds the reconcile
+// lease.  The query includes the changes made before it, so this node's are dropped once its result
+// is stored, while the ones other nodes flush while it runs are added to its result.
+func (counter *docCounter) reconcile() error {
+	if held, err := counter.acquireLease(); err != nil || !held {
+		return err
+	}
+	before, err := counter.readStored()
+	if err != nil {
+		return err
+	}
+
+	counter.lock.Lock()
+	dropped := counter.pending
+	counter.lock.Unlock()
+
+	var stored DocStateCounts
+	counts, err := counter.context.querier.queryDocStates()
+	if err == nil {
+		err = counter.context.Bucket.Update(kDocCountsKey, 0, func(current []byte) ([]byte, error) {
+			// Be careful: this block can be invoked multiple times if there are races!
+			stored = counts
+			if current != nil {
+				var flushed DocStateCounts
+				if err := json.Unmarshal(current, &flushed); err != nil {
+					return nil, err
+				}
+				flushed.subtract(before)
+				stored.add(flushed)
+			}
+			return json.Marshal(stored)
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	counter.pending.subtract(dropped)
+	counter.stored = stored
+	return nil
+}
+
+// Takes or renews the reconcile lease, for twice the interval so that it doesn't lapse between
+// runs.  Returns false if another node holds it.
+func (counter *docCounter) acquireLease() (bool, error) {
+	duration := 2 * kDocCountReconcileInterval
+	err := counter.context.Bucket.Update(kDocCountsLeaseKey, base.DurationToCbsExpiry(duration), func(currentValue []byte) ([]byte, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		now := time.Now()
+		var lease docCountsLease
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &lease); err == nil && lease.Owner != counter.owner && now.Before(lease.Expires) {
+				return nil, errDocCountsLeaseHeld
+			}
+		}
+		return json.Marshal(docCountsLease{Owner: counter.owner, Expires: now.Add(duration)})
+	})
+	if err == errDocCountsLeaseHeld {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stops the background task, after flushing this node's changes.
+func (counter *docCounter) stop() {
+	close(counter.terminator)
+	<-counter.done
+	if err := counter.flush(); err != nil {
+		base.Warn("Couldn't save the document counts of database %q: %v", counter.context.Name, err)
+	}
+}
+
+// Returns the database's document counts, or ok=false if they haven't been loaded yet.
+func (context *DatabaseContext) DocStateCounts() (counts DocStateCounts, ok bool) {
+	return context.docCounts.counts()
+}
+
+// Reads the state of a doc, for the counts, without importing it.
+func (context *DatabaseContext) getDocState(docid string) docState {
+	if sync := context.peekSyncData(docid); sync != nil {
+		return sync.docState()
+	}
+	return docState{}
+}
+
+// Reads a doc's _sync metadata without importing it.  Returns nil if it can't be read.
+func (context *DatabaseContext) peekSyncData(docid string) *syncData {
+	if context.UseXattrs() {
+		var rawDoc, rawXattr []byte
+		if _, err := context.Bucket.GetWithXattr(docid, KSyncXattrName, &rawDoc, &rawXattr); err != nil || len(rawXattr) == 0 {
+			return nil
+		}
+		var sync syncData
+		if err := json.Unmarshal(rawXattr, &sync); err != nil {
+			return nil
+		}
+		return &sync
+	}
+	sync, err := context.GetDocSyncData(docid)
+	if err != nil {
+		return nil
+	}
+	return &sync
+}
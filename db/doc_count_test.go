@@ -0,0 +1,127 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func assertDocCounts(t *testing.T, db *Database, expected DocStateCounts) {
+	counts, ok := db.DocStateCounts()
+	assert.True(t, ok)
+	assert.DeepEquals(t, counts, expected)
+}
+
+func TestDocCounts(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	<-db.docCounts.ready
+	assertDocCounts(t, db, DocStateCounts{})
+
+	// Creates, updates and deletes:
+	rev1, err := db.Put("doc1", Body{"k": 1})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("doc1", Body{"k": 2, "_rev": rev1})
+	assertNoError(t, err, "Put")
+	rev1, err = db.Put("doc2", Body{"k": 1})
+	assertNoError(t, err, "Put")
+	assertDocCounts(t, db, DocStateCounts{Docs: 2})
+	_, err = db.DeleteDoc("doc2", rev1)
+	assertNoError(t, err, "DeleteDoc")
+	assertDocCounts(t, db, DocStateCounts{Docs: 1, Tombstones: 1})
+
+	// A conflict:
+	assertNoError(t, db.PutExistingRev("doc3", Body{"k": 1}, []string{"1-a"}), "PutExistingRev")
+	assertNoError(t, db.PutExistingRev("doc3", Body{"k": 2}, []string{"2-b", "1-a"}), "PutExistingRev")
+	assertNoError(t, db.PutExistingRev("doc3", Body{"k": 3}, []string{"2-c", "1-a"}), "PutExistingRev")
+	assertDocCounts(t, db, DocStateCounts{Docs: 2, Tombstones: 1, Conflicts: 1})
+
+	// Purges:
+	assertNoError(t, db.Purge("doc2"), "Purge")
+	assertDocCounts(t, db, DocStateCounts{Docs: 2, Conflicts: 1})
+
+	// The counts are stored, and recounting them gives the same result:
+	assertNoError(t, db.docCounts.flush(), "flush")
+	assert.DeepEquals(t, db.docCounts.pending, DocStateCounts{})
+	assertNoError(t, db.docCounts.reconcile(), "reconcile")
+	assertDocCounts(t, db, DocStateCounts{Docs: 2, Conflicts: 1})
+}
+
+func TestDocCountsFailedFlush(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	<-db.docCounts.ready
+
+	_, err := db.Put("doc1", Body{"k": 1})
+	assertNoError(t, err, "Put")
+
+	// A flush that fails leaves the change pending, and it's counted once:
+	assertNoError(t, db.Bucket.SetRaw(kDocCountsKey, 0, []byte("garbage")), "SetRaw")
+	assert.True(t, db.docCounts.flush() != nil)
+	assert.DeepEquals(t, db.docCounts.pending, DocStateCounts{Docs: 1})
+	assertDocCounts(t, db, DocStateCounts{Docs: 1})
+
+	// ...until a flush stores it:
+	assertNoError(t, db.Bucket.Delete(kDocCountsKey), "Delete")
+	assertNoError(t, db.docCounts.flush(), "flush")
+	assert.DeepEquals(t, db.docCounts.pending, DocStateCounts{})
+	assertDocCounts(t, db, DocStateCounts{Docs: 1})
+	var stored DocStateCounts
+	_, err = db.Bucket.Get(kDocCountsKey, &stored)
+	assertNoError(t, err, "Get counts")
+	assert.DeepEquals(t, stored, DocStateCounts{Docs: 1})
+}
+
+func TestDocCountsReconcile(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	<-db.docCounts.ready
+
+	_, err := db.Put("doc1", Body{"k": 1})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("doc2", Body{"k": 1})
+	assertNoError(t, err, "Put")
+
+	// A doc removed behind the gateway's back is only noticed by the reconciliation:
+	assertNoError(t, db.Bucket.Delete("doc2"), "Delete")
+	assertDocCounts(t, db, DocStateCounts{Docs: 2})
+	assertNoError(t, db.docCounts.reconcile(), "reconcile")
+	assertDocCounts(t, db, DocStateCounts{Docs: 1})
+}
+
+func TestDocCountsReconcileLease(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	<-db.docCounts.ready
+
+	_, err := db.Put("doc1", Body{"k": 1})
+	assertNoError(t, err, "Put")
+	assertNoError(t, db.docCounts.flush(), "flush")
+	assertNoError(t, db.Bucket.Delete("doc1"), "Delete")
+
+	// Another node holds the lease, so this one doesn't recount:
+	lease := docCountsLease{Owner: "other", Expires: time.Now().Add(time.Minute)}
+	assertNoError(t, db.Bucket.Set(kDocCountsLeaseKey, 0, lease), "Set lease")
+	assertNoError(t, db.docCounts.reconcile(), "reconcile")
+	assertDocCounts(t, db, DocStateCounts{Docs: 1})
+
+	// Once it has expired, this node takes it over:
+	lease.Expires = time.Now().Add(-time.Minute)
+	assertNoError(t, db.Bucket.Set(kDocCountsLeaseKey, 0, lease), "Set lease")
+	assertNoError(t, db.docCounts.reconcile(), "reconcile")
+	assertDocCounts(t, db, DocStateCounts{})
+	var stored DocStateCounts
+	_, err = db.Bucket.Get(kDocCountsKey, &stored)
+	assertNoError(t, err, "Get counts")
+	assert.DeepEquals(t, stored, DocStateCounts{})
+}
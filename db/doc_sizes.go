@@ -0,0 +1,115 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// The storage footprint of a document, in bytes.
+type DocSizes struct {
+	Body        int   `json:"body"`        // The current revision's JSON body, as stored
+	Attachments int64 `json:"attachments"` // The current revision's attachments, as stored (encoded, if they are)
+	Sync        int   `json:"sync"`        // The _sync metadata
+}
+
+func (sizes DocSizes) Total() int64 {
+	return int64(sizes.Body) + sizes.Attachments + int64(sizes.Sync)
+}
+
+// Returns the storage footprint of a document, with a single read of the doc.  If its body is
+// stored out of line, the sizes of the body and its attachments come from the doc's metadata, so
+// the body isn't read; attachments are never read, their sizes come from their metadata.
+func (context *DatabaseContext) GetDocSizes(docid string) (sizes DocSizes, err error) {
+	key := context.realDocID(docid)
+	if key == "" {
+		return sizes, base.HTTPErrorf(http.StatusBadRequest, "Invalid doc ID")
+	}
+
+	var rawBody, rawSync []byte
+	if context.UseXattrs() {
+		if _, err = context.Bucket.GetWithXattr(key, KSyncXattrName, &rawBody, &rawSync); err != nil {
+			return sizes, err
+		}
+	} else {
+		if rawBody, _, err = context.Bucket.GetRaw(key); err != nil {
+			return sizes, err
+		}
+		// The metadata is a property of the doc; only it is unmarshaled here, not the body:
+		var root struct {
+			Sync json.RawMessage `json:"_sync"`
+		}
+		if err = json.Unmarshal(rawBody, &root); err != nil {
+			return sizes, err
+		}
+		rawSync = root.Sync
+	}
+	if len(rawSync) == 0 {
+		return sizes, base.HTTPErrorf(http.StatusNotFound, "Not imported")
+	}
+
+	var sync struct {
+		BodyKey         string `json:"body_key"`
+		BodySize        int    `json:"body_size"`
+		AttachmentsSize int64  `json:"att_size"`
+	}
+	if err = json.Unmarshal(rawSync, &sync); err != nil {
+		return sizes, err
+	}
+	sizes.Sync = len(rawSync)
+	if sync.BodyKey != "" && sync.BodySize > 0 {
+		sizes.Body = sync.BodySize
+		sizes.Attachments = sync.AttachmentsSize
+		return sizes, nil
+	} else if sync.BodyKey != "" {
+		// Written before the sizes were kept in the metadata:
+		if rawBody, _, err = context.Bucket.GetRaw(sync.BodyKey); err != nil {
+			return sizes, err
+		}
+	}
+
+	sizes.Body = len(rawBody)
+	if !context.UseXattrs() && sync.BodyKey == "" {
+		// The stored body includes the "_sync" property; leave it (and its comma) out:
+		sizes.Body -= len(`"_sync":`) + len(rawSync)
+		if sizes.Body > len("{}") {
+			sizes.Body--
+		}
+	}
+	sizes.Attachments, err = attachmentsSize(rawBody)
+	return sizes, err
+}
+
+// Adds up the lengths in a JSON body's _attachments metadata.
+func attachmentsSize(rawBody []byte) (total int64, err error) {
+	if len(rawBody) == 0 {
+		return 0, nil // An xattr tombstone
+	}
+	var body struct {
+		Attachments map[string]struct {
+			Length        int64 `json:"length"`
+			EncodedLength int64 `json:"encoded_length"`
+		} `json:"_attachments"`
+	}
+	if err = json.Unmarshal(rawBody, &body); err != nil {
+		return 0, err
+	}
+	for _, meta := range body.Attachments {
+		if meta.EncodedLength > 0 {
+			total += meta.EncodedLength
+		} else {
+			total += meta.Length
+		}
+	}
+	return total, nil
+}
@@ -36,11 +36,19 @@ type syncData struct {
 	RecentSequences []uint64            `json:"recent_sequences,omitempty"` // recent sequences for this doc - used in server dedup handling
 	History         RevTree             `json:"history"`
 	Channels        channels.ChannelMap `json:"channels,omitempty"`
+	ChannelHistory  ChannelHistory      `json:"channel_history,omitempty"` // When the doc joined & left its current & past channels
 	Access          UserAccessMap       `json:"access,omitempty"`
 	RoleAccess      UserAccessMap       `json:"role_access,omitempty"`
 	Expiry          *time.Time          `json:"exp,omitempty"`           // Document expiry.  Information only - actual expiry/delete handling is done by bucket storage.  Needs to be pointer for omitempty to work (see https://github.com/golang/go/issues/4357)
 	Cas             string              `json:"cas"`                     // String representation of a cas value, populated via macro expansion
 	TombstonedAt    int64               `json:"tombstoned_at,omitempty"` // Time the document was tombstoned.  Used for view compaction
+	UpdatedBy       string              `json:"updated_by,omitempty"`    // Name of the user who wrote the current revision, empty for admin writes; each RevInfo has its own
+	Version         int                 `json:"ver,omitempty"`           // Version of the metadata's format; see SyncMetadataVersion1
+	BodyKey         string              `json:"body_key,omitempty"`      // Key of the current revision's body, if it's stored out of line
+	BodySize        int                 `json:"body_size,omitempty"`     // Length of the out-of-line body; see GetDocSizes
+	AttachmentsSize int64               `json:"att_size,omitempty"`      // Declared length of the out-of-line body's attachments
+	Operations      []operationRecord   `json:"ops,omitempty"`           // Revisions created by recent writes with operation IDs
+	SyncFnEpoch     string              `json:"sync_fn,omitempty"`       // Epoch of the sync function that computed the channels and access
 
 	// Fields used by bucket-shadowing:
 	UpstreamCAS *uint64 `json:"upstream_cas,omitempty"` // CAS value of remote doc
@@ -109,6 +117,9 @@ func UnmarshalDocumentSyncData(data []byte, needHistory bool) (*syncData, error)
 	if err := json.Unmarshal(data, &root); err != nil {
 		return nil, err
 	}
+	if err := root.SyncData.checkMetadataVersion(); err != nil {
+		return nil, err
+	}
 	if root.SyncData != nil && root.SyncData.Deleted_OLD {
 		root.SyncData.Deleted_OLD = false
 		root.SyncData.Flags |= channels.Deleted // Backward compatibility with old Deleted property
@@ -142,6 +153,9 @@ func UnmarshalDocumentSyncDataFromFeed(data []byte, dataType uint8, needHistory
 			if err != nil {
 				return nil, nil, err
 			}
+			if err = result.checkMetadataVersion(); err != nil {
+				return nil, nil, err
+			}
 			return result, body, nil
 		}
 	} else {
@@ -327,19 +341,25 @@ func (doc *document) UpdateExpiry(expiry uint32) {
 // Returns the set of channels that have changed (document joined or left in this revision)
 func (doc *document) updateChannels(newChannels base.Set) (changedChannels base.Set) {
 	var changed []string
+	doc.migrateChannelHistory()
+	curSequence := doc.Sequence
 	oldChannels := doc.Channels
+	wasInNoChannels := false
+	if removal, found := oldChannels[channels.NoChannels]; found && removal == nil {
+		wasInNoChannels = true
+	}
 	if oldChannels == nil {
 		oldChannels = channels.ChannelMap{}
 		doc.Channels = oldChannels
 	} else {
 		// Mark every no-longer-current channel as unsubscribed:
-		curSequence := doc.Sequence
 		for channel, removal := range oldChannels {
 			if removal == nil && !newChannels.Contains(channel) {
 				oldChannels[channel] = &channels.ChannelRemoval{
 					Seq:     curSequence,
 					RevID:   doc.CurrentRev,
 					Deleted: doc.hasFlag(channels.Deleted)}
+				doc.addChannelHistory(channel, curSequence, false)
 				changed = append(changed, channel)
 			}
 		}
@@ -349,9 +369,22 @@ func (doc *document) updateChannels(newChannels base.Set) (changedChannels base.
 	for channel := range newChannels {
 		if value, exists := oldChannels[channel]; value != nil || !exists {
 			oldChannels[channel] = nil
+			doc.addChannelHistory(channel, curSequence, true)
 			changed = append(changed, channel)
 		}
 	}
+
+	// A doc that was visible to users with "*" and is now in no channels is recorded as removed
+	// from "*", so that they're told about it like users of the channels it left.  The removal is
+	// dropped once the doc is back in "*".
+	if !newChannels.Contains(channels.NoChannels) {
+		delete(oldChannels, channels.UserStarChannel)
+	} else if !wasInNoChannels && len(doc.History) > 1 {
+		oldChannels[channels.UserStarChannel] = &channels.ChannelRemoval{
+			Seq:     curSequence,
+			RevID:   doc.CurrentRev,
+			Deleted: doc.hasFlag(channels.Deleted)}
+	}
 	if changed != nil {
 		base.LogTo("CRUD", "\tDoc %q in channels %q", doc.ID, newChannels)
 		changedChannels = channels.SetOf(changed...)
@@ -359,12 +392,17 @@ func (doc *document) updateChannels(newChannels base.Set) (changedChannels base.
 	return
 }
 
-// Updates a document's channel/role UserAccessMap with new access settings from an AccessMap.
+// Updates a document's channel/role UserAccessMap with new access settings from an AccessMap, and
+// the expiry times of its time-limited grants.
 // Returns an array of the user/role names whose access has changed as a result.
-func (accessMap *UserAccessMap) updateAccess(doc *document, newAccess channels.AccessMap) (changedUsers []string) {
+func (accessMap *UserAccessMap) updateAccess(doc *document, newAccess channels.AccessMap, expiries channels.AccessExpiryMap) (changedUsers []string) {
 	// Update users already appearing in doc.Access:
 	for name, access := range *accessMap {
-		if access.UpdateAtSequence(newAccess[name], doc.Sequence) {
+		changed := access.UpdateAtSequence(newAccess[name], doc.Sequence)
+		if access.UpdateExpiry(expiries[name]) {
+			changed = true
+		}
+		if changed {
 			if len(access) == 0 {
 				delete(*accessMap, name)
 			}
@@ -377,7 +415,9 @@ func (accessMap *UserAccessMap) updateAccess(doc *document, newAccess channels.A
 			if *accessMap == nil {
 				*accessMap = UserAccessMap{}
 			}
-			(*accessMap)[name] = channels.AtSequence(access, doc.Sequence)
+			timedAccess := channels.AtSequence(access, doc.Sequence)
+			timedAccess.UpdateExpiry(expiries[name])
+			(*accessMap)[name] = timedAccess
 			changedUsers = append(changedUsers, name)
 		}
 	}
@@ -408,6 +448,9 @@ func (doc *document) UnmarshalJSON(data []byte) error {
 		return err
 	}
 	if root.SyncData != nil {
+		if err := root.SyncData.checkMetadataVersion(); err != nil {
+			return err
+		}
 		doc.syncData = *root.SyncData
 	}
 
@@ -421,7 +464,7 @@ func (doc *document) UnmarshalJSON(data []byte) error {
 
 func (doc *document) MarshalJSON() ([]byte, error) {
 	body := doc.body
-	if body == nil {
+	if body == nil || doc.BodyKey != "" {
 		body = Body{}
 	}
 	body["_sync"] = &doc.syncData
@@ -441,6 +484,9 @@ func (doc *document) UnmarshalWithXattr(data []byte, xdata []byte) error {
 	if err := json.Unmarshal(xdata, &doc.syncData); err != nil {
 		return err
 	}
+	if err := doc.checkMetadataVersion(); err != nil {
+		return err
+	}
 	// Unmarshal document body, if present
 	if len(data) > 0 {
 		return doc.unmarshalBody(data)
@@ -457,6 +503,9 @@ func (doc *document) UnmarshalWithXattr(data []byte, xdata []byte) error {
 func (doc *document) MarshalWithXattr() (data []byte, xdata []byte, err error) {
 
 	body := doc.body
+	if doc.BodyKey != "" {
+		body = Body{} // The body is stored out of line
+	}
 	// If body is non-empty and non-deleted, unmarshal and return
 	if body != nil {
 		deleted, _ := body["_deleted"].(bool)
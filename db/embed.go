@@ -0,0 +1,70 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// OpenDatabase and NewDatabaseForUser are the supported way for another Go program (like a bulk
+// migration tool) to use a database directly, with the same sync function, channel and access
+// semantics as the gateway, but without its REST API.  The lifecycle is:
+//
+//	context, err := db.OpenDatabase(spec, db.DatabaseContextOptions{})
+//	defer context.Close()
+//	context.UpdateSyncFun(syncFn)
+//	database, err := db.NewDatabaseForUser(context, "naomi")  // or CreateDatabase(context), as an admin
+//	database.Put(docid, body)
+//
+// A DatabaseContext is safe to share between goroutines; a Database isn't.  Close stops the
+// bucket's mutation feed and the change cache, saves the doc counts, and closes the bucket, so
+// call it once, when nothing is using the database any more.  TestOpenDatabase covers this API,
+// so changes that would break programs using it show up there.
+
+// Connects to the bucket a spec describes (retrying for a while if it's unreachable), installs the
+// gateway's views in it, and returns a database on it named after the bucket.  The zero value of
+// DatabaseContextOptions gives the gateway's defaults.  The database has no sync function until
+// UpdateSyncFun is called, so it uses the default one that assigns docs to doc.channels.
+func OpenDatabase(spec base.BucketSpec, options DatabaseContextOptions) (*DatabaseContext, error) {
+	if err := ValidateDatabaseName(spec.BucketName); err != nil {
+		return nil, err
+	}
+	if options.CacheOptions == nil {
+		options.CacheOptions = &CacheOptions{}
+	}
+	bucket, err := ConnectToBucket(spec, func(bucket string, err error) {
+		base.Warn("Embedded database %q lost its mutation feed: %v", bucket, err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	context, err := NewDatabaseContext(spec.BucketName, bucket, false, options)
+	if err != nil {
+		bucket.Close()
+		return nil, err
+	}
+	context.BucketSpec = spec
+	return context, nil
+}
+
+// Returns a Database that acts as the named user, so that its reads and writes are limited to
+// what the user has access to, as if they were made through the public REST API.  The name ""
+// is the guest user.  Use CreateDatabase for a Database with admin access.
+func NewDatabaseForUser(context *DatabaseContext, username string) (*Database, error) {
+	user, err := context.Authenticator().GetUser(username)
+	if err != nil {
+		return nil, err
+	} else if user == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "No such user %q", username)
+	}
+	return GetDatabase(context, user)
+}
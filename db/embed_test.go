@@ -0,0 +1,93 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"log"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Keeps the embedding API working the way programs using it expect.
+func TestOpenDatabase(t *testing.T) {
+	if !base.UnitTestUrlIsWalrus() {
+		t.Skip("Opens its own walrus bucket")
+	}
+	context, err := OpenDatabase(base.BucketSpec{Server: base.UnitTestUrl(), BucketName: "embedded"}, DatabaseContextOptions{})
+	assertNoError(t, err, "OpenDatabase")
+	defer context.Close()
+	assert.Equals(t, context.Name, "embedded")
+	_, err = context.UpdateSyncFun(`function(doc) {channel(doc.channels);}`)
+	assertNoError(t, err, "UpdateSyncFun")
+
+	authenticator := context.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC"))
+	assertNoError(t, authenticator.Save(user), "Save")
+	_, err = NewDatabaseForUser(context, "nobody")
+	assertHTTPError(t, err, 404)
+
+	admin, err := CreateDatabase(context)
+	assertNoError(t, err, "CreateDatabase")
+	_, err = admin.Put("doc1", Body{"channels": []string{"ABC"}})
+	assertNoError(t, err, "Put")
+	_, err = admin.Put("doc2", Body{"channels": []string{"PBS"}})
+	assertNoError(t, err, "Put")
+	context.changeCache.waitForSequence(2)
+
+	// The user only sees the docs in their channels:
+	database, err := NewDatabaseForUser(context, "naomi")
+	assertNoError(t, err, "NewDatabaseForUser")
+	_, err = database.GetRev("doc1", "", false, nil)
+	assertNoError(t, err, "GetRev")
+	_, err = database.GetRev("doc2", "", false, nil)
+	assertHTTPError(t, err, 403)
+	changes, err := database.GetChanges(base.SetOf("*"), ChangesOptions{Since: SequenceID{Seq: 0}})
+	assertNoError(t, err, "GetChanges")
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "doc1")
+}
+
+func ExampleOpenDatabase() {
+	spec := base.BucketSpec{Server: "http://localhost:8091", PoolName: "default", BucketName: "travel"}
+	context, err := OpenDatabase(spec, DatabaseContextOptions{})
+	if err != nil {
+		log.Fatalf("Couldn't open the database: %v", err)
+	}
+	defer context.Close()
+	if _, err := context.UpdateSyncFun(`function(doc) {channel(doc.channels);}`); err != nil {
+		log.Fatalf("Invalid sync function: %v", err)
+	}
+
+	// Write as an admin, so the sync function assigns the doc's channels with no access checks:
+	admin, _ := CreateDatabase(context)
+	if _, err := admin.Put("hotel1", Body{"channels": []string{"hotels"}}); err != nil {
+		log.Printf("Couldn't migrate hotel1: %v", err)
+	}
+}
+
+func ExampleNewDatabaseForUser() {
+	context, err := OpenDatabase(base.BucketSpec{Server: "http://localhost:8091", BucketName: "travel"}, DatabaseContextOptions{})
+	if err != nil {
+		log.Fatalf("Couldn't open the database: %v", err)
+	}
+	defer context.Close()
+
+	// Reads are limited to the channels the user has access to:
+	database, err := NewDatabaseForUser(context, "naomi")
+	if err != nil {
+		log.Fatalf("Couldn't load the user: %v", err)
+	}
+	if _, err := database.Get("hotel1"); err != nil {
+		log.Printf("naomi can't read hotel1: %v", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/robertkrimen/otto"
 )
 
@@ -70,7 +71,6 @@ func (dsce *DBStateChangeEvent) EventType() EventType {
 }
 
 // Javascript function handling for events
-const kTaskCacheSize = 4
 
 type ResponseType uint8
 
@@ -118,16 +118,17 @@ func newJsEventTask(funcSource string) (sgbucket.JSServerTask, error) {
 
 //////// JSEventFunction
 
-// A thread-safe wrapper around a jsEventTask, i.e. an event function.
+// A thread-safe wrapper around a jsEventTask, i.e. an event function.  Like the other JS
+// functions, it runs on the shared JS runner pool.
 type JSEventFunction struct {
-	*sgbucket.JSServer
+	*channels.JSFunction
 }
 
 func NewJSEventFunction(fnSource string) *JSEventFunction {
 
 	base.LogTo("Events", "Creating new JSEventFunction")
 	return &JSEventFunction{
-		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
+		JSFunction: channels.NewJSFunction("event", fnSource,
 			func(fnSource string) (sgbucket.JSServerTask, error) {
 				return newJsEventTask(fnSource)
 			}),
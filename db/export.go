@@ -0,0 +1,159 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// One line of a database export, which is a stream of these as newline-delimited JSON.  A doc line
+// has the current revision of a document; an attachment line (from an attachment export) has
+// the data of an attachment that doc lines refer to by digest.
+type ExportLine struct {
+	Seq      uint64   `json:"seq,omitempty"`      // The doc's sequence in the exported database; resume an export after it
+	ID       string   `json:"id,omitempty"`       // Doc ID
+	Rev      string   `json:"rev,omitempty"`      // Current revision ID
+	Deleted  bool     `json:"deleted,omitempty"`  // True if the current revision is a tombstone
+	Channels []string `json:"channels,omitempty"` // Channels of the current revision
+	Body     Body     `json:"body,omitempty"`     // Revision body, with its _revisions history and _attachments
+	Digest   string   `json:"digest,omitempty"`   // Attachment line: the attachment's digest
+	Data     []byte   `json:"data,omitempty"`     // Attachment line: the attachment's data, base64-encoded in JSON
+}
+
+type ExportOptions struct {
+	Since             uint64 // Only export docs changed after this sequence
+	Limit             int    // Max number of docs to export; 0 for no limit
+	InlineAttachments bool   // Put attachment data in the docs' _attachments, instead of stubs
+	AttachmentsOnly   bool   // Export attachment lines for the docs' stub attachments, instead of doc lines
+}
+
+// Exports the current revision of each document changed since options.Since, in sequence order,
+// passing each line to the callback.  An export can be resumed after an interruption by exporting
+// again since the Seq of the last line received.  An attachment export covers the same docs, and
+// has a line for each distinct attachment of their current revisions.  Admin only.
+func (db *Database) Export(options ExportOptions, callback func(*ExportLine) error) error {
+	if db.user != nil {
+		return base.HTTPErrorf(http.StatusForbidden, "Only admins can export a database")
+	}
+	terminator := make(chan bool)
+	defer close(terminator)
+	feed, err := db.MultiChangesFeed(base.SetOf(channels.UserStarChannel), ChangesOptions{
+		Since:      SequenceID{Seq: options.Since},
+		Limit:      options.Limit,
+		Terminator: terminator,
+	})
+	if err != nil {
+		return err
+	}
+
+	exportedDigests := map[string]bool{}
+	for entry := range feed {
+		if entry.Err != nil {
+			return entry.Err
+		}
+		line, err := db.exportDoc(entry.ID, options.InlineAttachments)
+		if base.IsDocNotFoundError(err) {
+			continue // purged since the change
+		} else if err != nil {
+			return err
+		}
+		line.Seq = entry.Seq.Seq
+
+		if !options.AttachmentsOnly {
+			if err := callback(line); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, value := range BodyAttachments(line.Body) {
+			meta, _ := value.(map[string]interface{})
+			digest, ok := Body(meta).GetString("digest")
+			if !ok || exportedDigests[digest] {
+				continue
+			}
+			data, err := db.GetAttachment(AttachmentKey(digest))
+			if err != nil {
+				db.LogContext.Warn("Export: can't read attachment %s of doc %q: %v", digest, line.ID, err)
+				continue
+			}
+			exportedDigests[digest] = true
+			if err := callback(&ExportLine{Seq: line.Seq, Digest: digest, Data: data}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the export line of a document's current revision.
+func (db *Database) exportDoc(docid string, inlineAttachments bool) (*ExportLine, error) {
+	doc, err := db.GetDoc(docid)
+	if doc == nil {
+		if err == nil {
+			err = base.HTTPErrorf(http.StatusNotFound, "missing")
+		}
+		return nil, err
+	}
+	revid := doc.CurrentRev
+	body, err := db.getRevision(doc, revid)
+	if err != nil {
+		return nil, err
+	}
+	deleted := doc.hasFlag(channels.Deleted)
+	if deleted {
+		body["_deleted"] = true
+	}
+	body["_revisions"] = encodeRevisions(doc.History.getHistory(revid))
+	if inlineAttachments && len(BodyAttachments(body)) > 0 {
+		if body, err = db.loadBodyAttachments(body, 1); err != nil {
+			return nil, err
+		}
+	}
+	chans := doc.History[revid].Channels.ToArray()
+	sort.Strings(chans)
+	return &ExportLine{ID: docid, Rev: revid, Deleted: deleted, Channels: chans, Body: body}, nil
+}
+
+// Writes a line of an export to the database.  A doc line's revision is added with its history,
+// as with new_edits=false, so it keeps its rev ID but gets a new sequence; added is false if the
+// database already had it.  An attachment line's data is stored, if it matches its digest.
+// The channels of a doc line are ignored; the sync function assigns them.
+func (db *Database) ImportExportLine(line *ExportLine) (added bool, err error) {
+	if line.Digest != "" {
+		if line.ID != "" {
+			return false, base.HTTPErrorf(http.StatusBadRequest, "Invalid attachment line")
+		} else if sha1DigestKey(line.Data) != line.Digest {
+			return false, base.HTTPErrorf(http.StatusBadRequest, "Attachment data doesn't match digest %s", line.Digest)
+		}
+		_, err = db.setAttachment(line.Data)
+		return err == nil, err
+	}
+
+	if line.ID == "" || line.Body == nil {
+		return false, base.HTTPErrorf(http.StatusBadRequest, "Line has no doc ID or body")
+	}
+	if err = db.ValidateDocID(line.ID); err != nil {
+		return false, err
+	}
+	history := ParseRevisions(line.Body)
+	if history == nil {
+		return false, base.HTTPErrorf(http.StatusBadRequest, "Bad _revisions")
+	} else if line.Rev != "" && history[0] != line.Rev {
+		return false, base.HTTPErrorf(http.StatusBadRequest, "Body's _revisions doesn't start with rev %s", line.Rev)
+	}
+	if line.Deleted {
+		line.Body["_deleted"] = true
+	}
+	return db.PutExistingRevIfNew(line.ID, line.Body, history)
+}
@@ -0,0 +1,88 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/robertkrimen/otto"
+)
+
+// A compiled JavaScript import filter function.
+type jsImportFilterTask struct {
+	sgbucket.JSRunner
+}
+
+func newJsImportFilterTask(funcSource string) (sgbucket.JSServerTask, error) {
+	task := &jsImportFilterTask{}
+	if err := task.Init(funcSource); err != nil {
+		return nil, err
+	}
+	task.After = func(result otto.Value, err error) (interface{}, error) {
+		nativeValue, _ := result.Export()
+		return nativeValue, err
+	}
+	return task, nil
+}
+
+//////// ImportFilterFunction
+
+// A thread-safe wrapper around an import filter: a JavaScript function that's given the body of a
+// document written directly to the bucket (not through Sync Gateway), and returns true if the
+// document should be imported.
+type ImportFilterFunction struct {
+	*channels.JSFunction
+}
+
+func NewImportFilterFunction(fnSource string) *ImportFilterFunction {
+	base.LogTo("Import", "Creating new ImportFilterFunction")
+	return &ImportFilterFunction{
+		JSFunction: channels.NewJSFunction("import", fnSource,
+			func(fnSource string) (sgbucket.JSServerTask, error) {
+				return newJsImportFilterTask(fnSource)
+			}),
+	}
+}
+
+// Calls the filter function on a document body.
+func (f *ImportFilterFunction) EvaluateFunction(body Body) (bool, error) {
+	result, err := f.Call(body)
+	if err != nil {
+		return false, err
+	}
+	switch result := result.(type) {
+	case bool:
+		return result, nil
+	default:
+		return false, fmt.Errorf("Import filter function returned non-boolean value %v", result)
+	}
+}
+
+// Returns true if a document written directly to the bucket should be imported, according to the
+// database's import filter (if any).  A filter that fails counts as rejecting the document.
+func (context *DatabaseContext) shouldImport(docid string, body Body) bool {
+	filter := context.GetOptions().ImportFilter
+	if filter == nil {
+		return true
+	}
+	shouldImport, err := filter.EvaluateFunction(body)
+	if err != nil {
+		base.Warn("Error calling import filter on doc %q - not importing it: %v", docid, err)
+		shouldImport = false
+	}
+	if !shouldImport {
+		dbExpvars.Add("import_filter_rejections", 1)
+		base.LogTo("Import+", "Doc %q rejected by import filter", docid)
+	}
+	return shouldImport
+}
@@ -48,11 +48,19 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 		var addedChannels base.Set // Tracks channels added to the user during changes processing.
 		var userChanged bool       // Whether the user document has changed
 
+		var grantExpiryTimer *time.Timer // Wakes the changeWaiter when a time-limited grant expires
+		defer func() {
+			if grantExpiryTimer != nil {
+				grantExpiryTimer.Stop()
+			}
+		}()
+
 		// Restrict to available channels, expand wild-card, and find since when these channels
 		// have been available to the user:
 		var channelsSince, secondaryTriggers channels.TimedSet
 		if db.user != nil {
 			channelsSince, secondaryTriggers = db.user.FilterToAvailableChannelsForSince(chans, getChangesClock(options.Since))
+			channelsSince = db.expandPrefixGrants(channelsSince)
 		} else {
 			channelsSince = channels.AtSequence(chans, 0)
 		}
@@ -72,6 +80,7 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 					base.Warn("Error reloading user during changes initialization %q: %v", db.user.Name(), err)
 					return
 				}
+				grantExpiryTimer = db.scheduleGrantExpiryNotification(grantExpiryTimer)
 			}
 		}
 
@@ -154,8 +163,15 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 					continue
 				}
 
-				// Add the doc body or the conflicting rev IDs, if those options are set:
-				if options.IncludeDocs || options.Conflicts {
+				// Apply the filter function, if any, which also adds the doc body or the conflicting
+				// rev IDs; otherwise add those if the options are set:
+				if options.Filter != nil {
+					if !db.filterChangeEntry(minEntry, options) {
+						// Left out, but the clock still moves past it
+						cumulativeClock.SetMaxSequence(minEntry.Seq.vbNo, minEntry.Seq.Seq)
+						continue
+					}
+				} else if options.IncludeDocs || options.Conflicts {
 					db.addDocToChangeEntry(minEntry, options)
 				}
 
@@ -259,10 +275,12 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 			userChanged, userCounter, addedChannels, err = db.checkForUserUpdatesSince(userCounter, changeWaiter, options.Continuous, channelsSince, options.Since.Clock)
 			if userChanged && db.user != nil {
 				channelsSince, secondaryTriggers = db.user.FilterToAvailableChannelsForSince(chans, getChangesClock(options.Since))
+				channelsSince = db.expandPrefixGrants(channelsSince)
+				grantExpiryTimer = db.scheduleGrantExpiryNotification(grantExpiryTimer)
 			}
 			if err != nil {
-				change := makeErrorEntry("User not found during reload - terminating changes feed")
-				base.LogTo("Changes+", "User not found during reload - terminating changes feed with entry %+v", change)
+				change := makeUserReloadErrorEntry(err)
+				base.LogTo("Changes+", "Terminating changes feed with entry %+v", change)
 				output <- &change
 				return
 			}
@@ -287,6 +305,9 @@ func (db *Database) checkForUserUpdatesSince(userChangeCount uint64, changeWaite
 				base.Warn("Error reloading user %q: %v", db.user.Name(), err)
 				return false, 0, nil, err
 			}
+			if db.user.Disabled() {
+				return false, 0, nil, errUserDisabled
+			}
 			// check whether channels have changed
 			newChannels = base.Set{}
 			currentChannels, _ := db.user.InheritedChannelsForClock(since)
@@ -308,7 +329,7 @@ func (db *Database) checkForUserUpdatesSince(userChangeCount uint64, changeWaite
 func (db *Database) startChangeWaiterSince(chans base.Set, since base.SequenceClock) *changeWaiter {
 	waitChans := chans
 	if db.user != nil {
-		waitChans = db.user.ExpandWildCardChannelSince(chans, since)
+		waitChans = channels.ExpandingPrefixGrants(db.user.ExpandWildCardChannelSince(chans, since), db.changeCache.KnownChannels())
 	}
 	return db.tapListener.NewWaiterWithChannels(waitChans, db.user)
 }
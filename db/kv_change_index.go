@@ -182,6 +182,10 @@ func (k *kvChangeIndex) DocChanged(event sgbucket.TapEvent) {
 
 // No-ops - pending refactoring of change_cache.go to remove usage (or deprecation of
 // change_cache altogether)
+func (k *kvChangeIndex) KnownChannels() base.Set {
+	return k.reader.knownChannels()
+}
+
 func (k *kvChangeIndex) getOldestSkippedSequence() uint64 {
 	return uint64(0)
 }
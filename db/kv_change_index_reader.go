@@ -350,6 +350,17 @@ func (k *kvChangeIndexReader) newChannelReader(channelName string) (*KvChannelIn
 	return k.channelIndexReaders[channelName], nil
 }
 
+// Returns the names of the channels that currently have a reader.
+func (k *kvChangeIndexReader) knownChannels() base.Set {
+	k.channelIndexReaderLock.RLock()
+	defer k.channelIndexReaderLock.RUnlock()
+	names := make([]string, 0, len(k.channelIndexReaders))
+	for name := range k.channelIndexReaders {
+		names = append(names, name)
+	}
+	return base.SetFromArray(names)
+}
+
 // TODO: If mutex read lock is too much overhead every time we poll, could manage numReaders using
 // atomic uint64
 func (k *kvChangeIndexReader) hasActiveReaders() bool {
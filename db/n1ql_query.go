@@ -0,0 +1,389 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// N1QL query settings of a database.
+type N1QLConfig struct {
+	Enabled           bool `json:"enabled"`                       // Use N1QL queries of GSI indexes, instead of views, for channel, _all_docs and access queries
+	VerifyIndexesOnly bool `json:"verify_indexes_only,omitempty"` // Don't create the GSI indexes; just fail at startup if any of them isn't online
+}
+
+const (
+	kN1QLSyncToken     = "$sync"  // Replaced by the path of the _sync metadata in N1QL statements
+	kN1QLIDToken       = "$id"    // Replaced by the doc ID expression in N1QL statements
+	kN1QLKeyspaceAlias = "sgb"    // Alias of the bucket in N1QL queries
+	kN1QLIndexOnline   = "online" // system:indexes state of an index that's ready
+	kN1QLIndexWaitTime = time.Minute
+)
+
+// A GSI index used by the N1QL queries.
+type n1qlIndex struct {
+	name   string
+	keys   string // The index keys
+	filter string // The index's WHERE condition, if any
+}
+
+var n1qlIndexes = []n1qlIndex{
+	{
+		name: "sg_channels",
+		keys: "ALL ARRAY [op.name, LEAST($sync.sequence, op.val.seq)] FOR op IN OBJECT_PAIRS($sync.channels) END",
+	},
+	{
+		name:   "sg_sequence",
+		keys:   "$sync.sequence",
+		filter: "$sync.sequence IS NOT MISSING",
+	},
+	{
+		name:   "sg_all_docs",
+		keys:   "$id",
+		filter: "$sync.sequence IS NOT MISSING",
+	},
+	{
+		name:   "sg_principals",
+		keys:   "$id",
+		filter: n1qlPrincipalsFilter,
+	},
+	{
+		name: "sg_access",
+		keys: "DISTINCT ARRAY name FOR name IN OBJECT_NAMES($sync.access) END",
+	},
+	{
+		name: "sg_role_access",
+		keys: "DISTINCT ARRAY name FOR name IN OBJECT_NAMES($sync.role_access) END",
+	},
+}
+
+var n1qlPrincipalsFilter = fmt.Sprintf("$id LIKE %q OR $id LIKE %q",
+	n1qlLikePrefix(auth.UserKeyPrefix), n1qlLikePrefix(auth.RoleKeyPrefix))
+
+const (
+	n1qlChannelQuery = `SELECT $id AS id, $sync.rev AS rev, $sync.flags AS flags, $sync.deleted AS deleted,
+	                           $sync.sequence AS seq, $sync.channels.[$channel] AS removal
+	                    FROM ` + base.KeyspaceToken + ` AS ` + kN1QLKeyspaceAlias + `
+	                    WHERE ANY op IN OBJECT_PAIRS($sync.channels)
+	                          SATISFIES [op.name, LEAST($sync.sequence, op.val.seq)] BETWEEN $startKey AND $endKey END
+	                    ORDER BY LEAST($sync.sequence, $sync.channels.[$channel].seq)`
+
+	n1qlStarChannelQuery = `SELECT $id AS id, $sync.rev AS rev, $sync.flags AS flags, $sync.deleted AS deleted,
+	                               $sync.sequence AS seq, $sync.channels.["*"] AS removal
+	                        FROM ` + base.KeyspaceToken + ` AS ` + kN1QLKeyspaceAlias + `
+	                        WHERE $sync.sequence IS NOT MISSING AND $sync.sequence >= $startSeq
+	                              AND (IFMISSING($sync.channels.["` + channels.NoChannels + `"], true) IS NOT NULL
+	                                   OR $sync.channels.["*"].seq >= $startSeq)`
+
+	n1qlAllDocsQuery = `SELECT $id AS id, $sync.rev AS rev, $sync.sequence AS seq,
+	                           ARRAY op.name FOR op IN OBJECT_PAIRS($sync.channels) WHEN op.val IS NULL END AS channels
+	                    FROM ` + base.KeyspaceToken + ` AS ` + kN1QLKeyspaceAlias + `
+	                    WHERE $sync.sequence IS NOT MISSING AND $id >= $startKey
+	                          AND IFMISSINGORNULL($sync.flags, 0) % 2 = 0 AND IFMISSINGORNULL($sync.deleted, false) = false`
+
+	n1qlPrincipalsQuery = `SELECT RAW $id FROM ` + base.KeyspaceToken + ` AS ` + kN1QLKeyspaceAlias + `
+	                       WHERE `
+
+	n1qlAccessQuery = `SELECT RAW $sync.%[1]s.[$principal] FROM ` + base.KeyspaceToken + ` AS ` + kN1QLKeyspaceAlias + `
+	                   WHERE ANY name IN OBJECT_NAMES($sync.%[1]s) SATISFIES name = $principal END`
+
+	n1qlDocStatesQuery = `SELECT COUNT(*) AS total,
+	                             SUM(CASE WHEN IFMISSINGORNULL($sync.flags, 0) % 2 = 1 OR IFMISSINGORNULL($sync.deleted, false) THEN 1 ELSE 0 END) AS tombstones,
+	                             SUM(CASE WHEN FLOOR(IFMISSINGORNULL($sync.flags, 0) / 8) % 2 = 1 THEN 1 ELSE 0 END) AS conflicts
+	                      FROM ` + base.KeyspaceToken + ` AS ` + kN1QLKeyspaceAlias + `
+	                      WHERE $sync.sequence IS NOT MISSING`
+)
+
+// Makes a database's index queries with N1QL, using GSI indexes.
+type n1qlQuerier struct {
+	bucket   base.N1QLBucket
+	syncPath string // N1QL path of the _sync metadata, relative to the bucket
+}
+
+// Returns the N1QL path of the _sync metadata, relative to the bucket.
+func n1qlSyncPath(useXattrs bool) string {
+	if useXattrs {
+		return "META().xattrs.`" + KSyncXattrName + "`"
+	}
+	return "`_sync`"
+}
+
+// Escapes a doc ID prefix for a N1QL LIKE pattern.
+func n1qlLikePrefix(prefix string) string {
+	return strings.Replace(prefix, "_", `\_`, -1) + "%"
+}
+
+// Expands the tokens in a N1QL statement.  In index definitions the paths are relative to the
+// bucket; in queries they're relative to the bucket's alias.
+func (q *n1qlQuerier) expand(statement string, inQuery bool) string {
+	syncPath, idExpr := q.syncPath, "META().id"
+	if inQuery {
+		if strings.HasPrefix(syncPath, "META()") {
+			syncPath = "META(" + kN1QLKeyspaceAlias + ")" + syncPath[len("META()"):]
+		} else {
+			syncPath = kN1QLKeyspaceAlias + "." + syncPath
+		}
+		idExpr = "META(" + kN1QLKeyspaceAlias + ").id"
+	}
+	statement = strings.Replace(statement, kN1QLSyncToken, syncPath, -1)
+	return strings.Replace(statement, kN1QLIDToken, idExpr, -1)
+}
+
+// Runs a query as a prepared statement, calling `each` until it returns false.  The query waits
+// for the indexes to include all earlier mutations, like a view query with stale=false.
+func (q *n1qlQuerier) query(statement string, params map[string]interface{}, each func(results base.N1QLQueryResults) bool) error {
+	results, err := q.bucket.Query(q.expand(statement, true), params, true, false)
+	if err != nil {
+		return err
+	}
+	for each(results) {
+	}
+	return results.Close()
+}
+
+// Runs an adhoc statement, such as DDL, returning its first row (if any) in result.
+func (q *n1qlQuerier) exec(statement string, params map[string]interface{}, result interface{}) error {
+	results, err := q.bucket.Query(statement, params, false, true)
+	if err != nil {
+		return err
+	}
+	if result != nil {
+		results.Next(result)
+	}
+	return results.Close()
+}
+
+// Checks that N1QL is available, then creates the GSI indexes (unless verifyOnly) and waits until
+// they're online.  Fails if N1QL or any index isn't available, so that a database configured to
+// use N1QL doesn't start on a cluster that can't serve its queries.
+func (q *n1qlQuerier) initIndexes(verifyOnly bool) error {
+	if err := q.exec("SELECT RAW 1", nil, nil); err != nil {
+		return fmt.Errorf("N1QL queries are unavailable on bucket %q; they need a query node and a cluster whose nodes all run Couchbase Server 5.0 or later: %v", q.bucket.GetName(), err)
+	}
+
+	for _, index := range n1qlIndexes {
+		if !verifyOnly {
+			statement := fmt.Sprintf("CREATE INDEX `%s` ON %s(%s)", index.name, base.KeyspaceToken, q.expand(index.keys, false))
+			if index.filter != "" {
+				statement += " WHERE " + q.expand(index.filter, false)
+			}
+			statement += " USING GSI"
+			err := q.exec(statement, nil, nil)
+			if err != nil && !strings.Contains(err.Error(), "already exists") {
+				return fmt.Errorf("Unable to create N1QL index %q on bucket %q: %v", index.name, q.bucket.GetName(), err)
+			} else if err == nil {
+				base.Logf("Created N1QL index %q on bucket %q", index.name, q.bucket.GetName())
+			}
+		}
+		if err := q.waitForIndex(index.name, verifyOnly); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Waits until an index is online.  With verifyOnly, fails right away if it doesn't exist.
+func (q *n1qlQuerier) waitForIndex(name string, verifyOnly bool) error {
+	deadline := time.Now().Add(kN1QLIndexWaitTime)
+	for {
+		var state string
+		err := q.exec("SELECT RAW state FROM system:indexes WHERE keyspace_id = $bucket AND name = $name",
+			map[string]interface{}{"bucket": q.bucket.GetName(), "name": name}, &state)
+		if err != nil {
+			return fmt.Errorf("Unable to get the state of N1QL index %q: %v", name, err)
+		} else if state == kN1QLIndexOnline {
+			return nil
+		} else if state == "" && verifyOnly {
+			return fmt.Errorf("N1QL index %q doesn't exist on bucket %q", name, q.bucket.GetName())
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("N1QL index %q on bucket %q isn't online (state %q)", name, q.bucket.GetName(), state)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Queries the sg_channels index, or for the "*" channel the sg_sequence index.
+func (q *n1qlQuerier) queryChannel(channelName string, startSeq, endSeq uint64, limit int) (LogEntries, error) {
+	var statement string
+	params := map[string]interface{}{}
+	if channelName == "*" {
+		statement = n1qlStarChannelQuery
+		params["startSeq"] = startSeq
+		if endSeq > 0 {
+			statement += " AND " + kN1QLSyncToken + ".sequence <= $endSeq"
+			params["endSeq"] = endSeq
+		}
+		statement += " ORDER BY " + kN1QLSyncToken + ".sequence"
+	} else {
+		statement = n1qlChannelQuery
+		params["channel"] = channelName
+		params["startKey"] = []interface{}{channelName, startSeq}
+		if endSeq > 0 {
+			params["endKey"] = []interface{}{channelName, endSeq}
+		} else {
+			params["endKey"] = []interface{}{channelName, map[string]interface{}{}} // Objects sort after numbers
+		}
+	}
+	if limit > 0 {
+		statement += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	entries := LogEntries{}
+	var row struct {
+		ID      string                   `json:"id"`
+		Rev     string                   `json:"rev"`
+		Flags   uint8                    `json:"flags"`
+		Deleted bool                     `json:"deleted"`
+		Seq     uint64                   `json:"seq"`
+		Removal *channels.ChannelRemoval `json:"removal"`
+	}
+	err := q.query(statement, params, func(results base.N1QLQueryResults) bool {
+		row.Flags, row.Deleted, row.Removal = 0, false, nil
+		if !results.Next(&row) {
+			return false
+		}
+		// Same entries as the channels view emits:
+		entry := &LogEntry{DocID: row.ID, Sequence: row.Seq, RevID: row.Rev, Flags: row.Flags, TimeReceived: time.Now()}
+		if row.Removal != nil {
+			entry.Sequence, entry.RevID, entry.Flags = row.Removal.Seq, row.Removal.RevID, channels.Removed
+			if row.Removal.Deleted {
+				entry.Flags |= channels.Deleted
+			}
+		} else if entry.Flags == 0 && row.Deleted {
+			entry.Flags = channels.Deleted
+		}
+		entries = append(entries, entry)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Queries the sg_all_docs index.
+func (q *n1qlQuerier) queryAllDocs(startKey, endKey string) ([]allDocsQueryRow, error) {
+	statement := n1qlAllDocsQuery
+	params := map[string]interface{}{"startKey": startKey}
+	if endKey != "" {
+		statement += " AND " + kN1QLIDToken + " <= $endKey"
+		params["endKey"] = endKey
+	}
+	statement += " ORDER BY " + kN1QLIDToken
+
+	rows := []allDocsQueryRow{}
+	err := q.query(statement, params, func(results base.N1QLQueryResults) bool {
+		var row struct {
+			ID       string   `json:"id"`
+			Rev      string   `json:"rev"`
+			Seq      uint64   `json:"seq"`
+			Channels []string `json:"channels"`
+		}
+		if !results.Next(&row) {
+			return false
+		}
+		rows = append(rows, allDocsQueryRow{IDAndRev{row.ID, row.Rev, row.Seq}, row.Channels})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Queries the sg_principals index.
+func (q *n1qlQuerier) queryPrincipals() (users, roles []string, err error) {
+	users = []string{}
+	roles = []string{}
+	err = q.query(n1qlPrincipalsQuery+n1qlPrincipalsFilter, nil, func(results base.N1QLQueryResults) bool {
+		var docID string
+		if !results.Next(&docID) {
+			return false
+		}
+		if strings.HasPrefix(docID, auth.UserKeyPrefix) {
+			users = append(users, docID[len(auth.UserKeyPrefix):])
+		} else if strings.HasPrefix(docID, auth.RoleKeyPrefix) {
+			roles = append(roles, docID[len(auth.RoleKeyPrefix):])
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return users, roles, nil
+}
+
+// Returns the TimedSets granted to a principal by the access or role_access metadata of docs.
+func (q *n1qlQuerier) queryAccessProperty(property string, principalKey string) ([]channels.TimedSet, error) {
+	var sets []channels.TimedSet
+	err := q.query(fmt.Sprintf(n1qlAccessQuery, property), map[string]interface{}{"principal": principalKey},
+		func(results base.N1QLQueryResults) bool {
+			var set channels.TimedSet
+			if !results.Next(&set) {
+				return false
+			}
+			sets = append(sets, set)
+			return true
+		})
+	return sets, err
+}
+
+// Queries the sg_access index.
+func (q *n1qlQuerier) queryAccess(principalKey string) (channels.TimedSet, error) {
+	sets, err := q.queryAccessProperty("access", principalKey)
+	if err != nil {
+		return nil, err
+	}
+	channelSet := channels.TimedSet{}
+	for _, set := range sets {
+		channelSet.Add(set)
+	}
+	return channelSet, nil
+}
+
+// Queries the sg_role_access index.
+func (q *n1qlQuerier) queryRoleAccess(username string) (channels.TimedSet, error) {
+	sets, err := q.queryAccessProperty("role_access", username)
+	if err != nil {
+		return nil, err
+	}
+	var result channels.TimedSet
+	for _, set := range sets {
+		if result == nil {
+			result = set
+		} else {
+			result.Add(set)
+		}
+	}
+	return result, nil
+}
+
+// Counts the docs with the sg_sequence index.
+func (q *n1qlQuerier) queryDocStates() (DocStateCounts, error) {
+	var row struct {
+		Total      int64 `json:"total"`
+		Tombstones int64 `json:"tombstones"`
+		Conflicts  int64 `json:"conflicts"`
+	}
+	err := q.query(n1qlDocStatesQuery, nil, func(results base.N1QLQueryResults) bool {
+		results.Next(&row)
+		return false
+	})
+	if err != nil {
+		return DocStateCounts{}, err
+	}
+	return DocStateCounts{Docs: row.Total - row.Tombstones, Tombstones: row.Tombstones, Conflicts: row.Conflicts}, nil
+}
@@ -0,0 +1,105 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbaselabs/go.assert"
+)
+
+// A N1QLBucket that returns canned rows, and remembers the statements it's given.
+type cannedN1QLBucket struct {
+	rows       []interface{}
+	statements []string
+	params     []map[string]interface{}
+}
+
+type cannedN1QLResults struct {
+	rows []interface{}
+}
+
+func (r *cannedN1QLResults) Next(valuePtr interface{}) bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	data, _ := json.Marshal(r.rows[0])
+	r.rows = r.rows[1:]
+	return json.Unmarshal(data, valuePtr) == nil
+}
+
+func (r *cannedN1QLResults) Close() error { return nil }
+
+func (b *cannedN1QLBucket) GetName() string { return "canned" }
+
+func (b *cannedN1QLBucket) Query(statement string, params map[string]interface{}, requestPlus bool, adhoc bool) (base.N1QLQueryResults, error) {
+	b.statements = append(b.statements, statement)
+	b.params = append(b.params, params)
+	return &cannedN1QLResults{rows: b.rows}, nil
+}
+
+func TestN1QLRequiresCouchbaseBucket(t *testing.T) {
+	bucket := testBucket()
+	defer bucket.Close()
+	_, err := NewDatabaseContext("db", bucket, false, DatabaseContextOptions{N1QL: &N1QLConfig{Enabled: true}})
+	assert.True(t, err != nil)
+	assert.True(t, strings.Contains(err.Error(), "N1QL"))
+}
+
+func TestN1QLExpand(t *testing.T) {
+	q := &n1qlQuerier{syncPath: n1qlSyncPath(false)}
+	assert.Equals(t, q.expand("$sync.sequence", false), "`_sync`.sequence")
+	assert.Equals(t, q.expand("$sync.sequence", true), "sgb.`_sync`.sequence")
+	assert.Equals(t, q.expand("$id", true), "META(sgb).id")
+
+	q = &n1qlQuerier{syncPath: n1qlSyncPath(true)}
+	assert.Equals(t, q.expand("$sync.sequence", false), "META().xattrs.`_sync`.sequence")
+	assert.Equals(t, q.expand("$sync.sequence", true), "META(sgb).xattrs.`_sync`.sequence")
+	assert.Equals(t, q.expand(n1qlPrincipalsFilter, false), `META().id LIKE "\\_sync:user:%" OR META().id LIKE "\\_sync:role:%"`)
+}
+
+func TestN1QLChannelQuery(t *testing.T) {
+	bucket := &cannedN1QLBucket{rows: []interface{}{
+		map[string]interface{}{"id": "doc1", "rev": "1-a", "seq": 5, "removal": nil},
+		map[string]interface{}{"id": "doc2", "rev": "2-b", "seq": 6, "deleted": true},
+		map[string]interface{}{"id": "doc3", "rev": "3-c", "seq": 9, "removal": map[string]interface{}{"seq": 7, "rev": "2-c"}},
+		map[string]interface{}{"id": "doc4", "rev": "2-d", "seq": 8, "removal": map[string]interface{}{"seq": 8, "rev": "2-d", "del": true}},
+	}}
+	q := &n1qlQuerier{bucket: bucket, syncPath: n1qlSyncPath(false)}
+	entries, err := q.queryChannel("ABC", 5, 0, 10)
+	assertNoError(t, err, "queryChannel")
+	assert.Equals(t, len(entries), 4)
+	assert.Equals(t, entries[0].DocID, "doc1")
+	assert.Equals(t, entries[0].RevID, "1-a")
+	assert.Equals(t, entries[0].Sequence, uint64(5))
+	assert.Equals(t, entries[0].Flags, uint8(0))
+	assert.Equals(t, entries[1].Flags, uint8(channels.Deleted))
+	assert.Equals(t, entries[2].Sequence, uint64(7))
+	assert.Equals(t, entries[2].RevID, "2-c")
+	assert.Equals(t, entries[2].Flags, uint8(channels.Removed))
+	assert.Equals(t, entries[3].Flags, uint8(channels.Removed|channels.Deleted))
+
+	assert.True(t, strings.HasSuffix(bucket.statements[0], "LIMIT 10"))
+	assert.DeepEquals(t, bucket.params[0]["startKey"], []interface{}{"ABC", uint64(5)})
+	assert.DeepEquals(t, bucket.params[0]["endKey"], []interface{}{"ABC", map[string]interface{}{}})
+}
+
+func TestN1QLPrincipalsQuery(t *testing.T) {
+	bucket := &cannedN1QLBucket{rows: []interface{}{"_sync:user:", "_sync:user:alice", "_sync:role:admins"}}
+	q := &n1qlQuerier{bucket: bucket, syncPath: n1qlSyncPath(false)}
+	users, roles, err := q.queryPrincipals()
+	assertNoError(t, err, "queryPrincipals")
+	assert.DeepEquals(t, users, []string{"", "alice"})
+	assert.DeepEquals(t, roles, []string{"admins"})
+}
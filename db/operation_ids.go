@@ -0,0 +1,109 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"time"
+)
+
+// A client can make a document write safe to retry by giving it an operation ID.  The doc's
+// metadata records the revisions recent operation IDs created, so when a write whose response was
+// lost is retried, the retry gets the revision the first attempt made instead of creating a
+// duplicate.  The records outlive the revisions being superseded, but are pruned to the newest
+// MaxOperationIDs, and dropped after OperationIDTTL.  They're only kept once the cluster
+// compatibility version is at least SyncMetadataVersion3; below it, a retry is an ordinary write.
+
+// Defaults for DatabaseContextOptions
+const (
+	DefaultMaxOperationIDs = 10
+	DefaultOperationIDTTL  = 24 * time.Hour
+)
+
+// Max length of an operation ID
+const MaxOperationIDLength = 128
+
+// The revision an operation created.  Stored in the doc's _sync metadata.
+type operationRecord struct {
+	ID   string `json:"id"`
+	User string `json:"user,omitempty"` // Name of the user who made it; empty for an admin
+	Rev  string `json:"rev"`
+	Time int64  `json:"t"` // Unix time it was made
+}
+
+// Aborts an update whose operation already created a revision.
+type operationDoneError struct {
+	revID string
+}
+
+func (err *operationDoneError) Error() string {
+	return fmt.Sprintf("Operation already created revision %s", err.revID)
+}
+
+// Returns a copy of the database whose Put and Post calls are made on behalf of an operation.
+func (db *Database) WithOperationID(operationID string) *Database {
+	opDB := *db
+	opDB.operationID = operationID
+	return &opDB
+}
+
+func (context *DatabaseContext) operationIDLimits() (maxIDs int, ttl time.Duration) {
+	options := context.GetOptions()
+	maxIDs, ttl = options.MaxOperationIDs, options.OperationIDTTL
+	if maxIDs <= 0 {
+		maxIDs = DefaultMaxOperationIDs
+	}
+	if ttl <= 0 {
+		ttl = DefaultOperationIDTTL
+	}
+	return
+}
+
+func (db *Database) operationUser() string {
+	if db.user == nil {
+		return ""
+	}
+	return db.user.Name()
+}
+
+// Returns the ID of a new doc created by a Post of the database's operation.  It's derived from
+// the operation ID, so that a retry of the Post updates the same doc.
+func (db *Database) operationDocID() string {
+	digest := sha1.Sum([]byte(db.operationUser() + "\x00" + db.operationID))
+	return fmt.Sprintf("%x", digest[:16])
+}
+
+// Returns the revision the operation created, if it's recorded as made since minTime.
+func (s *syncData) operationRev(operationID, user string, minTime int64) string {
+	for _, record := range s.Operations {
+		if record.ID == operationID && record.User == user && record.Time > minTime {
+			return record.Rev
+		}
+	}
+	return ""
+}
+
+// Records the revision an operation created, and prunes the records that have expired or exceed
+// the max.
+func (s *syncData) recordOperation(record operationRecord, maxIDs int, ttl time.Duration) {
+	minTime := record.Time - int64(ttl/time.Second)
+	kept := make([]operationRecord, 0, len(s.Operations)+1)
+	for _, old := range s.Operations {
+		if old.Time > minTime && !(old.ID == record.ID && old.User == record.User) {
+			kept = append(kept, old)
+		}
+	}
+	kept = append(kept, record)
+	if len(kept) > maxIDs {
+		kept = kept[len(kept)-maxIDs:]
+	}
+	s.Operations = kept
+}
@@ -0,0 +1,159 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Bodies of large documents can be stored out of line: if the current revision's body is at least
+// DatabaseContextOptions.OutOfLineBodyThreshold bytes, it's written to a key of its own, and the
+// document keeps only its _sync metadata, whose "body_key" points to the body.  That way updates of
+// just the metadata don't rewrite the body.  GetDoc resolves the pointer, so the rest of the
+// gateway (including the revision cache) sees the body as usual.  Bucket views see an empty body.
+//
+// Setting DatabaseContextOptions.InlineBodies moves bodies back into their docs as they're
+// written, or by a resync.  So does a cluster compatibility version below SyncMetadataVersion3,
+// since older nodes don't know about "body_key".  An out-of-line body expires with its doc, and is
+// removed when the doc is purged.
+
+// Prefix of the keys of document bodies stored out of line.
+const kOutOfLineBodyKeyPrefix = KSyncKeyPrefix + "body:"
+
+// Max attempts at reading or updating a doc whose out-of-line body was replaced meanwhile.
+const kMaxOutOfLineBodyAttempts = 3
+
+// Returned when a doc's out-of-line body is missing, which means a concurrent write replaced it.
+var errOutOfLineBodyMissing = errors.New("Out-of-line document body is missing")
+
+// The key of an out-of-line body.  Like an attachment's, it's a digest of the content, but it also
+// covers the doc and revision IDs, so that each body belongs to one revision of one doc, and is
+// unreferenced once that doc points to another body.
+func outOfLineBodyKey(docid, revid string, bodyJSON []byte) string {
+	digester := sha1.New()
+	digester.Write([]byte(docid))
+	digester.Write([]byte{0})
+	digester.Write([]byte(revid))
+	digester.Write([]byte{0})
+	digester.Write(bodyJSON)
+	return kOutOfLineBodyKeyPrefix + "sha1-" + base64.StdEncoding.EncodeToString(digester.Sum(nil))
+}
+
+// Loads the body of a document that's stored out of line.  A doc updated by something other than
+// Sync Gateway since its last SG write has its own body, so its pointer is stale and is ignored.
+func (context *DatabaseContext) loadOutOfLineBody(doc *document) error {
+	if doc.BodyKey == "" || (context.UseXattrs() && !doc.IsSGWrite()) {
+		return nil
+	}
+	var bodyJSON []byte
+	err := context.retryBucketOp("GetOutOfLineBody "+doc.ID, true, func() (opErr error) {
+		bodyJSON, _, opErr = context.Bucket.GetRaw(doc.BodyKey)
+		return opErr
+	})
+	if err != nil {
+		if base.IsDocNotFoundError(err) {
+			return errOutOfLineBodyMissing
+		}
+		return err
+	}
+	var body Body
+	if err := body.Unmarshal(bodyJSON); err != nil {
+		return err
+	}
+	doc.body = body
+	return nil
+}
+
+// Decides where the body of a document's current revision is stored, just before the doc is
+// written: if it's big enough it's written to its own key (unless the doc already points to it),
+// otherwise it goes back inline.  Returns the key it wrote, if any.
+func (db *Database) storeOutOfLineBody(doc *document) (writtenKey string, err error) {
+	threshold := db.GetOptions().OutOfLineBodyThreshold
+	if threshold <= 0 || !db.outOfLineBodiesAllowed() || doc.body == nil || doc.hasFlag(channels.Deleted) {
+		doc.BodyKey, doc.BodySize, doc.AttachmentsSize = "", 0, 0
+		return "", nil
+	}
+	bodyJSON, err := json.Marshal(doc.body)
+	if err != nil {
+		return "", err
+	}
+	if len(bodyJSON) < threshold {
+		doc.BodyKey, doc.BodySize, doc.AttachmentsSize = "", 0, 0
+		return "", nil
+	}
+
+	key := outOfLineBodyKey(doc.ID, doc.CurrentRev, bodyJSON)
+	if key != doc.BodyKey {
+		// The body expires with its doc:
+		var expiry int
+		if doc.Expiry != nil {
+			expiry = int(doc.Expiry.Unix())
+		}
+		err = db.retryBucketOp("SetOutOfLineBody "+doc.ID, true, func() error {
+			return db.Bucket.SetRaw(key, expiry, bodyJSON)
+		})
+		if err != nil {
+			return "", err
+		}
+		dbExpvars.Add("out_of_line_bodies_written", 1)
+		writtenKey = key
+	}
+	doc.BodyKey = key
+	// Sizes are kept with the pointer, so GetDocSizes needn't read the body:
+	doc.BodySize = len(bodyJSON)
+	doc.AttachmentsSize = 0
+	for _, value := range BodyAttachments(doc.body) {
+		if meta, ok := value.(map[string]interface{}); ok {
+			length, _ := declaredAttachmentLength(meta)
+			doc.AttachmentsSize += length
+		}
+	}
+	return writtenKey, nil
+}
+
+// Whether bodies may be stored out of line: not if the database is set to store them inline, nor
+// while some nodes of the cluster can't read "body_key".
+func (db *Database) outOfLineBodiesAllowed() bool {
+	return !db.GetOptions().InlineBodies && db.syncMetadataWriteVersion() >= SyncMetadataVersion3
+}
+
+// If bodies aren't allowed out of line, moves a document's (loaded) out-of-line body back into it.
+// Returns the key of the body, to remove once the doc has been written.
+func (db *Database) inlineOutOfLineBody(doc *document) (oldKey string) {
+	if db.outOfLineBodiesAllowed() || doc.BodyKey == "" || doc.body == nil {
+		return ""
+	}
+	oldKey, doc.BodyKey = doc.BodyKey, ""
+	doc.BodySize, doc.AttachmentsSize = 0, 0
+	return oldKey
+}
+
+// Removes the out-of-line bodies a document no longer points to, after it's been written.
+func (db *Database) removeOutOfLineBodies(doc *document, keys ...string) {
+	for _, key := range keys {
+		if key == "" || key == doc.BodyKey {
+			continue
+		}
+		err := db.retryBucketOp("DeleteOutOfLineBody "+doc.ID, true, func() error {
+			return db.Bucket.Delete(key)
+		})
+		if err != nil && !base.IsDocNotFoundError(err) {
+			db.LogContext.Warn("Unable to remove out-of-line body of doc %q: %v", doc.ID, err)
+		} else if err == nil {
+			dbExpvars.Add("out_of_line_bodies_removed", 1)
+		}
+	}
+}
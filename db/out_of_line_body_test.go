@@ -0,0 +1,175 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Returns the doc's body as stored in the bucket, without its metadata.
+func rawDocBody(t *testing.T, db *Database, docid string) Body {
+	rawDoc, _, err := db.Bucket.GetRaw(docid)
+	assertNoError(t, err, "GetRaw")
+	var body Body
+	assertNoError(t, json.Unmarshal(rawDoc, &body), "Unmarshal")
+	delete(body, "_sync")
+	return body
+}
+
+func TestOutOfLineBody(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.Options.OutOfLineBodyThreshold = 100
+
+	bigValue := strings.Repeat("x", 200)
+	rev1, err := db.Put("doc1", Body{"big": bigValue})
+	assertNoError(t, err, "Put")
+
+	// The body is stored under its own key, and the doc only points to it:
+	doc, err := db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	bodyKey1 := doc.BodyKey
+	assert.True(t, strings.HasPrefix(bodyKey1, kOutOfLineBodyKeyPrefix))
+	assert.Equals(t, doc.body["big"], bigValue)
+	assert.Equals(t, len(rawDocBody(t, db, "doc1")), 0)
+
+	// Reads resolve the pointer, also when the revision isn't cached:
+	db.revisionCache = NewRevisionCache(KDefaultRevisionCacheCapacity, db.revCacheLoader)
+	body, err := db.Get("doc1")
+	assertNoError(t, err, "Get")
+	assert.Equals(t, body["big"], bigValue)
+
+	// A new revision replaces the body, and the superseded one is removed:
+	rev2, err := db.Put("doc1", Body{"big": bigValue + "y", "_rev": rev1})
+	assertNoError(t, err, "Put")
+	doc, err = db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	bodyKey2 := doc.BodyKey
+	assert.True(t, bodyKey2 != "" && bodyKey2 != bodyKey1)
+	_, _, err = db.Bucket.GetRaw(bodyKey1)
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// A body under the threshold is stored inline again:
+	rev3, err := db.Put("doc1", Body{"small": true, "_rev": rev2})
+	assertNoError(t, err, "Put")
+	doc, err = db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.BodyKey, "")
+	assert.Equals(t, rawDocBody(t, db, "doc1")["small"], true)
+	_, _, err = db.Bucket.GetRaw(bodyKey2)
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// And so is a tombstone:
+	_, err = db.Put("doc1", Body{"big": bigValue, "_rev": rev3})
+	assertNoError(t, err, "Put")
+	doc, err = db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	assert.True(t, doc.BodyKey != "")
+	_, err = db.DeleteDoc("doc1", doc.CurrentRev)
+	assertNoError(t, err, "DeleteDoc")
+	doc, err = db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.BodyKey, "")
+}
+
+func TestInlineOutOfLineBodies(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.Options.OutOfLineBodyThreshold = 100
+
+	bigValue := strings.Repeat("x", 200)
+	_, err := db.Put("doc1", Body{"big": bigValue})
+	assertNoError(t, err, "Put")
+	doc, err := db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	bodyKey := doc.BodyKey
+	assert.True(t, bodyKey != "")
+
+	// With inline bodies set, a resync moves the body back into the doc:
+	db.Options.InlineBodies = true
+	assertNoError(t, db.resyncDocument("doc1", true, false), "resyncDocument")
+	assert.Equals(t, rawDocBody(t, db, "doc1")["big"], bigValue)
+	doc, err = db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.BodyKey, "")
+	assert.Equals(t, doc.body["big"], bigValue)
+	_, _, err = db.Bucket.GetRaw(bodyKey)
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// ...and new revisions stay inline:
+	_, err = db.Put("doc1", Body{"big": bigValue + "y", "_rev": doc.CurrentRev})
+	assertNoError(t, err, "Put")
+	doc, err = db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.BodyKey, "")
+}
+
+func TestOutOfLineBodyCompatAndPurge(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.Options.OutOfLineBodyThreshold = 100
+	bigValue := strings.Repeat("x", 200)
+
+	// While some nodes don't know about "body_key", bodies stay inline:
+	db.Options.ClusterCompatVersion = SyncMetadataVersion2
+	_, err := db.Put("doc1", Body{"big": bigValue})
+	assertNoError(t, err, "Put")
+	doc, err := db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.BodyKey, "")
+	assert.Equals(t, rawDocBody(t, db, "doc1")["big"], bigValue)
+
+	// Purging a doc removes its out-of-line body:
+	db.Options.ClusterCompatVersion = 0
+	_, err = db.Put("doc2", Body{"big": bigValue})
+	assertNoError(t, err, "Put")
+	doc, err = db.GetDoc("doc2")
+	assertNoError(t, err, "GetDoc")
+	bodyKey := doc.BodyKey
+	assert.True(t, bodyKey != "")
+	assertNoError(t, db.Purge("doc2"), "Purge")
+	_, _, err = db.Bucket.GetRaw(bodyKey)
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestOutOfLineBodySizes(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	bigValue := strings.Repeat("x", 200)
+	newBody := func() Body {
+		return Body{"big": bigValue, "_attachments": map[string]interface{}{
+			"hello.txt": map[string]interface{}{"data": "aGVsbG8gd29ybGQ="}}}
+	}
+
+	_, err := db.Put("inline", newBody())
+	assertNoError(t, err, "Put")
+	inlineSizes, err := db.GetDocSizes("inline")
+	assertNoError(t, err, "GetDocSizes")
+	assert.Equals(t, inlineSizes.Attachments, int64(len("hello world")))
+
+	// The sizes of an out-of-line body are the same, but come from the doc's metadata:
+	db.Options.OutOfLineBodyThreshold = 100
+	_, err = db.Put("outofline", newBody())
+	assertNoError(t, err, "Put")
+	doc, err := db.GetDoc("outofline")
+	assertNoError(t, err, "GetDoc")
+	assert.True(t, doc.BodyKey != "")
+	assertNoError(t, db.Bucket.Delete(doc.BodyKey), "Delete")
+	sizes, err := db.GetDocSizes("outofline")
+	assertNoError(t, err, "GetDocSizes")
+	assert.Equals(t, sizes.Body, inlineSizes.Body)
+	assert.Equals(t, sizes.Attachments, inlineSizes.Attachments)
+	assert.True(t, sizes.Sync > 0)
+}
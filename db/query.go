@@ -0,0 +1,99 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// A current doc returned by an all-docs query, with the channels it's in.
+type allDocsQueryRow struct {
+	IDAndRev
+	Channels []string
+}
+
+// The index queries a database makes for the changes feeds, _all_docs and principals' access.
+// They're made either with views (viewQuerier) or with N1QL and GSI indexes (n1qlQuerier); the
+// rest of the db package doesn't care which.
+type indexQuerier interface {
+	// Returns the entries of a channel with sequences from startSeq to endSeq (0 for no limit),
+	// in sequence order.  The "*" channel has every doc.  limit is 0 for no limit.
+	queryChannel(channelName string, startSeq, endSeq uint64, limit int) (LogEntries, error)
+
+	// Returns the current, non-deleted docs with IDs from startKey to endKey, in ID order.  Empty
+	// keys mean no limit.
+	queryAllDocs(startKey, endKey string) ([]allDocsQueryRow, error)
+
+	// Returns the names of all users and roles, including the guest user's "".
+	queryPrincipals() (users, roles []string, err error)
+
+	// Returns the channels granted to a principal by docs' access() calls.  A role's key has a
+	// "role:" prefix.
+	queryAccess(principalKey string) (channels.TimedSet, error)
+
+	// Returns the roles granted to a user by docs' role() calls; nil if there are none.
+	queryRoleAccess(username string) (channels.TimedSet, error)
+
+	// Counts the docs, tombstones and conflicted docs, not including the gateway's own docs.
+	queryDocStates() (DocStateCounts, error)
+}
+
+// Creates the querier of a database: a n1qlQuerier if its options enable N1QL, else a viewQuerier.
+func newIndexQuerier(context *DatabaseContext) (indexQuerier, error) {
+	config := context.GetOptions().N1QL
+	if config == nil || !config.Enabled {
+		return &viewQuerier{context: context}, nil
+	}
+	if !context.UseGlobalSequence() {
+		return nil, errors.New("N1QL queries aren't supported with a channel index")
+	}
+	bucket, ok := base.AsN1QLBucket(context.Bucket)
+	if !ok {
+		return nil, fmt.Errorf("N1QL queries require a Couchbase Server bucket accessed with the gocb driver; bucket %q isn't one", context.Bucket.GetName())
+	}
+	querier := &n1qlQuerier{bucket: bucket, syncPath: n1qlSyncPath(context.UseXattrs())}
+	if err := querier.initIndexes(config.VerifyIndexesOnly); err != nil {
+		return nil, err
+	}
+	return querier, nil
+}
+
+// Queries a range of sequences of a single channel as LogEntries.
+func (dbc *DatabaseContext) getChangesInChannelFromQuery(
+	channelName string, endSeq uint64, options ChangesOptions) (LogEntries, error) {
+	if dbc.Bucket == nil {
+		return nil, errors.New("No bucket available for channel query")
+	}
+	start := time.Now()
+	startSeq := options.Since.SafeSequence() + 1
+	base.LogTo("Cache", "  Querying channel %q (start=#%d, end=#%d, limit=%d)", channelName, startSeq, endSeq, options.Limit)
+	entries, err := dbc.querier.queryChannel(channelName, startSeq, endSeq, options.Limit)
+	if err != nil {
+		base.Logf("Error from channel query: %v", err)
+		return nil, err
+	} else if len(entries) == 0 {
+		base.LogTo("Cache", "    Got no rows from query for %q", channelName)
+		return nil, nil
+	}
+
+	base.LogTo("Cache", "    Got %d rows from query for %q: #%d ... #%d",
+		len(entries), channelName, entries[0].Sequence, entries[len(entries)-1].Sequence)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		base.Logf("changes_view: Query took %v to return %d rows, channel %q, start=#%d, end=#%d",
+			elapsed, len(entries), channelName, startSeq, endSeq)
+	}
+	changeCacheExpvars.Add("view_queries", 1)
+	return entries, nil
+}
@@ -0,0 +1,385 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	kResyncCheckpointKey = KSyncKeyPrefix + "resync_checkpoint" // Progress of an interrupted _resync
+	kResyncBatchSize     = 1000                                 // Docs per view query, and between checkpoints
+)
+
+// States of a background _resync task
+const (
+	ResyncStateRunning   = "running"
+	ResyncStateCompleted = "completed"
+	ResyncStateStopped   = "stopped"
+	ResyncStateAborted   = "aborted"
+	ResyncStateError     = "error"
+)
+
+// Progress of a background _resync, as reported by the admin REST API.
+type ResyncStatus struct {
+	State                  string     `json:"state,omitempty"`
+	DocsProcessed          int        `json:"docs_processed"`
+	DocsChanged            int        `json:"docs_changed"`
+	DocsTotal              int        `json:"docs_total"`
+	DocsRemaining          int        `json:"docs_remaining"`
+	EstimatedSecsRemaining *float64   `json:"estimated_secs_remaining,omitempty"`
+	DocsPerSecond          float64    `json:"docs_per_second,omitempty"` // Rate limit; 0 if unlimited
+	Resumed                bool       `json:"resumed,omitempty"`         // Whether it picked up from a checkpoint
+	StartTime              *time.Time `json:"start_time,omitempty"`
+	LastError              string     `json:"last_error,omitempty"`
+	PendingCheckpoint      bool       `json:"pending_checkpoint,omitempty"` // An unfinished _resync must be resumed or aborted
+	StaleOnly              bool       `json:"stale_only,omitempty"`         // Only docs on older sync function epochs are processed
+}
+
+// Saved to the bucket periodically, so that a stopped or interrupted _resync resumes where it left off.
+type resyncCheckpoint struct {
+	LastDocID     string `json:"last_doc_id"`
+	LastEpoch     string `json:"last_epoch,omitempty"` // Sync function epoch of LastDocID, if StaleOnly
+	DocsProcessed int    `json:"docs_processed"`
+	DocsChanged   int    `json:"docs_changed"`
+	StaleOnly     bool   `json:"stale_only,omitempty"`
+}
+
+// State of the background _resync task of a DatabaseContext.
+type resyncTask struct {
+	lock         sync.Mutex
+	status       ResyncStatus
+	runStart     time.Time     // When the current run started (differs from StartTime if resumed)
+	runProcessed int           // Docs processed by the current run, for the time estimate
+	terminator   chan struct{} // Closed to stop the running task
+	done         chan struct{} // Closed by the task once it has stopped
+	abort        bool          // If set when stopping, the checkpoint is discarded
+}
+
+// Starts re-running the sync function on all documents in the background.  The database must be
+// offline; it stays in the Resyncing state until the task completes, is stopped, or is aborted.
+// If a previous _resync was stopped or interrupted, this resumes from its checkpoint.
+// docsPerSecond limits the rate at which docs are processed; 0 means no limit.  If staleOnly is
+// set, only the docs on older sync function epochs than the current one are processed.  (A
+// resumed _resync keeps the setting it was started with.)
+func (context *DatabaseContext) StartResync(docsPerSecond float64, staleOnly bool) error {
+	if docsPerSecond < 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "docs_per_second must not be negative")
+	}
+	if staleOnly && !context.recordsSyncFnEpochs() {
+		return base.HTTPErrorf(http.StatusBadRequest, "stale_only requires a cluster_compat_version of at least %d", SyncMetadataVersion3)
+	}
+	task := &context.resync
+	task.lock.Lock()
+	defer task.lock.Unlock()
+
+	if task.status.State == ResyncStateRunning {
+		return base.HTTPErrorf(http.StatusServiceUnavailable, "Database _resync is already in progress")
+	}
+	if !atomic.CompareAndSwapUint32(&context.State, DBOffline, DBResyncing) {
+		return base.HTTPErrorf(http.StatusServiceUnavailable, "Database must be _offline before calling /_resync")
+	}
+
+	checkpoint, err := context.getResyncCheckpoint()
+	if err != nil {
+		atomic.CompareAndSwapUint32(&context.State, DBResyncing, DBOffline)
+		return err
+	}
+	now := time.Now()
+	task.status = ResyncStatus{
+		State:         ResyncStateRunning,
+		DocsPerSecond: docsPerSecond,
+		StartTime:     &now,
+	}
+	if checkpoint != nil {
+		base.Logf("Resuming _resync of db %q after doc %q", context.Name, checkpoint.LastDocID)
+		task.status.Resumed = true
+		task.status.DocsProcessed = checkpoint.DocsProcessed
+		task.status.DocsChanged = checkpoint.DocsChanged
+	} else {
+		// Saved right away, so that the _resync is still pending if the node stops before the
+		// first checkpoint:
+		checkpoint = &resyncCheckpoint{StaleOnly: staleOnly}
+		if err := context.Bucket.Set(kResyncCheckpointKey, 0, checkpoint); err != nil {
+			atomic.CompareAndSwapUint32(&context.State, DBResyncing, DBOffline)
+			return err
+		}
+	}
+	task.status.StaleOnly = checkpoint.StaleOnly
+	task.runStart = now
+	task.runProcessed = 0
+	task.abort = false
+	task.terminator = make(chan struct{})
+	task.done = make(chan struct{})
+
+	go context.runResync(checkpoint, docsPerSecond, task.terminator, task.done)
+	return nil
+}
+
+// Stops a running background _resync, blocking until it has stopped.  Progress is checkpointed so
+// the next StartResync resumes, unless abort is true, in which case the checkpoint is discarded.
+// Aborting also discards the checkpoint of a _resync that isn't currently running.
+func (context *DatabaseContext) StopResync(abort bool) error {
+	task := &context.resync
+	task.lock.Lock()
+	if task.status.State == ResyncStateRunning {
+		task.abort = abort
+		close(task.terminator)
+		done := task.done
+		task.lock.Unlock()
+		<-done
+		return nil
+	}
+	task.lock.Unlock()
+
+	if !abort {
+		return base.HTTPErrorf(http.StatusBadRequest, "No _resync is in progress")
+	}
+	if err := context.deleteResyncCheckpoint(); err != nil {
+		return err
+	}
+	task.lock.Lock()
+	if task.status.State != "" {
+		task.status.State = ResyncStateAborted
+	}
+	task.lock.Unlock()
+	return nil
+}
+
+// Returns the progress of the current or most recent background _resync.
+func (context *DatabaseContext) GetResyncStatus() ResyncStatus {
+	task := &context.resync
+	task.lock.Lock()
+	status := task.status
+	if status.State == ResyncStateRunning && task.runProcessed > 0 {
+		if rate := float64(task.runProcessed) / time.Since(task.runStart).Seconds(); rate > 0 {
+			estimate := float64(status.DocsRemaining) / rate
+			status.EstimatedSecsRemaining = &estimate
+		}
+	}
+	task.lock.Unlock()
+
+	if status.State != ResyncStateRunning {
+		status.PendingCheckpoint = context.HasPendingResync()
+	}
+	return status
+}
+
+// Returns true if a _resync was stopped or interrupted before completing, and hasn't been aborted.
+func (context *DatabaseContext) HasPendingResync() bool {
+	checkpoint, err := context.getResyncCheckpoint()
+	if err != nil {
+		base.Warn("Unable to read _resync checkpoint for db %q: %v", context.Name, err)
+	}
+	return checkpoint != nil
+}
+
+func (context *DatabaseContext) runResync(checkpoint *resyncCheckpoint, docsPerSecond float64, terminator, done chan struct{}) {
+	defer close(done)
+	defer atomic.CompareAndSwapUint32(&context.State, DBResyncing, DBOffline)
+
+	db, _ := CreateDatabase(context)
+	task := &context.resync
+
+	// We are about to alter documents without updating their sequence numbers, which would
+	// really confuse the changeCache, so turn it off until we're done:
+	context.changeCache.EnableChannelIndexing(false)
+	defer context.changeCache.EnableChannelIndexing(true)
+	context.changeCache.Clear()
+
+	var total int
+	var err error
+	if checkpoint.StaleOnly {
+		var counts *SyncFnEpochCounts
+		if counts, err = context.GetSyncFnEpochCounts(); err == nil {
+			// The docs already processed have left the older epochs:
+			total = counts.StaleDocs + checkpoint.DocsProcessed
+		}
+	} else {
+		total, err = db.countCurrentDocs()
+	}
+	if err != nil {
+		task.finish(ResyncStateError, err)
+		return
+	}
+	task.lock.Lock()
+	task.status.DocsTotal = total
+	task.status.DocsRemaining = remainingDocs(total, checkpoint.DocsProcessed)
+	task.lock.Unlock()
+	base.Logf("Re-running sync function on %d documents of db %q...", total, context.Name)
+
+	var interval time.Duration
+	if docsPerSecond > 0 {
+		interval = time.Duration(float64(time.Second) / docsPerSecond)
+	}
+
+	for {
+		docs, more, err := db.nextResyncBatch(checkpoint)
+		if err != nil {
+			context.saveResyncCheckpoint(checkpoint)
+			task.finish(ResyncStateError, err)
+			return
+		}
+
+		for _, doc := range docs {
+			docid := doc.docID
+			if !waitForResync(terminator, interval) {
+				task.lock.Lock()
+				abort := task.abort
+				task.lock.Unlock()
+				if abort {
+					context.deleteResyncCheckpoint()
+					task.finish(ResyncStateAborted, nil)
+				} else {
+					context.saveResyncCheckpoint(checkpoint)
+					task.finish(ResyncStateStopped, nil)
+				}
+				return
+			}
+
+			err := db.resyncDocument(docid, true, false)
+			if err == nil {
+				checkpoint.DocsChanged++
+			} else if err != couchbase.UpdateCancel {
+				base.Warn("Error updating doc %q: %v", docid, err)
+			}
+			checkpoint.LastDocID = docid
+			checkpoint.LastEpoch = doc.epoch
+			checkpoint.DocsProcessed++
+
+			task.lock.Lock()
+			task.runProcessed++
+			task.status.DocsProcessed = checkpoint.DocsProcessed
+			task.status.DocsChanged = checkpoint.DocsChanged
+			task.status.DocsRemaining = remainingDocs(total, checkpoint.DocsProcessed)
+			task.lock.Unlock()
+		}
+
+		if !more {
+			break
+		}
+		context.saveResyncCheckpoint(checkpoint)
+	}
+	base.Logf("Finished re-running sync function on db %q; %d docs changed", context.Name, checkpoint.DocsChanged)
+
+	if checkpoint.DocsChanged > 0 {
+		db.invalAllPrincipalChannels()
+	}
+	context.deleteResyncCheckpoint()
+	task.finish(ResyncStateCompleted, nil)
+}
+
+// Returns the next batch of docs to resync after the checkpoint, and whether there may be more:
+// the docs known to the gateway, or if StaleOnly is set, the docs on older sync function epochs.
+func (db *Database) nextResyncBatch(checkpoint *resyncCheckpoint) (docs []epochDocID, more bool, err error) {
+	if checkpoint.StaleOnly {
+		docs, err = db.staleSyncFnDocs(checkpoint.LastEpoch, checkpoint.LastDocID, kResyncBatchSize)
+		return docs, len(docs) >= kResyncBatchSize, err
+	}
+	startKey := []interface{}{true}
+	if checkpoint.LastDocID != "" {
+		startKey = append(startKey, checkpoint.LastDocID)
+	}
+	options := Body{"stale": false, "reduce": false, "startkey": startKey, "limit": kResyncBatchSize}
+	vres, err := db.Bucket.View(db.DesignDocName(DesignDocSyncHousekeeping, ViewImport), ViewImport, options)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, row := range vres.Rows {
+		docid := row.Key.([]interface{})[1].(string)
+		if docid == checkpoint.LastDocID {
+			continue // startkey is inclusive, and this doc was already processed
+		}
+		docs = append(docs, epochDocID{docID: docid})
+	}
+	return docs, len(vres.Rows) >= kResyncBatchSize, nil
+}
+
+// Sleeps for the rate-limit interval between docs.  Returns false if the task is being stopped.
+func waitForResync(terminator chan struct{}, interval time.Duration) bool {
+	if interval <= 0 {
+		select {
+		case <-terminator:
+			return false
+		default:
+			return true
+		}
+	}
+	select {
+	case <-terminator:
+		return false
+	case <-time.After(interval):
+		return true
+	}
+}
+
+func (task *resyncTask) finish(state string, err error) {
+	task.lock.Lock()
+	defer task.lock.Unlock()
+	task.status.State = state
+	if err != nil {
+		base.Warn("_resync failed: %v", err)
+		task.status.LastError = err.Error()
+	}
+}
+
+func remainingDocs(total, processed int) int {
+	if processed >= total {
+		return 0
+	}
+	return total - processed
+}
+
+// Returns the number of documents known to the gateway, using the reduce function of the import view.
+func (db *Database) countCurrentDocs() (int, error) {
+	options := Body{"stale": false, "reduce": true, "startkey": []interface{}{true}}
+	vres, err := db.Bucket.View(db.DesignDocName(DesignDocSyncHousekeeping, ViewImport), ViewImport, options)
+	if err != nil || len(vres.Rows) == 0 {
+		return 0, err
+	}
+	switch count := vres.Rows[0].Value.(type) {
+	case float64:
+		return int(count), nil
+	case int:
+		return count, nil
+	default:
+		return 0, nil
+	}
+}
+
+func (context *DatabaseContext) getResyncCheckpoint() (*resyncCheckpoint, error) {
+	var checkpoint resyncCheckpoint
+	if _, err := context.Bucket.Get(kResyncCheckpointKey, &checkpoint); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (context *DatabaseContext) saveResyncCheckpoint(checkpoint *resyncCheckpoint) {
+	if err := context.Bucket.Set(kResyncCheckpointKey, 0, checkpoint); err != nil {
+		base.Warn("Unable to save _resync checkpoint for db %q: %v", context.Name, err)
+	}
+}
+
+func (context *DatabaseContext) deleteResyncCheckpoint() error {
+	if err := context.Bucket.Delete(kResyncCheckpointKey); err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	return nil
+}
@@ -35,6 +35,36 @@ func (b *Body) Unmarshal(data []byte) error {
 	return nil
 }
 
+// Typed accessors of a body's properties.  They return false, rather than panicking, if the
+// property is missing or has the wrong type, so malformed input can be rejected with a 400.
+// Attachment metadata can be read with them too, as Body(meta).
+
+func (body Body) GetString(key string) (value string, ok bool) {
+	value, ok = body[key].(string)
+	return
+}
+
+// Accepts any JSON number, truncating a fractional one.
+func (body Body) GetInt64(key string) (int64, bool) {
+	return base.ToInt64(body[key])
+}
+
+func (body Body) GetBool(key string) (value bool, ok bool) {
+	value, ok = body[key].(bool)
+	return
+}
+
+// Returns a property that's a JSON object.
+func (body Body) GetMap(key string) (Body, bool) {
+	switch value := body[key].(type) {
+	case map[string]interface{}:
+		return Body(value), true
+	case Body:
+		return value, true
+	}
+	return nil, false
+}
+
 func (body Body) ShallowCopy() Body {
 	copied := make(Body, len(body))
 	for key, value := range body {
@@ -49,16 +79,17 @@ func (body Body) ImmutableAttachmentsCopy() Body {
 	}
 	copied := make(Body, len(body))
 	for k1, v1 := range body {
-		if k1 == "_attachments" {
-			atts := v1.(map[string]interface{})
+		if atts, ok := v1.(map[string]interface{}); ok && k1 == "_attachments" {
 			attscopy := make(map[string]interface{}, len(atts))
 			for k2, v2 := range atts {
-				attachment := v2.(map[string]interface{})
-				attachmentcopy := make(map[string]interface{}, len(attachment))
-				for k3, v3 := range attachment {
-					attachmentcopy[k3] = v3
+				if attachment, ok := v2.(map[string]interface{}); ok {
+					attachmentcopy := make(map[string]interface{}, len(attachment))
+					for k3, v3 := range attachment {
+						attachmentcopy[k3] = v3
+					}
+					v2 = attachmentcopy
 				}
-				attscopy[k2] = attachmentcopy
+				attscopy[k2] = v2
 			}
 			v1 = attscopy
 		}
@@ -135,7 +166,7 @@ func (db *DatabaseContext) getOldRevisionJSON(docid string, revid string) ([]byt
 }
 
 func (db *Database) setOldRevisionJSON(docid string, revid string, body []byte) error {
-	base.LogTo("CRUD+", "Saving old revision %q / %q (%d bytes)", docid, revid, len(body))
+	db.LogContext.LogTo("CRUD+", "Saving old revision %q / %q (%d bytes)", docid, revid, len(body))
 
 	// Set old revisions to expire after 5 minutes.  Future enhancement to make this a config
 	// setting might be appropriate.
@@ -172,6 +203,20 @@ func createRevID(generation int, parentRevID string, body Body) string {
 	return fmt.Sprintf("%d-%x", generation, digester.Sum(nil))
 }
 
+// Checks that a revision pushed with new_edits=false has the rev ID createRevID gives its content
+// (whose attachments have been replaced by their digests), so that a client can't push different
+// bodies under the same rev ID.  The digest can only be checked if the revision's parent is known.
+func verifyRevID(revid string, generation int, parentRevID string, body Body) error {
+	if generation > 1 && genOfRevID(parentRevID) != generation-1 {
+		return nil
+	}
+	if expected := createRevID(generation, parentRevID, body); revid != expected {
+		base.StatsExpvars.Add("revs_idMismatches", 1)
+		return &base.RevIDMismatchError{RevID: revid, Expected: expected}
+	}
+	return nil
+}
+
 // Returns the generation number (numeric prefix) of a revision ID.
 func genOfRevID(revid string) int {
 	if revid == "" {
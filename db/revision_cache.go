@@ -15,7 +15,10 @@ type RevisionCache struct {
 	cache      map[IDAndRev]*list.Element // Fast lookup of list element by doc/rev ID
 	lruList    *list.List                 // List ordered by most recent access (Front is newest)
 	capacity   int                        // Max number of revisions to cache
+	maxBytes   int64                      // Max estimated size of the cached revisions; 0 for no limit
+	bytes      int64                      // Estimated size of the cached revisions
 	loaderFunc RevisionCacheLoaderFunc
+	dbName     string     // Database name, for metrics
 	lock       sync.Mutex // For thread-safety
 }
 
@@ -28,10 +31,13 @@ type revCacheValue struct {
 	history  Body       // Rev history encoded like a "_revisions" property
 	channels base.Set   // Set of channels that have access
 	err      error      // Error from loaderFunc if it failed
+	size     int64      // Estimated size of body & history; protected by the RevisionCache's lock
 	lock     sync.Mutex // Synchronizes access to this struct
 }
 
 // Creates a revision cache with the given capacity and an optional loader function.
+// The cache holds at most `capacity` revisions, no matter how small they are; call SetMaxBytes
+// to also limit the total size of their bodies.
 func NewRevisionCache(capacity int, loaderFunc RevisionCacheLoaderFunc) *RevisionCache {
 
 	if capacity == 0 {
@@ -55,9 +61,11 @@ func (rc *RevisionCache) Get(docid, revid string) (Body, Body, base.Set, error)
 	if value == nil {
 		return nil, nil, nil, nil
 	}
-	body, history, channels, err := value.load(rc.loaderFunc)
+	body, history, channels, size, err := value.load(rc.loaderFunc, rc.dbName)
 	if err != nil {
 		rc.removeValue(value) // don't keep failed loads in the cache
+	} else if size > 0 {
+		rc.setValueSize(value, size)
 	}
 	return body, history, channels, err
 }
@@ -68,7 +76,39 @@ func (rc *RevisionCache) Put(body Body, history Body, channels base.Set) {
 		panic("Missing history for RevisionCache.Put")
 	}
 	value := rc.getValue(body["_id"].(string), body["_rev"].(string), true)
-	value.store(body, history, channels)
+	if size := value.store(body, history, channels); size > 0 {
+		rc.setValueSize(value, size)
+	}
+}
+
+// Sets the maximum estimated size of the cached revision bodies, evicting revisions if necessary.
+// A value of 0 means there's no limit other than the capacity.
+func (rc *RevisionCache) SetMaxBytes(maxBytes int64) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.maxBytes = maxBytes
+	rc.enforceMaxBytes_()
+}
+
+// Returns the number of cached revisions and their estimated total size in bytes.
+func (rc *RevisionCache) Size() (count int, bytes int64) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return len(rc.cache), rc.bytes
+}
+
+// Removes all cached revisions of a document.  This has to be called when a document is changed
+// or removed without going through the normal write path, e.g. when it's purged, since otherwise
+// its old revisions could still be served from the cache.
+func (rc *RevisionCache) Invalidate(docid string) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	for key, elem := range rc.cache {
+		if key.DocID == docid {
+			rc.removeElement_(elem)
+		}
+	}
+	rc.updateBytesMetric_()
 }
 
 func (rc *RevisionCache) getValue(docid, revid string, create bool) (value *revCacheValue) {
@@ -87,6 +127,7 @@ func (rc *RevisionCache) getValue(docid, revid string, create bool) (value *revC
 		for len(rc.cache) > rc.capacity {
 			rc.purgeOldest_()
 		}
+		rc.updateBytesMetric_()
 	}
 	return
 }
@@ -94,40 +135,80 @@ func (rc *RevisionCache) getValue(docid, revid string, create bool) (value *revC
 func (rc *RevisionCache) removeValue(value *revCacheValue) {
 	rc.lock.Lock()
 	if element := rc.cache[value.key]; element != nil && element.Value == value {
-		rc.lruList.Remove(element)
-		delete(rc.cache, value.key)
+		rc.removeElement_(element)
+		rc.updateBytesMetric_()
 	}
 	rc.lock.Unlock()
 }
 
+// Records the size of a value's newly loaded body, then evicts the oldest revisions if the cache
+// is now too big.
+func (rc *RevisionCache) setValueSize(value *revCacheValue, size int64) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if element := rc.cache[value.key]; element == nil || element.Value != value {
+		return // Already evicted
+	}
+	rc.bytes += size - value.size
+	value.size = size
+	rc.enforceMaxBytes_()
+}
+
+func (rc *RevisionCache) enforceMaxBytes_() {
+	// Always keep the newest revision, even if it's bigger than maxBytes by itself:
+	for rc.maxBytes > 0 && rc.bytes > rc.maxBytes && rc.lruList.Len() > 1 {
+		rc.purgeOldest_()
+	}
+	rc.updateBytesMetric_()
+}
+
 func (rc *RevisionCache) purgeOldest_() {
-	value := rc.lruList.Remove(rc.lruList.Back()).(*revCacheValue)
+	rc.removeElement_(rc.lruList.Back())
+	base.StatsExpvars.Add("revisionCache_evictions", 1)
+	base.MetricRevCacheEvictions.Add(rc.dbName, 1)
+}
+
+func (rc *RevisionCache) removeElement_(element *list.Element) {
+	value := rc.lruList.Remove(element).(*revCacheValue)
 	delete(rc.cache, value.key)
+	rc.bytes -= value.size
+}
+
+func (rc *RevisionCache) updateBytesMetric_() {
+	base.MetricRevCacheBytes.Set(rc.dbName, rc.bytes)
 }
 
 // Gets the body etc. out of a revCacheValue. If they aren't present already, the loader func
 // will be called. This is synchronized so that the loader will only be called once even if
 // multiple goroutines try to load at the same time.
-func (value *revCacheValue) load(loaderFunc RevisionCacheLoaderFunc) (Body, Body, base.Set, error) {
+// If the loader was called, also returns the estimated size of what it loaded.
+func (value *revCacheValue) load(loaderFunc RevisionCacheLoaderFunc, dbName string) (Body, Body, base.Set, int64, error) {
 	value.lock.Lock()
 	defer value.lock.Unlock()
+	var size int64
 	if value.body == nil && value.err == nil {
 		base.StatsExpvars.Add("revisionCache_misses", 1)
+		base.MetricRevCacheMisses.Add(dbName, 1)
 		if loaderFunc != nil {
 			value.body, value.history, value.channels, value.err = loaderFunc(value.key)
+			if value.err == nil {
+				size = estimateRevSize(value.body, value.history)
+			}
 		}
 	} else {
 		base.StatsExpvars.Add("revisionCache_hits", 1)
+		base.MetricRevCacheHits.Add(dbName, 1)
 	}
 	body := value.body
 	if body != nil {
 		body = body.ShallowCopy() // Never let the caller mutate the stored body
 	}
-	return body, value.history, value.channels, value.err
+	return body, value.history, value.channels, size, value.err
 }
 
 // Stores a body etc. into a revCacheValue if there isn't one already.
-func (value *revCacheValue) store(body Body, history Body, channels base.Set) {
+// Returns the estimated size of what was stored, or 0 if nothing was.
+func (value *revCacheValue) store(body Body, history Body, channels base.Set) (size int64) {
 	value.lock.Lock()
 	if value.body == nil {
 		value.body = body.ShallowCopy() // Don't store a body the caller might later mutate
@@ -135,6 +216,49 @@ func (value *revCacheValue) store(body Body, history Body, channels base.Set) {
 		value.channels = channels
 		value.err = nil
 		dbExpvars.Add("revisionCache_adds", 1)
+		size = estimateRevSize(value.body, value.history)
 	}
 	value.lock.Unlock()
+	return
+}
+
+// Roughly estimates how much memory a revision takes up, going by the size of its JSON form.
+// This is much cheaper than actually encoding it.
+func estimateRevSize(body Body, history Body) int64 {
+	return estimateJSONSize(map[string]interface{}(body)) + estimateJSONSize(map[string]interface{}(history))
+}
+
+func estimateJSONSize(value interface{}) int64 {
+	switch value := value.(type) {
+	case nil:
+		return 4
+	case bool:
+		return 5
+	case string:
+		return int64(len(value)) + 2
+	case []byte:
+		return int64(len(value))
+	case map[string]interface{}:
+		size := int64(2)
+		for key, item := range value {
+			size += int64(len(key)) + 4 + estimateJSONSize(item)
+		}
+		return size
+	case Body:
+		return estimateJSONSize(map[string]interface{}(value))
+	case []interface{}:
+		size := int64(2)
+		for _, item := range value {
+			size += estimateJSONSize(item) + 1
+		}
+		return size
+	case []string:
+		size := int64(2)
+		for _, item := range value {
+			size += int64(len(item)) + 3
+		}
+		return size
+	default:
+		return 8 // numbers, mostly
+	}
 }
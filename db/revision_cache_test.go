@@ -2,6 +2,7 @@ package db
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -101,3 +102,47 @@ func TestLoaderFunction(t *testing.T) {
 	assert.DeepEquals(t, err, base.HTTPErrorf(404, "missing"))
 	assert.Equals(t, callsToLoader, 3)
 }
+
+func TestRevisionCacheMaxBytes(t *testing.T) {
+	bigText := strings.Repeat("x", 1000)
+	cache := NewRevisionCache(100, nil)
+	cache.SetMaxBytes(5000)
+	for i := 0; i < 10; i++ {
+		cache.Put(Body{"_id": fmt.Sprintf("doc%d", i), "_rev": "1-a", "text": bigText}, Body{"start": 1}, nil)
+	}
+
+	// Only the newest revisions that fit in the byte budget are kept:
+	count, bytes := cache.Size()
+	assert.True(t, count >= 3 && count < 5)
+	assert.True(t, bytes <= 5000)
+	body, _, _, _ := cache.Get("doc0", "1-a")
+	assert.True(t, body == nil)
+	body, _, _, _ = cache.Get("doc9", "1-a")
+	assert.Equals(t, body["text"], bigText)
+
+	// Lowering the limit evicts more, but always keeps the newest:
+	cache.SetMaxBytes(10)
+	count, _ = cache.Size()
+	assert.Equals(t, count, 1)
+	body, _, _, _ = cache.Get("doc9", "1-a")
+	assert.Equals(t, body["text"], bigText)
+}
+
+func TestRevisionCacheInvalidate(t *testing.T) {
+	cache := NewRevisionCache(10, nil)
+	cache.Put(Body{"_id": "doc1", "_rev": "1-a"}, Body{"start": 1}, nil)
+	cache.Put(Body{"_id": "doc1", "_rev": "2-b"}, Body{"start": 2}, nil)
+	cache.Put(Body{"_id": "doc2", "_rev": "1-a"}, Body{"start": 1}, nil)
+
+	cache.Invalidate("doc1")
+	body, _, _, _ := cache.Get("doc1", "1-a")
+	assert.True(t, body == nil)
+	body, _, _, _ = cache.Get("doc1", "2-b")
+	assert.True(t, body == nil)
+	body, _, _, _ = cache.Get("doc2", "1-a")
+	assert.Equals(t, body["_id"], "doc2")
+
+	count, bytes := cache.Size()
+	assert.Equals(t, count, 1)
+	assert.Equals(t, bytes, estimateRevSize(Body{"_id": "doc2", "_rev": "1-a"}, Body{"start": 1}))
+}
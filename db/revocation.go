@@ -0,0 +1,130 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// For a changes feed with the Revocations option, adds a feed of "removed" entries for each channel
+// the user lost access to after the client's since value, so the client can purge the docs it
+// pulled from that channel.
+//
+// Removal entries for a revocation at sequence R have sequence IDs of the form R:docSeq (like a
+// backfill), so they're sent after every change before R and can be resumed if a limit cuts them
+// off.  They're only sent to clients whose since value shows they synced while they had access.
+func (db *Database) appendRevocationFeeds(feeds []<-chan *ChangeEntry, names []string, options ChangesOptions) ([]<-chan *ChangeEntry, []string) {
+	for channelName, revocation := range db.user.RevokedChannels() {
+		if !revocationApplies(options.Since, revocation) {
+			continue
+		}
+		for _, name := range db.expandRevokedChannel(channelName) {
+			if db.user.CanSeeChannel(name) {
+				continue // Access has been regained
+			}
+			entries, err := db.revokedChannelEntries(name, revocation, options.Since)
+			if err != nil {
+				db.LogContext.Warn("Unable to read changes of revoked channel %q: %v", name, err)
+				continue
+			}
+			if len(entries) == 0 {
+				continue
+			}
+			feed := make(chan *ChangeEntry, len(entries))
+			for _, entry := range entries {
+				feed <- entry
+			}
+			close(feed)
+			feeds = append(feeds, feed)
+			names = append(names, "revoked_"+name)
+		}
+	}
+	return feeds, names
+}
+
+// Returns true if a client at the given since value has to be told about a revocation: it has
+// synced since access was granted, but hasn't yet passed the revocation.
+func revocationApplies(since SequenceID, revocation auth.ChannelRevocation) bool {
+	if !since.Before(SequenceID{Seq: revocation.RevokedSeq}) {
+		return false
+	}
+	return since.Seq >= revocation.GrantedSeq || since.TriggeredBy >= revocation.GrantedSeq
+}
+
+// A revoked channel may be a prefix grant or the star channel; returns the channels it covered.
+func (db *Database) expandRevokedChannel(channelName string) []string {
+	if channelName != channels.UserStarChannel && !channels.IsPrefixGrant(channelName) {
+		return []string{channelName}
+	}
+	var result []string
+	for known := range db.changeCache.KnownChannels() {
+		if channelName == channels.UserStarChannel || channels.MatchesPrefixGrant(channelName, known) {
+			result = append(result, known)
+		}
+	}
+	return result
+}
+
+// Returns "removed" entries for the docs that were in the channel as of the revocation, that the
+// user can't see through any other channel, starting after since if it's partway through this
+// revocation's entries.  Only the channel's history up to the revocation is queried, and the docs'
+// current channels are read in bulk.
+func (db *Database) revokedChannelEntries(channelName string, revocation auth.ChannelRevocation, since SequenceID) ([]*ChangeEntry, error) {
+	var startAfter uint64
+	if since.TriggeredBy == revocation.RevokedSeq {
+		startAfter = since.Seq
+	}
+	if startAfter >= revocation.RevokedSeq {
+		return nil, nil
+	}
+	log, err := db.getChangesInChannelFromQuery(channelName, revocation.RevokedSeq, ChangesOptions{Since: SequenceID{Seq: startAfter}})
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]*LogEntry, 0, len(log))
+	docIDs := make([]string, 0, len(log))
+	for _, logEntry := range log {
+		if logEntry.Flags&(channels.Deleted|channels.Removed) != 0 {
+			continue // The client has already been told this doc is gone
+		}
+		candidates = append(candidates, logEntry)
+		docIDs = append(docIDs, logEntry.DocID)
+	}
+	docsSyncData := db.getDocsSyncData(docIDs)
+	var entries []*ChangeEntry
+	for _, logEntry := range candidates {
+		if db.docVisibleToUser(docsSyncData[logEntry.DocID]) {
+			continue
+		}
+		entries = append(entries, &ChangeEntry{
+			Seq:     SequenceID{Seq: logEntry.Sequence, TriggeredBy: revocation.RevokedSeq},
+			ID:      logEntry.DocID,
+			Removed: base.SetOf(channelName),
+			Changes: []ChangeRev{{"rev": logEntry.RevID}},
+			revoked: true,
+		})
+	}
+	return entries, nil
+}
+
+// Returns true if the doc, given its sync metadata, is currently in any channel the user can see.
+func (db *Database) docVisibleToUser(syncData *syncData) bool {
+	if syncData == nil {
+		return false
+	}
+	for channelName, removal := range syncData.Channels {
+		if removal == nil && db.user.CanSeeChannel(channelName) {
+			return true
+		}
+	}
+	return false
+}
@@ -26,12 +26,13 @@ type RevKey string
 
 // Information about a single revision.
 type RevInfo struct {
-	ID       string
-	Parent   string
-	Deleted  bool
-	Body     []byte
-	Channels base.Set
-	depth    uint32
+	ID        string
+	Parent    string
+	Deleted   bool
+	Body      []byte
+	Channels  base.Set
+	UpdatedBy string // Name of the user who wrote the revision, empty for admin writes or if unknown
+	depth     uint32
 }
 
 func (rev RevInfo) IsRoot() bool {
@@ -51,6 +52,7 @@ type revTreeList struct {
 	Bodies_Old []string          `json:"bodies,omitempty"`  // JSON of each revision (legacy)
 	BodyMap    map[string]string `json:"bodymap,omitempty"` // JSON of each revision
 	Channels   []base.Set        `json:"channels"`
+	UpdatedBy  map[string]string `json:"updated_by,omitempty"` // User who wrote each revision, if known
 }
 
 func (tree RevTree) MarshalJSON() ([]byte, error) {
@@ -73,6 +75,12 @@ func (tree RevTree) MarshalJSON() ([]byte, error) {
 			rep.BodyMap[strconv.FormatInt(int64(i), 10)] = string(info.Body)
 		}
 		rep.Channels[i] = info.Channels
+		if info.UpdatedBy != "" {
+			if rep.UpdatedBy == nil {
+				rep.UpdatedBy = make(map[string]string, 1)
+			}
+			rep.UpdatedBy[strconv.FormatInt(int64(i), 10)] = info.UpdatedBy
+		}
 		if info.Deleted {
 			if rep.Deleted == nil {
 				rep.Deleted = make([]int, 0, 1)
@@ -112,6 +120,9 @@ func (tree RevTree) UnmarshalJSON(inputjson []byte) (err error) {
 		if rep.Channels != nil {
 			info.Channels = rep.Channels[i]
 		}
+		if rep.UpdatedBy != nil {
+			info.UpdatedBy = rep.UpdatedBy[strconv.FormatInt(int64(i), 10)]
+		}
 		parentIndex := rep.Parents[i]
 		if parentIndex >= 0 {
 			info.Parent = rep.Revs[parentIndex]
@@ -575,9 +586,9 @@ func (tree RevTree) RenderGraphvizDot() string {
 // Parses a CouchDB _rev or _revisions property into a list of revision IDs
 func ParseRevisions(body Body) []string {
 	// http://wiki.apache.org/couchdb/HTTP_Document_API#GET
-	revisions, ok := body["_revisions"].(map[string]interface{})
+	revisions, ok := body.GetMap("_revisions")
 	if !ok {
-		revid, ok := body["_rev"].(string)
+		revid, ok := body.GetString("_rev")
 		if !ok {
 			return nil
 		}
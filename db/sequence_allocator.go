@@ -121,3 +121,16 @@ func (s *sequenceAllocator) releaseSequence(sequence uint64) error {
 	base.LogTo("CRUD+", "Released unused sequence #%d", sequence)
 	return err
 }
+
+// Releases the sequences that were reserved but never assigned, so the change cache doesn't wait
+// for them.  Called on shutdown.
+func (s *sequenceAllocator) releaseUnusedSequences() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.last < s.max {
+		s.last++
+		if err := s.releaseSequence(s.last); err != nil {
+			base.Warn("Error releasing unused sequence #%d: %v", s.last, err)
+		}
+	}
+}
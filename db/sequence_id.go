@@ -317,6 +317,30 @@ func ParseSequenceIDFromJSON(data []byte) (SequenceID, error) {
 	return seq, err
 }
 
+// Returns the sequence a client should checkpoint (the changes feed's last_seq) after receiving
+// an entry with sequence `next`, when s was its checkpoint before that.  An entry for a sequence
+// that arrived late can follow entries with later sequences; checkpointing it would make the client
+// receive all of those again, so the checkpoint never moves backwards.  Instead, if the late
+// sequence is the oldest one the checkpoint's LowSeq was waiting for, LowSeq moves past it, and it's
+// dropped once it catches up with Seq.
+func (s SequenceID) AdvanceCheckpoint(next SequenceID) SequenceID {
+	if s.SeqType == ClockSequenceType || next.SeqType == ClockSequenceType {
+		return next
+	}
+	current, candidate := s, next
+	current.LowSeq, candidate.LowSeq = 0, 0
+	if current.Before(candidate) {
+		return next
+	}
+	if s.LowSeq > 0 && next.TriggeredBy == 0 && next.Seq == s.LowSeq+1 {
+		s.LowSeq = next.Seq
+	}
+	if s.LowSeq >= s.Seq {
+		s.LowSeq = 0
+	}
+	return s
+}
+
 func (s SequenceID) SafeSequence() uint64 {
 	if s.LowSeq > 0 {
 		return s.LowSeq
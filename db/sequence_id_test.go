@@ -124,3 +124,30 @@ func TestCompareSequenceIDs(t *testing.T) {
 		}
 	}
 }
+
+func TestAdvanceCheckpoint(t *testing.T) {
+	var checkpoint SequenceID
+	checkpoint = checkpoint.AdvanceCheckpoint(SequenceID{Seq: 1})
+	assert.Equals(t, checkpoint.String(), "1")
+	checkpoint = checkpoint.AdvanceCheckpoint(SequenceID{Seq: 6, LowSeq: 2})
+	assert.Equals(t, checkpoint.String(), "2::6")
+
+	// Late sequences don't move the checkpoint back, but move LowSeq past the oldest missing one:
+	checkpoint = checkpoint.AdvanceCheckpoint(SequenceID{Seq: 4, LowSeq: 2})
+	assert.Equals(t, checkpoint.String(), "2::6")
+	checkpoint = checkpoint.AdvanceCheckpoint(SequenceID{Seq: 3, LowSeq: 2})
+	assert.Equals(t, checkpoint.String(), "3::6")
+	checkpoint = checkpoint.AdvanceCheckpoint(SequenceID{Seq: 4})
+	checkpoint = checkpoint.AdvanceCheckpoint(SequenceID{Seq: 5})
+	assert.Equals(t, checkpoint.String(), "5::6")
+	checkpoint = checkpoint.AdvanceCheckpoint(SequenceID{Seq: 6})
+	assert.Equals(t, checkpoint.String(), "6")
+
+	// Backfill sequences are ordered by the sequence that triggered them:
+	checkpoint = checkpoint.AdvanceCheckpoint(SequenceID{Seq: 3, TriggeredBy: 9})
+	assert.Equals(t, checkpoint.String(), "9:3")
+	checkpoint = checkpoint.AdvanceCheckpoint(SequenceID{Seq: 8})
+	assert.Equals(t, checkpoint.String(), "9:3")
+	checkpoint = checkpoint.AdvanceCheckpoint(SequenceID{Seq: 10})
+	assert.Equals(t, checkpoint.String(), "10")
+}
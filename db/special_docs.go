@@ -13,30 +13,38 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/couchbase/go-couchbase"
 	"github.com/couchbase/sync_gateway/base"
 )
 
+const (
+	kLocalDocKeyPrefix           = KSyncKeyPrefix + "local:"
+	kSpecialDocUpdatedAtProperty = "_updated_at" // Unix time a special doc was last written
+)
+
 func (db *Database) GetSpecial(doctype string, docid string) (Body, error) {
-	key := db.realSpecialDocID(doctype, docid)
-	if key == "" {
-		return nil, base.HTTPErrorf(400, "Invalid doc ID")
+	if err := db.checkCancelled(); err != nil {
+		return nil, err
 	}
+	key := db.realSpecialDocID(doctype, docid)
 
 	body := Body{}
 	_, err := db.Bucket.Get(key, &body)
 	if err != nil {
 		return nil, err
 	}
+	delete(body, kSpecialDocUpdatedAtProperty)
 	return body, nil
 }
 
 // Updates or deletes a special document.
 func (db *Database) putSpecial(doctype string, docid string, matchRev string, body Body) (string, error) {
-	key := db.realSpecialDocID(doctype, docid)
-	if key == "" {
-		return "", base.HTTPErrorf(400, "Invalid doc ID")
+	if err := db.checkCancelled(); err != nil {
+		return "", err
 	}
+	key := db.realSpecialDocID(doctype, docid)
 	var revid string
 
 	expiry, err := body.getExpiry()
@@ -48,6 +56,9 @@ func (db *Database) putSpecial(doctype string, docid string, matchRev string, bo
 			if matchRev != "" || body == nil {
 				return nil, base.HTTPErrorf(http.StatusNotFound, "No previous revision to replace")
 			}
+			if err := db.checkDocIDFormat(docid); err != nil {
+				return nil, err
+			}
 		} else {
 			prevBody := Body{}
 			if err := json.Unmarshal(value, &prevBody); err != nil {
@@ -66,7 +77,12 @@ func (db *Database) putSpecial(doctype string, docid string, matchRev string, bo
 			}
 			revid = fmt.Sprintf("0-%d", generation+1)
 			body["_rev"] = revid
-			return json.Marshal(body)
+			body[kSpecialDocUpdatedAtProperty] = time.Now().Unix()
+			data, err := json.Marshal(body)
+			if err == nil && doctype == "local" && int64(len(data)) > db.MaxLocalDocBytes() {
+				return nil, base.HTTPErrorf(http.StatusRequestEntityTooLarge, "_local doc is larger than the limit of %d bytes", db.MaxLocalDocBytes())
+			}
+			return data, err
 		} else {
 			// Deleting:
 			return nil, nil
@@ -79,7 +95,11 @@ func (db *Database) putSpecial(doctype string, docid string, matchRev string, bo
 func (db *Database) PutSpecial(doctype string, docid string, body Body) (string, error) {
 	matchRev, _ := body["_rev"].(string)
 	body = stripSpecialSpecialProperties(body)
-	return db.putSpecial(doctype, docid, matchRev, body)
+	revid, err := db.putSpecial(doctype, docid, matchRev, body)
+	if err == nil && doctype == "local" {
+		db.recordCheckpoint(body)
+	}
+	return revid, err
 }
 
 func (db *Database) DeleteSpecial(doctype string, docid string, revid string) error {
@@ -87,6 +107,71 @@ func (db *Database) DeleteSpecial(doctype string, docid string, revid string) er
 	return err
 }
 
+// Size and last-modified time of a _local doc, as listed by ListLocalDocs.
+type LocalDocInfo struct {
+	ID        string     `json:"id"`
+	Size      int        `json:"size"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"` // Unknown if the doc was last written by an older version
+}
+
+// Lists the _local docs, in order of doc ID.
+func (db *Database) ListLocalDocs() ([]LocalDocInfo, error) {
+	vres, err := db.Bucket.View(db.DesignDocName(DesignDocSyncHousekeeping, ViewLocalDocs), ViewLocalDocs, Body{"stale": false})
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]LocalDocInfo, 0, len(vres.Rows))
+	for _, row := range vres.Rows {
+		docid, _ := row.Key.(string)
+		info := LocalDocInfo{ID: "_local/" + docid}
+		if value, ok := row.Value.(map[string]interface{}); ok {
+			if size, ok := base.ToInt64(value["size"]); ok {
+				info.Size = int(size)
+			}
+			if updatedAt, ok := base.ToInt64(value["updated_at"]); ok {
+				t := time.Unix(updatedAt, 0).UTC()
+				info.UpdatedAt = &t
+			}
+		}
+		docs = append(docs, info)
+	}
+	return docs, nil
+}
+
+// Deletes the _local docs that haven't been written since before the given time, and returns
+// their IDs.  Docs last written by an older version, which didn't record the time, are kept.
+func (db *Database) PurgeLocalDocs(before time.Time) ([]string, error) {
+	docs, err := db.ListLocalDocs()
+	if err != nil {
+		return nil, err
+	}
+	purged := []string{}
+	for _, info := range docs {
+		if info.UpdatedAt == nil || !info.UpdatedAt.Before(before) {
+			continue
+		}
+		docid := info.ID[len("_local/"):]
+		err := db.Bucket.Update(db.realSpecialDocID("local", docid), 0, func(value []byte) ([]byte, error) {
+			// Check again, in case the doc was written since the view query:
+			var body Body
+			if len(value) == 0 || json.Unmarshal(value, &body) != nil {
+				return nil, couchbase.UpdateCancel
+			}
+			if updatedAt, ok := base.ToInt64(body[kSpecialDocUpdatedAtProperty]); !ok || updatedAt >= before.Unix() {
+				return nil, couchbase.UpdateCancel
+			}
+			return nil, nil
+		})
+		if err == nil {
+			purged = append(purged, info.ID)
+		} else if err != couchbase.UpdateCancel && !base.IsDocNotFoundError(err) {
+			return purged, err
+		}
+	}
+	db.LogContext.LogTo("CRUD", "Purged %d _local docs last written before %v", len(purged), before)
+	return purged, nil
+}
+
 func (db *Database) realSpecialDocID(doctype string, docid string) string {
 	return "_sync:" + doctype + ":" + docid
 }
@@ -0,0 +1,189 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// A sync function's epoch is a digest of its source.  Whenever the sync function computes a doc's
+// channels and access, the doc's _sync metadata records the epoch, so after the function changes
+// (without a _resync) the docs whose channels were computed by an older one can be told apart,
+// counted with the sync_fn_epochs view, and resynced on their own.  Docs written before epochs
+// were recorded have the empty epoch.  It isn't known which function computed their channels, so
+// they aren't counted as stale, flagged or resynced on their own; a full resync only rewrites them
+// if their channels or access change, rather than rewriting every doc.  Epochs aren't recorded while the cluster compatibility
+// version is below SyncMetadataVersion3, so then docs aren't told apart by them.
+
+// Max number of changes entries whose docs' sync function epochs are read at once
+const kSyncFnEpochBatchSize = 50
+
+// Returns the epoch of a sync function's source; "" is the default sync function.
+func syncFnEpoch(syncFun string) string {
+	digest := sha1.Sum([]byte(syncFun))
+	return hex.EncodeToString(digest[0:8])
+}
+
+// Returns the epoch of the database's current sync function.
+func (context *DatabaseContext) SyncFnEpoch() string {
+	context.configLock.RLock()
+	defer context.configLock.RUnlock()
+	if context.syncFnEpoch == "" {
+		return syncFnEpoch("")
+	}
+	return context.syncFnEpoch
+}
+
+// Whether docs record the epoch of the sync function that computed their channels.
+func (context *DatabaseContext) recordsSyncFnEpochs() bool {
+	return context.syncMetadataWriteVersion() >= SyncMetadataVersion3
+}
+
+// The number of docs on each sync function epoch, as returned by GET /db/_sync_fn_epochs
+type SyncFnEpochCounts struct {
+	Current   string         `json:"current"`    // Epoch of the current sync function
+	Docs      map[string]int `json:"docs"`       // Number of docs on each epoch; "" for docs older than epochs
+	StaleDocs int            `json:"stale_docs"` // Number of docs on older epochs, which a _resync would recompute
+}
+
+// Counts the docs on each sync function epoch, with a reduce over the sync_fn_epochs view.
+func (context *DatabaseContext) GetSyncFnEpochCounts() (*SyncFnEpochCounts, error) {
+	opts := Body{"stale": false, "reduce": true, "group_level": 1}
+	vres, err := context.Bucket.View(context.DesignDocName(DesignDocSyncHousekeeping, ViewSyncFnEpochs), ViewSyncFnEpochs, opts)
+	if err != nil {
+		return nil, err
+	}
+	counts := &SyncFnEpochCounts{Current: context.SyncFnEpoch(), Docs: map[string]int{}}
+	for _, row := range vres.Rows {
+		key, ok := row.Key.([]interface{})
+		if !ok || len(key) < 1 {
+			continue
+		}
+		if epoch, ok := key[0].(string); ok {
+			count := viewRowCount(row.Value)
+			counts.Docs[epoch] = count
+			if epoch != "" && epoch != counts.Current {
+				counts.StaleDocs += count
+			}
+		}
+	}
+	return counts, nil
+}
+
+// A doc's ID and sync function epoch, as listed by the sync_fn_epochs view
+type epochDocID struct {
+	epoch, docID string
+}
+
+// Returns up to limit docs on older sync function epochs than the current one, in [epoch, docid]
+// order, starting after the given epoch and doc ID (both "" to start at the beginning.)
+func (db *Database) staleSyncFnDocs(afterEpoch, afterDocID string, limit int) (docs []epochDocID, err error) {
+	current := db.SyncFnEpoch()
+	query := func(startKey, endKey interface{}) error {
+		opts := Body{"stale": false, "reduce": false, "startkey": startKey, "limit": limit - len(docs) + 1}
+		if endKey != nil {
+			opts["endkey"] = endKey
+		}
+		vres, err := db.Bucket.View(db.DesignDocName(DesignDocSyncHousekeeping, ViewSyncFnEpochs), ViewSyncFnEpochs, opts)
+		if err != nil {
+			return err
+		}
+		for _, row := range vres.Rows {
+			key, ok := row.Key.([]interface{})
+			if !ok || len(key) < 2 || len(docs) >= limit {
+				continue
+			}
+			epoch, _ := key[0].(string)
+			docid, _ := key[1].(string)
+			if epoch == afterEpoch && docid == afterDocID {
+				continue // startkey is inclusive, and this doc was already returned
+			}
+			docs = append(docs, epochDocID{epoch, docid})
+		}
+		return nil
+	}
+
+	// The docs on the current epoch are skipped by querying the key ranges before and after it,
+	// and the docs on the empty epoch by starting after them.  (The current epoch is never "".)
+	startKey := []interface{}{afterEpoch, afterDocID}
+	if afterEpoch == "" {
+		startKey = []interface{}{"", map[string]interface{}{}}
+	}
+	if afterEpoch < current {
+		if err = query(startKey, []interface{}{current}); err != nil || len(docs) >= limit {
+			return docs, err
+		}
+		startKey = []interface{}{current, map[string]interface{}{}}
+	}
+	err = query(startKey, nil)
+	return docs, err
+}
+
+// Passes on the entries of a changes feed, flagging those whose docs' channels were computed by an
+// older sync function.  The docs' metadata is read in bulk, for the entries that are ready at once.
+func (db *Database) flagStaleSyncFnEpochs(input <-chan *ChangeEntry, terminator chan bool) <-chan *ChangeEntry {
+	output := make(chan *ChangeEntry, kSyncFnEpochBatchSize)
+	go func() {
+		defer close(output)
+		for entry := range input {
+			batch := []*ChangeEntry{entry}
+			// A nil entry tells the reader that the feed is waiting, so it's passed on right away:
+		gather:
+			for entry != nil && len(batch) < kSyncFnEpochBatchSize {
+				select {
+				case next, ok := <-input:
+					if !ok {
+						break gather
+					}
+					entry = next
+					batch = append(batch, entry)
+				default:
+					break gather
+				}
+			}
+			db.flagStaleSyncFnEpoch(batch)
+			for _, entry := range batch {
+				select {
+				case <-terminator:
+					return
+				case output <- entry:
+				}
+			}
+		}
+	}()
+	return output
+}
+
+// Flags the changes entries whose docs' channels were computed by an older sync function.
+func (db *Database) flagStaleSyncFnEpoch(entries []*ChangeEntry) {
+	if !db.recordsSyncFnEpochs() {
+		return
+	}
+	docids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry != nil && !entry.pseudoDoc {
+			docids = append(docids, entry.ID)
+		}
+	}
+	if len(docids) == 0 {
+		return
+	}
+	docsSyncData := db.getDocsSyncData(docids)
+	current := db.SyncFnEpoch()
+	for _, entry := range entries {
+		if entry == nil || entry.pseudoDoc {
+			continue
+		}
+		if syncData := docsSyncData[entry.ID]; syncData != nil {
+			entry.OldSyncFn = syncData.SyncFnEpoch != "" && syncData.SyncFnEpoch != current
+		}
+	}
+}
@@ -0,0 +1,152 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestSyncFnEpochs(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	_, err := db.UpdateSyncFun(`function(doc) {channel(doc.channels);}`)
+	assertNoError(t, err, "UpdateSyncFun")
+	oldEpoch := db.SyncFnEpoch()
+	for i := 0; i < 5; i++ {
+		_, err = db.Put(fmt.Sprintf("doc%d", i), Body{"channels": []string{"ABC"}})
+		assertNoError(t, err, "Put")
+	}
+	db.changeCache.waitForSequence(5)
+
+	counts, err := db.GetSyncFnEpochCounts()
+	assertNoError(t, err, "GetSyncFnEpochCounts")
+	assert.Equals(t, counts.Current, oldEpoch)
+	assert.DeepEquals(t, counts.Docs, map[string]int{oldEpoch: 5})
+	assert.Equals(t, counts.StaleDocs, 0)
+
+	// Changing the sync function leaves the docs on the old epoch until they're written:
+	_, err = db.UpdateSyncFun(`function(doc) {channel(doc.channels); channel("all");}`)
+	assertNoError(t, err, "UpdateSyncFun")
+	newEpoch := db.SyncFnEpoch()
+	assert.NotEquals(t, newEpoch, oldEpoch)
+	_, err = db.Put("doc5", Body{"channels": []string{"ABC"}})
+	assertNoError(t, err, "Put")
+	db.changeCache.waitForSequence(6)
+
+	counts, err = db.GetSyncFnEpochCounts()
+	assertNoError(t, err, "GetSyncFnEpochCounts")
+	assert.DeepEquals(t, counts.Docs, map[string]int{oldEpoch: 5, newEpoch: 1})
+	assert.Equals(t, counts.StaleDocs, 5)
+
+	// The stale docs can be listed in batches:
+	docs, err := db.staleSyncFnDocs("", "", 3)
+	assertNoError(t, err, "staleSyncFnDocs")
+	assert.DeepEquals(t, docs, []epochDocID{{oldEpoch, "doc0"}, {oldEpoch, "doc1"}, {oldEpoch, "doc2"}})
+	docs, err = db.staleSyncFnDocs(oldEpoch, "doc2", 3)
+	assertNoError(t, err, "staleSyncFnDocs")
+	assert.DeepEquals(t, docs, []epochDocID{{oldEpoch, "doc3"}, {oldEpoch, "doc4"}})
+
+	// The changes feed flags their entries if asked to:
+	options := getZeroSequence(db)
+	options.SyncFnEpoch = true
+	changes, err := db.GetChanges(base.SetOf("*"), options)
+	assertNoError(t, err, "GetChanges")
+	assert.Equals(t, len(changes), 6)
+	for _, change := range changes {
+		assert.Equals(t, change.OldSyncFn, change.ID != "doc5")
+	}
+
+	// A stale-only _resync processes just those docs:
+	atomic.StoreUint32(&db.State, DBOffline)
+	assertNoError(t, db.StartResync(0, true), "StartResync")
+	var status ResyncStatus
+	for i := 0; i < 100; i++ {
+		if status = db.GetResyncStatus(); status.State != ResyncStateRunning {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equals(t, status.State, ResyncStateCompleted)
+	assert.True(t, status.StaleOnly)
+	assert.Equals(t, status.DocsTotal, 5)
+	assert.Equals(t, status.DocsProcessed, 5)
+
+	counts, err = db.GetSyncFnEpochCounts()
+	assertNoError(t, err, "GetSyncFnEpochCounts")
+	assert.DeepEquals(t, counts.Docs, map[string]int{newEpoch: 6})
+	assert.Equals(t, counts.StaleDocs, 0)
+	doc, err := db.GetDoc("doc3")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.SyncFnEpoch, newEpoch)
+	_, found := doc.Channels["all"]
+	assert.True(t, found)
+}
+
+// Docs from before epochs were recorded aren't counted as stale, and a resync only rewrites them
+// if their channels change.
+func TestPreEpochDocs(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	_, err := db.UpdateSyncFun(`function(doc) {channel(doc.channels);}`)
+	assertNoError(t, err, "UpdateSyncFun")
+	db.Options.ClusterCompatVersion = SyncMetadataVersion2
+	for i := 0; i < 3; i++ {
+		_, err = db.Put(fmt.Sprintf("doc%d", i), Body{"channels": []string{"ABC"}, "extra": fmt.Sprintf("X%d", i)})
+		assertNoError(t, err, "Put")
+	}
+	db.changeCache.waitForSequence(3)
+	db.Options.ClusterCompatVersion = SyncMetadataVersion3
+
+	counts, err := db.GetSyncFnEpochCounts()
+	assertNoError(t, err, "GetSyncFnEpochCounts")
+	assert.DeepEquals(t, counts.Docs, map[string]int{"": 3})
+	assert.Equals(t, counts.StaleDocs, 0)
+	docs, err := db.staleSyncFnDocs("", "", 10)
+	assertNoError(t, err, "staleSyncFnDocs")
+	assert.Equals(t, len(docs), 0)
+	options := getZeroSequence(db)
+	options.SyncFnEpoch = true
+	changes, err := db.GetChanges(base.SetOf("*"), options)
+	assertNoError(t, err, "GetChanges")
+	assert.Equals(t, len(changes), 3)
+	for _, change := range changes {
+		assert.False(t, change.OldSyncFn)
+	}
+
+	// Only doc1's channels change:
+	_, err = db.UpdateSyncFun(`function(doc) {channel(doc.channels); if (doc.extra == "X1") {channel("X1");}}`)
+	assertNoError(t, err, "UpdateSyncFun")
+	atomic.StoreUint32(&db.State, DBOffline)
+	assertNoError(t, db.StartResync(0, false), "StartResync")
+	var status ResyncStatus
+	for i := 0; i < 100; i++ {
+		if status = db.GetResyncStatus(); status.State != ResyncStateRunning {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equals(t, status.State, ResyncStateCompleted)
+	assert.Equals(t, status.DocsProcessed, 3)
+
+	doc, err := db.GetDoc("doc0")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.SyncFnEpoch, "")
+	doc, err = db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.SyncFnEpoch, db.SyncFnEpoch())
+}
@@ -0,0 +1,116 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Versions of the format of a doc's _sync metadata, stored in its "ver" property.  Metadata
+// written before the format was versioned has no "ver", and is version 1.
+//
+// During a rolling upgrade the nodes of a cluster run different builds, so a node mustn't write
+// metadata that the other nodes can't read.  Each database has a cluster compatibility version
+// (DatabaseContextOptions.ClusterCompatVersion) that is the highest version every node supports;
+// docs are written in that version, and it's raised once every node has been upgraded.
+const (
+	SyncMetadataVersion1 = 1 // The original, unversioned format
+	SyncMetadataVersion2 = 2 // Adds "ver" and "updated_by", of the doc and of each revision
+	SyncMetadataVersion3 = 3 // Adds "body_key", "ops" and "sync_fn"
+
+	MinSyncMetadataVersion = SyncMetadataVersion1
+	MaxSyncMetadataVersion = SyncMetadataVersion3 // The highest version this build can read and write
+)
+
+// Converts metadata between a version and the one before it.  upgrade converts metadata from the
+// previous version, and downgrade converts it back, dropping whatever the previous version can't
+// represent.  Either may be nil if there's nothing to convert.
+type syncMetadataMigration struct {
+	upgrade   func(s *syncData)
+	downgrade func(s *syncData)
+}
+
+// The migrations to each version from the one before it.
+var syncMetadataMigrations = map[int]syncMetadataMigration{
+	SyncMetadataVersion2: {
+		downgrade: func(s *syncData) {
+			s.UpdatedBy = ""
+			for _, info := range s.History {
+				info.UpdatedBy = ""
+			}
+		},
+	},
+	// Below version 3 bodies are written inline (see outOfLineBodiesAllowed), so "body_key" is
+	// already gone by the time a doc is downgraded.
+	SyncMetadataVersion3: {
+		downgrade: func(s *syncData) {
+			s.Operations = nil
+			s.SyncFnEpoch = ""
+		},
+	},
+}
+
+// Checks that a cluster compatibility version is one this build supports.
+func ValidateClusterCompatVersion(version int) error {
+	if version < MinSyncMetadataVersion || version > MaxSyncMetadataVersion {
+		return fmt.Errorf("Invalid cluster_compat_version %d; this version of Sync Gateway supports %d to %d",
+			version, MinSyncMetadataVersion, MaxSyncMetadataVersion)
+	}
+	return nil
+}
+
+// The metadata version docs are written in: the cluster compatibility version, which defaults to
+// the highest version this build supports.
+func (context *DatabaseContext) syncMetadataWriteVersion() int {
+	if version := context.GetOptions().ClusterCompatVersion; version != 0 {
+		return version
+	}
+	return MaxSyncMetadataVersion
+}
+
+// The version of the metadata's format.
+func (s *syncData) metadataVersion() int {
+	if s.Version == 0 {
+		return SyncMetadataVersion1
+	}
+	return s.Version
+}
+
+// Returns an error if the metadata was written in a newer format than this build can read.  Reading
+// it anyway could silently misinterpret it, or lose its new properties when the doc is next written.
+func (s *syncData) checkMetadataVersion() error {
+	if s == nil || s.metadataVersion() <= MaxSyncMetadataVersion {
+		return nil
+	}
+	return base.HTTPErrorf(501, "Doc has sync metadata version %d, but this version of Sync Gateway only supports up to %d",
+		s.metadataVersion(), MaxSyncMetadataVersion)
+}
+
+// Migrates the metadata to another version, one version at a time, before it's written.  Docs are
+// upgraded lazily, the next time they're written after the cluster compatibility version is raised.
+func (s *syncData) migrateMetadata(version int) {
+	for current := s.metadataVersion(); current < version; current++ {
+		if upgrade := syncMetadataMigrations[current+1].upgrade; upgrade != nil {
+			upgrade(s)
+		}
+	}
+	for current := s.metadataVersion(); current > version; current-- {
+		if downgrade := syncMetadataMigrations[current].downgrade; downgrade != nil {
+			downgrade(s)
+		}
+	}
+	if version == SyncMetadataVersion1 {
+		s.Version = 0 // Version 1 nodes don't know about "ver"
+	} else {
+		s.Version = version
+	}
+}
@@ -0,0 +1,103 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestUnsupportedSyncMetadataVersion(t *testing.T) {
+	doc, err := unmarshalDocument("doc1", []byte(`{"_sync":{"rev":"1-a","sequence":1,"ver":2},"k":"v"}`))
+	assertNoError(t, err, "unmarshalDocument")
+	assert.Equals(t, doc.metadataVersion(), SyncMetadataVersion2)
+
+	_, err = unmarshalDocument("doc1", []byte(`{"_sync":{"rev":"1-a","sequence":1,"ver":99},"k":"v"}`))
+	assertHTTPError(t, err, 501)
+	_, err = UnmarshalDocumentSyncData([]byte(`{"_sync":{"rev":"1-a","ver":99}}`), false)
+	assertHTTPError(t, err, 501)
+	doc = newDocument("doc1")
+	err = doc.UnmarshalWithXattr([]byte(`{"k":"v"}`), []byte(`{"rev":"1-a","ver":99}`))
+	assertHTTPError(t, err, 501)
+
+	assert.True(t, ValidateClusterCompatVersion(SyncMetadataVersion1) == nil)
+	assert.True(t, ValidateClusterCompatVersion(MaxSyncMetadataVersion) == nil)
+	assert.True(t, ValidateClusterCompatVersion(MaxSyncMetadataVersion+1) != nil)
+	assert.True(t, ValidateClusterCompatVersion(0) != nil)
+}
+
+func TestMigrateSyncMetadata(t *testing.T) {
+	s := syncData{CurrentRev: "1-a", UpdatedBy: "alice"}
+	assert.Equals(t, s.metadataVersion(), SyncMetadataVersion1)
+
+	s.migrateMetadata(SyncMetadataVersion2)
+	assert.Equals(t, s.Version, SyncMetadataVersion2)
+	assert.Equals(t, s.UpdatedBy, "alice")
+
+	// Version 1 has no "ver" or "updated_by":
+	s.migrateMetadata(SyncMetadataVersion1)
+	assert.Equals(t, s.Version, 0)
+	assert.Equals(t, s.UpdatedBy, "")
+
+	// Version 2 has no "ops" or "sync_fn":
+	s = syncData{CurrentRev: "1-a", UpdatedBy: "alice", SyncFnEpoch: "abc", Operations: []operationRecord{{ID: "op1", Rev: "1-a"}}}
+	s.migrateMetadata(SyncMetadataVersion3)
+	assert.Equals(t, s.Version, SyncMetadataVersion3)
+	assert.Equals(t, len(s.Operations), 1)
+	s.migrateMetadata(SyncMetadataVersion2)
+	assert.Equals(t, s.Version, SyncMetadataVersion2)
+	assert.Equals(t, s.UpdatedBy, "alice")
+	assert.Equals(t, s.SyncFnEpoch, "")
+	assert.True(t, s.Operations == nil)
+}
+
+func TestSyncMetadataUpgradeOnWrite(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// While some nodes only support version 1, docs are written in version 1:
+	db.Options.ClusterCompatVersion = SyncMetadataVersion1
+	revid, err := db.Put("doc1", Body{"k": "v1"})
+	assertNoError(t, err, "Put")
+	doc, err := db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.Version, 0)
+
+	// Once the cluster is upgraded, the doc's metadata is upgraded the next time it's written:
+	db.Options.ClusterCompatVersion = SyncMetadataVersion2
+	doc, err = db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.Version, 0)
+	_, err = db.Put("doc1", Body{"k": "v2", "_rev": revid})
+	assertNoError(t, err, "Put")
+	doc, err = db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.Version, SyncMetadataVersion2)
+
+	// Below version 3, docs are written without the properties older nodes don't know about:
+	_, err = db.WithOperationID("op1").Put("doc2", Body{"k": "v"})
+	assertNoError(t, err, "Put")
+	doc, err = db.GetDoc("doc2")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.Version, SyncMetadataVersion2)
+	assert.Equals(t, doc.SyncFnEpoch, "")
+	assert.Equals(t, len(doc.Operations), 0)
+
+	// New docs are written in the highest version by default:
+	db.Options.ClusterCompatVersion = 0
+	_, err = db.WithOperationID("op2").Put("doc3", Body{"k": "v"})
+	assertNoError(t, err, "Put")
+	doc, err = db.GetDoc("doc3")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.Version, MaxSyncMetadataVersion)
+	assert.True(t, doc.SyncFnEpoch != "")
+	assert.Equals(t, len(doc.Operations), 1)
+}
@@ -0,0 +1,115 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	DefaultSyncRejectionLogSize  = 100  // Number of recent sync function rejections remembered
+	kMaxSyncRejectionMessages    = 1000 // Max distinct rejection messages counted
+	kOtherSyncRejectionsMessage  = "(other)"
+	kHiddenSyncRejectionsMessage = "Document rejected by sync function"
+)
+
+// A document revision rejected by the sync function.
+type SyncRejection struct {
+	DocID   string    `json:"doc_id"`
+	RevID   string    `json:"rev_id,omitempty"`
+	User    string    `json:"user,omitempty"` // Empty for the admin API
+	Status  int       `json:"status"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Remembers a database's most recent sync function rejections, in a ring buffer, and counts all
+// of them by message.
+type syncRejectionLog struct {
+	lock    sync.Mutex
+	entries []SyncRejection
+	next    int  // Index in entries where the next rejection goes
+	full    bool // True once entries has wrapped around
+	counts  map[string]int64
+}
+
+func newSyncRejectionLog(size int) *syncRejectionLog {
+	return &syncRejectionLog{
+		entries: make([]SyncRejection, size),
+		counts:  map[string]int64{},
+	}
+}
+
+func (l *syncRejectionLog) add(rejection SyncRejection) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.entries) > 0 {
+		l.entries[l.next] = rejection
+		if l.next = (l.next + 1) % len(l.entries); l.next == 0 {
+			l.full = true
+		}
+	}
+	// Messages can include doc contents, so don't let the number of counters grow without limit:
+	if _, found := l.counts[rejection.Message]; found || len(l.counts) < kMaxSyncRejectionMessages {
+		l.counts[rejection.Message]++
+	} else {
+		l.counts[kOtherSyncRejectionsMessage]++
+	}
+}
+
+// Returns the recent rejections, oldest first.
+func (l *syncRejectionLog) recent() []SyncRejection {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.full {
+		return append([]SyncRejection(nil), l.entries[:l.next]...)
+	}
+	result := make([]SyncRejection, 0, len(l.entries))
+	result = append(result, l.entries[l.next:]...)
+	return append(result, l.entries[:l.next]...)
+}
+
+func (l *syncRejectionLog) countsByMessage() map[string]int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	counts := make(map[string]int64, len(l.counts))
+	for message, count := range l.counts {
+		counts[message] = count
+	}
+	return counts
+}
+
+// Returns the database's most recent sync function rejections, oldest first.
+func (context *DatabaseContext) RecentSyncRejections() []SyncRejection {
+	return context.syncRejections.recent()
+}
+
+// Returns the number of sync function rejections since the database was opened, by message.
+func (context *DatabaseContext) SyncRejectionCounts() map[string]int64 {
+	return context.syncRejections.countsByMessage()
+}
+
+// Records a sync function rejection.  Returns the error to give the client, which is a generic one
+// if the database hides rejection messages from the public API.
+func (db *Database) recordSyncRejection(docid, revid string, rejection error) error {
+	status, message := base.ErrorAsHTTPStatus(rejection)
+	entry := SyncRejection{DocID: docid, RevID: revid, Status: status, Message: message, Time: time.Now()}
+	if db.user != nil {
+		entry.User = db.user.Name()
+	}
+	db.syncRejections.add(entry)
+	if db.user != nil && db.GetOptions().HideSyncRejectionMessages {
+		return base.HTTPErrorf(status, kHiddenSyncRejectionsMessage)
+	}
+	return rejection
+}
@@ -0,0 +1,55 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestSyncRejectionLog(t *testing.T) {
+	log := newSyncRejectionLog(3)
+	assert.Equals(t, len(log.recent()), 0)
+
+	log.add(SyncRejection{DocID: "doc1", Message: "nope"})
+	log.add(SyncRejection{DocID: "doc2", Message: "nope"})
+	recent := log.recent()
+	assert.Equals(t, len(recent), 2)
+	assert.Equals(t, recent[0].DocID, "doc1")
+	assert.Equals(t, recent[1].DocID, "doc2")
+
+	// Wrap around; the oldest entries are dropped:
+	log.add(SyncRejection{DocID: "doc3", Message: "no way"})
+	log.add(SyncRejection{DocID: "doc4", Message: "nope"})
+	recent = log.recent()
+	assert.Equals(t, len(recent), 3)
+	assert.Equals(t, recent[0].DocID, "doc2")
+	assert.Equals(t, recent[1].DocID, "doc3")
+	assert.Equals(t, recent[2].DocID, "doc4")
+
+	// Counts cover all rejections, not just the recent ones:
+	counts := log.countsByMessage()
+	assert.Equals(t, counts["nope"], int64(3))
+	assert.Equals(t, counts["no way"], int64(1))
+}
+
+func TestSyncRejectionLogMaxMessages(t *testing.T) {
+	log := newSyncRejectionLog(1)
+	for i := 0; i < kMaxSyncRejectionMessages+10; i++ {
+		log.add(SyncRejection{Message: fmt.Sprintf("message %d", i)})
+	}
+	log.add(SyncRejection{Message: "message 0"})
+	counts := log.countsByMessage()
+	assert.Equals(t, len(counts), kMaxSyncRejectionMessages+1)
+	assert.Equals(t, counts["message 0"], int64(2))
+	assert.Equals(t, counts[kOtherSyncRejectionsMessage], int64(10))
+}
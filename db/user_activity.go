@@ -0,0 +1,260 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Each node notes the latest changes request and checkpoint write of each user in memory, and every
+// kUserActivityFlushInterval merges them into a per-user doc in the bucket, so support tooling can
+// tell how far behind a user's replication is without scanning logs.  An activity is only recorded
+// for a named user, not for the admin API or the guest.
+
+// Prefix of the docs holding each user's activity
+const kUserActivityKeyPrefix = KSyncKeyPrefix + "user_activity:"
+
+// How often a node merges the activity it's seen into the stored activity
+const kUserActivityFlushInterval = 10 * time.Second
+
+// What's shown instead of a time or sequence for an activity a user hasn't done.
+const UserActivityNever = "never"
+
+// A user's latest replication activity, as stored in the bucket.
+type userActivity struct {
+	ChangesAt      *time.Time `json:"changes_at,omitempty"`      // Time of the latest changes request
+	ChangesSince   string     `json:"changes_since,omitempty"`   // Its since value
+	CheckpointAt   *time.Time `json:"checkpoint_at,omitempty"`   // Time of the latest checkpoint (_local doc) write
+	CheckpointSeq  string     `json:"checkpoint_seq,omitempty"`  // The sequence it recorded, if there was one
+	CheckpointPull bool       `json:"checkpoint_pull,omitempty"` // True if that's a sequence of this database, pulled by the client
+}
+
+// Merges in another record of the activity, keeping the later of each.
+func (activity *userActivity) merge(other *userActivity) {
+	if other.ChangesAt != nil && (activity.ChangesAt == nil || other.ChangesAt.After(*activity.ChangesAt)) {
+		activity.ChangesAt = other.ChangesAt
+		activity.ChangesSince = other.ChangesSince
+	}
+	if other.CheckpointAt != nil && (activity.CheckpointAt == nil || other.CheckpointAt.After(*activity.CheckpointAt)) {
+		activity.CheckpointAt = other.CheckpointAt
+		activity.CheckpointSeq = other.CheckpointSeq
+		activity.CheckpointPull = other.CheckpointPull
+	}
+}
+
+// Keeps the activity a node has seen until it's flushed.
+type userActivityTracker struct {
+	context    *DatabaseContext
+	lock       sync.Mutex
+	pending    map[string]*userActivity // Activity seen since the last flush, by user name
+	terminator chan struct{}            // Closed to stop the background task
+	done       chan struct{}            // Closed when the background task has stopped
+}
+
+func newUserActivityTracker(context *DatabaseContext) *userActivityTracker {
+	tracker := &userActivityTracker{
+		context:    context,
+		pending:    map[string]*userActivity{},
+		terminator: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go tracker.run()
+	return tracker
+}
+
+// Flushes the activity periodically until stopped.
+func (tracker *userActivityTracker) run() {
+	defer close(tracker.done)
+	ticker := time.NewTicker(kUserActivityFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := tracker.flush(); err != nil {
+				base.Warn("Couldn't save the user activity of database %q: %v", tracker.context.Name, err)
+			}
+		case <-tracker.terminator:
+			return
+		}
+	}
+}
+
+func (tracker *userActivityTracker) record(username string, activity userActivity) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if pending := tracker.pending[username]; pending != nil {
+		pending.merge(&activity)
+	} else {
+		tracker.pending[username] = &activity
+	}
+}
+
+// Returns a user's activity: the stored activity merged with what this node hasn't flushed yet.
+func (tracker *userActivityTracker) get(username string) (*userActivity, error) {
+	activity := &userActivity{}
+	rawActivity, _, err := tracker.context.Bucket.GetRaw(kUserActivityKeyPrefix + username)
+	if err == nil {
+		if err = json.Unmarshal(rawActivity, activity); err != nil {
+			return nil, err
+		}
+	} else if !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if pending := tracker.pending[username]; pending != nil {
+		activity.merge(pending)
+	}
+	return activity, nil
+}
+
+// Merges the activity seen since the last flush into the stored activity.  Whatever can't be
+// saved is kept for the next flush, unless newer activity has been seen since.
+func (tracker *userActivityTracker) flush() error {
+	tracker.lock.Lock()
+	pending := tracker.pending
+	tracker.pending = map[string]*userActivity{}
+	tracker.lock.Unlock()
+
+	var lastErr error
+	for username, activity := range pending {
+		err := tracker.context.Bucket.Update(kUserActivityKeyPrefix+username, 0, func(current []byte) ([]byte, error) {
+			stored := &userActivity{}
+			if current != nil {
+				if err := json.Unmarshal(current, stored); err != nil {
+					return nil, err
+				}
+			}
+			stored.merge(activity)
+			return json.Marshal(stored)
+		})
+		if err != nil {
+			lastErr = err
+			tracker.record(username, *activity)
+		}
+	}
+	return lastErr
+}
+
+// Stops the background task, after flushing the activity.
+func (tracker *userActivityTracker) stop() {
+	close(tracker.terminator)
+	<-tracker.done
+	if err := tracker.flush(); err != nil {
+		base.Warn("Couldn't save the user activity of database %q: %v", tracker.context.Name, err)
+	}
+}
+
+// Records that the database's user made a changes request.
+func (db *Database) RecordChangesRequest(since SequenceID) {
+	if db.user == nil || db.user.Name() == "" {
+		return
+	}
+	now := time.Now().UTC()
+	db.userActivity.record(db.user.Name(), userActivity{ChangesAt: &now, ChangesSince: since.String()})
+}
+
+// Records that the database's user wrote a _local doc, which is how replicators save checkpoints.
+func (db *Database) recordCheckpoint(body Body) {
+	if db.user == nil || db.user.Name() == "" {
+		return
+	}
+	now := time.Now().UTC()
+	seq, pull := checkpointSequence(body)
+	db.userActivity.record(db.user.Name(), userActivity{CheckpointAt: &now, CheckpointSeq: seq, CheckpointPull: pull})
+}
+
+// Returns the sequence a checkpoint body records, in any of the forms replicators use, or "" if
+// there isn't one.  pull is true if it's known to be a sequence of this database: a Couchbase Lite
+// 2 checkpoint's "remote" one.  The other forms are written by push replications too, which record
+// the client's own sequences.
+func checkpointSequence(body Body) (seq string, pull bool) {
+	for _, key := range []string{"remote", "lastSequence", "last_seq"} {
+		switch value := body[key].(type) {
+		case nil:
+			continue
+		case string:
+			return value, key == "remote"
+		default:
+			return fmt.Sprint(value), key == "remote"
+		}
+	}
+	return "", false
+}
+
+// A user's replication status, as returned by GET /db/_user/name/_sync_status.  Activities the
+// user hasn't done are shown as "never" (UserActivityNever.)
+type UserSyncStatus struct {
+	Name              string  `json:"name"`
+	LastChanges       string  `json:"last_changes"`        // Time of the latest changes request
+	LastChangesSince  string  `json:"last_changes_since"`  // Its since value
+	LastCheckpoint    string  `json:"last_checkpoint"`     // Time of the latest checkpoint write
+	LastCheckpointSeq string  `json:"last_checkpoint_seq"` // The sequence it recorded
+	CurrentSeq        uint64  `json:"current_seq"`         // The database's latest sequence
+	Lag               *uint64 `json:"lag"`                 // Sequences since the pull checkpoint's, or else the latest changes request's; null if unknown
+}
+
+// Returns a user's replication status.
+func (context *DatabaseContext) GetUserSyncStatus(username string) (*UserSyncStatus, error) {
+	activity, err := context.userActivity.get(username)
+	if err != nil {
+		return nil, err
+	}
+	status := &UserSyncStatus{
+		Name:              username,
+		LastChanges:       UserActivityNever,
+		LastChangesSince:  UserActivityNever,
+		LastCheckpoint:    UserActivityNever,
+		LastCheckpointSeq: UserActivityNever,
+	}
+	if status.CurrentSeq, err = context.LastSequence(); err != nil {
+		return nil, err
+	}
+	if activity.ChangesAt != nil {
+		status.LastChanges = activity.ChangesAt.Format(time.RFC3339)
+		status.LastChangesSince = activity.ChangesSince
+	}
+	if activity.CheckpointAt != nil {
+		status.LastCheckpoint = activity.CheckpointAt.Format(time.RFC3339)
+		status.LastCheckpointSeq = activity.CheckpointSeq
+	}
+	if activity.CheckpointPull {
+		status.Lag = context.sequenceLag(activity.CheckpointSeq, status.CurrentSeq)
+	} else if activity.ChangesAt != nil {
+		status.Lag = context.sequenceLag(activity.ChangesSince, status.CurrentSeq)
+	}
+	return status, nil
+}
+
+// Returns the number of sequences after a client's since value, or nil if it can't be parsed.
+func (context *DatabaseContext) sequenceLag(since string, currentSeq uint64) *uint64 {
+	if context.SequenceHasher != nil || since == "" {
+		return nil
+	}
+	seq, err := context.ParseSequenceID(since)
+	if err != nil {
+		return nil
+	}
+	// The client is only complete up to the low sequence of a compound one
+	safeSeq := seq.Seq
+	if seq.LowSeq > 0 && seq.LowSeq < safeSeq {
+		safeSeq = seq.LowSeq
+	}
+	var lag uint64
+	if safeSeq < currentSeq {
+		lag = currentSeq - safeSeq
+	}
+	return &lag
+}
@@ -0,0 +1,55 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestUserActivityFlush(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	tracker := db.userActivity
+	earlier := time.Now().UTC().Add(-time.Minute)
+	later := earlier.Add(30 * time.Second)
+	tracker.record("alice", userActivity{ChangesAt: &later, ChangesSince: "5"})
+	assertNoError(t, tracker.flush(), "flush")
+	assert.Equals(t, len(tracker.pending), 0)
+
+	// Older activity (say, flushed late by another node) doesn't replace newer:
+	tracker.record("alice", userActivity{ChangesAt: &earlier, ChangesSince: "2", CheckpointAt: &earlier, CheckpointSeq: "2"})
+	assertNoError(t, tracker.flush(), "flush")
+	activity, err := tracker.get("alice")
+	assertNoError(t, err, "get")
+	assert.True(t, activity.ChangesAt.Equal(later))
+	assert.Equals(t, activity.ChangesSince, "5")
+	assert.True(t, activity.CheckpointAt.Equal(earlier))
+	assert.Equals(t, activity.CheckpointSeq, "2")
+
+	activity, err = tracker.get("bob")
+	assertNoError(t, err, "get")
+	assert.True(t, activity.ChangesAt == nil && activity.CheckpointAt == nil)
+}
+
+func TestCheckpointSequence(t *testing.T) {
+	assertCheckpointSequence := func(body Body, expectedSeq string, expectedPull bool) {
+		seq, pull := checkpointSequence(body)
+		assert.Equals(t, seq, expectedSeq)
+		assert.Equals(t, pull, expectedPull)
+	}
+	assertCheckpointSequence(Body{"lastSequence": "12"}, "12", false)
+	assertCheckpointSequence(Body{"last_seq": "3::12"}, "3::12", false)
+	assertCheckpointSequence(Body{"local": 5, "remote": 12}, "12", true)
+	assertCheckpointSequence(Body{"other": "12"}, "", false)
+}
@@ -0,0 +1,149 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A user's computed channels and roles are saved in its doc, and only recomputed when a doc
+// update invalidates them.  Tooling that edits user or role docs directly in the bucket, or a
+// restore from a backup, leaves them stale; refreshing a user invalidates and recomputes them,
+// including the channels of its roles and the grants from docs found by the access queries.
+
+// Default max number of users refreshed per second by RefreshAllUserChannels
+const DefaultUserRefreshRate = 100
+
+// The channels a user could see before and after a refresh, including those of its roles.
+type UserChannelsRefresh struct {
+	Name           string   `json:"name"`
+	ChannelsBefore base.Set `json:"channels_before"`
+	ChannelsAfter  base.Set `json:"channels_after"`
+}
+
+// The result of refreshing all users.
+type AllUsersRefresh struct {
+	Users   int      `json:"users"`   // Number of users refreshed
+	Changed []string `json:"changed"` // Names of the users whose channels changed
+}
+
+// Recomputes and saves a user's roles and channels, and the channels of its roles.  Returns nil
+// if there's no such user.
+func (db *Database) RefreshUserChannels(username string) (*UserChannelsRefresh, error) {
+	return db.refreshUserChannels(username, true)
+}
+
+func (db *Database) refreshUserChannels(username string, refreshRoles bool) (*UserChannelsRefresh, error) {
+	if err := db.checkCancelled(); err != nil {
+		return nil, err
+	}
+	authr := db.Authenticator()
+	user, err := authr.GetUser(username)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	result := &UserChannelsRefresh{Name: username, ChannelsBefore: user.InheritedChannels().AsSet()}
+
+	if err = authr.InvalidateRoles(user); err != nil {
+		return nil, err
+	}
+	if err = authr.InvalidateChannels(user); err != nil {
+		return nil, err
+	}
+	// Getting the user recomputes and saves them:
+	if user, err = authr.GetUser(username); err != nil || user == nil {
+		return nil, err
+	}
+	if refreshRoles {
+		for roleName := range user.RoleNames() {
+			if err = db.refreshRoleChannels(roleName); err != nil {
+				return nil, err
+			}
+		}
+		// Get the user again, so its roles are loaded after they've been refreshed:
+		if user, err = authr.GetUser(username); err != nil || user == nil {
+			return nil, err
+		}
+	}
+	result.ChannelsAfter = user.InheritedChannels().AsSet()
+	base.LogTo("Access", "Refreshed channels of user %q: %s", username, result.ChannelsAfter)
+	return result, nil
+}
+
+func (db *Database) refreshRoleChannels(roleName string) error {
+	authr := db.Authenticator()
+	role, err := authr.GetRole(roleName)
+	if err != nil || role == nil {
+		return err
+	}
+	if err = authr.InvalidateChannels(role); err != nil {
+		return err
+	}
+	_, err = authr.GetRole(roleName)
+	return err
+}
+
+// Refreshes every role and then every user, at most usersPerSec of them a second so as not to
+// swamp the bucket.  Only one refresh of all users may run at a time.
+func (db *Database) RefreshAllUserChannels(usersPerSec float64) (*AllUsersRefresh, error) {
+	if !atomic.CompareAndSwapInt32(&db.refreshingUsers, 0, 1) {
+		return nil, base.HTTPErrorf(http.StatusServiceUnavailable, "A refresh of all users is already running")
+	}
+	defer atomic.StoreInt32(&db.refreshingUsers, 0)
+	if usersPerSec <= 0 {
+		usersPerSec = DefaultUserRefreshRate
+	}
+
+	users, roles, err := db.AllPrincipalIDs()
+	if err != nil {
+		return nil, err
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / usersPerSec))
+	defer ticker.Stop()
+	pace := func() error {
+		select {
+		case <-ticker.C:
+			return nil
+		case <-db.cancelled:
+			return ErrRequestCancelled
+		}
+	}
+
+	for _, roleName := range roles {
+		if err := pace(); err != nil {
+			return nil, err
+		}
+		if err := db.refreshRoleChannels(roleName); err != nil {
+			return nil, err
+		}
+	}
+	result := &AllUsersRefresh{Changed: []string{}}
+	for _, username := range users {
+		if err := pace(); err != nil {
+			return nil, err
+		}
+		refresh, err := db.refreshUserChannels(username, false)
+		if err != nil {
+			return nil, err
+		} else if refresh == nil {
+			continue // deleted since it was listed
+		}
+		result.Users++
+		if !refresh.ChannelsBefore.Equals(refresh.ChannelsAfter) {
+			result.Changed = append(result.Changed, username)
+		}
+	}
+	base.Logf("Refreshed the channels of %d users of database %q; %d changed", result.Users, db.Name, len(result.Changed))
+	return result, nil
+}
@@ -1,7 +1,12 @@
 package db
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
@@ -19,8 +24,18 @@ type PrincipalConfig struct {
 	Email             string   `json:"email,omitempty"`
 	Disabled          bool     `json:"disabled,omitempty"`
 	Password          *string  `json:"password,omitempty"`
+	PasswordHash      *string  `json:"password_hash,omitempty"` // bcrypt hash of the password, instead of the password itself
 	ExplicitRoleNames []string `json:"admin_roles,omitempty"`
 	RoleNames         []string `json:"roles,omitempty"`
+	// Fields below only apply to the GUEST user in a DbConfig:
+	RateLimit   *GuestRateLimitConfig `json:"rate_limit,omitempty"`   // Limits unauthenticated requests per client IP
+	MaxChannels *uint32               `json:"max_channels,omitempty"` // Max channels the guest user may be granted
+}
+
+// Token-bucket rate limit of unauthenticated requests from each client IP address.
+type GuestRateLimitConfig struct {
+	RequestsPerSec float64 `json:"requests_per_sec"`
+	Burst          int     `json:"burst,omitempty"` // Defaults to requests_per_sec
 }
 
 // Check if the password in this PrincipalConfig is valid.  Only allow
@@ -28,7 +43,7 @@ type PrincipalConfig struct {
 func (p PrincipalConfig) IsPasswordValid(allowEmptyPass bool) (isValid bool, reason string) {
 	// if it's an anon user, they should not have a password
 	if p.Name == nil {
-		if p.Password != nil {
+		if p.Password != nil || p.PasswordHash != nil {
 			return false, "Anonymous users should not have a password"
 		} else {
 			return true, ""
@@ -45,6 +60,13 @@ func (p PrincipalConfig) IsPasswordValid(allowEmptyPass bool) (isValid bool, rea
 		}
 	*/
 
+	if p.PasswordHash != nil {
+		if p.Password != nil {
+			return false, "Can't give both a password and a password_hash"
+		}
+		return true, "" // The hash is checked when it's set
+	}
+
 	if p.Password == nil || len(*p.Password) == 0 {
 		if !allowEmptyPass {
 			return false, "Empty passwords are not allowed "
@@ -83,6 +105,36 @@ func (dbc *DatabaseContext) GetPrincipal(name string, isUser bool) (info *Princi
 
 // Updates or creates a principal from a PrincipalConfig structure.
 func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool, allowReplace bool) (replaced bool, err error) {
+	replaced, _, err = dbc.updatePrincipal(newInfo, isUser, allowReplace, false)
+	return
+}
+
+// Creates or updates a user or role configured in a DbConfig, only saving it if it differs from
+// the stored one.  The configured admin channels and roles replace the stored ones; channels and
+// roles granted by the sync function, and the sequences of unchanged grants, are kept.  A user's
+// configured password is only set (revoking the user's sessions) when it differs from the one the
+// config last set, so a password changed since then through the API isn't reset.
+func (dbc *DatabaseContext) ProvisionPrincipal(newInfo PrincipalConfig, isUser bool) (created bool, changed bool, err error) {
+	replaced, changed, err := dbc.updatePrincipal(newInfo, isUser, true, true)
+	return !replaced && err == nil, changed, err
+}
+
+// Counts of the users or roles installed from a DbConfig by ProvisionPrincipal.
+type PrincipalProvisionCounts struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+}
+
+func (counts *PrincipalProvisionCounts) Add(other PrincipalProvisionCounts) {
+	counts.Created += other.Created
+	counts.Updated += other.Updated
+	counts.Unchanged += other.Unchanged
+}
+
+// Implementation of UpdatePrincipal and ProvisionPrincipal.  If fromConfig is true, a user's
+// password (or hash) is only set if it's changed since the config last set it.
+func (dbc *DatabaseContext) updatePrincipal(newInfo PrincipalConfig, isUser bool, allowReplace bool, fromConfig bool) (replaced bool, changed bool, err error) {
 	// Get the existing principal, or if this is a POST make sure there isn't one:
 	var princ auth.Principal
 	var user auth.User
@@ -97,7 +149,12 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 		return
 	}
 
-	changed := false
+	if isUser && *newInfo.Name == "" {
+		if err = dbc.checkGuestChannels(newInfo.ExplicitChannels); err != nil {
+			return
+		}
+	}
+
 	replaced = (princ != nil)
 	if !replaced {
 		// If user/role didn't exist already, instantiate a new one:
@@ -119,7 +176,7 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 	} else if !allowReplace {
 		err = base.HTTPErrorf(http.StatusConflict, "Already exists")
 		return
-	} else if isUser && newInfo.Password != nil {
+	} else if isUser && (newInfo.Password != nil || newInfo.PasswordHash != nil) {
 		isValid, reason := newInfo.IsPasswordValid(dbc.AllowEmptyPassword)
 		if !isValid {
 			err = base.HTTPErrorf(http.StatusBadRequest, reason)
@@ -143,8 +200,22 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 			user.SetEmail(newInfo.Email)
 			changed = true
 		}
-		if newInfo.Password != nil {
-			user.SetPassword(*newInfo.Password)
+		if !fromConfig {
+			var passwordSet bool
+			if passwordSet, err = setPrincipalPassword(user, newInfo); err != nil {
+				return
+			} else if passwordSet {
+				changed = true
+			}
+		} else if digest := configPasswordDigest(newInfo); digest != "" && digest != user.ConfigPasswordDigest() {
+			// A user provisioned before the digest was recorded keeps a password that's still the
+			// configured one; checking it costs a bcrypt comparison, but only this once:
+			if !(replaced && user.ConfigPasswordDigest() == "" && hasConfiguredPassword(user, newInfo)) {
+				if _, err = setPrincipalPassword(user, newInfo); err != nil {
+					return
+				}
+			}
+			user.SetConfigPasswordDigest(digest)
 			changed = true
 		}
 		if newInfo.Disabled != user.Disabled() {
@@ -170,7 +241,7 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 			var err error
 			nextSeq, err = dbc.sequences.nextSequence()
 			if err != nil {
-				return replaced, err
+				return replaced, changed, err
 			}
 			princ.SetSequence(nextSeq)
 		}
@@ -189,3 +260,259 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 	}
 	return
 }
+
+// Sets a user's password, or its hash, from a PrincipalConfig.  Returns false if it has neither.
+func setPrincipalPassword(user auth.User, info PrincipalConfig) (bool, error) {
+	if info.Password != nil {
+		user.SetPassword(*info.Password)
+	} else if info.PasswordHash != nil {
+		if user.SetPasswordHash([]byte(*info.PasswordHash)) != nil {
+			return false, base.HTTPErrorf(http.StatusBadRequest, "Invalid password_hash; must be a bcrypt hash")
+		}
+	} else {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Returns true if a user's password, or its hash, is already the one in a PrincipalConfig.
+func hasConfiguredPassword(user auth.User, info PrincipalConfig) bool {
+	if info.Password != nil {
+		return user.HasPassword(*info.Password)
+	}
+	return info.PasswordHash != nil && user.HasPasswordHash([]byte(*info.PasswordHash))
+}
+
+// A digest of the password (or hash) in a user's PrincipalConfig, recorded when the config sets
+// it, so that the config is only applied again once it changes.  It's salted with the user's name,
+// and is "" if there's no password.
+func configPasswordDigest(info PrincipalConfig) string {
+	var kind, value string
+	if info.Password != nil {
+		kind, value = "password", *info.Password
+	} else if info.PasswordHash != nil {
+		kind, value = "password_hash", *info.PasswordHash
+	} else {
+		return ""
+	}
+	digest := sha256.Sum256([]byte(*info.Name + "\x00" + kind + "\x00" + value))
+	return hex.EncodeToString(digest[:])
+}
+
+// Result of creating or updating one user or role, in UpdatePrincipals.
+type PrincipalUpdateResult struct {
+	Name   string `json:"name"`
+	Status int    `json:"status"` // 201 if created, 200 if updated, else the error status
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Max number of principals UpdatePrincipals updates at once
+const kBulkPrincipalConcurrency = 16
+
+// Creates or updates a batch of users or roles, running up to kBulkPrincipalConcurrency of them
+// at a time.  A failure only affects that principal's result, not the rest of the batch.
+func (dbc *DatabaseContext) UpdatePrincipals(infos []PrincipalConfig, isUser bool, allowReplace bool) []PrincipalUpdateResult {
+	results := make([]PrincipalUpdateResult, len(infos))
+	throttle := make(chan struct{}, kBulkPrincipalConcurrency)
+	var wg sync.WaitGroup
+	for i := range infos {
+		wg.Add(1)
+		throttle <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-throttle
+				wg.Done()
+			}()
+			results[i] = dbc.updatePrincipalForBatch(infos[i], isUser, allowReplace)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func (dbc *DatabaseContext) updatePrincipalForBatch(info PrincipalConfig, isUser bool, allowReplace bool) (result PrincipalUpdateResult) {
+	var err error
+	if info.Name == nil {
+		err = base.HTTPErrorf(http.StatusBadRequest, "Missing name property")
+	} else {
+		result.Name = *info.Name
+		var replaced bool
+		if replaced, err = dbc.UpdatePrincipal(info, isUser, allowReplace); err == nil {
+			result.Status = http.StatusCreated
+			if replaced {
+				result.Status = http.StatusOK
+			}
+			return
+		}
+	}
+	result.Status, result.Reason = base.ErrorAsHTTPStatus(err)
+	result.Error = base.CouchHTTPErrorName(result.Status)
+	return
+}
+
+// Returns an error if the channels exceed the ceiling on the guest user's channels.
+func (dbc *DatabaseContext) checkGuestChannels(channels base.Set) error {
+	max := dbc.GetOptions().GuestMaxChannels
+	if max == 0 {
+		return nil
+	}
+	if channels.Contains(ch.UserStarChannel) {
+		base.StatsExpvars.Add("auth_guestChannelGrantsRejected", 1)
+		return base.HTTPErrorf(http.StatusBadRequest, "The guest user can't be granted the %q channel when max_channels is set", ch.UserStarChannel)
+	}
+	if uint32(len(channels)) > max {
+		base.StatsExpvars.Add("auth_guestChannelGrantsRejected", 1)
+		return base.HTTPErrorf(http.StatusBadRequest, "The guest user can't be granted more than %d channels", max)
+	}
+	return nil
+}
+
+// Options for ListPrincipals.
+type PrincipalListOptions struct {
+	Roles    bool   // List roles instead of users
+	StartKey string // Name to start listing at (inclusive)
+	Prefix   string // Only list names with this prefix
+	Channel  string // Only list principals whose computed channels include this one
+	Limit    int    // Max number of principals to return, if nonzero
+}
+
+// Summary of a user or role, as returned by ListPrincipals.
+type PrincipalSummary struct {
+	Name              string   `json:"name"`
+	ExplicitChannels  []string `json:"admin_channels"`
+	ExplicitRoleNames []string `json:"admin_roles,omitempty"`
+	Disabled          bool     `json:"disabled,omitempty"`
+}
+
+// Lists users or roles in name order, using the principal_details view (or principal_grants, if
+// filtering by channel) so that no principal docs need to be loaded.  The channel filter matches
+// the principal's own computed channels, or just its admin channels if those are invalidated and
+// not yet recomputed, including the "*" and prefix grants that cover the channel.  The guest user
+// is never listed.
+func (context *DatabaseContext) ListPrincipals(options PrincipalListOptions) ([]PrincipalSummary, error) {
+	principalType := "user"
+	if options.Roles {
+		principalType = "role"
+	}
+	startName := options.StartKey
+	if startName < options.Prefix {
+		startName = options.Prefix
+	}
+	if options.Channel == "" {
+		return context.listPrincipals(principalType, startName, options)
+	}
+
+	// The principals of every grant that covers the channel come from a single query, by key, so
+	// they're filtered by name and merged in name order here:
+	keys := []interface{}{}
+	for _, grant := range grantsCoveringChannel(options.Channel) {
+		keys = append(keys, []interface{}{principalType, grant})
+	}
+	opts := Body{"stale": false, "keys": keys}
+	vres, err := context.Bucket.View(context.DesignDocName(DesignDocSyncHousekeeping, ViewPrincipalGrants), ViewPrincipalGrants, opts)
+	if err != nil {
+		return nil, err
+	}
+	docIDPrefix := auth.UserKeyPrefix
+	if options.Roles {
+		docIDPrefix = auth.RoleKeyPrefix
+	}
+	byName := map[string]PrincipalSummary{}
+	for _, row := range vres.Rows {
+		name := strings.TrimPrefix(row.ID, docIDPrefix)
+		if name == "" || name == row.ID || name < startName || !strings.HasPrefix(name, options.Prefix) {
+			continue
+		}
+		byName[name] = newPrincipalSummary(name, row.Value, options.Roles)
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if options.Limit > 0 && len(names) > options.Limit {
+		names = names[:options.Limit]
+	}
+	result := make([]PrincipalSummary, len(names))
+	for i, name := range names {
+		result[i] = byName[name]
+	}
+	return result, nil
+}
+
+// Returns the grants that give access to a channel: itself, "*", and the prefix grants matching
+// it.  A channel that's itself "*" or a prefix grant only matches itself.
+func grantsCoveringChannel(channel string) []string {
+	if channel == ch.UserStarChannel || ch.IsPrefixGrant(channel) {
+		return []string{channel}
+	}
+	grants := []string{channel, ch.UserStarChannel}
+	for i := range channel {
+		if i > 0 {
+			grants = append(grants, channel[:i]+ch.UserStarChannel)
+		}
+	}
+	return append(grants, channel+ch.UserStarChannel)
+}
+
+// Lists the principals of one type in name order, from the principal_details view.
+func (context *DatabaseContext) listPrincipals(principalType, startName string, options PrincipalListOptions) ([]PrincipalSummary, error) {
+	var endName interface{} = map[string]interface{}{}
+	if options.Prefix != "" {
+		endName = options.Prefix + "\uefff"
+	}
+	opts := Body{"stale": false,
+		"startkey": []interface{}{principalType, startName},
+		"endkey":   []interface{}{principalType, endName}}
+	if options.Limit > 0 {
+		opts["limit"] = options.Limit + 1 // in case the guest user is included
+	}
+	vres, err := context.Bucket.View(context.DesignDocName(DesignDocSyncHousekeeping, ViewPrincipalDetails), ViewPrincipalDetails, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]PrincipalSummary, 0, len(vres.Rows))
+	for _, row := range vres.Rows {
+		key, ok := row.Key.([]interface{})
+		if !ok || len(key) == 0 {
+			continue
+		}
+		name, _ := key[len(key)-1].(string)
+		if name == "" {
+			continue
+		}
+		result = append(result, newPrincipalSummary(name, row.Value, options.Roles))
+		if options.Limit > 0 && len(result) >= options.Limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+// Makes a PrincipalSummary from the value a principal view emitted.
+func newPrincipalSummary(name string, value interface{}, isRole bool) PrincipalSummary {
+	summary := PrincipalSummary{Name: name, ExplicitChannels: []string{}}
+	if value, ok := value.(map[string]interface{}); ok {
+		summary.ExplicitChannels = viewStringArray(value["admin_channels"])
+		if !isRole {
+			summary.ExplicitRoleNames = viewStringArray(value["admin_roles"])
+			summary.Disabled, _ = value["disabled"].(bool)
+		}
+	}
+	return summary
+}
+
+// Converts a JSON array of strings emitted by a view into a sorted []string.
+func viewStringArray(value interface{}) []string {
+	items, _ := value.([]interface{})
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		if str, ok := item.(string); ok {
+			result = append(result, str)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,245 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+const (
+	DefaultViewTimeout       = 75 * time.Second // Default max time a view query may take
+	DefaultViewMaxRetries    = 2                // Default number of retries of a view query that fails with a recoverable error
+	kViewRetryInitialSleepMs = 100
+)
+
+// Values of a view query's "stale" parameter
+const (
+	ViewStaleOK          = "ok"           // Use the index as it is
+	ViewStaleUpdateAfter = "update_after" // Use the index as it is, then update it
+	ViewStaleFalse       = "false"        // Update the index before querying it
+)
+
+// View query settings of a database.
+type ViewQueryConfig struct {
+	TimeoutSecs  *uint32 `json:"timeout_secs,omitempty"`   // Max time a query may take; defaults to 75
+	MaxRetries   *int    `json:"max_retries,omitempty"`    // Retries of queries that fail with recoverable errors; defaults to 2
+	ChangesStale string  `json:"changes_stale,omitempty"`  // "stale" setting of channel backfill queries for _changes; defaults to "false"
+	AllDocsStale string  `json:"all_docs_stale,omitempty"` // "stale" setting of _all_docs queries; defaults to "false"
+}
+
+func validateViewStale(stale string) error {
+	switch stale {
+	case "", ViewStaleOK, ViewStaleUpdateAfter, ViewStaleFalse:
+		return nil
+	default:
+		return fmt.Errorf("Invalid view stale setting %q; must be %q, %q or %q", stale, ViewStaleOK, ViewStaleUpdateAfter, ViewStaleFalse)
+	}
+}
+
+// Returns the value of the "stale" view query parameter for a stale setting, which defaults to
+// "false".
+func viewStaleParam(stale string) interface{} {
+	if stale == "" || stale == ViewStaleFalse {
+		return false
+	}
+	return stale
+}
+
+func (context *DatabaseContext) viewTimeout() time.Duration {
+	if config := context.GetOptions().ViewQuery; config != nil && config.TimeoutSecs != nil {
+		return time.Duration(*config.TimeoutSecs) * time.Second
+	}
+	return DefaultViewTimeout
+}
+
+func (context *DatabaseContext) viewMaxRetries() int {
+	if config := context.GetOptions().ViewQuery; config != nil && config.MaxRetries != nil {
+		return *config.MaxRetries
+	}
+	return DefaultViewMaxRetries
+}
+
+// The "stale" parameter for channel backfill queries of _changes feeds.
+func (context *DatabaseContext) changesViewStale() interface{} {
+	if config := context.GetOptions().ViewQuery; config != nil {
+		return viewStaleParam(config.ChangesStale)
+	}
+	return false
+}
+
+// The "stale" parameter for _all_docs queries.
+func (context *DatabaseContext) allDocsViewStale() interface{} {
+	if config := context.GetOptions().ViewQuery; config != nil {
+		return viewStaleParam(config.AllDocsStale)
+	}
+	return false
+}
+
+// Returns true if a failed view query might succeed if it's retried.
+func isRecoverableViewError(err error) bool {
+	if base.IsRetryableBucketError(err, true) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, fragment := range []string{"timeout", "connection reset", "connection refused", "eof", "503"} {
+		if strings.Contains(message, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// Queries a view, like Bucket.ViewCustom, but gives up with a 504 error if the query takes longer
+// than the database's view timeout, and retries queries that fail with recoverable errors.
+// `about` describes what the query is for (e.g. a channel name), for logs and error messages.
+func (context *DatabaseContext) queryView(ddoc, viewName string, opts Body, vres interface{}, about string) error {
+	timeout := context.viewTimeout()
+	worker := func() (bool, error, interface{}) {
+		// The bucket API doesn't support timeouts, so run the query in a goroutine and stop
+		// waiting for it after the timeout.  (If that happens, vres is still being written to, so
+		// the query can't be retried.)
+		result := make(chan error, 1)
+		go func() {
+			result <- context.Bucket.ViewCustom(context.DesignDocName(ddoc, viewName), viewName, opts, vres)
+		}()
+		select {
+		case err := <-result:
+			if err != nil && isRecoverableViewError(err) {
+				base.Warn("Error querying view %s/%s for %s: %v", ddoc, viewName, about, err)
+				return true, err, nil
+			}
+			return false, err, nil
+		case <-time.After(timeout):
+			dbExpvars.Add("view_query_timeouts", 1)
+			return false, base.HTTPErrorf(504, "Timed out after %v querying view %s/%s for %s", timeout, ddoc, viewName, about), nil
+		}
+	}
+	sleeper := base.CreateDoublingSleeperFunc(context.viewMaxRetries(), kViewRetryInitialSleepMs)
+	err, _ := base.RetryLoop(fmt.Sprintf("view query %s/%s for %s", ddoc, viewName, about), worker, sleeper)
+	return err
+}
+
+// Makes a database's index queries with views.
+type viewQuerier struct {
+	context *DatabaseContext
+}
+
+// Queries the all_docs view.
+func (q *viewQuerier) queryAllDocs(startKey, endKey string) ([]allDocsQueryRow, error) {
+	var vres struct {
+		Rows []struct {
+			Key   string
+			Value struct {
+				RevID    string   `json:"r"`
+				Sequence uint64   `json:"s"`
+				Channels []string `json:"c"`
+			}
+		}
+	}
+	opts := Body{"stale": q.context.allDocsViewStale(), "reduce": false}
+	if startKey != "" {
+		opts["startkey"] = startKey
+	}
+	if endKey != "" {
+		opts["endkey"] = endKey
+	}
+	if err := q.context.queryView(DesignDocSyncHousekeeping, ViewAllDocs, opts, &vres, "_all_docs"); err != nil {
+		return nil, err
+	}
+	rows := make([]allDocsQueryRow, 0, len(vres.Rows))
+	for _, row := range vres.Rows {
+		rows = append(rows, allDocsQueryRow{IDAndRev{row.Key, row.Value.RevID, row.Value.Sequence}, row.Value.Channels})
+	}
+	return rows, nil
+}
+
+// Queries the principals view.
+func (q *viewQuerier) queryPrincipals() (users, roles []string, err error) {
+	vres, err := q.context.Bucket.View(q.context.DesignDocName(DesignDocSyncHousekeeping, ViewPrincipals), ViewPrincipals, Body{"stale": false})
+	if err != nil {
+		return nil, nil, err
+	}
+	users = []string{}
+	roles = []string{}
+	for _, row := range vres.Rows {
+		name := row.Key.(string)
+		if row.Value.(bool) {
+			users = append(users, name)
+		} else {
+			roles = append(roles, name)
+		}
+	}
+	return users, roles, nil
+}
+
+// Queries the access view.
+func (q *viewQuerier) queryAccess(principalKey string) (channels.TimedSet, error) {
+	var vres struct {
+		Rows []struct {
+			Value channels.TimedSet
+		}
+	}
+	opts := map[string]interface{}{"stale": false, "key": principalKey}
+	if err := q.context.Bucket.ViewCustom(q.context.DesignDocName(DesignDocSyncGatewayAccess, ViewAccess), ViewAccess, opts, &vres); err != nil {
+		return nil, err
+	}
+	channelSet := channels.TimedSet{}
+	for _, row := range vres.Rows {
+		channelSet.Add(row.Value)
+	}
+	return channelSet, nil
+}
+
+// Queries the role_access view.
+func (q *viewQuerier) queryRoleAccess(username string) (channels.TimedSet, error) {
+	var vres struct {
+		Rows []struct {
+			Value channels.TimedSet
+		}
+	}
+	opts := map[string]interface{}{"stale": false, "key": username}
+	if err := q.context.Bucket.ViewCustom(q.context.DesignDocName(DesignDocSyncGatewayRoleAccess, ViewRoleAccess), ViewRoleAccess, opts, &vres); err != nil {
+		return nil, err
+	}
+	// Merge the TimedSets from the view result:
+	var result channels.TimedSet
+	for _, row := range vres.Rows {
+		if result == nil {
+			result = row.Value
+		} else {
+			result.Add(row.Value)
+		}
+	}
+	return result, nil
+}
+
+// Queries the doc_states view, once for each of its keys.
+func (q *viewQuerier) queryDocStates() (counts DocStateCounts, err error) {
+	for key, count := range map[string]*int64{"live": &counts.Docs, "tombstone": &counts.Tombstones, "conflict": &counts.Conflicts} {
+		var vres struct {
+			Rows []struct {
+				Value int64
+			}
+		}
+		opts := Body{"stale": false, "reduce": true, "key": key}
+		if err := q.context.queryView(DesignDocSyncHousekeeping, ViewDocStates, opts, &vres, "document counts"); err != nil {
+			return DocStateCounts{}, err
+		}
+		if len(vres.Rows) > 0 {
+			*count = vres.Rows[0].Value
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,84 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+// A bucket whose view queries fail or stall as configured.
+type troubledViewBucket struct {
+	base.Bucket
+	failures int           // Number of queries that fail before they start working
+	delay    time.Duration // How long every query takes
+	queries  int
+}
+
+func (b *troubledViewBucket) ViewCustom(ddoc, name string, params map[string]interface{}, vres interface{}) error {
+	b.queries++
+	time.Sleep(b.delay)
+	if b.queries <= b.failures {
+		return errors.New("read: connection reset by peer")
+	}
+	return b.Bucket.ViewCustom(ddoc, name, params, vres)
+}
+
+func TestViewQueryRetry(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	_, err := db.Put("doc1", Body{"foo": "bar"})
+	assertNoError(t, err, "Put")
+
+	bucket := &troubledViewBucket{Bucket: db.Bucket, failures: 1}
+	db.Bucket = bucket
+	count := 0
+	err = db.ForEachDocID(func(IDAndRev, []string) bool { count++; return true }, ForEachDocIDOptions{})
+	assertNoError(t, err, "ForEachDocID")
+	assert.Equals(t, count, 1)
+	assert.Equals(t, bucket.queries, 2)
+
+	// Too many failures:
+	bucket.queries, bucket.failures = 0, 10
+	err = db.ForEachDocID(func(IDAndRev, []string) bool { return true }, ForEachDocIDOptions{})
+	assert.True(t, err != nil)
+	assert.Equals(t, bucket.queries, DefaultViewMaxRetries+1)
+}
+
+func TestViewQueryTimeout(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	timeoutSecs := uint32(1)
+	db.Options.ViewQuery = &ViewQueryConfig{TimeoutSecs: &timeoutSecs}
+	db.Bucket = &troubledViewBucket{Bucket: db.Bucket, delay: 1500 * time.Millisecond}
+	_, err := db.getChangesInChannelFromQuery("ABC", 0, ChangesOptions{})
+	assertHTTPError(t, err, 504)
+	assert.True(t, strings.Contains(err.Error(), `channel "ABC"`))
+	assert.True(t, strings.Contains(err.Error(), DesignDocSyncGatewayChannels+"/"+ViewChannels))
+}
+
+func TestViewStaleConfig(t *testing.T) {
+	assert.Equals(t, viewStaleParam(""), false)
+	assert.Equals(t, viewStaleParam(ViewStaleFalse), false)
+	assert.Equals(t, viewStaleParam(ViewStaleUpdateAfter), "update_after")
+
+	bucket := testBucket()
+	defer bucket.Close()
+	_, err := NewDatabaseContext("db", bucket, false, DatabaseContextOptions{
+		ViewQuery: &ViewQueryConfig{ChangesStale: "sometimes"},
+	})
+	assert.True(t, err != nil)
+}
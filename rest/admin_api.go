@@ -14,15 +14,16 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbase/sync_gateway/db"
 	"github.com/couchbaselabs/sg-replicate"
-	"github.com/gorilla/mux"
 )
 
 const kDefaultDBOnlineDelay = 0
@@ -60,6 +61,11 @@ func (h *handler) handleDbOnline() error {
 		return base.HTTPErrorf(http.StatusServiceUnavailable, "Database _resync is in progress, this may take some time, try again later")
 	}
 
+	//If a background resync was stopped before completing, it has to be finished or aborted first
+	if h.db.HasPendingResync() {
+		return base.HTTPErrorf(http.StatusServiceUnavailable, "Database _resync was stopped before completing; resume it or abort it before taking the database online")
+	}
+
 	body, err := h.readBody()
 	if err != nil {
 		return err
@@ -73,7 +79,7 @@ func (h *handler) handleDbOnline() error {
 
 	json.Unmarshal(body, &input)
 
-	base.LogTo("CRUD", "Taking Database : %v, online in %v seconds", h.db.Name, input.Delay)
+	h.logContext.LogTo("CRUD", "Taking Database : %v, online in %v seconds", h.db.Name, input.Delay)
 
 	timer := time.NewTimer(time.Duration(input.Delay) * time.Second)
 	go func() {
@@ -90,7 +96,7 @@ func (h *handler) handleDbOffline() error {
 	h.assertAdminOnly()
 	var err error
 	if err = h.db.TakeDbOffline("ADMIN Request"); err != nil {
-		base.LogTo("CRUD", "Unable to take Database : %v, offline", h.db.Name)
+		h.logContext.LogTo("CRUD", "Unable to take Database : %v, offline", h.db.Name)
 	}
 
 	return err
@@ -108,7 +114,10 @@ func (h *handler) handleGetConfig() error {
 	return nil
 }
 
-// PUT a new database config
+// PUT a new database config.  If the database is online the config is applied right away, and the
+// response's "resync_required" property tells whether the sync function changed, and its
+// "principals" property how many configured users and roles were written; otherwise it's
+// just stored, and takes effect when the database is brought online.
 func (h *handler) handlePutDbConfig() error {
 	h.assertAdminOnly()
 	dbName := h.db.Name
@@ -119,6 +128,14 @@ func (h *handler) handlePutDbConfig() error {
 	if err := config.setup(dbName); err != nil {
 		return err
 	}
+	if atomic.LoadUint32(&h.db.State) == db.DBOnline {
+		changed, principals, err := h.server.ReloadDatabaseConfig(h.db.DatabaseContext, config)
+		if err != nil {
+			return err
+		}
+		h.writeJSONStatus(http.StatusCreated, db.Body{"ok": true, "resync_required": changed, "principals": principals})
+		return nil
+	}
 	h.server.lock.Lock()
 	defer h.server.lock.Unlock()
 	h.server.config.Databases[dbName] = config
@@ -169,6 +186,7 @@ type ReplicationConfig struct {
 	CreateTarget     bool        `json:"create_target"`
 	DocIds           []string    `json:"doc_ids"`
 	Filter           string      `json:"filter"`
+	Channels         []string    `json:"channels"` // Shorthand for the sync_gateway/bychannel filter
 	Proxy            string      `json:"proxy"`
 	QueryParams      interface{} `json:"query_params"`
 	Cancel           bool        `json:"cancel"`
@@ -205,6 +223,19 @@ func validateReplicationParameters(requestParams ReplicationConfig, paramsFromCo
 
 	params.ReplicationId = requestParams.ReplicationId
 
+	if requestParams.Channels != nil {
+		if requestParams.Filter != "" {
+			err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate channels can't be combined with a filter")
+			return
+		}
+		channelArray := make([]interface{}, len(requestParams.Channels))
+		for i, channel := range requestParams.Channels {
+			channelArray[i] = channel
+		}
+		requestParams.Filter = "sync_gateway/bychannel"
+		requestParams.QueryParams = channelArray
+	}
+
 	//cancel parameter is only supported via the REST API
 	if requestParams.Cancel {
 		if paramsFromConfig {
@@ -285,6 +316,9 @@ func validateReplicationParameters(requestParams ReplicationConfig, paramsFromCo
 						return
 					}
 				}
+				if _, err = ch.SetFromArray(channels, ch.ExpandStar); err != nil {
+					return
+				}
 				params.Channels = channels
 			}
 		} else {
@@ -315,14 +349,36 @@ func (h *handler) handleActiveTasks() error {
 
 // raw document access for admin api
 
+// HTTP handler for GET /db/_raw/{docid}.  Returns the document as stored in the bucket, including
+// its _sync metadata.  ?include_doc=false returns only the metadata; ?rev= returns the stored body
+// of that revision instead, if it's still available.
 func (h *handler) handleGetRawDoc() error {
 	h.assertAdminOnly()
 	docid := h.PathVar("docid")
-	doc, err := h.db.GetDoc(docid)
-	if doc != nil {
-		h.writeJSON(doc)
+	var data []byte
+	var err error
+	if revid := h.getQuery("rev"); revid != "" {
+		data, err = h.db.GetRawRevisionJSON(docid, revid)
+	} else {
+		data, err = h.db.GetRawDocJSON(docid, h.getOptBoolQuery("include_doc", true))
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	h.setHeader("Content-Type", "application/json")
+	h.response.Write(data)
+	return nil
+}
+
+// HTTP handler for GET /db/_rejections.  Returns the database's most recent sync function
+// rejections, oldest first, and the number of rejections so far by message.
+func (h *handler) handleGetRejections() error {
+	h.assertAdminOnly()
+	h.writeJSON(db.Body{
+		"recent": h.db.RecentSyncRejections(),
+		"counts": h.db.SyncRejectionCounts(),
+	})
+	return nil
 }
 
 func (h *handler) handleGetRevTree() error {
@@ -336,19 +392,172 @@ func (h *handler) handleGetRevTree() error {
 	return err
 }
 
+// HTTP handler for POST /db/_sync_function_test.  Runs the sync function (or an alternate one given
+// in the request) against a document and returns what it computed, without writing anything.
+func (h *handler) handleSyncFunctionTest() error {
+	h.assertAdminOnly()
+	var input struct {
+		Doc    db.Body `json:"doc"`
+		OldDoc db.Body `json:"oldDoc"`
+		User   string  `json:"user"`
+		Sync   string  `json:"sync"`
+	}
+	if err := h.readJSONInto(&input); err != nil {
+		return err
+	}
+	if input.Doc == nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing doc")
+	}
+
+	var user auth.User
+	if input.User != "" {
+		var err error
+		if user, err = h.db.Authenticator().GetUser(input.User); err != nil {
+			return err
+		} else if user == nil {
+			return base.HTTPErrorf(http.StatusNotFound, "No such user %q", input.User)
+		}
+	}
+
+	output, err := h.db.DryRunSyncFunction(input.Sync, input.Doc, input.OldDoc, user)
+	if err != nil {
+		return err
+	}
+	response := db.Body{
+		"channels": output.Channels,
+		"access":   output.Access,
+		"roles":    output.Roles,
+	}
+	if output.Rejection != nil {
+		status, message := base.ErrorAsHTTPStatus(output.Rejection)
+		response["rejection"] = db.Body{"status": status, "message": message}
+	}
+	if output.Expiry != nil {
+		response["expiry"] = *output.Expiry
+	}
+	h.writeJSON(response)
+	return nil
+}
+
+// HTTP handler for GET /db/_skipped_sequences
+func (h *handler) handleGetSkippedSequences() error {
+	h.assertAdminOnly()
+	skipped, err := h.db.GetSkippedSequences()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"skipped_sequences": skipped})
+	return nil
+}
+
+// Default and maximum number of sample doc IDs returned per channel by GET /db/_channels?doc_ids=true
+const (
+	kDefaultChannelStatsDocIDs = 10
+	kMaxChannelStatsDocIDs     = 1000
+)
+
+// HTTP handler for GET /db/_channels.  Returns per-channel doc counts and cache residency, for all
+// channels or for the comma-separated list in ?channels=
+func (h *handler) handleGetChannelStats() error {
+	h.assertAdminOnly()
+	var channelNames []string
+	if channelsParam := h.getQuery("channels"); channelsParam != "" {
+		channelSet, err := ch.SetFromArray(strings.Split(channelsParam, ","), ch.KeepStar)
+		if err != nil {
+			return err
+		}
+		channelNames = channelSet.ToArray()
+	}
+	docIDLimit := 0
+	if h.getBoolQuery("doc_ids") {
+		docIDLimit = int(getRestrictedIntQuery(h.rq.URL.Query(), "doc_id_limit", kDefaultChannelStatsDocIDs, 1, kMaxChannelStatsDocIDs, false))
+	}
+	stats, err := h.db.GetChannelStats(channelNames, docIDLimit)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"channels": stats})
+	return nil
+}
+
+// HTTP handler for GET /db/_sync_fn_epochs.  Returns the number of docs whose channels were
+// computed by each version of the sync function, and how many are stale.
+func (h *handler) handleGetSyncFnEpochs() error {
+	h.assertAdminOnly()
+	counts, err := h.db.GetSyncFnEpochCounts()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(counts)
+	return nil
+}
+
+// HTTP handler for POST /db/_release_sequence/{seq}
+func (h *handler) handleReleaseSequence() error {
+	h.assertAdminOnly()
+	sequence, err := strconv.ParseUint(h.PathVar("seq"), 10, 64)
+	if err != nil || sequence == 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid sequence %q", h.PathVar("seq"))
+	}
+	if err := h.db.ReleaseSkippedSequence(sequence); err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"released": sequence})
+	return nil
+}
+
+
+// Returns the log keys of the database named by the "db" query parameter, which _logging applies
+// to instead of the global ones, or nil if there's no such parameter.
+func (h *handler) loggingDatabaseKeys() (*base.LogKeySet, error) {
+	dbName := h.getQuery("db")
+	if dbName == "" {
+		return nil, nil
+	}
+	dbContext, err := h.server.GetDatabase(dbName)
+	if err != nil {
+		return nil, err
+	}
+	return dbContext.LogKeys, nil
+}
 
 func (h *handler) handleGetLogging() error {
-	h.writeJSON(base.GetLogKeys())
+	dbKeys, err := h.loggingDatabaseKeys()
+	if err != nil {
+		return err
+	}
+	keys := base.GetLogKeys()
+	if dbKeys != nil {
+		if ownKeys := dbKeys.Keys(); ownKeys != nil {
+			keys = ownKeys
+		}
+	}
+	h.writeJSON(keys)
 	return nil
 }
 
+// With a "db" query parameter, sets that database's log keys and level rather than the global
+// ones.  A database whose keys are updated by POST starts from the global keys, if it doesn't
+// have its own yet.
 func (h *handler) handleSetLogging() error {
 	body, err := h.readBody()
 	if err != nil {
 		return nil
 	}
+	dbKeys, err := h.loggingDatabaseKeys()
+	if err != nil {
+		return err
+	}
 	if h.getQuery("level") != "" {
-		base.SetLogLevel(int(getRestrictedIntQuery(h.rq.URL.Query(), "level", uint64(base.LogLevel()), 1, 3, false)))
+		if dbKeys != nil {
+			currentLevel := dbKeys.Level()
+			if currentLevel == 0 {
+				currentLevel = base.LogLevel()
+			}
+			dbKeys.SetLevel(int(getRestrictedIntQuery(h.rq.URL.Query(), "level", uint64(currentLevel), 1, 3, false)))
+		} else {
+			base.SetLogLevel(int(getRestrictedIntQuery(h.rq.URL.Query(), "level", uint64(base.LogLevel()), 1, 3, false)))
+		}
 		if len(body) == 0 {
 			return nil // empty body is OK if request is just setting the log level
 		}
@@ -357,7 +566,23 @@ func (h *handler) handleSetLogging() error {
 	if err := json.Unmarshal(body, &keys); err != nil {
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid JSON or non-boolean values")
 	}
-	base.UpdateLogKeys(keys, h.rq.Method == "PUT")
+	if dbKeys != nil {
+		dbKeys.UpdateKeys(keys, h.rq.Method == "PUT")
+	} else {
+		base.UpdateLogKeys(keys, h.rq.Method == "PUT")
+	}
+	return nil
+}
+
+// Makes a database's messages use the global log keys and level again.
+func (h *handler) handleDeleteLogging() error {
+	dbKeys, err := h.loggingDatabaseKeys()
+	if err != nil {
+		return err
+	} else if dbKeys == nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing db parameter")
+	}
+	dbKeys.Configure(nil, 0)
 	return nil
 }
 
@@ -426,13 +651,7 @@ func (h *handler) updatePrincipal(name string, isUser bool) error {
 	if err != nil {
 		return err
 	} else if replaced {
-		// on update with a new password, remove previous user sessions
-		if newInfo.Password != nil {
-			err = h.db.DeleteUserSessions(*newInfo.Name)
-			if err != nil {
-				return err
-			}
-		}
+		// On update with a new password, previous user sessions are revoked by the password change
 		h.writeStatus(http.StatusOK, "OK")
 	} else {
 		h.writeStatus(http.StatusCreated, "Created")
@@ -442,19 +661,70 @@ func (h *handler) updatePrincipal(name string, isUser bool) error {
 
 // Handles PUT or POST to /_user/*
 func (h *handler) putUser() error {
-	username := mux.Vars(h.rq)["name"]
+	username := h.PathVar("name")
 	return h.updatePrincipal(username, true)
 }
 
 // Handles PUT or POST to /_role/*
 func (h *handler) putRole() error {
-	rolename := mux.Vars(h.rq)["name"]
+	rolename := h.PathVar("name")
 	return h.updatePrincipal(rolename, false)
 }
 
+// Handles POST to /_user/_bulk
+func (h *handler) putUsersBulk() error {
+	h.setRequestClass(bulkRequest)
+	return h.updatePrincipalsBulk(true)
+}
+
+// Handles POST to /_role/_bulk
+func (h *handler) putRolesBulk() error {
+	h.setRequestClass(bulkRequest)
+	return h.updatePrincipalsBulk(false)
+}
+
+// Creates users or roles in bulk.  The request body is {"users": [...]} or {"roles": [...]}, an
+// array of the same objects PUT to /_user/{name} or /_role/{name}.  Existing principals are
+// conflicts, unless "update_existing" is true.  Responds with an array of per-principal results.
+func (h *handler) updatePrincipalsBulk(isUser bool) error {
+	h.assertAdminOnly()
+	var request struct {
+		Users          []db.PrincipalConfig `json:"users"`
+		Roles          []db.PrincipalConfig `json:"roles"`
+		UpdateExisting bool                 `json:"update_existing"`
+	}
+	if err := h.readJSONInto(&request); err != nil {
+		return err
+	}
+	infos, property := request.Users, "users"
+	if !isUser {
+		infos, property = request.Roles, "roles"
+	}
+	if infos == nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "missing '%s' property", property)
+	} else if maxPrincipals := h.db.MaxBulkPrincipals(); len(infos) > maxPrincipals {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "Bulk request has more than %d %s", maxPrincipals, property)
+	}
+	for i, info := range infos {
+		if info.Name != nil {
+			internalName := internalUserName(*info.Name)
+			infos[i].Name = &internalName
+		}
+	}
+
+	results := h.db.UpdatePrincipals(infos, isUser, request.UpdateExisting)
+	for i := range results {
+		if infos[i].Name != nil {
+			results[i].Name = externalUserName(results[i].Name)
+		}
+	}
+	h.writeJSON(results)
+	return nil
+}
+
 func (h *handler) deleteUser() error {
 	h.assertAdminOnly()
-	user, err := h.db.Authenticator().GetUser(mux.Vars(h.rq)["name"])
+	user, err := h.db.Authenticator().GetUser(h.PathVar("name"))
 	if user == nil {
 		if err == nil {
 			err = kNotFoundError
@@ -466,7 +736,7 @@ func (h *handler) deleteUser() error {
 
 func (h *handler) deleteRole() error {
 	h.assertAdminOnly()
-	role, err := h.db.Authenticator().GetRole(mux.Vars(h.rq)["name"])
+	role, err := h.db.Authenticator().GetRole(h.PathVar("name"))
 	if role == nil {
 		if err == nil {
 			err = kNotFoundError
@@ -478,7 +748,7 @@ func (h *handler) deleteRole() error {
 
 func (h *handler) getUserInfo() error {
 	h.assertAdminOnly()
-	user, err := h.db.Authenticator().GetUser(internalUserName(mux.Vars(h.rq)["name"]))
+	user, err := h.db.Authenticator().GetUser(internalUserName(h.PathVar("name")))
 	if user == nil {
 		if err == nil {
 			err = kNotFoundError
@@ -491,9 +761,58 @@ func (h *handler) getUserInfo() error {
 	return err
 }
 
+// ADMIN API: Returns a user's replication status: their latest changes request and checkpoint, and
+// how far the checkpoint is behind the database's latest sequence.
+func (h *handler) getUserSyncStatus() error {
+	h.assertAdminOnly()
+	name := h.PathVar("name")
+	user, err := h.db.Authenticator().GetUser(name)
+	if user == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	status, err := h.db.GetUserSyncStatus(name)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(status)
+	return nil
+}
+
+// ADMIN API: Recomputes and saves a user's roles and channels, and those of its roles, for when
+// user or role docs have been edited directly in the bucket.  Returns its channels before and after.
+func (h *handler) refreshUser() error {
+	h.assertAdminOnly()
+	refresh, err := h.db.RefreshUserChannels(h.PathVar("name"))
+	if refresh == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	h.writeJSON(refresh)
+	return nil
+}
+
+// ADMIN API: Refreshes all roles and users, e.g. after restoring the bucket from a backup.  The
+// "rate" query param is the max number refreshed per second.
+func (h *handler) refreshAllUsers() error {
+	h.assertAdminOnly()
+	h.setRequestClass(unlimitedRequest)
+	rate := h.getIntQuery("rate", db.DefaultUserRefreshRate)
+	result, err := h.db.RefreshAllUserChannels(float64(rate))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(result)
+	return nil
+}
+
 func (h *handler) getRoleInfo() error {
 	h.assertAdminOnly()
-	role, err := h.db.Authenticator().GetRole(mux.Vars(h.rq)["name"])
+	role, err := h.db.Authenticator().GetRole(h.PathVar("name"))
 	if role == nil {
 		if err == nil {
 			err = kNotFoundError
@@ -506,28 +825,44 @@ func (h *handler) getRoleInfo() error {
 }
 
 func (h *handler) getUsers() error {
-	users, _, err := h.db.AllPrincipalIDs()
-	if err != nil {
-		return err
-	}
-	bytes, err := json.Marshal(users)
-	h.response.Write(bytes)
-	return err
+	return h.listPrincipals(false)
 }
 
 func (h *handler) getRoles() error {
-	_, roles, err := h.db.AllPrincipalIDs()
+	return h.listPrincipals(true)
+}
+
+// Responds with the names of users or roles, or with ?details=true, their admin channels (and
+// roles and disabled flag, for users.)  ?limit, ?startkey and ?name_prefix page through the list;
+// ?channel only lists principals with access to that channel.
+func (h *handler) listPrincipals(roles bool) error {
+	summaries, err := h.db.ListPrincipals(db.PrincipalListOptions{
+		Roles:    roles,
+		StartKey: h.getJSONStringQuery("startkey"),
+		Prefix:   h.getQuery("name_prefix"),
+		Channel:  h.getQuery("channel"),
+		Limit:    int(h.getIntQuery("limit", 0)),
+	})
 	if err != nil {
 		return err
 	}
-	bytes, err := json.Marshal(roles)
+	var bytes []byte
+	if h.getBoolQuery("details") {
+		bytes, err = json.Marshal(summaries)
+	} else {
+		names := make([]string, 0, len(summaries))
+		for _, summary := range summaries {
+			names = append(names, summary.Name)
+		}
+		bytes, err = json.Marshal(names)
+	}
 	h.response.Write(bytes)
 	return err
 }
 
 // HTTP handler for /index
 func (h *handler) handleIndex() error {
-	base.LogTo("HTTP", "Index")
+	h.logContext.LogTo("HTTP", "Index")
 
 	indexStats, err := h.db.IndexStats()
 
@@ -542,7 +877,7 @@ func (h *handler) handleIndex() error {
 // HTTP handler for /index/channel
 func (h *handler) handleIndexChannel() error {
 	channelName := h.PathVar("channel")
-	base.LogTo("HTTP", "Index channel %q", channelName)
+	h.logContext.LogTo("HTTP", "Index channel %q", channelName)
 
 	channelStats, err := h.db.IndexChannelStats(channelName)
 
@@ -556,7 +891,7 @@ func (h *handler) handleIndexChannel() error {
 
 // HTTP handler for /index/channels
 func (h *handler) handleIndexAllChannels() error {
-	base.LogTo("HTTP", "Index channels")
+	h.logContext.LogTo("HTTP", "Index channels")
 
 	channelStats, err := h.db.IndexAllChannelStats()
 
@@ -569,6 +904,7 @@ func (h *handler) handleIndexAllChannels() error {
 }
 
 func (h *handler) handlePurge() error {
+	h.setRequestClass(bulkRequest)
 	h.assertAdminOnly()
 
 	message := "OK"
@@ -587,18 +923,18 @@ func (h *handler) handlePurge() error {
 
 	for key, value := range input {
 		//For each one validate that the revision list is set to ["*"], otherwise skip doc and log warning
-		base.LogTo("CRUD", "purging document = %v", key)
+		h.logContext.LogTo("CRUD", "purging document = %v", key)
 
 		if revisionList, ok := value.([]interface{}); ok {
 
 			//There should only be a single revision entry of "*"
 			if len(revisionList) != 1 {
-				base.LogTo("CRUD", "Revision list for doc ID %v, should contain exactly one entry", key)
+				h.logContext.LogTo("CRUD", "Revision list for doc ID %v, should contain exactly one entry", key)
 				continue //skip this entry its not valid
 			}
 
 			if revisionList[0] != "*" {
-				base.LogTo("CRUD", "Revision entry for doc ID %v, should be the '*' revison", key)
+				h.logContext.LogTo("CRUD", "Revision entry for doc ID %v, should be the '*' revison", key)
 				continue //skip this entry its not valid
 			}
 
@@ -616,12 +952,12 @@ func (h *handler) handlePurge() error {
 				h.response.Write([]byte(s))
 
 			} else {
-				base.LogTo("CRUD", "Failed to purge document %v, err = %v", key, err)
+				h.logContext.LogTo("CRUD", "Failed to purge document %v, err = %v", key, err)
 				continue //skip this entry its not valid
 			}
 
 		} else {
-			base.LogTo("CRUD", "Revision list for doc ID %v, is not an array, ", key)
+			h.logContext.LogTo("CRUD", "Revision list for doc ID %v, is not an array, ", key)
 			continue //skip this entry its not valid
 		}
 	}
@@ -16,6 +16,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -25,6 +27,7 @@ import (
 	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbase/sync_gateway/db"
 	"github.com/couchbaselabs/go.assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestUserAPI(t *testing.T) {
@@ -410,6 +413,106 @@ func TestRoleAPI(t *testing.T) {
 	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_role/hipster", ""), 200)
 }
 
+func TestBulkPrincipals(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/existing", `{"password":"letmein"}`), 201)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("letmein"), bcrypt.MinCost)
+
+	response := rt.SendAdminRequest("POST", "/db/_user/_bulk", `{"users": [
+		{"name":"alice", "password":"letmein", "admin_channels":["a"], "email":"alice@example.com"},
+		{"name":"bob", "password_hash":"`+string(hash)+`", "admin_roles":["r1"]},
+		{"name":"carol", "password_hash":"not a hash"},
+		{"password":"letmein"},
+		{"name":"existing", "password":"newpassword"}]}`)
+	assertStatus(t, response, 200)
+	var results []db.PrincipalUpdateResult
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &results), "Couldn't parse bulk response")
+	assert.Equals(t, len(results), 5)
+	assert.DeepEquals(t, results[0], db.PrincipalUpdateResult{Name: "alice", Status: 201})
+	assert.DeepEquals(t, results[1], db.PrincipalUpdateResult{Name: "bob", Status: 201})
+	assert.Equals(t, results[2].Status, 400)
+	assert.Equals(t, results[3].Status, 400)
+	assert.Equals(t, results[4].Status, 409)
+	assert.Equals(t, results[4].Error, "conflict")
+
+	// The users that were created can log in:
+	assertStatus(t, rt.Send(requestByUser("GET", "/db/", "", "alice")), 200)
+	assertStatus(t, rt.Send(requestByUser("GET", "/db/", "", "bob")), 200)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/carol", ""), 404)
+
+	// With update_existing, existing users are updated:
+	response = rt.SendAdminRequest("POST", "/db/_user/_bulk", `{"users": [{"name":"alice", "admin_channels":["b"]}], "update_existing": true}`)
+	assertStatus(t, response, 200)
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &results), "Couldn't parse bulk response")
+	assert.DeepEquals(t, results, []db.PrincipalUpdateResult{{Name: "alice", Status: 200}})
+	response = rt.SendAdminRequest("GET", "/db/_user/alice", "")
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body["admin_channels"], []interface{}{"b"})
+
+	// Roles:
+	response = rt.SendAdminRequest("POST", "/db/_role/_bulk", `{"roles": [{"name":"r1", "admin_channels":["x"]}, {"name":"r2"}]}`)
+	assertStatus(t, response, 200)
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &results), "Couldn't parse bulk response")
+	assert.DeepEquals(t, results, []db.PrincipalUpdateResult{{Name: "r1", Status: 201}, {Name: "r2", Status: 201}})
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_role/r2", ""), 200)
+
+	// Bad requests:
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_role/_bulk", `{"users": []}`), 400)
+	rt.GetDatabase().Options.MaxBulkPrincipals = 1
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_role/_bulk", `{"roles": [{"name":"r3"}, {"name":"r4"}]}`), 413)
+}
+
+func TestListPrincipals(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_role/r1", `{"admin_channels":["a"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_role/r2", `{"admin_channels":["b"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["a"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/bob", `{"password":"letmein", "admin_channels":["b"], "disabled":true}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/carol", `{"password":"letmein", "admin_channels":["a", "c"], "admin_roles":["r1"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/dave", `{"password":"letmein"}`), 201)
+
+	assertListResponse := func(resource string, expected string) {
+		response := rt.SendAdminRequest("GET", resource, "")
+		assertStatus(t, response, 200)
+		assert.Equals(t, string(response.Body.Bytes()), expected)
+	}
+	assertListResponse("/db/_user/", `["alice","bob","carol","dave"]`)
+	assertListResponse("/db/_user/?limit=2", `["alice","bob"]`)
+	assertListResponse("/db/_user/?limit=2&startkey=carol", `["carol","dave"]`)
+	assertListResponse(`/db/_user/?startkey="bz"`, `["carol","dave"]`)
+	assertListResponse("/db/_user/?name_prefix=b", `["bob"]`)
+	assertListResponse("/db/_user/?channel=a", `["alice","carol"]`)
+	assertListResponse("/db/_user/?channel=a&limit=1&startkey=b", `["carol"]`)
+	assertListResponse("/db/_user/?channel=x", `[]`)
+	assertListResponse("/db/_role/", `["r1","r2"]`)
+	assertListResponse("/db/_role/?channel=b", `["r2"]`)
+
+	response := rt.SendAdminRequest("GET", "/db/_user/?details=true&name_prefix=b", "")
+	assertStatus(t, response, 200)
+	var summaries []db.PrincipalSummary
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &summaries), nil)
+	assert.DeepEquals(t, summaries, []db.PrincipalSummary{{Name: "bob", ExplicitChannels: []string{"b"}, ExplicitRoleNames: []string{}, Disabled: true}})
+
+	response = rt.SendAdminRequest("GET", "/db/_user/?details=true&channel=c", "")
+	assertStatus(t, response, 200)
+	summaries = nil
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &summaries), nil)
+	assert.DeepEquals(t, summaries, []db.PrincipalSummary{{Name: "carol", ExplicitChannels: []string{"a", "c"}, ExplicitRoleNames: []string{"r1"}}})
+
+	// Prefix and "*" grants cover the channels they match:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/erin", `{"password":"letmein", "admin_channels":["t-1-*"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/frank", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+	assertListResponse("/db/_user/?channel=t-1-x", `["erin","frank"]`)
+	assertListResponse("/db/_user/?channel=t-2-x", `["frank"]`)
+	assertListResponse("/db/_user/?channel=a", `["alice","carol","frank"]`)
+	assertListResponse("/db/_user/?channel=a&limit=2", `["alice","carol"]`)
+	assertListResponse("/db/_user/?channel=t-1-*", `["erin"]`)
+}
+
 func TestGuestUser(t *testing.T) {
 
 	guestUserEndpoint := fmt.Sprintf("/db/_user/%s", base.GuestUsername)
@@ -761,7 +864,42 @@ func TestDBOffline503Response(t *testing.T) {
 	json.Unmarshal(response.Body.Bytes(), &body)
 	assert.True(t, body["state"].(string) == "Offline")
 
-	assertStatus(t, rt.SendRequest("GET", "/db/doc1", ""), 503)
+	response = rt.SendRequest("GET", "/db/doc1", "")
+	assertStatus(t, response, 503)
+	assert.Equals(t, response.Header().Get("Retry-After"), "30")
+}
+
+//Take DB offline and back online, and ensure the change feed resumes
+func TestDBOfflineOnlineResumesChanges(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"channels":["A"]}`), 201)
+	response := rt.SendAdminRequest("POST", "/db/_offline", "")
+	assertStatus(t, response, 200)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_online", ""), 200)
+
+	var body db.Body
+	for i := 0; i < 50; i++ {
+		body = nil
+		json.Unmarshal(rt.SendAdminRequest("GET", "/db/", "").Body.Bytes(), &body)
+		if body["state"] == "Online" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equals(t, body["state"], "Online")
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"channels":["A"]}`), 201)
+	assert.Equals(t, rt.GetDatabase().WaitForPendingChanges(), nil)
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	response = rt.SendAdminRequest("GET", "/db/_changes", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.Equals(t, len(changes.Results), 2)
+	assert.Equals(t, changes.Results[1].ID, "doc2")
 }
 
 //Take DB offline and ensure can put db config
@@ -786,6 +924,119 @@ func TestDBOfflinePutDbConfig(t *testing.T) {
 	assertStatus(t, rt.SendRequest("PUT", "/db/_config", ""), 404)
 }
 
+// PUT a new config to an online database, and make sure it's applied without restarting it
+func TestPutDbConfigReload(t *testing.T) {
+	rt := RestTester{noAdminParty: true}
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["new"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"chan":"new"}`), 201)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/doc1", "", nil, "alice", "letmein"), 403)
+
+	// An invalid sync function is rejected, and the old config stays in effect:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_config", `{"sync":"function(doc) {"}`), 400)
+	assert.Equals(t, rt.GetDatabase().RevsLimit, uint32(db.DefaultRevsLimit))
+
+	response := rt.SendAdminRequest("PUT", "/db/_config",
+		`{"sync":"function(doc) {channel(doc.chan);}", "revs_limit":50, "cache":{"channel_cache_max_length":10}}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["resync_required"], true)
+	assert.Equals(t, rt.GetDatabase().RevsLimit, uint32(50))
+	assert.Equals(t, *rt.ServerContext().GetDatabaseConfig("db").RevsLimit, uint32(50))
+
+	// New writes use the new sync function:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"chan":"new"}`), 201)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/doc2", "", nil, "alice", "letmein"), 200)
+
+	// Putting the same sync function again doesn't require a resync:
+	response = rt.SendAdminRequest("PUT", "/db/_config", `{"sync":"function(doc) {channel(doc.chan);}"}`)
+	assertStatus(t, response, 201)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["resync_required"], false)
+}
+
+// Reloading the config only writes the configured users and roles that differ from it
+func TestPutDbConfigPrincipals(t *testing.T) {
+	rt := RestTester{noAdminParty: true}
+	defer rt.Close()
+
+	putConfig := func(aliceChannels string, alicePassword string) db.Body {
+		response := rt.SendAdminRequest("PUT", "/db/_config", `{
+			"sync": "function(doc) {channel(doc.channels); if (doc.grant) access('alice', doc.grant);}",
+			"users": {"alice": {"password": "`+alicePassword+`", "admin_channels": [`+aliceChannels+`]}},
+			"roles": {"staff": {"admin_channels": ["b"]}}}`)
+		assertStatus(t, response, 201)
+		var body db.Body
+		json.Unmarshal(response.Body.Bytes(), &body)
+		return body["principals"].(map[string]interface{})
+	}
+	assert.DeepEquals(t, putConfig(`"a"`, "letmein"), db.Body{"created": 2.0, "updated": 0.0, "unchanged": 0.0})
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/grant", `{"grant":"dyn"}`), 201)
+	authenticator := rt.GetDatabase().Authenticator()
+	alice, _ := authenticator.GetUser("alice")
+	sequence := alice.Sequence()
+
+	// Nothing has changed, so nothing is written:
+	assert.DeepEquals(t, putConfig(`"a"`, "letmein"), db.Body{"created": 0.0, "updated": 0.0, "unchanged": 2.0})
+	alice, _ = authenticator.GetUser("alice")
+	assert.Equals(t, alice.Sequence(), sequence)
+
+	// Changing alice's admin channels keeps the sync function's grant, and her password:
+	assert.DeepEquals(t, putConfig(`"a", "c"`, "letmein"), db.Body{"created": 0.0, "updated": 1.0, "unchanged": 1.0})
+	alice, _ = authenticator.GetUser("alice")
+	assert.DeepEquals(t, alice.Channels().AsSet(), base.SetOf("!", "a", "c", "dyn"))
+	assert.True(t, alice.Authenticate("letmein"))
+
+	// A password changed since the config set it isn't reset by loading the same config again:
+	alice.SetPassword("changed")
+	assertNoError(t, authenticator.Save(alice), "Save")
+	assert.DeepEquals(t, putConfig(`"a", "c"`, "letmein"), db.Body{"created": 0.0, "updated": 0.0, "unchanged": 2.0})
+	alice, _ = authenticator.GetUser("alice")
+	assert.True(t, alice.Authenticate("changed"))
+
+	// ...but it is when the configured password changes:
+	assert.DeepEquals(t, putConfig(`"a", "c"`, "newpass"), db.Body{"created": 0.0, "updated": 1.0, "unchanged": 1.0})
+	alice, _ = authenticator.GetUser("alice")
+	assert.True(t, alice.Authenticate("newpass"))
+}
+
+// The validate function runs before the sync function, and can be changed without a resync
+func TestValidateFunction(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc) {channel(doc.channels);}`}
+	defer rt.Close()
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+
+	response := rt.SendAdminRequest("PUT", "/db/_config",
+		`{"sync":"function(doc) {channel(doc.channels);}", "validate":"function(doc, oldDoc, userCtx) {if (!doc.title) throw({forbidden: 'missing title'}); if (userCtx && doc.owner != userCtx.name) throw({forbidden: 'not the owner'});}"}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["resync_required"], false)
+
+	response = rt.SendAdminRequest("PUT", "/db/doc1", `{"channels":["a"]}`)
+	assertStatus(t, response, 403)
+	assert.True(t, strings.Contains(response.Body.String(), "missing title"))
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"title":"hi"}`), 201)
+	assertStatus(t, rt.Send(requestByUser("PUT", "/db/doc2", `{"title":"hi", "owner":"bob"}`, "alice")), 403)
+	assertStatus(t, rt.Send(requestByUser("PUT", "/db/doc2", `{"title":"hi", "owner":"alice"}`, "alice")), 201)
+
+	// The validate function can't assign channels:
+	response = rt.SendAdminRequest("PUT", "/db/_config",
+		`{"sync":"function(doc) {channel(doc.channels);}", "validate":"function(doc) {channel('x');}"}`)
+	assertStatus(t, response, 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc3", `{"title":"hi"}`), 500)
+
+	// An invalid validate function is rejected:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_config", `{"validate":"function(doc) {"}`), 400)
+
+	// Removing it lets anything through:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_config", `{"sync":"function(doc) {channel(doc.channels);}"}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc3", `{}`), 201)
+}
+
 //Take DB offline and ensure can post _resync
 func TestDBOfflinePostResync(t *testing.T) {
 	var rt RestTester
@@ -808,6 +1059,217 @@ func TestDBOfflinePostResync(t *testing.T) {
 	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync", ""), 200)
 }
 
+func TestChannelStats(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc1", `{"channels":["ABC"]}`), 201)
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc2", `{"channels":["ABC","NBC"]}`), 201)
+	response := rt.SendRequest("PUT", "/db/doc3", `{"channels":["NBC"]}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc3?rev="+body["rev"].(string), `{"channels":["CBS"]}`), 201)
+
+	var result struct {
+		Channels map[string]db.ChannelDocStats `json:"channels"`
+	}
+	response = rt.SendAdminRequest("GET", "/db/_channels", "")
+	assertStatus(t, response, 200)
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &result), "Unexpected error")
+	assert.Equals(t, result.Channels["ABC"].DocCount, 2)
+	assert.Equals(t, result.Channels["NBC"].DocCount, 1) // doc3 was removed from NBC
+	assert.Equals(t, result.Channels["CBS"].DocCount, 1)
+	assert.Equals(t, result.Channels["CBS"].LastSequence, uint64(4))
+
+	// Restricted to a list of channels, with sample doc IDs:
+	result.Channels = nil
+	response = rt.SendAdminRequest("GET", "/db/_channels?channels=ABC,PBS&doc_ids=true&doc_id_limit=1", "")
+	assertStatus(t, response, 200)
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &result), "Unexpected error")
+	assert.Equals(t, len(result.Channels), 2)
+	assert.Equals(t, result.Channels["ABC"].DocCount, 2)
+	assert.DeepEquals(t, result.Channels["ABC"].DocIDs, []string{"doc1"})
+	assert.Equals(t, result.Channels["PBS"].DocCount, 0)
+
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_channels?channels=bad%20name", ""), 400)
+}
+
+// Run _resync as a background task and poll its status until it completes
+func TestDBOfflineBackgroundResync(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	for i := 0; i < 5; i++ {
+		assertStatus(t, rt.SendRequest("PUT", fmt.Sprintf("/db/doc%d", i), `{"channels":["ABC"]}`), 201)
+	}
+
+	// Can't start while online
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?action=start", ""), 503)
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_offline", ""), 200)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?action=bogus", ""), 400)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?action=stop", ""), 400)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?action=start&docs_per_second=x", ""), 400)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?action=start&docs_per_second=1000", ""), 200)
+
+	var status db.ResyncStatus
+	for i := 0; i < 100; i++ {
+		response := rt.SendAdminRequest("GET", "/db/_resync", "")
+		assertStatus(t, response, 200)
+		assertNoError(t, json.Unmarshal(response.Body.Bytes(), &status), "Unexpected error")
+		if status.State != db.ResyncStateRunning {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equals(t, status.State, db.ResyncStateCompleted)
+	assert.Equals(t, status.DocsTotal, 5)
+	assert.Equals(t, status.DocsProcessed, 5)
+	assert.Equals(t, status.DocsRemaining, 0)
+	assert.False(t, status.PendingCheckpoint)
+
+	response := rt.SendAdminRequest("GET", "/db/", "")
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["state"], "Offline")
+}
+
+// GET /db/_sync_fn_epochs reports docs whose channels were computed by an older sync function
+func TestSyncFnEpochsAPI(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"channels":["ABC"]}`), 201)
+	_, err := rt.GetDatabase().UpdateSyncFun(`function(doc) {channel("XYZ");}`)
+	assertNoError(t, err, "UpdateSyncFun")
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"channels":["ABC"]}`), 201)
+
+	response := rt.SendAdminRequest("GET", "/db/_sync_fn_epochs", "")
+	assertStatus(t, response, 200)
+	var counts db.SyncFnEpochCounts
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &counts), "Unmarshal")
+	assert.Equals(t, counts.Current, rt.GetDatabase().SyncFnEpoch())
+	assert.Equals(t, counts.Docs[counts.Current], 1)
+	assert.Equals(t, counts.StaleDocs, 1)
+
+	assertNoError(t, rt.WaitForPendingChanges(), "WaitForPendingChanges")
+	response = rt.SendAdminRequest("GET", "/db/_changes?sync_fn_epoch=true", "")
+	assertStatus(t, response, 200)
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &changes), "Unmarshal")
+	assert.Equals(t, len(changes.Results), 2)
+	assert.True(t, changes.Results[0].OldSyncFn)
+	assert.False(t, changes.Results[1].OldSyncFn)
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_offline", ""), 200)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?stale_only=true", ""), 400)
+}
+
+// Polls the status of a background consistency check until it's no longer running.
+func waitForConsistencyCheck(t *testing.T, rt *RestTester) db.ConsistencyCheckStatus {
+	var status db.ConsistencyCheckStatus
+	for i := 0; i < 100; i++ {
+		response := rt.SendAdminRequest("GET", "/db/_consistency_check", "")
+		assertStatus(t, response, 200)
+		assertNoError(t, json.Unmarshal(response.Body.Bytes(), &status), "Unexpected error")
+		if status.State != db.ResyncStateRunning {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return status
+}
+
+func TestConsistencyCheck(t *testing.T) {
+	if base.TestUseXattrs() {
+		t.Skip("This test modifies the _sync property of a doc body directly")
+	}
+	rt := RestTester{SyncFn: `function(doc) {channel(doc.channel)}`}
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"channel":"A"}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"channel":"B"}`), 201)
+
+	// Corrupt doc1's channel metadata:
+	var raw map[string]interface{}
+	_, err := rt.Bucket().Get("doc1", &raw)
+	assertNoError(t, err, "Couldn't get doc1")
+	raw["_sync"].(map[string]interface{})["channels"] = map[string]interface{}{"X": nil}
+	assertNoError(t, rt.Bucket().Set("doc1", 0, raw), "Couldn't set doc1")
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_consistency_check?action=bogus", ""), 400)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_consistency_check?action=stop", ""), 400)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_consistency_check", ""), 200)
+	status := waitForConsistencyCheck(t, &rt)
+	assert.Equals(t, status.State, db.ResyncStateCompleted)
+	assert.Equals(t, status.DocsTotal, 2)
+	assert.Equals(t, status.DocsProcessed, 2)
+	assert.Equals(t, status.DocsInconsistent, 1)
+	assert.Equals(t, status.DocsRepaired, 0)
+	assert.DeepEquals(t, status.Issues, []db.ConsistencyIssue{
+		{DocID: "doc1", MissingChannels: []string{"A"}, ExtraChannels: []string{"X"}}})
+
+	// Repair just doc1:
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_consistency_check?repair=true", `{"doc_ids":["doc1"]}`), 200)
+	status = waitForConsistencyCheck(t, &rt)
+	assert.Equals(t, status.State, db.ResyncStateCompleted)
+	assert.True(t, status.Repair)
+	assert.Equals(t, status.DocsTotal, 1)
+	assert.Equals(t, status.DocsRepaired, 1)
+	assert.True(t, status.Issues[0].Repaired)
+
+	// Now doc1 is in channel A's feed, and everything is consistent:
+	rt.WaitForPendingChanges()
+	response := rt.SendAdminRequest("GET", "/db/_changes?filter=sync_gateway/bychannel&channels=A", "")
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &changes), "Couldn't parse changes")
+	assert.Equals(t, len(changes.Results), 1)
+	assert.Equals(t, changes.Results[0].ID, "doc1")
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_consistency_check", ""), 200)
+	status = waitForConsistencyCheck(t, &rt)
+	assert.Equals(t, status.DocsInconsistent, 0)
+	assert.Equals(t, len(status.Issues), 0)
+}
+
+// A stopped _resync leaves a checkpoint that keeps the DB offline until it's resumed or aborted
+func TestDBOfflinePendingResync(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_offline", ""), 200)
+	assertNoError(t, rt.Bucket().Set("_sync:resync_checkpoint", 0, db.Body{"last_doc_id": "doc1", "docs_processed": 1}), "Unexpected error")
+
+	response := rt.SendAdminRequest("GET", "/db/_resync", "")
+	assertStatus(t, response, 200)
+	var status db.ResyncStatus
+	json.Unmarshal(response.Body.Bytes(), &status)
+	assert.True(t, status.PendingCheckpoint)
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_online", ""), 503)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?action=abort", ""), 200)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_online", `{"delay":0}`), 200)
+}
+
+// A _resync is pending in the bucket as soon as it starts, before its first checkpoint
+func TestDBOfflineResyncPendingFromStart(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc1", `{"channels":["ABC"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_offline", ""), 200)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?action=start&docs_per_second=0.1", ""), 200)
+	assert.True(t, rt.GetDatabase().HasPendingResync())
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?action=abort", ""), 200)
+	assert.False(t, rt.GetDatabase().HasPendingResync())
+}
+
 //Take DB offline and ensure only one _resync can be in progress
 // When running under the race flag, we can't guarantee which resync call gets executed first,
 // or even that they execute at the same time.  Disabling test
@@ -1228,6 +1690,20 @@ func TestReplicateErrorConditions(t *testing.T) {
 	//Send JSON Object containing no source and target as local DB
 	assertStatus(t, rt.SendAdminRequest("POST", "/_replicate", `{"target":"mylocaltargetdb"}`), 400)
 
+	//Send JSON Object containing both channels and a filter
+	assertStatus(t, rt.SendAdminRequest("POST", "/_replicate", `{"source":"db", "target":"db2", "channels":["A"], "filter":"sync_gateway/bychannel", "query_params":["A"]}`), 400)
+
+}
+
+func TestReplicateChannelsShorthand(t *testing.T) {
+	params, _, localdb, err := validateReplicationParameters(ReplicationConfig{
+		Source:   "db",
+		Target:   "http://myhost:4985/mytargetdb",
+		Channels: []string{"A", "B"},
+	}, false, "127.0.0.1:4985")
+	assert.Equals(t, err, nil)
+	assert.True(t, localdb)
+	assert.DeepEquals(t, params.Channels, []string{"A", "B"})
 }
 
 //These tests validate request parameters not actual replication
@@ -1271,3 +1747,337 @@ func TestDocumentChangeReplicate(t *testing.T) {
 	assertStatus(t, rt.SendAdminRequest("POST", "/_replicate", `{"replication_id":"ABC", "cancel":true}`), 404)
 
 }
+
+func TestSyncFunctionTest(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc, oldDoc) {if (doc.bad) {throw({forbidden: "bad doc"});} channel(doc.channels); access(doc.owner, doc.channels);}`}
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("POST", "/db/_sync_function_test", `{"doc": {"channels": ["ch1"], "owner": "alice"}}`)
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body["channels"], []interface{}{"ch1"})
+	assert.DeepEquals(t, body["access"], map[string]interface{}{"alice": []interface{}{"ch1"}})
+	assert.Equals(t, body["rejection"], nil)
+
+	// Rejections are reported, not returned as errors
+	response = rt.SendAdminRequest("POST", "/db/_sync_function_test", `{"doc": {"bad": true}}`)
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body["rejection"], map[string]interface{}{"status": float64(403), "message": "bad doc"})
+
+	// Alternate sync function
+	response = rt.SendAdminRequest("POST", "/db/_sync_function_test", `{"doc": {}, "sync": "function(doc) {channel(\"other\");}"}`)
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body["channels"], []interface{}{"other"})
+
+	// Invalid sync function
+	response = rt.SendAdminRequest("POST", "/db/_sync_function_test", `{"doc": {}, "sync": "function(doc) {channel("}`)
+	assertStatus(t, response, 400)
+
+	// Unknown user
+	response = rt.SendAdminRequest("POST", "/db/_sync_function_test", `{"doc": {}, "user": "nobody"}`)
+	assertStatus(t, response, 404)
+
+	// Nothing should have been written
+	response = rt.SendAdminRequest("GET", "/db/_all_docs", "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, len(body["rows"].([]interface{})), 0)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	writes := base.MetricDocWrites.Value("db")
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"foo":"bar"}`), 201)
+	assert.Equals(t, base.MetricDocWrites.Value("db"), writes+1)
+
+	response := rt.SendAdminRequest("GET", "/_metrics", "")
+	assertStatus(t, response, 200)
+	assert.True(t, strings.HasPrefix(response.Header().Get("Content-Type"), "text/plain"))
+	text := response.Body.String()
+	assert.True(t, strings.Contains(text, "# TYPE sgw_doc_writes_total counter\n"))
+	assert.True(t, strings.Contains(text, fmt.Sprintf("sgw_doc_writes_total{db=\"db\"} %d\n", writes+1)))
+	assert.True(t, strings.Contains(text, "\ngo_goroutines "))
+}
+
+func TestGetRawDoc(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/doc1", `{"value":1}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	rev1 := body["rev"].(string)
+	response = rt.SendAdminRequest("PUT", "/db/doc1?rev="+rev1, `{"value":2}`)
+	assertStatus(t, response, 201)
+
+	// The whole doc, with its sync metadata:
+	response = rt.SendAdminRequest("GET", "/db/_raw/doc1", "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["value"], 2.0)
+	syncMeta, ok := body["_sync"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.True(t, syncMeta["sequence"] != nil)
+	assert.True(t, syncMeta["history"] != nil)
+
+	// Just the metadata:
+	response = rt.SendAdminRequest("GET", "/db/_raw/doc1?include_doc=false", "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["value"], nil)
+	assert.True(t, body["_sync"] != nil)
+
+	// An older revision's stored body:
+	response = rt.SendAdminRequest("GET", "/db/_raw/doc1?rev="+rev1, "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["value"], 1.0)
+
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_raw/doc1?rev=9-abc", ""), 404)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_raw/nosuchdoc", ""), 404)
+}
+
+func TestAllDocsIncludeSizes(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/small", `{"n": 1}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/big", `{"text": "`+strings.Repeat("x", 1000)+`"}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/attached",
+		`{"n": 2, "_attachments": {"hello.txt": {"data": "aGVsbG8gd29ybGQ="}}}`), 201)
+
+	type sizesRow struct {
+		ID    string `json:"id"`
+		Value struct {
+			Sizes *db.DocSizes `json:"sizes"`
+		} `json:"value"`
+	}
+	getRows := func(query string) []sizesRow {
+		response := rt.SendAdminRequest("GET", "/db/_all_docs?"+query, "")
+		assertStatus(t, response, 200)
+		var body struct {
+			Rows []sizesRow `json:"rows"`
+		}
+		assertNoError(t, json.Unmarshal(response.Body.Bytes(), &body), "Unmarshal")
+		return body.Rows
+	}
+
+	rows := getRows("include_sizes=true")
+	assert.Equals(t, len(rows), 3)
+	sizes := map[string]db.DocSizes{}
+	for _, row := range rows {
+		assert.True(t, row.Value.Sizes != nil)
+		sizes[row.ID] = *row.Value.Sizes
+	}
+	assert.Equals(t, sizes["attached"].Attachments, int64(len("hello world")))
+	assert.Equals(t, sizes["small"].Attachments, int64(0))
+	assert.True(t, sizes["big"].Body > 1000)
+	assert.True(t, sizes["small"].Body < 100)
+	assert.True(t, sizes["small"].Sync > 0)
+
+	// Without include_sizes there are none:
+	rows = getRows("")
+	assert.True(t, rows[0].Value.Sizes == nil)
+
+	// Sorted by size, biggest first:
+	rows = getRows("sort=size")
+	assert.Equals(t, len(rows), 3)
+	assert.Equals(t, rows[0].ID, "big")
+	assert.True(t, rows[1].Value.Sizes.Total() >= rows[2].Value.Sizes.Total())
+	rows = getRows("sort=size&limit=1")
+	assert.Equals(t, len(rows), 1)
+	assert.Equals(t, rows[0].ID, "big")
+	rows = getRows("sort=size&skip=1&limit=1")
+	assert.Equals(t, len(rows), 1)
+	assert.True(t, rows[0].ID != "big")
+
+	// Only the rows that may be written are kept while sorting, and ties stay in doc ID order:
+	var sorted sizedRowHeap
+	for i, size := range []int64{3, 9, 1, 9, 5} {
+		sorted.add(sizedRow{row: i, size: size, index: sorted.found}, 3)
+		assert.True(t, len(sorted.sizedRows) <= 3)
+	}
+	sort.Sort(sorted.sizedRows)
+	assert.Equals(t, len(sorted.sizedRows), 3)
+	for i, expected := range []int{1, 3, 4} {
+		assert.Equals(t, sorted.sizedRows[i].row, expected)
+	}
+
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_all_docs?sort=name", ""), 400)
+	assertStatus(t, rt.SendRequest("GET", "/db/_all_docs?include_sizes=true", ""), 403)
+}
+
+func TestGetRejections(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc) {if (doc.reject) {throw({forbidden: "rejected: " + doc.reason})}}`}
+	defer rt.Close()
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+
+	response := rt.Send(requestByUser("PUT", "/db/doc1", `{"reject":true, "reason":"no"}`, "bernard"))
+	assertStatus(t, response, 403)
+	assert.True(t, strings.Contains(response.Body.String(), "rejected: no"))
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"reject":true, "reason":"no"}`), 403)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc3", `{"value":1}`), 201)
+
+	// With messages hidden, the public API gets a generic one, but the rejection is still recorded:
+	rt.GetDatabase().Options.HideSyncRejectionMessages = true
+	response = rt.Send(requestByUser("PUT", "/db/doc4", `{"reject":true, "reason":"secret"}`, "bernard"))
+	assertStatus(t, response, 403)
+	assert.False(t, strings.Contains(response.Body.String(), "secret"))
+
+	response = rt.SendAdminRequest("GET", "/db/_rejections", "")
+	assertStatus(t, response, 200)
+	var body struct {
+		Recent []db.SyncRejection `json:"recent"`
+		Counts map[string]int64   `json:"counts"`
+	}
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &body), "Couldn't parse _rejections response")
+	assert.Equals(t, len(body.Recent), 3)
+	assert.Equals(t, body.Recent[0].DocID, "doc1")
+	assert.Equals(t, body.Recent[0].User, "bernard")
+	assert.Equals(t, body.Recent[0].Status, 403)
+	assert.Equals(t, body.Recent[0].Message, "rejected: no")
+	assert.Equals(t, body.Recent[1].DocID, "doc2")
+	assert.Equals(t, body.Recent[1].User, "")
+	assert.Equals(t, body.Recent[2].Message, "rejected: secret")
+	assert.Equals(t, body.Counts["rejected: no"], int64(2))
+	assert.Equals(t, body.Counts["rejected: secret"], int64(1))
+
+	// Not available on the public API:
+	assertStatus(t, rt.SendRequest("GET", "/db/_rejections", ""), 404)
+}
+
+func TestDatabaseLogging(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/_logging", `{"HTTP":true}`), 200)
+	globalLevel := base.LogLevel()
+
+	// Setting a database's keys and level doesn't change the global ones:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/_logging?db=db&level=2", `{"Changes+":true, "Changes":true}`), 200)
+	response := rt.SendAdminRequest("GET", "/_logging?db=db", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), `{"Changes":true,"Changes+":true}`)
+	response = rt.SendAdminRequest("GET", "/_logging", "")
+	assert.Equals(t, response.Body.String(), `{"HTTP":true}`)
+	assert.Equals(t, rt.GetDatabase().LogKeys.Level(), 2)
+	assert.Equals(t, base.LogLevel(), globalLevel)
+
+	// POST adds to the database's keys:
+	assertStatus(t, rt.SendAdminRequest("POST", "/_logging?db=db", `{"Cache":true}`), 200)
+	assert.DeepEquals(t, rt.GetDatabase().LogKeys.Keys(), map[string]bool{"Changes": true, "Changes+": true, "Cache": true})
+
+	// DELETE goes back to the global keys and level:
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/_logging?db=db", ""), 200)
+	response = rt.SendAdminRequest("GET", "/_logging?db=db", "")
+	assert.Equals(t, response.Body.String(), `{"HTTP":true}`)
+	assert.Equals(t, rt.GetDatabase().LogKeys.Level(), 0)
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/_logging?db=nosuchdb", `{"CRUD":true}`), 404)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/_logging", ""), 400)
+}
+
+func TestUserSyncStatus(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/nobody/_sync_status", ""), 404)
+
+	// A user who hasn't replicated has no activity:
+	var status db.UserSyncStatus
+	response := rt.SendAdminRequest("GET", "/db/_user/alice/_sync_status", "")
+	assertStatus(t, response, 200)
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &status), "Couldn't parse status")
+	assert.Equals(t, status.LastChanges, "never")
+	assert.Equals(t, status.LastChangesSince, "never")
+	assert.Equals(t, status.LastCheckpoint, "never")
+	assert.Equals(t, status.LastCheckpointSeq, "never")
+	assert.True(t, status.Lag == nil)
+
+	for i := 1; i <= 3; i++ {
+		assertStatus(t, rt.SendAdminRequest("PUT", fmt.Sprintf("/db/doc%d", i), `{}`), 201)
+	}
+	rt.WaitForPendingChanges()
+
+	// Admin requests aren't the user's activity:
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_changes", ""), 200)
+
+	assertStatus(t, rt.Send(requestByUser("GET", "/db/_changes?since=1", "", "alice")), 200)
+	assertStatus(t, rt.Send(requestByUser("PUT", "/db/_local/checkpoint", `{"lastSequence":"1"}`, "alice")), 201)
+	status = db.UserSyncStatus{}
+	response = rt.SendAdminRequest("GET", "/db/_user/alice/_sync_status", "")
+	assertStatus(t, response, 200)
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &status), "Couldn't parse status")
+	assert.Equals(t, status.Name, "alice")
+	_, err := time.Parse(time.RFC3339, status.LastChanges)
+	assertNoError(t, err, "last_changes isn't a time")
+	assert.Equals(t, status.LastChangesSince, "1")
+	_, err = time.Parse(time.RFC3339, status.LastCheckpoint)
+	assertNoError(t, err, "last_checkpoint isn't a time")
+	assert.Equals(t, status.LastCheckpointSeq, "1")
+	assert.Equals(t, status.CurrentSeq, uint64(3))
+	// A lastSequence checkpoint may be a push one, so the lag is the changes request's:
+	assert.Equals(t, *status.Lag, uint64(2))
+
+	// A Couchbase Lite 2 checkpoint's remote sequence is a pull one:
+	assertStatus(t, rt.Send(requestByUser("PUT", "/db/_local/cp2", `{"local":10, "remote":2}`, "alice")), 201)
+	status = db.UserSyncStatus{}
+	response = rt.SendAdminRequest("GET", "/db/_user/alice/_sync_status", "")
+	assertStatus(t, response, 200)
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &status), "Couldn't parse status")
+	assert.Equals(t, status.LastCheckpointSeq, "2")
+	assert.Equals(t, *status.Lag, uint64(1))
+}
+
+func TestRefreshUser(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_role/staff", `{"admin_channels":["s"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["a"], "admin_roles":["staff"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/nobody/_refresh", ""), 404)
+
+	// Edit the role's doc directly, as tooling might; its computed channels are now stale:
+	bucket := rt.Bucket()
+	raw, _, err := bucket.GetRaw("_sync:role:staff")
+	assertNoError(t, err, "GetRaw")
+	var roleDoc map[string]interface{}
+	assertNoError(t, json.Unmarshal(raw, &roleDoc), "Couldn't parse role doc")
+	roleDoc["admin_channels"].(map[string]interface{})["s2"] = 1
+	raw, _ = json.Marshal(roleDoc)
+	assertNoError(t, bucket.SetRaw("_sync:role:staff", 0, raw), "SetRaw")
+
+	var refresh db.UserChannelsRefresh
+	response := rt.SendAdminRequest("POST", "/db/_user/alice/_refresh", "")
+	assertStatus(t, response, 200)
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &refresh), "Couldn't parse refresh")
+	assert.Equals(t, refresh.Name, "alice")
+	assert.DeepEquals(t, refresh.ChannelsBefore, channels.SetOf("!", "a", "s"))
+	assert.DeepEquals(t, refresh.ChannelsAfter, channels.SetOf("!", "a", "s", "s2"))
+
+	// The recomputed channels were saved:
+	user, err := rt.GetDatabase().Authenticator().GetUser("alice")
+	assertNoError(t, err, "GetUser")
+	assert.True(t, user.CanSeeChannel("s2"))
+
+	// Refreshing all users finds nothing else stale:
+	var result db.AllUsersRefresh
+	response = rt.SendAdminRequest("POST", "/db/_user/_refresh?rate=1000", "")
+	assertStatus(t, response, 200)
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &result), "Couldn't parse refresh")
+	assert.Equals(t, result.Users, 1)
+	assert.DeepEquals(t, result.Changed, []string{})
+}
@@ -0,0 +1,176 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// The admin API is open to anyone who can reach its port, unless admin_keys are configured.  Then
+// every admin request has to present one of the keys as "Authorization: Bearer <key>", and the
+// key's permissions have to cover the route.  Only the SHA-256 digests of the keys are stored in
+// the config, and the name of the key that made each change is logged.
+
+// Permission sets of admin keys
+const (
+	AdminPermissionsReadOnly = "read-only"         // GETs, and POSTs that only read, except of config and sessions
+	AdminPermissionsUsers    = "user-management"   // read-only, plus sessions and changing users and roles
+	AdminPermissionsConfig   = "config-management" // read-only, plus server and database config
+	AdminPermissionsFull     = "full"              // Everything, including writing docs
+)
+
+type adminPermission uint
+
+const (
+	adminPermRead adminPermission = 1 << iota
+	adminPermUsers
+	adminPermConfig
+	adminPermWrite
+
+	adminPermAll = adminPermRead | adminPermUsers | adminPermConfig | adminPermWrite
+)
+
+var adminPermissionSets = map[string]adminPermission{
+	AdminPermissionsReadOnly: adminPermRead,
+	AdminPermissionsUsers:    adminPermRead | adminPermUsers,
+	AdminPermissionsConfig:   adminPermRead | adminPermConfig,
+	AdminPermissionsFull:     adminPermAll,
+}
+
+// An admin API key, named by its key in the admin_keys map.
+type AdminKeyConfig struct {
+	KeySHA256   string `json:"key_sha256"`  // Hex SHA-256 digest of the key
+	Permissions string `json:"permissions"` // "read-only", "user-management", "config-management" or "full"
+	digest      []byte
+	permissions adminPermission
+}
+
+func (config *AdminKeyConfig) validate(name string) error {
+	digest, err := hex.DecodeString(config.KeySHA256)
+	if err != nil || len(digest) != sha256.Size {
+		return fmt.Errorf("Admin key %q: key_sha256 must be a hex SHA-256 digest", name)
+	}
+	permissions, found := adminPermissionSets[config.Permissions]
+	if !found {
+		return fmt.Errorf("Admin key %q: invalid permissions %q; must be %q, %q, %q or %q", name, config.Permissions,
+			AdminPermissionsReadOnly, AdminPermissionsUsers, AdminPermissionsConfig, AdminPermissionsFull)
+	}
+	config.digest = digest
+	config.permissions = permissions
+	return nil
+}
+
+// Admin keys, mapped by name
+type AdminKeyMap map[string]*AdminKeyConfig
+
+// Returns the name and config of the key, or nil if it's not one of the admin keys.
+func (keys AdminKeyMap) find(key string) (string, *AdminKeyConfig) {
+	digest := sha256.Sum256([]byte(key))
+	for name, config := range keys {
+		if subtle.ConstantTimeCompare(digest[:], config.digest) == 1 {
+			return name, config
+		}
+	}
+	return "", nil
+}
+
+// POSTs that only read, on database-relative paths
+var adminReadOnlyPosts = map[string]bool{
+	"_all_docs":           true,
+	"_bulk_get":           true,
+	"_changes":            true,
+	"_revs_diff":          true,
+	"_sync_function_test": true,
+}
+
+// Returns the permission a request to the admin API needs, judging by its method and path.
+func requiredAdminPermission(method, path string) adminPermission {
+	reading := method == "GET" || method == "HEAD"
+	components := strings.Split(strings.Trim(path, "/"), "/")
+	if components[0] == "" || strings.HasPrefix(components[0], "_") {
+		// Server-level path:
+		switch components[0] {
+		case "_config", "_logging", "_profile", "_heap", "_debug":
+			return adminPermConfig
+		}
+	} else if len(components) == 1 {
+		// Database root; PUT and DELETE create and delete the database:
+		switch method {
+		case "PUT", "DELETE":
+			return adminPermConfig
+		}
+	} else if reading {
+		// Database config includes the bucket credentials, and sessions can be used to log in
+		// as their users:
+		switch components[1] {
+		case "_config":
+			return adminPermConfig
+		case "_session":
+			return adminPermUsers
+		case "_user":
+			if len(components) > 3 && strings.HasPrefix(components[3], "_session") {
+				return adminPermUsers
+			}
+		}
+	} else {
+		switch name := components[1]; name {
+		case "_user", "_role", "_session":
+			return adminPermUsers
+		case "_config", "_resync", "_online", "_offline", "_design":
+			return adminPermConfig
+		default:
+			if method == "POST" && adminReadOnlyPosts[name] {
+				return adminPermRead
+			}
+		}
+	}
+	if reading {
+		return adminPermRead
+	}
+	return adminPermWrite
+}
+
+// Authenticates a request to the admin API by its admin key, if any keys are configured.
+func (h *handler) checkAdminAuth() error {
+	keys := h.server.config.AdminKeys
+	if len(keys) == 0 {
+		return nil
+	}
+	token := h.getBearerToken()
+	if token == "" {
+		h.response.Header().Set("WWW-Authenticate", `Bearer realm="Couchbase Sync Gateway Admin"`)
+		return base.HTTPErrorf(http.StatusUnauthorized, "Admin key required")
+	}
+	name, key := keys.find(token)
+	if key == nil {
+		h.response.Header().Set("WWW-Authenticate", `Bearer realm="Couchbase Sync Gateway Admin", error="invalid_token"`)
+		return base.HTTPErrorf(http.StatusUnauthorized, "Invalid admin key")
+	}
+	h.adminKey = name
+	if required := requiredAdminPermission(h.rq.Method, h.rq.URL.Path); key.permissions&required == 0 {
+		return base.HTTPErrorf(http.StatusForbidden, "Admin key %q is not permitted to do this", name)
+	}
+	return nil
+}
+
+// Logs a change made through the admin API with a key, whether or not HTTP logging is enabled.
+func (h *handler) logAdminAudit() {
+	if h.adminKey == "" || h.rq.Method == "GET" || h.rq.Method == "HEAD" {
+		return
+	}
+	base.Logf("Audit: #%03d: %s %s by admin key %q", h.serialNumber, h.rq.Method, base.SanitizeRequestURL(h.rq.URL), h.adminKey)
+}
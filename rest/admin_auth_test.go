@@ -0,0 +1,115 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func testAdminKey(t *testing.T, key, permissions string) *AdminKeyConfig {
+	config := &AdminKeyConfig{KeySHA256: fmt.Sprintf("%x", sha256.Sum256([]byte(key))), Permissions: permissions}
+	assertNoError(t, config.validate(key), "validate")
+	return config
+}
+
+func TestRequiredAdminPermission(t *testing.T) {
+	cases := []struct {
+		method, path string
+		required     adminPermission
+	}{
+		{"GET", "/", adminPermRead},
+		{"GET", "/_config", adminPermConfig},
+		{"PUT", "/_logging", adminPermConfig},
+		{"GET", "/_expvar", adminPermRead},
+		{"POST", "/_replicate", adminPermWrite},
+		{"PUT", "/db/", adminPermConfig},
+		{"DELETE", "/db/", adminPermConfig},
+		{"POST", "/db/", adminPermWrite},
+		{"GET", "/db/doc", adminPermRead},
+		{"PUT", "/db/doc", adminPermWrite},
+		{"GET", "/db/_user/alice", adminPermRead},
+		{"PUT", "/db/_user/alice", adminPermUsers},
+		{"DELETE", "/db/_role/admins", adminPermUsers},
+		{"POST", "/db/_session", adminPermUsers},
+		{"GET", "/db/_user/alice/_sessions", adminPermUsers},
+		{"GET", "/db/_session/1234", adminPermUsers},
+		{"GET", "/db/_config", adminPermConfig},
+		{"PUT", "/db/_config", adminPermConfig},
+		{"POST", "/db/_offline", adminPermConfig},
+		{"PUT", "/db/_design/foo", adminPermConfig},
+		{"POST", "/db/_changes", adminPermRead},
+		{"POST", "/db/_bulk_docs", adminPermWrite},
+		{"POST", "/db/_purge", adminPermWrite},
+	}
+	for _, c := range cases {
+		assert.Equals(t, requiredAdminPermission(c.method, c.path), c.required)
+	}
+
+	assert.True(t, (&AdminKeyConfig{KeySHA256: "1234", Permissions: "full"}).validate("short") != nil)
+	config := testAdminKey(t, "key", "full")
+	config.Permissions = "root"
+	assert.True(t, config.validate("bad") != nil)
+}
+
+func TestAdminKeyAuth(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	// With no keys, the admin API is open:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein"}`), 201)
+
+	rt.ServerContext().config.AdminKeys = AdminKeyMap{
+		"monitor":  testAdminKey(t, "monitor-secret", AdminPermissionsReadOnly),
+		"helpdesk": testAdminKey(t, "helpdesk-secret", AdminPermissionsUsers),
+		"ops":      testAdminKey(t, "ops-secret", AdminPermissionsConfig),
+		"root":     testAdminKey(t, "root-secret", AdminPermissionsFull),
+	}
+	withKey := func(key string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + key}
+	}
+
+	// Missing or unknown keys get a 401:
+	response := rt.SendAdminRequest("GET", "/db/_user/alice", "")
+	assertStatus(t, response, 401)
+	assert.Equals(t, response.Header().Get("WWW-Authenticate"), `Bearer realm="Couchbase Sync Gateway Admin"`)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/db/_user/alice", "", withKey("wrong")), 401)
+
+	// Every key can read:
+	for _, key := range []string{"monitor-secret", "helpdesk-secret", "ops-secret", "root-secret"} {
+		assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/db/_user/alice", "", withKey(key)), 200)
+	}
+
+	// Only user-management and full keys can change users:
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/db/_user/bob", `{"password":"letmein"}`, withKey("monitor-secret")), 403)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/db/_user/bob", `{"password":"letmein"}`, withKey("ops-secret")), 403)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/db/_user/bob", `{"password":"letmein"}`, withKey("helpdesk-secret")), 201)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/db/_user/carol", `{"password":"letmein"}`, withKey("root-secret")), 201)
+
+	// Only config-management and full keys can change config:
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/_logging", `{}`, withKey("helpdesk-secret")), 403)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/_logging", `{}`, withKey("ops-secret")), 200)
+
+	// Reading the database config or a user's sessions needs the same permissions as changing them:
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/db/_config", "", withKey("monitor-secret")), 403)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/db/_config", "", withKey("ops-secret")), 200)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/db/_user/alice/_sessions", "", withKey("monitor-secret")), 403)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("GET", "/db/_user/alice/_sessions", "", withKey("helpdesk-secret")), 200)
+
+	// Only full keys can write docs:
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/db/doc", `{"a":1}`, withKey("ops-secret")), 403)
+	assertStatus(t, rt.SendAdminRequestWithHeaders("PUT", "/db/doc", `{"a":1}`, withKey("root-secret")), 201)
+
+	// A read-only POST is allowed for a read-only key:
+	assertStatus(t, rt.SendAdminRequestWithHeaders("POST", "/db/_all_docs", `{"keys":["doc"]}`, withKey("monitor-secret")), 200)
+}
@@ -86,6 +86,7 @@ func (h *handler) handleAllDbs() error {
 }
 
 func (h *handler) handleCompact() error {
+	h.setRequestClass(bulkRequest)
 	revsDeleted, err := h.db.Compact()
 	if err != nil {
 		return err
@@ -95,6 +96,7 @@ func (h *handler) handleCompact() error {
 }
 
 func (h *handler) handleVacuum() error {
+	h.setRequestClass(bulkRequest)
 	attsDeleted, err := db.VacuumAttachments(h.db.Bucket)
 	if err != nil {
 		return err
@@ -119,7 +121,39 @@ func (h *handler) handleFlush() error {
 	}
 }
 
+// POST /db/_resync.  With no action, re-runs the sync function on all docs and returns when done.
+// action=start runs it as a background task (optionally rate-limited by docs_per_second, and
+// limited by stale_only=true to the docs on older sync function epochs), action=stop pauses it at
+// a checkpoint, and action=abort cancels it and discards the checkpoint.
 func (h *handler) handleResync() error {
+	switch action := h.getQuery("action"); action {
+	case "":
+		// Synchronous resync, below
+		if h.getBoolQuery("stale_only") {
+			return base.HTTPErrorf(http.StatusBadRequest, "stale_only requires action=start")
+		}
+	case "start":
+		var docsPerSecond float64
+		if rate := h.getQuery("docs_per_second"); rate != "" {
+			var err error
+			if docsPerSecond, err = strconv.ParseFloat(rate, 64); err != nil {
+				return base.HTTPErrorf(http.StatusBadRequest, "Invalid docs_per_second %q", rate)
+			}
+		}
+		if err := h.db.StartResync(docsPerSecond, h.getBoolQuery("stale_only")); err != nil {
+			return err
+		}
+		h.writeJSON(h.db.GetResyncStatus())
+		return nil
+	case "stop", "abort":
+		if err := h.db.StopResync(action == "abort"); err != nil {
+			return err
+		}
+		h.writeJSON(h.db.GetResyncStatus())
+		return nil
+	default:
+		return base.HTTPErrorf(http.StatusBadRequest, "Unknown _resync action %q", action)
+	}
 
 	//If the DB is already re syncing, return error to user
 	dbState := atomic.LoadUint32(&h.db.State)
@@ -144,6 +178,56 @@ func (h *handler) handleResync() error {
 	return nil
 }
 
+// GET /db/_resync: progress of the current or most recent background resync.
+func (h *handler) handleGetResync() error {
+	h.writeJSON(h.db.GetResyncStatus())
+	return nil
+}
+
+// POST /db/_consistency_check: starts checking, in the background, that docs' channel metadata and
+// channel index entries agree with the sync function.  An optional body {"doc_ids": [...]} limits
+// the check to those docs, and ?repair=true fixes the inconsistent docs.  action=stop stops it.
+func (h *handler) handleConsistencyCheck() error {
+	h.setRequestClass(bulkRequest)
+	if action := h.getQuery("action"); action == "stop" {
+		if err := h.db.StopConsistencyCheck(); err != nil {
+			return err
+		}
+		h.writeJSON(h.db.GetConsistencyCheckStatus())
+		return nil
+	} else if action != "" && action != "start" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Unknown _consistency_check action %q", action)
+	}
+
+	var docIDs []string
+	if body, err := h.readBody(); err != nil {
+		return err
+	} else if len(body) > 0 {
+		var request struct {
+			DocIDs []string `json:"doc_ids"`
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid request body: %v", err)
+		}
+		docIDs = request.DocIDs
+		if docIDs == nil {
+			docIDs = []string{}
+		}
+	}
+	if err := h.db.StartConsistencyCheck(docIDs, h.getBoolQuery("repair")); err != nil {
+		return err
+	}
+	h.writeJSON(h.db.GetConsistencyCheckStatus())
+	return nil
+}
+
+// GET /db/_consistency_check: progress of the current or most recent consistency check, and the
+// report of the inconsistent docs found.
+func (h *handler) handleGetConsistencyCheck() error {
+	h.writeJSON(h.db.GetConsistencyCheckStatus())
+	return nil
+}
+
 func (h *handler) instanceStartTime() json.Number {
 	return json.Number(strconv.FormatInt(h.db.StartTime.UnixNano()/1000, 10))
 }
@@ -154,23 +238,31 @@ func (h *handler) handleGetDB() error {
 	}
 
 	lastSeq := uint64(0)
+	stableSeq := uint64(0)
 	runState := db.RunStateString[atomic.LoadUint32(&h.db.State)]
 
 	// Don't bother trying to lookup LastSequence() if offline
 	if runState != db.RunStateString[db.DBOffline] {
 		lastSeq, _ = h.db.LastSequence()
+		stableSeq, _ = h.db.StableSequence()
 	}
 
 	response := db.Body{
 		"db_name":              h.db.Name,
-		"update_seq":           lastSeq,
+		"update_seq":           stableSeq, // The changes feeds are complete up to here
 		"committed_update_seq": lastSeq,
 		"instance_start_time":  h.instanceStartTime(),
 		"compact_running":      false, // TODO: Implement this
 		"purge_seq":            0,     // TODO: Should track this value
 		"disk_format_version":  0,     // Probably meaningless, but add for compatibility
 		"state":                runState,
-		//"doc_count":          h.db.DocCount(), // Removed: too expensive to compute (#278)
+		"disable_guest":        h.db.GetOptions().DisableGuest, // If true, other requests without credentials get a 401
+	}
+	// The doc counts are maintained by the gateway (#278), and left out until they've been loaded:
+	if counts, ok := h.db.DocStateCounts(); ok {
+		response["doc_count"] = counts.Docs
+		response["tombstone_count"] = counts.Tombstones
+		response["conflict_count"] = counts.Conflicts
 	}
 	h.writeJSON(response)
 	return nil
@@ -307,12 +399,13 @@ func (h *handler) handlePprofThreadcreate() error {
 }
 
 type stats struct {
-	MemStats runtime.MemStats
+	MemStats       runtime.MemStats
+	RequestTimings requestTimingsSnapshot
 }
 
 // ADMIN API to expose runtime and other stats
 func (h *handler) handleStats() error {
-	st := stats{}
+	st := stats{RequestTimings: handlerTimings.snapshot()}
 	runtime.ReadMemStats(&st.MemStats)
 
 	h.writeJSON(st)
@@ -12,10 +12,14 @@ package rest
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -59,6 +63,34 @@ func TestRoot(t *testing.T) {
 	assert.Equals(t, response.Header().Get("Allow"), "GET, HEAD")
 }
 
+func TestGetDBDocCounts(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	// Wait for the counts to be loaded:
+	for i := 0; i < 100; i++ {
+		if _, ok := rt.GetDatabase().DocStateCounts(); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	revid := rt.createDoc(t, "doc1")
+	rt.createDoc(t, "doc2")
+	assertStatus(t, rt.SendRequest("DELETE", "/db/doc1?rev="+revid, ""), 200)
+	assertNoError(t, rt.WaitForPendingChanges(), "WaitForPendingChanges")
+
+	response := rt.SendRequest("GET", "/db/", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &body), "Unmarshal")
+	assert.Equals(t, body["doc_count"], float64(1))
+	assert.Equals(t, body["tombstone_count"], float64(1))
+	assert.Equals(t, body["conflict_count"], float64(0))
+	assert.Equals(t, body["update_seq"], float64(3))
+	assert.Equals(t, body["committed_update_seq"], float64(3))
+}
+
 func (rt *RestTester) createDoc(t *testing.T, docid string) string {
 	response := rt.SendRequest("PUT", "/db/"+docid, `{"prop":true}`)
 	assertStatus(t, response, 201)
@@ -150,6 +182,160 @@ func TestDocEtag(t *testing.T) {
 
 }
 
+// Conditional GETs with If-None-Match, and writes with If-Match
+func TestDocConditionalRequests(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	response := rt.SendRequest("PUT", "/db/doc", `{"prop":true}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	rev1 := body["rev"].(string)
+
+	// The client has the current revision:
+	response = rt.SendRequestWithHeaders("GET", "/db/doc", "", map[string]string{"If-None-Match": strconv.Quote(rev1)})
+	assertStatus(t, response, 304)
+	assert.Equals(t, response.Body.Len(), 0)
+	assert.Equals(t, response.Header().Get("Etag"), strconv.Quote(rev1))
+
+	// The client has some other revision:
+	response = rt.SendRequestWithHeaders("GET", "/db/doc", "", map[string]string{"If-None-Match": `"1-abc", W/"1-def"`})
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["_rev"], rev1)
+	assert.Equals(t, body["prop"], true)
+	assert.Equals(t, body["_revisions"], nil)
+	response = rt.SendRequestWithHeaders("GET", "/db/doc?revs=true", "", map[string]string{"If-None-Match": `"1-abc"`})
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.True(t, body["_revisions"] != nil)
+
+	// If-Match instead of ?rev=:
+	response = rt.SendRequestWithHeaders("PUT", "/db/doc", `{"prop":false}`, map[string]string{"If-Match": strconv.Quote(rev1)})
+	assertStatus(t, response, 201)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	rev2 := body["rev"].(string)
+	response = rt.SendRequestWithHeaders("PUT", "/db/doc", `{"prop":3}`, map[string]string{"If-Match": strconv.Quote(rev1)})
+	assertStatus(t, response, 409)
+	response = rt.SendRequestWithHeaders("PUT", "/db/doc?rev="+rev1, `{"prop":3}`, map[string]string{"If-Match": strconv.Quote(rev2)})
+	assertStatus(t, response, 400)
+
+	// Attachments:
+	response = rt.SendRequestWithHeaders("PUT", "/db/doc/attach1", "attachment body", map[string]string{"If-Match": strconv.Quote(rev2)})
+	assertStatus(t, response, 201)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	rev3 := body["rev"].(string)
+	response = rt.SendRequest("GET", "/db/doc/attach1", "")
+	assertStatus(t, response, 200)
+	digest := response.Header().Get("Etag")
+	response = rt.SendRequestWithHeaders("GET", "/db/doc/attach1", "", map[string]string{"If-None-Match": digest})
+	assertStatus(t, response, 304)
+	assert.Equals(t, response.Body.Len(), 0)
+	assert.Equals(t, response.Header().Get("Etag"), digest)
+
+	// The multipart response carries the ETag too:
+	response = rt.SendRequestWithHeaders("GET", "/db/doc?attachments=true", "", map[string]string{"Accept": "multipart/related"})
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Etag"), strconv.Quote(rev3))
+
+	response = rt.SendRequestWithHeaders("DELETE", "/db/doc", "", map[string]string{"If-Match": strconv.Quote(rev2)})
+	assertStatus(t, response, 409)
+	response = rt.SendRequestWithHeaders("DELETE", "/db/doc", "", map[string]string{"If-Match": strconv.Quote(rev3)})
+	assertStatus(t, response, 200)
+}
+
+// GET with attachments=true responds in whichever of JSON and multipart the client accepts
+func TestGetDocAttachmentsAccept(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	data := strings.Repeat("0123456789", 50) // big enough to be a separate MIME part
+	response := rt.SendRequest("PUT", "/db/doc", fmt.Sprintf(`{"_attachments": {"att": {"data": %q}}}`,
+		base64.StdEncoding.EncodeToString([]byte(data))))
+	assertStatus(t, response, 201)
+
+	getWithAccept := func(query string, accept string) *TestResponse {
+		return rt.SendRequestWithHeaders("GET", "/db/doc?"+query, "", map[string]string{"Accept": accept})
+	}
+	response = getWithAccept("attachments=true", "multipart/related")
+	assertStatus(t, response, 200)
+	assert.True(t, strings.HasPrefix(response.Header().Get("Content-Type"), "multipart/related"))
+
+	// A client that only takes JSON gets the data inline, as base64:
+	for _, accept := range []string{"application/json", "application/json, multipart/related;q=0"} {
+		response = getWithAccept("attachments=true", accept)
+		assertStatus(t, response, 200)
+		assert.Equals(t, response.Header().Get("Content-Type"), "application/json")
+		var body db.Body
+		assertNoError(t, json.Unmarshal(response.Body.Bytes(), &body), "Bad JSON")
+		att := body["_attachments"].(map[string]interface{})["att"].(map[string]interface{})
+		assert.Equals(t, att["data"], base64.StdEncoding.EncodeToString([]byte(data)))
+		assert.Equals(t, att["follows"], nil)
+	}
+
+	response = getWithAccept("attachments=true", "text/html")
+	assertStatus(t, response, 406)
+	assert.True(t, strings.Contains(response.Body.String(), "application/json and multipart/related"))
+	assertStatus(t, getWithAccept("open_revs=all", "text/html"), 406)
+	assertStatus(t, getWithAccept("attachments=true", "text/html, */*;q=0.1"), 200)
+}
+
+// Retrieve an attachment by its digest, which requires access to a doc that has it
+func TestAttachmentByDigest(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc) {channel(doc.channels);}`}
+	defer rt.Close()
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["a"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/bob", `{"password":"letmein", "admin_channels":["b"]}`), 201)
+
+	response := rt.SendAdminRequest("PUT", "/db/doc1",
+		`{"channels":["a"], "_attachments": {"att": {"data": "aGVsbG8gd29ybGQ=", "content_type": "text/plain"}}}`)
+	assertStatus(t, response, 201)
+	response = rt.SendAdminRequest("GET", "/db/doc1", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	digest := db.BodyAttachments(body)["att"].(map[string]interface{})["digest"].(string)
+	attURL := "/db/_attachment/" + url.QueryEscape(digest)
+
+	response = rt.Send(requestByUser("GET", attURL, "", "alice"))
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "hello world")
+	assert.Equals(t, response.Header().Get("Content-Type"), "text/plain")
+	assert.Equals(t, response.Header().Get("Etag"), strconv.Quote(digest))
+	assert.Equals(t, response.Header().Get("Cache-Control"), "max-age=31536000, immutable")
+
+	request := requestByUser("GET", attURL, "", "alice")
+	request.Header.Set("If-None-Match", strconv.Quote(digest))
+	response = rt.Send(request)
+	assertStatus(t, response, 304)
+	assert.Equals(t, response.Body.Len(), 0)
+
+	// Bob can't see any doc with the attachment:
+	assertStatus(t, rt.Send(requestByUser("GET", attURL, "", "bob")), 404)
+	request = requestByUser("GET", attURL, "", "bob")
+	request.Header.Set("If-None-Match", strconv.Quote(digest))
+	assertStatus(t, rt.Send(request), 404)
+
+	// Until another doc he can see has the same attachment:
+	response = rt.SendAdminRequest("PUT", "/db/doc2",
+		`{"channels":["b"], "_attachments": {"copy": {"data": "aGVsbG8gd29ybGQ="}}}`)
+	assertStatus(t, response, 201)
+	response = rt.Send(requestByUser("GET", attURL, "", "bob"))
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "hello world")
+
+	// Removing the attachment from the doc revokes access to it:
+	response = rt.SendAdminRequest("GET", "/db/doc2", "")
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2?rev="+body["_rev"].(string), `{"channels":["b"]}`), 201)
+	assertStatus(t, rt.Send(requestByUser("GET", attURL, "", "bob")), 404)
+
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_attachment/sha1-nosuchdigest", ""), 404)
+}
+
 // Add and retrieve an attachment, including a subrange
 func TestDocAttachment(t *testing.T) {
 	var rt RestTester
@@ -395,6 +581,64 @@ func TestFunkyDocAndAttachmentIDs(t *testing.T) {
 	assert.True(t, response.Header().Get("Content-Type") == attachmentContentType)
 }
 
+func TestSlashesInIDsRoundTrip(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	// A doc ID with a slash:
+	response := rt.SendRequest("PUT", "/db/design%2Freadme", `{"title":"readme"}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["id"], "design/readme")
+	revid := body["rev"].(string)
+
+	// An attachment name with one:
+	response = rt.SendRequestWithHeaders("PUT", "/db/design%2Freadme/images%2Flogo.png?rev="+revid, "PNG", map[string]string{"Content-Type": "image/png"})
+	assertStatus(t, response, 201)
+	response = rt.SendRequest("GET", "/db/design%2Freadme/images%2Flogo.png", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "PNG")
+
+	response = rt.SendRequest("GET", "/db/design%2Freadme", "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["_id"], "design/readme")
+	_, found := body["_attachments"].(map[string]interface{})["images/logo.png"]
+	assert.True(t, found)
+
+	// A POSTed doc's Location escapes the slash:
+	response = rt.SendRequest("POST", "/db/", `{"_id":"design/posted"}`)
+	assertStatus(t, response, 200)
+	location := response.Header().Get("Location")
+	assert.Equals(t, location, "design%2Fposted")
+	assertStatus(t, rt.SendRequest("GET", "/db/"+location, ""), 200)
+
+	// A _local doc ID with a slash:
+	assertStatus(t, rt.SendRequest("PUT", "/db/_local/client%2F1", `{"lastSequence":"1"}`), 201)
+	response = rt.SendRequest("GET", "/db/_local/client%2F1", "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["_id"], "_local/client/1")
+
+	// Other escapes alongside a slash are only unescaped once:
+	response = rt.SendRequest("PUT", "/db/a%2Fb%20c%25", `{}`)
+	assertStatus(t, response, 201)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["id"], "a/b c%")
+	assertStatus(t, rt.SendRequest("GET", "/db/"+escapePathSegment("a/b c%"), ""), 200)
+}
+
+func TestPathSegmentEscaping(t *testing.T) {
+	assert.Equals(t, escapePathSegment("images/logo 1+2.png"), "images%2Flogo%201%2B2.png")
+	assert.Equals(t, unescapePathSegment("images%2Flogo%201+2.png"), "images/logo 1+2.png")
+	assert.Equals(t, dbNameFromPath("/my%2Fdb/doc"), "my/db")
+	assert.Equals(t, dbNameFromPath("/_config"), "")
+}
+
 func TestCORSOrigin(t *testing.T) {
 	var rt RestTester
 	reqHeaders := map[string]string{
@@ -404,12 +648,12 @@ func TestCORSOrigin(t *testing.T) {
 	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "http://example.com")
 
 	// now test a non-listed origin
-	// b/c * is in config we get *
+	// b/c * is in config it's allowed, and echoed back since credentials are allowed
 	reqHeaders = map[string]string{
 		"Origin": "http://hack0r.com",
 	}
 	response = rt.SendRequestWithHeaders("GET", "/db/", "", reqHeaders)
-	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "*")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "http://hack0r.com")
 
 	// now test another origin in config
 	reqHeaders = map[string]string{
@@ -434,7 +678,104 @@ func TestCORSOrigin(t *testing.T) {
 		"Origin": "http://hack0r.com",
 	}
 	response = rt.SendRequestWithHeaders("GET", "/db/", "", reqHeaders)
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Credentials"), "")
+}
+
+func TestCORSWildcardAndPreflight(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	sc := rt.ServerContext()
+	sc.config.CORS.Origin = []string{"https://*.example.com"}
+	sc.config.CORS.Headers = []string{"Content-Type", "Authorization"}
+
+	reqHeaders := map[string]string{"Origin": "https://app.example.com"}
+	response := rt.SendRequestWithHeaders("GET", "/db/", "", reqHeaders)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "https://app.example.com")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Credentials"), "true")
+	assert.True(t, strings.Contains(response.Header().Get("Access-Control-Expose-Headers"), "Etag"))
+
+	reqHeaders = map[string]string{"Origin": "https://example.com.hack0r.com"}
+	response = rt.SendRequestWithHeaders("GET", "/db/", "", reqHeaders)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "")
+
+	// Preflight requests are answered without authentication:
+	rt.SetAdminParty(false)
+	reqHeaders = map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "PUT"}
+	response = rt.SendRequestWithHeaders("OPTIONS", "/db/doc1", "", reqHeaders)
+	assertStatus(t, response, 204)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "https://app.example.com")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Headers"), "Content-Type, Authorization")
+	assert.Equals(t, response.Header().Get("Access-Control-Max-Age"), "1728000")
+	assert.True(t, strings.Contains(response.Header().Get("Access-Control-Allow-Methods"), "PUT"))
+}
+
+func TestRequestID(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	response1 := rt.SendRequest("GET", "/db/", "")
+	assertStatus(t, response1, 200)
+	response2 := rt.SendRequest("GET", "/db/nosuchdoc", "")
+	assertStatus(t, response2, 404)
+	id1, id2 := response1.Header().Get("X-Request-Id"), response2.Header().Get("X-Request-Id")
+	assert.Equals(t, len(id1), 8)
+	assert.Equals(t, len(id2), 8)
+	assert.True(t, id1 != id2)
+}
+
+func TestGetDocBodyDelta(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	longText := strings.Repeat("lorem ipsum ", 100)
+	response := rt.SendRequest("PUT", "/db/doc1", `{"text":"`+longText+`", "count":1}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	rev1 := body["rev"].(string)
+	response = rt.SendRequest("PUT", "/db/doc1?rev="+rev1, `{"text":"`+longText+`", "count":2}`)
+	assertStatus(t, response, 201)
+
+	// With a known revision, the response is a delta from it:
+	headers := map[string]string{"X-Known-Revs": "1-unknown, " + rev1}
+	response = rt.SendRequestWithHeaders("GET", "/db/doc1?deltas=true", "", headers)
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Content-Type"), "application/json-delta")
+	assert.Equals(t, response.Header().Get("X-Delta-Source"), rev1)
+	var delta db.BodyDelta
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &delta), nil)
+	assert.Equals(t, delta["count"], float64(2))
+	assert.Equals(t, delta["text"], nil)
+
+	// Without deltas=true, or with revs=true, the full body is returned:
+	response = rt.SendRequestWithHeaders("GET", "/db/doc1", "", headers)
+	assert.Equals(t, response.Header().Get("X-Delta-Source"), "")
+	response = rt.SendRequestWithHeaders("GET", "/db/doc1?deltas=true&revs=true", "", headers)
+	assert.Equals(t, response.Header().Get("X-Delta-Source"), "")
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["text"], longText)
+}
+
+func TestCORSPerDatabase(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	sc := rt.ServerContext()
+	sc.GetDatabaseConfig("db").CORS = &CORSConfig{Origin: []string{"http://db.example.com"}, MaxAge: 60}
+
+	// The database's config replaces the server's:
+	reqHeaders := map[string]string{"Origin": "http://db.example.com"}
+	response := rt.SendRequestWithHeaders("GET", "/db/", "", reqHeaders)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "http://db.example.com")
+	reqHeaders = map[string]string{"Origin": "http://example.com"}
+	response = rt.SendRequestWithHeaders("GET", "/db/", "", reqHeaders)
 	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "")
+
+	// Server-level paths still use the server's config:
+	response = rt.SendRequestWithHeaders("GET", "/", "", reqHeaders)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "http://example.com")
 }
 
 func TestCORSLoginOriginOnSessionPost(t *testing.T) {
@@ -648,6 +989,128 @@ func TestManualAttachment(t *testing.T) {
 	}
 }
 
+func TestDeleteAttachment(t *testing.T) {
+	var rt RestTester
+
+	response := rt.SendRequest("PUT", "/db/doc1", `{"prop":true, "_attachments": {"attach1": {"data": "aGVsbG8gd29ybGQ="}, "attach2": {"data": "Z29vZGJ5ZSB3b3JsZA=="}}}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	revId := body["rev"].(string)
+
+	// delete without a rev (should fail)
+	response = rt.SendRequest("DELETE", "/db/doc1/attach1", "")
+	assertStatus(t, response, 409)
+
+	// delete with a stale rev using If-Match header (should fail)
+	reqHeaders := map[string]string{"If-Match": "1-xyz"}
+	response = rt.SendRequestWithHeaders("DELETE", "/db/doc1/attach1", "", reqHeaders)
+	assertStatus(t, response, 409)
+
+	// delete a nonexistent attachment (should fail without creating a revision)
+	response = rt.SendRequest("DELETE", "/db/doc1/nosuchattach?rev="+revId, "")
+	assertStatus(t, response, 404)
+	response = rt.SendRequest("GET", "/db/doc1", "")
+	assertStatus(t, response, 200)
+	body = db.Body{}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["_rev"], revId)
+
+	// delete with the current rev using If-Match header (should succeed)
+	reqHeaders["If-Match"] = revId
+	response = rt.SendRequestWithHeaders("DELETE", "/db/doc1/attach1", "", reqHeaders)
+	assertStatus(t, response, 200)
+	body = db.Body{}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["ok"], true)
+	revIdAfterDelete := body["rev"].(string)
+	assert.True(t, revIdAfterDelete != revId)
+	assert.Equals(t, response.Header().Get("Etag"), strconv.Quote(revIdAfterDelete))
+
+	// the deleted attachment is gone, and the other one and the properties remain
+	response = rt.SendRequest("GET", "/db/doc1/attach1", "")
+	assertStatus(t, response, 404)
+	response = rt.SendRequest("GET", "/db/doc1/attach2", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, string(response.Body.Bytes()), "goodbye world")
+	response = rt.SendRequest("GET", "/db/doc1", "")
+	assertStatus(t, response, 200)
+	body = db.Body{}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	bodyAttachments, ok := body["_attachments"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Attachments must be map")
+	}
+	assert.Equals(t, len(bodyAttachments), 1)
+	assert.True(t, body["prop"] == true)
+
+	// deleting the last attachment removes _attachments
+	response = rt.SendRequest("DELETE", "/db/doc1/attach2?rev="+revIdAfterDelete, "")
+	assertStatus(t, response, 200)
+	response = rt.SendRequest("GET", "/db/doc1", "")
+	assertStatus(t, response, 200)
+	body = db.Body{}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	_, found := body["_attachments"]
+	assert.False(t, found)
+}
+
+func TestDeletionAttachments(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	const attachments = `"_attachments": {"attach1": {"data": "aGVsbG8gd29ybGQ="}}`
+	const blobKey = "_sync:att:sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0="
+
+	// By default, a deletion's attachments are stripped, and their blobs aren't stored:
+	response := rt.SendRequest("PUT", "/db/doc1", `{"prop":true}`)
+	assertStatus(t, response, 201)
+	response = rt.SendRequest("PUT", "/db/doc1", `{"_rev":"`+respRevID(t, response)+`", "_deleted":true, `+attachments+`}`)
+	assertStatus(t, response, 201)
+	deletedRev := respRevID(t, response)
+	_, _, err := rt.Bucket().GetRaw(blobKey)
+	assert.True(t, err != nil)
+	response = rt.SendRequest("GET", "/db/doc1?rev="+deletedRev+"&attachments=true", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["_deleted"], true)
+	assert.Equals(t, body["_attachments"], nil)
+
+	// Likewise through _bulk_docs, with and without new_edits:
+	response = rt.SendRequest("PUT", "/db/doc2", `{"prop":true}`)
+	assertStatus(t, response, 201)
+	input := `{"docs": [{"_id": "doc2", "_rev": "` + respRevID(t, response) + `", "_deleted": true, ` + attachments + `}]}`
+	response = rt.SendRequest("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, 201)
+	var docs []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.Equals(t, len(docs), 1)
+	assert.True(t, docs[0]["rev"] != nil)
+	input = `{"new_edits": false, "docs": [{"_id": "doc3", "_rev": "2-b", "_revisions": {"start": 2, "ids": ["b", "a"]}, "_deleted": true, ` + attachments + `}]}`
+	assertStatus(t, rt.SendRequest("POST", "/db/_bulk_docs", input), 201)
+	_, _, err = rt.Bucket().GetRaw(blobKey)
+	assert.True(t, err != nil)
+
+	// With the database option set, they're rejected instead:
+	rt.GetDatabase().Options.RejectDeletionAttachments = true
+	response = rt.SendRequest("PUT", "/db/doc4", `{"prop":true}`)
+	assertStatus(t, response, 201)
+	rev := respRevID(t, response)
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc4", `{"_rev":"`+rev+`", "_deleted":true, `+attachments+`}`), 400)
+	input = `{"docs": [{"_id": "doc4", "_rev": "` + rev + `", "_deleted": true, ` + attachments + `}]}`
+	response = rt.SendRequest("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, 201)
+	docs = nil
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.Equals(t, len(docs), 1)
+	assert.Equals(t, docs[0]["status"], 400.0)
+	_, _, err = rt.Bucket().GetRaw(blobKey)
+	assert.True(t, err != nil)
+
+	// Deletions without attachments are unaffected:
+	assertStatus(t, rt.SendRequest("DELETE", "/db/doc4?rev="+rev, ""), 200)
+}
+
 // PUT attachment on non-existant docid should create empty doc
 func TestManualAttachmentNewDoc(t *testing.T) {
 	var rt RestTester
@@ -726,6 +1189,81 @@ func TestBulkDocs(t *testing.T) {
 	assertStatus(t, response, 200)
 }
 
+// A conflicting update's 409 describes the doc's current revision, for PUT and _bulk_docs
+func TestConflictErrorDetails(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	response := rt.SendRequest("PUT", "/db/doc", `{"n":1}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	rev1 := body["rev"].(string)
+	response = rt.SendRequest("PUT", "/db/doc?rev="+rev1, `{"n":2}`)
+	assertStatus(t, response, 201)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	rev2 := body["rev"].(string)
+
+	response = rt.SendRequest("PUT", "/db/doc?rev="+rev1, `{"n":3}`)
+	assertStatus(t, response, 409)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["error"], "conflict")
+	assert.Equals(t, body["current_rev"], rev2)
+	assert.Equals(t, body["deleted"], false)
+	assert.Equals(t, body["leaves"], nil)
+
+	response = rt.SendRequest("PUT", "/db/doc?conflict_leaves=true", `{"n":3}`)
+	assertStatus(t, response, 409)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["current_rev"], rev2)
+	assert.DeepEquals(t, body["leaves"], []interface{}{rev2})
+
+	// Tombstone:
+	response = rt.SendRequest("DELETE", "/db/doc?rev="+rev2, "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	rev3 := body["rev"].(string)
+	response = rt.SendRequest("PUT", "/db/doc?rev="+rev2, `{"n":4}`)
+	assertStatus(t, response, 409)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["current_rev"], rev3)
+	assert.Equals(t, body["deleted"], true)
+
+	response = rt.SendRequest("POST", "/db/_bulk_docs?conflict_leaves=true",
+		`{"docs": [{"_id": "doc", "_rev": "`+rev1+`", "n": 5}, {"_id": "doc2", "n": 1}]}`)
+	assertStatus(t, response, 201)
+	var rows []db.Body
+	json.Unmarshal(response.Body.Bytes(), &rows)
+	assert.Equals(t, len(rows), 2)
+	assert.Equals(t, rows[0]["error"], "conflict")
+	assert.Equals(t, rows[0]["current_rev"], rev3)
+	assert.Equals(t, rows[0]["deleted"], true)
+	assert.DeepEquals(t, rows[0]["leaves"], []interface{}{rev3})
+	assert.Equals(t, rows[1]["current_rev"], nil)
+}
+
+func TestRevIDMismatchError(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	rt.GetDatabase().Options.VerifyRevIDs = true
+
+	response := rt.SendAdminRequest("PUT", "/db/doc?new_edits=false", `{"_rev": "1-abc", "n": 1}`)
+	assertStatus(t, response, 400)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["error"], "bad_rev_id")
+
+	response = rt.SendAdminRequest("POST", "/db/_bulk_docs", `{"new_edits": false, "docs": [{"_id": "doc", "_rev": "1-abc", "n": 1}]}`)
+	assertStatus(t, response, 201)
+	var rows []db.Body
+	json.Unmarshal(response.Body.Bytes(), &rows)
+	assert.Equals(t, len(rows), 1)
+	assert.Equals(t, rows[0]["error"], "bad_rev_id")
+	assert.Equals(t, rows[0]["status"], 400.0)
+}
+
 func TestBulkDocsUnusedSequences(t *testing.T) {
 
 	//We want a sync function that will reject some docs
@@ -1038,16 +1576,184 @@ func TestBulkDocsEmptyDocs(t *testing.T) {
 	assertStatus(t, response, 400)
 }
 
-func TestBulkDocsMalformedDocs(t *testing.T) {
+func TestBulkDocsMalformedDocs(t *testing.T) {
+	var rt RestTester
+	input := `{"docs":["A","B"]}`
+	response := rt.SendRequest("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, 201)
+	var docs []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.Equals(t, len(docs), 2)
+	assert.Equals(t, docs[0]["status"], 400.0)
+	assert.Equals(t, docs[1]["status"], 400.0)
+
+	input = `{"docs": [{"_id": 3, "n": 1}]}`
+	response = rt.SendRequest("POST", "/db/_bulk_docs", input)
+	log.Printf("response:%s", response.Body.Bytes())
+	assertStatus(t, response, 201)
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.Equals(t, len(docs), 1)
+	assert.Equals(t, docs[0]["status"], 400.0)
+}
+
+// Docs can't be written under the keys of internal docs, or other "_" IDs, on either port.
+func TestBulkDocsReservedDocIDs(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	input := `{"docs": [{"_id": "_sync:user:eve", "name": "eve"}, {"_id": "_sync:session:1234"}, {"_id": "_idx:x"}, {"_id": "_foo"}, {"_id": "_local/loc1"}, {"_id": "ok"}]}`
+	for _, admin := range []bool{false, true} {
+		var response *TestResponse
+		if admin {
+			response = rt.SendAdminRequest("POST", "/db/_bulk_docs", input)
+		} else {
+			response = rt.SendRequest("POST", "/db/_bulk_docs", input)
+		}
+		assertStatus(t, response, 201)
+		var docs []map[string]interface{}
+		json.Unmarshal(response.Body.Bytes(), &docs)
+		assert.Equals(t, len(docs), 6)
+		for i := 0; i < 4; i++ {
+			assert.Equals(t, docs[i]["status"], 400.0)
+		}
+		assert.Equals(t, docs[4]["status"], nil)
+	}
+	_, _, err := rt.Bucket().GetRaw("_sync:user:eve")
+	assert.True(t, base.IsDocNotFoundError(err))
+	_, _, err = rt.Bucket().GetRaw("_sync:session:1234")
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// Nor through a single POST, or new_edits=false:
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/", `{"_id": "_sync:user:eve", "name": "eve"}`), 400)
+	response := rt.SendAdminRequest("POST", "/db/_bulk_docs", `{"new_edits": false, "docs": [{"_id": "_sync:user:eve", "_rev": "1-a"}]}`)
+	assert.True(t, strings.Contains(response.Body.String(), `"status":400`))
+	_, _, err = rt.Bucket().GetRaw("_sync:user:eve")
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestBulkDocsPerDocErrors(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc) {if (doc.reject) {throw({forbidden: "rejected"})}}`}
+	defer rt.Close()
+
+	// Every doc gets a result row, in request order, including local docs and rejected docs:
+	input := `{"docs": [{"_id": "ok1"}, "bad", {"_id": "_local/loc1", "n": 1}, {"_id": "rejected", "reject": true}, {"n": 5}]}`
+	response := rt.SendRequest("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, 201)
+	var docs []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.Equals(t, len(docs), 5)
+	assert.Equals(t, docs[0]["id"], "ok1")
+	assert.True(t, docs[0]["rev"] != nil)
+	assert.Equals(t, docs[1]["status"], 400.0)
+	assert.Equals(t, docs[2]["id"], "_local/loc1")
+	assert.Equals(t, docs[2]["rev"], "0-1")
+	assert.Equals(t, docs[3]["id"], "rejected")
+	assert.Equals(t, docs[3]["status"], 403.0)
+	assert.True(t, docs[4]["id"] != nil && docs[4]["rev"] != nil)
+
+	// With new_edits=false, revisions that already exist get no row:
+	input = `{"new_edits":false, "docs": [
+                {"_id": "ne1", "_rev": "2-b", "_revisions": {"start": 2, "ids": ["b", "a"]}},
+                {"_id": "ne2", "_rev": "1-a"}]}`
+	assertStatus(t, rt.SendRequest("POST", "/db/_bulk_docs", input), 201)
+	input = `{"new_edits":false, "docs": [
+                {"_id": "ne1", "_rev": "2-b", "_revisions": {"start": 2, "ids": ["b", "a"]}},
+                {"_id": "ne2", "_rev": "2-b", "_revisions": {"start": 2, "ids": ["b", "a"]}}]}`
+	response = rt.SendRequest("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, 201)
+	docs = nil
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.Equals(t, len(docs), 1)
+	assert.Equals(t, docs[0]["id"], "ne2")
+	assert.Equals(t, docs[0]["rev"], "2-b")
+}
+
+func TestDryRunPut(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc) {
+		if (doc.reject) {throw({forbidden: "rejected"})}
+		channel(doc.channels);
+		if (doc.grant) {access(doc.grant, "granted")}
+	}`}
+	defer rt.Close()
+
+	// A dry run reports the rev, channels and access grants, without writing the doc:
+	response := rt.SendAdminRequest("PUT", "/db/doc1?dry_run=true", `{"channels": ["a", "b"], "grant": "alice"}`)
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["dry_run"], true)
+	assert.DeepEquals(t, body["channels"], []interface{}{"a", "b"})
+	assert.DeepEquals(t, body["access"], map[string]interface{}{"alice": []interface{}{"granted"}})
+	dryRunRev := body["rev"].(string)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/doc1", ""), 404)
+
+	// The real write creates the same revision:
+	response = rt.SendAdminRequest("PUT", "/db/doc1", `{"channels": ["a", "b"], "grant": "alice"}`)
+	assertStatus(t, response, 201)
+	body = db.Body{}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["rev"], dryRunRev)
+
+	// Conflicts and rejections are reported as they would be:
+	response = rt.SendAdminRequest("PUT", "/db/doc1?dry_run=true", `{"channels": ["c"]}`)
+	assertStatus(t, response, 409)
+	response = rt.SendAdminRequest("PUT", "/db/doc1?dry_run=true&rev="+dryRunRev, `{"reject": true}`)
+	assertStatus(t, response, 403)
+	response = rt.SendAdminRequest("PUT", "/db/doc1?dry_run=true&rev="+dryRunRev, `{"channels": ["c"]}`)
+	assertStatus(t, response, 200)
+	response = rt.SendAdminRequest("GET", "/db/doc1", "")
+	body = db.Body{}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["_rev"], dryRunRev)
+
+	// Dry runs are only allowed on the admin port:
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc2?dry_run=true", `{}`), 403)
+	assertStatus(t, rt.SendRequest("POST", "/db/_bulk_docs?dry_run=true", `{"docs": [{"_id": "doc2"}]}`), 403)
+}
+
+func TestDryRunBulkDocs(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc) {if (doc.reject) {throw({forbidden: "rejected"})} channel(doc.channels);}`}
+	defer rt.Close()
+
+	input := `{"docs": [{"_id": "doc1", "channels": ["a"]}, {"_id": "doc2", "reject": true}, {"_id": "_local/loc1"}]}`
+	response := rt.SendAdminRequest("POST", "/db/_bulk_docs?dry_run=true", input)
+	assertStatus(t, response, 200)
+	var docs []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.Equals(t, len(docs), 3)
+	assert.Equals(t, docs[0]["id"], "doc1")
+	assert.Equals(t, docs[0]["dry_run"], true)
+	assert.True(t, docs[0]["rev"] != nil)
+	assert.DeepEquals(t, docs[0]["channels"], []interface{}{"a"})
+	assert.Equals(t, docs[1]["status"], 403.0)
+	assert.Equals(t, docs[2]["status"], 400.0)
+
+	// Nothing was written, and no sequences were used:
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/doc1", ""), 404)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_local/loc1", ""), 404)
+	response = rt.SendAdminRequest("PUT", "/db/doc1", `{"channels": ["a"]}`)
+	assertStatus(t, response, 201)
+	doc, err := rt.GetDatabase().GetDocSyncData("doc1")
+	assertNoError(t, err, "GetDocSyncData")
+	assert.Equals(t, doc.Sequence, uint64(1))
+}
+
+func TestBulkDocsLimits(t *testing.T) {
 	var rt RestTester
-	input := `{"docs":["A","B"]}`
-	response := rt.SendRequest("POST", "/db/_bulk_docs", input)
-	assertStatus(t, response, 400)
+	defer rt.Close()
+	rt.GetDatabase().Options.MaxBulkDocs = 2
+	rt.GetDatabase().Options.MaxBulkDocsBytes = 100
 
-	input = `{"docs": [{"_id": 3, "n": 1}]}`
-	response = rt.SendRequest("POST", "/db/_bulk_docs", input)
-	log.Printf("response:%s", response.Body.Bytes())
-	assertStatus(t, response, 400)
+	response := rt.SendRequest("POST", "/db/_bulk_docs", `{"docs": [{"_id": "a"}, {"_id": "b"}, {"_id": "c"}]}`)
+	assertStatus(t, response, 413)
+	response = rt.SendRequest("POST", "/db/_bulk_docs", `{"docs": [{"_id": "a", "padding": "`+strings.Repeat("x", 100)+`"}]}`)
+	assertStatus(t, response, 413)
+
+	// Nothing was saved:
+	assertStatus(t, rt.SendRequest("GET", "/db/a", ""), 404)
+
+	response = rt.SendRequest("POST", "/db/_bulk_docs", `{"docs": [{"_id": "a"}, {"_id": "b"}]}`)
+	assertStatus(t, response, 201)
 }
 
 func TestBulkGetEmptyDocs(t *testing.T) {
@@ -1057,6 +1763,48 @@ func TestBulkGetEmptyDocs(t *testing.T) {
 	assertStatus(t, response, 400)
 }
 
+func TestBulkGetJSON(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	response := rt.SendRequest("PUT", "/db/doc1", `{"n": 1, "_attachments": {"hello.txt": {"data": "aGVsbG8gd29ybGQ="}}}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	revid := body["rev"].(string)
+
+	input := `{"docs": [{"id": "doc1", "rev": "` + revid + `"}, {"id": "missing"}, {"rev": "1-abc"}]}`
+	response = rt.SendRequestWithHeaders("POST", "/db/_bulk_get?revs=true&attachments=true", input,
+		map[string]string{"Accept": "application/json"})
+	assertStatus(t, response, 200)
+	assert.True(t, strings.HasPrefix(response.Header().Get("Content-Type"), "application/json"))
+
+	var result struct {
+		Results []struct {
+			ID   string    `json:"id"`
+			Docs []db.Body `json:"docs"`
+		} `json:"results"`
+	}
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &result), "Couldn't parse _bulk_get response")
+	assert.Equals(t, len(result.Results), 3)
+
+	// Per-doc errors are reported without failing the batch:
+	assert.Equals(t, result.Results[0].ID, "doc1")
+	doc := result.Results[0].Docs[0]["ok"].(map[string]interface{})
+	assert.Equals(t, doc["_rev"], revid)
+	assert.True(t, doc["_revisions"] != nil)
+	attachment := doc["_attachments"].(map[string]interface{})["hello.txt"].(map[string]interface{})
+	assert.Equals(t, attachment["data"], "aGVsbG8gd29ybGQ=")
+	assert.Equals(t, result.Results[1].ID, "missing")
+	assert.Equals(t, result.Results[1].Docs[0]["error"].(map[string]interface{})["status"], 404.0)
+	assert.Equals(t, result.Results[2].Docs[0]["error"].(map[string]interface{})["status"], 400.0)
+
+	// Without the Accept header the response is still multipart:
+	response = rt.SendRequest("POST", "/db/_bulk_get", input)
+	assertStatus(t, response, 200)
+	assert.True(t, strings.HasPrefix(response.Header().Get("Content-Type"), "multipart/mixed"))
+}
+
 func TestBulkDocsChangeToAccess(t *testing.T) {
 
 	var logKeys = map[string]bool{
@@ -1178,6 +1926,97 @@ func TestOpenRevs(t *testing.T) {
 ]`)
 }
 
+func TestOpenRevsAttsSince(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	response := rt.SendRequest("PUT", "/db/or2", `{"n":1, "_attachments": {"a.txt": {"data": "aGVsbG8="}}}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	rev1 := body["rev"].(string)
+	response = rt.SendRequest("PUT", "/db/or2?rev="+rev1, `{"n":2, "_attachments": {"a.txt": {"stub": true}}}`)
+	assertStatus(t, response, 201)
+
+	getAttachment := func(query string) map[string]interface{} {
+		response := rt.SendRequestWithHeaders("GET", "/db/or2?open_revs=all"+query, "", map[string]string{"Accept": "application/json"})
+		assertStatus(t, response, 200)
+		var revs []map[string]db.Body
+		assertNoError(t, json.Unmarshal(response.Body.Bytes(), &revs), "Couldn't parse open_revs response")
+		assert.Equals(t, len(revs), 1)
+		return db.BodyAttachments(revs[0]["ok"])["a.txt"].(map[string]interface{})
+	}
+
+	// By default, attachment bodies are included:
+	assert.Equals(t, getAttachment("")["data"], "aGVsbG8=")
+	// ...but not ones the client already has:
+	attachment := getAttachment(`&atts_since=["` + rev1 + `"]`)
+	assert.Equals(t, attachment["stub"], true)
+	assert.Equals(t, attachment["data"], nil)
+}
+
+func TestGetDocShowChannels(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc, oldDoc){channel(doc.channels);}`}
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/doc", `{"channels": ["a", "b"]}`)
+	assertStatus(t, response, 201)
+	response = rt.SendAdminRequest("PUT", "/db/doc?rev="+respRevID(t, response), `{"channels": ["b", "c"]}`)
+	assertStatus(t, response, 201)
+
+	getDoc := func(query string, admin bool) (body db.Body) {
+		if admin {
+			response = rt.SendAdminRequest("GET", "/db/doc"+query, "")
+		} else {
+			response = rt.SendRequest("GET", "/db/doc"+query, "")
+		}
+		assertStatus(t, response, 200)
+		assertNoError(t, json.Unmarshal(response.Body.Bytes(), &body), "Couldn't parse doc")
+		return body
+	}
+
+	// Only the admin port shows the channels:
+	body := getDoc("?show_channels=true", true)
+	assert.DeepEquals(t, body["_channels"], []interface{}{"b", "c"})
+	assert.Equals(t, body["_channel_history"], nil)
+	assert.Equals(t, body["_sync"], nil)
+	body = getDoc("?show_channels=true&show_channel_history=true", false)
+	assert.Equals(t, body["_channels"], nil)
+	assert.Equals(t, body["_channel_history"], nil)
+
+	// The history shows when the doc joined and left each channel:
+	body = getDoc("?show_channels=true&show_channel_history=true", true)
+	assert.DeepEquals(t, body["_channels"], []interface{}{"b", "c"})
+	history := map[string]interface{}{}
+	for _, entry := range body["_channel_history"].([]interface{}) {
+		entry := entry.(map[string]interface{})
+		history[entry["channel"].(string)] = entry
+		delete(entry, "channel")
+	}
+	assert.DeepEquals(t, history, map[string]interface{}{
+		"a": map[string]interface{}{"added_seq": float64(1), "removed_seq": float64(2)},
+		"b": map[string]interface{}{"added_seq": float64(1)},
+		"c": map[string]interface{}{"added_seq": float64(2)},
+	})
+
+	// With open_revs, each leaf shows its own channels:
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/cd?new_edits=false", `{"_rev": "1-a", "channels": ["x"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/cd?new_edits=false", `{"_rev": "2-b", "_revisions": {"start": 2, "ids": ["b", "a"]}, "channels": ["y"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/cd?new_edits=false", `{"_rev": "2-c", "_revisions": {"start": 2, "ids": ["c", "a"]}, "channels": ["z"]}`), 201)
+	response = rt.SendAdminRequestWithHeaders("GET", "/db/cd?open_revs=all&show_channels=true", "", map[string]string{"Accept": "application/json"})
+	assertStatus(t, response, 200)
+	var revs []map[string]db.Body
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &revs), "Couldn't parse open_revs response")
+	assert.Equals(t, len(revs), 2)
+	for _, rev := range revs {
+		if rev["ok"]["_rev"] == "2-b" {
+			assert.DeepEquals(t, rev["ok"]["_channels"], []interface{}{"y"})
+		} else {
+			assert.DeepEquals(t, rev["ok"]["_channels"], []interface{}{"z"})
+		}
+	}
+}
+
 func TestLocalDocs(t *testing.T) {
 	var rt RestTester
 	response := rt.SendRequest("GET", "/db/_local/loc1", "")
@@ -1222,6 +2061,57 @@ func TestLocalDocs(t *testing.T) {
 	assertStatus(t, response, 404)
 }
 
+func TestListAndPurgeLocalDocs(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	assertStatus(t, rt.SendRequest("PUT", "/db/_local/new", `{"hi": "there"}`), 201)
+	old := time.Now().Add(-10 * 24 * time.Hour).Unix()
+	assertNoError(t, rt.Bucket().Set("_sync:local:old", 0, map[string]interface{}{"_rev": "0-1", "_updated_at": old}), "Set failed")
+	assertNoError(t, rt.Bucket().Set("_sync:local:legacy", 0, map[string]interface{}{"_rev": "0-1"}), "Set failed")
+
+	// Listing:
+	assertStatus(t, rt.SendRequest("GET", "/db/_local_docs", ""), 404)
+	response := rt.SendAdminRequest("GET", "/db/_local_docs", "")
+	assertStatus(t, response, 200)
+	var list struct {
+		Rows      []db.LocalDocInfo
+		TotalRows int `json:"total_rows"`
+	}
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &list), "Couldn't parse response")
+	assert.Equals(t, list.TotalRows, 3)
+	assert.Equals(t, list.Rows[0].ID, "_local/legacy")
+	assert.True(t, list.Rows[0].UpdatedAt == nil)
+	assert.Equals(t, list.Rows[1].ID, "_local/new")
+	assert.True(t, list.Rows[1].Size > 0)
+	assert.True(t, time.Since(*list.Rows[1].UpdatedAt) < time.Minute)
+	assert.Equals(t, list.Rows[2].ID, "_local/old")
+	assert.Equals(t, list.Rows[2].UpdatedAt.Unix(), old)
+
+	// Purging checkpoints older than a week deletes only "old":
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_local_docs", ""), 400)
+	response = rt.SendAdminRequest("DELETE", "/db/_local_docs?older_than_days=7", "")
+	assertStatus(t, response, 200)
+	var result struct {
+		Purged []string
+	}
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &result), "Couldn't parse response")
+	assert.DeepEquals(t, result.Purged, []string{"_local/old"})
+	assertStatus(t, rt.SendRequest("GET", "/db/_local/old", ""), 404)
+	assertStatus(t, rt.SendRequest("GET", "/db/_local/new", ""), 200)
+	assertStatus(t, rt.SendRequest("GET", "/db/_local/legacy", ""), 200)
+}
+
+func TestLocalDocMaxSize(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	rt.GetDatabase().Options.MaxLocalDocBytes = 100
+	assertStatus(t, rt.SendRequest("PUT", "/db/_local/small", `{"hi": "there"}`), 201)
+	big := fmt.Sprintf(`{"data": %q}`, strings.Repeat("x", 100))
+	assertStatus(t, rt.SendRequest("PUT", "/db/_local/big", big), 413)
+	assertStatus(t, rt.SendRequest("GET", "/db/_local/big", ""), 404)
+	assertStatus(t, rt.SendRequest("PUT", "/db/_local/small", `{"_rev": "0-1", "data": "`+strings.Repeat("x", 100)+`"}`), 413)
+}
+
 func TestResponseEncoding(t *testing.T) {
 	// Make a doc longer than 1k so the HTTP response will be compressed:
 	str := "DORKY "
@@ -1506,7 +2396,7 @@ func testAccessControl(t *testing.T, rt indexTester) {
 	assert.Equals(t, allDocsResult.Rows[0].ID, "doc4")
 	assert.DeepEquals(t, allDocsResult.Rows[0].Value.Channels, []string{"Cinemax"})
 	assert.Equals(t, allDocsResult.Rows[1].Key, "doc1")
-	assert.Equals(t, allDocsResult.Rows[1].Error, "forbidden")
+	assert.Equals(t, allDocsResult.Rows[1].Error, "not_found")
 	assert.Equals(t, allDocsResult.Rows[2].ID, "doc3")
 	assert.DeepEquals(t, allDocsResult.Rows[2].Value.Channels, []string{"Cinemax"})
 	assert.Equals(t, allDocsResult.Rows[3].Key, "b0gus")
@@ -1526,7 +2416,7 @@ func testAccessControl(t *testing.T, rt indexTester) {
 	assert.Equals(t, allDocsResult.Rows[0].ID, "doc4")
 	assert.DeepEquals(t, allDocsResult.Rows[0].Value.Channels, []string{"Cinemax"})
 	assert.Equals(t, allDocsResult.Rows[1].Key, "doc1")
-	assert.Equals(t, allDocsResult.Rows[1].Error, "forbidden")
+	assert.Equals(t, allDocsResult.Rows[1].Error, "not_found")
 	assert.Equals(t, allDocsResult.Rows[2].ID, "doc3")
 	assert.DeepEquals(t, allDocsResult.Rows[2].Value.Channels, []string{"Cinemax"})
 	assert.Equals(t, allDocsResult.Rows[3].Key, "b0gus")
@@ -1547,6 +2437,32 @@ func testAccessControl(t *testing.T, rt indexTester) {
 	assert.Equals(t, allDocsResult.Rows[0].ID, "doc4")
 	assert.DeepEquals(t, allDocsResult.Rows[0].Value.Channels, []string{"Cinemax"})
 
+	// Check POST to _all_docs with include_docs and skip options:
+	body = `{"keys": ["doc4", "doc1", "doc3", "b0gus"]}`
+	request, _ = http.NewRequest("POST", "/db/_all_docs?include_docs=true&skip=1&limit=2", bytes.NewBufferString(body))
+	request.SetBasicAuth("alice", "letmein")
+	response = rt.Send(request)
+	assertStatus(t, response, 200)
+
+	log.Printf("Response from POST _all_docs = %s", response.Body.Bytes())
+	allDocsResult.Rows = nil
+	err = json.Unmarshal(response.Body.Bytes(), &allDocsResult)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(allDocsResult.Rows), 2)
+	assert.Equals(t, allDocsResult.Rows[0].Key, "doc1")
+	assert.Equals(t, allDocsResult.Rows[0].Error, "not_found")
+	assert.True(t, allDocsResult.Rows[0].Doc == nil)
+	assert.Equals(t, allDocsResult.Rows[1].ID, "doc3")
+	assert.Equals(t, allDocsResult.Rows[1].Doc["_id"], "doc3")
+	assert.DeepEquals(t, allDocsResult.Rows[1].Doc["channels"], []interface{}{"CBS", "Cinemax"})
+
+	// Too many keys:
+	rt.GetDatabase().Options.MaxAllDocsKeys = 3
+	request, _ = http.NewRequest("POST", "/db/_all_docs", bytes.NewBufferString(body))
+	request.SetBasicAuth("alice", "letmein")
+	assertStatus(t, rt.Send(request), 413)
+	rt.GetDatabase().Options.MaxAllDocsKeys = 0
+
 	// Check _all_docs as admin:
 	response = rt.SendAdminRequest("GET", "/db/_all_docs", "")
 	assertStatus(t, response, 200)
@@ -2328,10 +3244,21 @@ func TestStarAccess(t *testing.T) {
 
 	// GET /db/_changes for unauthorized channel
 	response = rt.Send(requestByUser("GET", "/db/_changes?filter=sync_gateway/bychannel&channels=gifts", "", "bernard"))
-	log.Printf("_changes looks like: %s", response.Body.Bytes())
+	assertStatus(t, response, 403)
+	assert.True(t, strings.Contains(response.Body.String(), "gifts"))
+
+	// GET /db/_changes for authorized and unauthorized channels only returns the authorized one
+	response = rt.Send(requestByUser("GET", "/db/_changes?filter=sync_gateway/bychannel&channels=books,gifts", "", "bernard"))
+	assertStatus(t, response, 200)
+	changes.Results = nil
 	err = json.Unmarshal(response.Body.Bytes(), &changes)
 	assert.Equals(t, err, nil)
-	assert.Equals(t, len(changes.Results), 0)
+	assert.Equals(t, len(changes.Results), 1)
+	assert.Equals(t, changes.Results[0].ID, "doc1")
+
+	// The admin port isn't restricted
+	response = rt.SendAdminRequest("GET", "/db/_changes?filter=sync_gateway/bychannel&channels=gifts", "")
+	assertStatus(t, response, 200)
 
 	//
 	// Part 2 - Tests for user with * channel access
@@ -2481,6 +3408,413 @@ func TestBasicAuthWithSessionCookie(t *testing.T) {
 
 }
 
+func TestSessionTTL(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	rt.GetDatabase().Options.MaxSessionTTL = time.Hour
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"name":"bernard", "password":"letmein"}`)
+	assertStatus(t, response, 201)
+
+	// The requested TTL is reflected in the cookie and the response:
+	response = rt.SendRequest("POST", "/db/_session", `{"name":"bernard", "password":"letmein", "ttl":600}`)
+	assertStatus(t, response, 200)
+	cookies := (&http.Response{Header: response.Header()}).Cookies()
+	assert.Equals(t, len(cookies), 1)
+	assert.Equals(t, cookies[0].MaxAge, 600)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	expires, err := time.Parse(time.RFC3339, body["expires"].(string))
+	assert.Equals(t, err, nil)
+	assert.True(t, expires.After(time.Now().Add(590*time.Second)) && expires.Before(time.Now().Add(610*time.Second)))
+
+	// GET /_session with the cookie returns the same expiry:
+	reqHeaders := map[string]string{"Cookie": response.Header().Get("Set-Cookie")}
+	response = rt.SendRequestWithHeaders("GET", "/db/_session", "", reqHeaders)
+	assertStatus(t, response, 200)
+	var getBody db.Body
+	json.Unmarshal(response.Body.Bytes(), &getBody)
+	assert.Equals(t, getBody["expires"], body["expires"])
+
+	// A TTL over the max is clamped:
+	response = rt.SendRequest("POST", "/db/_session", `{"name":"bernard", "password":"letmein", "ttl":86400}`)
+	assertStatus(t, response, 200)
+	cookies = (&http.Response{Header: response.Header()}).Cookies()
+	assert.Equals(t, cookies[0].MaxAge, 3600)
+
+	// Without a TTL, the default is clamped too:
+	response = rt.SendRequest("POST", "/db/_session", `{"name":"bernard", "password":"letmein"}`)
+	assertStatus(t, response, 200)
+	cookies = (&http.Response{Header: response.Header()}).Cookies()
+	assert.Equals(t, cookies[0].MaxAge, 3600)
+
+	response = rt.SendRequest("POST", "/db/_session", `{"name":"bernard", "password":"letmein", "ttl":-5}`)
+	assertStatus(t, response, 400)
+
+	// The admin API can exceed the max:
+	response = rt.SendAdminRequest("POST", "/db/_session", `{"name":"bernard", "ttl":86400}`)
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	expires, err = time.Parse(time.RFC3339, body["expires"].(string))
+	assert.Equals(t, err, nil)
+	assert.True(t, expires.After(time.Now().Add(23*time.Hour)))
+}
+
+func TestSessionLoginByEmail(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"email":"bernard@example.com", "password":"letmein"}`)
+	assertStatus(t, response, 201)
+
+	// Another user can't claim the same email address:
+	response = rt.SendAdminRequest("PUT", "/db/_user/manny", `{"email":"bernard@example.com", "password":"letmein"}`)
+	assertStatus(t, response, 409)
+
+	response = rt.SendRequest("POST", "/db/_session", `{"name":"bernard@example.com", "password":"letmein"}`)
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["userCtx"].(map[string]interface{})["name"], "bernard")
+
+	response = rt.SendRequest("POST", "/db/_session", `{"name":"bernard@example.com", "password":"wrong"}`)
+	assertStatus(t, response, 401)
+}
+
+func TestBearerJWTAuth(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	secret := "s3cr3t"
+	bearer, err := auth.NewJWTBearerAuth(auth.JWTBearerOptions{
+		Issuer:   "https://idp.example.com",
+		Audience: "sync_gateway",
+		Secret:   &secret,
+		Register: true,
+		Channels: []string{"user-{{sub}}"},
+	})
+	assertNoError(t, err, "Couldn't create JWTBearerAuth")
+	rt.GetDatabase().JWTBearer = bearer
+
+	makeToken := func(key string, expiry time.Time) string {
+		claims := fmt.Sprintf(`{"iss":"https://idp.example.com","aud":"sync_gateway","sub":"bernard","exp":%d}`, expiry.Unix())
+		data := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(claims))
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(data))
+		return data + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	response := rt.SendRequestWithHeaders("GET", "/db/_session", "",
+		map[string]string{"Authorization": "Bearer " + makeToken(secret, time.Now().Add(time.Hour))})
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	userCtx := body["userCtx"].(map[string]interface{})
+	assert.Equals(t, userCtx["name"], "bernard")
+	_, ok := userCtx["channels"].(map[string]interface{})["user-bernard"]
+	assert.True(t, ok)
+
+	// Expired and badly signed tokens get a 401 with a Bearer challenge:
+	for _, token := range []string{makeToken(secret, time.Now().Add(-time.Minute)), makeToken("wrong", time.Now().Add(time.Hour))} {
+		response = rt.SendRequestWithHeaders("GET", "/db/_session", "", map[string]string{"Authorization": "Bearer " + token})
+		assertStatus(t, response, 401)
+		assert.True(t, strings.HasPrefix(response.Header().Get("WWW-Authenticate"), "Bearer "))
+	}
+}
+
+func TestListUserSessions(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"name":"bernard", "password":"letmein"}`)
+	assertStatus(t, response, 201)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/nobody/_sessions", ""), 404)
+
+	getSessions := func() []interface{} {
+		response := rt.SendAdminRequest("GET", "/db/_user/bernard/_sessions", "")
+		assertStatus(t, response, 200)
+		var body db.Body
+		json.Unmarshal(response.Body.Bytes(), &body)
+		return body["sessions"].([]interface{})
+	}
+	assert.Equals(t, len(getSessions()), 0)
+
+	var sessionIDs []string
+	for _, ttl := range []int{3600, 7200, 1} {
+		response = rt.SendAdminRequest("POST", "/db/_session", fmt.Sprintf(`{"name":"bernard", "ttl":%d}`, ttl))
+		assertStatus(t, response, 200)
+		var body db.Body
+		json.Unmarshal(response.Body.Bytes(), &body)
+		sessionIDs = append(sessionIDs, body["session_id"].(string))
+	}
+	sessions := getSessions()
+	assert.Equals(t, len(sessions), 3)
+	first := sessions[0].(map[string]interface{})
+	assert.Equals(t, first["id"], sessionIDs[0])
+	assert.Equals(t, first["ttl"], 3600.0)
+
+	// The session that expired without being deleted is left out:
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equals(t, len(getSessions()), 2)
+
+	// Deleting a session removes it from the list:
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_session/"+sessionIDs[0], ""), 200)
+	sessions = getSessions()
+	assert.Equals(t, len(sessions), 1)
+	assert.Equals(t, sessions[0].(map[string]interface{})["id"], sessionIDs[1])
+
+	// Revoked sessions are left out:
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/bernard/_session", ""), 200)
+	assert.Equals(t, len(getSessions()), 0)
+}
+
+func TestGuestRateLimit(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	rt.GetDatabase().GuestRateLimiter = base.NewRateLimiter(0.5, 2)
+
+	sendFrom := func(addr string) *TestResponse {
+		rq := request("GET", "/db/", "")
+		rq.RemoteAddr = addr
+		return rt.Send(rq)
+	}
+	assertStatus(t, sendFrom("10.0.0.1:5000"), 200)
+	assertStatus(t, sendFrom("10.0.0.1:5001"), 200)
+	response := sendFrom("10.0.0.1:5002")
+	assertStatus(t, response, 429)
+	assert.Equals(t, response.Header().Get("Retry-After"), "2")
+
+	// Other clients, and authenticated requests, aren't affected:
+	assertStatus(t, sendFrom("10.0.0.2:5000"), 200)
+	response = rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"name":"bernard", "password":"letmein"}`)
+	assertStatus(t, response, 201)
+	rq := request("GET", "/db/", "")
+	rq.RemoteAddr = "10.0.0.1:5003"
+	rq.SetBasicAuth("bernard", "letmein")
+	assertStatus(t, rt.Send(rq), 200)
+}
+
+func TestDisableGuest(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	rt.GetDatabase().Options.DisableGuest = true
+
+	response := rt.SendRequest("GET", "/db/_changes", "")
+	assertStatus(t, response, 401)
+	assert.Equals(t, response.Header().Get("WWW-Authenticate"), `Basic realm="Couchbase Sync Gateway"`)
+	assertStatus(t, rt.SendRequest("GET", "/db/_all_docs", ""), 401)
+
+	// The database info is still readable without logging in, and reports that guest access is off:
+	var body db.Body
+	response = rt.SendRequest("GET", "/db/", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["disable_guest"], true)
+	assertStatus(t, rt.SendRequest("HEAD", "/db/", ""), 200)
+
+	// Even a guest user with access to everything doesn't let requests in:
+	response = rt.SendAdminRequest("PUT", "/db/_user/GUEST", `{"disabled":false, "admin_channels":["*"]}`)
+	assertStatus(t, response, 200)
+	assertStatus(t, rt.SendRequest("GET", "/db/_changes", ""), 401)
+
+	// Logging in still works:
+	response = rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"password":"letmein"}`)
+	assertStatus(t, response, 201)
+	response = rt.SendRequest("POST", "/db/_session", `{"name":"bernard", "password":"letmein"}`)
+	assertStatus(t, response, 200)
+	response = rt.SendRequestWithHeaders("GET", "/db/_changes", "", map[string]string{"Cookie": response.Header().Get("Set-Cookie")})
+	assertStatus(t, response, 200)
+
+	// The admin API is unaffected:
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/", ""), 200)
+
+	// A GUEST user in the config isn't created:
+	spec := map[string]*db.PrincipalConfig{"GUEST": {Disabled: false, ExplicitChannels: base.SetOf("*")}}
+	counts, err := rt.ServerContext().installPrincipals(rt.GetDatabase(), spec, "user")
+	assertNoError(t, err, "installPrincipals")
+	assert.Equals(t, counts, db.PrincipalProvisionCounts{})
+}
+
+func TestGuestMaxChannels(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	rt.GetDatabase().Options.GuestMaxChannels = 2
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/GUEST", `{"disabled":false, "admin_channels":["a", "b"]}`)
+	assertStatus(t, response, 200)
+	response = rt.SendAdminRequest("PUT", "/db/_user/GUEST", `{"disabled":false, "admin_channels":["a", "b", "c"]}`)
+	assertStatus(t, response, 400)
+	response = rt.SendAdminRequest("PUT", "/db/_user/GUEST", `{"disabled":false, "admin_channels":["*"]}`)
+	assertStatus(t, response, 400)
+
+	// Other users aren't limited:
+	response = rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"password":"letmein", "admin_channels":["a", "b", "c"]}`)
+	assertStatus(t, response, 201)
+}
+
+func TestSessionRevocation(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"name":"bernard", "password":"letmein"}`)
+	assertStatus(t, response, 201)
+
+	newSession := func(password string) map[string]string {
+		response := rt.SendRequest("POST", "/db/_session", fmt.Sprintf(`{"name":"bernard", "password":%q}`, password))
+		assertStatus(t, response, 200)
+		return map[string]string{"Cookie": response.Header().Get("Set-Cookie")}
+	}
+
+	// Changing the password revokes existing sessions:
+	reqHeaders := newSession("letmein")
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/_session", "", reqHeaders), 200)
+	response = rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"name":"bernard", "password":"newpassword"}`)
+	assertStatus(t, response, 200)
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/_session", "", reqHeaders), 401)
+
+	// So does revoking them through the admin API:
+	reqHeaders = newSession("newpassword")
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/_session", "", reqHeaders), 200)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/bernard/_session", ""), 200)
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/_session", "", reqHeaders), 401)
+
+	// Sessions created afterwards are valid:
+	reqHeaders = newSession("newpassword")
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/_session", "", reqHeaders), 200)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/nobody/_session", ""), 404)
+}
+
+func TestChangeOwnPassword(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"name":"bernard", "password":"letmein"}`)
+	assertStatus(t, response, 201)
+	newSession := func(password string) map[string]string {
+		response := rt.SendRequest("POST", "/db/_session", fmt.Sprintf(`{"name":"bernard", "password":%q}`, password))
+		assertStatus(t, response, 200)
+		return map[string]string{"Cookie": response.Header().Get("Set-Cookie")}
+	}
+	otherDevice := newSession("letmein")
+	thisDevice := newSession("letmein")
+
+	// The old password has to be right, and the new one has to meet the policy:
+	assertStatus(t, rt.SendRequestWithHeaders("PUT", "/db/_user/_password", `{"old_password":"wrong", "new_password":"new-password"}`, thisDevice), 403)
+	assertStatus(t, rt.SendRequestWithHeaders("PUT", "/db/_user/_password", `{"old_password":"letmein", "new_password":"short"}`, thisDevice), 400)
+	rt.GetDatabase().Options.PasswordPolicy.MinCharClasses = 3
+	assertStatus(t, rt.SendRequestWithHeaders("PUT", "/db/_user/_password", `{"old_password":"letmein", "new_password":"new-password"}`, thisDevice), 400)
+
+	// Changing it ends the other sessions, and gives this client a new one:
+	response = rt.SendRequestWithHeaders("PUT", "/db/_user/_password", `{"old_password":"letmein", "new_password":"New-Password"}`, thisDevice)
+	assertStatus(t, response, 200)
+	newCookie := response.Header().Get("Set-Cookie")
+	assert.True(t, newCookie != "")
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/", "", otherDevice), 401)
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/", "", thisDevice), 401)
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/", "", map[string]string{"Cookie": newCookie}), 200)
+	newSession("New-Password")
+
+	// Basic auth works too:
+	rq := request("PUT", "/db/_user/_password", `{"old_password":"New-Password", "new_password":"Newer-Password1"}`)
+	rq.SetBasicAuth("bernard", "New-Password")
+	assertStatus(t, rt.Send(rq), 200)
+	newSession("Newer-Password1")
+
+	// The guest user can't change a password:
+	rt.SetAdminParty(true)
+	assertStatus(t, rt.SendRequest("PUT", "/db/_user/_password", `{"old_password":"", "new_password":"Guest-Password1"}`), 403)
+}
+
+func TestChangeOwnPasswordRateLimit(t *testing.T) {
+
+	var rt RestTester
+	defer rt.Close()
+	rt.GetDatabase().GuestRateLimiter = base.NewRateLimiter(0.5, 2)
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"name":"bernard", "password":"letmein"}`)
+	assertStatus(t, response, 201)
+	changePassword := func(oldPassword string) *TestResponse {
+		rq := request("PUT", "/db/_user/_password", fmt.Sprintf(`{"old_password":%q, "new_password":"New-Password"}`, oldPassword))
+		rq.RemoteAddr = "10.0.0.1:5000"
+		rq.SetBasicAuth("bernard", "letmein")
+		return rt.Send(rq)
+	}
+
+	// Wrong old passwords use up the limit, and then even the right one isn't checked:
+	assertStatus(t, changePassword("wrong1"), 403)
+	assertStatus(t, changePassword("wrong2"), 403)
+	response = changePassword("letmein")
+	assertStatus(t, response, 429)
+	assert.Equals(t, response.Header().Get("Retry-After"), "2")
+}
+
+func TestUnicodeAndLongDocIDs(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	// Unicode IDs, and IDs containing escape-like characters, round-trip whether or not they're
+	// %-escaped in the URL:
+	revs := map[string]string{}
+	for _, docid := range []string{"café", "日本語", "100%", "a%2Fb", "a+b c"} {
+		escaped := strings.Replace(url.QueryEscape(docid), "+", "%20", -1)
+		response := rt.SendRequest("PUT", "/db/"+escaped, `{"n":1}`)
+		assertStatus(t, response, 201)
+		revs[docid] = respRevID(t, response)
+		response = rt.SendRequest("GET", "/db/"+escaped, "")
+		assertStatus(t, response, 200)
+		var body db.Body
+		json.Unmarshal(response.Body.Bytes(), &body)
+		assert.Equals(t, body["_id"], docid)
+	}
+	assertStatus(t, rt.SendRequest("GET", "/db/café", ""), 200)
+	response := rt.SendRequest("PUT", "/db/%E6%97%A5%E6%9C%AC%E8%AA%9E/att.txt?rev="+revs["日本語"], "hi")
+	assertStatus(t, response, 201)
+	response = rt.SendRequest("GET", "/db/日本語/att.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, string(response.Body.Bytes()), "hi")
+
+	// New docs with IDs that are too long or aren't UTF-8 are rejected everywhere:
+	longID := strings.Repeat("x", db.DefaultMaxDocIDLength+1)
+	maxID := strings.Repeat("x", db.DefaultMaxDocIDLength)
+	response = rt.SendRequest("PUT", "/db/"+maxID, `{}`)
+	assertStatus(t, response, 201)
+	maxIDRev := respRevID(t, response)
+	response = rt.SendRequest("PUT", "/db/"+longID, `{}`)
+	assertStatus(t, response, 400)
+	assert.True(t, strings.Contains(string(response.Body.Bytes()), longID))
+	assertStatus(t, rt.SendRequest("PUT", "/db/%FF%FE", `{}`), 400)
+	assertStatus(t, rt.SendRequest("PUT", "/db/_local/"+longID, `{}`), 400)
+	response = rt.SendRequest("POST", "/db/_bulk_docs", `{"docs":[{"_id":"`+longID+`"}, {"_id":"short"}]}`)
+	assertStatus(t, response, 201)
+	var results []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &results)
+	assert.Equals(t, len(results), 2)
+	assert.Equals(t, results[0]["status"], 400.0)
+	assert.Equals(t, results[1]["id"], "short")
+
+	// The max length can be lowered:
+	rt.GetDatabase().Options.MaxDocIDLength = 40
+	assertStatus(t, rt.SendRequest("PUT", "/db/"+strings.Repeat("y", 41), `{}`), 400)
+	assertStatus(t, rt.SendRequest("PUT", "/db/"+strings.Repeat("y", 40), `{}`), 201)
+	assertStatus(t, rt.SendRequest("POST", "/db/", `{}`), 200)
+
+	// ...but existing docs with longer IDs can still be read, updated and deleted:
+	assertStatus(t, rt.SendRequest("GET", "/db/"+maxID, ""), 200)
+	response = rt.SendRequest("PUT", "/db/"+maxID+"?rev="+maxIDRev, `{"updated": true}`)
+	assertStatus(t, response, 201)
+	assertStatus(t, rt.SendRequest("DELETE", "/db/"+maxID+"?rev="+respRevID(t, response), ""), 200)
+}
+
 func TestEventConfigValidationSuccess(t *testing.T) {
 
 	sc := NewServerContext(&ServerConfig{})
@@ -2842,3 +4176,50 @@ func Benchmark_RestApiPutDocPerformanceExplicitSyncFunc(b *testing.B) {
 		}
 	})
 }
+
+// A _bulk_get of 1,000 docs by a user with a role, which checks the user's access to each doc.
+func Benchmark_RestApiBulkGet1000Docs(b *testing.B) {
+	rt := RestTester{SyncFn: `function(doc, oldDoc){channel(doc.channels);}`}
+	defer rt.Close()
+
+	rt.SendAdminRequest("PUT", "/db/_role/staff", `{"admin_channels":["staff"]}`)
+	rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["a", "tenant-1-*"], "admin_roles":["staff"]}`)
+	var docs, requested []string
+	for i := 0; i < 1000; i++ {
+		docs = append(docs, fmt.Sprintf(`{"_id": "doc%d", "channels": ["tenant-%d-x", "staff"]}`, i, i%10))
+		requested = append(requested, fmt.Sprintf(`{"id": "doc%d"}`, i))
+	}
+	if response := rt.SendAdminRequest("POST", "/db/_bulk_docs", `{"docs": [`+strings.Join(docs, ",")+`]}`); response.Code != 201 {
+		b.Fatalf("_bulk_docs failed: %s", response.Body)
+	}
+	input := `{"docs": [` + strings.Join(requested, ",") + `]}`
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request := requestByUser("POST", "/db/_bulk_get", input, "alice")
+		request.Header.Set("Accept", "application/json")
+		if response := rt.Send(request); response.Code != 200 {
+			b.Fatalf("_bulk_get failed: %s", response.Body)
+		}
+	}
+}
+
+func TestRetriedWriteWithOperationID(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	headers := map[string]string{"X-Operation-Id": "client-op-1"}
+	response := rt.SendRequestWithHeaders("PUT", "/db/doc", `{"n": 1}`, headers)
+	assertStatus(t, response, 201)
+	rev1 := respRevID(t, response)
+
+	// The retry gets the original response, rather than a conflict:
+	response = rt.SendRequestWithHeaders("PUT", "/db/doc", `{"n": 1}`, headers)
+	assertStatus(t, response, 201)
+	assert.Equals(t, respRevID(t, response), rev1)
+	assert.Equals(t, response.Header().Get("Etag"), strconv.Quote(rev1))
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc", `{"n": 1}`), 409)
+
+	headers["X-Operation-Id"] = strings.Repeat("x", db.MaxOperationIDLength+1)
+	assertStatus(t, rt.SendRequestWithHeaders("PUT", "/db/doc2", `{}`, headers), 400)
+}
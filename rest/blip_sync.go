@@ -55,6 +55,8 @@ func (h *handler) handleBLIPSync() error {
 	if !h.server.GetDatabaseConfig(h.db.Name).Unsupported.Replicator2 {
 		return base.HTTPErrorf(http.StatusNotFound, "feature not enabled")
 	}
+	// The connection lasts as long as the client's replication, so it has no deadline:
+	h.setFeed()
 
 	ctx := blipSyncContext{
 		blipContext: blip.NewContext(),
@@ -67,7 +69,7 @@ func (h *handler) handleBLIPSync() error {
 	}
 
 	ctx.blipContext.Logger = func(fmt string, params ...interface{}) {
-		base.LogTo("BLIP", fmt, params...)
+		h.logContext.LogTo("BLIP", fmt, params...)
 	}
 	ctx.blipContext.LogMessages = base.LogEnabledExcludingLogStar("BLIP+")
 	ctx.blipContext.LogFrames = base.LogEnabledExcludingLogStar("BLIP++")
@@ -77,7 +79,7 @@ func (h *handler) handleBLIPSync() error {
 		h.logStatus(101, "Upgraded to BLIP+WebSocket protocol")
 		defer func() {
 			conn.Close()
-			base.LogTo("HTTP+", "#%03d:     --> BLIP+WebSocket connection closed", h.serialNumber)
+			h.logContext.LogTo("HTTP+", "#%03d:     --> BLIP+WebSocket connection closed", h.serialNumber)
 		}()
 		ctx.blipContext.WebSocketHandler()(conn)
 	}
@@ -212,6 +214,7 @@ func (bh *blipHandler) sendChanges(since db.SequenceID) {
 	}()
 
 	base.LogTo("Sync", "Sending changes since %v", since)
+	bh.db.RecordChangesRequest(since)
 	options := db.ChangesOptions{
 		Since:      since,
 		Conflicts:  true,
@@ -10,12 +10,16 @@
 package rest
 
 import (
+	"container/heap"
 	"encoding/json"
 	"fmt"
 	"html"
+	"io"
+	"io/ioutil"
 	"math"
 	"mime/multipart"
 	"net/http"
+	"sort"
 	"strings"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -36,14 +40,28 @@ func init() {
 	base.StatsExpvars.Set("bulkApi.BulkDocsPerDocRollingMean", &bulkApiBulkDocsPerDocRollingMean)
 }
 
-// HTTP handler for _all_docs
+// HTTP handler for _all_docs.  A GET lists all docs the user can see; a POST (or a GET with a
+// "keys" param) returns a row for each requested doc ID, in order.  Docs that are missing or that
+// the user doesn't have access to get a "not_found" error row.
 func (h *handler) handleAllDocs() error {
+	h.setRequestClass(bulkRequest)
+	h.db = h.db.WithChannelAccessCache()
 	// http://wiki.apache.org/couchdb/HTTP_Bulk_Document_API
 	includeDocs := h.getBoolQuery("include_docs")
 	includeChannels := h.getBoolQuery("channels")
 	includeAccess := h.getBoolQuery("access") && h.user == nil
 	includeRevs := h.getBoolQuery("revs")
 	includeSeqs := h.getBoolQuery("update_seq")
+	includeSizes := h.getBoolQuery("include_sizes")
+	sortBySize := false
+	if sortBy := h.getQuery("sort"); sortBy == "size" {
+		includeSizes, sortBySize = true, true
+	} else if sortBy != "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid sort %q", sortBy)
+	}
+	if includeSizes && h.privs != adminPrivs {
+		return base.HTTPErrorf(http.StatusForbidden, "include_sizes is only allowed on the admin port")
+	}
 
 	// Get the doc IDs if this is a POST request:
 	var explicitDocIDs []string
@@ -63,6 +81,9 @@ func (h *handler) handleAllDocs() error {
 			return base.HTTPErrorf(http.StatusBadRequest, "Bad keys")
 		}
 	}
+	if maxKeys := h.db.MaxAllDocsKeys(); len(explicitDocIDs) > maxKeys {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "_all_docs request has more than %d keys", maxKeys)
+	}
 
 	// Get the set of channels the user has access to; nil if user is admin or has access to user "*"
 	var availableChannels channels.TimedSet
@@ -76,9 +97,17 @@ func (h *handler) handleAllDocs() error {
 		}
 	}
 
+	// Docs in no channels are only visible to admins, even if the user has access to "*":
+	adminOnly := func(docChannels []string) bool {
+		return h.user != nil && len(docChannels) == 1 && docChannels[0] == channels.NoChannels
+	}
+
 	// Subroutines that filter a channel list down to the ones that the user has access to:
 	filterChannels := func(channels []string) []string {
 		if availableChannels == nil {
+			if adminOnly(channels) {
+				return nil
+			}
 			return channels
 		}
 		dst := 0
@@ -94,6 +123,9 @@ func (h *handler) handleAllDocs() error {
 		return channels[0:dst]
 	}
 	filterChannelSet := func(channelMap channels.ChannelMap) []string {
+		if removal, found := channelMap[channels.NoChannels]; found && removal == nil && h.user != nil {
+			return nil
+		}
 		var result []string
 		if availableChannels == nil {
 			result = []string{}
@@ -113,6 +145,7 @@ func (h *handler) handleAllDocs() error {
 		Rev      string              `json:"rev"`
 		Channels []string            `json:"channels,omitempty"`
 		Access   map[string]base.Set `json:"access,omitempty"` // for admins only
+		Sizes    *db.DocSizes        `json:"sizes,omitempty"`  // for admins only
 	}
 	type allDocsRow struct {
 		Key       string           `json:"key"`
@@ -137,36 +170,47 @@ func (h *handler) handleAllDocs() error {
 			}
 		}
 
-		if explicitDocIDs != nil || includeDocs || includeAccess {
-			// Fetch the document body and other metadata that lives with it:
-			body, channelSet, access, roleAccess, _, _, err := h.db.GetRevAndChannels(doc.DocID, doc.RevID, includeRevs)
+		if explicitDocIDs != nil || includeAccess {
+			// Look up the doc's current revision, channels and access grants:
+			syncData, err := h.db.GetDocSyncData(doc.DocID)
 			if err != nil {
 				row.Status, _ = base.ErrorAsHTTPStatus(err)
 				return row
-			} else if body["_removed"] != nil {
-				row.Status = http.StatusForbidden
-				return row
 			}
 			if explicitDocIDs != nil {
-				if channels = filterChannelSet(channelSet); channels == nil {
-					row.Status = http.StatusForbidden
+				// Docs the user can't see are reported as missing, so as not to leak their existence:
+				if channels = filterChannelSet(syncData.Channels); channels == nil {
+					row.Status = http.StatusNotFound
 					return row
 				}
-				doc.RevID = body["_rev"].(string)
+				doc.RevID = syncData.CurrentRev
 			}
-			if includeDocs {
-				row.Doc = body
-			}
-			if includeAccess && (access != nil || roleAccess != nil) {
+			if includeAccess && (syncData.Access != nil || syncData.RoleAccess != nil) {
 				value.Access = map[string]base.Set{}
-				for userName, channels := range access {
+				for userName, channels := range syncData.Access {
 					value.Access[userName] = channels.AsSet()
 				}
-				for roleName, channels := range roleAccess {
+				for roleName, channels := range syncData.RoleAccess {
 					value.Access["role:"+roleName] = channels.AsSet()
 				}
 			}
 		}
+		if includeDocs {
+			// Now that the revision is known, its body can come from the revision cache:
+			maxHistory := 0
+			if includeRevs {
+				maxHistory = math.MaxInt32
+			}
+			body, err := h.db.GetRevWithHistory(doc.DocID, doc.RevID, maxHistory, nil, nil, false)
+			if err != nil {
+				row.Status, _ = base.ErrorAsHTTPStatus(err)
+				return row
+			} else if body["_removed"] != nil {
+				row.Status = http.StatusNotFound
+				return row
+			}
+			row.Doc = body
+		}
 
 		row.Value = &value
 		row.ID = doc.DocID
@@ -177,21 +221,55 @@ func (h *handler) handleAllDocs() error {
 		if includeChannels {
 			row.Value.Channels = channels
 		}
+		if includeSizes {
+			// Sizes come from the doc's metadata, not from its attachments:
+			sizes, err := h.db.GetDocSizes(doc.DocID)
+			if err != nil {
+				row.Value, row.ID = nil, ""
+				row.Status, _ = base.ErrorAsHTTPStatus(err)
+				return row
+			}
+			row.Value.Sizes = &sizes
+		}
 		return row
 	}
 
-	// Subroutine that writes a response entry for a document:
+	// Subroutine that writes a response row:
+	writeRow := func(row *allDocsRow) {
+		if row.Status >= 300 {
+			row.Error = base.CouchHTTPErrorName(row.Status)
+		}
+		if totalRows > 0 {
+			h.response.Write([]byte(","))
+		}
+		totalRows++
+		h.addJSON(row)
+	}
+
+	// Subroutine that writes a response entry for a document, after skipping the first 'skip' rows.
+	// When sorting by size, the biggest skip+limit rows are collected instead, and skipped and
+	// written afterwards:
+	skip := h.getIntQuery("skip", 0)
+	limit := h.getIntQuery("limit", 0)
+	var rowsToSort sizedRowHeap
 	writeDoc := func(doc db.IDAndRev, channels []string) bool {
 		row := createRow(doc, channels)
-		if row != nil {
-			if row.Status >= 300 {
-				row.Error = base.CouchHTTPErrorName(row.Status)
+		if row != nil && sortBySize {
+			var size int64
+			if row.Value != nil {
+				size = row.Value.Sizes.Total()
 			}
-			if totalRows > 0 {
-				h.response.Write([]byte(","))
+			maxRows := uint64(0)
+			if limit > 0 {
+				maxRows = skip + limit
 			}
-			totalRows++
-			h.addJSON(row)
+			rowsToSort.add(sizedRow{row: row, size: size, index: rowsToSort.found}, maxRows)
+			return true
+		} else if row != nil && skip > 0 {
+			skip--
+			return false
+		} else if row != nil {
+			writeRow(row)
 			return true
 		}
 		return false
@@ -200,7 +278,9 @@ func (h *handler) handleAllDocs() error {
 	var options db.ForEachDocIDOptions
 	options.Startkey = h.getJSONStringQuery("startkey")
 	options.Endkey = h.getJSONStringQuery("endkey")
-	options.Limit = h.getIntQuery("limit", 0)
+	if !sortBySize {
+		options.Limit = limit
+	}
 
 	// Now it's time to actually write the response!
 	lastSeq, _ := h.db.LastSequence()
@@ -210,12 +290,12 @@ func (h *handler) handleAllDocs() error {
 	if explicitDocIDs != nil {
 		count := uint64(0)
 		for _, docID := range explicitDocIDs {
-			writeDoc(db.IDAndRev{DocID: docID, RevID: "", Sequence: 0}, nil)
-			count++
+			if writeDoc(db.IDAndRev{DocID: docID, RevID: "", Sequence: 0}, nil) {
+				count++
+			}
 			if options.Limit > 0 && count == options.Limit {
 				break
 			}
-
 		}
 	} else {
 		if err := h.db.ForEachDocID(writeDoc, options); err != nil {
@@ -223,6 +303,19 @@ func (h *handler) handleAllDocs() error {
 		}
 	}
 
+	if sortBySize {
+		sort.Sort(rowsToSort.sizedRows)
+		for _, sorted := range rowsToSort.sizedRows {
+			if skip > 0 {
+				skip--
+				continue
+			} else if limit > 0 && uint64(totalRows) >= limit {
+				break
+			}
+			writeRow(sorted.row.(*allDocsRow))
+		}
+	}
+
 	h.response.Write([]byte(fmt.Sprintf("],\n"+`"total_rows":%d,"update_seq":%d}`,
 		totalRows, lastSeq)))
 	return nil
@@ -231,13 +324,13 @@ func (h *handler) handleAllDocs() error {
 // HTTP handler for _dump
 func (h *handler) handleDump() error {
 	viewName := h.PathVar("view")
-	base.LogTo("HTTP", "Dump view %q", viewName)
+	h.logContext.LogTo("HTTP", "Dump view %q", viewName)
 	opts := db.Body{"stale": false, "reduce": false}
 	designDocName := db.GetDesignDocForView(viewName)
 	if designDocName == "" {
 		return fmt.Errorf("Unknown view name: %s", viewName)
 	}
-	result, err := h.db.Bucket.View(designDocName, viewName, opts)
+	result, err := h.db.Bucket.View(h.db.DesignDocName(designDocName, viewName), viewName, opts)
 	if err != nil {
 		return err
 	}
@@ -263,9 +356,10 @@ func (h *handler) handleDump() error {
 
 // HTTP handler for _dumpchannel
 func (h *handler) handleDumpChannel() error {
+	h.setRequestClass(bulkRequest)
 	channelName := h.PathVar("channel")
 	since := h.getIntQuery("since", 0)
-	base.LogTo("HTTP", "Dump channel %q", channelName)
+	h.logContext.LogTo("HTTP", "Dump channel %q", channelName)
 
 	chanLog := h.db.GetChangeLog(channelName, since)
 	if chanLog == nil {
@@ -301,8 +395,16 @@ func (h *handler) handleDumpChannel() error {
 //		{"id": "docid", "rev": "revid", "atts_since": [12,...]}, ...
 // 	 ]
 // }
+// The response is multipart/mixed with a part per doc, unless the client only accepts
+// application/json, in which case it looks like:
+// {
+//   "results": [
+//		{"id": "docid", "docs": [{"ok": {...}} or {"error": {...}}]}, ...
+//   ]
+// }
 func (h *handler) handleBulkGet() error {
-
+	h.setRequestClass(bulkRequest)
+	h.db = h.db.WithChannelAccessCache()
 	handleBulkGetStartedAt := time.Now()
 	defer bulkApiBulkGetRollingMean.AddSince(handleBulkGetStartedAt)
 
@@ -340,50 +442,23 @@ func (h *handler) handleBulkGet() error {
 
 	defer bulkApiBulkGetPerDocRollingMean.AddSincePerItem(handleBulkGetStartedAt, len(docs))
 
-	err = h.writeMultipart("mixed", func(writer *multipart.Writer) error {
+	if !h.requestAccepts("multipart/") && h.requestAccepts("application/json") {
+		results := make([]db.Body, 0, len(docs))
 		for _, item := range docs {
-			var body db.Body
-			var revsFrom, attsSince []string
-			var err error
-
-			doc := item.(map[string]interface{})
-			docid, _ := doc["id"].(string)
-			revid := ""
-			revok := true
-			if doc["rev"] != nil {
-				revid, revok = doc["rev"].(string)
-			}
-			if docid == "" || !revok {
-				err = base.HTTPErrorf(http.StatusBadRequest, "Invalid doc/rev ID in _bulk_get")
-			} else {
-				attsSince, err = db.GetStringArrayProperty(doc, "atts_since")
-				if revsLimit > 0 {
-					revsFrom, err = db.GetStringArrayProperty(doc, "revs_from")
-					if revsFrom == nil {
-						revsFrom = attsSince // revs_from defaults to same value as atts_since
-					}
-				}
-				if !includeAttachments {
-					attsSince = nil
-				} else if attsSince == nil {
-					attsSince = []string{}
-				}
-			}
-
-			if err == nil {
-				body, err = h.db.GetRevWithHistory(docid, revid, revsLimit, revsFrom, attsSince, showExp)
-			}
-
+			docid, body, err := h.bulkGetDoc(item, revsLimit, includeAttachments, showExp)
+			result := db.Body{"ok": body}
 			if err != nil {
-				// Report error in the response for this doc:
-				status, reason := base.ErrorAsHTTPStatus(err)
-				errStr := base.CouchHTTPErrorName(status)
-				body = db.Body{"id": docid, "error": errStr, "reason": reason, "status": status}
-				if revid != "" {
-					body["rev"] = revid
-				}
+				result = db.Body{"error": body}
 			}
+			results = append(results, db.Body{"id": docid, "docs": []db.Body{result}})
+		}
+		h.writeJSON(db.Body{"results": results})
+		return nil
+	}
 
+	err = h.writeMultipart("mixed", func(writer *multipart.Writer) error {
+		for _, item := range docs {
+			_, body, err := h.bulkGetDoc(item, revsLimit, includeAttachments, showExp)
 			h.db.WriteRevisionAsPart(body, err != nil, canCompressParts, writer)
 		}
 		return nil
@@ -392,14 +467,71 @@ func (h *handler) handleBulkGet() error {
 	return err
 }
 
-// HTTP handler for a POST to _bulk_docs
-func (h *handler) handleBulkDocs() error {
+// Gets one of the docs requested by a _bulk_get.  If it fails, returns the error along with a
+// body describing it, to be reported in the response for this doc.
+func (h *handler) bulkGetDoc(item interface{}, revsLimit int, includeAttachments, showExp bool) (string, db.Body, error) {
+	var body db.Body
+	var revsFrom, attsSince []string
+	var err error
+
+	doc, _ := item.(map[string]interface{})
+	docid, _ := doc["id"].(string)
+	revid := ""
+	revok := true
+	if doc["rev"] != nil {
+		revid, revok = doc["rev"].(string)
+	}
+	if docid == "" || !revok {
+		err = base.HTTPErrorf(http.StatusBadRequest, "Invalid doc/rev ID in _bulk_get")
+	} else {
+		attsSince, err = db.GetStringArrayProperty(doc, "atts_since")
+		if revsLimit > 0 {
+			revsFrom, err = db.GetStringArrayProperty(doc, "revs_from")
+			if revsFrom == nil {
+				revsFrom = attsSince // revs_from defaults to same value as atts_since
+			}
+		}
+		if !includeAttachments {
+			attsSince = nil
+		} else if attsSince == nil {
+			attsSince = []string{}
+		}
+	}
+
+	if err == nil {
+		body, err = h.db.GetRevWithHistory(docid, revid, revsLimit, revsFrom, attsSince, showExp)
+	}
+
+	if err != nil {
+		// Report error in the response for this doc:
+		status, reason := base.ErrorAsHTTPStatus(err)
+		errStr := base.CouchHTTPErrorName(status)
+		body = db.Body{"id": docid, "error": errStr, "reason": reason, "status": status}
+		if revid != "" {
+			body["rev"] = revid
+		}
+	}
+	return docid, body, err
+}
 
+// HTTP handler for a POST to _bulk_docs.  Each doc is saved independently, and the response has a
+// row for each, in request order, with either its new revision ID or the error that prevented it
+// from being saved.  With new_edits=false, docs whose revision already existed get no row.
+func (h *handler) handleBulkDocs() error {
+	h.setRequestClass(bulkRequest)
 	handleBulkDocsStartedAt := time.Now()
 	defer bulkApiBulkDocsRollingMean.AddSince(handleBulkDocsStartedAt)
 
+	maxBytes := h.db.MaxBulkDocsBytes()
+	if h.rq.ContentLength > maxBytes {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "_bulk_docs request body is larger than %d bytes", maxBytes)
+	}
+	limitedBody := &io.LimitedReader{R: h.requestBody, N: maxBytes + 1}
+	h.requestBody = ioutil.NopCloser(limitedBody)
 	body, err := h.readJSON()
-	if err != nil {
+	if limitedBody.N <= 0 {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "_bulk_docs request body is larger than %d bytes", maxBytes)
+	} else if err != nil {
 		return err
 	}
 	newEdits, ok := body["new_edits"].(bool)
@@ -412,98 +544,162 @@ func (h *handler) handleBulkDocs() error {
 		err = base.HTTPErrorf(http.StatusBadRequest, "missing 'docs' property")
 		return err
 	}
-	lenDocs := len(userDocs)
+	if maxDocs := h.db.MaxBulkDocs(); len(userDocs) > maxDocs {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "_bulk_docs request has more than %d docs", maxDocs)
+	}
 
 	defer bulkApiBulkDocsPerDocRollingMean.AddSincePerItem(handleBulkDocsStartedAt, len(userDocs))
 
-	// split out local docs, save them on their own
-	localDocs := make([]interface{}, 0, lenDocs)
-	docs := make([]interface{}, 0, lenDocs)
-	for _, item := range userDocs {
-		doc, ok := item.(map[string]interface{})
-		if !ok {
-			err = base.HTTPErrorf(http.StatusBadRequest, "Document body must be JSON")
-			return err
-		}
-		docid, ok := doc["_id"].(string)
-		if !ok {
-			err = base.HTTPErrorf(http.StatusBadRequest, "Document id must be string")
-			return err
-		}
-		if strings.HasPrefix(docid, "_local/") {
-			localDocs = append(localDocs, doc)
-		} else {
-			docs = append(docs, doc)
-		}
+	dryRun := h.getBoolQuery("dry_run")
+	if dryRun && h.privs != adminPrivs {
+		return base.HTTPErrorf(http.StatusForbidden, "dry_run is only allowed on the admin port")
 	}
 
-	h.db.ReserveSequences(uint64(len(docs)))
-
-	result := make([]db.Body, 0, len(docs))
-	for _, item := range docs {
-		doc := item.(map[string]interface{})
-		docid, _ := doc["_id"].(string)
-		var err error
-		var revid string
-		if newEdits {
-			if docid != "" {
-				revid, err = h.db.Put(docid, doc)
-			} else {
-				docid, revid, err = h.db.Post(doc)
-			}
-		} else {
-			revisions := db.ParseRevisions(doc)
-			if revisions == nil {
-				err = base.HTTPErrorf(http.StatusBadRequest, "Bad _revisions")
-			} else {
-				revid = revisions[0]
-				err = h.db.PutExistingRev(docid, doc, revisions)
+	numDocs := 0
+	for _, item := range userDocs {
+		if doc, ok := item.(map[string]interface{}); ok {
+			if docid, _ := doc["_id"].(string); !strings.HasPrefix(docid, "_local/") {
+				numDocs++
 			}
 		}
+	}
+	if !dryRun {
+		h.db.ReserveSequences(uint64(numDocs))
+	}
 
-		status := db.Body{}
-		if docid != "" {
-			status["id"] = docid
+	result := make([]db.Body, 0, len(userDocs))
+	for _, item := range userDocs {
+		if status := h.bulkDocsSave(item, newEdits, dryRun); status != nil {
+			result = append(result, status)
 		}
-		if err != nil {
-			code, msg := base.ErrorAsHTTPStatus(err)
-			status["status"] = code
-			status["error"] = base.CouchHTTPErrorName(code)
-			status["reason"] = msg
-			base.Logf("\tBulkDocs: Doc %q --> %d %s (%v)", docid, code, msg, err)
-			err = nil // wrote it to output already; not going to return it
-		} else {
-			status["rev"] = revid
+	}
+
+	if dryRun {
+		h.writeJSON(result)
+		return nil
+	}
+	h.writeJSONStatus(http.StatusCreated, result)
+	return nil
+}
+
+// Saves one doc of a _bulk_docs request, returning its result row, or nil if it was an existing
+// revision of a new_edits=false request.  A dry run's row describes the would-be revision.
+func (h *handler) bulkDocsSave(item interface{}, newEdits bool, dryRun bool) db.Body {
+	var docid, revid string
+	var err error
+	database := h.db
+	var dryRunResult *db.DryRunResult
+	if dryRun {
+		dryRunResult = &db.DryRunResult{}
+		database = h.db.WithDryRun(dryRunResult)
+	}
+	doc, ok := item.(map[string]interface{})
+	if !ok {
+		err = base.HTTPErrorf(http.StatusBadRequest, "Document body must be JSON")
+	} else if rawID, found := doc["_id"]; found {
+		if docid, ok = rawID.(string); !ok {
+			err = base.HTTPErrorf(http.StatusBadRequest, "Document id must be string")
+		} else if docid != "" && !strings.HasPrefix(docid, "_local/") {
+			// Checked here too, before the ID can reach any code path that builds a key from it:
+			err = h.db.ValidateDocID(docid)
 		}
-		result = append(result, status)
 	}
 
-	for _, item := range localDocs {
-		doc := item.(map[string]interface{})
+	switch {
+	case err != nil:
+		// The doc is malformed; the error is reported below
+	case strings.HasPrefix(docid, "_local/") && dryRun:
+		err = base.HTTPErrorf(http.StatusBadRequest, "dry_run isn't supported for _local docs")
+	case strings.HasPrefix(docid, "_local/"):
 		for k, v := range doc {
 			doc[k] = base.FixJSONNumbers(v)
 		}
-		var err error
-		var revid string
-		offset := len("_local/")
-		docid, _ := doc["_id"].(string)
-		idslug := docid[offset:]
-		revid, err = h.db.PutSpecial("local", idslug, doc)
-		status := db.Body{}
+		revid, err = h.db.PutSpecial("local", docid[len("_local/"):], doc)
+	case newEdits && docid != "":
+		revid, err = database.Put(docid, doc)
+	case newEdits:
+		docid, revid, err = database.Post(doc)
+	case docid == "":
+		err = base.HTTPErrorf(http.StatusBadRequest, "Document id is required with new_edits=false")
+	default:
+		revisions := db.ParseRevisions(doc)
+		if revisions == nil {
+			err = base.HTTPErrorf(http.StatusBadRequest, "Bad _revisions")
+			break
+		}
+		revid = revisions[0]
+		var added bool
+		added, err = database.PutExistingRevIfNew(docid, doc, revisions)
+		if err == nil && !added {
+			return nil // Like CouchDB, don't report revisions that already existed
+		}
+	}
+
+	status := db.Body{}
+	if docid != "" {
 		status["id"] = docid
-		if err != nil {
-			code, msg := base.ErrorAsHTTPStatus(err)
-			status["status"] = code
-			status["error"] = base.CouchHTTPErrorName(code)
-			status["reason"] = msg
-			base.Logf("\tBulkDocs: Local Doc %q --> %d %s (%v)", docid, code, msg, err)
-			err = nil
-		} else {
-			status["rev"] = revid
+	}
+	if err != nil {
+		code, msg := base.ErrorAsHTTPStatus(err)
+		status["status"] = code
+		status["error"] = base.CouchHTTPErrorName(code)
+		status["reason"] = msg
+		for key, value := range h.errorDetails(err) {
+			status[key] = value
 		}
-		result = append(result, status)
+		base.Logf("\tBulkDocs: Doc %q --> %d %s (%v)", docid, code, msg, err)
+	} else if dryRun {
+		status = dryRunResponse(docid, dryRunResult)
+	} else {
+		status["rev"] = revid
 	}
+	return status
+}
 
-	h.writeJSONStatus(http.StatusCreated, result)
-	return nil
+// _all_docs rows sorted by descending size, for ?sort=size.  Rows of the same size stay in the
+// order they were found in, which is by doc ID.
+type sizedRow struct {
+	row   interface{}
+	size  int64
+	index int // Number of rows found before this one
+}
+
+type sizedRows []sizedRow
+
+func (rows sizedRows) Len() int { return len(rows) }
+func (rows sizedRows) Less(i, j int) bool {
+	if rows[i].size != rows[j].size {
+		return rows[i].size > rows[j].size
+	}
+	return rows[i].index < rows[j].index
+}
+func (rows sizedRows) Swap(i, j int) { rows[i], rows[j] = rows[j], rows[i] }
+
+// A heap of the rows that sort first, whose top is the one that sorts last, so that the rows
+// collected for ?sort=size&limit=n are bounded by the limit rather than the number of docs.
+type sizedRowHeap struct {
+	sizedRows
+	found int // Number of rows added, including those dropped
+}
+
+func (rows sizedRowHeap) Less(i, j int) bool { return rows.sizedRows.Less(j, i) }
+
+func (rows *sizedRowHeap) Push(row interface{}) {
+	rows.sizedRows = append(rows.sizedRows, row.(sizedRow))
+}
+
+func (rows *sizedRowHeap) Pop() interface{} {
+	last := len(rows.sizedRows) - 1
+	row := rows.sizedRows[last]
+	rows.sizedRows = rows.sizedRows[:last]
+	return row
+}
+
+// Adds a row, then drops the row that sorts last if there are more than maxRows (0 for no max.)
+func (rows *sizedRowHeap) add(row sizedRow, maxRows uint64) {
+	rows.found++
+	heap.Push(rows, row)
+	if maxRows > 0 && uint64(len(rows.sizedRows)) > maxRows {
+		heap.Pop(rows)
+	}
 }
@@ -17,6 +17,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/websocket"
@@ -38,29 +39,30 @@ const kDefaultTimeoutMS = 5 * 60 * 1000
 // Maximum value of _changes?timeout property
 const kMaxTimeoutMS = 15 * 60 * 1000
 
+// HTTP handler for _revs_diff. The docs' revision trees are all fetched in one bulk operation.
 func (h *handler) handleRevsDiff() error {
+	h.setRequestClass(bulkRequest)
 	var input map[string][]string
 	err := h.readJSONInto(&input)
 	if err != nil {
 		return err
 	}
 
+	missing, possible := h.db.RevsDiff(input)
+
 	h.response.Write([]byte("{"))
 	first := true
-	for docid, revs := range input {
-		missing, possible := h.db.RevDiff(docid, revs)
-		if missing != nil {
-			docOutput := map[string]interface{}{"missing": missing}
-			if possible != nil {
-				docOutput["possible_ancestors"] = possible
-			}
-			if !first {
-				h.response.Write([]byte(",\n"))
-			}
-			first = false
-			h.response.Write([]byte(fmt.Sprintf("%q:", docid)))
-			h.addJSON(docOutput)
+	for docid, docMissing := range missing {
+		docOutput := map[string]interface{}{"missing": docMissing}
+		if docPossible := possible[docid]; docPossible != nil {
+			docOutput["possible_ancestors"] = docPossible
 		}
+		if !first {
+			h.response.Write([]byte(",\n"))
+		}
+		first = false
+		h.response.Write([]byte(fmt.Sprintf("%q:", docid)))
+		h.addJSON(docOutput)
 	}
 	h.response.Write([]byte("}"))
 	return nil
@@ -99,6 +101,14 @@ func (h *handler) updateChangesOptionsFromQuery(feed *string, options *db.Change
 		options.ActiveOnly = h.getBoolQuery("active_only")
 	}
 
+	if _, ok := values["revocations"]; ok {
+		options.Revocations = h.getBoolQuery("revocations")
+	}
+
+	if _, ok := values["sync_fn_epoch"]; ok {
+		options.SyncFnEpoch = h.getBoolQuery("sync_fn_epoch")
+	}
+
 	if _, ok := values["include_docs"]; ok {
 		options.IncludeDocs = (h.getBoolQuery("include_docs"))
 	}
@@ -162,6 +172,8 @@ func (h *handler) handleChanges() error {
 	base.StatsExpvars.Add("changesFeeds_total", 1)
 	base.StatsExpvars.Add("changesFeeds_active", 1)
 	defer base.StatsExpvars.Add("changesFeeds_active", -1)
+	base.MetricChangesFeedsActive.Add(h.db.Name, 1)
+	defer base.MetricChangesFeedsActive.Add(h.db.Name, -1)
 
 	var feed string
 	var options db.ChangesOptions
@@ -179,6 +191,8 @@ func (h *handler) handleChanges() error {
 		options.Limit = int(h.getIntQuery("limit", 0))
 		options.Conflicts = (h.getQuery("style") == "all_docs")
 		options.ActiveOnly = h.getBoolQuery("active_only")
+		options.Revocations = h.getBoolQuery("revocations")
+		options.SyncFnEpoch = h.getBoolQuery("sync_fn_epoch")
 		options.IncludeDocs = (h.getBoolQuery("include_docs"))
 		filter = h.getQuery("filter")
 		channelsParam := h.getQuery("channels")
@@ -240,7 +254,7 @@ func (h *handler) handleChanges() error {
 			to = fmt.Sprintf("  (to %s)", h.user.Name())
 		}
 
-		base.LogTo("Changes+", "Changes POST request.  URL: %v, feed: %v, options: %+v, filter: %v, bychannel: %v, docIds: %v %s",
+		h.logContext.LogTo("Changes+", "Changes POST request.  URL: %v, feed: %v, options: %+v, filter: %v, bychannel: %v, docIds: %v %s",
 			h.rq.URL, feed, options, filter, channelsArray, docIdsArray, to)
 
 
@@ -262,6 +276,13 @@ func (h *handler) handleChanges() error {
 			if len(userChannels) == 0 {
 				return base.HTTPErrorf(http.StatusBadRequest, "Empty channel list")
 			}
+			// A feed of only inaccessible channels would look to the client like it's up to date, so
+			// it gets a 403 instead.  (The feed itself follows the user's access as it changes.)
+			if allowed, disallowed := h.db.FilterChannelsForUser(userChannels); len(allowed) == 0 {
+				return base.HTTPErrorf(http.StatusForbidden, "No access to channels: %s", strings.Join(disallowed, ", "))
+			} else if len(disallowed) > 0 {
+				base.LogTo("Changes+", "Ignoring channels %v that %q can't access, for now", disallowed, h.user.Name())
+			}
 		} else if filter == "_doc_ids" {
 			if feed != "normal" && feed != "" {
 				return base.HTTPErrorf(http.StatusBadRequest, "Filter '_doc_ids' is only valid for feed=normal replications")
@@ -272,21 +293,44 @@ func (h *handler) handleChanges() error {
 			if len(docIdsArray) == 0 {
 				return base.HTTPErrorf(http.StatusBadRequest, "Empty doc_ids list")
 			}
+		} else if filterFn := h.db.GetOptions().ChangesFilters[filter]; filterFn != nil {
+			// A JS filter function from the database config, which gets the query params as req.query:
+			query := map[string]interface{}{}
+			for key, values := range h.rq.URL.Query() {
+				query[key] = values[0]
+			}
+			options.Filter = &db.ChangesFilter{Name: filter, Function: filterFn, Query: query}
 		} else {
-			return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel or _doc_ids")
+			return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel, _doc_ids or a filter from the database config")
 		}
 	}
 
+	// Closing the Terminator ends the feed; it's closed when the feed ends, or earlier if the feed
+	// has to make room for a newer one of the same user's:
+	options.Terminator = make(chan bool)
+	var terminateOnce sync.Once
+	terminate := func() {
+		terminateOnce.Do(func() { close(options.Terminator) })
+	}
+	feedEntry, err := h.registerChangesFeed(feed, options.Since.String(), terminate)
+	if err != nil {
+		return err
+	}
+	h.db.RecordChangesRequest(options.Since)
+	defer h.server.changesFeeds.remove(feedEntry)
+
 	h.db.ChangesClientStats.Increment()
 	defer h.db.ChangesClientStats.Decrement()
 
-	options.Terminator = make(chan bool)
-
-	var err error
 	forceClose := false
 
 	switch feed {
 	case "normal", "":
+		h.setRequestClass(bulkRequest)
+		// The database's row limit caps the client's:
+		if maxRows := h.db.GetOptions().MaxChangesRows; maxRows > 0 && (options.Limit <= 0 || options.Limit > maxRows) {
+			options.Limit = maxRows
+		}
 		if filter == "_doc_ids" {
 			err, forceClose = h.sendChangesForDocIds(userChannels, docIdsArray, options)
 		} else {
@@ -294,17 +338,20 @@ func (h *handler) handleChanges() error {
 		}
 	case "longpoll":
 		options.Wait = true
+		h.setFeed()
 		err, forceClose = h.sendSimpleChanges(userChannels, options)
 	case "continuous":
+		h.setFeed()
 		err, forceClose = h.sendContinuousChangesByHTTP(userChannels, options)
 	case "websocket":
+		h.setFeed()
 		err, forceClose = h.sendContinuousChangesByWebSocket(userChannels, options)
 	default:
 		err = base.HTTPErrorf(http.StatusBadRequest, "Unknown feed type")
 		forceClose = false
 	}
 
-	close(options.Terminator)
+	terminate()
 
 	if forceClose && h.user != nil {
 		h.db.DatabaseContext.NotifyUser(h.user.Name())
@@ -316,15 +363,26 @@ func (h *handler) handleChanges() error {
 func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions) (error, bool) {
 	lastSeq := options.Since
 	var first bool = true
+	rows := 0
+	cutOff := false // Set if the feed ends at a limit before reaching the latest change
 	feed, err := h.db.MultiChangesFeed(channels, options)
 	if err != nil {
 		return err, false
 	}
 
-	h.setHeader("Content-Type", "application/json")
-	h.setHeader("Cache-Control", "private, max-age=0, no-cache, no-store")
-	h.response.Write([]byte("{\"results\":[\r\n"))
+	// A one-shot feed's response is only started once it has a change to send, so that it can
+	// still fail if the request times out before then:
+	started := false
+	startResponse := func() {
+		if !started {
+			started = true
+			h.setHeader("Content-Type", "application/json")
+			h.setHeader("Cache-Control", "private, max-age=0, no-cache, no-store")
+			h.response.Write([]byte("{\"results\":[\r\n"))
+		}
+	}
 	if options.Wait {
+		startResponse()
 		h.flush()
 	}
 	message := "OK"
@@ -344,12 +402,26 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 			}
 		}
 
+		// A one-shot feed is cut off after the database's max duration, for the client to resume:
+		var timeLimit <-chan time.Time
+		if maxDuration := h.db.GetOptions().MaxChangesDuration; !options.Wait && maxDuration > 0 {
+			timer := time.NewTimer(maxDuration)
+			defer timer.Stop()
+			timeLimit = timer.C
+		}
+
+		// ...or when the request runs past its deadline:
+		var requestDone <-chan struct{}
+		if !options.Wait {
+			requestDone = h.requestDone()
+		}
+
 		var closeNotify <-chan bool
 		cn, ok := h.response.(http.CloseNotifier)
 		if ok {
 			closeNotify = cn.CloseNotify()
 		} else {
-			base.LogTo("Changes", "simple changes cannot get Close Notifier from ResponseWriter")
+			h.logContext.LogTo("Changes", "simple changes cannot get Close Notifier from ResponseWriter")
 		}
 
 		encoder := json.NewEncoder(h.response)
@@ -364,25 +436,40 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 					if entry.Err != nil {
 						break loop // error returned by feed - end changes
 					}
+					startResponse()
 					if first {
 						first = false
 					} else {
 						h.response.Write([]byte(","))
 					}
 					encoder.Encode(entry)
-					lastSeq = entry.Seq
+					lastSeq = lastSeq.AdvanceCheckpoint(entry.Seq)
+					rows++
 				}
 
 			case <-heartbeat:
 				_, err = h.response.Write([]byte("\n"))
 				h.flush()
-				base.LogTo("Heartbeat", "heartbeat written to _changes feed for request received %s", h.currentEffectiveUserName())
+				h.logContext.LogTo("Heartbeat", "heartbeat written to _changes feed for request received %s", h.currentEffectiveUserName())
 			case <-timeout:
 				message = "OK (timeout)"
 				forceClose = true
 				break loop
+			case <-timeLimit:
+				message = "OK (time limit)"
+				cutOff = true
+				forceClose = true
+				break loop
+			case <-requestDone:
+				if !started {
+					return h.cancellationError(), true
+				}
+				message = "OK (request timeout)"
+				cutOff = true
+				forceClose = true
+				break loop
 			case <-closeNotify:
-				base.LogTo("Changes", "Connection lost from client: %v", h.currentEffectiveUserName())
+				h.logContext.LogTo("Changes", "Connection lost from client: %v", h.currentEffectiveUserName())
 				forceClose = true
 				break loop
 			case <-h.db.ExitChanges:
@@ -397,7 +484,17 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 		}
 	}
 
-	s := fmt.Sprintf("],\n\"last_seq\":%q}\n", lastSeq.String())
+	if options.Limit > 0 && rows >= options.Limit {
+		cutOff = true
+	}
+	var s string
+	if cutOff && !options.Wait {
+		// Tell the client roughly how many changes are left, so it knows to get the next page:
+		s = fmt.Sprintf("],\n\"last_seq\":%q,\n\"pending\":%d}\n", lastSeq.String(), h.db.EstimatePendingChanges(lastSeq))
+	} else {
+		s = fmt.Sprintf("],\n\"last_seq\":%q}\n", lastSeq.String())
+	}
+	startResponse()
 	h.response.Write([]byte(s))
 	h.logStatus(http.StatusOK, message)
 	return nil, forceClose
@@ -421,7 +518,7 @@ func (h *handler) sendChangesForDocIds(userChannels base.Set, explicitDocIds []s
 		// Fetch the document body and other metadata that lives with it:
 		populatedDoc, body, err := h.db.GetDocAndActiveRev(doc.DocID)
 		if err != nil {
-			base.LogTo("Changes", "Unable to get changes for docID %v, caused by %v", doc.DocID, err)
+			h.logContext.LogTo("Changes", "Unable to get changes for docID %v, caused by %v", doc.DocID, err)
 			return nil
 		}
 
@@ -447,7 +544,10 @@ func (h *handler) sendChangesForDocIds(userChannels base.Set, explicitDocIds []s
 
 		userCanSeeDocChannel := false
 
-		if h.user == nil || h.user.Channels().Contains(ch.UserStarChannel) {
+		// Users only see the removals of docs in no channels, including from "*":
+		removal, inNoChannels := populatedDoc.Channels[ch.NoChannels]
+		inNoChannels = inNoChannels && removal == nil
+		if h.user == nil || (!inNoChannels && h.user.Channels().Contains(ch.UserStarChannel)) {
 			userCanSeeDocChannel = true
 		} else if len(populatedDoc.Channels) > 0 {
 			//Do special _removed/_deleted processing
@@ -534,6 +634,12 @@ func (h *handler) generateContinuousChanges(inChannels base.Set, options db.Chan
 // Shell of the continuous changes feed -- calls out to a `send` function to deliver the change.
 // This is called from BLIP connections as well as HTTP handlers, which is why this is not a
 // method on `handler`. (In the BLIP case the `h` parameter will be nil.)
+//
+// The changes are sent by a separate goroutine, from a buffer of at most database.ChangesBuffer()
+// entries, so that a client that isn't reading can't make the feed buffer changes without limit.
+// If the buffer overflows, the feed is stopped, remembering only the last sequence buffered; once
+// the client has caught up, a new feed starts from that sequence, which backfills the changes
+// that didn't fit.
 func generateContinuousChanges(database *db.Database, inChannels base.Set, options db.ChangesOptions, h *handler, send func([]*db.ChangeEntry) error) (error, bool) {
 	// Set up heartbeat/timeout
 	var timeoutInterval time.Duration
@@ -554,11 +660,21 @@ func generateContinuousChanges(database *db.Database, inChannels base.Set, optio
 
 	options.Wait = true       // we want the feed channel to wait for changes
 	options.Continuous = true // and to keep sending changes indefinitely
-	var lastSeq db.SequenceID
+	lastSeq := options.Since
 	var feed <-chan *db.ChangeEntry
+	var feedTerminator chan bool // Closed to stop the current feed, without ending the response
 	var timeout <-chan time.Time
 	var err error
 
+	stopFeed := func() {
+		if feedTerminator != nil {
+			close(feedTerminator)
+			feedTerminator = nil
+		}
+		feed = nil
+	}
+	defer stopFeed()
+
 	var closeNotify <-chan bool
 	if h != nil {
 		cn, ok := h.response.(http.CloseNotifier)
@@ -569,22 +685,80 @@ func generateContinuousChanges(database *db.Database, inChannels base.Set, optio
 		}
 	}
 
+	// The sender: a nil entry in the buffer means the feed is caught up and waiting
+	buffer := make(chan *db.ChangeEntry, database.ChangesBuffer())
+	drained := make(chan struct{}, 1)   // Signaled when the sender has emptied the buffer
+	sendErrors := make(chan error, 1)   // Gets the error that stopped the sender
+	abortSending := make(chan struct{}) // Closed to make the sender stop without emptying the buffer
+	senderDone := make(chan struct{})
+	go func() {
+		defer close(senderDone)
+		for entry := range buffer {
+			select {
+			case <-abortSending:
+				return
+			default:
+			}
+			var err error
+			if entry == nil {
+				err = send(nil)
+			} else {
+				entries := []*db.ChangeEntry{entry}
+				waiting := false
+				// Batch up as many entries as we can without waiting:
+			collect:
+				for len(entries) < 20 {
+					select {
+					case entry, ok := <-buffer:
+						if !ok {
+							break collect
+						} else if entry == nil {
+							waiting = true
+							break collect
+						}
+						entries = append(entries, entry)
+					default:
+						break collect
+					}
+				}
+				base.LogTo("Changes", "sending %d change(s)", len(entries))
+				err = send(entries)
+				if err == nil && waiting {
+					err = send(nil)
+				}
+			}
+			if err != nil {
+				sendErrors <- err
+				return
+			}
+			if len(buffer) == 0 {
+				select {
+				case drained <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	overflowed := false // The buffer overflowed, and the client hasn't caught up yet
 	forceClose := false
+	drain := false // Whether to send the changes still in the buffer before returning
 
 loop:
 	for {
-		if feed == nil {
+		if feed == nil && !overflowed {
 			// Refresh the feed of all current changes:
-			if lastSeq.IsNonZero() { // start after end of last feed
-				options.Since = lastSeq
-			}
+			options.Since = lastSeq // start after end of last feed
 			if database.IsClosed() {
 				forceClose = true
 				break loop
 			}
-			feed, err = database.MultiChangesFeed(inChannels, options)
+			feedOptions := options
+			feedTerminator = make(chan bool)
+			feedOptions.Terminator = feedTerminator
+			feed, err = database.MultiChangesFeed(inChannels, feedOptions)
 			if err != nil || feed == nil {
-				return err, forceClose
+				break loop
 			}
 		}
 
@@ -598,56 +772,49 @@ loop:
 		select {
 		case entry, ok := <-feed:
 			if !ok {
-				feed = nil
+				stopFeed()
 			} else if entry == nil {
-				err = send(nil)
+				select {
+				case buffer <- nil:
+				default: // The client has plenty to read already
+				}
 			} else if entry.Err != nil {
 				break loop // error returned by feed - end changes
 			} else {
-				entries := []*db.ChangeEntry{entry}
-				waiting := false
-				// Batch up as many entries as we can without waiting:
-			collect:
-				for len(entries) < 20 {
-					select {
-					case entry, ok = <-feed:
-						if !ok {
-							feed = nil
-							break collect
-						} else if entry == nil {
-							waiting = true
-							break collect
-						} else if entry.Err != nil {
-							break loop // error returned by feed - end changes
-						}
-						entries = append(entries, entry)
-					default:
-						break collect
-					}
+				select {
+				case buffer <- entry:
+				default:
+					// The client isn't keeping up; stop buffering until it's read what's buffered
+					base.LogTo("Changes", "Continuous feed buffer is full; pausing the feed after %s", lastSeq)
+					base.StatsExpvars.Add("changesFeeds_overflowed", 1)
+					overflowed = true
+					stopFeed()
+					continue loop
 				}
-				base.LogTo("Changes", "sending %d change(s)", len(entries))
-				err = send(entries)
-
-				if err == nil && waiting {
-					err = send(nil)
-				}
-
-				lastSeq = entries[len(entries)-1].Seq
+				lastSeq = lastSeq.AdvanceCheckpoint(entry.Seq)
 				if options.Limit > 0 {
-					if len(entries) >= options.Limit {
-						forceClose = true
+					if options.Limit--; options.Limit == 0 {
+						forceClose, drain = true, true
 						break loop
 					}
-					options.Limit -= len(entries)
+				}
+				// Reset the timeout after sending an entry:
+				if timer != nil {
+					timer.Stop()
+					timer = nil
 				}
 			}
-			// Reset the timeout after sending an entry:
-			if timer != nil {
-				timer.Stop()
-				timer = nil
+		case <-drained:
+			if overflowed && len(buffer) == 0 {
+				base.LogTo("Changes", "Client of continuous feed has caught up; resuming the feed after %s", lastSeq)
+				overflowed = false
 			}
+		case err = <-sendErrors:
 		case <-heartbeat:
-			err = send(nil)
+			select {
+			case buffer <- nil:
+			default: // The client has plenty to read already
+			}
 			if h != nil {
 				base.LogTo("Heartbeat", "heartbeat written to _changes feed for request received %s", h.currentEffectiveUserName())
 			}
@@ -659,6 +826,16 @@ loop:
 			forceClose = true
 			break loop
 		case <-database.ExitChanges:
+			// a final heartbeat before closing the feed
+			close(buffer)
+			close(abortSending)
+			<-senderDone
+			forceClose = true
+			if err = send(nil); err != nil && h != nil {
+				h.logStatus(http.StatusOK, fmt.Sprintf("Write error: %v", err))
+			}
+			return nil, forceClose
+		case <-options.Terminator:
 			forceClose = true
 			break loop
 		}
@@ -667,11 +844,17 @@ loop:
 			if h != nil {
 				h.logStatus(http.StatusOK, fmt.Sprintf("Write error: %v", err))
 			}
-			return nil, forceClose // error is probably because the client closed the connection
+			err = nil // error is probably because the client closed the connection
+			break loop
 		}
 	}
-	
-	return nil, forceClose
+
+	close(buffer)
+	if !drain {
+		close(abortSending)
+	}
+	<-senderDone
+	return err, forceClose
 }
 
 func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.ChangesOptions) (error, bool) {
@@ -680,11 +863,19 @@ func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.Ch
 	// receiving the response.
 	h.setHeader("Content-Type", "application/octet-stream")
 	h.setHeader("Cache-Control", "private, max-age=0, no-cache, no-store")
+	// When the feed ends, the checkpoint to resume from is sent in a trailer, since the body
+	// only contains change entries:
+	h.setHeader("Trailer", "X-Last-Seq")
 	h.logStatus(http.StatusOK, "sending continuous feed")
+	lastSeq := options.Since
+	defer func() {
+		h.setHeader("X-Last-Seq", lastSeq.String())
+	}()
 	return h.generateContinuousChanges(inChannels, options, func(changes []*db.ChangeEntry) error {
 		var err error
 		if changes != nil {
 			for _, change := range changes {
+				lastSeq = lastSeq.AdvanceCheckpoint(change.Seq)
 				data, _ := json.Marshal(change)
 				if _, err = h.response.Write(data); err != nil {
 					break
@@ -708,7 +899,7 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 		h.logStatus(101, "Upgraded to WebSocket protocol")
 		defer func() {
 			conn.Close()
-			base.LogTo("HTTP+", "#%03d:     --> WebSocket closed", h.serialNumber)
+			h.logContext.LogTo("HTTP+", "#%03d:     --> WebSocket closed", h.serialNumber)
 		}()
 
 		// Read changes-feed options from an initial incoming WebSocket message in JSON format:
@@ -723,7 +914,10 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 				return
 			}
 			if channelNames != nil {
-				inChannels, _ = ch.SetFromArray(channelNames, ch.ExpandStar)
+				if inChannels, err = ch.SetFromArray(channelNames, ch.ExpandStar); err != nil {
+					h.logContext.LogTo("Changes", "Invalid channels in websocket changes request: %v", err)
+					return
+				}
 			}
 		}
 
@@ -791,6 +985,8 @@ func (h *handler) readChangesOptionsFromJSON(jsonData []byte) (feed string, opti
 		TimeoutMs      *uint64       `json:"timeout"`
 		AcceptEncoding string        `json:"accept_encoding"`
 		ActiveOnly     bool          `json:"active_only"` // Return active revisions only
+		Revocations    bool          `json:"revocations"` // Send removals for revoked channels
+		SyncFnEpoch    bool          `json:"sync_fn_epoch"`
 	}
 	// Initialize since clock and hasher ahead of unmarshalling sequence
 	if h.db != nil && h.db.SequenceType == db.ClockSequenceType {
@@ -807,6 +1003,8 @@ func (h *handler) readChangesOptionsFromJSON(jsonData []byte) (feed string, opti
 
 	options.Conflicts = input.Style == "all_docs"
 	options.ActiveOnly = input.ActiveOnly
+	options.Revocations = input.Revocations
+	options.SyncFnEpoch = input.SyncFnEpoch
 
 	options.IncludeDocs = input.IncludeDocs
 	filter = input.Filter
@@ -11,6 +11,7 @@ package rest
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"log"
 	"strings"
@@ -612,6 +613,92 @@ func TestChangesLoopingWhenLowSequence(t *testing.T) {
 
 }
 
+func TestContinuousChangesLastSeqTrailer(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc) {channel(doc.channel)}`}
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"channel":"PBS"}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"channel":"PBS"}`), 201)
+
+	response := rt.SendAdminRequest("GET", "/db/_changes?feed=continuous&since=0&timeout=100", "")
+	assertStatus(t, response, 200)
+	changes, err := readContinuousChanges(response)
+	assertNoError(t, err, "Couldn't read continuous changes")
+	assert.Equals(t, len(changes), 2)
+	assert.Equals(t, response.Header().Get("Trailer"), "X-Last-Seq")
+	lastSeq := response.Header().Get("X-Last-Seq")
+	assert.Equals(t, lastSeq, changes[1].Seq.String())
+
+	// Resuming from the trailer's checkpoint doesn't resend anything:
+	response = rt.SendAdminRequest("GET", "/db/_changes?feed=continuous&timeout=100&since="+lastSeq, "")
+	changes, err = readContinuousChanges(response)
+	assertNoError(t, err, "Couldn't read continuous changes")
+	assert.Equals(t, len(changes), 0)
+	assert.Equals(t, response.Header().Get("X-Last-Seq"), lastSeq)
+}
+
+// A client that doesn't read its continuous feed makes the feed stop buffering, then resume where
+// it stopped once the client catches up, without missing or repeating changes.
+func TestContinuousChangesBufferOverflow(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	const numDocs = 50
+	for i := 1; i <= numDocs; i++ {
+		assertStatus(t, rt.SendAdminRequest("PUT", fmt.Sprintf("/db/doc%d", i), `{}`), 201)
+	}
+	assertNoError(t, rt.WaitForPendingChanges(), "WaitForPendingChanges")
+	rt.GetDatabase().Options.ChangesBuffer = 2
+	database, err := db.CreateDatabase(rt.GetDatabase())
+	assertNoError(t, err, "CreateDatabase")
+
+	overflows := func() int64 {
+		if count, ok := base.StatsExpvars.Get("changesFeeds_overflowed").(*expvar.Int); ok {
+			return count.Value()
+		}
+		return 0
+	}
+	initialOverflows := overflows()
+
+	release := make(chan struct{})
+	allReceived := make(chan struct{})
+	var received []string
+	options := db.ChangesOptions{Terminator: make(chan bool)}
+	feedDone := make(chan struct{})
+	go func() {
+		defer close(feedDone)
+		generateContinuousChanges(database, base.SetOf("*"), options, nil, func(entries []*db.ChangeEntry) error {
+			<-release // The client doesn't read anything until it's released
+			for _, entry := range entries {
+				received = append(received, entry.ID)
+			}
+			if len(received) == numDocs {
+				close(allReceived)
+			}
+			return nil
+		})
+	}()
+
+	for start := time.Now(); overflows() == initialOverflows; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("The feed's buffer didn't overflow")
+		}
+	}
+	close(release)
+	select {
+	case <-allReceived:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("The feed didn't resume")
+	}
+	close(options.Terminator)
+	<-feedDone
+
+	assert.Equals(t, len(received), numDocs)
+	for i, docID := range received {
+		assert.Equals(t, docID, fmt.Sprintf("doc%d", i+1))
+	}
+}
+
 func TestUnusedSequences(t *testing.T) {
 
 	// Only do 10 iterations if running against walrus.  If against a live couchbase server,
@@ -974,6 +1061,94 @@ func TestOneShotChangesWithExplicitDocIds(t *testing.T) {
 
 }
 
+func TestChangesFilterFunction(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc) {channel(doc.channels)}`}
+	defer rt.Close()
+	rt.ServerContext().Database("db").Options.ChangesFilters = map[string]*channels.ChangesFilterFunction{
+		"app/by_type": channels.NewChangesFilterFunction(`function(doc, req) {
+			if (doc.boom) throw("boom");
+			return doc.type == req.query.type;
+		}`, channels.DefaultSyncFnTimeout),
+	}
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/user1", `{"password":"letmein", "admin_channels":["alpha"]}`), 201)
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc1", `{"channels":["alpha"], "type":"task"}`), 201)
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc2", `{"channels":["alpha"], "type":"note"}`), 201)
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc3", `{"channels":["beta"], "type":"task"}`), 201)
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc4", `{"channels":["alpha"], "type":"task", "boom":true}`), 201)
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc5", `{"channels":["alpha"], "type":"task"}`), 201)
+	rt.WaitForPendingChanges()
+
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	// doc2 doesn't pass the filter, the user can't see doc3, and the filter throws on doc4:
+	response := rt.Send(requestByUser("GET", "/db/_changes?filter=app/by_type&type=task&include_docs=true", "", "user1"))
+	assertStatus(t, response, 200)
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &changes), "Unmarshal")
+	assert.Equals(t, len(changes.Results), 3)
+	assert.Equals(t, changes.Results[0].ID, "_user/user1")
+	assert.Equals(t, changes.Results[1].ID, "doc1")
+	assert.Equals(t, changes.Results[1].Doc["type"], "task")
+	assert.Equals(t, changes.Results[2].ID, "doc5")
+
+	// The limit counts entries that pass the filter:
+	response = rt.Send(requestByUser("GET", "/db/_changes?filter=app/by_type&type=note&limit=2", "", "user1"))
+	assertStatus(t, response, 200)
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &changes), "Unmarshal")
+	assert.Equals(t, len(changes.Results), 2)
+	assert.Equals(t, changes.Results[1].ID, "doc2")
+	assert.True(t, changes.Results[1].Doc == nil)
+
+	assertStatus(t, rt.Send(requestByUser("GET", "/db/_changes?filter=app/missing", "", "user1")), 400)
+}
+
+func TestOneShotChangesLimits(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	for i := 1; i <= 5; i++ {
+		assertStatus(t, rt.SendRequest("PUT", fmt.Sprintf("/db/doc%d", i), `{"channels":["alpha"]}`), 201)
+	}
+	rt.WaitForPendingChanges()
+	rt.GetDatabase().Options.MaxChangesRows = 2
+
+	getChanges := func(query string) (results []db.ChangeEntry, lastSeq string, pending *uint64) {
+		var changes struct {
+			Results []db.ChangeEntry
+			LastSeq string  `json:"last_seq"`
+			Pending *uint64 `json:"pending"`
+		}
+		response := rt.SendAdminRequest("GET", "/db/_changes"+query, "")
+		assertStatus(t, response, 200)
+		assertNoError(t, json.Unmarshal(response.Body.Bytes(), &changes), "Unmarshal")
+		return changes.Results, changes.LastSeq, changes.Pending
+	}
+
+	// The database's limit cuts the feed off, and the response estimates what's left:
+	results, lastSeq, pending := getChanges("")
+	assert.Equals(t, len(results), 2)
+	assert.Equals(t, lastSeq, results[1].Seq.String())
+	assert.True(t, pending != nil && *pending == 3)
+
+	// A client can lower the limit, but not raise it:
+	results, _, pending = getChanges("?limit=1")
+	assert.Equals(t, len(results), 1)
+	assert.True(t, pending != nil && *pending == 4)
+	results, _, _ = getChanges("?limit=10")
+	assert.Equals(t, len(results), 2)
+
+	// Paginating from last_seq gets the rest; the last page isn't cut off:
+	results, lastSeq, pending = getChanges("?since=" + lastSeq)
+	assert.Equals(t, len(results), 2)
+	assert.Equals(t, results[0].ID, "doc3")
+	assert.True(t, pending != nil && *pending == 1)
+	results, lastSeq, pending = getChanges("?since=" + lastSeq)
+	assert.Equals(t, len(results), 1)
+	assert.Equals(t, results[0].ID, "doc5")
+	assert.Equals(t, lastSeq, results[0].Seq.String())
+	assert.True(t, pending == nil)
+}
+
 // Test _changes with channel filter
 func changesActiveOnly(t *testing.T, it indexTester) {
 
@@ -0,0 +1,170 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// What happens when a user already has the max number of _changes feeds open
+const (
+	ChangesFeedLimitReject      = "reject"       // The new feed fails with a 429
+	ChangesFeedLimitCloseOldest = "close_oldest" // The user's oldest feed is closed to make room
+)
+
+// Limits on concurrent _changes feeds.  The admin API isn't limited.
+type ChangesFeedLimitConfig struct {
+	MaxPerUser *int   `json:"max_per_user,omitempty"` // Max feeds per user, or per IP address for the guest user; 0 for no limit
+	Policy     string `json:"policy,omitempty"`       // "reject" (the default) or "close_oldest"
+}
+
+func (config *ChangesFeedLimitConfig) validate() error {
+	switch config.Policy {
+	case "", ChangesFeedLimitReject, ChangesFeedLimitCloseOldest:
+		return nil
+	default:
+		return fmt.Errorf("Invalid changes_feed_limit policy %q; must be %q or %q", config.Policy, ChangesFeedLimitReject, ChangesFeedLimitCloseOldest)
+	}
+}
+
+// A _changes feed in progress.
+type activeChangesFeed struct {
+	ID       uint64    `json:"id"`
+	Database string    `json:"db"`
+	User     string    `json:"user,omitempty"` // Empty for the guest user or the admin API
+	Address  string    `json:"address"`
+	Feed     string    `json:"feed"`
+	Since    string    `json:"since"`
+	Started  time.Time `json:"started"`
+	AgeSecs  float64   `json:"age_secs"`
+	key      string    // Key the per-user limit is applied to; empty for the admin API
+	stop     func()    // Makes the feed end
+}
+
+// Keeps track of the _changes feeds in progress, and enforces the per-user limit on them.
+type changesFeedRegistry struct {
+	lock   sync.Mutex
+	config ChangesFeedLimitConfig
+	lastID uint64
+	feeds  map[uint64]*activeChangesFeed
+}
+
+func newChangesFeedRegistry(config *ChangesFeedLimitConfig) *changesFeedRegistry {
+	registry := &changesFeedRegistry{feeds: map[uint64]*activeChangesFeed{}}
+	if config != nil {
+		registry.config = *config
+	}
+	return registry
+}
+
+// Registers a new feed, if the limit allows it.  If the user is at the limit, either returns a 429
+// error, or stops the user's oldest feed, depending on the policy.
+func (r *changesFeedRegistry) add(feed *activeChangesFeed) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if max := r.maxPerUser(); max > 0 && feed.key != "" {
+		var userFeeds []*activeChangesFeed
+		for _, f := range r.feeds {
+			if f.key == feed.key {
+				userFeeds = append(userFeeds, f)
+			}
+		}
+		if len(userFeeds) >= max {
+			if r.config.Policy != ChangesFeedLimitCloseOldest {
+				base.StatsExpvars.Add("changesFeeds_rejected", 1)
+				return base.HTTPErrorf(http.StatusTooManyRequests, "Too many concurrent _changes feeds")
+			}
+			sort.Sort(changesFeedsByAge(userFeeds))
+			for _, oldest := range userFeeds[:len(userFeeds)-max+1] {
+				base.LogTo("Changes", "Closing _changes feed #%d to make room for a new one (%s)", oldest.ID, feed.key)
+				base.StatsExpvars.Add("changesFeeds_evicted", 1)
+				delete(r.feeds, oldest.ID)
+				oldest.stop()
+			}
+		}
+	}
+	r.lastID++
+	feed.ID = r.lastID
+	feed.Started = time.Now()
+	r.feeds[feed.ID] = feed
+	return nil
+}
+
+// Unregisters a feed that's ended.
+func (r *changesFeedRegistry) remove(feed *activeChangesFeed) {
+	r.lock.Lock()
+	delete(r.feeds, feed.ID)
+	r.lock.Unlock()
+}
+
+// Returns copies of the feeds in progress, oldest first.
+func (r *changesFeedRegistry) list() []activeChangesFeed {
+	r.lock.Lock()
+	feeds := make([]*activeChangesFeed, 0, len(r.feeds))
+	for _, feed := range r.feeds {
+		feeds = append(feeds, feed)
+	}
+	r.lock.Unlock()
+	sort.Sort(changesFeedsByAge(feeds))
+	result := make([]activeChangesFeed, len(feeds))
+	for i, feed := range feeds {
+		result[i] = *feed
+		result[i].AgeSecs = time.Since(feed.Started).Seconds()
+	}
+	return result
+}
+
+func (r *changesFeedRegistry) maxPerUser() int {
+	if r.config.MaxPerUser != nil {
+		return *r.config.MaxPerUser
+	}
+	return 0
+}
+
+type changesFeedsByAge []*activeChangesFeed
+
+func (feeds changesFeedsByAge) Len() int           { return len(feeds) }
+func (feeds changesFeedsByAge) Less(i, j int) bool { return feeds[i].ID < feeds[j].ID }
+func (feeds changesFeedsByAge) Swap(i, j int)      { feeds[i], feeds[j] = feeds[j], feeds[i] }
+
+// Registers the handler's _changes feed with the server, applying the per-user limit.  `stop`
+// will be called if the feed has to be closed to make room for a newer one.
+func (h *handler) registerChangesFeed(feed string, since string, stop func()) (*activeChangesFeed, error) {
+	entry := &activeChangesFeed{
+		Database: h.db.Name,
+		Address:  h.clientAddress(),
+		Feed:     feed,
+		Since:    since,
+		stop:     stop,
+	}
+	if h.user != nil {
+		if entry.User = h.user.Name(); entry.User != "" {
+			entry.key = h.db.Name + "/" + entry.User
+		} else {
+			entry.key = h.db.Name + "/guest@" + entry.Address
+		}
+	}
+	if err := h.server.changesFeeds.add(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// HTTP handler for GET /_changes_feeds: lists the _changes feeds in progress, oldest first.
+func (h *handler) handleGetChangesFeeds() error {
+	h.writeJSON(h.server.changesFeeds.list())
+	return nil
+}
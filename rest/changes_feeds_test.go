@@ -0,0 +1,91 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Starts a longpoll _changes feed by a user in the background, and waits until it's registered.
+func startLongpollFeed(t *testing.T, rt *RestTester, username string, expectedFeeds int) chan *TestResponse {
+	done := make(chan *TestResponse, 1)
+	go func() {
+		done <- rt.Send(requestByUser("GET", "/db/_changes?feed=longpoll&since=999999&timeout=30000", "", username))
+	}()
+	for i := 0; i < 100 && len(rt.ServerContext().changesFeeds.list()) < expectedFeeds; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equals(t, len(rt.ServerContext().changesFeeds.list()), expectedFeeds)
+	return done
+}
+
+func TestChangesFeedLimitReject(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	max := 1
+	rt.ServerContext().changesFeeds = newChangesFeedRegistry(&ChangesFeedLimitConfig{MaxPerUser: &max})
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+
+	done := startLongpollFeed(t, &rt, "bernard", 1)
+
+	// A second feed by the same user is rejected:
+	response := rt.Send(requestByUser("GET", "/db/_changes?feed=longpoll&since=999999&timeout=30000", "", "bernard"))
+	assertStatus(t, response, 429)
+
+	// The admin API lists the feed:
+	response = rt.SendAdminRequest("GET", "/_changes_feeds", "")
+	assertStatus(t, response, 200)
+	var feeds []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &feeds)
+	assert.Equals(t, len(feeds), 1)
+	assert.Equals(t, feeds[0]["user"], "bernard")
+	assert.Equals(t, feeds[0]["feed"], "longpoll")
+	assert.Equals(t, feeds[0]["since"], "999999")
+
+	// End the feed; then it's unregistered:
+	rt.ServerContext().changesFeeds.list()[0].stop()
+	select {
+	case response = <-done:
+		assertStatus(t, response, 200)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Feed didn't end")
+	}
+	assert.Equals(t, len(rt.ServerContext().changesFeeds.list()), 0)
+}
+
+func TestChangesFeedLimitCloseOldest(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	max := 1
+	rt.ServerContext().changesFeeds = newChangesFeedRegistry(&ChangesFeedLimitConfig{MaxPerUser: &max, Policy: ChangesFeedLimitCloseOldest})
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+
+	oldest := startLongpollFeed(t, &rt, "bernard", 1)
+	firstID := rt.ServerContext().changesFeeds.list()[0].ID
+
+	// A second feed closes the first one:
+	newest := startLongpollFeed(t, &rt, "bernard", 1)
+	select {
+	case response := <-oldest:
+		assertStatus(t, response, 200)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Oldest feed wasn't closed")
+	}
+	feeds := rt.ServerContext().changesFeeds.list()
+	assert.Equals(t, len(feeds), 1)
+	assert.True(t, feeds[0].ID != firstID)
+
+	feeds[0].stop()
+	<-newest
+}
@@ -0,0 +1,118 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The addresses of the proxies (like load balancers) in front of the gateway, whose
+// X-Forwarded-For and Forwarded headers are trusted to report the client's address.
+type trustedProxies []*net.IPNet
+
+// Parses the trusted_proxies config: CIDRs, or single IP addresses.
+func parseTrustedProxies(specs []string) (trustedProxies, error) {
+	proxies := make(trustedProxies, 0, len(specs))
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted_proxies address %q", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted_proxies CIDR %q", spec)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+func (proxies trustedProxies) contains(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range proxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the IP address of the client making a request.  That's the remote address, unless it's
+// a trusted proxy: then it's the rightmost address in X-Forwarded-For (or else Forwarded) that
+// isn't a trusted proxy, since proxies append the address they received the request from, and
+// anything to the left of an untrusted hop could have been made up by the client.
+func (proxies trustedProxies) clientAddress(rq *http.Request) string {
+	address := rq.RemoteAddr
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	if !proxies.contains(address) {
+		return address
+	}
+
+	hops := forwardedForHops(rq.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break // Obfuscated or garbled; the last proxy is as close to the client as we can tell
+		}
+		address = hops[i]
+		if !proxies.contains(address) {
+			break
+		}
+	}
+	return address
+}
+
+// Returns the addresses a request was forwarded for, client first, from its X-Forwarded-For
+// headers, or else its Forwarded headers (RFC 7239.)  Ports and IPv6 brackets are removed.
+func forwardedForHops(header http.Header) []string {
+	var hops []string
+	if values := header["X-Forwarded-For"]; len(values) > 0 {
+		for _, value := range values {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, stripHopPort(strings.TrimSpace(hop)))
+			}
+		}
+		return hops
+	}
+	for _, value := range header["Forwarded"] {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					hops = append(hops, stripHopPort(strings.Trim(pair[4:], `"`)))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// Removes the port (and brackets) from a forwarded address like "[2001:db8::1]:4711" or "1.2.3.4:80".
+func stripHopPort(hop string) string {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+}
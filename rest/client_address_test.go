@@ -0,0 +1,65 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	assertNoError(t, err, "parseTrustedProxies")
+	assert.True(t, proxies.contains("10.20.30.40"))
+	assert.True(t, proxies.contains("192.168.1.1"))
+	assert.False(t, proxies.contains("192.168.1.2"))
+	assert.True(t, proxies.contains("fd12::1"))
+	assert.False(t, proxies.contains("not-an-ip"))
+
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.True(t, err != nil)
+	_, err = parseTrustedProxies([]string{"lb.example.com"})
+	assert.True(t, err != nil)
+}
+
+func TestClientAddress(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	assertNoError(t, err, "parseTrustedProxies")
+
+	tests := []struct {
+		remoteAddr string
+		header     http.Header
+		expected   string
+	}{
+		// Not from a proxy; the headers are ignored:
+		{"1.2.3.4:5000", nil, "1.2.3.4"},
+		{"1.2.3.4:5000", http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "1.2.3.4"},
+		// From a proxy:
+		{"10.0.0.1:5000", nil, "10.0.0.1"},
+		{"10.0.0.1:5000", http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "5.6.7.8"},
+		{"10.0.0.1:5000", http.Header{"X-Forwarded-For": {"9.9.9.9, 5.6.7.8, 10.0.0.2"}}, "5.6.7.8"},
+		{"10.0.0.1:5000", http.Header{"X-Forwarded-For": {"9.9.9.9, 5.6.7.8", "10.0.0.2"}}, "5.6.7.8"},
+		{"10.0.0.1:5000", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"10.0.0.1:5000", http.Header{"X-Forwarded-For": {"garbage, 10.0.0.2"}}, "10.0.0.2"},
+		{"10.0.0.1:5000", http.Header{"Forwarded": {`for=192.0.2.60;proto=http, for="[2001:db8::1]:4711"`}}, "2001:db8::1"},
+		{"10.0.0.1:5000", http.Header{"Forwarded": {"for=192.0.2.60;proto=http;by=203.0.113.43"}}, "192.0.2.60"},
+		{"10.0.0.1:5000", http.Header{"Forwarded": {"for=_hidden"}}, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		rq := &http.Request{RemoteAddr: test.remoteAddr, Header: test.header}
+		assert.Equals(t, proxies.clientAddress(rq), test.expected)
+	}
+
+	// With no trusted proxies, it's always the remote address:
+	rq := &http.Request{RemoteAddr: "10.0.0.1:5000", Header: http.Header{"X-Forwarded-For": {"5.6.7.8"}}}
+	assert.Equals(t, trustedProxies(nil).clientAddress(rq), "10.0.0.1")
+}
@@ -0,0 +1,189 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+)
+
+const (
+	ClientCertUsernameFromCN     = "cn"      // The username is the subject's common name
+	ClientCertUsernameFromSANURI = "san_uri" // The username is a subject alternative name URI, minus a prefix
+
+	kClientCertUsernameVariable = "$username" // Replaced by the username in user_channels
+)
+
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// Authentication of public API requests by TLS client certificate.  Requires SSLCert and SSLKey,
+// since the certificate is presented during the TLS handshake.
+type ClientCertAuthConfig struct {
+	CAFile            string   `json:"ca_file"`                       // PEM file of the CA certs client certs must be issued by
+	UsernameFrom      string   `json:"username_from,omitempty"`       // "cn" (the default) or "san_uri"
+	SANURIPrefix      string   `json:"san_uri_prefix,omitempty"`      // With "san_uri", only URIs with this prefix map to a username; the prefix is removed
+	RequireClientCert bool     `json:"require_client_cert,omitempty"` // If true, requests without a valid client cert fail with a 401 instead of trying other auth
+	AutoCreateUsers   bool     `json:"auto_create_users,omitempty"`   // If true, a user that doesn't exist yet is created
+	UserChannels      []string `json:"user_channels,omitempty"`       // Channels of auto-created users; "$username" is replaced by the username
+	roots             *x509.CertPool
+}
+
+func (config *ClientCertAuthConfig) validate() error {
+	switch config.UsernameFrom {
+	case "", ClientCertUsernameFromCN, ClientCertUsernameFromSANURI:
+	default:
+		return fmt.Errorf("Invalid client_cert_auth username_from %q; must be %q or %q", config.UsernameFrom, ClientCertUsernameFromCN, ClientCertUsernameFromSANURI)
+	}
+	if config.CAFile == "" {
+		return errors.New("client_cert_auth requires a ca_file")
+	}
+	pemCerts, err := ioutil.ReadFile(config.CAFile)
+	if err != nil {
+		return fmt.Errorf("Unable to read client_cert_auth ca_file: %v", err)
+	}
+	config.roots = x509.NewCertPool()
+	if !config.roots.AppendCertsFromPEM(pemCerts) {
+		return fmt.Errorf("No certificates found in client_cert_auth ca_file %q", config.CAFile)
+	}
+	return nil
+}
+
+// Verifies the client cert of a TLS connection against the CA bundle, and returns the username it
+// maps to.  Returns "" with no error if the client didn't present a cert.
+func (config *ClientCertAuthConfig) usernameForConnection(state *tls.ConnectionState) (string, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return "", nil
+	}
+	cert := state.PeerCertificates[0]
+	options := x509.VerifyOptions{
+		Roots:         config.roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, intermediate := range state.PeerCertificates[1:] {
+		options.Intermediates.AddCert(intermediate)
+	}
+	if _, err := cert.Verify(options); err != nil {
+		return "", err
+	}
+	return config.usernameForCert(cert)
+}
+
+// Maps a (verified) client cert to a username, according to the username_from rule.
+func (config *ClientCertAuthConfig) usernameForCert(cert *x509.Certificate) (string, error) {
+	if config.UsernameFrom == ClientCertUsernameFromSANURI {
+		uris, err := subjectAltNameURIs(cert)
+		if err != nil {
+			return "", err
+		}
+		for _, uri := range uris {
+			if strings.HasPrefix(uri, config.SANURIPrefix) && len(uri) > len(config.SANURIPrefix) {
+				return uri[len(config.SANURIPrefix):], nil
+			}
+		}
+		return "", errors.New("Client cert has no matching subject alternative name URI")
+	}
+	if cert.Subject.CommonName == "" {
+		return "", errors.New("Client cert has no subject common name")
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// Returns the URIs in a cert's subject alternative name extension.
+func subjectAltNameURIs(cert *x509.Certificate) ([]string, error) {
+	var uris []string
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var seq asn1.RawValue
+		if rest, err := asn1.Unmarshal(ext.Value, &seq); err != nil {
+			return nil, err
+		} else if len(rest) != 0 {
+			return nil, errors.New("Trailing data after subject alternative name extension")
+		}
+		rest := seq.Bytes
+		for len(rest) > 0 {
+			var name asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+				return nil, err
+			}
+			if name.Class == asn1.ClassContextSpecific && name.Tag == 6 { // uniformResourceIdentifier
+				uris = append(uris, string(name.Bytes))
+			}
+		}
+	}
+	return uris, nil
+}
+
+// Authenticates a request by its TLS client cert, if any.  Returns a nil user and no error if the
+// request didn't present a cert (or presented one that doesn't verify) and other auth methods may
+// be tried instead.
+func (config *ClientCertAuthConfig) authenticate(authenticator *auth.Authenticator, state *tls.ConnectionState) (auth.User, error) {
+	username, err := config.usernameForConnection(state)
+	if err != nil {
+		base.LogTo("Auth+", "Invalid client cert: %v", err)
+	}
+	if username == "" {
+		if config.RequireClientCert {
+			return nil, base.HTTPErrorf(http.StatusUnauthorized, "Valid client certificate required")
+		}
+		return nil, nil
+	}
+
+	user, err := authenticator.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		if !config.AutoCreateUsers {
+			base.Logf("No user %q for client cert", username)
+			return nil, base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
+		}
+		if user, err = config.registerUser(authenticator, username); err != nil {
+			return nil, err
+		}
+	}
+	if user.Disabled() {
+		return nil, base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
+	}
+	return user, nil
+}
+
+func (config *ClientCertAuthConfig) registerUser(authenticator *auth.Authenticator, username string) (auth.User, error) {
+	names := make([]string, 0, len(config.UserChannels))
+	for _, template := range config.UserChannels {
+		names = append(names, strings.Replace(template, kClientCertUsernameVariable, username, -1))
+	}
+	channels, err := ch.SetFromArray(names, ch.RemoveStar)
+	if err != nil {
+		return nil, err
+	}
+	base.LogTo("Auth", "Registering new user %q from client cert, with channels %v", username, channels)
+	user, err := authenticator.NewUser(username, base.GenerateRandomSecret(), channels)
+	if err != nil {
+		return nil, err
+	}
+	if err := authenticator.Save(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,185 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+type testCertAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCertAuthority(t *testing.T) *testCertAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assertNoError(t, err, "GenerateKey")
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assertNoError(t, err, "CreateCertificate")
+	cert, err := x509.ParseCertificate(der)
+	assertNoError(t, err, "ParseCertificate")
+	return &testCertAuthority{cert: cert, key: key}
+}
+
+// Issues a client cert with the given common name and subject alternative name URIs.
+func (ca *testCertAuthority) issue(t *testing.T, commonName string, uris ...string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assertNoError(t, err, "GenerateKey")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if len(uris) > 0 {
+		names := make([]asn1.RawValue, len(uris))
+		for i, uri := range uris {
+			names[i] = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte(uri)}
+		}
+		value, err := asn1.Marshal(names)
+		assertNoError(t, err, "Marshal SAN")
+		template.ExtraExtensions = []pkix.Extension{{Id: oidSubjectAltName, Value: value}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assertNoError(t, err, "CreateCertificate")
+	cert, err := x509.ParseCertificate(der)
+	assertNoError(t, err, "ParseCertificate")
+	return cert
+}
+
+// Returns a ClientCertAuthConfig trusting the CA.
+func (ca *testCertAuthority) config(t *testing.T) *ClientCertAuthConfig {
+	file, err := ioutil.TempFile("", "client_ca")
+	assertNoError(t, err, "TempFile")
+	defer os.Remove(file.Name())
+	assertNoError(t, pem.Encode(file, &pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), "pem.Encode")
+	file.Close()
+	config := &ClientCertAuthConfig{CAFile: file.Name()}
+	assertNoError(t, config.validate(), "validate")
+	return config
+}
+
+func requestWithClientCert(method, resource, body string, cert *x509.Certificate) *http.Request {
+	r := request(method, resource, body)
+	r.TLS = &tls.ConnectionState{HandshakeComplete: true, PeerCertificates: []*x509.Certificate{cert}}
+	return r
+}
+
+func TestClientCertUsername(t *testing.T) {
+	ca := newTestCertAuthority(t)
+	config := ca.config(t)
+	cert := ca.issue(t, "device1", "urn:other:x", "urn:device:device2")
+
+	username, err := config.usernameForConnection(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	assertNoError(t, err, "usernameForConnection")
+	assert.Equals(t, username, "device1")
+
+	config.UsernameFrom = ClientCertUsernameFromSANURI
+	config.SANURIPrefix = "urn:device:"
+	username, err = config.usernameForCert(cert)
+	assertNoError(t, err, "usernameForCert")
+	assert.Equals(t, username, "device2")
+
+	config.SANURIPrefix = "urn:missing:"
+	_, err = config.usernameForCert(cert)
+	assert.True(t, err != nil)
+
+	// No cert:
+	username, err = config.usernameForConnection(&tls.ConnectionState{})
+	assert.Equals(t, username, "")
+	assert.Equals(t, err, nil)
+
+	// Cert issued by another CA:
+	other := newTestCertAuthority(t).issue(t, "device1")
+	_, err = config.usernameForConnection(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{other}})
+	assert.True(t, err != nil)
+
+	assert.True(t, (&ClientCertAuthConfig{CAFile: "/nonexistent", UsernameFrom: "cn"}).validate() != nil)
+	assert.True(t, (&ClientCertAuthConfig{CAFile: config.CAFile, UsernameFrom: "email"}).validate() != nil)
+}
+
+func TestClientCertAuth(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	ca := newTestCertAuthority(t)
+	config := ca.config(t)
+	rt.ServerContext().config.ClientCertAuth = config
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/bernard", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+
+	sessionName := func(response *TestResponse) interface{} {
+		var body struct {
+			UserCtx struct {
+				Name interface{} `json:"name"`
+			} `json:"userCtx"`
+		}
+		assertNoError(t, json.Unmarshal(response.Body.Bytes(), &body), "Unmarshal")
+		return body.UserCtx.Name
+	}
+
+	// A cert for an existing user authenticates as that user:
+	response := rt.Send(requestWithClientCert("GET", "/db/_session", "", ca.issue(t, "bernard")))
+	assertStatus(t, response, 200)
+	assert.Equals(t, sessionName(response), "bernard")
+
+	// A cert for an unknown user fails unless users are auto-created:
+	assertStatus(t, rt.Send(requestWithClientCert("GET", "/db/_session", "", ca.issue(t, "device1"))), 401)
+	config.AutoCreateUsers = true
+	config.UserChannels = []string{"device-$username", "public"}
+	response = rt.Send(requestWithClientCert("GET", "/db/_session", "", ca.issue(t, "device1")))
+	assertStatus(t, response, 200)
+	assert.Equals(t, sessionName(response), "device1")
+	user, err := rt.ServerContext().Database("db").Authenticator().GetUser("device1")
+	assertNoError(t, err, "GetUser")
+	assert.True(t, user != nil)
+	assert.True(t, user.CanSeeChannel("device-device1"))
+	assert.True(t, user.CanSeeChannel("public"))
+
+	// An untrusted cert falls back to other auth, unless a client cert is required:
+	untrusted := newTestCertAuthority(t).issue(t, "bernard")
+	request := requestWithClientCert("GET", "/db/_session", "", untrusted)
+	request.SetBasicAuth("bernard", "letmein")
+	response = rt.Send(request)
+	assertStatus(t, response, 200)
+	assert.Equals(t, sessionName(response), "bernard")
+
+	config.RequireClientCert = true
+	request = requestWithClientCert("GET", "/db/_session", "", untrusted)
+	request.SetBasicAuth("bernard", "letmein")
+	assertStatus(t, rt.Send(request), 401)
+	request = requestByUser("GET", "/db/_session", "", "bernard")
+	assertStatus(t, rt.Send(request), 401)
+}
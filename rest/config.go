@@ -10,6 +10,7 @@
 package rest
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -17,11 +18,15 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbase/sync_gateway/db"
 )
 
@@ -82,11 +87,23 @@ type ServerConfig struct {
 	CompressResponses              *bool                    `json:",omitempty"`            // If false, disables compression of HTTP responses
 	Databases                      DbConfigMap              `json:",omitempty"`            // Pre-configured databases, mapped by name
 	Replications                   []*ReplicationConfig     `json:",omitempty"`
-	MaxHeartbeat                   uint64                   `json:",omitempty"`                        // Max heartbeat value for _changes request (seconds)
-	ClusterConfig                  *ClusterConfig           `json:"cluster_config,omitempty"`          // Bucket and other config related to CBGT
-	SkipRunmodeValidation          bool                     `json:"skip_runmode_validation,omitempty"` // If this is true, skips any config validation regarding accel vs normal mode
-	Unsupported                    *UnsupportedServerConfig `json:"unsupported,omitempty"`             // Config for unsupported features
-	RunMode                        SyncGatewayRunMode       `json:"runmode,omitempty"`                 // Whether this is an SG reader or an SG Accelerator
+	MaxHeartbeat                   uint64                   `json:",omitempty"`                            // Max heartbeat value for _changes request (seconds)
+	ClusterConfig                  *ClusterConfig           `json:"cluster_config,omitempty"`              // Bucket and other config related to CBGT
+	SkipRunmodeValidation          bool                     `json:"skip_runmode_validation,omitempty"`     // If this is true, skips any config validation regarding accel vs normal mode
+	Unsupported                    *UnsupportedServerConfig `json:"unsupported,omitempty"`                 // Config for unsupported features
+	RunMode                        SyncGatewayRunMode       `json:"runmode,omitempty"`                     // Whether this is an SG reader or an SG Accelerator
+	ExtraChannelNameChars          *string                  `json:"extra_channel_name_chars,omitempty"`    // Characters allowed in channel names besides letters, digits and -_.@
+	BcryptCost                     *int                     `json:"bcrypt_cost,omitempty"`                 // bcrypt cost of password hashes, for databases that don't set one; defaults to 10
+	ShutdownDelaySecs              *int                     `json:"shutdown_delay_secs,omitempty"`         // On shutdown, time to report "draining" from /_status before closing the listeners
+	ShutdownDrainTimeoutSecs       *int                     `json:"shutdown_drain_timeout_secs,omitempty"` // On shutdown, max time to wait for requests in progress; defaults to 30
+	ChangesFeedLimit               *ChangesFeedLimitConfig  `json:"changes_feed_limit,omitempty"`          // Limits on concurrent _changes feeds per user
+	ClientCertAuth                 *ClientCertAuthConfig    `json:"client_cert_auth,omitempty"`            // Authentication of public API requests by TLS client cert
+	SlowRequestThresholdMs         *int                     `json:"slow_request_threshold_ms,omitempty"`   // Log warnings for requests that take this many ms; defaults to 2000, 0 to disable
+	TrustedProxies                 []string                 `json:"trusted_proxies,omitempty"`             // CIDRs of proxies whose X-Forwarded-For/Forwarded headers give the client's address
+	JSPool                         *JSPoolConfig            `json:"js_pool,omitempty"`                     // Sizing of the pool of JS runners shared by the sync fn, filters and validators
+	AdminKeys                      AdminKeyMap              `json:"admin_keys,omitempty"`                  // Named keys required by the admin API, if any; otherwise it's open
+	RequestTimeouts                *RequestTimeoutsConfig   `json:"request_timeouts,omitempty"`            // Max durations of requests, by kind of endpoint
+	trustedProxies                 trustedProxies
 }
 
 // Bucket configuration elements - used by db, shadow, index
@@ -104,6 +121,71 @@ type ClusterConfig struct {
 	HeartbeatIntervalSeconds *uint16 `json:"heartbeat_interval_seconds,omitempty"`
 }
 
+// Sizing of the shared pool of JavaScript runners (VMs).  The js_checkouts, js_waits, js_timeouts
+// and js_recycles stats show whether it's too small.
+type JSPoolConfig struct {
+	Size              *int `json:"size,omitempty"`                // Max number of JS runners; defaults to 32
+	CheckoutTimeoutMs *int `json:"checkout_timeout_ms,omitempty"` // Max time a call waits for a free runner, after which it fails with a 503; 0 (the default) for no limit
+	MaxPrograms       *int `json:"max_programs,omitempty"`        // Max number of functions to keep compiled in idle runners; defaults to 16
+}
+
+func (config *JSPoolConfig) options() channels.JSRunnerPoolOptions {
+	var options channels.JSRunnerPoolOptions
+	if config.Size != nil {
+		options.Size = *config.Size
+	}
+	if config.CheckoutTimeoutMs != nil {
+		options.CheckoutTimeout = time.Duration(*config.CheckoutTimeoutMs) * time.Millisecond
+	}
+	if config.MaxPrograms != nil {
+		options.MaxPrograms = *config.MaxPrograms
+	}
+	return options
+}
+
+type SessionCleanupConfig struct {
+	IntervalSecs *uint32 `json:"interval_secs,omitempty"` // How often to look for expired sessions; defaults to 3600
+	BatchSize    *int    `json:"batch_size,omitempty"`    // Max sessions deleted per query; defaults to 500
+	GraceSecs    *uint32 `json:"grace_secs,omitempty"`    // How long past their expiration sessions are kept; defaults to 600
+}
+
+func (config *SessionCleanupConfig) options() auth.SessionCleanupOptions {
+	var options auth.SessionCleanupOptions
+	if config == nil {
+		return options
+	}
+	if config.IntervalSecs != nil {
+		options.Interval = time.Duration(*config.IntervalSecs) * time.Second
+	}
+	if config.BatchSize != nil {
+		options.BatchSize = *config.BatchSize
+	}
+	if config.GraceSecs != nil {
+		options.GracePeriod = time.Duration(*config.GraceSecs) * time.Second
+	}
+	return options
+}
+
+// Requirements of passwords users change through the public API.
+type PasswordPolicyConfig struct {
+	MinLength      *int `json:"min_length,omitempty"`       // Min length in characters; defaults to 8
+	MinCharClasses *int `json:"min_char_classes,omitempty"` // Min kinds of character (lowercase, uppercase, digit, other) to mix; defaults to 1
+}
+
+func (config *PasswordPolicyConfig) options() auth.PasswordPolicy {
+	var policy auth.PasswordPolicy
+	if config == nil {
+		return policy
+	}
+	if config.MinLength != nil {
+		policy.MinLength = *config.MinLength
+	}
+	if config.MinCharClasses != nil {
+		policy.MinCharClasses = *config.MinCharClasses
+	}
+	return policy
+}
+
 func (c ClusterConfig) CBGTEnabled() bool {
 	// if we have a non-empty server field, then assume CBGT is enabled.
 	return c.Server != nil && *c.Server != ""
@@ -112,22 +194,63 @@ func (c ClusterConfig) CBGTEnabled() bool {
 // JSON object that defines a database configuration within the ServerConfig.
 type DbConfig struct {
 	BucketConfig
-	Name               string                         `json:"name,omitempty"`                 // Database name in REST API (stored as key in JSON)
-	Sync               *string                        `json:"sync,omitempty"`                 // Sync function defines which users can see which data
-	Users              map[string]*db.PrincipalConfig `json:"users,omitempty"`                // Initial user accounts
-	Roles              map[string]*db.PrincipalConfig `json:"roles,omitempty"`                // Initial roles
-	RevsLimit          *uint32                        `json:"revs_limit,omitempty"`           // Max depth a document's revision tree can grow to
-	ImportDocs         interface{}                    `json:"import_docs,omitempty"`          // false, true, or "continuous"
-	Shadow             *ShadowConfig                  `json:"shadow,omitempty"`               // External bucket to shadow
-	EventHandlers      interface{}                    `json:"event_handlers,omitempty"`       // Event handlers (webhook)
-	FeedType           string                         `json:"feed_type,omitempty"`            // Feed type - "DCP" or "TAP"; defaults based on Couchbase server version
-	AllowEmptyPassword bool                           `json:"allow_empty_password,omitempty"` // Allow empty passwords?  Defaults to false
-	CacheConfig        *CacheConfig                   `json:"cache,omitempty"`                // Cache settings
-	ChannelIndex       *ChannelIndexConfig            `json:"channel_index,omitempty"`        // Channel index settings
-	RevCacheSize       *uint32                        `json:"rev_cache_size,omitempty"`       // Maximum number of revisions to store in the revision cache
-	StartOffline       bool                           `json:"offline,omitempty"`              // start the DB in the offline state, defaults to false
-	Unsupported        db.UnsupportedOptions          `json:"unsupported,omitempty"`          // Config for unsupported features
-	OIDCConfig         *auth.OIDCOptions              `json:"oidc,omitempty"`                 // Config properties for OpenID Connect authentication
+	Name                    string                         `json:"name,omitempty"`                      // Database name in REST API (stored as key in JSON)
+	Sync                    *string                        `json:"sync,omitempty"`                      // Sync function defines which users can see which data
+	Validate                *string                        `json:"validate,omitempty"`                  // Validate function checks document updates before the sync function runs
+	Users                   map[string]*db.PrincipalConfig `json:"users,omitempty"`                     // User accounts, created or updated to match on startup and config reload
+	Roles                   map[string]*db.PrincipalConfig `json:"roles,omitempty"`                     // Roles, likewise
+	RevsLimit               *uint32                        `json:"revs_limit,omitempty"`                // Max depth a document's revision tree can grow to
+	ImportDocs              interface{}                    `json:"import_docs,omitempty"`               // false, true, or "continuous"
+	ImportFilter            *string                        `json:"import_filter,omitempty"`             // JS function deciding which docs written directly to the bucket are imported
+	Shadow                  *ShadowConfig                  `json:"shadow,omitempty"`                    // External bucket to shadow
+	EventHandlers           interface{}                    `json:"event_handlers,omitempty"`            // Event handlers (webhook)
+	FeedType                string                         `json:"feed_type,omitempty"`                 // Feed type - "DCP" or "TAP"; defaults based on Couchbase server version
+	AllowEmptyPassword      bool                           `json:"allow_empty_password,omitempty"`      // Allow empty passwords?  Defaults to false
+	CacheConfig             *CacheConfig                   `json:"cache,omitempty"`                     // Cache settings
+	ChannelIndex            *ChannelIndexConfig            `json:"channel_index,omitempty"`             // Channel index settings
+	RevCacheSize            *uint32                        `json:"rev_cache_size,omitempty"`            // Maximum number of revisions to store in the revision cache
+	RevCacheMaxBytes        *uint64                        `json:"rev_cache_max_bytes,omitempty"`       // Maximum estimated size of the revisions in the revision cache; unlimited by default
+	StartOffline            bool                           `json:"offline,omitempty"`                   // start the DB in the offline state, defaults to false
+	Unsupported             db.UnsupportedOptions          `json:"unsupported,omitempty"`               // Config for unsupported features
+	OIDCConfig              *auth.OIDCOptions              `json:"oidc,omitempty"`                      // Config properties for OpenID Connect authentication
+	JWTConfig               *auth.JWTBearerOptions         `json:"jwt,omitempty"`                       // Config properties for bearer JWTs from an external identity provider
+	SyncFnTimeoutSecs       *uint32                        `json:"sync_fn_timeout_secs,omitempty"`      // Max execution time of the sync function per document, defaults to 5
+	ValidateFnTimeoutSecs   *uint32                        `json:"validate_fn_timeout_secs,omitempty"`  // Max execution time of the validate function per document, defaults to 5
+	MaxChannelsPerDoc       *uint32                        `json:"max_channels_per_doc,omitempty"`      // Max channels a doc can be assigned to, or grant to a user/role.  Defaults to 1000; 0 for no limit
+	MaxSessionTTLSecs       *uint32                        `json:"max_session_ttl_secs,omitempty"`      // Max session TTL a client can request from POST /_session, defaults to 24 hours
+	BcryptCost              *int                           `json:"bcrypt_cost,omitempty"`               // bcrypt cost of password hashes; overrides the server's bcrypt_cost
+	MaxBulkDocs             *uint32                        `json:"max_bulk_docs,omitempty"`             // Max docs in a _bulk_docs request, defaults to 10000
+	MaxBulkDocsBytes        *int64                         `json:"max_bulk_docs_bytes,omitempty"`       // Max size of a _bulk_docs request body, defaults to 100MB
+	MaxAllDocsKeys          *uint32                        `json:"max_all_docs_keys,omitempty"`         // Max keys in an _all_docs request, defaults to 10000
+	MaxBulkPrincipals       *uint32                        `json:"max_bulk_principals,omitempty"`       // Max users or roles in a _user/_bulk or _role/_bulk request, defaults to 10000
+	MaxLocalDocBytes        *int64                         `json:"max_local_doc_bytes,omitempty"`       // Max size of a _local doc, defaults to 1MB
+	ChangesBuffer           *uint32                        `json:"changes_buffer,omitempty"`            // Max changes buffered for a continuous _changes feed whose client is slow, defaults to 1000
+	LogKeys                 []string                       `json:"log,omitempty"`                       // Log keywords to enable for this database's messages, instead of the server's
+	LogLevel                *int                           `json:"log_level,omitempty"`                 // Log level of this database's messages (1-3), instead of the server's
+	CORS                    *CORSConfig                    `json:"cors,omitempty"`                      // CORS config for this database; overrides the server's
+	BucketRetry             *db.BucketRetryConfig          `json:"bucket_retry,omitempty"`              // Retries & circuit breaker for bucket ops that fail with transient errors
+	ViewQuery               *db.ViewQueryConfig            `json:"view_query,omitempty"`                // Timeout, retries and stale settings of view queries
+	N1QL                    *db.N1QLConfig                 `json:"n1ql,omitempty"`                      // Use N1QL queries of GSI indexes instead of views
+	HideSyncRejections      bool                           `json:"hide_sync_rejections,omitempty"`      // Hide the sync function's rejection messages from the public API
+	ChannelHistoryRetention *uint64                        `json:"channel_history_retention,omitempty"` // Number of sequences docs keep past channel removals in their channel history; unlimited by default
+	ClusterCompatVersion    *int                           `json:"cluster_compat_version,omitempty"`    // Sync metadata version every node in the cluster supports; lower it during rolling upgrades
+	ChangesFilters          map[string]string              `json:"changes_filters,omitempty"`           // Named JS filter functions clients can apply to changes feeds with ?filter=
+	FilterTimeoutSecs       *uint32                        `json:"filter_timeout_secs,omitempty"`       // Max execution time of a changes filter function per entry, defaults to 5
+	OutOfLineBodyThreshold  *int                           `json:"out_of_line_body_bytes,omitempty"`    // Doc bodies at least this size in bytes are stored under their own key; off by default
+	InlineBodies            bool                           `json:"inline_bodies,omitempty"`             // Move bodies stored out of line back into their docs, as they're written or resynced
+	VerifyRevIDs            bool                           `json:"verify_rev_ids,omitempty"`            // Reject revisions pushed with new_edits=false whose rev IDs aren't the digest of their content
+	DisableGuest            bool                           `json:"disable_guest,omitempty"`             // Reject unauthenticated public API requests, other than GET /{db}/, with a 401 instead of treating them as the GUEST user
+	SessionCleanup          *SessionCleanupConfig          `json:"session_cleanup,omitempty"`           // Schedule of the task deleting expired session docs
+	MaxOperationIDs         *int                           `json:"max_operation_ids,omitempty"`         // Max X-Operation-Id values recorded per doc, to make retried writes idempotent; defaults to 10
+	OperationIDTTLSecs      *uint32                        `json:"operation_id_ttl_secs,omitempty"`     // How long a doc's operation IDs are recorded; defaults to 24 hours
+	DeletionAttachments     *string                        `json:"deletion_attachments,omitempty"`      // "strip" (the default) or "reject": what happens to _attachments in deletion revisions
+	MaxChangesRows          *int                           `json:"max_changes_rows,omitempty"`          // Max rows of a one-shot _changes response, after which clients get "pending" and paginate; no limit by default
+	MaxChangesSecs          *uint32                        `json:"max_changes_secs,omitempty"`          // Max time spent sending a one-shot _changes response; no limit by default
+	DeltaMaxBodyBytes       *int                           `json:"delta_max_body_bytes,omitempty"`      // Max size of a revision body sent as a delta (?deltas=true); no limit by default
+	DeltaMaxRatio           *float64                       `json:"delta_max_ratio,omitempty"`           // A delta bigger than this fraction of the full body is sent as the body instead; defaults to 0.5
+	PasswordPolicy          *PasswordPolicyConfig          `json:"password_policy,omitempty"`           // Requirements of passwords users change through the public API
+	MaxDocIDLength          *int                           `json:"max_doc_id_length,omitempty"`         // Max length of doc IDs in bytes, from 32 to the default of 186 (so internal keys fit the bucket's limit)
+	MaxAttNameLength        *int                           `json:"max_att_name_length,omitempty"`       // Max length of the names of attachments being added, in bytes; defaults to 255
 }
 
 type DbConfigMap map[string]*DbConfig
@@ -144,7 +267,7 @@ type GoogleConfig struct {
 }
 
 type CORSConfig struct {
-	Origin      []string // List of allowed origins, use ["*"] to allow access from everywhere
+	Origin      []string // List of allowed origins, use ["*"] to allow access from everywhere, or wildcards like "https://*.example.com"
 	LoginOrigin []string // List of allowed login origins
 	Headers     []string // List of allowed headers
 	MaxAge      int      // Maximum age of the CORS Options request
@@ -288,6 +411,71 @@ func (dbConfig DbConfig) validate() error {
 		}
 	}
 
+	if dbConfig.BcryptCost != nil {
+		if err := auth.ValidateBcryptCost(*dbConfig.BcryptCost); err != nil {
+			return err
+		}
+	}
+
+	if dbConfig.ClusterCompatVersion != nil {
+		if err := db.ValidateClusterCompatVersion(*dbConfig.ClusterCompatVersion); err != nil {
+			return err
+		}
+	}
+
+	if dbConfig.OutOfLineBodyThreshold != nil && *dbConfig.OutOfLineBodyThreshold < 0 {
+		return fmt.Errorf("out_of_line_body_bytes must not be negative")
+	}
+
+	if dbConfig.LogLevel != nil && (*dbConfig.LogLevel < 1 || *dbConfig.LogLevel > 3) {
+		return fmt.Errorf("log_level must be 1, 2 or 3")
+	}
+
+	if dbConfig.MaxDocIDLength != nil && (*dbConfig.MaxDocIDLength < db.MinMaxDocIDLength || *dbConfig.MaxDocIDLength > db.DefaultMaxDocIDLength) {
+		return fmt.Errorf("max_doc_id_length must be between %d and %d", db.MinMaxDocIDLength, db.DefaultMaxDocIDLength)
+	}
+
+	if dbConfig.MaxAttNameLength != nil && *dbConfig.MaxAttNameLength < 1 {
+		return fmt.Errorf("max_att_name_length must be at least 1")
+	}
+
+	if policy := dbConfig.PasswordPolicy; policy != nil && policy.MinCharClasses != nil && (*policy.MinCharClasses < 0 || *policy.MinCharClasses > 4) {
+		return fmt.Errorf("password_policy min_char_classes must be between 0 and 4")
+	}
+
+	if dbConfig.DeltaMaxRatio != nil && (*dbConfig.DeltaMaxRatio <= 0 || *dbConfig.DeltaMaxRatio > 1) {
+		return fmt.Errorf("delta_max_ratio must be greater than 0 and at most 1")
+	}
+
+	if dbConfig.MaxChangesRows != nil && *dbConfig.MaxChangesRows < 0 {
+		return fmt.Errorf("max_changes_rows must not be negative")
+	}
+
+	if dbConfig.DeletionAttachments != nil && *dbConfig.DeletionAttachments != "strip" && *dbConfig.DeletionAttachments != "reject" {
+		return fmt.Errorf("deletion_attachments must be \"strip\" or \"reject\"")
+	}
+
+	for name, source := range dbConfig.ChangesFilters {
+		if name == "" || name == "sync_gateway/bychannel" || name == "_doc_ids" {
+			return fmt.Errorf("Invalid changes filter name %q", name)
+		}
+		if _, err := channels.NewChangesFilterRunner(source, 0); err != nil {
+			return fmt.Errorf("Invalid changes filter %q: %v", name, err)
+		}
+	}
+
+	for name, user := range dbConfig.Users {
+		if user == nil || (user.RateLimit == nil && user.MaxChannels == nil) {
+			continue
+		}
+		if name != base.GuestUsername {
+			return fmt.Errorf("rate_limit and max_channels only apply to the %s user, not %q", base.GuestUsername, name)
+		}
+		if user.RateLimit != nil && (user.RateLimit.RequestsPerSec <= 0 || user.RateLimit.Burst < 0) {
+			return fmt.Errorf("The %s user's rate_limit needs a positive requests_per_sec, and a non-negative burst", base.GuestUsername)
+		}
+	}
+
 	return nil
 
 }
@@ -373,6 +561,38 @@ func (dbConfig *DbConfig) UseXattrs() bool {
 	return base.DefaultUseXattrs
 }
 
+// The max execution time of the validate function, or 0 for the default.
+func (dbConfig *DbConfig) validateFnTimeout() time.Duration {
+	if dbConfig.ValidateFnTimeoutSecs != nil {
+		return time.Duration(*dbConfig.ValidateFnTimeoutSecs) * time.Second
+	}
+	return 0
+}
+
+// The validate function's source, or "" if there isn't one.
+func (dbConfig *DbConfig) validateFn() string {
+	if dbConfig.Validate != nil {
+		return *dbConfig.Validate
+	}
+	return ""
+}
+
+// Creates the changes filter functions, keyed by name; nil if there aren't any.
+func (dbConfig *DbConfig) changesFilters() map[string]*channels.ChangesFilterFunction {
+	if len(dbConfig.ChangesFilters) == 0 {
+		return nil
+	}
+	timeout := channels.DefaultSyncFnTimeout
+	if dbConfig.FilterTimeoutSecs != nil {
+		timeout = time.Duration(*dbConfig.FilterTimeoutSecs) * time.Second
+	}
+	filters := make(map[string]*channels.ChangesFilterFunction, len(dbConfig.ChangesFilters))
+	for name, source := range dbConfig.ChangesFilters {
+		filters[name] = channels.NewChangesFilterFunction(source, timeout)
+	}
+	return filters
+}
+
 // Implementation of AuthHandler interface for ShadowConfig
 func (shadowConfig *ShadowConfig) GetCredentials() (string, string, string) {
 	return base.TransformBucketCredentials(shadowConfig.Username, shadowConfig.Password, *shadowConfig.Bucket)
@@ -457,6 +677,41 @@ func ReadServerConfigFromFile(runMode SyncGatewayRunMode, path string) (*ServerC
 }
 
 func (config *ServerConfig) setupAndValidateDatabases() error {
+	if config.BcryptCost != nil {
+		if err := auth.ValidateBcryptCost(*config.BcryptCost); err != nil {
+			return err
+		}
+	}
+	if config.ChangesFeedLimit != nil {
+		if err := config.ChangesFeedLimit.validate(); err != nil {
+			return err
+		}
+	}
+	if config.RequestTimeouts != nil {
+		if err := config.RequestTimeouts.validate(); err != nil {
+			return err
+		}
+	}
+	if len(config.TrustedProxies) > 0 {
+		proxies, err := parseTrustedProxies(config.TrustedProxies)
+		if err != nil {
+			return err
+		}
+		config.trustedProxies = proxies
+	}
+	if config.ClientCertAuth != nil {
+		if config.SSLCert == nil || config.SSLKey == nil {
+			return fmt.Errorf("client_cert_auth requires SSLCert and SSLKey")
+		}
+		if err := config.ClientCertAuth.validate(); err != nil {
+			return err
+		}
+	}
+	for name, key := range config.AdminKeys {
+		if err := key.validate(name); err != nil {
+			return err
+		}
+	}
 	for name, dbConfig := range config.Databases {
 		dbConfig.setup(name)
 		if err := config.validateDbConfig(dbConfig); err != nil {
@@ -684,7 +939,7 @@ func SetMaxFileDescriptors(maxP *uint64) {
 	}
 }
 
-func (config *ServerConfig) Serve(addr string, handler http.Handler) {
+func (config *ServerConfig) Serve(addr string, handler http.Handler, clientAuth tls.ClientAuthType) {
 	maxConns := DefaultMaxIncomingConnections
 	if config.MaxIncomingConnections != nil {
 		maxConns = *config.MaxIncomingConnections
@@ -703,8 +958,9 @@ func (config *ServerConfig) Serve(addr string, handler http.Handler) {
 		config.ServerReadTimeout,
 		config.ServerWriteTimeout,
 		http2Enabled,
+		clientAuth,
 	)
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		base.LogFatal("Failed to start HTTP server on %s: %v", addr, err)
 	}
 }
@@ -739,7 +995,22 @@ func (config *ServerConfig) NumIndexWriters() int {
 	return n
 }
 
-// Starts and runs the server given its configuration. (This function never returns.)
+func (config *ServerConfig) shutdownDelay() time.Duration {
+	if config.ShutdownDelaySecs != nil {
+		return time.Duration(*config.ShutdownDelaySecs) * time.Second
+	}
+	return 0
+}
+
+func (config *ServerConfig) shutdownDrainTimeout() time.Duration {
+	if config.ShutdownDrainTimeoutSecs != nil {
+		return time.Duration(*config.ShutdownDrainTimeoutSecs) * time.Second
+	}
+	return DefaultShutdownDrainTimeout
+}
+
+// Starts and runs the server given its configuration.  Returns after the server has been shut
+// down by a SIGTERM or interrupt signal.
 func RunServer(config *ServerConfig) {
 	PrettyPrint = config.Pretty
 
@@ -770,10 +1041,30 @@ func RunServer(config *ServerConfig) {
 		}()
 	}
 
+	// On SIGTERM or ^C, shut down gracefully.  A second signal kills the process right away.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		signal.Reset(syscall.SIGTERM, os.Interrupt)
+		base.Logf("Received %v; shutting down", sig)
+		sc.Shutdown(config.shutdownDelay(), config.shutdownDrainTimeout())
+	}()
+
 	base.Logf("Starting admin server on %s", *config.AdminInterface)
-	go config.Serve(*config.AdminInterface, CreateAdminHandler(sc))
+	go config.Serve(*config.AdminInterface, CreateAdminHandler(sc), tls.NoClientCert)
 	base.Logf("Starting server on %s ...", *config.Interface)
-	config.Serve(*config.Interface, CreatePublicHandler(sc))
+	// Client certs are requested but not verified by the handshake, so that requests with a missing
+	// or invalid one can fall back to other auth; the handler verifies them.
+	publicClientAuth := tls.NoClientCert
+	if config.ClientCertAuth != nil {
+		publicClientAuth = tls.RequestClientCert
+	}
+	config.Serve(*config.Interface, CreatePublicHandler(sc), publicClientAuth)
+
+	// Serve only returns once Shutdown has closed the listener; wait for it to finish:
+	sc.WaitForShutdown()
+	base.Logf("Shut down")
 }
 
 // for now  just cycle the logger to allow for log file rotation
@@ -144,8 +144,14 @@ func recordCBClientStat(opname, k string, start time.Time, err error) {
 	histo.Update(int64(duration))
 }
 
+// Returns the metrics in the Prometheus text format, for scraping.
+func (h *handler) handleMetrics() error {
+	h.setHeader("Content-Type", "text/plain; version=0.0.4")
+	return base.Metrics.WritePrometheus(h.response)
+}
+
 func (h *handler) handleExpvar() error {
-	base.LogTo("HTTP", "Recording snapshot of current debug variables.")
+	h.logContext.LogTo("HTTP", "Recording snapshot of current debug variables.")
 	grTracker.recordSnapshot()
 	h.rq.URL.Path = strings.Replace(h.rq.URL.Path, kDebugURLPathPrefix, "/debug/vars", 1)
 	http.DefaultServeMux.ServeHTTP(h.response, h.rq)
@@ -11,7 +11,6 @@ package rest
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/db"
 	"math"
@@ -19,6 +18,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // HTTP handler for a GET of a document
@@ -28,12 +28,16 @@ func (h *handler) handleGetDoc() error {
 	openRevs := h.getQuery("open_revs")
 	showExp := h.getBoolQuery("show_exp")
 
+	// Admins may also ask for the channels of the revisions; the public port ignores this:
+	showChannelHistory := h.privs == adminPrivs && h.getBoolQuery("show_channel_history")
+	showChannels := showChannelHistory || (h.privs == adminPrivs && h.getBoolQuery("show_channels"))
+
 	// Check whether the caller wants a revision history, or attachment bodies, or both:
 	var revsLimit = 0
-	var revsFrom, attachmentsSince []string
+	var revsFrom, attachmentsSince, attsSinceParam []string
 	{
 		var err error
-		var attsSinceParam, revsFromParam []string
+		var revsFromParam []string
 		if revsFromParam, err = h.getJSONStringArrayQuery("revs_from"); err != nil {
 			return err
 		}
@@ -60,18 +64,64 @@ func (h *handler) handleGetDoc() error {
 	}
 
 	if openRevs == "" {
-		// Single-revision GET:
-		value, err := h.db.GetRevWithHistory(docid, revid, revsLimit, revsFrom, attachmentsSince, showExp)
-		if err != nil {
-			return err
+		// Single-revision GET.  The response format has to be settled before the revision is
+		// loaded, since WriteMultipartDocument rewrites its attachments' metadata.
+		acceptsJSON, acceptsMultipart := h.requestAccepts("application/json"), h.requestAccepts("multipart/related")
+		if !acceptsJSON && !acceptsMultipart {
+			return base.HTTPErrorf(http.StatusNotAcceptable, "Supported types are application/json and multipart/related")
+		}
+
+		// If the client already has the revision, don't bother loading its history or attachments.
+		// Otherwise the plain revision is all that's needed, unless those were asked for:
+		var value db.Body
+		var err error
+		if h.rq.Header.Get("If-None-Match") != "" {
+			if current, err := h.db.GetRev(docid, revid, false, nil); err == nil && current != nil {
+				if currentRev, _ := current["_rev"].(string); h.ifNoneMatch(currentRev) {
+					h.writeNotModified(currentRev)
+					return nil
+				}
+				if revsLimit == 0 && attachmentsSince == nil && !showExp {
+					value = current
+				}
+			}
+		}
+		if value == nil {
+			if value, err = h.db.GetRevWithHistory(docid, revid, revsLimit, revsFrom, attachmentsSince, showExp); err != nil {
+				return err
+			}
 		}
 		if value == nil {
 			return kNotFoundError
 		}
+		if showChannels {
+			if err := h.db.AddRevChannels(docid, value, showChannelHistory); err != nil {
+				return err
+			}
+		}
 		h.setHeader("Etag", strconv.Quote(value["_rev"].(string)))
 
+		// If the client has other revisions, it may ask for a delta from one of them instead.
+		// (Not with revs or attachments, since those depend on more than the two revisions.)
+		if h.getBoolQuery("deltas") && revsLimit == 0 && attachmentsSince == nil && !showExp && !showChannels {
+			if knownRevs := h.rq.Header.Get("X-Known-Revs"); knownRevs != "" {
+				revids := strings.Split(knownRevs, ",")
+				for i, knownRev := range revids {
+					revids[i] = strings.TrimSpace(knownRev)
+				}
+				if sourceRevID, delta := h.db.GetBodyDelta(docid, value, revids); delta != nil {
+					h.setHeader("Content-Type", "application/json-delta")
+					h.setHeader("X-Delta-Source", sourceRevID)
+					h.response.Write(delta)
+					return nil
+				}
+			}
+		}
+
+		// Attachment bodies go in MIME parts if the client takes multipart; otherwise the JSON
+		// marshaler encodes their data as base64 in _attachments:
 		hasBodies := (attachmentsSince != nil && value["_attachments"] != nil)
-		if h.requestAccepts("multipart/") && (hasBodies || !h.requestAccepts("application/json")) {
+		if acceptsMultipart && (hasBodies || !acceptsJSON) {
 			canCompress := strings.Contains(h.rq.Header.Get("X-Accept-Part-Encoding"), "gzip")
 			return h.writeMultipart("related", func(writer *multipart.Writer) error {
 				h.db.WriteMultipartDocument(value, writer, canCompress)
@@ -81,8 +131,19 @@ func (h *handler) handleGetDoc() error {
 			h.writeJSON(value)
 		}
 	} else {
+		acceptsMultipart := h.requestAccepts("multipart/mixed")
+		if !acceptsMultipart && !h.requestAccepts("application/json") {
+			return base.HTTPErrorf(http.StatusNotAcceptable, "Supported types are application/json and multipart/mixed")
+		}
+
 		var revids []string
-		attachmentsSince = []string{}
+		// Revisions are always sent with their attachment bodies, except ones the client already
+		// has according to atts_since:
+		if attsSinceParam != nil {
+			attachmentsSince = attsSinceParam
+		} else {
+			attachmentsSince = []string{}
+		}
 
 		if openRevs == "all" {
 			// open_revs=all
@@ -102,10 +163,13 @@ func (h *handler) handleGetDoc() error {
 			}
 		}
 
-		if h.requestAccepts("multipart/") {
+		if acceptsMultipart {
 			err := h.writeMultipart("mixed", func(writer *multipart.Writer) error {
 				for _, revid := range revids {
 					revBody, err := h.db.GetRevWithHistory(docid, revid, revsLimit, revsFrom, attachmentsSince, showExp)
+					if err == nil && showChannels {
+						err = h.db.AddRevChannels(docid, revBody, showChannelHistory)
+					}
 					if err != nil {
 						revBody = db.Body{"missing": revid} //TODO: More specific error
 					}
@@ -115,12 +179,15 @@ func (h *handler) handleGetDoc() error {
 			})
 			return err
 		} else {
-			base.LogTo("HTTP+", "Fallback to non-multipart for open_revs")
+			h.logContext.LogTo("HTTP+", "Fallback to non-multipart for open_revs")
 			h.setHeader("Content-Type", "application/json")
 			h.response.Write([]byte(`[` + "\n"))
 			separator := []byte(``)
 			for _, revid := range revids {
 				revBody, err := h.db.GetRevWithHistory(docid, revid, revsLimit, revsFrom, attachmentsSince, showExp)
+				if err == nil && showChannels {
+					err = h.db.AddRevChannels(docid, revBody, showChannelHistory)
+				}
 				if err != nil {
 					revBody = db.Body{"missing": revid} //TODO: More specific error
 				} else {
@@ -153,6 +220,10 @@ func (h *handler) handleGetAttachment() error {
 		return base.HTTPErrorf(http.StatusNotFound, "missing attachment %s", attachmentName)
 	}
 	digest := meta["digest"].(string)
+	if h.ifNoneMatch(digest) {
+		h.writeNotModified(digest)
+		return nil
+	}
 	data, err := h.db.GetAttachment(db.AttachmentKey(digest))
 	if err != nil {
 		return err
@@ -167,6 +238,50 @@ func (h *handler) handleGetAttachment() error {
 	h.setHeader("Content-Length", strconv.FormatUint(uint64(len(data)), 10))
 
 	h.setHeader("Etag", strconv.Quote(digest))
+	h.setAttachmentContentHeaders(meta)
+	if h.privs == adminPrivs { // #720
+		h.setHeader("Content-Disposition", db.AttachmentContentDisposition(attachmentName))
+	}
+	h.response.WriteHeader(status)
+	h.response.Write(data)
+	return nil
+}
+
+// HTTP handler for GET /db/_attachment/{digest}: an attachment's data, given just its digest, if the
+// user can access a document that has it.  Since attachments are content-addressed, the response
+// never changes and can be cached indefinitely.
+func (h *handler) handleGetAttachmentByDigest() error {
+	digest := h.PathVar("digest")
+	meta, err := h.db.GetAttachmentMetaByDigest(digest)
+	if err != nil {
+		return err
+	}
+	h.setHeader("Cache-Control", "max-age=31536000, immutable")
+	if h.ifNoneMatch(digest) {
+		h.writeNotModified(digest)
+		return nil
+	}
+	data, err := h.db.GetAttachment(db.AttachmentKey(digest))
+	if err != nil {
+		return err
+	}
+
+	status, start, end := h.handleRange(uint64(len(data)))
+	if status > 299 {
+		return base.HTTPErrorf(status, "")
+	} else if status == http.StatusPartialContent {
+		data = data[start:end]
+	}
+	h.setHeader("Content-Length", strconv.FormatUint(uint64(len(data)), 10))
+	h.setHeader("Etag", strconv.Quote(digest))
+	h.setAttachmentContentHeaders(meta)
+	h.response.WriteHeader(status)
+	h.response.Write(data)
+	return nil
+}
+
+// Sets the Content-Type and Content-Encoding response headers of an attachment, given its metadata.
+func (h *handler) setAttachmentContentHeaders(meta map[string]interface{}) {
 	if contentType, ok := meta["content_type"].(string); ok {
 		h.setHeader("Content-Type", contentType)
 	}
@@ -183,12 +298,6 @@ func (h *handler) handleGetAttachment() error {
 			h.setHeader("Content-Type", "application/gzip")
 		}
 	}
-	if h.privs == adminPrivs { // #720
-		h.setHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%q", attachmentName))
-	}
-	h.response.WriteHeader(status)
-	h.response.Write(data)
-	return nil
 }
 
 // HTTP handler for a PUT of an attachment
@@ -199,9 +308,9 @@ func (h *handler) handlePutAttachment() error {
 	if attachmentContentType == "" {
 		attachmentContentType = "application/octet-stream"
 	}
-	revid := h.getQuery("rev")
-	if revid == "" {
-		revid = h.rq.Header.Get("If-Match")
+	revid, err := h.getRevForWrite()
+	if err != nil {
+		return err
 	}
 	attachmentData, err := h.readBody()
 	if err != nil {
@@ -245,6 +354,44 @@ func (h *handler) handlePutAttachment() error {
 	return nil
 }
 
+// HTTP handler for a DELETE of an attachment, which creates a new revision of the doc without it.
+// The parent revision is given by the rev query param or an If-Match header.
+func (h *handler) handleDeleteAttachment() error {
+	docid := h.PathVar("docid")
+	attachmentName := h.PathVar("attach")
+	revid, err := h.getRevForWrite()
+	if err != nil {
+		return err
+	} else if revid == "" {
+		return base.HTTPErrorf(http.StatusConflict, "Missing rev; use the rev parameter or an If-Match header")
+	}
+
+	body, err := h.db.GetRev(docid, revid, false, nil)
+	if err != nil {
+		return err
+	}
+	body = body.ImmutableAttachmentsCopy() // The attachments may be shared with the revision cache
+	attachments := db.BodyAttachments(body)
+	if _, found := attachments[attachmentName]; !found {
+		return base.HTTPErrorf(http.StatusNotFound, "missing attachment %s", attachmentName)
+	}
+
+	// The remaining attachments are stubs, which storeAttachments carries over from the parent:
+	delete(attachments, attachmentName)
+	if len(attachments) == 0 {
+		delete(body, "_attachments")
+	}
+	body["_rev"] = revid
+
+	newRev, err := h.db.Put(docid, body)
+	if err != nil {
+		return err
+	}
+	h.setHeader("Etag", strconv.Quote(newRev))
+	h.writeJSON(db.Body{"ok": true, "id": docid, "rev": newRev})
+	return nil
+}
+
 // HTTP handler for a PUT of a document
 func (h *handler) handlePutDoc() error {
 	docid := h.PathVar("docid")
@@ -255,47 +402,108 @@ func (h *handler) handlePutDoc() error {
 	if body == nil {
 		return base.HTTPErrorf(http.StatusBadRequest, "Document body is empty")
 	}
+	database, dryRunResult, err := h.dbForWrite()
+	if err != nil {
+		return err
+	}
 	var newRev string
 
 	if h.getQuery("new_edits") != "false" {
 		// Regular PUT:
-		if oldRev := h.getQuery("rev"); oldRev != "" {
+		oldRev, err := h.getRevForWrite()
+		if err != nil {
+			return err
+		}
+		if oldRev != "" {
 			body["_rev"] = oldRev
-		} else if ifMatch := h.rq.Header.Get("If-Match"); ifMatch != "" {
-			body["_rev"] = ifMatch
 		}
-		newRev, err = h.db.Put(docid, body)
+		if database, err = h.dbForOperation(database); err != nil {
+			return err
+		}
+		newRev, err = database.Put(docid, body)
 		if err != nil {
 			return err
 		}
-		h.setHeader("Etag", strconv.Quote(newRev))
+		if dryRunResult == nil {
+			h.setHeader("Etag", strconv.Quote(newRev))
+		}
 	} else {
 		// Replicator-style PUT with new_edits=false:
 		revisions := db.ParseRevisions(body)
 		if revisions == nil {
 			return base.HTTPErrorf(http.StatusBadRequest, "Bad _revisions")
 		}
-		err = h.db.PutExistingRev(docid, body, revisions)
+		err = database.PutExistingRev(docid, body, revisions)
 		if err != nil {
 			return err
 		}
 		newRev = body["_rev"].(string)
 	}
+	if dryRunResult != nil {
+		h.writeJSON(dryRunResponse(docid, dryRunResult))
+		return nil
+	}
 	h.writeJSONStatus(http.StatusCreated, db.Body{"ok": true, "id": docid, "rev": newRev})
 	return nil
 }
 
+// Returns the database to make a request's document writes with.  If the request has ?dry_run=true
+// (only allowed on the admin port), the writes are dry runs, whose result is also returned.
+func (h *handler) dbForWrite() (*db.Database, *db.DryRunResult, error) {
+	if !h.getBoolQuery("dry_run") {
+		return h.db, nil, nil
+	} else if h.privs != adminPrivs {
+		return nil, nil, base.HTTPErrorf(http.StatusForbidden, "dry_run is only allowed on the admin port")
+	}
+	result := &db.DryRunResult{}
+	return h.db.WithDryRun(result), result, nil
+}
+
+// Returns the database to make a write with on behalf of the request's X-Operation-Id, if it has
+// one: a retry of the write returns the revision it created, rather than creating another.
+func (h *handler) dbForOperation(database *db.Database) (*db.Database, error) {
+	operationID := h.rq.Header.Get("X-Operation-Id")
+	if operationID == "" {
+		return database, nil
+	} else if len(operationID) > db.MaxOperationIDLength {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "X-Operation-Id is too long")
+	}
+	return database.WithOperationID(operationID), nil
+}
+
+// The response to a dry run of a document write: the revision it would have created, and the
+// channels and access the sync function gave it.
+func dryRunResponse(docid string, result *db.DryRunResult) db.Body {
+	response := db.Body{"ok": true, "id": docid, "rev": result.RevID, "dry_run": true}
+	if result.Channels != nil {
+		response["channels"] = result.Channels
+	} else {
+		response["channels"] = []string{}
+	}
+	if len(result.Access) > 0 {
+		response["access"] = result.Access
+	}
+	if len(result.Roles) > 0 {
+		response["roles"] = result.Roles
+	}
+	return response
+}
+
 // HTTP handler for a POST to a database (creating a document)
 func (h *handler) handlePostDoc() error {
 	body, err := h.readDocument()
 	if err != nil {
 		return err
 	}
-	docid, newRev, err := h.db.Post(body)
+	database, err := h.dbForOperation(h.db)
 	if err != nil {
 		return err
 	}
-	h.setHeader("Location", docid)
+	docid, newRev, err := database.Post(body)
+	if err != nil {
+		return err
+	}
+	h.setHeader("Location", escapePathSegment(docid))
 	h.setHeader("Etag", strconv.Quote(newRev))
 	h.writeJSON(db.Body{"ok": true, "id": docid, "rev": newRev})
 	return nil
@@ -304,12 +512,13 @@ func (h *handler) handlePostDoc() error {
 // HTTP handler for a DELETE of a document
 func (h *handler) handleDeleteDoc() error {
 	docid := h.PathVar("docid")
-	revid := h.getQuery("rev")
-	if revid == "" {
-		revid = h.rq.Header.Get("If-Match")
+	revid, err := h.getRevForWrite()
+	if err != nil {
+		return err
 	}
 	newRev, err := h.db.DeleteDoc(docid, revid)
 	if err == nil {
+		h.setHeader("Etag", strconv.Quote(newRev))
 		h.writeJSON(db.Body{"ok": true, "id": docid, "rev": newRev})
 	}
 	return err
@@ -353,3 +562,28 @@ func (h *handler) handleDelLocalDoc() error {
 	docid := h.PathVar("docid")
 	return h.db.DeleteSpecial("local", docid, h.getQuery("rev"))
 }
+
+// HTTP handler for GET /db/_local_docs: lists the _local documents with their sizes and last-modified times
+func (h *handler) handleListLocalDocs() error {
+	docs, err := h.db.ListLocalDocs()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"rows": docs, "total_rows": len(docs)})
+	return nil
+}
+
+// HTTP handler for DELETE /db/_local_docs?older_than_days=N: deletes the _local documents that haven't
+// been written for N days, such as the checkpoints of clients that no longer replicate.
+func (h *handler) handlePurgeLocalDocs() error {
+	days, err := strconv.ParseFloat(h.getQuery("older_than_days"), 64)
+	if err != nil || days < 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing or invalid older_than_days")
+	}
+	purged, err := h.db.PurgeLocalDocs(time.Now().Add(-time.Duration(days * 24 * float64(time.Hour))))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"purged": purged})
+	return nil
+}
@@ -10,6 +10,9 @@ import (
 	"github.com/couchbase/sync_gateway/base"
 )
 
+// Responses shorter than this aren't compressed, since it wouldn't save enough to be worth it.
+const minCompressedResponseSize = 1000
+
 // An implementation of http.ResponseWriter that wraps another instance and transparently applies
 // GZip compression when appropriate.
 type EncodedResponseWriter struct {
@@ -17,6 +20,8 @@ type EncodedResponseWriter struct {
 	gz        *gzip.Writer
 	status    int
 	sniffDone bool
+	buffering bool   // True while a compressible response is too short to tell if it's worth compressing
+	buffer    []byte // Output held back while buffering
 }
 
 // Creates a new EncodedResponseWriter, or returns nil if the request doesn't allow encoded responses.
@@ -46,12 +51,22 @@ func NewEncodedResponseWriter(response http.ResponseWriter, rq *http.Request) *E
 func (w *EncodedResponseWriter) WriteHeader(status int) {
 	w.status = status
 	w.sniff(nil) // Must do it now because headers can't be changed after WriteHeader call
-	w.ResponseWriter.WriteHeader(status)
+	if !w.buffering {
+		w.ResponseWriter.WriteHeader(status)
+	}
 }
 
 func (w *EncodedResponseWriter) Write(b []byte) (int, error) {
 	w.sniff(b)
-	if w.gz != nil {
+	if w.buffering {
+		w.buffer = append(w.buffer, b...)
+		if len(w.buffer) >= minCompressedResponseSize {
+			if err := w.startCompression(); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	} else if w.gz != nil {
 		return w.gz.Write(b)
 	} else {
 		return w.ResponseWriter.Write(b)
@@ -59,7 +74,9 @@ func (w *EncodedResponseWriter) Write(b []byte) (int, error) {
 }
 
 func (w *EncodedResponseWriter) disableCompression() {
-	if w.sniffDone {
+	if w.buffering {
+		w.stopBuffering()
+	} else if w.sniffDone {
 		base.Warn("EncodedResponseWriter: Too late to disableCompression!")
 	}
 	w.sniffDone = true
@@ -77,22 +94,54 @@ func (w *EncodedResponseWriter) sniff(bytes []byte) {
 		w.Header().Set("Content-Type", respType)
 	}
 
-	// Can/should we compress the response?
+	// Can/should we compress the response?  Not if it's already encoded (like a gzipped attachment
+	// served with ?content_encoding=false) or if it's a byte range.
 	if w.status >= 300 || w.Header().Get("Content-Encoding") != "" ||
+		w.Header().Get("X-Content-Encoding") != "" || w.Header().Get("Content-Range") != "" ||
 		(!strings.HasPrefix(respType, "application/json") && !strings.HasPrefix(respType, "text/") && !strings.HasPrefix(respType, "multipart/mixed")) {
 		return
 	}
 
-	// OK, we can compress the response:
+	// OK, we can compress the response, but hold the output back until there's enough of it:
+	w.buffering = true
+}
+
+// Starts compressing the response, beginning with the buffered output.
+func (w *EncodedResponseWriter) startCompression() error {
 	//base.LogTo("HTTP+", "GZip-compressing response")
+	w.buffering = false
 	w.Header().Set("Content-Encoding", "gzip")
 	w.Header().Del("Content-Length") // length is unknown due to compression
+	if w.status > 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
 
 	w.gz = GetGZipWriter(w.ResponseWriter)
+	_, err := w.gz.Write(w.buffer)
+	w.buffer = nil
+	return err
 }
 
-// Flushes the GZip encoder buffer, and if possible flushes output to the network.
+// Gives up on compressing the response, and writes the buffered output as-is.
+func (w *EncodedResponseWriter) stopBuffering() error {
+	w.buffering = false
+	if w.status > 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	var err error
+	if len(w.buffer) > 0 {
+		_, err = w.ResponseWriter.Write(w.buffer)
+	}
+	w.buffer = nil
+	return err
+}
+
+// Flushes the GZip encoder buffer, and if possible flushes output to the network.  A streaming
+// response (like a continuous changes feed) gets compressed even if its output so far is short.
 func (w *EncodedResponseWriter) Flush() {
+	if w.buffering {
+		w.startCompression()
+	}
 	if w.gz != nil {
 		w.gz.Flush()
 	}
@@ -104,6 +153,9 @@ func (w *EncodedResponseWriter) Flush() {
 
 // The writer should be closed when output is complete, to flush the GZip encoder buffer.
 func (w *EncodedResponseWriter) Close() {
+	if w.buffering {
+		w.stopBuffering() // The response was too short to compress
+	}
 	if w.gz != nil {
 		ReturnGZipWriter(w.gz)
 		w.gz = nil
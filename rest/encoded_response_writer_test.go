@@ -0,0 +1,76 @@
+package rest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func newTestEncodedResponseWriter(recorder *httptest.ResponseRecorder) *EncodedResponseWriter {
+	rq, _ := http.NewRequest("GET", "/db/_changes", nil)
+	rq.Header.Set("Accept-Encoding", "gzip")
+	return NewEncodedResponseWriter(recorder, rq)
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	unzip, err := gzip.NewReader(bytes.NewReader(data))
+	assert.Equals(t, err, nil)
+	result, _ := ioutil.ReadAll(unzip)
+	return string(result)
+}
+
+func TestEncodedResponseWriterMinSize(t *testing.T) {
+	// A short response isn't compressed:
+	recorder := httptest.NewRecorder()
+	w := newTestEncodedResponseWriter(recorder)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"rows":[`))
+	w.Write([]byte(`]}`))
+	w.Close()
+	assert.Equals(t, recorder.Header().Get("Content-Encoding"), "")
+	assert.Equals(t, recorder.Body.String(), `{"rows":[]}`)
+
+	// A long one is:
+	recorder = httptest.NewRecorder()
+	w = newTestEncodedResponseWriter(recorder)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	long := `"` + string(bytes.Repeat([]byte("x"), minCompressedResponseSize)) + `"`
+	w.Write([]byte(long))
+	w.Close()
+	assert.Equals(t, recorder.Code, http.StatusOK)
+	assert.Equals(t, recorder.Header().Get("Content-Encoding"), "gzip")
+	assert.Equals(t, gunzip(t, recorder.Body.Bytes()), long)
+
+	// An already-encoded one isn't:
+	recorder = httptest.NewRecorder()
+	w = newTestEncodedResponseWriter(recorder)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("X-Content-Encoding", "gzip")
+	w.Write([]byte(long))
+	w.Close()
+	assert.Equals(t, recorder.Header().Get("Content-Encoding"), "")
+	assert.Equals(t, recorder.Body.String(), long)
+}
+
+func TestEncodedResponseWriterFlush(t *testing.T) {
+	// Flushing a streamed response sends the output so far, compressed:
+	recorder := httptest.NewRecorder()
+	w := newTestEncodedResponseWriter(recorder)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"seq":1}` + "\n"))
+	w.Flush()
+	assert.Equals(t, recorder.Header().Get("Content-Encoding"), "gzip")
+	assert.True(t, recorder.Flushed)
+	assert.Equals(t, gunzip(t, recorder.Body.Bytes()), `{"seq":1}`+"\n")
+
+	w.Write([]byte(`{"seq":2}` + "\n"))
+	w.Close()
+	assert.Equals(t, gunzip(t, recorder.Body.Bytes()), `{"seq":1}`+"\n"+`{"seq":2}`+"\n")
+}
@@ -0,0 +1,143 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Number of export lines written between flushes of the response
+const kExportFlushInterval = 100
+
+// HTTP handler for GET /db/_export, which streams the current revision of every doc, in sequence
+// order, as newline-delimited JSON (see db.ExportLine.)  ?since resumes an interrupted export
+// after the seq of the last line received, and ?limit limits the number of docs.  By default
+// attachments are stubs; ?attachments=true puts their data in the docs, and ?attachments=only
+// exports just the attachments the stubs refer to, for importing alongside the docs.
+func (h *handler) handleExport() error {
+	h.setRequestClass(unlimitedRequest)
+	options := db.ExportOptions{
+		Since: h.getIntQuery("since", 0),
+		Limit: int(h.getIntQuery("limit", 0)),
+	}
+	switch h.getQuery("attachments") {
+	case "", "false":
+	case "true":
+		options.InlineAttachments = true
+	case "only":
+		options.AttachmentsOnly = true
+	default:
+		return base.HTTPErrorf(http.StatusBadRequest, "attachments must be true, false or only")
+	}
+
+	count := 0
+	err := h.db.Export(options, func(line *db.ExportLine) error {
+		if count == 0 {
+			h.setHeader("Content-Type", "application/x-ndjson")
+			h.response.WriteHeader(http.StatusOK)
+			h.setStatus(http.StatusOK, "")
+		}
+		h.addJSON(line)
+		if count++; count%kExportFlushInterval == 0 {
+			h.flush()
+		}
+		return nil
+	})
+	if count == 0 {
+		if err == nil {
+			h.setHeader("Content-Type", "application/x-ndjson")
+		}
+		return err
+	} else if err != nil {
+		// Too late to change the status; end with a line an import will reject
+		h.logContext.Warn("Export failed after %d lines: %v", count, err)
+		status, message := base.ErrorAsHTTPStatus(err)
+		h.addJSON(db.Body{"error": base.CouchHTTPErrorName(status), "reason": message})
+	}
+	return nil
+}
+
+// A line of an import that failed
+type importError struct {
+	Line   int    `json:"line"`
+	ID     string `json:"id,omitempty"`
+	Rev    string `json:"rev,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// Response of POST /db/_import
+type importResult struct {
+	Imported    int           `json:"imported"`    // Revisions added
+	Unchanged   int           `json:"unchanged"`   // Revisions the database already had
+	Attachments int           `json:"attachments"` // Attachments stored
+	Errors      []importError `json:"errors"`
+}
+
+// HTTP handler for POST /db/_import, which writes the docs and attachments of an export (in any
+// order) to the database.  The revisions keep their rev IDs and histories, and get new sequences.
+// A line that fails is listed in the response's errors, and the import goes on with the next.
+func (h *handler) handleImport() error {
+	h.setRequestClass(unlimitedRequest)
+	result := importResult{Errors: []importError{}}
+	reader := bufio.NewReader(h.requestBody)
+	for lineNum := 1; ; lineNum++ {
+		data, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			var line db.ExportLine
+			err := json.Unmarshal(data, &line)
+			if err != nil {
+				err = base.HTTPErrorf(http.StatusBadRequest, "Bad JSON")
+			} else {
+				var added bool
+				added, err = h.db.ImportExportLine(&line)
+				switch {
+				case err != nil:
+				case line.Digest != "":
+					result.Attachments++
+				case added:
+					result.Imported++
+				default:
+					result.Unchanged++
+				}
+			}
+			if err != nil {
+				status, message := base.ErrorAsHTTPStatus(err)
+				base.Logf("\tImport: line %d (doc %q) --> %d %s", lineNum, line.ID, status, message)
+				result.Errors = append(result.Errors, importError{
+					Line:   lineNum,
+					ID:     line.ID,
+					Rev:    line.Rev,
+					Digest: line.Digest,
+					Status: status,
+					Error:  base.CouchHTTPErrorName(status),
+					Reason: message,
+				})
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	h.writeJSON(result)
+	return nil
+}
@@ -0,0 +1,128 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func parseExportLines(t *testing.T, response *TestResponse) (lines []db.ExportLine) {
+	assertStatus(t, response, 200)
+	decoder := json.NewDecoder(bytes.NewReader(response.Body.Bytes()))
+	for decoder.More() {
+		var line db.ExportLine
+		assertNoError(t, decoder.Decode(&line), "Bad export line")
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Returns the "rev" property of a successful doc write's response.
+func respRevID(t *testing.T, response *TestResponse) string {
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	revid, _ := body["rev"].(string)
+	assert.True(t, revid != "")
+	return revid
+}
+
+func TestExportImport(t *testing.T) {
+	if !base.UnitTestUrlIsWalrus() {
+		t.Skip("Creates a second walrus database")
+	}
+	var rt RestTester
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/doc1", `{"n": 1}`)
+	assertStatus(t, response, 201)
+	response = rt.SendAdminRequest("PUT", "/db/doc1?rev="+respRevID(t, response), `{"n": 2}`)
+	assertStatus(t, response, 201)
+	doc1Rev := respRevID(t, response)
+	response = rt.SendAdminRequest("PUT", "/db/doc2", `{"_attachments": {"hello.txt": {"data": "aGVsbG8gd29ybGQ="}}}`)
+	assertStatus(t, response, 201)
+	response = rt.SendAdminRequest("PUT", "/db/doc3", `{"n": 3}`)
+	assertStatus(t, response, 201)
+	response = rt.SendAdminRequest("DELETE", "/db/doc3?rev="+respRevID(t, response), "")
+	assertStatus(t, response, 200)
+	rt.WaitForPendingChanges()
+
+	// Docs are exported in sequence order, with their histories and channels:
+	lines := parseExportLines(t, rt.SendAdminRequest("GET", "/db/_export", ""))
+	assert.Equals(t, len(lines), 3)
+	assert.Equals(t, lines[0].ID, "doc1")
+	assert.Equals(t, lines[0].Rev, doc1Rev)
+	assert.Equals(t, len(db.ParseRevisions(lines[0].Body)), 2)
+	assert.Equals(t, lines[1].ID, "doc2")
+	assert.Equals(t, lines[2].ID, "doc3")
+	assert.True(t, lines[2].Deleted)
+	assert.True(t, lines[0].Seq < lines[1].Seq && lines[1].Seq < lines[2].Seq)
+
+	// The export can be resumed after any line:
+	resumed := parseExportLines(t, rt.SendAdminRequest("GET", fmt.Sprintf("/db/_export?since=%d", lines[0].Seq), ""))
+	assert.Equals(t, len(resumed), 2)
+	assert.Equals(t, resumed[0].ID, "doc2")
+
+	attachments := parseExportLines(t, rt.SendAdminRequest("GET", "/db/_export?attachments=only", ""))
+	assert.Equals(t, len(attachments), 1)
+	assert.Equals(t, string(attachments[0].Data), "hello world")
+
+	// Import the attachments and docs into another database, with a couple of bad lines:
+	server, bucket := "walrus:", "export_target"
+	_, err := rt.ServerContext().AddDatabaseFromConfig(&DbConfig{
+		BucketConfig: BucketConfig{Server: &server, Bucket: &bucket},
+		Name:         "target",
+	})
+	assertNoError(t, err, "Couldn't add target db")
+	var input bytes.Buffer
+	encoder := json.NewEncoder(&input)
+	encoder.Encode(attachments[0])
+	for _, line := range lines {
+		encoder.Encode(line)
+	}
+	input.WriteString("{oops\n")
+	input.WriteString(`{"id": "doc4", "body": {"_revisions": "bogus"}}` + "\n")
+
+	response = rt.SendAdminRequest("POST", "/target/_import", input.String())
+	assertStatus(t, response, 200)
+	var result importResult
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.Equals(t, result.Imported, 3)
+	assert.Equals(t, result.Attachments, 1)
+	assert.Equals(t, len(result.Errors), 2)
+	assert.Equals(t, result.Errors[0].Line, 5)
+	assert.Equals(t, result.Errors[1].ID, "doc4")
+	assert.Equals(t, result.Errors[1].Status, 400)
+
+	// The revisions keep their IDs and histories:
+	var body db.Body
+	response = rt.SendAdminRequest("GET", "/target/doc1?revs=true", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["_rev"], doc1Rev)
+	assert.DeepEquals(t, db.ParseRevisions(body), db.ParseRevisions(lines[0].Body))
+	response = rt.SendAdminRequest("GET", "/target/doc2/hello.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "hello world")
+	assertStatus(t, rt.SendAdminRequest("GET", "/target/doc3", ""), 404)
+
+	// Importing again changes nothing:
+	response = rt.SendAdminRequest("POST", "/target/_import", input.String())
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.Equals(t, result.Imported, 0)
+	assert.Equals(t, result.Unchanged, 3)
+}
@@ -29,7 +29,10 @@ func (h *handler) handleFacebookPOST() error {
 	// CORS not allowed for login #115 #762
 	originHeader := h.rq.Header["Origin"]
 	if len(originHeader) > 0 {
-		matched := matchedOrigin(h.server.config.CORS.LoginOrigin, originHeader)
+		matched := ""
+		if cors := h.server.corsConfigFor(h.PathVar("db")); cors != nil {
+			matched = matchedOrigin(cors.LoginOrigin, originHeader)
+		}
 		if matched == "" {
 			return base.HTTPErrorf(http.StatusBadRequest, "No CORS")
 		}
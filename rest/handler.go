@@ -12,6 +12,7 @@ package rest
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"expvar"
@@ -57,6 +58,12 @@ var kBadRequestError = base.HTTPErrorf(http.StatusMethodNotAllowed, "Bad Request
 
 var checkAuthRollingMean = base.NewIntRollingMeanVar(100)
 
+// Retry-After values of 503 responses to requests for a database that's offline, or going on/offline
+const (
+	kOfflineRetryAfterSecs    = 30
+	kTransitionRetryAfterSecs = 5
+)
+
 func init() {
 	base.StatsExpvars.Set("handler.CheckAuthRollingMean", &checkAuthRollingMean)
 }
@@ -74,8 +81,17 @@ type handler struct {
 	privs          handlerPrivs
 	startTime      time.Time
 	serialNumber   uint64
+	logContext     *base.LogContext // Tags the request's log messages with its X-Request-Id
 	loggedDuration bool
 	runOffline     bool
+	timingResponse *timingResponseWriter // Wraps the original ResponseWriter, to time the response
+	isFeed         bool                  // True for feeds, which are timed to the first byte only
+	adminKey       string                // Name of the admin key the request was made with, if any
+	spool          *db.AttachmentSpool   // Holds attachments read from MIME parts until the request ends
+	ctx            context.Context       // Cancelled when the request times out or its client goes away
+	cancelCtx      context.CancelFunc    // Cancels ctx
+	deadlineTimer  *time.Timer           // Cancels ctx at the request's deadline; see setRequestClass
+	timedOut       int32                 // Set (atomically) once the deadline has passed
 }
 
 type handlerPrivs int
@@ -90,36 +106,43 @@ type handlerMethod func(*handler) error
 
 // Creates an http.Handler that will run a handler with the given method
 func makeHandler(server *ServerContext, privs handlerPrivs, method handlerMethod) http.Handler {
+	handlerName := handlerMethodName(method)
 	return http.HandlerFunc(func(r http.ResponseWriter, rq *http.Request) {
 		runOffline := false
 		h := newHandler(server, privs, r, rq, runOffline)
 		err := h.invoke(method)
 		h.writeError(err)
 		h.logDuration(true)
+		h.recordTiming(handlerName)
 	})
 }
 
 // Creates an http.Handler that will run a handler with the given method even if the target DB is offline
 func makeOfflineHandler(server *ServerContext, privs handlerPrivs, method handlerMethod) http.Handler {
+	handlerName := handlerMethodName(method)
 	return http.HandlerFunc(func(r http.ResponseWriter, rq *http.Request) {
 		runOffline := true
 		h := newHandler(server, privs, r, rq, runOffline)
 		err := h.invoke(method)
 		h.writeError(err)
 		h.logDuration(true)
+		h.recordTiming(handlerName)
 	})
 }
 
 func newHandler(server *ServerContext, privs handlerPrivs, r http.ResponseWriter, rq *http.Request, runOffline bool) *handler {
+	timingResponse := &timingResponseWriter{ResponseWriter: r}
 	return &handler{
-		server:       server,
-		privs:        privs,
-		rq:           rq,
-		response:     r,
-		status:       http.StatusOK,
-		serialNumber: atomic.AddUint64(&lastSerialNum, 1),
-		startTime:    time.Now(),
-		runOffline:   runOffline,
+		server:         server,
+		privs:          privs,
+		rq:             rq,
+		response:       timingResponse,
+		status:         http.StatusOK,
+		serialNumber:   atomic.AddUint64(&lastSerialNum, 1),
+		logContext:     &base.LogContext{RequestID: base.CreateUUID()[:8], ClientIP: server.config.trustedProxies.clientAddress(rq)},
+		startTime:      time.Now(),
+		runOffline:     runOffline,
+		timingResponse: timingResponse,
 	}
 }
 
@@ -128,6 +151,15 @@ func (h *handler) invoke(method handlerMethod) error {
 	base.StatsExpvars.Add("requests_total", 1)
 	base.StatsExpvars.Add("requests_active", 1)
 	defer base.StatsExpvars.Add("requests_active", -1)
+	defer func() {
+		if h.spool != nil {
+			h.spool.Close()
+		}
+	}()
+	h.startRequestTimeout()
+	defer h.stopRequestTimeout()
+
+	h.setHeader("X-Request-Id", h.logContext.RequestID)
 
 	var err error
 	if h.server.config.CompressResponses == nil || *h.server.config.CompressResponses {
@@ -154,10 +186,12 @@ func (h *handler) invoke(method handlerMethod) error {
 	// If there is a "db" path variable, look up the database context:
 	var dbContext *db.DatabaseContext
 	if dbname := h.PathVar("db"); dbname != "" {
+		h.logContext.Database = dbname
 		if dbContext, err = h.server.GetDatabase(dbname); err != nil {
 			h.logRequestLine()
 			return err
 		}
+		h.logContext.Keys = dbContext.LogKeys
 	}
 
 	// If this call is in the context of a DB make sure the DB is in a valid state
@@ -177,20 +211,34 @@ func (h *handler) invoke(method handlerMethod) error {
 			//if dbState == db.DBOnline, continue flow and invoke the handler method
 			if dbState == db.DBOffline {
 				//DB is offline, only handlers with runOffline true can run in this state
+				h.setHeader("Retry-After", strconv.Itoa(kOfflineRetryAfterSecs))
 				return base.HTTPErrorf(http.StatusServiceUnavailable, "DB is currently under maintenance")
 			} else if dbState != db.DBOnline {
 				//DB is in transition state, no calls will be accepted until it is Online or Offline state
+				h.setHeader("Retry-After", strconv.Itoa(kTransitionRetryAfterSecs))
 				return base.HTTPErrorf(http.StatusServiceUnavailable, fmt.Sprintf("DB is %v - try again later", db.RunStateString[dbState]))
 			}
 		}
 	}
 
-	// Authenticate, if not on admin port:
-	if h.privs != adminPrivs {
+	// Authenticate; on the admin port, only by admin key (if any are configured):
+	if h.privs == adminPrivs {
+		if err = h.checkAdminAuth(); err != nil {
+			h.logRequestLine()
+			return err
+		}
+		h.logAdminAudit()
+	} else {
 		if err = h.checkAuth(dbContext); err != nil {
+			if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusUnauthorized {
+				base.MetricAuthFailures.Add(h.logContext.Database, 1)
+			}
 			h.logRequestLine()
 			return err
 		}
+		if h.user != nil {
+			h.logContext.User = h.user.Name()
+		}
 	}
 
 	h.logRequestLine()
@@ -205,6 +253,8 @@ func (h *handler) invoke(method handlerMethod) error {
 		if err != nil {
 			return err
 		}
+		h.db.LogContext = h.logContext
+		h.db = h.db.WithCancel(h.requestDone())
 	}
 
 	if base.EnableLogHTTPBodies {
@@ -226,7 +276,9 @@ func (h *handler) logRequestLine() {
 		return
 	}
 	as := ""
-	if h.privs == adminPrivs {
+	if h.privs == adminPrivs && h.adminKey != "" {
+		as = fmt.Sprintf("  (ADMIN key %s)", h.adminKey)
+	} else if h.privs == adminPrivs {
 		as = "  (ADMIN)"
 	} else if h.user != nil && h.user.Name() != "" {
 		as = fmt.Sprintf("  (as %s)", h.user.Name())
@@ -236,7 +288,7 @@ func (h *handler) logRequestLine() {
 		proto = " HTTP/2"
 	}
 
-	base.LogTo("HTTP", " #%03d: %s %s%s%s", h.serialNumber, h.rq.Method, base.SanitizeRequestURL(h.rq.URL), proto, as)
+	h.logContext.LogTo("HTTP", " #%03d: %s %s%s%s", h.serialNumber, h.rq.Method, base.SanitizeRequestURL(h.rq.URL), proto, as)
 }
 
 func (h *handler) logRequestBody() {
@@ -275,7 +327,7 @@ func (h *handler) logDuration(realTime bool) {
 	if h.status >= 300 {
 		logKey = "HTTP"
 	}
-	base.LogTo(logKey, "#%03d:     --> %d %s  (%.1f ms)",
+	h.logContext.LogTo(logKey, "#%03d:     --> %d %s  (%.1f ms)",
 		h.serialNumber, h.status, h.statusMessage,
 		float64(duration)/float64(time.Millisecond))
 }
@@ -295,8 +347,27 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 	defer checkAuthRollingMean.AddSince(time.Now())
 
 	var err error
+	// If client cert auth is enabled, check for a TLS client cert
+	if certAuth := h.server.config.ClientCertAuth; certAuth != nil {
+		if h.user, err = certAuth.authenticate(context.Authenticator(), h.rq.TLS); err != nil || h.user != nil {
+			return err
+		}
+	}
+
+	// If bearer JWTs are enabled, check for one (unless it's an OIDC token for an OIDC provider)
+	if context.JWTBearer != nil {
+		if token := h.getBearerToken(); token != "" && (context.GetOptions().OIDCOptions == nil || context.JWTBearer.IsIssuerOf(token)) {
+			h.user, err = context.Authenticator().AuthenticateBearerJWT(token, context.JWTBearer)
+			if h.user == nil || err != nil {
+				h.response.Header().Set("WWW-Authenticate", `Bearer realm="Couchbase Sync Gateway", error="invalid_token"`)
+				return base.HTTPErrorf(http.StatusUnauthorized, "Invalid bearer token")
+			}
+			return nil
+		}
+	}
+
 	// If oidc enabled, check for bearer ID token
-	if context.Options.OIDCOptions != nil {
+	if context.GetOptions().OIDCOptions != nil {
 		if token := h.getBearerToken(); token != "" {
 			h.user, _, err = context.Authenticator().AuthenticateUntrustedJWT(token, context.OIDCProviders, h.getOIDCCallbackURL)
 			if h.user == nil || err != nil {
@@ -311,9 +382,9 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 		* and the username and password match those in the oidc default provider config
 		* then authorize this request
 		 */
-		if context.Options.UnsupportedOptions.OidcTestProvider.Enabled && strings.HasSuffix(h.rq.URL.Path, "/_oidc_testing/token") {
+		if context.GetOptions().UnsupportedOptions.OidcTestProvider.Enabled && strings.HasSuffix(h.rq.URL.Path, "/_oidc_testing/token") {
 			if username, password := h.getBasicAuth(); username != "" && password != "" {
-				provider := context.Options.OIDCOptions.Providers.GetProviderForIssuer(issuerUrlForDB(h, context.Name), testProviderAudiences)
+				provider := context.GetOptions().OIDCOptions.Providers.GetProviderForIssuer(issuerUrlForDB(h, context.Name), testProviderAudiences)
 				if provider != nil && provider.ClientID != nil && provider.ValidationKey != nil {
 					if *provider.ClientID == username && *provider.ValidationKey == password {
 						return nil
@@ -343,6 +414,19 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 	}
 
 	// No auth given -- check guest access
+	if context.GetOptions().DisableGuest {
+		// Don't even look at the guest user; handlers that don't require auth get a disabled one.
+		// The database info stays readable, so that clients can find out that they need to log in.
+		if h.privs == regularPrivs && !h.isDBInfoRequest() {
+			h.response.Header().Set("WWW-Authenticate", `Basic realm="Couchbase Sync Gateway"`)
+			return base.HTTPErrorf(http.StatusUnauthorized, "Login required")
+		}
+		h.user = context.Authenticator().DisabledGuestUser()
+		return nil
+	}
+	if err = h.checkGuestRateLimit(context); err != nil {
+		return err
+	}
 	if h.user, err = context.Authenticator().GetUser(""); err != nil {
 		return err
 	}
@@ -354,6 +438,37 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 	return nil
 }
 
+// Is this a GET or HEAD of the database's root, which is handled by handleGetDB?
+func (h *handler) isDBInfoRequest() bool {
+	if h.rq.Method != "GET" && h.rq.Method != "HEAD" {
+		return false
+	}
+	return h.rq.URL.Path == "/"+h.PathVar("db")+"/"
+}
+
+// Applies the database's guest rate limit, if any, to an unauthenticated request.
+func (h *handler) checkGuestRateLimit(context *db.DatabaseContext) error {
+	if context.GuestRateLimiter == nil {
+		return nil
+	}
+	if ok, retryAfter := context.GuestRateLimiter.Allow(h.clientAddress()); !ok {
+		return h.guestRateLimited(retryAfter)
+	}
+	return nil
+}
+
+// Returns the 429 error for a client that's over the guest rate limit.
+func (h *handler) guestRateLimited(retryAfter time.Duration) error {
+	base.StatsExpvars.Add("guest_rateLimited", 1)
+	h.setHeader("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return base.HTTPErrorf(http.StatusTooManyRequests, "Too many requests")
+}
+
+// Returns the IP address of the client making the request, as seen through any trusted proxies.
+func (h *handler) clientAddress() string {
+	return h.logContext.ClientIP
+}
+
 func (h *handler) assertAdminOnly() {
 	if h.privs != adminPrivs {
 		panic("Admin-only handler called without admin privileges, on " + h.rq.RequestURI)
@@ -362,18 +477,42 @@ func (h *handler) assertAdminOnly() {
 
 func (h *handler) PathVar(name string) string {
 	v := mux.Vars(h.rq)[name]
-
-	//Escape special chars i.e. '+' otherwise they are removed by QueryUnescape()
-	v = strings.Replace(v, "+", "%2B", -1)
+	if !h.pathVarsEscaped() {
+		return v
+	}
 
 	// Before routing the URL we explicitly disabled expansion of %-escapes in the path
 	// (see function FixQuotedSlashes). So we have to unescape them now.
-	v, _ = url.QueryUnescape(v)
-	return v
+	return unescapePathSegment(v)
 }
 
 func (h *handler) SetPathVar(name string, value string) {
-	mux.Vars(h.rq)[name] = url.QueryEscape(value)
+	if h.pathVarsEscaped() {
+		value = escapePathSegment(value)
+	}
+	mux.Vars(h.rq)[name] = value
+}
+
+// Escapes a string, such as a doc ID, to be a single segment of a URL path; unlike
+// url.QueryEscape this escapes a space as "%20", since a "+" in a path is literal.
+func escapePathSegment(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// Unescapes a segment of a raw URL path.
+func unescapePathSegment(s string) string {
+	//Escape special chars i.e. '+' otherwise they are removed by QueryUnescape()
+	s = strings.Replace(s, "+", "%2B", -1)
+	s, _ = url.QueryUnescape(s)
+	return s
+}
+
+// Returns true if the URL was routed by its raw path, so its path variables still contain
+// %-escapes.  That's the case if FixQuotedSlashes replaced the path with the raw one, or if the
+// path had no escapes to begin with.  Otherwise they were already unescaped, and unescaping them
+// again would mangle IDs containing "%".
+func (h *handler) pathVarsEscaped() bool {
+	return rawRequestPath(h.rq) == h.rq.URL.Path
 }
 
 func (h *handler) getQuery(query string) string {
@@ -461,24 +600,103 @@ func (h *handler) readDocument() (db.Body, error) {
 				return nil, err
 			}
 			reader := multipart.NewReader(bytes.NewReader(raw), attrs["boundary"])
-			body, err := db.ReadMultipartDocument(reader)
+			body, err := db.ReadMultipartDocument(reader, h.attachmentSpool())
 			if err != nil {
 				ioutil.WriteFile("GatewayPUT.mime", raw, 0600)
-				base.Warn("Error reading MIME data: copied to file GatewayPUT.mime")
+				h.logContext.Warn("Error reading MIME data: copied to file GatewayPUT.mime")
 			}
 			return body, err
 		} else {
 			reader := multipart.NewReader(h.requestBody, attrs["boundary"])
-			return db.ReadMultipartDocument(reader)
+			return db.ReadMultipartDocument(reader, h.attachmentSpool())
 		}
 	default:
 		return nil, base.HTTPErrorf(http.StatusUnsupportedMediaType, "Invalid content type %s", contentType)
 	}
 }
 
+// Returns the spool that holds the attachments read from the request's MIME parts; it's closed
+// when the request has been handled.
+func (h *handler) attachmentSpool() *db.AttachmentSpool {
+	if h.spool == nil {
+		h.spool = db.NewAttachmentSpool(db.DefaultAttachmentSpoolThreshold)
+	}
+	return h.spool
+}
+
+// Returns true if the request's Accept header allows a response of the given MIME type.  A type
+// ending in "/", like "multipart/", stands for any of its subtypes.  Media ranges with q=0 refuse
+// their types.
 func (h *handler) requestAccepts(mimetype string) bool {
 	accept := h.rq.Header.Get("Accept")
-	return accept == "" || strings.Contains(accept, mimetype) || strings.Contains(accept, "*/*")
+	if accept == "" {
+		return true
+	}
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			continue
+		}
+		if mediaType == "*/*" || mediaType == mimetype ||
+			(strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(mimetype, strings.TrimSuffix(mediaType, "*"))) ||
+			(strings.HasSuffix(mimetype, "/") && strings.HasPrefix(mediaType, mimetype)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the entity tag in a request header like If-Match, without its quotes, or "" if the
+// header is missing.
+func (h *handler) getETagHeader(name string) string {
+	return unquoteETag(h.rq.Header.Get(name))
+}
+
+// Returns true if the request's If-None-Match header matches an entity tag.
+func (h *handler) ifNoneMatch(etag string) bool {
+	header := h.rq.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if tag = unquoteETag(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes a 304 Not Modified response, with no body.
+func (h *handler) writeNotModified(etag string) {
+	h.setHeader("Etag", strconv.Quote(etag))
+	h.response.WriteHeader(http.StatusNotModified)
+	h.setStatus(http.StatusNotModified, "Not Modified")
+}
+
+// Returns the revision ID a write applies to, from the "rev" query parameter or the If-Match
+// header.  It's an error for them to disagree.
+func (h *handler) getRevForWrite() (string, error) {
+	revid := h.getQuery("rev")
+	if ifMatch := h.getETagHeader("If-Match"); ifMatch != "" {
+		if revid != "" && revid != ifMatch {
+			return "", base.HTTPErrorf(http.StatusBadRequest, "rev parameter doesn't match If-Match header")
+		}
+		revid = ifMatch
+	}
+	return revid, nil
+}
+
+// Strips the quotes, and the "W/" prefix of a weak tag, from an entity tag.  (Rev IDs and digests
+// are never reused for different content, so weak tags can be compared like strong ones.)
+func unquoteETag(tag string) string {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	if unquoted, err := strconv.Unquote(tag); err == nil {
+		return unquoted
+	}
+	return tag
 }
 
 func (h *handler) getBasicAuth() (username string, password string) {
@@ -542,14 +760,14 @@ func (h *handler) disableResponseCompression() {
 // If status is nonzero, the header will be written with that status.
 func (h *handler) writeJSONStatus(status int, value interface{}) {
 	if !h.requestAccepts("application/json") {
-		base.Warn("Client won't accept JSON, only %s", h.rq.Header.Get("Accept"))
+		h.logContext.Warn("Client won't accept JSON, only %s", h.rq.Header.Get("Accept"))
 		h.writeStatus(http.StatusNotAcceptable, "only application/json available")
 		return
 	}
 
 	jsonOut, err := json.Marshal(value)
 	if err != nil {
-		base.Warn("Couldn't serialize JSON for %v : %s", value, err)
+		h.logContext.Warn("Couldn't serialize JSON for %v : %s", value, err)
 		h.writeStatus(http.StatusInternalServerError, "JSON serialization failed")
 		return
 	}
@@ -560,7 +778,7 @@ func (h *handler) writeJSONStatus(status int, value interface{}) {
 	}
 	h.setHeader("Content-Type", "application/json")
 	if h.rq.Method != "HEAD" {
-		if len(jsonOut) < 1000 {
+		if len(jsonOut) < minCompressedResponseSize {
 			h.disableResponseCompression()
 		}
 		h.setHeader("Content-Length", fmt.Sprintf("%d", len(jsonOut)))
@@ -585,7 +803,7 @@ func (h *handler) writeText(value []byte) {
 
 func (h *handler) writeTextStatus(status int, value []byte) {
 	if !h.requestAccepts("text/plain") {
-		base.Warn("Client won't accept text/plain, only %s", h.rq.Header.Get("Accept"))
+		h.logContext.Warn("Client won't accept text/plain, only %s", h.rq.Header.Get("Accept"))
 		h.writeStatus(http.StatusNotAcceptable, "only text/plain available")
 		return
 	}
@@ -606,7 +824,7 @@ func (h *handler) addJSON(value interface{}) {
 	encoder := json.NewEncoder(h.response)
 	err := encoder.Encode(value)
 	if err != nil {
-		base.Warn("Couldn't serialize JSON for %v : %s", value, err)
+		h.logContext.Warn("Couldn't serialize JSON for %v : %s", value, err)
 		panic("JSON serialization failed")
 	}
 }
@@ -652,13 +870,24 @@ func (h *handler) flush() {
 func (h *handler) writeError(err error) {
 	if err != nil {
 		err = auth.OIDCToHTTPError(err) // Map OIDC/OAuth2 errors to HTTP form
+		if err == db.ErrRequestCancelled {
+			err = h.cancellationError()
+		}
+		if circuitErr, ok := err.(*base.CircuitOpenError); ok {
+			h.setHeader("Retry-After", strconv.Itoa(int(math.Ceil(circuitErr.RetryAfter.Seconds()))))
+		}
 		status, message := base.ErrorAsHTTPStatus(err)
-		h.writeStatus(status, message)
+		h.writeStatusWithDetails(status, message, h.errorDetails(err))
 	}
 }
 
 // Writes the response status code, and if it's an error writes a JSON description to the body.
 func (h *handler) writeStatus(status int, message string) {
+	h.writeStatusWithDetails(status, message, nil)
+}
+
+// Like writeStatus, but adds the given properties to the JSON description of an error.
+func (h *handler) writeStatusWithDetails(status int, message string, details db.Body) {
 	if status < 300 {
 		h.response.WriteHeader(status)
 		h.setStatus(status, message)
@@ -682,10 +911,41 @@ func (h *handler) writeStatus(status int, message string) {
 	h.setHeader("Content-Type", "application/json")
 	h.response.WriteHeader(status)
 	h.setStatus(status, message)
-	jsonOut, _ := json.Marshal(db.Body{"error": errorStr, "reason": message})
+	body := db.Body{"error": errorStr, "reason": message}
+	for key, value := range details {
+		body[key] = value
+	}
+	jsonOut, _ := json.Marshal(body)
 	h.response.Write(jsonOut)
 }
 
+// Returns the properties to add to the JSON description of an error, beyond its status and reason:
+// a more specific "error" name than its status gives, or the details of a conflict.
+func (h *handler) errorDetails(err error) db.Body {
+	if _, ok := err.(*base.RevIDMismatchError); ok {
+		return db.Body{"error": "bad_rev_id"}
+	}
+	return h.conflictDetails(err)
+}
+
+// If the error is a document update conflict, returns the properties describing the doc's current
+// state to add to the error response: "current_rev", "deleted", and, if the request has
+// ?conflict_leaves=true, "leaves".  Otherwise returns nil.
+func (h *handler) conflictDetails(err error) db.Body {
+	conflictErr, ok := err.(*base.DocConflictError)
+	if !ok {
+		return nil
+	}
+	details := db.Body{"deleted": conflictErr.Deleted}
+	if conflictErr.CurrentRev != "" {
+		details["current_rev"] = conflictErr.CurrentRev
+	}
+	if h.getBoolQuery("conflict_leaves") {
+		details["leaves"] = conflictErr.Leaves
+	}
+	return details
+}
+
 var kRangeRegex = regexp.MustCompile("^bytes=(\\d+)?-(\\d+)?$")
 
 // Detects and partially HTTP content range requests.
@@ -100,7 +100,7 @@ var authCodeTokenMap map[string]AuthState = make(map[string]AuthState)
  * Returns the OpenID provider configuration info
  */
 func (h *handler) handleOidcProviderConfiguration() error {
-	if !h.db.DatabaseContext.Options.UnsupportedOptions.OidcTestProvider.Enabled {
+	if !h.db.GetOptions().UnsupportedOptions.OidcTestProvider.Enabled {
 		return base.HTTPErrorf(http.StatusForbidden, "OIDC test provider is not enabled")
 	}
 
@@ -141,7 +141,7 @@ type AuthorizeParameters struct {
  * which is part of an internal authentication flow
  */
 func (h *handler) handleOidcTestProviderAuthorize() error {
-	if !h.db.DatabaseContext.Options.UnsupportedOptions.OidcTestProvider.Enabled {
+	if !h.db.GetOptions().UnsupportedOptions.OidcTestProvider.Enabled {
 		return base.HTTPErrorf(http.StatusForbidden, "OIDC test provider is not enabled")
 	}
 
@@ -200,7 +200,7 @@ type OidcTokenResponse struct {
  * Return tokens for Auth code flow
  */
 func (h *handler) handleOidcTestProviderToken() error {
-	if !h.db.DatabaseContext.Options.UnsupportedOptions.OidcTestProvider.Enabled {
+	if !h.db.GetOptions().UnsupportedOptions.OidcTestProvider.Enabled {
 		return base.HTTPErrorf(http.StatusForbidden, "OIDC test provider is not enabled")
 	}
 
@@ -222,7 +222,7 @@ func (h *handler) handleOidcTestProviderToken() error {
  * Return public certificates for signing keys
  */
 func (h *handler) handleOidcTestProviderCerts() error {
-	if !h.db.DatabaseContext.Options.UnsupportedOptions.OidcTestProvider.Enabled {
+	if !h.db.GetOptions().UnsupportedOptions.OidcTestProvider.Enabled {
 		return base.HTTPErrorf(http.StatusForbidden, "OIDC test provider is not enabled")
 	}
 
@@ -259,7 +259,7 @@ func (h *handler) handleOidcTestProviderCerts() error {
  * Return an OAuth 2.0 Authorization Response
  */
 func (h *handler) handleOidcTestProviderAuthenticate() error {
-	if !h.db.DatabaseContext.Options.UnsupportedOptions.OidcTestProvider.Enabled {
+	if !h.db.GetOptions().UnsupportedOptions.OidcTestProvider.Enabled {
 		return base.HTTPErrorf(http.StatusForbidden, "OIDC test provider is not enabled")
 	}
 
@@ -448,7 +448,7 @@ func writeTokenResponse(h *handler, subject string, issuerUrl string, tokenttl t
 		refreshToken = base64.StdEncoding.EncodeToString([]byte(subject + ":::" + accessToken))
 	}
 
-	idToken, err := createJWTToken(subject, issuerUrl, tokenttl, scopesMap, h.db.DatabaseContext.Options.UnsupportedOptions.OidcTestProvider.UnsignedIDToken)
+	idToken, err := createJWTToken(subject, issuerUrl, tokenttl, scopesMap, h.db.GetOptions().UnsupportedOptions.OidcTestProvider.UnsignedIDToken)
 	if err != nil {
 		return base.HTTPErrorf(http.StatusInternalServerError, "Unable to generate OIDC Auth Token")
 	}
@@ -0,0 +1,147 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A request's deadline depends on the kind of endpoint it's for: reads and writes of docs,
+// attachments and the like get a short one, and bulk operations, queries and one-shot changes
+// feeds a longer one.  Feeds that wait for changes (longpoll, continuous, websocket and BLIP) have
+// none; a heartbeat that can't be written ends them instead.  When the deadline passes (or the
+// client goes away) the request's context is cancelled, which makes its db.Database fail its next
+// read or write with a 503 saying which it was.  A one-shot changes feed fails with a 503 too if
+// it hasn't sent any changes yet; otherwise it's cut short, for the client to resume.
+
+// Default max durations of requests
+const (
+	DefaultReadRequestTimeout  = 30 * time.Second
+	DefaultWriteRequestTimeout = 60 * time.Second
+	DefaultBulkRequestTimeout  = 5 * time.Minute
+)
+
+// The kinds of endpoints, by deadline
+type requestClass int
+
+const (
+	readRequest      requestClass = iota // GET or HEAD of a doc, attachment etc.
+	writeRequest                         // Other methods on a doc, attachment etc.
+	bulkRequest                          // Bulk operations, queries and one-shot changes feeds
+	unlimitedRequest                     // Feeds that wait for changes, and streams like _export
+)
+
+// Max durations of requests by kind of endpoint, in seconds; 0 for no limit.
+type RequestTimeoutsConfig struct {
+	ReadSecs  *int `json:"read_secs,omitempty"`  // GETs of docs, attachments etc.; defaults to 30
+	WriteSecs *int `json:"write_secs,omitempty"` // Writes of docs, attachments etc.; defaults to 60
+	BulkSecs  *int `json:"bulk_secs,omitempty"`  // Bulk operations, queries and one-shot changes feeds; defaults to 300
+}
+
+func (config *RequestTimeoutsConfig) validate() error {
+	for name, secs := range map[string]*int{"read_secs": config.ReadSecs, "write_secs": config.WriteSecs, "bulk_secs": config.BulkSecs} {
+		if secs != nil && *secs < 0 {
+			return fmt.Errorf("request_timeouts.%s can't be negative", name)
+		}
+	}
+	return nil
+}
+
+// Returns the max duration of a kind of request, or 0 for no limit.
+func (config *RequestTimeoutsConfig) timeout(class requestClass) time.Duration {
+	var secs *int
+	var timeout time.Duration
+	switch class {
+	case readRequest:
+		timeout = DefaultReadRequestTimeout
+		if config != nil {
+			secs = config.ReadSecs
+		}
+	case writeRequest:
+		timeout = DefaultWriteRequestTimeout
+		if config != nil {
+			secs = config.WriteSecs
+		}
+	case bulkRequest:
+		timeout = DefaultBulkRequestTimeout
+		if config != nil {
+			secs = config.BulkSecs
+		}
+	default:
+		return 0
+	}
+	if secs != nil {
+		timeout = time.Duration(*secs) * time.Second
+	}
+	return timeout
+}
+
+// Creates the request's context, with the deadline of a read or write by its method.
+func (h *handler) startRequestTimeout() {
+	h.ctx, h.cancelCtx = context.WithCancel(h.rq.Context())
+	if h.rq.Method == "GET" || h.rq.Method == "HEAD" {
+		h.setRequestClass(readRequest)
+	} else {
+		h.setRequestClass(writeRequest)
+	}
+}
+
+// Changes the request's deadline to that of another kind of endpoint.  It still counts from the
+// start of the request.
+func (h *handler) setRequestClass(class requestClass) {
+	if h.ctx == nil {
+		return
+	}
+	if h.deadlineTimer != nil {
+		h.deadlineTimer.Stop()
+		h.deadlineTimer = nil
+	}
+	if timeout := h.server.config.RequestTimeouts.timeout(class); timeout > 0 {
+		h.deadlineTimer = time.AfterFunc(timeout-time.Since(h.startTime), func() {
+			atomic.StoreInt32(&h.timedOut, 1)
+			h.cancelCtx()
+		})
+	}
+}
+
+// Returns a channel that's closed when the request times out or its client goes away.
+func (h *handler) requestDone() <-chan struct{} {
+	if h.ctx == nil {
+		return nil
+	}
+	return h.ctx.Done()
+}
+
+// Returns true if the request has run past its deadline.
+func (h *handler) requestTimedOut() bool {
+	return atomic.LoadInt32(&h.timedOut) != 0
+}
+
+// Returns the 503 error of a cancelled request, telling whether it ran past its deadline or its
+// client went away.
+func (h *handler) cancellationError() error {
+	if h.requestTimedOut() {
+		return base.HTTPErrorf(http.StatusServiceUnavailable, "Request timed out")
+	}
+	return base.HTTPErrorf(http.StatusServiceUnavailable, "Request cancelled by the client")
+}
+
+func (h *handler) stopRequestTimeout() {
+	if h.deadlineTimer != nil {
+		h.deadlineTimer.Stop()
+	}
+	h.cancelCtx()
+}
@@ -0,0 +1,82 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestRequestTimeoutsConfig(t *testing.T) {
+	var config *RequestTimeoutsConfig
+	assert.Equals(t, config.timeout(readRequest), DefaultReadRequestTimeout)
+	assert.Equals(t, config.timeout(writeRequest), DefaultWriteRequestTimeout)
+	assert.Equals(t, config.timeout(bulkRequest), DefaultBulkRequestTimeout)
+	assert.Equals(t, config.timeout(unlimitedRequest), time.Duration(0))
+
+	five, zero, negative := 5, 0, -1
+	config = &RequestTimeoutsConfig{ReadSecs: &five, BulkSecs: &zero}
+	assertNoError(t, config.validate(), "validate")
+	assert.Equals(t, config.timeout(readRequest), 5*time.Second)
+	assert.Equals(t, config.timeout(writeRequest), DefaultWriteRequestTimeout)
+	assert.Equals(t, config.timeout(bulkRequest), time.Duration(0))
+
+	config.WriteSecs = &negative
+	assert.True(t, config.validate() != nil)
+}
+
+func TestRequestDeadline(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	// A request that's run past its deadline is cancelled:
+	h := newHandler(rt.ServerContext(), regularPrivs, httptest.NewRecorder(), request("PUT", "/db/doc", "{}"), false)
+	h.startTime = time.Now().Add(-time.Hour)
+	h.startRequestTimeout()
+	defer h.stopRequestTimeout()
+	select {
+	case <-h.requestDone():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Request wasn't cancelled at its deadline")
+	}
+	assert.True(t, h.requestTimedOut())
+	status, message := base.ErrorAsHTTPStatus(h.cancellationError())
+	assert.Equals(t, status, 503)
+	assert.Equals(t, message, "Request timed out")
+
+	// ...and so is its Database's next write:
+	database, err := db.GetDatabase(rt.GetDatabase(), nil)
+	assertNoError(t, err, "GetDatabase")
+	_, err = database.WithCancel(h.requestDone()).Put("doc", db.Body{})
+	assert.Equals(t, err, db.ErrRequestCancelled)
+	_, err = database.Put("doc", db.Body{})
+	assertNoError(t, err, "Put")
+
+	// A bulk request's deadline is longer, and a feed has none:
+	h = newHandler(rt.ServerContext(), regularPrivs, httptest.NewRecorder(), request("GET", "/db/_changes", ""), false)
+	h.startRequestTimeout()
+	defer h.stopRequestTimeout()
+	h.setRequestClass(bulkRequest)
+	assert.True(t, h.deadlineTimer != nil)
+	h.setFeed()
+	assert.True(t, h.deadlineTimer == nil)
+	assert.False(t, h.requestTimedOut())
+
+	// A request whose client went away isn't reported as timed out:
+	h.cancelCtx()
+	status, message = base.ErrorAsHTTPStatus(h.cancellationError())
+	assert.Equals(t, status, 503)
+	assert.Equals(t, message, "Request cancelled by the client")
+}
@@ -0,0 +1,221 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Requests taking longer than this are logged as warnings, unless the config sets a threshold.
+const DefaultSlowRequestThreshold = 2 * time.Second
+
+// Upper bounds, in ms, of the buckets of the request latency histograms.  The last bucket counts
+// everything slower.
+var requestTimingBucketsMs = []int64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// The timings of the requests to one handler with one method.  Feeds (continuous, longpoll and
+// websocket _changes, and BLIP sync) are supposed to be long, so only their time to first byte is
+// recorded.
+type requestTiming struct {
+	Count            int64   `json:"count"`
+	TotalMs          float64 `json:"total_ms"`
+	Buckets          []int64 `json:"buckets"` // Counts of requests by latency; see BucketBoundsMs
+	Feeds            int64   `json:"feeds,omitempty"`
+	FeedFirstByteMs  float64 `json:"feed_first_byte_total_ms,omitempty"`
+	FeedsNoFirstByte int64   `json:"feeds_no_first_byte,omitempty"` // Feeds that ended without sending anything
+}
+
+// Timings of the requests to each handler, keyed by method and handler name (e.g. "GET handleGetDoc.")
+// Implements expvar.Var, so it can be published in base.StatsExpvars.
+type requestTimings struct {
+	lock     sync.Mutex
+	handlers map[string]*requestTiming
+}
+
+// A snapshot of the request timings, as returned by the admin API's /_stats.
+type requestTimingsSnapshot struct {
+	BucketBoundsMs []int64                   `json:"bucket_bounds_ms"`
+	Handlers       map[string]*requestTiming `json:"handlers"`
+}
+
+var handlerTimings = &requestTimings{handlers: map[string]*requestTiming{}}
+
+func init() {
+	base.StatsExpvars.Set("requestTimings", handlerTimings)
+}
+
+func (timings *requestTimings) timing(method, handlerName string) *requestTiming {
+	key := method + " " + handlerName
+	timing := timings.handlers[key]
+	if timing == nil {
+		timing = &requestTiming{Buckets: make([]int64, len(requestTimingBucketsMs)+1)}
+		timings.handlers[key] = timing
+	}
+	return timing
+}
+
+// Records the duration of a request.
+func (timings *requestTimings) recordRequest(method, handlerName string, duration time.Duration) {
+	bucket := len(requestTimingBucketsMs)
+	for i, boundMs := range requestTimingBucketsMs {
+		if duration <= time.Duration(boundMs)*time.Millisecond {
+			bucket = i
+			break
+		}
+	}
+	timings.lock.Lock()
+	defer timings.lock.Unlock()
+	timing := timings.timing(method, handlerName)
+	timing.Count++
+	timing.TotalMs += float64(duration) / float64(time.Millisecond)
+	timing.Buckets[bucket]++
+}
+
+// Records the time to first byte of a feed, or that it didn't send anything if firstByte is negative.
+func (timings *requestTimings) recordFeed(method, handlerName string, firstByte time.Duration) {
+	timings.lock.Lock()
+	defer timings.lock.Unlock()
+	timing := timings.timing(method, handlerName)
+	timing.Feeds++
+	if firstByte >= 0 {
+		timing.FeedFirstByteMs += float64(firstByte) / float64(time.Millisecond)
+	} else {
+		timing.FeedsNoFirstByte++
+	}
+}
+
+func (timings *requestTimings) snapshot() requestTimingsSnapshot {
+	timings.lock.Lock()
+	defer timings.lock.Unlock()
+	snapshot := requestTimingsSnapshot{
+		BucketBoundsMs: requestTimingBucketsMs,
+		Handlers:       make(map[string]*requestTiming, len(timings.handlers)),
+	}
+	for key, timing := range timings.handlers {
+		timingCopy := *timing
+		timingCopy.Buckets = append([]int64(nil), timing.Buckets...)
+		snapshot.Handlers[key] = &timingCopy
+	}
+	return snapshot
+}
+
+// expvar.Var interface
+func (timings *requestTimings) String() string {
+	data, _ := json.Marshal(timings.snapshot())
+	return string(data)
+}
+
+// The name of a handler method, e.g. "handleGetDoc", for its timings.
+func handlerMethodName(method handlerMethod) string {
+	name := runtime.FuncForPC(reflect.ValueOf(method).Pointer()).Name()
+	name = strings.TrimSuffix(name, "-fm")
+	if i := strings.LastIndex(name, "."); i >= 0 && i < len(name)-1 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// Records the request's timing, and logs it if it was slow.  Feeds only record their time to first
+// byte, and are never logged as slow.
+func (h *handler) recordTiming(handlerName string) {
+	if h.isFeed {
+		firstByte := time.Duration(-1)
+		if !h.timingResponse.firstByte.IsZero() {
+			firstByte = h.timingResponse.firstByte.Sub(h.startTime)
+		}
+		handlerTimings.recordFeed(h.rq.Method, handlerName, firstByte)
+		return
+	}
+
+	duration := time.Since(h.startTime)
+	handlerTimings.recordRequest(h.rq.Method, handlerName, duration)
+
+	threshold := DefaultSlowRequestThreshold
+	if ms := h.server.config.SlowRequestThresholdMs; ms != nil {
+		threshold = time.Duration(*ms) * time.Millisecond
+	}
+	if threshold > 0 && duration > threshold {
+		user := "GUEST"
+		if h.privs == adminPrivs {
+			user = "ADMIN"
+		} else if h.user != nil && h.user.Name() != "" {
+			user = h.user.Name()
+		}
+		h.logContext.Warn("Slow request #%03d: %s %s (as %s) --> %d in %.1f ms, %d bytes written",
+			h.serialNumber, h.rq.Method, base.SanitizeRequestURL(h.rq.URL), user, h.status,
+			float64(duration)/float64(time.Millisecond), h.timingResponse.bytesWritten)
+	}
+}
+
+// Marks the request as a feed, which is supposed to be long, so that only its time to first byte
+// is recorded.
+func (h *handler) setFeed() {
+	h.isFeed = true
+	h.setRequestClass(unlimitedRequest)
+}
+
+// Wraps a handler's http.ResponseWriter to record when the response started and how many bytes
+// were written.  It passes through the optional interfaces the handlers use.
+type timingResponseWriter struct {
+	http.ResponseWriter
+	firstByte    time.Time
+	bytesWritten int64
+}
+
+func (w *timingResponseWriter) markFirstByte() {
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
+}
+
+func (w *timingResponseWriter) WriteHeader(status int) {
+	w.markFirstByte()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timingResponseWriter) Write(b []byte) (int, error) {
+	w.markFirstByte()
+	n, err := w.ResponseWriter.Write(b)
+	w.bytesWritten += int64(n)
+	return n, err
+}
+
+func (w *timingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *timingResponseWriter) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return nil
+}
+
+func (w *timingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T doesn't support hijacking", w.ResponseWriter)
+	}
+	w.markFirstByte()
+	return hijacker.Hijack()
+}
@@ -0,0 +1,66 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestHandlerMethodName(t *testing.T) {
+	assert.Equals(t, handlerMethodName((*handler).handleGetDoc), "handleGetDoc")
+	assert.Equals(t, handlerMethodName((*handler).handleChanges), "handleChanges")
+}
+
+func TestRequestTimings(t *testing.T) {
+	timings := &requestTimings{handlers: map[string]*requestTiming{}}
+	timings.recordRequest("GET", "handleGetDoc", 3*time.Millisecond)
+	timings.recordRequest("GET", "handleGetDoc", 30*time.Millisecond)
+	timings.recordRequest("GET", "handleGetDoc", time.Minute)
+	timings.recordFeed("GET", "handleChanges", 20*time.Millisecond)
+	timings.recordFeed("GET", "handleChanges", -1)
+
+	snapshot := timings.snapshot()
+	getDoc := snapshot.Handlers["GET handleGetDoc"]
+	assert.Equals(t, getDoc.Count, int64(3))
+	assert.Equals(t, getDoc.TotalMs, float64(60033))
+	assert.Equals(t, getDoc.Buckets[0], int64(1))
+	assert.Equals(t, getDoc.Buckets[3], int64(1))
+	assert.Equals(t, getDoc.Buckets[len(requestTimingBucketsMs)], int64(1))
+
+	changes := snapshot.Handlers["GET handleChanges"]
+	assert.Equals(t, changes.Count, int64(0))
+	assert.Equals(t, changes.Feeds, int64(2))
+	assert.Equals(t, changes.FeedFirstByteMs, float64(20))
+	assert.Equals(t, changes.FeedsNoFirstByte, int64(1))
+}
+
+func TestRequestTimingsInStats(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+	assertStatus(t, rt.SendRequest("PUT", "/db/doc1", `{"k":"v"}`), 201)
+	assertStatus(t, rt.SendRequest("GET", "/db/doc1", ""), 200)
+
+	response := rt.SendAdminRequest("GET", "/_stats", "")
+	assertStatus(t, response, 200)
+	var stats struct {
+		RequestTimings struct {
+			BucketBoundsMs []int64                  `json:"bucket_bounds_ms"`
+			Handlers       map[string]requestTiming `json:"handlers"`
+		}
+	}
+	assertNoError(t, json.Unmarshal(response.Body.Bytes(), &stats), "Unmarshal")
+	assert.Equals(t, len(stats.RequestTimings.BucketBoundsMs), len(requestTimingBucketsMs))
+	assert.True(t, stats.RequestTimings.Handlers["GET handleGetDoc"].Count >= 1)
+	assert.True(t, stats.RequestTimings.Handlers["PUT handlePutDoc"].Count >= 1)
+}
@@ -11,7 +11,6 @@ package rest
 
 import (
 	"net/http"
-	"regexp"
 	"strconv"
 	"strings"
 
@@ -25,15 +24,6 @@ import (
 const dbRegex = "[^_/][^/]*"
 const docRegex = "[^_/][^/]*"
 
-// Regex that matches a URI containing either:
-//  - A regular doc ID with an escaped "/" character
-//  - A user name with an escaped "/" character
-var docWithSlashPathRegex *regexp.Regexp
-
-func init() {
-	docWithSlashPathRegex, _ = regexp.Compile("/" + dbRegex + "/([^_]|_user/).*%2[fF]")
-}
-
 // Creates a GorillaMux router containing the basic HTTP handlers for a server.
 // This is the common functionality of the public and admin ports.
 // The 'privs' parameter specifies the authentication the handler will use.
@@ -42,6 +32,7 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 	r.StrictSlash(true)
 	// Global operations:
 	r.Handle("/", makeHandler(sc, privs, (*handler).handleRoot)).Methods("GET", "HEAD")
+	r.Handle("/_status", makeHandler(sc, privs, (*handler).handleStatus)).Methods("GET", "HEAD")
 
 	// Operations on databases:
 	r.Handle("/{db:"+dbRegex+"}/", makeOfflineHandler(sc, privs, (*handler).handleGetDB)).Methods("GET", "HEAD")
@@ -60,6 +51,7 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 	dbr.Handle("/_design/{ddoc}/_view/{view}", makeHandler(sc, privs, (*handler).handleView)).Methods("GET")
 	dbr.Handle("/_ensure_full_commit", makeHandler(sc, privs, (*handler).handleEFC)).Methods("POST")
 	dbr.Handle("/_revs_diff", makeHandler(sc, privs, (*handler).handleRevsDiff)).Methods("POST")
+	dbr.Handle("/_attachment/{digest:.+}", makeHandler(sc, privs, (*handler).handleGetAttachmentByDigest)).Methods("GET", "HEAD")
 
 	// Document URLs:
 	dbr.Handle("/_local/{docid}", makeHandler(sc, privs, (*handler).handleGetLocalDoc)).Methods("GET", "HEAD")
@@ -72,6 +64,7 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 
 	dbr.Handle("/{docid:"+docRegex+"}/{attach}", makeHandler(sc, privs, (*handler).handleGetAttachment)).Methods("GET", "HEAD")
 	dbr.Handle("/{docid:"+docRegex+"}/{attach}", makeHandler(sc, privs, (*handler).handlePutAttachment)).Methods("PUT")
+	dbr.Handle("/{docid:"+docRegex+"}/{attach}", makeHandler(sc, privs, (*handler).handleDeleteAttachment)).Methods("DELETE")
 
 	// Session/login URLs are per-database (unlike in CouchDB)
 	// These have public privileges so that they can be called without being logged in already
@@ -121,6 +114,8 @@ func CreatePublicHandler(sc *ServerContext) http.Handler {
 		(*handler).handleSessionPOST)).Methods("POST")
 	dbr.Handle("/_session", makeHandler(sc, regularPrivs,
 		(*handler).handleSessionDELETE)).Methods("DELETE")
+	dbr.Handle("/_user/_password", makeHandler(sc, regularPrivs,
+		(*handler).handleChangePassword)).Methods("PUT")
 	// The routine below is part of the CouchDB REST API, users can't create DB's via the pblic API
 	// but if the client set the 'createTarget' property of the Replicatior SG should return HTTP status 412
 	// if the db exists, and 403 if it doesn't.
@@ -168,10 +163,17 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 	dbr.Handle("/_revtree/{docid:"+docRegex+"}",
 		makeHandler(sc, adminPrivs, (*handler).handleGetRevTree)).Methods("GET")
 
+	dbr.Handle("/_rejections",
+		makeHandler(sc, adminPrivs, (*handler).handleGetRejections)).Methods("GET")
+
 	dbr.Handle("/_user/",
 		makeHandler(sc, adminPrivs, (*handler).getUsers)).Methods("GET", "HEAD")
 	dbr.Handle("/_user/",
 		makeHandler(sc, adminPrivs, (*handler).putUser)).Methods("POST")
+	dbr.Handle("/_user/_bulk",
+		makeHandler(sc, adminPrivs, (*handler).putUsersBulk)).Methods("POST")
+	dbr.Handle("/_user/_refresh",
+		makeHandler(sc, adminPrivs, (*handler).refreshAllUsers)).Methods("POST")
 	dbr.Handle("/_user/{name}",
 		makeHandler(sc, adminPrivs, (*handler).getUserInfo)).Methods("GET", "HEAD")
 	dbr.Handle("/_user/{name}",
@@ -181,13 +183,21 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 
 	dbr.Handle("/_user/{name}/_session",
 		makeHandler(sc, adminPrivs, (*handler).deleteUserSessions)).Methods("DELETE")
+	dbr.Handle("/_user/{name}/_sessions",
+		makeHandler(sc, adminPrivs, (*handler).getUserSessions)).Methods("GET", "HEAD")
 	dbr.Handle("/_user/{name}/_session/{sessionid}",
 		makeHandler(sc, adminPrivs, (*handler).deleteUserSession)).Methods("DELETE")
+	dbr.Handle("/_user/{name}/_sync_status",
+		makeHandler(sc, adminPrivs, (*handler).getUserSyncStatus)).Methods("GET", "HEAD")
+	dbr.Handle("/_user/{name}/_refresh",
+		makeHandler(sc, adminPrivs, (*handler).refreshUser)).Methods("POST")
 
 	dbr.Handle("/_role/",
 		makeHandler(sc, adminPrivs, (*handler).getRoles)).Methods("GET", "HEAD")
 	dbr.Handle("/_role/",
 		makeHandler(sc, adminPrivs, (*handler).putRole)).Methods("POST")
+	dbr.Handle("/_role/_bulk",
+		makeHandler(sc, adminPrivs, (*handler).putRolesBulk)).Methods("POST")
 	dbr.Handle("/_role/{name}",
 		makeHandler(sc, adminPrivs, (*handler).getRoleInfo)).Methods("GET", "HEAD")
 	dbr.Handle("/_role/{name}",
@@ -199,6 +209,8 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeHandler(sc, adminPrivs, (*handler).handleGetLogging)).Methods("GET")
 	r.Handle("/_logging",
 		makeHandler(sc, adminPrivs, (*handler).handleSetLogging)).Methods("PUT", "POST")
+	r.Handle("/_logging",
+		makeHandler(sc, adminPrivs, (*handler).handleDeleteLogging)).Methods("DELETE")
 	r.Handle("/_profile/{name}",
 		makeHandler(sc, adminPrivs, (*handler).handleProfiling)).Methods("POST")
 	r.Handle("/_profile",
@@ -209,12 +221,16 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeHandler(sc, adminPrivs, (*handler).handleStats)).Methods("GET")
 	r.Handle(kDebugURLPathPrefix,
 		makeHandler(sc, adminPrivs, (*handler).handleExpvar)).Methods("GET")
+	r.Handle("/_metrics",
+		makeHandler(sc, adminPrivs, (*handler).handleMetrics)).Methods("GET")
 	r.Handle("/_config",
 		makeHandler(sc, adminPrivs, (*handler).handleGetConfig)).Methods("GET")
 	r.Handle("/_replicate",
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleReplicate)).Methods("POST")
 	r.Handle("/_active_tasks",
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleActiveTasks)).Methods("GET")
+	r.Handle("/_changes_feeds",
+		makeHandler(sc, adminPrivs, (*handler).handleGetChangesFeeds)).Methods("GET")
 
 	// Debugging handlers
 	r.Handle("/_debug/pprof/goroutine",
@@ -241,12 +257,30 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeOfflineHandler(sc, adminPrivs, (*handler).handlePutDbConfig)).Methods("PUT")
 	dbr.Handle("/_resync",
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleResync)).Methods("POST")
+	dbr.Handle("/_resync",
+		makeOfflineHandler(sc, adminPrivs, (*handler).handleGetResync)).Methods("GET")
+	dbr.Handle("/_consistency_check",
+		makeHandler(sc, adminPrivs, (*handler).handleConsistencyCheck)).Methods("POST")
+	dbr.Handle("/_consistency_check",
+		makeHandler(sc, adminPrivs, (*handler).handleGetConsistencyCheck)).Methods("GET")
+	dbr.Handle("/_local_docs",
+		makeHandler(sc, adminPrivs, (*handler).handleListLocalDocs)).Methods("GET")
+	dbr.Handle("/_local_docs",
+		makeHandler(sc, adminPrivs, (*handler).handlePurgeLocalDocs)).Methods("DELETE")
+	dbr.Handle("/_channels",
+		makeHandler(sc, adminPrivs, (*handler).handleGetChannelStats)).Methods("GET")
+	dbr.Handle("/_sync_fn_epochs",
+		makeHandler(sc, adminPrivs, (*handler).handleGetSyncFnEpochs)).Methods("GET")
 	dbr.Handle("/_vacuum",
 		makeHandler(sc, adminPrivs, (*handler).handleVacuum)).Methods("POST")
 	dbr.Handle("/_purge",
 		makeHandler(sc, adminPrivs, (*handler).handlePurge)).Methods("POST")
 	dbr.Handle("/_flush",
 		makeHandler(sc, adminPrivs, (*handler).handleFlush)).Methods("POST")
+	dbr.Handle("/_export",
+		makeHandler(sc, adminPrivs, (*handler).handleExport)).Methods("GET")
+	dbr.Handle("/_import",
+		makeHandler(sc, adminPrivs, (*handler).handleImport)).Methods("POST")
 	dbr.Handle("/_online",
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleDbOnline)).Methods("POST")
 	dbr.Handle("/_offline",
@@ -257,6 +291,12 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeHandler(sc, adminPrivs, (*handler).handleView)).Methods("GET")
 	dbr.Handle("/_dumpchannel/{channel}",
 		makeHandler(sc, adminPrivs, (*handler).handleDumpChannel)).Methods("GET")
+	dbr.Handle("/_sync_function_test",
+		makeHandler(sc, adminPrivs, (*handler).handleSyncFunctionTest)).Methods("POST")
+	dbr.Handle("/_skipped_sequences",
+		makeHandler(sc, adminPrivs, (*handler).handleGetSkippedSequences)).Methods("GET")
+	dbr.Handle("/_release_sequence/{seq}",
+		makeHandler(sc, adminPrivs, (*handler).handleReleaseSequence)).Methods("POST")
 	dbr.Handle("/_index",
 		makeHandler(sc, adminPrivs, (*handler).handleIndex)).Methods("GET")
 	dbr.Handle("/_index/channel/{channel}",
@@ -287,13 +327,22 @@ func wrapRouter(sc *ServerContext, privs handlerPrivs, router *mux.Router) http.
 		FixQuotedSlashes(rq)
 		var match mux.RouteMatch
 
-		// Inject CORS if enabled and requested and not admin port
+		// Inject CORS if enabled and requested and not admin port.  Requests from origins that
+		// aren't allowed are still served, just without CORS headers.
+		var cors *CORSConfig
 		originHeader := rq.Header["Origin"]
-		if privs != adminPrivs && sc.config.CORS != nil && len(originHeader) > 0 {
-			origin := matchedOrigin(sc.config.CORS.Origin, originHeader)
-			response.Header().Add("Access-Control-Allow-Origin", origin)
-			response.Header().Add("Access-Control-Allow-Credentials", "true")
-			response.Header().Add("Access-Control-Allow-Headers", strings.Join(sc.config.CORS.Headers, ", "))
+		if privs != adminPrivs && len(originHeader) > 0 {
+			if cors = sc.corsConfigFor(dbNameFromPath(rawRequestPath(rq))); cors != nil {
+				response.Header().Add("Vary", "Origin")
+				if origin := matchedOrigin(cors.Origin, originHeader); origin != "" {
+					response.Header().Add("Access-Control-Allow-Origin", origin)
+					response.Header().Add("Access-Control-Allow-Credentials", "true")
+					response.Header().Add("Access-Control-Allow-Headers", strings.Join(cors.Headers, ", "))
+					response.Header().Add("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+				} else {
+					cors = nil
+				}
+			}
 		}
 
 		if router.Match(rq, &match) {
@@ -314,8 +363,8 @@ func wrapRouter(sc *ServerContext, privs handlerPrivs, router *mux.Router) http.
 				h.writeStatus(http.StatusNotFound, "unknown URL")
 			} else {
 				response.Header().Add("Allow", strings.Join(options, ", "))
-				if privs != adminPrivs && sc.config.CORS != nil && len(originHeader) > 0 {
-					response.Header().Add("Access-Control-Max-Age", strconv.Itoa(sc.config.CORS.MaxAge))
+				if cors != nil {
+					response.Header().Add("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
 					response.Header().Add("Access-Control-Allow-Methods", strings.Join(options, ", "))
 				}
 				if rq.Method != "OPTIONS" {
@@ -329,29 +378,65 @@ func wrapRouter(sc *ServerContext, privs handlerPrivs, router *mux.Router) http.
 	})
 }
 
+// Response headers that CORS clients are allowed to read
+var corsExposedHeaders = []string{"Content-Length", "Content-Range", "Etag", "Location", "Retry-After", "X-Delta-Source", "X-Request-Id"}
+
+// Returns the first of the request's origins that's allowed, or "" if none is.  An allowed origin
+// may be "*" to allow any origin, or contain a "*" wildcard, like "https://*.example.com".  The
+// request's own origin is returned even if it matched "*", since credentials are allowed.
 func matchedOrigin(allowOrigins []string, rqOrigins []string) string {
 	for _, rv := range rqOrigins {
 		for _, av := range allowOrigins {
-			if rv == av {
-				return av
+			if originMatches(av, rv) {
+				return rv
 			}
 		}
 	}
-	for _, av := range allowOrigins {
-		if av == "*" {
-			return "*"
-		}
-	}
 	return ""
 }
 
+func originMatches(pattern string, origin string) bool {
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+	if star := strings.Index(pattern, "*"); star >= 0 {
+		prefix, suffix := pattern[0:star], pattern[star+1:]
+		return len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) &&
+			strings.HasSuffix(origin, suffix)
+	}
+	return false
+}
+
+// Returns the database name a raw (still escaped) URL path refers to, or "" if it's a
+// server-level path.
+func dbNameFromPath(path string) string {
+	name := strings.TrimPrefix(path, "/")
+	if slash := strings.Index(name, "/"); slash >= 0 {
+		name = name[0:slash]
+	}
+	if strings.HasPrefix(name, "_") {
+		return ""
+	}
+	return unescapePathSegment(name)
+}
+
+// Returns the path of a request's URL as the client sent it, with its %-escapes.
+func rawRequestPath(rq *http.Request) string {
+	path := rq.RequestURI
+	if stop := strings.IndexAny(path, "?#"); stop >= 0 {
+		path = path[0:stop]
+	}
+	return path
+}
+
+// The router matches a URL against its unescaped path, so an escaped "/" (%2F) in a database name,
+// doc ID, attachment name, user name etc. would split it into two path segments.  To prevent that,
+// a URL whose path contains one is routed by its raw path instead, and the handler unescapes the
+// path variables afterwards (see handler.PathVar.)
 func FixQuotedSlashes(rq *http.Request) {
-	uri := rq.RequestURI
-	if docWithSlashPathRegex.MatchString(uri) {
-		if stop := strings.IndexAny(uri, "?#"); stop >= 0 {
-			uri = uri[0:stop]
-		}
-		rq.URL.Path = uri
+	path := rawRequestPath(rq)
+	if strings.Contains(path, "%2F") || strings.Contains(path, "%2f") {
+		rq.URL.Path = path
 	}
 }
 
@@ -26,6 +26,7 @@ import (
 
 	"github.com/couchbase/go-couchbase"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbase/sync_gateway/db"
 	"github.com/couchbaselabs/sg-replicate"
 )
@@ -42,12 +43,15 @@ const KDefaultNumShards = 16
 // This struct is accessed from HTTP handlers running on multiple goroutines, so it needs to
 // be thread-safe.
 type ServerContext struct {
-	config      *ServerConfig
-	databases_  map[string]*db.DatabaseContext
-	lock        sync.RWMutex
-	statsTicker *time.Ticker
-	HTTPClient  *http.Client
-	replicator  *base.Replicator
+	config       *ServerConfig
+	databases_   map[string]*db.DatabaseContext
+	lock         sync.RWMutex
+	statsTicker  *time.Ticker
+	HTTPClient   *http.Client
+	replicator   *base.Replicator
+	state        uint32               // serverRunning, serverDraining or serverStopped; access atomically
+	stopped      chan struct{}        // Closed when Shutdown has finished
+	changesFeeds *changesFeedRegistry // _changes feeds in progress
 }
 
 func NewServerContext(config *ServerConfig) *ServerContext {
@@ -56,7 +60,9 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 		databases_: map[string]*db.DatabaseContext{},
 		HTTPClient: http.DefaultClient,
 		replicator: base.NewReplicator(),
+		stopped:    make(chan struct{}),
 	}
+	sc.changesFeeds = newChangesFeedRegistry(config.ChangesFeedLimit)
 	if config.Databases == nil {
 		config.Databases = DbConfigMap{}
 	}
@@ -81,6 +87,16 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 	}
 	couchbase.SlowServerCallWarningThreshold = time.Duration(slow) * time.Millisecond
 
+	if config.ExtraChannelNameChars != nil {
+		if err := channels.SetExtraChannelNameChars(*config.ExtraChannelNameChars); err != nil {
+			base.Warn("Ignoring extra_channel_name_chars: %v", err)
+		}
+	}
+
+	if config.JSPool != nil {
+		channels.ConfigureJSRunnerPool(config.JSPool.options())
+	}
+
 	if config.DeploymentID != nil {
 		sc.startStatsReporter()
 	}
@@ -177,6 +193,16 @@ func (sc *ServerContext) GetDatabaseConfig(name string) *DbConfig {
 	return config
 }
 
+// Returns the CORS config of a database, or the server's if the database doesn't have its own.
+func (sc *ServerContext) corsConfigFor(dbName string) *CORSConfig {
+	if dbName != "" {
+		if config := sc.GetDatabaseConfig(dbName); config != nil && config.CORS != nil {
+			return config.CORS
+		}
+	}
+	return sc.config.CORS
+}
+
 func (sc *ServerContext) GetConfig() *ServerConfig {
 	return sc.config
 }
@@ -213,7 +239,7 @@ func (sc *ServerContext) numIndexWriters() (numIndexWriters, numIndexNonWriters
 		if strings.ToLower(dbContext.BucketSpec.FeedType) != base.DcpShardFeedType {
 			continue
 		}
-		if dbContext.Options.IndexOptions.Writer {
+		if dbContext.GetOptions().IndexOptions.Writer {
 			numIndexWriters += 1
 		} else {
 			numIndexNonWriters += 1
@@ -319,6 +345,7 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		Auth:            config,
 		CouchbaseDriver: couchbaseDriver,
 		UseXattrs:       config.UseXattrs(),
+		DCPCheckpoints:  true,
 	}
 
 	// Set cache properties, if present
@@ -338,16 +365,7 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 			db.EnableStarChannelLog = *config.CacheConfig.EnableStarChannel
 		}
 
-		if config.CacheConfig.ChannelCacheMaxLength != nil && *config.CacheConfig.ChannelCacheMaxLength > 0 {
-			cacheOptions.ChannelCacheMaxLength = *config.CacheConfig.ChannelCacheMaxLength
-		}
-		if config.CacheConfig.ChannelCacheMinLength != nil && *config.CacheConfig.ChannelCacheMinLength > 0 {
-			cacheOptions.ChannelCacheMinLength = *config.CacheConfig.ChannelCacheMinLength
-		}
-		if config.CacheConfig.ChannelCacheAge != nil && *config.CacheConfig.ChannelCacheAge > 0 {
-			cacheOptions.ChannelCacheAge = time.Duration(*config.CacheConfig.ChannelCacheAge) * time.Second
-		}
-
+		cacheOptions.ChannelCacheOptions = channelCacheOptions(config.CacheConfig)
 	}
 
 	bucket, err := db.ConnectToBucket(spec, func(bucket string, err error) {
@@ -476,6 +494,27 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 	} else {
 		revCacheSize = db.KDefaultRevisionCacheCapacity
 	}
+	var revCacheMaxBytes int64
+	if config.RevCacheMaxBytes != nil {
+		revCacheMaxBytes = int64(*config.RevCacheMaxBytes)
+	}
+
+	var syncFnTimeout time.Duration
+	if config.SyncFnTimeoutSecs != nil && *config.SyncFnTimeoutSecs > 0 {
+		syncFnTimeout = time.Duration(*config.SyncFnTimeoutSecs) * time.Second
+	}
+
+	var bcryptCost int
+	if config.BcryptCost != nil {
+		bcryptCost = *config.BcryptCost
+	} else if sc.config.BcryptCost != nil {
+		bcryptCost = *sc.config.BcryptCost
+	}
+
+	var maxSessionTTL time.Duration
+	if config.MaxSessionTTLSecs != nil && *config.MaxSessionTTLSecs > 0 {
+		maxSessionTTL = time.Duration(*config.MaxSessionTTLSecs) * time.Second
+	}
 
 	// Enable doc tracking if needed for autoImport or shadowing.  Only supported for non-xattr configurations
 	trackDocs := false
@@ -494,11 +533,93 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		IndexOptions:          channelIndexOptions,
 		SequenceHashOptions:   sequenceHashOptions,
 		RevisionCacheCapacity: revCacheSize,
+		RevisionCacheMaxBytes: revCacheMaxBytes,
 		AdminInterface:        sc.config.AdminInterface,
 		UnsupportedOptions:    config.Unsupported,
 		TrackDocs:             trackDocs,
 		OIDCOptions:           config.OIDCConfig,
+		JWTBearerOptions:      config.JWTConfig,
 		DBOnlineCallback:      dbOnlineCallback,
+		SyncFnTimeout:         syncFnTimeout,
+		MaxChannelsPerDoc:     config.MaxChannelsPerDoc,
+		MaxSessionTTL:         maxSessionTTL,
+		BcryptCost:            bcryptCost,
+		ValidateFnTimeout:     config.validateFnTimeout(),
+	}
+	if config.MaxBulkDocs != nil {
+		contextOptions.MaxBulkDocs = *config.MaxBulkDocs
+	}
+	if config.MaxBulkDocsBytes != nil {
+		contextOptions.MaxBulkDocsBytes = *config.MaxBulkDocsBytes
+	}
+	if config.MaxAllDocsKeys != nil {
+		contextOptions.MaxAllDocsKeys = *config.MaxAllDocsKeys
+	}
+	if config.MaxBulkPrincipals != nil {
+		contextOptions.MaxBulkPrincipals = *config.MaxBulkPrincipals
+	}
+	if config.MaxLocalDocBytes != nil {
+		contextOptions.MaxLocalDocBytes = *config.MaxLocalDocBytes
+	}
+	if config.ChangesBuffer != nil {
+		contextOptions.ChangesBuffer = *config.ChangesBuffer
+	}
+	contextOptions.LogKeys = config.LogKeys
+	if config.LogLevel != nil {
+		contextOptions.LogLevel = *config.LogLevel
+	}
+	contextOptions.BucketRetry = config.BucketRetry
+	contextOptions.ViewQuery = config.ViewQuery
+	contextOptions.N1QL = config.N1QL
+	contextOptions.ChangesFilters = config.changesFilters()
+	if config.ClusterCompatVersion != nil {
+		contextOptions.ClusterCompatVersion = *config.ClusterCompatVersion
+	}
+	if config.OutOfLineBodyThreshold != nil {
+		contextOptions.OutOfLineBodyThreshold = *config.OutOfLineBodyThreshold
+	}
+	contextOptions.InlineBodies = config.InlineBodies
+	contextOptions.VerifyRevIDs = config.VerifyRevIDs
+	contextOptions.DisableGuest = config.DisableGuest
+	contextOptions.SessionCleanup = config.SessionCleanup.options()
+	contextOptions.RejectDeletionAttachments = config.DeletionAttachments != nil && *config.DeletionAttachments == "reject"
+	if config.MaxChangesRows != nil {
+		contextOptions.MaxChangesRows = *config.MaxChangesRows
+	}
+	if config.MaxChangesSecs != nil {
+		contextOptions.MaxChangesDuration = time.Duration(*config.MaxChangesSecs) * time.Second
+	}
+	contextOptions.PasswordPolicy = config.PasswordPolicy.options()
+	if config.MaxDocIDLength != nil {
+		contextOptions.MaxDocIDLength = *config.MaxDocIDLength
+	}
+	if config.MaxAttNameLength != nil {
+		contextOptions.MaxAttachmentNameLength = *config.MaxAttNameLength
+	}
+	if config.DeltaMaxBodyBytes != nil {
+		contextOptions.BodyDeltaMaxBytes = *config.DeltaMaxBodyBytes
+	}
+	if config.DeltaMaxRatio != nil {
+		contextOptions.BodyDeltaMaxRatio = *config.DeltaMaxRatio
+	}
+	if config.MaxOperationIDs != nil {
+		contextOptions.MaxOperationIDs = *config.MaxOperationIDs
+	}
+	if config.OperationIDTTLSecs != nil {
+		contextOptions.OperationIDTTL = time.Duration(*config.OperationIDTTLSecs) * time.Second
+	}
+	contextOptions.HideSyncRejectionMessages = config.HideSyncRejections
+	if config.ChannelHistoryRetention != nil {
+		contextOptions.ChannelHistoryRetention = *config.ChannelHistoryRetention
+	}
+	if config.ImportFilter != nil {
+		contextOptions.ImportFilter = db.NewImportFilterFunction(*config.ImportFilter)
+	}
+	if guest := config.Users[base.GuestUsername]; guest != nil {
+		contextOptions.GuestRateLimit = guest.RateLimit
+		if guest.MaxChannels != nil {
+			contextOptions.GuestMaxChannels = *guest.MaxChannels
+		}
 	}
 
 	// Create the DB Context
@@ -515,6 +636,7 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 	if err := sc.applySyncFunction(dbcontext, syncFn); err != nil {
 		return nil, err
 	}
+	dbcontext.UpdateValidateFun(config.validateFn())
 
 	// Support for legacy importDocs handling - if xattrs aren't enabled, support a backfill-style import on startup
 	if importDocs && !config.UseXattrs() {
@@ -530,14 +652,12 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 
 	dbcontext.AllowEmptyPassword = config.AllowEmptyPassword
 
-	if dbcontext.ChannelMapper == nil {
+	if dbcontext.GetChannelMapper() == nil {
 		base.Logf("Using default sync function 'channel(doc.channels)' for database %q", dbName)
 	}
 
 	// Create default users & roles:
-	if err := sc.installPrincipals(dbcontext, config.Roles, "role"); err != nil {
-		return nil, err
-	} else if err := sc.installPrincipals(dbcontext, config.Users, "user"); err != nil {
+	if _, err := sc.installConfigPrincipals(dbcontext, config); err != nil {
 		return nil, err
 	}
 
@@ -564,7 +684,13 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 	// Save the config
 	sc.config.Databases[config.Name] = config
 
-	if config.StartOffline {
+	// A _resync that was interrupted, by a restart for instance, keeps the database offline until
+	// it's resumed or aborted:
+	pendingResync := dbcontext.HasPendingResync()
+	if pendingResync {
+		base.Warn("Database %q has an unfinished _resync; it stays offline until the _resync is resumed or aborted", dbName)
+	}
+	if config.StartOffline || pendingResync {
 		atomic.StoreUint32(&dbcontext.State, db.DBOffline)
 		if dbcontext.EventMgr.HasHandlerForEvent(db.DBStateChange) {
 			dbcontext.EventMgr.RaiseDBStateChangeEvent(dbName, "offline", "DB loaded from config", *sc.config.AdminInterface)
@@ -685,6 +811,181 @@ func (sc *ServerContext) processEventHandlersForEvent(events []*EventConfig, eve
 	return nil
 }
 
+// Returns the channel cache settings of a database's cache config.
+func channelCacheOptions(config *CacheConfig) (options db.ChannelCacheOptions) {
+	if config.ChannelCacheMaxLength != nil && *config.ChannelCacheMaxLength > 0 {
+		options.ChannelCacheMaxLength = *config.ChannelCacheMaxLength
+	}
+	if config.ChannelCacheMinLength != nil && *config.ChannelCacheMinLength > 0 {
+		options.ChannelCacheMinLength = *config.ChannelCacheMinLength
+	}
+	if config.ChannelCacheAge != nil && *config.ChannelCacheAge > 0 {
+		options.ChannelCacheAge = time.Duration(*config.ChannelCacheAge) * time.Second
+	}
+	return
+}
+
+// Applies a new config to a running database without taking it offline.  The sync and validate
+// functions, channel cache sizes, auth and request-limit settings, and configured users and roles
+// are updated in place; requests already in progress finish with the old settings.  Everything else
+// (like the bucket) takes effect the next time the database is brought online.  Returns true if
+// the sync function changed, in which case the database should be resynced, and how many of the
+// configured users and roles were created, updated or left unchanged.
+func (sc *ServerContext) ReloadDatabaseConfig(dbcontext *db.DatabaseContext, config *DbConfig) (syncFnChanged bool, principals db.PrincipalProvisionCounts, err error) {
+	if err = config.validate(); err != nil {
+		return false, principals, base.HTTPErrorf(http.StatusBadRequest, "%v", err)
+	}
+	syncFn := ""
+	if config.Sync != nil {
+		syncFn = *config.Sync
+	}
+	if syncFn != "" {
+		if _, err = channels.NewSyncRunner(syncFn); err != nil {
+			return false, principals, base.HTTPErrorf(http.StatusBadRequest, "Invalid sync function: %v", err)
+		}
+	}
+	if validateFn := config.validateFn(); validateFn != "" {
+		if _, err = channels.NewValidateRunner(validateFn, 0); err != nil {
+			return false, principals, base.HTTPErrorf(http.StatusBadRequest, "Invalid validate function: %v", err)
+		}
+	}
+	if config.Shadow != nil && config.Shadow.Doc_id_regex != nil {
+		if _, err = regexp.Compile(*config.Shadow.Doc_id_regex); err != nil {
+			return false, principals, base.HTTPErrorf(http.StatusBadRequest, "Invalid shadow doc_id_regex: %v", err)
+		}
+	}
+
+	base.Logf("Reloading config of database %q", dbcontext.Name)
+	if syncFnChanged, err = dbcontext.UpdateSyncFun(syncFn); err != nil {
+		return false, principals, err
+	} else if syncFnChanged {
+		base.Logf("**NOTE:** %q's sync function has changed. The new function may assign different channels to documents, or permissions to users. You may want to re-sync the database to update these.", dbcontext.Name)
+	}
+
+	if config.CacheConfig != nil {
+		dbcontext.UpdateChannelCacheOptions(channelCacheOptions(config.CacheConfig))
+	}
+	if cleanup := config.SessionCleanup.options(); cleanup != dbcontext.GetOptions().SessionCleanup {
+		dbcontext.SetSessionCleanup(cleanup)
+	}
+	guest := config.Users[base.GuestUsername]
+	if guest != nil {
+		dbcontext.SetGuestRateLimit(guest.RateLimit)
+	} else {
+		dbcontext.SetGuestRateLimit(nil)
+	}
+
+	// The rest of the options are replaced at once, so each request sees either the old or the new ones:
+	dbcontext.UpdateOptions(func(options *db.DatabaseContextOptions) {
+		options.ValidateFnTimeout = config.validateFnTimeout()
+		options.ChangesFilters = config.changesFilters()
+		options.MaxSessionTTL = 0
+		if config.MaxSessionTTLSecs != nil && *config.MaxSessionTTLSecs > 0 {
+			options.MaxSessionTTL = time.Duration(*config.MaxSessionTTLSecs) * time.Second
+		}
+		options.BcryptCost = 0
+		if config.BcryptCost != nil {
+			options.BcryptCost = *config.BcryptCost
+		} else if sc.config.BcryptCost != nil {
+			options.BcryptCost = *sc.config.BcryptCost
+		}
+		options.MaxChannelsPerDoc = config.MaxChannelsPerDoc
+		// Raising the cluster compatibility version once every node is upgraded upgrades docs as they're written:
+		options.ClusterCompatVersion = 0
+		if config.ClusterCompatVersion != nil {
+			options.ClusterCompatVersion = *config.ClusterCompatVersion
+		}
+		options.OutOfLineBodyThreshold = 0
+		if config.OutOfLineBodyThreshold != nil {
+			options.OutOfLineBodyThreshold = *config.OutOfLineBodyThreshold
+		}
+		options.InlineBodies = config.InlineBodies
+		options.VerifyRevIDs = config.VerifyRevIDs
+		options.DisableGuest = config.DisableGuest
+		options.RejectDeletionAttachments = config.DeletionAttachments != nil && *config.DeletionAttachments == "reject"
+		options.MaxChangesRows, options.MaxChangesDuration = 0, 0
+		if config.MaxChangesRows != nil {
+			options.MaxChangesRows = *config.MaxChangesRows
+		}
+		if config.MaxChangesSecs != nil {
+			options.MaxChangesDuration = time.Duration(*config.MaxChangesSecs) * time.Second
+		}
+		options.PasswordPolicy = config.PasswordPolicy.options()
+		options.MaxDocIDLength = 0
+		if config.MaxDocIDLength != nil {
+			options.MaxDocIDLength = *config.MaxDocIDLength
+		}
+		options.MaxAttachmentNameLength = 0
+		if config.MaxAttNameLength != nil {
+			options.MaxAttachmentNameLength = *config.MaxAttNameLength
+		}
+		options.BodyDeltaMaxBytes, options.BodyDeltaMaxRatio = 0, 0
+		if config.DeltaMaxBodyBytes != nil {
+			options.BodyDeltaMaxBytes = *config.DeltaMaxBodyBytes
+		}
+		if config.DeltaMaxRatio != nil {
+			options.BodyDeltaMaxRatio = *config.DeltaMaxRatio
+		}
+		options.MaxOperationIDs, options.OperationIDTTL = 0, 0
+		if config.MaxOperationIDs != nil {
+			options.MaxOperationIDs = *config.MaxOperationIDs
+		}
+		if config.OperationIDTTLSecs != nil {
+			options.OperationIDTTL = time.Duration(*config.OperationIDTTLSecs) * time.Second
+		}
+		options.ChannelHistoryRetention = 0
+		if config.ChannelHistoryRetention != nil {
+			options.ChannelHistoryRetention = *config.ChannelHistoryRetention
+		}
+		options.MaxBulkDocs, options.MaxBulkDocsBytes, options.MaxAllDocsKeys, options.MaxBulkPrincipals = 0, 0, 0, 0
+		options.MaxLocalDocBytes, options.ChangesBuffer = 0, 0
+		if config.MaxBulkDocs != nil {
+			options.MaxBulkDocs = *config.MaxBulkDocs
+		}
+		if config.MaxBulkDocsBytes != nil {
+			options.MaxBulkDocsBytes = *config.MaxBulkDocsBytes
+		}
+		if config.MaxAllDocsKeys != nil {
+			options.MaxAllDocsKeys = *config.MaxAllDocsKeys
+		}
+		if config.MaxBulkPrincipals != nil {
+			options.MaxBulkPrincipals = *config.MaxBulkPrincipals
+		}
+		if config.MaxLocalDocBytes != nil {
+			options.MaxLocalDocBytes = *config.MaxLocalDocBytes
+		}
+		if config.ChangesBuffer != nil {
+			options.ChangesBuffer = *config.ChangesBuffer
+		}
+		options.LogKeys, options.LogLevel = config.LogKeys, 0
+		if config.LogLevel != nil {
+			options.LogLevel = *config.LogLevel
+		}
+		options.GuestMaxChannels = 0
+		if guest != nil && guest.MaxChannels != nil {
+			options.GuestMaxChannels = *guest.MaxChannels
+		}
+	})
+
+	// The validate function doesn't affect channels or access, so changing it doesn't call for a resync:
+	dbcontext.UpdateValidateFun(config.validateFn())
+	options := dbcontext.GetOptions()
+	dbcontext.LogKeys.Configure(options.LogKeys, options.LogLevel)
+	if config.RevsLimit != nil && *config.RevsLimit > 0 {
+		dbcontext.RevsLimit = *config.RevsLimit
+	}
+	dbcontext.AllowEmptyPassword = config.AllowEmptyPassword
+
+	if principals, err = sc.installConfigPrincipals(dbcontext, config); err != nil {
+		return
+	}
+
+	sc.lock.Lock()
+	sc.config.Databases[dbcontext.Name] = config
+	sc.lock.Unlock()
+	return
+}
+
 func (sc *ServerContext) applySyncFunction(dbcontext *db.DatabaseContext, syncFn string) error {
 	changed, err := dbcontext.UpdateSyncFun(syncFn)
 	if err != nil || !changed {
@@ -766,28 +1067,56 @@ func (sc *ServerContext) _removeDatabase(dbName string) bool {
 	return true
 }
 
-func (sc *ServerContext) installPrincipals(context *db.DatabaseContext, spec map[string]*db.PrincipalConfig, what string) error {
+// Creates the users or roles in a DbConfig, and updates the existing ones that differ from their
+// config.  Principals that already match their config aren't written.
+func (sc *ServerContext) installPrincipals(context *db.DatabaseContext, spec map[string]*db.PrincipalConfig, what string) (counts db.PrincipalProvisionCounts, err error) {
 	for name, princ := range spec {
 		isGuest := name == base.GuestUsername
-		if isGuest {
+		if isGuest && context.GetOptions().DisableGuest {
+			base.Warn("    Not creating the %s user, since disable_guest is set", base.GuestUsername)
+			continue
+		} else if isGuest {
 			internalName := ""
 			princ.Name = &internalName
 		} else {
 			princ.Name = &name
 		}
-		_, err := context.UpdatePrincipal(*princ, (what == "user"), isGuest)
+		created, changed, err := context.ProvisionPrincipal(*princ, (what == "user"))
 		if err != nil {
-			// A conflict error just means updatePrincipal didn't overwrite an existing user.
-			if status, _ := base.ErrorAsHTTPStatus(err); status != http.StatusConflict {
-				return fmt.Errorf("Couldn't create %s %q: %v", what, name, err)
-			}
+			return counts, fmt.Errorf("Couldn't create %s %q: %v", what, name, err)
+		} else if created {
+			counts.Created++
+			base.Logf("    Created %s %q", what, name)
+		} else if !changed {
+			counts.Unchanged++
 		} else if isGuest {
+			counts.Updated++
 			base.Log("    Reset guest user to config")
 		} else {
-			base.Logf("    Created %s %q", what, name)
+			counts.Updated++
+			base.Logf("    Updated %s %q to match config", what, name)
 		}
 	}
-	return nil
+	return counts, nil
+}
+
+// Installs a DbConfig's roles and then its users, and logs how many of them were written.
+func (sc *ServerContext) installConfigPrincipals(context *db.DatabaseContext, config *DbConfig) (counts db.PrincipalProvisionCounts, err error) {
+	roleCounts, err := sc.installPrincipals(context, config.Roles, "role")
+	if err != nil {
+		return counts, err
+	}
+	userCounts, err := sc.installPrincipals(context, config.Users, "user")
+	if err != nil {
+		return counts, err
+	}
+	counts.Add(roleCounts)
+	counts.Add(userCounts)
+	if len(config.Roles)+len(config.Users) > 0 {
+		base.Logf("Database %q: configured users and roles: %d created, %d updated, %d unchanged",
+			context.Name, counts.Created, counts.Updated, counts.Unchanged)
+	}
+	return counts, nil
 }
 
 // Fetch a configuration for a database from the ConfigServer
@@ -937,7 +1266,7 @@ func collectAccessRelatedWarnings(config *DbConfig, context *db.DatabaseContext)
 		viewOptions := db.Body{
 			"limit": 1,
 		}
-		vres, err := currentDb.Bucket.View(db.DesignDocSyncHousekeeping, db.ViewPrincipals, viewOptions)
+		vres, err := currentDb.Bucket.View(currentDb.DesignDocName(db.DesignDocSyncHousekeeping, db.ViewPrincipals), db.ViewPrincipals, viewOptions)
 		if err != nil {
 			base.Warn("Error trying to query ViewPrincipals: %v", err)
 			return []string{}
@@ -251,7 +251,7 @@ func TestCollectAccessWarningsUsersInDb(t *testing.T) {
 	}
 
 	// add a user to the db
-	err = sc.installPrincipals(dbContext, spec, "user")
+	_, err = sc.installPrincipals(dbContext, spec, "user")
 	assertNoError(t, err, "Error installing principal")
 
 	var warnings []string
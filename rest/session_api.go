@@ -11,6 +11,7 @@ package rest
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/couchbase/sync_gateway/auth"
@@ -24,7 +25,14 @@ const kDefaultSessionTTL = 24 * time.Hour
 // Respond with a JSON struct containing info about the current login session
 func (h *handler) respondWithSessionInfo() error {
 
-	response := h.formatSessionResponse(h.user)
+	session, err := h.db.Authenticator().GetSessionForCookie(h.rq)
+	if err != nil {
+		return err
+	}
+	if session != nil && (h.user == nil || session.Username != h.user.Name()) {
+		session = nil // The request wasn't authenticated by the session cookie
+	}
+	response := h.formatSessionResponse(h.user, session)
 
 	h.writeJSON(response)
 	return nil
@@ -41,49 +49,76 @@ func (h *handler) handleSessionPOST() error {
 	originHeader := h.rq.Header["Origin"]
 	if len(originHeader) > 0 {
 		matched := ""
-		if h.server.config.CORS != nil {
-			matched = matchedOrigin(h.server.config.CORS.LoginOrigin, originHeader)
+		if cors := h.server.corsConfigFor(h.PathVar("db")); cors != nil {
+			matched = matchedOrigin(cors.LoginOrigin, originHeader)
 		}
 		if matched == "" {
 			return base.HTTPErrorf(http.StatusBadRequest, "No CORS")
 		}
 	}
 
-	user, err := h.getUserFromSessionRequestBody()
+	user, requestedTTL, err := h.getUserFromSessionRequestBody()
+	ttl, ttlErr := h.publicSessionTTL(requestedTTL)
+	if ttlErr != nil {
+		return ttlErr
+	}
 
 	// If we fail to get a user from the body and we've got a non-GUEST authenticated user, create the session based on that user
 	if user == nil && h.user != nil && h.user.Name() != "" {
-		return h.makeSession(h.user)
+		return h.makeSessionAndRespond(h.user, ttl)
 	} else {
 		if err != nil {
 			return err
 		}
-		return h.makeSession(user)
+		return h.makeSessionAndRespond(user, ttl)
 	}
 
 }
 
-func (h *handler) getUserFromSessionRequestBody() (auth.User, error) {
+// Returns the user whose credentials are in the request body, and the session TTL it requested
+// (in seconds), if any.
+func (h *handler) getUserFromSessionRequestBody() (auth.User, *int, error) {
 
 	var params struct {
 		Name     string `json:"name"`
 		Password string `json:"password"`
+		TTL      *int   `json:"ttl"`
 	}
 	err := h.readJSONInto(&params)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var user auth.User
 	user, err = h.db.Authenticator().GetUser(params.Name)
+	if user == nil && err == nil && strings.Contains(params.Name, "@") {
+		// Not the name of a user, so it may be one's email address:
+		user, err = h.db.Authenticator().GetUserByEmail(params.Name)
+	}
 	if err != nil {
-		return nil, err
+		return nil, params.TTL, err
 	}
 
 	if user != nil && !user.Authenticate(params.Password) {
 		user = nil
 	}
-	return user, err
+	return user, params.TTL, err
+}
+
+// Returns the TTL of a session created through the public API: the requested TTL (in seconds) or
+// the default, clamped to the database's max session TTL.
+func (h *handler) publicSessionTTL(requestedTTL *int) (time.Duration, error) {
+	ttl := kDefaultSessionTTL
+	if requestedTTL != nil {
+		if *requestedTTL <= 0 {
+			return 0, base.HTTPErrorf(http.StatusBadRequest, "Invalid ttl")
+		}
+		ttl = time.Duration(*requestedTTL) * time.Second
+	}
+	if maxTTL := h.db.MaxSessionTTL(); ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl, nil
 }
 
 // DELETE /_session logs out the current session
@@ -92,8 +127,8 @@ func (h *handler) handleSessionDELETE() error {
 	originHeader := h.rq.Header["Origin"]
 	if len(originHeader) > 0 {
 		matched := ""
-		if h.server.config.CORS != nil {
-			matched = matchedOrigin(h.server.config.CORS.LoginOrigin, originHeader)
+		if cors := h.server.corsConfigFor(h.PathVar("db")); cors != nil {
+			matched = matchedOrigin(cors.LoginOrigin, originHeader)
 		}
 		if matched == "" {
 			return base.HTTPErrorf(http.StatusBadRequest, "No CORS")
@@ -108,30 +143,95 @@ func (h *handler) handleSessionDELETE() error {
 	return nil
 }
 
+// PUT /_user/_password changes the password of the user making the request, given the old one.
+// Only a user who logged in with a password can use it.  Changing the password ends the user's
+// other sessions, so the response has a new session cookie for this client.
+func (h *handler) handleChangePassword() error {
+	if h.user == nil || h.user.Name() == "" {
+		return base.HTTPErrorf(http.StatusForbidden, "The guest user has no password")
+	}
+	authenticator := h.db.Authenticator()
+	session, _ := authenticator.GetSessionForCookie(h.rq)
+	if session != nil && session.Username != h.user.Name() {
+		session = nil // The request wasn't authenticated by the session cookie
+	}
+	if basicName, _ := h.getBasicAuth(); basicName != h.user.Name() && session == nil {
+		return base.HTTPErrorf(http.StatusForbidden, "Only a user logged in with a password can change it")
+	}
+	if h.user.HasPassword("") {
+		return base.HTTPErrorf(http.StatusForbidden, "User has no password; it's authenticated externally")
+	}
+
+	var params struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+
+	// Wrong old passwords are charged to the guest rate limit, like the unauthenticated POSTs to
+	// _session that guess passwords; once it's used up, no more guesses are checked.
+	limiter := h.db.GuestRateLimiter
+	if limiter != nil {
+		if ok, retryAfter := limiter.Check(h.clientAddress()); !ok {
+			return h.guestRateLimited(retryAfter)
+		}
+	}
+	user := authenticator.AuthenticateUser(h.user.Name(), params.OldPassword)
+	if user == nil {
+		if limiter != nil {
+			limiter.Allow(h.clientAddress())
+		}
+		return base.HTTPErrorf(http.StatusForbidden, "Incorrect old_password")
+	}
+	if err := h.db.GetOptions().PasswordPolicy.Check(params.NewPassword); err != nil {
+		return err
+	}
+	user.SetPassword(params.NewPassword)
+	if err := authenticator.Save(user); err != nil {
+		return err
+	}
+	base.LogTo("Auth", "User %q changed their password", user.Name())
+
+	// The old session is now invalid, so replace it:
+	if session != nil {
+		authenticator.DeleteSession(session.ID)
+	}
+	ttl, _ := h.publicSessionTTL(nil)
+	return h.makeSessionAndRespond(user, ttl)
+}
+
 func (h *handler) makeSession(user auth.User) error {
+	ttl, _ := h.publicSessionTTL(nil)
+	return h.makeSessionAndRespond(user, ttl)
+}
 
-	_, err := h.makeSessionWithTTL(user, kDefaultSessionTTL)
+// Creates a session with TTL and responds with the session info, including its expiry.
+func (h *handler) makeSessionAndRespond(user auth.User, ttl time.Duration) error {
+	session, err := h.makeSessionWithTTL(user, ttl)
 	if err != nil {
 		return err
 	}
-	return h.respondWithSessionInfo()
+	h.writeJSON(h.formatSessionResponse(h.user, session))
+	return nil
 }
 
 // Creates a session with TTL and adds to the response.  Does NOT return the session info response.
-func (h *handler) makeSessionWithTTL(user auth.User, expiry time.Duration) (sessionID string, err error) {
+func (h *handler) makeSessionWithTTL(user auth.User, expiry time.Duration) (*auth.LoginSession, error) {
 	if user == nil {
-		return "", base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
+		return nil, base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
 	}
 	h.user = user
 	auth := h.db.Authenticator()
-	session, err := auth.CreateSession(user.Name(), expiry)
+	session, err := auth.CreateSession(user, expiry)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	cookie := auth.MakeSessionCookie(session)
 	base.AddDbPathToCookie(h.rq, cookie)
 	http.SetCookie(h.response, cookie)
-	return session.ID, nil
+	return session, nil
 }
 
 func (h *handler) makeSessionFromEmail(email string, createUserIfNeeded bool) error {
@@ -221,7 +321,9 @@ func (h *handler) createUserSession() error {
 		return err
 	} else if params.Name == "" || params.Name == base.GuestUsername || !auth.IsValidPrincipalName(params.Name) {
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid or missing user name")
-	} else if user, err := h.db.Authenticator().GetUser(params.Name); user == nil {
+	}
+	user, err := h.db.Authenticator().GetUser(params.Name)
+	if user == nil {
 		if err == nil {
 			err = base.HTTPErrorf(http.StatusNotFound, "No such user %q", params.Name)
 		}
@@ -233,7 +335,7 @@ func (h *handler) createUserSession() error {
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid or missing ttl")
 	}
 
-	session, err := h.db.Authenticator().CreateSession(params.Name, ttl)
+	session, err := h.db.Authenticator().CreateSession(user, ttl)
 	if err != nil {
 		return err
 	}
@@ -276,12 +378,30 @@ func (h *handler) deleteUserSession() error {
 	}
 }
 
-// ADMIN API: Deletes all sessions for a user
+// ADMIN API: Lists a user's active sessions
+func (h *handler) getUserSessions() error {
+	h.assertAdminOnly()
+	user, err := h.db.Authenticator().GetUser(h.PathVar("name"))
+	if user == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	sessions, err := h.db.Authenticator().GetUserSessions(user)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"sessions": sessions})
+	return nil
+}
+
+// ADMIN API: Revokes all sessions for a user
 func (h *handler) deleteUserSessions() error {
 	h.assertAdminOnly()
 
 	userName := h.PathVar("name")
-	return h.db.DeleteUserSessions(userName)
+	return h.db.RevokeUserSessions(userName)
 }
 
 // Delete a session if associated with the user provided
@@ -320,15 +440,16 @@ func (h *handler) respondWithSessionInfoForSession(session *auth.LoginSession) e
 		return err
 	}
 
-	response := h.formatSessionResponse(user)
+	response := h.formatSessionResponse(user, session)
 	if response != nil {
 		h.writeJSON(response)
 	}
 	return nil
 }
 
-// Formats session response similar to what is returned by CouchDB
-func (h *handler) formatSessionResponse(user auth.User) db.Body {
+// Formats session response similar to what is returned by CouchDB.  If session is non-nil, its
+// expiry is included.
+func (h *handler) formatSessionResponse(user auth.User, session *auth.LoginSession) db.Body {
 
 	var name *string
 	allChannels := channels.TimedSet{}
@@ -345,6 +466,9 @@ func (h *handler) formatSessionResponse(user auth.User) db.Body {
 	userCtx := db.Body{"name": name, "channels": allChannels}
 	handlers := []string{"default", "cookie"}
 	response := db.Body{"ok": true, "userCtx": userCtx, "authentication_handlers": handlers}
+	if session != nil {
+		response["expires"] = session.Expiration.UTC().Format(time.RFC3339)
+	}
 	return response
 
 }
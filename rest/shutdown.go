@@ -0,0 +1,125 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Default max time to wait for requests in progress when shutting down
+const DefaultShutdownDrainTimeout = 30 * time.Second
+
+// States of a ServerContext, as reported by /_status
+const (
+	serverRunning = uint32(iota)
+	serverDraining
+	serverStopped
+)
+
+var serverStateNames = []string{"online", "draining", "stopped"}
+
+// Shuts down the server gracefully:
+//   - /_status starts reporting "draining", so load balancers stop sending requests here; after
+//     `delay`, the HTTP listeners are closed.
+//   - Every database starts stopping, which ends its _changes feeds (after a final heartbeat)
+//     and makes any new requests on open connections fail with a 503.
+//   - Waits up to `drainTimeout` for requests in progress, like document writes, to finish.
+//   - Releases the sequences reserved but not used, so other nodes' caches don't wait for them.
+//   - Closes the databases, which stops their feeds and closes their buckets.
+//
+// Only the first call does anything; later ones return once it's done.
+func (sc *ServerContext) Shutdown(delay, drainTimeout time.Duration) {
+	if !atomic.CompareAndSwapUint32(&sc.state, serverRunning, serverDraining) {
+		sc.WaitForShutdown()
+		return
+	}
+	if delay > 0 {
+		base.Logf("Shutdown: draining; waiting %v before closing listeners", delay)
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	serversDone := make(chan error, 1)
+	go func() {
+		serversDone <- base.ShutdownHTTPServers(ctx)
+	}()
+	databases := sc.AllDatabases()
+	for _, dbc := range databases {
+		dbc.BeginShutdown()
+	}
+	err := <-serversDone
+	for _, dbc := range databases {
+		if err == nil {
+			err = waitForDatabaseRequests(ctx, dbc)
+		}
+	}
+	if err != nil {
+		base.Warn("Shutdown: requests still in progress after %v; closing anyway", drainTimeout)
+	}
+
+	for _, dbc := range databases {
+		dbc.ReleaseUnusedSequences()
+	}
+	sc.Close()
+	atomic.StoreUint32(&sc.state, serverStopped)
+	close(sc.stopped)
+	base.Logf("Shutdown: complete")
+}
+
+// Waits until a stopping database's requests in progress have finished, or the context expires.
+// (ShutdownHTTPServers doesn't wait for hijacked connections like WebSockets.)
+func waitForDatabaseRequests(ctx context.Context, dbc *db.DatabaseContext) error {
+	done := make(chan struct{})
+	go func() {
+		// Handlers hold the read lock while they run:
+		dbc.AccessLock.Lock()
+		dbc.AccessLock.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Blocks until Shutdown has finished.
+func (sc *ServerContext) WaitForShutdown() {
+	<-sc.stopped
+}
+
+// HTTP handler for /_status, for load balancers and health checks.  Responds with a 503 once
+// the server has started shutting down.  On the admin port it also reports the state of each
+// database's design docs.
+func (h *handler) handleStatus() error {
+	state := atomic.LoadUint32(&h.server.state)
+	status := http.StatusOK
+	if state != serverRunning {
+		status = http.StatusServiceUnavailable
+	}
+	response := map[string]interface{}{"status": serverStateNames[state]}
+	if h.privs == adminPrivs {
+		designDocs := map[string]db.DesignDocStatus{}
+		for name, database := range h.server.AllDatabases() {
+			designDocs[name] = database.DesignDocStatus()
+		}
+		response["design_docs"] = designDocs
+	}
+	h.writeJSONStatus(status, response)
+	return nil
+}
@@ -0,0 +1,60 @@
+//  Copyright (c) 2017 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	var rt RestTester
+	defer rt.Close()
+
+	var status map[string]interface{}
+	response := rt.SendRequest("GET", "/_status", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &status)
+	assert.Equals(t, status["status"], "online")
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"value":1}`), 201)
+	assertNoError(t, rt.GetDatabase().ReserveSequences(5), "ReserveSequences failed")
+
+	feedDone := make(chan *TestResponse, 1)
+	go func() {
+		feedDone <- rt.SendAdminRequest("GET", "/db/_changes?feed=continuous&since=0&timeout=30000", "")
+	}()
+	time.Sleep(100 * time.Millisecond) // let the feed start
+
+	rt.ServerContext().Shutdown(0, 5*time.Second)
+
+	// The feed should have ended, after sending its changes and a final heartbeat:
+	select {
+	case response = <-feedDone:
+		assertStatus(t, response, 200)
+		changes, err := readContinuousChanges(response)
+		assertNoError(t, err, "Error reading changes")
+		assert.Equals(t, len(changes), 1)
+		assert.Equals(t, changes[0].ID, "doc1")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Continuous _changes feed didn't end on shutdown")
+	}
+
+	response = rt.SendRequest("GET", "/_status", "")
+	assertStatus(t, response, 503)
+	json.Unmarshal(response.Body.Bytes(), &status)
+	assert.Equals(t, status["status"], "stopped")
+
+	// Shutting down again is a no-op:
+	rt.ServerContext().Shutdown(0, time.Second)
+}
@@ -21,9 +21,9 @@ func (h *handler) handleGetDesignDoc() error {
 		// we serve this content here so that CouchDB 1.2 has something to
 		// hash into the replication-id, to correspond to our filter.
 		filter := "ok"
-		if h.db.DatabaseContext.ChannelMapper != nil {
+		if mapper := h.db.GetChannelMapper(); mapper != nil {
 			hash := sha1.New()
-			io.WriteString(hash, h.db.DatabaseContext.ChannelMapper.Function())
+			io.WriteString(hash, mapper.Function())
 			filter = fmt.Sprint(hash.Sum(nil))
 		}
 		result = db.Body{"filters": db.Body{"bychannel": filter}}
@@ -59,6 +59,7 @@ func (h *handler) handleDeleteDesignDoc() error {
 
 // HTTP handler for GET _design/$ddoc/_view/$view
 func (h *handler) handleView() error {
+	h.setRequestClass(bulkRequest)
 	// Couchbase Server view API:
 	// http://docs.couchbase.com/admin/admin/REST/rest-views-get.html
 	ddocName := h.PathVar("ddoc")
@@ -100,7 +101,7 @@ func (h *handler) handleView() error {
 		}
 	}
 
-	base.LogTo("HTTP", "JSON view %q/%q - opts %v", ddocName, viewName, opts)
+	h.logContext.LogTo("HTTP", "JSON view %q/%q - opts %v", ddocName, viewName, opts)
 
 	result, err := h.db.QueryDesignDoc(ddocName, viewName, opts)
 	if err != nil {
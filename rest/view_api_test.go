@@ -18,6 +18,7 @@ import (
 
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbase/sync_gateway/db"
 
 	"github.com/couchbaselabs/go.assert"
 )
@@ -339,6 +340,28 @@ func TestAdminReduceSumQuery(t *testing.T) {
 	assert.Equals(t, value, 108.0)
 }
 
+// Without user views, the map functions of design docs emit their own values, so reduce functions
+// like _sum work on them.
+func TestAdminReduceSumQueryWithoutUserViews(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc) {channel(doc.channel)}`}
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_design/foo", `{"views":{"bar": {"map": "function(doc) {if (doc.key && doc.value) emit(doc.key, doc.value);}", "reduce": "_sum"}}}`)
+	assertStatus(t, response, 201)
+	for i := 0; i < 3; i++ {
+		response = rt.SendAdminRequest("PUT", fmt.Sprintf("/db/doc%v", i), `{"key":"A", "value":2}`)
+		assertStatus(t, response, 201)
+	}
+
+	// A query without a reduce parameter reduces:
+	var result sgbucket.ViewResult
+	response = rt.SendAdminRequest("GET", "/db/_design/foo/_view/bar?stale=false", ``)
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.Equals(t, len(result.Rows), 1)
+	assert.Equals(t, result.Rows[0].Value, 6.0)
+}
+
 func TestAdminGroupReduceSumQuery(t *testing.T) {
 
 	rt := RestTester{SyncFn: `function(doc) {channel(doc.channel)}`}
@@ -406,3 +429,73 @@ func TestAdminGroupLevelReduceSumQuery(t *testing.T) {
 	value := row.Value.(float64)
 	assert.Equals(t, value, 99.0)
 }
+
+func TestChannelSafeViewQuery(t *testing.T) {
+	rt := RestTester{SyncFn: `function(doc) {channel(doc.channel)}`}
+	defer rt.Close()
+	rt.ServerContext().Database("db").SetUserViewsEnabled(true)
+
+	response := rt.SendAdminRequest("PUT", "/db/_design/foo", `{"views":{"bar": {"map": "function(doc) {if (doc._sync === undefined) emit(doc.key, doc.value);}", "reduce": "_count"}}}`)
+	assertStatus(t, response, 201)
+	response = rt.SendAdminRequest("PUT", "/db/_design/raw", `{"options":{"raw":true},"views":{"bar": {"map": "function(doc) {if (doc.channel) emit(doc.key, doc.value);}"}}}`)
+	assertStatus(t, response, 201)
+	for i, channel := range []string{"A", "B", "A", "B"} {
+		response = rt.SendAdminRequest("PUT", fmt.Sprintf("/db/doc%d", i), fmt.Sprintf(`{"key":%d, "value":"v%d", "channel":%q}`, i, i, channel))
+		assertStatus(t, response, 201)
+	}
+	a := rt.ServerContext().Database("db").Authenticator()
+	alice, _ := a.NewUser("alice", "letmein", channels.SetOf("A"))
+	a.Save(alice)
+
+	query := func(path string) (response *TestResponse, result sgbucket.ViewResult) {
+		request, _ := http.NewRequest("GET", path, nil)
+		request.SetBasicAuth("alice", "letmein")
+		response = rt.Send(request)
+		json.Unmarshal(response.Body.Bytes(), &result)
+		return
+	}
+
+	// The user only gets the rows of docs in the user's channels, with the map function's values:
+	response, result := query("/db/_design/foo/_view/bar?stale=false")
+	assertStatus(t, response, 200)
+	assert.Equals(t, len(result.Rows), 2)
+	assert.DeepEquals(t, result.Rows[0], &sgbucket.ViewRow{ID: "doc0", Key: 0.0, Value: "v0"})
+	assert.DeepEquals(t, result.Rows[1], &sgbucket.ViewRow{ID: "doc2", Key: 2.0, Value: "v2"})
+
+	// Query parameters pass through to the view:
+	response, result = query("/db/_design/foo/_view/bar?stale=false&descending=true&startkey=3&endkey=1")
+	assertStatus(t, response, 200)
+	assert.Equals(t, len(result.Rows), 1)
+	assert.Equals(t, result.Rows[0].ID, "doc2")
+
+	// but reduce queries can't be filtered:
+	response, _ = query("/db/_design/foo/_view/bar?reduce=true")
+	assertStatus(t, response, 403)
+
+	// The admin gets every row:
+	response = rt.SendAdminRequest("GET", "/db/_design/foo/_view/bar?stale=false&reduce=false", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.Equals(t, len(result.Rows), 4)
+	assert.Equals(t, result.Rows[3].Value, "v3")
+
+	// and the reduced row of a query that doesn't set reduce:
+	response = rt.SendAdminRequest("GET", "/db/_design/foo/_view/bar?stale=false", "")
+	assertStatus(t, response, 200)
+	result = sgbucket.ViewResult{}
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.Equals(t, len(result.Rows), 1)
+	assert.Equals(t, result.Rows[0].Value, 4.0)
+
+	// Raw design docs don't record channels, so only admins can query them:
+	response, _ = query("/db/_design/raw/_view/bar?stale=false")
+	assertStatus(t, response, 404)
+	response = rt.SendAdminRequest("GET", "/db/_design/raw/_view/bar?stale=false", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.Equals(t, len(result.Rows), 4)
+
+	// The namespace of the channel-safe design docs can't be written to directly:
+	response = rt.SendAdminRequest("PUT", "/db/_design/"+db.UserDesignDocPrefix+"raw", `{"options":{"raw":true}}`)
+	assertStatus(t, response, 403)
+}